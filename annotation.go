@@ -0,0 +1,180 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrInvalidAnnotationKey 描述了快照标注键为空或者包含空白字符的错误。
+var ErrInvalidAnnotationKey = errors.New("invalid annotation key")
+
+// IndexAnnotations 描述了快照索引创建后补充的备注和标注。
+//
+// 标注保存在仓库 annotations 文件夹下的独立对象中，不会修改索引对象，所以索引 ID 和哈希保持不变。
+type IndexAnnotations struct {
+	ID          string            `json:"id"`                    // 索引 ID
+	Memo        string            `json:"memo,omitempty"`        // 修改后的备注，为空时使用索引创建时的备注
+	Annotations map[string]string `json:"annotations,omitempty"` // 任意键值对标注，比如 "restore": "verified"
+	Updated     int64             `json:"updated"`               // 最近修改时间
+}
+
+// SetIndexMemo 用于修改索引 id 的备注，memo 为空或者和创建时的备注相同时恢复为创建时的备注。
+func (repo *Repo) SetIndexMemo(id, memo string) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	index, err := repo.store.GetIndex(id)
+	if nil != err {
+		return
+	}
+
+	annotations, err := repo.getAnnotations(id)
+	if nil != err {
+		return
+	}
+	if memo == index.Memo {
+		memo = ""
+	}
+	annotations.Memo = memo
+	err = repo.putAnnotations(annotations)
+	return
+}
+
+// SetAnnotation 用于设置索引 id 的标注 key 为 value，value 为空时删除该标注。
+func (repo *Repo) SetAnnotation(id, key, value string) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	if "" == key || strings.ContainsAny(key, " \t\r\n") {
+		err = ErrInvalidAnnotationKey
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, err = repo.store.GetIndex(id); nil != err {
+		return
+	}
+
+	annotations, err := repo.getAnnotations(id)
+	if nil != err {
+		return
+	}
+	if "" == value {
+		delete(annotations.Annotations, key)
+	} else {
+		annotations.Annotations[key] = value
+	}
+	err = repo.putAnnotations(annotations)
+	return
+}
+
+// GetAnnotations 用于获取索引 id 的备注和标注，没有标注时返回空的标注。
+func (repo *Repo) GetAnnotations(id string) (ret *IndexAnnotations, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	ret, err = repo.getAnnotations(id)
+	return
+}
+
+// indexMemo 用于获取索引 index 的备注，备注被修改过时返回修改后的备注。
+func (repo *Repo) indexMemo(index *entity.Index) string {
+	annotations, err := repo.getAnnotations(index.ID)
+	if nil != err || "" == annotations.Memo {
+		return index.Memo
+	}
+	return annotations.Memo
+}
+
+// purgeAnnotations 用于删除索引已经被清理的标注。
+func (repo *Repo) purgeAnnotations() {
+	dir := filepath.Join(repo.Path, "annotations")
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if _, statErr := os.Stat(filepath.Join(repo.Path, "indexes", id)); !os.IsNotExist(statErr) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, entry.Name())); nil != err {
+			logging.LogWarnf("remove annotations [%s] failed: %s", id, err)
+		}
+	}
+}
+
+func (repo *Repo) getAnnotations(id string) (ret *IndexAnnotations, err error) {
+	ret = &IndexAnnotations{ID: id, Annotations: map[string]string{}}
+	file := filepath.Join(repo.Path, "annotations", id+".json")
+	if !filelock.IsExist(file) {
+		return
+	}
+
+	data, err := filelock.ReadFile(file)
+	if nil != err {
+		return
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		logging.LogErrorf("unmarshal annotations [%s] failed: %s", id, err)
+		return
+	}
+	if nil == ret.Annotations {
+		ret.Annotations = map[string]string{}
+	}
+	return
+}
+
+func (repo *Repo) putAnnotations(annotations *IndexAnnotations) (err error) {
+	dir := filepath.Join(repo.Path, "annotations")
+	file := filepath.Join(dir, annotations.ID+".json")
+	if "" == annotations.Memo && 1 > len(annotations.Annotations) {
+		if err = os.Remove(file); nil != err && os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+	annotations.Updated = time.Now().UnixMilli()
+	data, err := gulu.JSON.MarshalJSON(annotations)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(file, data, 0644)
+	return
+}
@@ -0,0 +1,309 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+const archiveManifestName = "manifest.json" // 归档元数据在归档中的文件名，总是第一个文件
+
+var (
+	// ErrInvalidArchive 描述了归档格式不正确。
+	ErrInvalidArchive = errors.New("invalid archive")
+	// ErrArchiveBaseMissing 描述了导入增量归档时本地仓库中不存在其基准索引，需要先按顺序导入之前的归档。
+	ErrArchiveBaseMissing = errors.New("archive base index missing")
+)
+
+// ArchiveManifest 描述了归档的元数据。
+//
+// 完整归档包含所有本地索引以及它们引用的数据对象；增量归档只包含基准索引之后创建的索引，以及基准索引和更早的索引都没有引用的数据对象。
+// 以上一个归档的 Head 作为下一个增量归档的 Base 即可形成归档链，按顺序导入归档链即可重建仓库。
+type ArchiveManifest struct {
+	Base    string   `json:"base"`    // 增量归档的基准索引 ID，为空表示完整归档
+	Head    string   `json:"head"`    // 归档中最新的索引 ID，为空表示基准索引之后没有新的索引
+	Indexes []string `json:"indexes"` // 归档中的索引 ID，按创建时间正序
+	Objects int      `json:"objects"` // 归档中的数据对象数
+	Created int64    `json:"created"` // 归档创建时间，毫秒时间戳
+}
+
+// ExportArchive 用于将仓库导出为 tar 归档写入 w，baseIndexID 为空时导出完整归档，否则导出该索引之后的增量归档，只读仓库也可以调用。
+//
+// 数据对象按照仓库中的原始内容（已压缩加密）导出，所以归档只能导入到使用相同密钥的仓库中。
+func (repo *Repo) ExportArchive(w io.Writer, baseIndexID string) (ret *ArchiveManifest, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	entries, err := repo.store.readIndexLog()
+	if nil != err {
+		return
+	}
+
+	// 索引日志按创建时间倒序排列，基准索引之前的记录为新的索引
+	newEntries, oldEntries := entries, []*indexLogEntry{}
+	if "" != baseIndexID {
+		found := false
+		for i, entry := range entries {
+			if baseIndexID == entry.ID {
+				newEntries, oldEntries = entries[:i], entries[i:]
+				found = true
+				break
+			}
+		}
+		if !found {
+			err = ErrNotFoundIndex
+			return
+		}
+	}
+
+	exported := map[string]bool{}
+	for _, entry := range oldEntries {
+		if _, err = repo.collectArchiveObjects(entry.ID, exported, nil); nil != err {
+			return
+		}
+	}
+
+	ret = &ArchiveManifest{Base: baseIndexID, Indexes: []string{}, Created: time.Now().UnixMilli()}
+	var indexes []*entity.Index
+	var objectIDs []string
+	for i := len(newEntries) - 1; 0 <= i; i-- {
+		var index *entity.Index
+		if index, err = repo.collectArchiveObjects(newEntries[i].ID, exported, &objectIDs); nil != err {
+			return
+		}
+		if nil == index {
+			continue
+		}
+		indexes = append(indexes, index)
+		ret.Indexes = append(ret.Indexes, index.ID)
+		ret.Head = index.ID
+	}
+	ret.Objects = len(objectIDs)
+
+	tw := tar.NewWriter(w)
+	manifest, err := gulu.JSON.MarshalJSON(ret)
+	if nil != err {
+		return
+	}
+	if err = writeArchiveEntry(tw, archiveManifestName, manifest); nil != err {
+		return
+	}
+
+	// 先写入数据对象再写入索引，导入中断时不会留下引用缺失对象的索引
+	for _, id := range objectIDs {
+		_, file := repo.store.AbsPath(id)
+		data, readErr := repo.store.fs.ReadFile(file)
+		if nil != readErr {
+			logging.LogErrorf("read object [%s] failed: %s", id, readErr)
+			err = readErr
+			return
+		}
+		if err = writeArchiveEntry(tw, path.Join("objects", id), data); nil != err {
+			return
+		}
+	}
+	for _, index := range indexes {
+		data, marshalErr := gulu.JSON.MarshalJSON(index)
+		if nil != marshalErr {
+			err = marshalErr
+			return
+		}
+		if err = writeArchiveEntry(tw, path.Join("indexes", index.ID), data); nil != err {
+			return
+		}
+	}
+	if err = tw.Close(); nil != err {
+		return
+	}
+	logging.LogInfof("exported archive [base=%s, head=%s, indexes=%d, objects=%d]", ret.Base, ret.Head, len(ret.Indexes), ret.Objects)
+	return
+}
+
+// ImportArchive 用于导入 ExportArchive 导出的归档，增量归档的基准索引必须已经存在，否则返回 ErrArchiveBaseMissing。
+//
+// 本地最新索引不存在或者就是归档的基准索引时，导入后将本地最新索引更新为归档的 Head。
+func (repo *Repo) ImportArchive(r io.Reader) (ret *ArchiveManifest, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if nil != err || archiveManifestName != header.Name {
+		err = ErrInvalidArchive
+		return
+	}
+	data, err := io.ReadAll(tr)
+	if nil != err {
+		return
+	}
+	ret = &ArchiveManifest{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		err = ErrInvalidArchive
+		return
+	}
+	if "" != ret.Base && !repo.store.indexExist(ret.Base) {
+		err = ErrArchiveBaseMissing
+		return
+	}
+
+	for {
+		if header, err = tr.Next(); nil != err {
+			if io.EOF == err {
+				err = nil
+				break
+			}
+			return
+		}
+
+		kind, id := path.Split(header.Name)
+		if 40 != len(id) || !gulu.File.IsValidFilename(id) {
+			err = ErrInvalidArchive
+			return
+		}
+		if data, err = io.ReadAll(tr); nil != err {
+			return
+		}
+
+		switch kind {
+		case "objects/":
+			err = repo.importArchiveObject(id, data)
+		case "indexes/":
+			err = repo.importArchiveIndex(id, data)
+		default:
+			err = ErrInvalidArchive
+		}
+		if nil != err {
+			logging.LogErrorf("import archive entry [%s] failed: %s", header.Name, err)
+			return
+		}
+	}
+
+	if "" != ret.Head {
+		latest, latestErr := repo.Latest()
+		if nil != latestErr || latest.ID == ret.Base {
+			var head *entity.Index
+			if head, err = repo.store.GetIndex(ret.Head); nil != err {
+				return
+			}
+			if err = repo.updateLatest(head, RefOpImport); nil != err {
+				return
+			}
+		}
+	}
+	logging.LogInfof("imported archive [base=%s, head=%s, indexes=%d, objects=%d]", ret.Base, ret.Head, len(ret.Indexes), ret.Objects)
+	return
+}
+
+// collectArchiveObjects 用于收集索引 indexID 引用的数据对象，跳过 collected 中已有的对象，objectIDs 不为空时追加新收集的对象。
+//
+// 索引已经被清理时返回的 index 为 nil。
+func (repo *Repo) collectArchiveObjects(indexID string, collected map[string]bool, objectIDs *[]string) (index *entity.Index, err error) {
+	index, err = repo.store.GetIndex(indexID)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil // 索引已经被清理
+			return
+		}
+		logging.LogErrorf("get index [%s] failed: %s", indexID, err)
+		return
+	}
+
+	collect := func(id string) {
+		if collected[id] {
+			return
+		}
+		collected[id] = true
+		if nil != objectIDs {
+			*objectIDs = append(*objectIDs, id)
+		}
+	}
+	for _, fileID := range index.Files {
+		if collected[fileID] {
+			continue // 文件已经收集过，其分块也已经收集过
+		}
+		collect(fileID)
+
+		file, getErr := repo.store.GetFile(fileID)
+		if nil != getErr {
+			logging.LogErrorf("get file [%s] failed: %s", fileID, getErr)
+			err = getErr
+			return
+		}
+		for _, chunkID := range file.Chunks {
+			collect(chunkID)
+		}
+	}
+	return
+}
+
+func (repo *Repo) importArchiveObject(id string, data []byte) (err error) {
+	dir, file := repo.store.AbsPath(id)
+	if repo.store.exist(file) {
+		return
+	}
+	if err = repo.store.fs.MkdirAll(dir); nil != err {
+		return
+	}
+	err = repo.store.fs.WriteFile(file, data)
+	return
+}
+
+func (repo *Repo) importArchiveIndex(id string, data []byte) (err error) {
+	index := &entity.Index{}
+	if err = gulu.JSON.UnmarshalJSON(data, index); nil != err {
+		return
+	}
+	if id != index.ID {
+		err = fmt.Errorf("%w: index id [%s] not match entry [%s]", ErrInvalidArchive, index.ID, id)
+		return
+	}
+	if repo.store.indexExist(id) {
+		return
+	}
+
+	// 校验索引引用的文件对象能够解密，避免导入使用其他密钥的仓库导出的归档
+	for _, fileID := range index.Files {
+		if _, err = repo.store.GetFile(fileID); nil != err {
+			return
+		}
+	}
+	err = repo.store.PutIndex(index)
+	return
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte) (err error) {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err = tw.WriteHeader(header); nil != err {
+		return
+	}
+	_, err = tw.Write(data)
+	return
+}
@@ -28,16 +28,24 @@ import (
 )
 
 func (repo *Repo) DownloadIndex(id string, context map[string]interface{}) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	downloadFileCount, downloadChunkCount, downloadBytes, err = repo.downloadIndex(id, context)
 	return
 }
 
 func (repo *Repo) DownloadTagIndex(tag, id string, context map[string]interface{}) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	downloadFileCount, downloadChunkCount, downloadBytes, err = repo.downloadIndex(id, context)
 
@@ -108,8 +116,12 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 }
 
 func (repo *Repo) UploadTagIndex(tag, id string, context map[string]interface{}) (uploadFileCount, uploadChunkCount int, uploadBytes int64, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	uploadFileCount, uploadChunkCount, uploadBytes, err = repo.uploadTagIndex(tag, id, context)
 	if e, ok := err.(*os.PathError); ok && os.IsNotExist(err) {
@@ -0,0 +1,178 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// EvtCloudBenchmark 描述了云端存储服务测速进度的事件，参数为 context、对象类别名称、已完成的操作数和总操作数
+const EvtCloudBenchmark = "repo.cloudBenchmark"
+
+// BenchmarkClass 描述了一类测速对象。
+type BenchmarkClass struct {
+	Name  string `json:"name"`  // 类别名称
+	Size  int64  `json:"size"`  // 对象大小字节数
+	Count int    `json:"count"` // 对象个数
+}
+
+// DefaultBenchmarkClasses 为默认的测速对象类别，大致对应文档文件、一般分块和最大分块。
+var DefaultBenchmarkClasses = []*BenchmarkClass{
+	{Name: "small", Size: 4 * 1024, Count: 16},
+	{Name: "medium", Size: 256 * 1024, Count: 8},
+	{Name: "large", Size: 4 * 1024 * 1024, Count: 4},
+}
+
+// BenchmarkStat 描述了一类对象上传或者下载的测速结果。
+type BenchmarkStat struct {
+	Count      int           `json:"count"`      // 成功的操作数
+	Errors     int           `json:"errors"`     // 失败的操作数
+	Bytes      int64         `json:"bytes"`      // 成功传输的字节数
+	Duration   time.Duration `json:"duration"`   // 成功的操作总耗时
+	LatencyAvg time.Duration `json:"latencyAvg"` // 平均延迟
+	LatencyP50 time.Duration `json:"latencyP50"` // 延迟中位数
+	LatencyMax time.Duration `json:"latencyMax"` // 最大延迟
+	Throughput int64         `json:"throughput"` // 吞吐量，字节/秒
+	LastError  string        `json:"lastError"`  // 最后一次失败的错误信息
+
+	latencies []time.Duration
+}
+
+// BenchmarkResult 描述了一类对象的测速结果。
+type BenchmarkResult struct {
+	*BenchmarkClass
+	Upload   *BenchmarkStat `json:"upload"`
+	Download *BenchmarkStat `json:"download"`
+}
+
+// BenchmarkReport 描述了一次云端存储服务测速的报告。
+type BenchmarkReport struct {
+	Endpoint string             `json:"endpoint"` // 云端存储服务端点
+	Started  int64              `json:"started"`  // 开始时间
+	Duration time.Duration      `json:"duration"` // 总耗时
+	Results  []*BenchmarkResult `json:"results"`  // 各类对象的测速结果
+}
+
+// BenchmarkCloud 用于测试云端存储服务的上传下载速度，使用 DefaultBenchmarkClasses 中的对象类别。
+//
+// 测速对象为随机数据，上传到云端仓库的 benchmark/ 文件夹下，测速结束后删除。每个对象依次上传然后依次下载，所以延迟是单个请求的延迟，
+// 吞吐量是单连接的吞吐量。单个对象失败不会中止测速，失败次数记录在报告中。没有配置云端存储服务时返回 cloud.ErrUnsupported。
+func (repo *Repo) BenchmarkCloud(context map[string]interface{}) (ret *BenchmarkReport, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+
+	start := time.Now()
+	ret = &BenchmarkReport{Endpoint: repo.cloud.GetConf().Endpoint, Started: start.UnixMilli()}
+	dir := path.Join("benchmark", gulu.Rand.String(7))
+	for _, class := range DefaultBenchmarkClasses {
+		ret.Results = append(ret.Results, repo.benchmarkClass(dir, class, context))
+	}
+	ret.Duration = time.Since(start)
+	logging.LogInfof("benchmarked cloud [%s] cost [%s]", ret.Endpoint, ret.Duration)
+	return
+}
+
+func (repo *Repo) benchmarkClass(dir string, class *BenchmarkClass, context map[string]interface{}) (ret *BenchmarkResult) {
+	ret = &BenchmarkResult{BenchmarkClass: class, Upload: &BenchmarkStat{}, Download: &BenchmarkStat{}}
+	data := make([]byte, class.Size)
+	total, done := class.Count*2, 0
+
+	var keys []string
+	for i := 0; i < class.Count; i++ {
+		if _, err := rand.Read(data); nil != err {
+			ret.Upload.fail(err)
+			continue
+		}
+
+		key := path.Join(dir, fmt.Sprintf("%s-%d", class.Name, i))
+		start := time.Now()
+		length, err := repo.cloud.UploadBytes(key, data, true)
+		if nil != err {
+			ret.Upload.fail(err)
+		} else {
+			ret.Upload.observe(length, time.Since(start))
+			keys = append(keys, key)
+		}
+		done++
+		eventbus.Publish(EvtCloudBenchmark, context, class.Name, done, total)
+	}
+
+	for _, key := range keys {
+		start := time.Now()
+		downloaded, err := repo.cloud.DownloadObject(key)
+		if nil == err && int64(len(downloaded)) != class.Size {
+			err = fmt.Errorf("downloaded [%d] bytes, expected [%d]", len(downloaded), class.Size)
+		}
+		if nil != err {
+			ret.Download.fail(err)
+		} else {
+			ret.Download.observe(int64(len(downloaded)), time.Since(start))
+		}
+		done++
+		eventbus.Publish(EvtCloudBenchmark, context, class.Name, done, total)
+	}
+
+	for _, key := range keys {
+		if err := repo.cloud.RemoveObject(key); nil != err {
+			logging.LogWarnf("remove benchmark object [%s] failed: %s", key, err)
+		}
+	}
+
+	ret.Upload.summarize()
+	ret.Download.summarize()
+	return
+}
+
+func (stat *BenchmarkStat) observe(length int64, latency time.Duration) {
+	stat.Count++
+	stat.Bytes += length
+	stat.Duration += latency
+	stat.latencies = append(stat.latencies, latency)
+}
+
+func (stat *BenchmarkStat) fail(err error) {
+	stat.Errors++
+	stat.LastError = err.Error()
+}
+
+func (stat *BenchmarkStat) summarize() {
+	if 1 > len(stat.latencies) {
+		return
+	}
+
+	sort.Slice(stat.latencies, func(i, j int) bool { return stat.latencies[i] < stat.latencies[j] })
+	stat.LatencyAvg = stat.Duration / time.Duration(len(stat.latencies))
+	stat.LatencyP50 = stat.latencies[len(stat.latencies)/2]
+	stat.LatencyMax = stat.latencies[len(stat.latencies)-1]
+	if 0 < stat.Duration {
+		stat.Throughput = int64(float64(stat.Bytes) / stat.Duration.Seconds())
+	}
+}
@@ -0,0 +1,122 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sort"
+
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+// 文件变更事件的类型。
+const (
+	ChangeUpsert = "upsert" // 新增或者更新文件
+	ChangeRemove = "remove" // 删除文件
+	ChangeRename = "rename" // 移动（重命名）文件
+)
+
+// Change 描述了一个快照相比上一个快照的文件级别变更事件。
+type Change struct {
+	Type        string `json:"type"`              // 变更类型，ChangeUpsert、ChangeRemove 或者 ChangeRename
+	Path        string `json:"path"`              // 变更后的文件路径，删除时为被删除文件的路径
+	OldPath     string `json:"oldPath,omitempty"` // 重命名前的文件路径
+	FileID      string `json:"fileID"`            // 变更后的文件 ID，删除时为被删除文件的 ID
+	IndexID     string `json:"indexID"`           // 产生变更的索引 ID
+	PrevIndexID string `json:"prevIndexID"`       // 上一个索引 ID，第一个索引为空
+	Created     int64  `json:"created"`           // 产生变更的索引创建时间
+}
+
+// Changes 用于获取索引 sinceIndexID 之后所有快照的文件变更事件，外部的索引或者搜索服务可以据此增量跟踪仓库历史。
+//
+// 快照按照索引创建时间正序排列，每个快照和前一个快照比较，同一个快照中的变更按照路径排列。sinceIndexID 为空时从第一个快照开始，
+// 第一个快照中的文件都是新增。调用方可以保存最后一个变更的 IndexID，下次从该索引继续获取。sinceIndexID 不在索引日志中时返回 ErrNotFoundIndex。
+func (repo *Repo) Changes(sinceIndexID string) (ret []*Change, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	entries, err := repo.store.readIndexLog()
+	if nil != err {
+		return
+	}
+	// 索引日志按创建时间倒序排列
+	var ids []string
+	found := "" == sinceIndexID
+	for i := len(entries) - 1; 0 <= i; i-- {
+		if found {
+			ids = append(ids, entries[i].ID)
+			continue
+		}
+		found = sinceIndexID == entries[i].ID
+	}
+	if !found {
+		err = ErrNotFoundIndex
+		return
+	}
+	if 1 > len(ids) {
+		return
+	}
+
+	prev := &entity.Index{}
+	var prevFiles []*entity.File
+	if "" != sinceIndexID {
+		if prev, err = repo.store.GetIndex(sinceIndexID); nil != err {
+			return
+		}
+		if prevFiles, err = repo.getFiles(prev.Files); nil != err {
+			return
+		}
+	}
+	for _, id := range ids {
+		var index *entity.Index
+		if index, err = repo.store.GetIndex(id); nil != err {
+			return
+		}
+		var files []*entity.File
+		if files, err = repo.getFiles(index.Files); nil != err {
+			return
+		}
+
+		ret = append(ret, indexChanges(repo.diffFiles(index, prev, files, prevFiles))...)
+		prev, prevFiles = index, files
+	}
+	return
+}
+
+// indexChanges 用于将索引比较结果 diff 转换为左侧索引相比右侧索引的变更事件，结果按照路径排列。
+func indexChanges(diff *LeftRightDiff) (ret []*Change) {
+	index := diff.LeftIndex
+	change := func(typ string, file *entity.File) *Change {
+		return &Change{Type: typ, Path: file.Path, FileID: file.ID, IndexID: index.ID, PrevIndexID: diff.RightIndex.ID, Created: index.Created}
+	}
+
+	for _, file := range diff.AddsLeft {
+		ret = append(ret, change(ChangeUpsert, file))
+	}
+	for _, file := range diff.UpdatesLeft {
+		ret = append(ret, change(ChangeUpsert, file))
+	}
+	for _, file := range diff.RemovesRight {
+		ret = append(ret, change(ChangeRemove, file))
+	}
+	for _, move := range diff.Moves {
+		renamed := change(ChangeRename, move.To)
+		renamed.OldPath = move.From.Path
+		ret = append(ret, renamed)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return
+}
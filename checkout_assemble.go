@@ -0,0 +1,167 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+var ErrChunkSizeMismatch = errors.New("chunk size mismatch") // 组装后的文件大小和文件实体中记录的大小不一致
+
+// assembleConcurrency 为组装一个文件时并发读取分块的协程数。
+const assembleConcurrency = 4
+
+// assembleFile 用于将文件 file 的分块组装写入本地文件 f。
+//
+// 写入前先按文件大小预分配（稀疏文件），然后并发读取分块并写入到各自的偏移处。分块解码前无法知道大小，
+// 所以每个分块的偏移在前一个分块解码后才能确定，但是解码和写入都是并发的。开启 Store.Plain 时不压缩不加密的分块对象
+// 使用 util.CopyRange 直接从数据对象复制，不经过用户态缓冲区。
+func (repo *Repo) assembleFile(file *entity.File, f *os.File) (err error) {
+	if err = f.Truncate(file.Size); nil != err {
+		return
+	}
+	if 1 > len(file.Chunks) {
+		return
+	}
+
+	offsets := make([]chan int64, len(file.Chunks)+1)
+	for i := range offsets {
+		offsets[i] = make(chan int64, 1)
+	}
+	offsets[0] <- 0
+
+	var workerErrs []error
+	workerErrLock := sync.Mutex{}
+	waitGroup := &sync.WaitGroup{}
+	p, err := ants.NewPoolWithFunc(assembleConcurrency, func(arg interface{}) {
+		defer waitGroup.Done()
+
+		i := arg.(int)
+		size, write, getErr := repo.assembleChunk(file.Chunks[i], f)
+		offset := <-offsets[i]
+		offsets[i+1] <- offset + size
+		if nil == getErr {
+			getErr = write(offset)
+		}
+		if nil != getErr {
+			workerErrLock.Lock()
+			workerErrs = append(workerErrs, getErr)
+			workerErrLock.Unlock()
+		}
+	})
+	if nil != err {
+		return
+	}
+	defer p.Release()
+
+	for i := range file.Chunks {
+		waitGroup.Add(1)
+		if err = p.Invoke(i); nil != err {
+			logging.LogErrorf("invoke failed: %s", err)
+			waitGroup.Done()
+			waitGroup.Wait()
+			return
+		}
+	}
+	waitGroup.Wait()
+
+	if 0 < len(workerErrs) {
+		err = workerErrs[0]
+		return
+	}
+	if size := <-offsets[len(file.Chunks)]; size != file.Size {
+		err = fmt.Errorf("%w: file [%s] expected [%d] bytes, got [%d]", ErrChunkSizeMismatch, file.Path, file.Size, size)
+	}
+	return
+}
+
+// writeChunks 用于将文件 file 的分块按顺序写入 w，用于迁出到不支持随机写入的文件系统，参考 DataFS。
+func (repo *Repo) writeChunks(file *entity.File, w io.Writer) (err error) {
+	var size int64
+	for _, id := range file.Chunks {
+		var chunk *entity.Chunk
+		if chunk, err = repo.store.GetChunk(id); nil != err {
+			return
+		}
+		if _, err = w.Write(chunk.Data); nil != err {
+			return
+		}
+		size += int64(len(chunk.Data))
+	}
+	if size != file.Size {
+		err = fmt.Errorf("%w: file [%s] expected [%d] bytes, got [%d]", ErrChunkSizeMismatch, file.Path, file.Size, size)
+	}
+	return
+}
+
+// assembleChunk 用于读取分块 id，返回分块大小以及将分块写入文件 f 指定偏移处的函数。
+func (repo *Repo) assembleChunk(id string, f *os.File) (size int64, write func(offset int64) error, err error) {
+	if repo.store.Plain {
+		var src *os.File
+		if src, size, err = repo.store.openPlainChunk(id); nil == err && nil != src {
+			write = func(offset int64) error {
+				defer src.Close()
+				return util.CopyRange(f, offset, src, size)
+			}
+			return
+		}
+	}
+
+	chunk, err := repo.store.GetChunk(id)
+	if nil != err {
+		return
+	}
+	size = int64(len(chunk.Data))
+	write = func(offset int64) (writeErr error) {
+		_, writeErr = f.WriteAt(chunk.Data, offset)
+		return
+	}
+	return
+}
+
+// openPlainChunk 用于打开不压缩不加密的分块对象 id，分块对象不是不压缩不加密的时候返回 nil。
+//
+// 打开后会校验分块对象的哈希值，避免把（比如硬链接迁出后被原地修改而）损坏的分块对象复制到数据文件中。
+func (store *Store) openPlainChunk(id string) (ret *os.File, size int64, err error) {
+	f, err := os.Open(store.ObjectPath(id))
+	if nil != err {
+		return
+	}
+
+	hash := sha1.New()
+	if size, err = io.Copy(hash, f); nil != err {
+		f.Close()
+		return
+	}
+	if id != fmt.Sprintf("%x", hash.Sum(nil)) {
+		f.Close()
+		size = 0
+		return
+	}
+	ret = f
+	return
+}
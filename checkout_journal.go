@@ -0,0 +1,326 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+const checkoutJournalFile = "checkout-journal.json" // 迁出回滚日志文件，位于仓库根目录下
+
+// checkoutJournal 描述了一次原子迁出的回滚日志。
+type checkoutJournal struct {
+	Stage   string                  `json:"stage"`   // 暂存文件夹的绝对路径，待迁出的文件先写入该文件夹
+	Backup  string                  `json:"backup"`  // 备份文件夹的绝对路径，被替换和删除的数据文件先移动到该文件夹
+	Entries []*checkoutJournalEntry `json:"entries"` // 按应用顺序排列的变更
+}
+
+// checkoutJournalEntry 描述了原子迁出中的一个文件变更。
+type checkoutJournalEntry struct {
+	Path    string `json:"path"`           // 数据文件夹下的本地相对路径（转义后）
+	Remove  bool   `json:"remove"`         // 是否是删除
+	Existed bool   `json:"existed"`        // 变更前数据文件夹中是否存在该文件
+	From    string `json:"from,omitempty"` // 移动前的本地相对路径（转义后），不为空时该变更是将该文件移动到 Path
+}
+
+// applyFiles 用于将目录操作 dirOps 以及 upserts、moves 和 removes 原子地应用到数据文件夹中。
+//
+// 待迁出的文件先写入暂存文件夹，全部写入成功后记录回滚日志，然后将被替换和删除的数据文件移动到备份文件夹，再将暂存文件移动到数据文件夹。
+// 移动的文件和目录直接在数据文件夹中重命名，不需要迁出，删除的目录整个移动到备份文件夹。
+// 应用过程中出错或者崩溃时（下次打开仓库时）会根据回滚日志还原，所以数据文件夹要么是变更前的状态，要么是变更后的状态。
+func (repo *Repo) applyFiles(upserts, removes []*entity.File, moves []*Move, dirOps []*DirOp, context map[string]interface{}) (err error) {
+	if 1 > len(upserts) && 1 > len(removes) && 1 > len(moves) && 1 > len(dirOps) {
+		return
+	}
+	if !repo.localData() {
+		// 暂存文件夹和数据文件夹不在同一个文件系统中，无法通过重命名原子地应用
+		err = repo.applyFilesDirect(upserts, removes, moves, dirOps, context)
+		return
+	}
+
+	dir := filepath.Join(repo.Path, "checkout", time.Now().Format("2006-01-02-150405")+"-"+gulu.Rand.String(7))
+	journal := &checkoutJournal{Stage: filepath.Join(dir, "stage"), Backup: filepath.Join(dir, "backup")}
+	if err = repo.checkoutFilesTo(upserts, journal.Stage, context); nil != err {
+		logging.LogErrorf("stage checkout files failed: %s", err)
+		os.RemoveAll(dir)
+		return
+	}
+
+	// 目录操作最先应用，后续的文件变更可能位于移动后的目录下
+	total := len(removes)
+	for _, op := range dirOps {
+		if "" == op.To {
+			journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: repo.localPath(op.Path), Remove: true, Existed: true})
+			total++
+			continue
+		}
+		journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: repo.localPath(op.To), From: repo.localPath(op.Path)})
+	}
+	for _, file := range sortCheckoutFiles(upserts) {
+		localPath := repo.localPath(file.Path)
+		journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: localPath, Existed: lexists(repo.absPath(file.Path))})
+	}
+	for _, move := range moves {
+		localPath := repo.localPath(move.To.Path)
+		journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: localPath, Existed: lexists(repo.absPath(move.To.Path)), From: repo.localPath(move.From.Path)})
+	}
+	for _, file := range removes {
+		localPath := repo.localPath(file.Path)
+		journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: localPath, Remove: true, Existed: lexists(repo.absPath(file.Path))})
+	}
+	if err = repo.writeCheckoutJournal(journal); nil != err {
+		logging.LogErrorf("write checkout journal failed: %s", err)
+		os.RemoveAll(dir)
+		return
+	}
+
+	count := 0
+	eventbus.Publish(eventbus.EvtCheckoutRemoveFiles, context, total)
+	for _, entry := range journal.Entries {
+		if err = repo.applyCheckoutEntry(journal, entry); nil != err {
+			logging.LogErrorf("apply checkout [%s] failed: %s", entry.Path, err)
+			repo.rollbackCheckout(journal)
+			if isFileLockedErr(err) {
+				err = &LockedFilesError{Paths: []string{repo.originalPath(entry.Path)}, Err: err}
+			}
+			return
+		}
+		if entry.Remove {
+			count++
+			eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, count, total)
+		}
+	}
+
+	chtimesMoves := moves
+	for _, op := range dirOps {
+		for _, move := range op.Moves {
+			if move.From.Updated/1000 != move.To.Updated/1000 {
+				chtimesMoves = append(chtimesMoves, move)
+			}
+		}
+	}
+	for _, move := range chtimesMoves {
+		// 还原修改时间，使得下次索引时移动后的文件 ID 和云端一致
+		updated := time.UnixMilli(move.To.Updated)
+		if chtimesErr := os.Chtimes(repo.absPath(move.To.Path), updated, updated); nil != chtimesErr {
+			logging.LogWarnf("change time of moved file [%s] failed: %s", move.To.Path, chtimesErr)
+		}
+	}
+
+	if err = os.Remove(filepath.Join(repo.Path, checkoutJournalFile)); nil != err {
+		logging.LogErrorf("remove checkout journal failed: %s", err)
+		return
+	}
+	repo.trashRemoved(journal)
+	if removeErr := os.RemoveAll(dir); nil != removeErr {
+		logging.LogWarnf("remove checkout dir [%s] failed: %s", dir, removeErr)
+	}
+
+	for _, file := range upserts {
+		repo.recordCheckoutPath(file, repo.DataPath)
+	}
+	for _, file := range removes {
+		repo.forgetEscapedPath(file.Path)
+	}
+	for _, op := range dirOps {
+		for _, file := range op.Files {
+			repo.forgetEscapedPath(file.Path)
+		}
+		moves = append(moves, op.Moves...)
+	}
+	for _, move := range moves {
+		repo.recordCheckoutPath(move.To, repo.DataPath)
+		repo.forgetEscapedPath(move.From.Path)
+	}
+	return
+}
+
+func (repo *Repo) applyCheckoutEntry(journal *checkoutJournal, entry *checkoutJournalEntry) (err error) {
+	target, backup, staged := repo.checkoutJournalPaths(journal, entry)
+	if entry.Existed {
+		if err = os.MkdirAll(filepath.Dir(backup), 0755); nil != err {
+			return
+		}
+		// 数据文件可能被其他进程占用
+		if err = retryLocked(func() error { return moveCheckoutFile(target, backup) }); nil != err {
+			return
+		}
+	}
+	if entry.Remove {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); nil != err {
+		return
+	}
+	if "" != entry.From {
+		err = retryLocked(func() error { return moveCheckoutFile(util.LongPath(repo.dataAbsPath(entry.From)), target) })
+		return
+	}
+	err = moveCheckoutFile(staged, target)
+	return
+}
+
+// moveCheckoutFile 用于将 src 移动到 dst。
+//
+// 暂存和备份文件夹位于仓库文件夹下，数据文件夹或者附加根目录位于其他卷上时无法重命名，此时先复制到 dst 再删除 src。
+// 复制完成前 src 保持不变，中途崩溃时回滚日志仍然可以还原。
+func moveCheckoutFile(src, dst string) (err error) {
+	// 在 retryLocked 中调用，所以不能使用 filelock，否则文件被占用时会直接退出进程
+	if err = os.Rename(src, dst); nil == err || !util.IsCrossDeviceErr(err) {
+		return
+	}
+
+	logging.LogWarnf("rename [%s] across volumes, copy instead", src)
+	info, err := os.Lstat(src)
+	if nil != err {
+		return
+	}
+	if 0 != info.Mode()&os.ModeSymlink {
+		var linkTarget string
+		if linkTarget, err = os.Readlink(src); nil != err {
+			return
+		}
+		err = os.Symlink(linkTarget, dst)
+	} else {
+		err = gulu.File.Copy(src, dst)
+	}
+	if nil != err {
+		os.RemoveAll(dst)
+		return
+	}
+	err = os.RemoveAll(src)
+	return
+}
+
+// rollbackCheckout 用于根据回滚日志 journal 将数据文件夹还原到变更前的状态，可以重复执行。
+func (repo *Repo) rollbackCheckout(journal *checkoutJournal) {
+	for i := len(journal.Entries) - 1; 0 <= i; i-- {
+		entry := journal.Entries[i]
+		target, backup, staged := repo.checkoutJournalPaths(journal, entry)
+		if "" != entry.From {
+			if from := util.LongPath(repo.dataAbsPath(entry.From)); !lexists(from) && lexists(target) {
+				// 已经移动的文件移回原处
+				if err := os.MkdirAll(filepath.Dir(from), 0755); nil != err {
+					logging.LogErrorf("mkdir [%s] failed: %s", filepath.Dir(from), err)
+					continue
+				}
+				if err := moveCheckoutFile(target, from); nil != err {
+					logging.LogErrorf("rollback move [%s] failed: %s", target, err)
+					continue
+				}
+			}
+		}
+		if lexists(backup) {
+			// 变更前的文件已经移动到备份文件夹，移回原处
+			if err := os.RemoveAll(target); nil != err {
+				logging.LogErrorf("remove [%s] failed: %s", target, err)
+				continue
+			}
+			if err := moveCheckoutFile(backup, target); nil != err {
+				logging.LogErrorf("rollback [%s] failed: %s", target, err)
+			}
+			continue
+		}
+
+		if !entry.Remove && !entry.Existed && !lexists(staged) && lexists(target) {
+			// 新增的文件已经移动到数据文件夹，删除
+			if err := os.RemoveAll(target); nil != err {
+				logging.LogErrorf("remove [%s] failed: %s", target, err)
+			}
+		}
+	}
+
+	if err := os.Remove(filepath.Join(repo.Path, checkoutJournalFile)); nil != err && !os.IsNotExist(err) {
+		logging.LogErrorf("remove checkout journal failed: %s", err)
+		return
+	}
+	os.RemoveAll(filepath.Dir(journal.Stage))
+	logging.LogInfof("rolled back checkout [%d]", len(journal.Entries))
+}
+
+// recoverCheckout 用于在打开仓库时回滚因崩溃而未完成的原子迁出，并清理写入回滚日志前崩溃遗留的暂存文件夹。
+func (repo *Repo) recoverCheckout() {
+	// 同一仓库的其他实例可能正在迁出
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(repo.Path, checkoutJournalFile))
+	if nil != err {
+		repo.removeStaleCheckoutDirs()
+		return
+	}
+
+	journal := &checkoutJournal{}
+	if err = gulu.JSON.UnmarshalJSON(data, journal); nil != err {
+		logging.LogErrorf("unmarshal checkout journal failed: %s", err)
+		return
+	}
+	logging.LogWarnf("found unfinished checkout, rolling back")
+	repo.rollbackCheckout(journal)
+	if !lexists(filepath.Join(repo.Path, checkoutJournalFile)) {
+		repo.removeStaleCheckoutDirs()
+	}
+}
+
+// removeStaleCheckoutDirs 用于删除仓库 checkout 文件夹下的暂存文件夹，只能在没有回滚日志时调用，否则会删除回滚需要的备份文件。
+func (repo *Repo) removeStaleCheckoutDirs() {
+	checkoutDir := filepath.Join(repo.Path, "checkout")
+	entries, err := os.ReadDir(checkoutDir)
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(checkoutDir, entry.Name())
+		if err = os.RemoveAll(dir); nil != err {
+			logging.LogWarnf("remove stale checkout dir [%s] failed: %s", dir, err)
+			continue
+		}
+		logging.LogInfof("removed stale checkout dir [%s]", dir)
+	}
+}
+
+func (repo *Repo) checkoutJournalPaths(journal *checkoutJournal, entry *checkoutJournalEntry) (target, backup, staged string) {
+	target = util.LongPath(repo.dataAbsPath(entry.Path))
+	backup = util.LongPath(filepath.Join(journal.Backup, entry.Path))
+	staged = util.LongPath(filepath.Join(journal.Stage, entry.Path))
+	return
+}
+
+func (repo *Repo) writeCheckoutJournal(journal *checkoutJournal) (err error) {
+	data, err := gulu.JSON.MarshalJSON(journal)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, checkoutJournalFile), data, 0644)
+	return
+}
+
+// lexists 用于判断 path 是否存在，符号链接不会被跟随。
+func lexists(path string) bool {
+	_, err := os.Lstat(path)
+	return nil == err
+}
@@ -0,0 +1,147 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// defaultCheckoutConcurrency 为未设置时并发迁出文件的协程数。
+const defaultCheckoutConcurrency = 8
+
+// SetCheckoutConcurrency 用于设置并发迁出文件的协程数 concurrency，小于 1 时使用默认值，为 1 时按顺序迁出。
+func (repo *Repo) SetCheckoutConcurrency(concurrency int) {
+	repo.checkoutConcurrency = max(concurrency, 0)
+}
+
+func (repo *Repo) getCheckoutConcurrency() int {
+	if 1 > repo.checkoutConcurrency {
+		return defaultCheckoutConcurrency
+	}
+	return repo.checkoutConcurrency
+}
+
+// CheckoutFiles 用于将文件 files 批量迁出到数据文件夹中，文件的分块需要已经存在于本地仓库中。
+//
+// 迁出时每个文件完成后发布 eventbus.EvtCheckoutUpsertFile 进度事件，某个文件迁出失败时继续迁出其他文件，
+// 最后返回迁出失败的文件路径 failed，存在迁出失败的文件时 err 为最后一个失败的原因。
+func (repo *Repo) CheckoutFiles(files []*entity.File, context map[string]interface{}) (failed []string, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	failed, err = repo.checkoutFilesBatch(files, repo.DataPath, false, context)
+	return
+}
+
+// checkoutFilesBatch 用于使用协程池将文件 files 并发迁出到 checkoutDir 中。
+//
+// .siyuan 等配置文件在其他文件之前按顺序迁出。被其他进程占用的文件汇总为 LockedFilesError 返回；stopOnErr 为 true 时遇到其他错误
+// 不再迁出后续文件并返回该错误，否则继续迁出其他文件。failed 为所有迁出失败的文件路径。
+func (repo *Repo) checkoutFilesBatch(files []*entity.File, checkoutDir string, stopOnErr bool, context map[string]interface{}) (failed []string, err error) {
+	if 1 > len(files) {
+		return
+	}
+
+	files = sortCheckoutFiles(files)
+	total := len(files)
+	var count int64
+	var stopped atomic.Bool
+	lockedErr := &LockedFilesError{}
+	var lastErr error
+	resultLock := sync.Mutex{}
+	checkout := func(file *entity.File) {
+		if stopped.Load() {
+			return
+		}
+
+		checkoutErr := repo.checkoutFile(file, checkoutDir, int(atomic.AddInt64(&count, 1)), total, context)
+		if nil == checkoutErr {
+			return
+		}
+
+		resultLock.Lock()
+		defer resultLock.Unlock()
+		failed = append(failed, file.Path)
+		if fileLockedErr := (*LockedFilesError)(nil); errors.As(checkoutErr, &fileLockedErr) {
+			// 被其他进程占用的文件跳过，最后统一报告
+			lockedErr.Paths, lockedErr.Err = append(lockedErr.Paths, fileLockedErr.Paths...), fileLockedErr.Err
+			return
+		}
+		logging.LogErrorf("checkout file [%s] failed: %s", file.Path, checkoutErr)
+		lastErr = checkoutErr
+		if stopOnErr {
+			stopped.Store(true)
+		}
+	}
+
+	eventbus.Publish(eventbus.EvtCheckoutUpsertFiles, context, total)
+	i := 0
+	for ; i < len(files) && strings.Contains(files[i].Path, ".siyuan"); i++ {
+		checkout(files[i])
+	}
+
+	concurrency := repo.getCheckoutConcurrency()
+	if 1 == concurrency {
+		for ; i < len(files); i++ {
+			checkout(files[i])
+		}
+	} else {
+		waitGroup := &sync.WaitGroup{}
+		var p *ants.PoolWithFunc
+		p, err = ants.NewPoolWithFunc(concurrency, func(arg interface{}) {
+			defer waitGroup.Done()
+			checkout(arg.(*entity.File))
+		})
+		if nil != err {
+			return
+		}
+		for ; i < len(files) && !stopped.Load(); i++ {
+			waitGroup.Add(1)
+			if err = p.Invoke(files[i]); nil != err {
+				waitGroup.Done()
+				logging.LogErrorf("invoke failed: %s", err)
+				break
+			}
+		}
+		waitGroup.Wait()
+		p.Release()
+		if nil != err {
+			return
+		}
+	}
+
+	if nil != lastErr {
+		err = lastErr
+		return
+	}
+	if 0 < len(lockedErr.Paths) {
+		err = lockedErr
+	}
+	return
+}
@@ -0,0 +1,156 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// API 请求类型，S3 类存储服务按请求类型分别计费。
+const (
+	APIOpList   = "LIST"
+	APIOpHead   = "HEAD"
+	APIOpGet    = "GET"
+	APIOpPut    = "PUT"
+	APIOpDelete = "DELETE"
+)
+
+// APIOps 描述了按请求类型统计的 API 请求次数。
+type APIOps struct {
+	List   int64 `json:"list"`
+	Head   int64 `json:"head"`
+	Get    int64 `json:"get"`
+	Put    int64 `json:"put"`
+	Delete int64 `json:"delete"`
+}
+
+// Sub 用于计算 ops 相对 base 增加的请求次数，base 为 nil 时返回 ops 的副本。
+func (ops *APIOps) Sub(base *APIOps) (ret *APIOps) {
+	copied := *ops
+	ret = &copied
+	if nil == base {
+		return
+	}
+	ret.List -= base.List
+	ret.Head -= base.Head
+	ret.Get -= base.Get
+	ret.Put -= base.Put
+	ret.Delete -= base.Delete
+	return
+}
+
+// Add 用于累加请求次数 ops。
+func (ops *APIOps) Add(other *APIOps) {
+	if nil == other {
+		return
+	}
+	ops.List += other.List
+	ops.Head += other.Head
+	ops.Get += other.Get
+	ops.Put += other.Put
+	ops.Delete += other.Delete
+}
+
+// Total 用于获取请求总次数。
+func (ops *APIOps) Total() int64 {
+	return ops.List + ops.Head + ops.Get + ops.Put + ops.Delete
+}
+
+// APIOpsCounter 描述了按请求类型统计实际发出的 API 请求次数的云端存储服务。
+//
+// 目前 S3 按照 SDK 实际发出的请求（包括重试）统计，模拟云端存储服务按照模拟的请求统计，其他服务的统计结果为零。
+type APIOpsCounter interface {
+
+	// GetAPIOps 用于获取创建以来累计的请求次数。
+	GetAPIOps() *APIOps
+}
+
+// apiOpsCounter 描述了并发安全的请求次数计数器。
+type apiOpsCounter struct {
+	list, head, get, put, delete atomic.Int64
+}
+
+// GetAPIOps 用于获取创建以来累计的请求次数。
+func (baseCloud *BaseCloud) GetAPIOps() *APIOps {
+	ops := &baseCloud.apiOps
+	return &APIOps{List: ops.list.Load(), Head: ops.head.Load(), Get: ops.get.Load(), Put: ops.put.Load(), Delete: ops.delete.Load()}
+}
+
+// countAPIOp 用于记录一次类型为 op 的请求。
+func (baseCloud *BaseCloud) countAPIOp(op string) {
+	ops := &baseCloud.apiOps
+	switch op {
+	case APIOpList:
+		ops.list.Add(1)
+	case APIOpHead:
+		ops.head.Add(1)
+	case APIOpGet:
+		ops.get.Add(1)
+	case APIOpPut:
+		ops.put.Add(1)
+	case APIOpDelete:
+		ops.delete.Add(1)
+	}
+}
+
+// s3APIOps 为 S3 操作名称到计费请求类型的映射。
+var s3APIOps = map[string]string{
+	"ListObjectsV2":           APIOpList,
+	"ListObjects":             APIOpList,
+	"ListBuckets":             APIOpList,
+	"ListMultipartUploads":    APIOpList,
+	"ListParts":               APIOpList,
+	"HeadObject":              APIOpHead,
+	"HeadBucket":              APIOpHead,
+	"GetObject":               APIOpGet,
+	"PutObject":               APIOpPut,
+	"CopyObject":              APIOpPut,
+	"CreateBucket":            APIOpPut,
+	"CreateMultipartUpload":   APIOpPut,
+	"UploadPart":              APIOpPut,
+	"CompleteMultipartUpload": APIOpPut,
+	"DeleteObject":            APIOpDelete,
+	"DeleteObjects":           APIOpDelete,
+	"DeleteBucket":            APIOpDelete,
+	"AbortMultipartUpload":    APIOpDelete,
+}
+
+// countS3APIOps 用于在 S3 客户端中注入统计请求次数的中间件，中间件位于重试之后，所以每次重试都会被统计。
+func (s3 *S3) countS3APIOps(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("DejaVuCountAPIOps",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				if op, ok := s3APIOps[middleware.GetOperationName(ctx)]; ok {
+					s3.countAPIOp(op)
+				}
+				return next.HandleFinalize(ctx, in)
+			}), middleware.After)
+	})
+}
+
+// mockAPIOps 为模拟请求类型到计费请求类型的映射。
+var mockAPIOps = map[string]string{
+	MockOpUpload:   APIOpPut,
+	MockOpDownload: APIOpGet,
+	MockOpRemove:   APIOpDelete,
+	MockOpList:     APIOpList,
+	MockOpPing:     APIOpHead,
+}
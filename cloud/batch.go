@@ -0,0 +1,94 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+// uploadObjectsParallel 用于使用 poolSize 个并发请求调用 upload 上传对象 filePaths，返回上传的总字节数和第一个上传错误。
+func uploadObjectsParallel(filePaths []string, poolSize int, upload func(filePath string) (int64, error)) (length int64, err error) {
+	if 1 > len(filePaths) {
+		return
+	}
+	if 1 > poolSize {
+		poolSize = 1
+	}
+	if poolSize > len(filePaths) {
+		poolSize = len(filePaths)
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	uploadedBytes := atomic.Int64{}
+	var uploadErr error
+	errLock := sync.Mutex{}
+	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		errLock.Lock()
+		failed := nil != uploadErr
+		errLock.Unlock()
+		if failed {
+			return // 快速失败
+		}
+
+		n, uErr := upload(arg.(string))
+		if nil != uErr {
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = uErr
+			}
+			errLock.Unlock()
+			return
+		}
+		uploadedBytes.Add(n)
+	})
+	if nil != err {
+		return
+	}
+	defer p.Release()
+
+	for _, filePath := range filePaths {
+		waitGroup.Add(1)
+		if err = p.Invoke(filePath); nil != err {
+			waitGroup.Done()
+			break
+		}
+	}
+	waitGroup.Wait()
+	length = uploadedBytes.Load()
+	if nil == err {
+		err = uploadErr
+	}
+	return
+}
+
+// objectFolders 用于获取对象 filePaths 去重后的父目录。
+func objectFolders(filePaths []string) (ret []string) {
+	folders := map[string]bool{}
+	for _, filePath := range filePaths {
+		folder := path.Dir(filePath)
+		if !folders[folder] {
+			folders[folder] = true
+			ret = append(ret, folder)
+		}
+	}
+	return
+}
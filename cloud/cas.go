@@ -0,0 +1,36 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import "errors"
+
+var ErrCloudPreconditionFailed = errors.New("cloud precondition failed")               // ErrCloudPreconditionFailed 描述了条件写入时云端对象已经被其他设备修改的错误
+var ErrConditionalWriteUnsupported = errors.New("cloud conditional write unsupported") // ErrConditionalWriteUnsupported 描述了存储服务不支持条件写入的错误
+
+// ConditionalCloud 描述了支持条件写入（比较并交换）的云端存储服务，用于保证更新 refs/latest 时不会覆盖其他设备的更新。
+//
+// 目前只有 S3、本地存储和模拟存储实现了条件写入。思源云端的接口不提供对象版本标识，WebDAV 客户端无法为单个请求附加 If-Match 请求头，
+// 这两种存储服务没有实现该接口，更新 refs/latest 前只能检查一次云端是否已经改变，也不能开启无锁同步。
+// 部分 S3 兼容的存储服务不支持条件写入，此时 UploadBytesIfMatch 返回 ErrConditionalWriteUnsupported，调用方需要回退到检查后写入。
+type ConditionalCloud interface {
+
+	// DownloadObjectETag 用于下载对象数据 data 和版本标识 etag，对象不存在时返回 ErrCloudObjectNotFound。
+	DownloadObjectETag(filePath string) (data []byte, etag string, err error)
+
+	// UploadBytesIfMatch 用于在对象当前的版本标识为 etag 时写入 data，etag 为空时要求对象不存在，条件不满足时返回 ErrCloudPreconditionFailed。
+	UploadBytesIfMatch(filePath string, data []byte, etag string) (length int64, err error)
+}
@@ -18,11 +18,16 @@ package cloud
 
 import (
 	"errors"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/aws/smithy-go"
 	"github.com/dgraph-io/ristretto"
 	"github.com/klauspost/compress/zstd"
+	"github.com/qiniu/go-sdk/v7/client"
 	"github.com/siyuan-note/dejavu/entity"
+	"github.com/studio-b12/gowebdav"
 )
 
 // Conf 用于描述云端存储服务配置信息。
@@ -30,9 +35,23 @@ type Conf struct {
 	Dir      string                 // 存储目录，第三方存储不使用 Dir 区别多租户
 	UserID   string                 // 用户 ID，没有的话请传入一个定值比如 "0"
 	RepoPath string                 // 本地仓库的绝对路径，如：F:\\SiYuan\\repo\\
+	DeviceID string                 // 当前设备 ID，官方存储服务据此拒绝已吊销设备的上传
 	Endpoint string                 // 服务端点
 	Extras   map[string]interface{} // 一些可能需要的附加信息
 
+	// 上传对象后立即校验云端对象的大小和校验和，用于发现 WebDAV 等服务静默截断对象的问题
+	// 开启后每次上传会多一次请求，WebDAV 会回读整个对象进行比较，官方存储服务暂不支持
+	VerifyUpload bool
+
+	// 数据对象 ID 到本地文件绝对路径的映射，用于支持共享数据对象文件夹和多层分片，为空时使用 RepoPath 下的 objects/xx/yyyy
+	LocalObjectPath func(id string) string
+
+	// 基于 HTTP 协议的云端存储服务的连接配置，设置后 S3 和 WebDAV 使用按该配置构建的共享连接池
+	HTTP *ConfHTTP
+
+	// 按操作类别区分的超时配置，设置后所有基于 HTTP 协议的云端存储服务按操作类别设置超时，并覆盖原有的整体超时时间
+	Timeouts *ConfTimeouts
+
 	// S3 对象存储协议所需配置
 	S3 *ConfS3
 
@@ -48,6 +67,16 @@ type Conf struct {
 	Server        string // 云端接口端点
 }
 
+// LocalPath 用于获取对象 key 对应的本地文件绝对路径。
+func (conf *Conf) LocalPath(key string) string {
+	if nil != conf.LocalObjectPath {
+		if rel, ok := strings.CutPrefix(strings.TrimPrefix(key, "/"), "objects/"); ok {
+			return conf.LocalObjectPath(strings.ReplaceAll(rel, "/", ""))
+		}
+	}
+	return filepath.Join(conf.RepoPath, key)
+}
+
 // ConfS3 用于描述 S3 对象存储协议所需配置。
 type ConfS3 struct {
 	Endpoint       string // 服务端点
@@ -59,6 +88,8 @@ type ConfS3 struct {
 	SkipTlsVerify  bool   //  是否跳过 TLS 验证
 	Timeout        int    // 超时时间，单位：秒
 	ConcurrentReqs int    // 并发请求数
+	ObjectLockMode string // 对象锁定模式：GOVERNANCE 或者 COMPLIANCE，为空时不锁定，其他值上传时返回 ErrInvalidObjectLockMode，存储桶需要开启对象锁定
+	ObjectLockDays int    // 对象锁定的保留天数，快照引用的数据对象和索引在快照创建后至少这么多天内不能被覆盖或者删除
 }
 
 // ConfWebDAV 用于描述 WebDAV 协议所需配置。
@@ -94,12 +125,22 @@ type Cloud interface {
 	// GetRepos 用于获取云端仓库列表 repos，size 为仓库总大小字节数。
 	GetRepos() (repos []*Repo, size int64, err error)
 
+	// RenameRepo 用于将云端仓库 oldName 重命名为 newName。
+	RenameRepo(oldName, newName string) (err error)
+
+	// CopyRepo 用于在云端将仓库 src 复制为仓库 dst，数据不经过本地中转。
+	CopyRepo(src, dst string) (err error)
+
 	// UploadObject 用于上传对象，overwrite 参数用于指示是否覆盖已有对象。
 	UploadObject(filePath string, overwrite bool) (length int64, err error)
 
 	// UploadBytes 用于上传对象数据 data，overwrite 参数用于指示是否覆盖已有对象。
 	UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error)
 
+	// UploadObjects 用于批量上传对象 filePaths，overwrite 参数用于指示是否覆盖已有对象，用于减少上传大量小对象时的请求开销。
+	// 不支持批量上传时返回 ErrUnsupported，调用方应该逐个调用 UploadObject 上传；filePaths 为空时不上传，可用于探测是否支持批量上传。
+	UploadObjects(filePaths []string, overwrite bool) (length int64, err error)
+
 	// DownloadObject 用于下载对象数据 data。
 	DownloadObject(filePath string) (data []byte, err error)
 
@@ -138,6 +179,12 @@ type Cloud interface {
 
 	// GetConcurrentReqs 用于获取配置的并发请求数。
 	GetConcurrentReqs() int
+
+	// Ping 用于发送一个轻量请求检查云端存储服务是否可达，latency 为请求往返耗时。
+	Ping() (latency time.Duration, err error)
+
+	// Capabilities 用于探测云端存储服务的读写、列举能力和一致性模型。
+	Capabilities() (caps *Capabilities, err error)
 }
 
 // Traffic 描述了流量信息。
@@ -196,12 +243,17 @@ type Index struct {
 	SystemID   string `json:"systemID"`
 	SystemName string `json:"systemName"`
 	SystemOS   string `json:"systemOS"`
+	AuthorID   string `json:"authorID,omitempty"`
+	AuthorName string `json:"authorName,omitempty"`
+	Sealed     string `json:"sealed,omitempty"` // 加密后的系统信息，参考 entity.Index.Sealed
 }
 
 // BaseCloud 描述了云端存储服务的基础实现。
 type BaseCloud struct {
 	*Conf
 	Cloud
+
+	apiOps apiOpsCounter // 按请求类型统计的请求次数
 }
 
 func (baseCloud *BaseCloud) CreateRepo(name string) (err error) {
@@ -219,6 +271,16 @@ func (baseCloud *BaseCloud) GetRepos() (repos []*Repo, size int64, err error) {
 	return
 }
 
+func (baseCloud *BaseCloud) RenameRepo(oldName, newName string) (err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) CopyRepo(src, dst string) (err error) {
+	err = ErrUnsupported
+	return
+}
+
 func (baseCloud *BaseCloud) UploadObject(filePath string, overwrite bool) (length int64, err error) {
 	err = ErrUnsupported
 	return
@@ -229,6 +291,11 @@ func (baseCloud *BaseCloud) UploadBytes(filePath string, data []byte, overwrite
 	return
 }
 
+func (baseCloud *BaseCloud) UploadObjects(filePaths []string, overwrite bool) (length int64, err error) {
+	err = ErrUnsupported
+	return
+}
+
 func (baseCloud *BaseCloud) DownloadObject(filePath string) (data []byte, err error) {
 	err = ErrUnsupported
 	return
@@ -281,6 +348,16 @@ func (baseCloud *BaseCloud) GetConcurrentReqs() int {
 	return 8
 }
 
+func (baseCloud *BaseCloud) Ping() (latency time.Duration, err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) Capabilities() (caps *Capabilities, err error) {
+	err = ErrUnsupported
+	return
+}
+
 func (baseCloud *BaseCloud) GetConf() *Conf {
 	return baseCloud.Conf
 }
@@ -293,6 +370,29 @@ func (baseCloud *BaseCloud) AddTraffic(*Traffic) {
 	return
 }
 
+// ForRepo 用于获取访问同一云端存储服务下名为 name 的仓库的 Cloud 实例，返回的实例与 c 共享连接配置。
+// S3 对象存储协议的仓库即存储桶，这里直接返回 c。
+func ForRepo(c Cloud, name string) (ret Cloud, err error) {
+	conf := *c.GetConf()
+	conf.Dir = name
+	baseCloud := &BaseCloud{Conf: &conf}
+	switch cl := c.(type) {
+	case *Local:
+		ret = NewLocal(baseCloud)
+	case *WebDAV:
+		ret = NewWebDAV(baseCloud, cl.Client)
+	case *SiYuan:
+		ret = NewSiYuan(baseCloud)
+	case *S3:
+		ret = c
+	case *Mock:
+		ret = cl.forRepo(name)
+	default:
+		err = ErrUnsupported
+	}
+	return
+}
+
 var (
 	ErrUnsupported             = errors.New("not supported yet")         // ErrUnsupported 描述了尚未支持的操作
 	ErrCloudObjectNotFound     = errors.New("cloud object not found")    // ErrCloudObjectNotFound 描述了云端存储服务中的对象不存在的错误
@@ -303,8 +403,43 @@ var (
 	ErrCloudCheckFailed        = errors.New("cloud check failed")        // ErrCloudCheckFailed 描述了云端存储服务检查失败的错误
 	ErrCloudForbidden          = errors.New("cloud forbidden")           // ErrCloudForbidden 描述了云端存储服务禁止访问的错误
 	ErrCloudTooManyRequests    = errors.New("cloud too many requests")   // ErrCloudTooManyRequests 描述了云端存储服务请求过多的错误
+	ErrCloudObjectCorrupted    = errors.New("cloud object corrupted")    // ErrCloudObjectCorrupted 描述了上传后校验发现云端对象不完整的错误
+	ErrCloudQuotaExceeded      = errors.New("cloud quota exceeded")      // ErrCloudQuotaExceeded 描述了云端存储空间或配额不足的错误
+	ErrCloudNetworkTimeout     = errors.New("cloud network timeout")     // ErrCloudNetworkTimeout 描述了请求云端存储服务超时的错误
+	ErrDeviceRevoked           = errors.New("device revoked")            // ErrDeviceRevoked 描述了当前设备已被吊销，不能再上传数据的错误
 )
 
+// ErrStatus 用于获取云端存储服务返回的错误 err 中的 HTTP 状态码 status 和服务端错误码 code，无法获取时 status 为 0，code 为空。
+//
+// 只识别各存储服务 SDK 的类型化错误：S3 的 smithy.APIError 和响应错误、WebDAV 的 gowebdav.StatusError、思源云端上传使用的七牛 client.ErrorInfo。
+func ErrStatus(err error) (status int, code string) {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status = respErr.HTTPStatusCode()
+		return
+	}
+
+	var davErr gowebdav.StatusError
+	if errors.As(err, &davErr) {
+		status = davErr.Status
+		return
+	}
+
+	var qiniuErr *client.ErrorInfo
+	if errors.As(err, &qiniuErr) {
+		status = qiniuErr.Code
+		if "" == code {
+			code = qiniuErr.ErrorCode
+		}
+	}
+	return
+}
+
 func IsValidCloudDirName(cloudDirName string) bool {
 	if 63 < len(cloudDirName) || 1 > len(cloudDirName) {
 		return false
@@ -0,0 +1,67 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrObjectArchived 描述了云端对象位于归档存储层（如 S3 Glacier、Deep Archive），需要先请求恢复才能下载的错误。
+var ErrObjectArchived = errors.New("cloud object archived")
+
+// 恢复归档对象的速度等级，越快费用越高，Deep Archive 不支持 RestoreTierExpedited。
+const (
+	RestoreTierExpedited = "Expedited" // 几分钟内完成
+	RestoreTierStandard  = "Standard"  // 几小时内完成
+	RestoreTierBulk      = "Bulk"      // 十几个小时到两天内完成，费用最低
+)
+
+// RestoreStatus 描述了云端对象的恢复状态。
+type RestoreStatus struct {
+	Archived   bool  `json:"archived"`   // 对象是否位于归档存储层
+	InProgress bool  `json:"inProgress"` // 是否正在恢复
+	Ready      bool  `json:"ready"`      // 是否可以下载，不在归档存储层的对象总是可以下载
+	Expiry     int64 `json:"expiry"`     // 恢复副本的过期时间，毫秒时间戳，0 表示未知
+}
+
+// ColdStorageCloud 描述了支持归档存储层的云端存储服务，旧快照的数据对象可以转存到归档存储层以降低费用，需要时再请求恢复。
+type ColdStorageCloud interface {
+
+	// RestoreObject 用于请求恢复归档对象 filePath，tier 为恢复速度等级，恢复后的副本保留 days 天。对象正在恢复时不会报错。
+	RestoreObject(filePath, tier string, days int) error
+
+	// GetRestoreStatus 用于获取对象 filePath 的恢复状态，对象不存在时返回 ErrCloudObjectNotFound。
+	GetRestoreStatus(filePath string) (*RestoreStatus, error)
+}
+
+// parseRestoreHeader 用于解析 x-amz-restore 响应头（形如 ongoing-request="false", expiry-date="Fri, 23 Dec 2012 00:00:00 GMT"）。
+func parseRestoreHeader(restore string, status *RestoreStatus) {
+	if "" == restore {
+		return
+	}
+
+	status.InProgress = strings.Contains(restore, `ongoing-request="true"`)
+	status.Ready = !status.InProgress
+	if _, expiry, ok := strings.Cut(restore, `expiry-date="`); ok {
+		expiry, _, _ = strings.Cut(expiry, `"`)
+		if t, err := http.ParseTime(expiry); nil == err {
+			status.Expiry = t.UnixMilli()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"fmt"
+)
+
+// DeviceRevoker 描述了支持在服务端吊销设备的云端存储服务，吊销后服务端拒绝该设备的上传请求。
+//
+// 目前仅官方存储服务支持，S3 和 WebDAV 等服务只能由客户端根据云端设备列表自行拒绝上传。
+type DeviceRevoker interface {
+
+	// RevokeDevice 用于在服务端吊销设备 deviceID。
+	RevokeDevice(deviceID string) (err error)
+}
+
+func (siyuan *SiYuan) RevokeDevice(deviceID string) (err error) {
+	token := siyuan.Conf.Token
+	server := siyuan.Conf.Server
+	userId := siyuan.Conf.UserID
+
+	result := map[string]interface{}{}
+	request := siyuan.newCloudRequest30s()
+	resp, err := request.
+		SetSuccessResult(&result).
+		SetBody(map[string]string{"repo": siyuan.Conf.Dir, "token": token, "deviceID": deviceID}).
+		Post(server + "/apis/siyuan/dejavu/revokeRepoDevice?uid=" + userId)
+	if nil != err {
+		err = fmt.Errorf("revoke device failed: %s", err)
+		return
+	}
+
+	if 200 != resp.StatusCode {
+		if 401 == resp.StatusCode {
+			err = ErrCloudAuthFailed
+			return
+		}
+		err = fmt.Errorf("revoke device failed [%d]", resp.StatusCode)
+		return
+	}
+
+	code := result["code"].(float64)
+	if 0 != code {
+		err = fmt.Errorf("revoke device failed: %s", result["msg"])
+		return
+	}
+	return
+}
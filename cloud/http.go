@@ -0,0 +1,168 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/httpclient"
+	"github.com/siyuan-note/logging"
+)
+
+// ConfHTTP 用于描述基于 HTTP 协议的云端存储服务的连接配置。
+//
+// 上传大量小对象时每次新建连接的开销很大，这里的默认值会尽量复用连接，零值字段使用默认值。
+type ConfHTTP struct {
+	MaxIdleConns        int  // 最大空闲连接数，默认为 100
+	MaxIdleConnsPerHost int  // 每个主机的最大空闲连接数，默认为 32，应该不小于并发请求数
+	MaxConnsPerHost     int  // 每个主机的最大连接数，默认为 0 即不限制
+	IdleConnTimeout     int  // 空闲连接保持时间，单位：秒，默认为 90
+	KeepAlive           int  // TCP keep-alive 探测间隔，单位：秒，默认为 30
+	DisableHTTP2        bool // 是否禁用 HTTP/2，有些服务器在并发请求时使用 HTTP/2 会报错
+
+	// 代理地址，支持 http、https 和 socks5 协议，如 socks5://127.0.0.1:1080，为空时使用环境变量中配置的代理
+	Proxy string
+
+	// 自定义根证书 PEM 文件路径，会和系统根证书一起使用，用于信任企业网络中 TLS 拦截代理的证书
+	RootCAs string
+}
+
+// hasCustomNetwork 用于判断是否配置了代理或者自定义根证书。
+func (conf *ConfHTTP) hasCustomNetwork() bool {
+	return nil != conf && ("" != conf.Proxy || "" != conf.RootCAs)
+}
+
+var (
+	transports     = map[string]*http.Transport{}
+	transportsLock = sync.Mutex{}
+)
+
+// NewHTTPClient 用于按照 conf 构建访问云端存储服务的 HTTP 客户端，相同配置的客户端共享同一个连接池。
+//
+// 配置了按操作类别区分的超时时，客户端不设置整体超时时间。
+func NewHTTPClient(conf *Conf) *http.Client {
+	return &http.Client{Transport: roundTripper(conf)}
+}
+
+// roundTripper 用于获取 conf 对应的 RoundTripper，配置了按操作类别区分的超时时包装共享 Transport。
+func roundTripper(conf *Conf) http.RoundTripper {
+	if nil != conf.Timeouts {
+		return NewTimeoutTransport(sharedTransport(conf), conf.Timeouts)
+	}
+	return sharedTransport(conf)
+}
+
+// sharedTransport 用于获取 conf 对应的共享 Transport，连接池只有在共享 Transport 时才能跨客户端复用。
+func sharedTransport(conf *Conf) *http.Transport {
+	httpConf := &ConfHTTP{}
+	if nil != conf.HTTP {
+		httpConf = conf.HTTP
+	}
+	skipTlsVerify := (nil != conf.S3 && conf.S3.SkipTlsVerify) || (nil != conf.WebDAV && conf.WebDAV.SkipTlsVerify)
+
+	key := fmt.Sprintf("%+v|%v", *httpConf, skipTlsVerify)
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if ret := transports[key]; nil != ret {
+		return ret
+	}
+
+	ret := newTransport(httpConf, skipTlsVerify)
+	transports[key] = ret
+	return ret
+}
+
+func newTransport(conf *ConfHTTP, skipTlsVerify bool) (ret *http.Transport) {
+	maxIdleConns := conf.MaxIdleConns
+	if 1 > maxIdleConns {
+		maxIdleConns = 100
+	}
+	maxIdleConnsPerHost := conf.MaxIdleConnsPerHost
+	if 1 > maxIdleConnsPerHost {
+		maxIdleConnsPerHost = 32
+	}
+	idleConnTimeout := conf.IdleConnTimeout
+	if 1 > idleConnTimeout {
+		idleConnTimeout = 90
+	}
+	keepAlive := conf.KeepAlive
+	if 1 > keepAlive {
+		keepAlive = 30
+	}
+
+	proxy := httpclient.ProxyFromEnvironment
+	if "" != conf.Proxy {
+		if proxyURL, parseErr := url.Parse(conf.Proxy); nil != parseErr {
+			logging.LogErrorf("parse proxy [%s] failed: %s", conf.Proxy, parseErr)
+		} else {
+			proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: skipTlsVerify}
+	if "" != conf.RootCAs {
+		tlsConf.RootCAs = loadRootCAs(conf.RootCAs)
+	}
+
+	ret = &http.Transport{
+		Proxy: proxy,
+		DialContext: dialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: time.Duration(keepAlive) * time.Second,
+		}),
+		ForceAttemptHTTP2:     !conf.DisableHTTP2,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       conf.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(idleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConf,
+	}
+	if conf.DisableHTTP2 {
+		// 非 nil 的空映射会禁用 TLS 上的 HTTP/2 协商
+		ret.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return
+}
+
+// loadRootCAs 用于加载系统根证书和 PEM 文件 caPath 中的证书，加载失败时返回 nil 即使用系统根证书。
+func loadRootCAs(caPath string) (ret *x509.CertPool) {
+	data, err := os.ReadFile(caPath)
+	if nil != err {
+		logging.LogErrorf("read root CAs [%s] failed: %s", caPath, err)
+		return
+	}
+
+	ret, err = x509.SystemCertPool()
+	if nil != err || nil == ret {
+		ret = x509.NewCertPool()
+	}
+	if !ret.AppendCertsFromPEM(data) {
+		logging.LogErrorf("no certificate found in root CAs [%s]", caPath)
+		return nil
+	}
+	return
+}
@@ -17,12 +17,16 @@
 package cloud
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"math"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/88250/gulu"
 	"github.com/siyuan-note/dejavu/entity"
@@ -54,6 +58,24 @@ func (local *Local) RemoveRepo(name string) (err error) {
 	return
 }
 
+func (local *Local) RenameRepo(oldName, newName string) (err error) {
+	err = os.Rename(path.Join(local.Local.Endpoint, oldName), path.Join(local.Local.Endpoint, newName))
+	if os.IsNotExist(err) {
+		err = ErrCloudObjectNotFound
+	}
+	return
+}
+
+func (local *Local) CopyRepo(src, dst string) (err error) {
+	srcPath := path.Join(local.Local.Endpoint, src)
+	if !gulu.File.IsDir(srcPath) {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	err = gulu.File.Copy(srcPath, path.Join(local.Local.Endpoint, dst))
+	return
+}
+
 func (local *Local) GetRepos() (repos []*Repo, size int64, err error) {
 	repos, err = local.listRepos()
 	if err != nil {
@@ -67,7 +89,7 @@ func (local *Local) GetRepos() (repos []*Repo, size int64, err error) {
 }
 
 func (local *Local) UploadObject(filePath string, overwrite bool) (length int64, err error) {
-	absFilePath := filepath.Join(local.Conf.RepoPath, filePath)
+	absFilePath := local.Conf.LocalPath(filePath)
 	data, err := os.ReadFile(absFilePath)
 	if err != nil {
 		return
@@ -106,10 +128,38 @@ func (local *Local) UploadBytes(filePath string, data []byte, overwrite bool) (l
 
 	length = int64(len(data))
 
+	if local.Conf.VerifyUpload {
+		if err = local.verifyObject(key, data); nil != err {
+			return
+		}
+	}
+
 	//logging.LogInfof("uploaded object [%s]", key)
 	return
 }
 
+// verifyObject 用于回读刚上传的对象 key，校验内容是否和上传的数据 data 一致。
+func (local *Local) verifyObject(key string, data []byte) (err error) {
+	uploaded, err := os.ReadFile(key)
+	if nil != err {
+		logging.LogErrorf("read uploaded object [%s] failed: %s", key, err)
+		return
+	}
+
+	if !bytes.Equal(data, uploaded) {
+		logging.LogErrorf("verify uploaded object [%s] failed: expected size [%d], actual size [%d]", key, len(data), len(uploaded))
+		err = ErrCloudObjectCorrupted
+		return
+	}
+	return
+}
+
+func (local *Local) UploadObjects(filePaths []string, overwrite bool) (length int64, err error) {
+	return uploadObjectsParallel(filePaths, local.GetConcurrentReqs(), func(filePath string) (int64, error) {
+		return local.UploadObject(filePath, overwrite)
+	})
+}
+
 func (local *Local) DownloadObject(filePath string) (data []byte, err error) {
 	key := path.Join(local.getCurrentRepoDirPath(), filePath)
 	data, err = os.ReadFile(key)
@@ -124,6 +174,59 @@ func (local *Local) DownloadObject(filePath string) (data []byte, err error) {
 	return
 }
 
+func (local *Local) DownloadObjectRange(filePath string, offset, length int64) (data []byte, size int64, err error) {
+	key := path.Join(local.getCurrentRepoDirPath(), filePath)
+	f, err := os.Open(key)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = ErrCloudObjectNotFound
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if nil != err {
+		return
+	}
+	size = info.Size()
+	if offset >= size {
+		return
+	}
+	data = make([]byte, min(length, size-offset))
+	_, err = f.ReadAt(data, offset)
+	return
+}
+
+// localCASLock 用于保证本地存储服务条件写入的原子性，仅对同一进程内的写入有效。
+var localCASLock = sync.Mutex{}
+
+func (local *Local) DownloadObjectETag(filePath string) (data []byte, etag string, err error) {
+	if data, err = local.DownloadObject(filePath); nil != err {
+		return
+	}
+	etag = util.Hash(data)
+	return
+}
+
+// UploadBytesIfMatch 使用对象数据的哈希值作为版本标识进行条件写入。
+func (local *Local) UploadBytesIfMatch(filePath string, data []byte, etag string) (length int64, err error) {
+	localCASLock.Lock()
+	defer localCASLock.Unlock()
+
+	current, currentETag, err := local.DownloadObjectETag(filePath)
+	if nil != err && !errors.Is(err, ErrCloudObjectNotFound) {
+		return
+	}
+	if (nil == err) == ("" == etag) || (nil != current && currentETag != etag) {
+		err = ErrCloudPreconditionFailed
+		return
+	}
+
+	length, err = local.UploadBytes(filePath, data, true)
+	return
+}
+
 func (local *Local) RemoveObject(filePath string) (err error) {
 	key := path.Join(local.getCurrentRepoDirPath(), filePath)
 	err = os.Remove(key)
@@ -295,6 +398,26 @@ func (local *Local) GetConcurrentReqs() (ret int) {
 	return
 }
 
+func (local *Local) Ping() (latency time.Duration, err error) {
+	start := time.Now()
+	info, err := os.Stat(local.Local.Endpoint)
+	if nil != err {
+		logging.LogErrorf("stat local endpoint [%s] failed: %s", local.Local.Endpoint, err)
+		return
+	}
+	if !info.IsDir() {
+		err = fmt.Errorf("local endpoint [%s] is not a directory", local.Local.Endpoint)
+		return
+	}
+	latency = time.Since(start)
+	return
+}
+
+func (local *Local) Capabilities() (caps *Capabilities, err error) {
+	caps, err = probeCapabilities(local, ConsistencyStrong)
+	return
+}
+
 func (local *Local) GetConf() *Conf {
 	return local.Conf
 }
@@ -393,8 +516,7 @@ func (local *Local) repoIndex(id string) (index *entity.Index, err error) {
 		return
 	}
 
-	index = &entity.Index{}
-	err = gulu.JSON.UnmarshalJSON(data, index)
+	index, err = entity.UnmarshalIndex(data)
 	if err != nil {
 		return
 	}
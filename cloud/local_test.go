@@ -0,0 +1,66 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLocalVerifyUpload(t *testing.T) {
+	local := NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:          "test",
+		UserID:       "0",
+		VerifyUpload: true,
+		Local:        &ConfLocal{Endpoint: t.TempDir()},
+	}})
+
+	data := []byte("Hello, DejaVu!")
+	filePath := "objects/00/" + "11111111111111111111111111111111111111"
+	if _, err := local.UploadBytes(filePath, data, true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+
+	// 模拟存储服务静默截断对象
+	key := path.Join(local.getCurrentRepoDirPath(), filePath)
+	if err := os.Truncate(key, 5); nil != err {
+		t.Fatalf("truncate failed: %s", err)
+		return
+	}
+	if err := local.verifyObject(key, data); !errors.Is(err, ErrCloudObjectCorrupted) {
+		t.Fatalf("truncated object should be corrupted: %v", err)
+		return
+	}
+
+	// 大小相同但内容不同也需要发现
+	corrupted := []byte("Hello, DejaVu?")
+	if err := os.WriteFile(key, corrupted, 0644); nil != err {
+		t.Fatalf("write failed: %s", err)
+		return
+	}
+	if err := local.verifyObject(key, data); !errors.Is(err, ErrCloudObjectCorrupted) {
+		t.Fatalf("modified object should be corrupted: %v", err)
+		return
+	}
+	if err := local.verifyObject(key, corrupted); nil != err {
+		t.Fatalf("verify failed: %s", err)
+		return
+	}
+}
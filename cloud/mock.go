@@ -0,0 +1,584 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+)
+
+// MockFaults 描述了模拟云端存储服务注入的延迟、错误和一致性异常。
+type MockFaults struct {
+	Seed int64 // 随机数种子，相同的种子和请求顺序会注入相同的错误和延迟
+
+	Latency       time.Duration // 每个请求的固定延迟
+	LatencyJitter time.Duration // 每个请求在固定延迟之上增加的随机延迟上限
+
+	ErrorRate float64 // 请求失败的概率，取值 0~1
+	Error     error   // 请求失败时返回的错误，为 nil 时返回 ErrCloudServiceUnavailable
+
+	// 引用（refs/ 下的对象，比如 refs/latest）更新后在该时长内读取仍然返回更新前的版本，用于模拟最终一致的存储服务
+	StaleRefs time.Duration
+
+	// 按请求类型 op（MockOpUpload、MockOpDownload、MockOpRemove、MockOpList、MockOpPing）和对象 key 注入错误，返回非 nil 时该请求失败
+	Inject func(op, key string) error
+}
+
+const (
+	MockOpUpload   = "upload"   // 上传对象
+	MockOpDownload = "download" // 下载对象
+	MockOpRemove   = "remove"   // 删除对象
+	MockOpList     = "list"     // 列出对象、引用和仓库
+	MockOpPing     = "ping"     // 检查连通性
+)
+
+// Mock 描述了保存在内存中的模拟云端存储服务，可以注入延迟、错误和一致性异常，用于集成测试。
+//
+// 通过 ForRepo 获取的同一服务下的其他仓库和原实例共享数据和注入配置。
+type Mock struct {
+	*BaseCloud
+	*mockService
+}
+
+type mockService struct {
+	lock     sync.Mutex
+	repos    map[string]map[string]*mockObject // 仓库名称 -> 对象 key -> 对象
+	faults   *MockFaults
+	rand     *rand.Rand
+	requests map[string]int
+	traffic  Traffic
+}
+
+type mockObject struct {
+	data    []byte
+	prev    []byte // 更新前的数据，不存在时为 nil
+	updated time.Time
+}
+
+// NewMock 创建一个模拟云端存储服务，faults 为 nil 时不注入任何异常。
+func NewMock(baseCloud *BaseCloud, faults *MockFaults) (ret *Mock) {
+	ret = &Mock{BaseCloud: baseCloud, mockService: &mockService{repos: map[string]map[string]*mockObject{}, requests: map[string]int{}}}
+	ret.SetFaults(faults)
+	baseCloud.Cloud = ret
+	return
+}
+
+// SetFaults 用于修改注入的异常，faults 为 nil 时不注入任何异常。
+func (mock *Mock) SetFaults(faults *MockFaults) {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+
+	if nil == faults {
+		faults = &MockFaults{}
+	}
+	mock.faults = faults
+	mock.rand = rand.New(rand.NewSource(faults.Seed))
+}
+
+// Requests 用于获取类型为 op 的请求次数，包括注入失败的请求。
+func (mock *Mock) Requests(op string) int {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	return mock.requests[op]
+}
+
+// Traffic 用于获取通过 AddTraffic 统计的流量。
+func (mock *Mock) Traffic() Traffic {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	return mock.traffic
+}
+
+func (mock *Mock) forRepo(name string) *Mock {
+	conf := *mock.Conf
+	conf.Dir = name
+	baseCloud := &BaseCloud{Conf: &conf}
+	ret := &Mock{BaseCloud: baseCloud, mockService: mock.mockService}
+	baseCloud.Cloud = ret
+	return ret
+}
+
+// request 用于模拟一次请求的延迟并按注入配置返回错误。
+func (mock *Mock) request(op, key string) (err error) {
+	mock.countAPIOp(mockAPIOps[op])
+	mock.lock.Lock()
+	mock.requests[op]++
+	faults := mock.faults
+	latency := faults.Latency
+	if 0 < faults.LatencyJitter {
+		latency += time.Duration(mock.rand.Int63n(int64(faults.LatencyJitter)))
+	}
+	failed := 0 < faults.ErrorRate && mock.rand.Float64() < faults.ErrorRate
+	mock.lock.Unlock()
+
+	if 0 < latency {
+		time.Sleep(latency)
+	}
+	if nil != faults.Inject {
+		if err = faults.Inject(op, key); nil != err {
+			return
+		}
+	}
+	if failed {
+		err = faults.Error
+		if nil == err {
+			err = ErrCloudServiceUnavailable
+		}
+	}
+	return
+}
+
+// objects 用于获取当前仓库的对象，调用方需要持有锁。
+func (mock *Mock) objects() map[string]*mockObject {
+	ret := mock.repos[mock.Dir]
+	if nil == ret {
+		ret = map[string]*mockObject{}
+		mock.repos[mock.Dir] = ret
+	}
+	return ret
+}
+
+// read 用于读取对象 key 的数据，引用处于 StaleRefs 时长内时返回更新前的数据，调用方需要持有锁。
+func (mock *Mock) read(key string) (data []byte, ok bool) {
+	obj := mock.objects()[key]
+	if nil == obj {
+		return
+	}
+	if strings.HasPrefix(key, "refs/") && time.Since(obj.updated) < mock.faults.StaleRefs {
+		data, ok = obj.prev, nil != obj.prev
+		return
+	}
+	data, ok = obj.data, true
+	return
+}
+
+func cleanMockKey(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filePath), "/")
+}
+
+func (mock *Mock) CreateRepo(name string) (err error) {
+	if err = mock.request(MockOpUpload, name); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if _, ok := mock.repos[name]; !ok {
+		mock.repos[name] = map[string]*mockObject{}
+	}
+	return
+}
+
+func (mock *Mock) RemoveRepo(name string) (err error) {
+	if err = mock.request(MockOpRemove, name); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	delete(mock.repos, name)
+	return
+}
+
+func (mock *Mock) GetRepos() (repos []*Repo, size int64, err error) {
+	if err = mock.request(MockOpList, ""); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	for name, objects := range mock.repos {
+		repo := &Repo{Name: name}
+		var updated time.Time
+		for _, obj := range objects {
+			repo.Size += int64(len(obj.data))
+			if obj.updated.After(updated) {
+				updated = obj.updated
+			}
+		}
+		repo.Updated = updated.Local().Format("2006-01-02 15:04:05")
+		size += repo.Size
+		repos = append(repos, repo)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	return
+}
+
+func (mock *Mock) RenameRepo(oldName, newName string) (err error) {
+	if err = mock.request(MockOpUpload, newName); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if _, ok := mock.repos[newName]; ok {
+		err = os.ErrExist
+		return
+	}
+	mock.repos[newName] = mock.repos[oldName]
+	delete(mock.repos, oldName)
+	return
+}
+
+func (mock *Mock) CopyRepo(src, dst string) (err error) {
+	if err = mock.request(MockOpUpload, dst); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	objects := map[string]*mockObject{}
+	for key, obj := range mock.repos[src] {
+		copied := *obj
+		objects[key] = &copied
+	}
+	mock.repos[dst] = objects
+	return
+}
+
+func (mock *Mock) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	data, err := os.ReadFile(mock.Conf.LocalPath(filePath))
+	if nil != err {
+		return
+	}
+	length, err = mock.UploadBytes(filePath, data, overwrite)
+	return
+}
+
+func (mock *Mock) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	key := cleanMockKey(filePath)
+	if err = mock.request(MockOpUpload, key); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	objects := mock.objects()
+	obj := objects[key]
+	if nil != obj && !overwrite {
+		length = int64(len(data))
+		return
+	}
+	if nil == obj {
+		obj = &mockObject{}
+		objects[key] = obj
+	}
+	obj.prev, obj.data, obj.updated = obj.data, append([]byte{}, data...), time.Now()
+	length = int64(len(data))
+	return
+}
+
+func (mock *Mock) UploadObjects(filePaths []string, overwrite bool) (length int64, err error) {
+	return uploadObjectsParallel(filePaths, mock.GetConcurrentReqs(), func(filePath string) (int64, error) {
+		return mock.UploadObject(filePath, overwrite)
+	})
+}
+
+func (mock *Mock) DownloadObject(filePath string) (data []byte, err error) {
+	key := cleanMockKey(filePath)
+	if err = mock.request(MockOpDownload, key); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	stored, ok := mock.read(key)
+	if !ok {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	data = append([]byte{}, stored...)
+	return
+}
+
+func (mock *Mock) DownloadObjectRange(filePath string, offset, length int64) (data []byte, size int64, err error) {
+	key := cleanMockKey(filePath)
+	if err = mock.request(MockOpDownload, key); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	stored, ok := mock.read(key)
+	if !ok {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	size = int64(len(stored))
+	if offset < size {
+		data = append([]byte{}, stored[offset:min(offset+length, size)]...)
+	}
+	return
+}
+
+// DownloadObjectETag 读取的是最新版本，和 S3 的条件读取一样不受 StaleRefs 影响。
+func (mock *Mock) DownloadObjectETag(filePath string) (data []byte, etag string, err error) {
+	key := cleanMockKey(filePath)
+	if err = mock.request(MockOpDownload, key); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	obj := mock.objects()[key]
+	if nil == obj {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	data = append([]byte{}, obj.data...)
+	etag = util.Hash(data)
+	return
+}
+
+// UploadBytesIfMatch 使用对象数据的哈希值作为版本标识进行条件写入。
+func (mock *Mock) UploadBytesIfMatch(filePath string, data []byte, etag string) (length int64, err error) {
+	key := cleanMockKey(filePath)
+	if err = mock.request(MockOpUpload, key); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	objects := mock.objects()
+	obj := objects[key]
+	if (nil == obj) != ("" == etag) || (nil != obj && util.Hash(obj.data) != etag) {
+		err = ErrCloudPreconditionFailed
+		return
+	}
+	if nil == obj {
+		obj = &mockObject{}
+		objects[key] = obj
+	}
+	obj.prev, obj.data, obj.updated = obj.data, append([]byte{}, data...), time.Now()
+	length = int64(len(data))
+	return
+}
+
+func (mock *Mock) RemoveObject(filePath string) (err error) {
+	key := cleanMockKey(filePath)
+	if err = mock.request(MockOpRemove, key); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	delete(mock.objects(), key)
+	return
+}
+
+func (mock *Mock) ListObjects(pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	prefix := cleanMockKey(pathPrefix)
+	if err = mock.request(MockOpList, prefix); nil != err {
+		return
+	}
+	if "" != prefix {
+		prefix += "/"
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	objInfos = map[string]*entity.ObjectInfo{}
+	for key, obj := range mock.objects() {
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if dir, _, isDir := strings.Cut(name, "/"); isDir {
+			objInfos[dir] = &entity.ObjectInfo{Path: dir}
+			continue
+		}
+		objInfos[name] = &entity.ObjectInfo{Path: name, Size: int64(len(obj.data))}
+	}
+	return
+}
+
+func (mock *Mock) GetTags() (tags []*Ref, err error) {
+	tags, err = mock.listRefs("refs/tags/")
+	if 1 > len(tags) {
+		tags = []*Ref{}
+	}
+	return
+}
+
+func (mock *Mock) GetIndexes(page int) (indexes []*entity.Index, pageCount, totalCount int, err error) {
+	data, err := mock.DownloadObject("indexes-v2.json")
+	if nil != err {
+		if ErrCloudObjectNotFound == err {
+			err = nil
+		}
+		return
+	}
+	if data, err = compressDecoder.DecodeAll(data, nil); nil != err {
+		return
+	}
+	indexesJSON := &Indexes{}
+	if err = gulu.JSON.UnmarshalJSON(data, indexesJSON); nil != err {
+		return
+	}
+
+	totalCount = len(indexesJSON.Indexes)
+	pageCount = int(math.Ceil(float64(totalCount) / float64(pageSize)))
+	start := (page - 1) * pageSize
+	end := page * pageSize
+	if end > totalCount {
+		end = totalCount
+	}
+	for i := start; i < end; i++ {
+		index, getErr := mock.GetIndex(indexesJSON.Indexes[i].ID)
+		if nil != getErr {
+			continue
+		}
+		index.Files = nil
+		indexes = append(indexes, index)
+	}
+	return
+}
+
+func (mock *Mock) GetRefsFiles() (fileIDs []string, refs []*Ref, err error) {
+	if refs, err = mock.listRefs("refs/"); nil != err {
+		return
+	}
+
+	var files []string
+	for _, ref := range refs {
+		index, getErr := mock.GetIndex(ref.ID)
+		if nil != getErr {
+			err = getErr
+			return
+		}
+		files = append(files, index.Files...)
+	}
+	fileIDs = gulu.Str.RemoveDuplicatedElem(files)
+	if 1 > len(fileIDs) {
+		fileIDs = []string{}
+	}
+	return
+}
+
+func (mock *Mock) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	if err = mock.request(MockOpList, "objects"); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	objects := mock.objects()
+	for _, chunkID := range checkChunkIDs {
+		if _, ok := objects[path.Join("objects", chunkID[:2], chunkID[2:])]; !ok {
+			chunkIDs = append(chunkIDs, chunkID)
+		}
+	}
+	chunkIDs = gulu.Str.RemoveDuplicatedElem(chunkIDs)
+	if 1 > len(chunkIDs) {
+		chunkIDs = []string{}
+	}
+	return
+}
+
+func (mock *Mock) GetIndex(id string) (index *entity.Index, err error) {
+	data, err := mock.DownloadObject(path.Join("indexes", id))
+	if nil != err {
+		return
+	}
+	if data, err = compressDecoder.DecodeAll(data, nil); nil != err {
+		return
+	}
+	index, err = entity.UnmarshalIndex(data)
+	return
+}
+
+func (mock *Mock) GetConcurrentReqs() int {
+	return 16
+}
+
+func (mock *Mock) Ping() (latency time.Duration, err error) {
+	start := time.Now()
+	if err = mock.request(MockOpPing, ""); nil != err {
+		return
+	}
+	latency = time.Since(start)
+	return
+}
+
+func (mock *Mock) Capabilities() (caps *Capabilities, err error) {
+	mock.lock.Lock()
+	consistency := ConsistencyStrong
+	if 0 < mock.faults.StaleRefs {
+		consistency = ConsistencyEventual
+	}
+	mock.lock.Unlock()
+
+	caps, err = probeCapabilities(mock, consistency)
+	return
+}
+
+func (mock *Mock) GetConf() *Conf {
+	return mock.Conf
+}
+
+func (mock *Mock) GetAvailableSize() int64 {
+	if 0 < mock.Conf.AvailableSize {
+		return mock.Conf.AvailableSize
+	}
+	return math.MaxInt64
+}
+
+func (mock *Mock) AddTraffic(traffic *Traffic) {
+	if nil == traffic {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	mock.traffic.UploadBytes += traffic.UploadBytes
+	mock.traffic.DownloadBytes += traffic.DownloadBytes
+	mock.traffic.APIGet += traffic.APIGet
+	mock.traffic.APIPut += traffic.APIPut
+}
+
+// listRefs 用于列出 prefix 下（不包括子文件夹）的引用。
+func (mock *Mock) listRefs(prefix string) (refs []*Ref, err error) {
+	if err = mock.request(MockOpList, prefix); nil != err {
+		return
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	for key, obj := range mock.objects() {
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || strings.Contains(name, "/") {
+			continue
+		}
+		data, found := mock.read(key)
+		if !found {
+			continue
+		}
+		refs = append(refs, &Ref{Name: name, ID: string(data), Updated: obj.updated.Local().Format("2006-01-02 15:04:05")})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return
+}
@@ -0,0 +1,64 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidObjectLockMode 描述了配置的对象锁定模式不是 ObjectLockGovernance 或者 ObjectLockCompliance。
+var ErrInvalidObjectLockMode = errors.New("invalid object lock mode")
+
+// 对象锁定模式，参考 S3 Object Lock。
+const (
+	ObjectLockGovernance = "GOVERNANCE" // 有特殊权限的用户可以提前删除或者缩短保留期
+	ObjectLockCompliance = "COMPLIANCE" // 保留期内任何用户都不能删除对象或者缩短保留期
+)
+
+// ObjectLockCloud 描述了支持对象锁定的云端存储服务，上传的快照对象在保留期内不能被覆盖或者删除。
+//
+// 数据对象按内容寻址，已经存在的对象不会重新上传，新的快照引用这些对象时需要调用 ExtendObjectLocks 延长保留期。
+type ObjectLockCloud interface {
+
+	// ObjectLockDays 返回配置的对象锁定保留天数，未开启对象锁定时返回 0。
+	ObjectLockDays() int
+
+	// ExtendObjectLocks 用于将对象 filePaths 的保留期延长到 until。
+	ExtendObjectLocks(filePaths []string, until time.Time) error
+}
+
+// ObjectLockUntil 返回在 now 上传或者延长保留期的对象的保留截止时间。
+//
+// 在保留天数 days 之外再保留 days/2（至少 1 天）的余量，这样同一个对象被新的快照引用时最多每 days/2 天才需要延长一次保留期。
+func ObjectLockUntil(now time.Time, days int) time.Time {
+	slack := days / 2
+	if 1 > slack {
+		slack = 1
+	}
+	return now.AddDate(0, 0, days+slack)
+}
+
+// checkObjectLockMode 用于检查对象锁定模式 mode 是否有效，为空表示不锁定。
+func checkObjectLockMode(mode string) (err error) {
+	switch mode {
+	case "", ObjectLockGovernance, ObjectLockCompliance:
+		return
+	}
+	err = ErrInvalidObjectLockMode
+	return
+}
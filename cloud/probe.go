@@ -0,0 +1,87 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	ConsistencyStrong   = "strong"   // 写入后立即可读
+	ConsistencyEventual = "eventual" // 写入后可能需要一段时间才能读到
+)
+
+// Capabilities 描述了云端存储服务的连通性和能力探测结果。
+type Capabilities struct {
+	Latency     time.Duration `json:"latency"`     // 探测请求往返耗时
+	Writable    bool          `json:"writable"`    // 是否可写入对象
+	Listable    bool          `json:"listable"`    // 是否支持列出对象
+	Consistency string        `json:"consistency"` // 一致性模型，ConsistencyStrong 或 ConsistencyEventual
+}
+
+// probeCapabilities 用于探测云端存储服务 c 的能力。
+//
+// 探测时会在 check/probe/ 下写入、读取并删除一个临时对象，读取到的数据和写入的不一致时视为不可写。
+func probeCapabilities(c Cloud, consistency string) (ret *Capabilities, err error) {
+	ret = &Capabilities{Consistency: consistency}
+	ret.Latency, err = c.Ping()
+	if nil != err {
+		logging.LogErrorf("ping cloud failed: %s", err)
+		return
+	}
+
+	key := path.Join("check", "probe", util.RandHash())
+	data := []byte(key)
+	if _, err = c.UploadBytes(key, data, true); nil != err {
+		logging.LogErrorf("probe cloud upload failed: %s", err)
+		return
+	}
+	defer func() {
+		if removeErr := c.RemoveObject(key); nil != removeErr {
+			logging.LogWarnf("remove probe object [%s] failed: %s", key, removeErr)
+		}
+	}()
+
+	downloaded, downloadErr := c.DownloadObject(key)
+	if nil != downloadErr {
+		if !errors.Is(downloadErr, ErrCloudObjectNotFound) || ConsistencyStrong == consistency {
+			logging.LogErrorf("probe cloud download failed: %s", downloadErr)
+			err = downloadErr
+			return
+		}
+		// 最终一致的存储服务刚写入的对象可能暂时读不到
+		ret.Writable = true
+	} else {
+		ret.Writable = bytes.Equal(data, downloaded)
+		if !ret.Writable {
+			logging.LogErrorf("probe cloud object [%s] mismatch: expected [%d] bytes, actual [%d] bytes", key, len(data), len(downloaded))
+		}
+	}
+
+	if _, listErr := c.ListObjects("check/probe/"); nil == listErr {
+		ret.Listable = true
+	} else if !errors.Is(listErr, ErrUnsupported) {
+		logging.LogWarnf("probe cloud list objects failed: %s", listErr)
+	}
+	return
+}
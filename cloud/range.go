@@ -0,0 +1,43 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RangeCloud 描述了支持按范围下载对象的云端存储服务，用于并发分段下载大对象。
+type RangeCloud interface {
+
+	// DownloadObjectRange 用于下载对象从 offset 开始最多 length 字节的数据 data，size 为对象的总大小。
+	// 存储服务忽略范围请求时返回完整的对象数据，调用方需要按 len(data) 和 size 判断。
+	DownloadObjectRange(filePath string, offset, length int64) (data []byte, size int64, err error)
+}
+
+// parseContentRangeSize 用于从 Content-Range 响应头（形如 bytes 0-99/1234）中解析对象的总大小，解析失败时返回 -1。
+func parseContentRangeSize(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(total), 10, 64)
+	if nil != err {
+		return -1
+	}
+	return size
+}
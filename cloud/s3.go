@@ -19,13 +19,15 @@ package cloud
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -52,9 +54,26 @@ type S3 struct {
 }
 
 func NewS3(baseCloud *BaseCloud, httpClient *http.Client) *S3 {
+	if nil == httpClient || nil != baseCloud.Conf.HTTP || nil != baseCloud.Conf.Timeouts {
+		// 配置了连接参数时使用共享连接池，保留调用方设置的超时，配置了按操作类别区分的超时时由其覆盖整体超时
+		client := NewHTTPClient(baseCloud.Conf)
+		if nil != httpClient && nil == baseCloud.Conf.Timeouts {
+			client.Timeout = httpClient.Timeout
+		}
+		httpClient = client
+	}
 	return &S3{BaseCloud: baseCloud, HTTPClient: httpClient}
 }
 
+// timeout 用于获取一次操作的整体超时时间，配置了按操作类别区分的超时时不小于其中最长的超时时间，单个请求的超时由 TimeoutTransport 控制。
+func (s3 *S3) timeout() time.Duration {
+	ret := time.Duration(s3.S3.Timeout) * time.Second
+	if nil != s3.Conf.Timeouts {
+		ret = max(ret, s3.Conf.Timeouts.longest())
+	}
+	return ret
+}
+
 func (s3 *S3) GetRepos() (repos []*Repo, size int64, err error) {
 	repos, err = s3.listRepos()
 	if nil != err {
@@ -67,12 +86,74 @@ func (s3 *S3) GetRepos() (repos []*Repo, size int64, err error) {
 	return
 }
 
+// RenameRepo 用于重命名仓库，S3 对象存储协议的仓库即存储桶，存储桶不支持重命名。
+func (s3 *S3) RenameRepo(oldName, newName string) (err error) {
+	err = ErrUnsupported
+	return
+}
+
+// CopyRepo 用于将存储桶 src 中的仓库对象在服务端复制到已经存在的存储桶 dst 中。
+func (s3 *S3) CopyRepo(src, dst string) (err error) {
+	if src != s3.S3.Bucket {
+		err = ErrCloudObjectNotFound
+		return
+	}
+
+	objInfos, err := s3.ListObjects("/")
+	if nil != err {
+		return
+	}
+	if 1 > len(objInfos) {
+		return
+	}
+
+	poolSize := s3.GetConcurrentReqs()
+	if poolSize > len(objInfos) {
+		poolSize = len(objInfos)
+	}
+
+	svc := s3.getService()
+	waitGroup := &sync.WaitGroup{}
+	var copyErr error
+	errLock := sync.Mutex{}
+	p, _ := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		key := path.Join("repo", arg.(string))
+		ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+		defer cancelFn()
+		_, cErr := svc.CopyObject(ctx, &as3.CopyObjectInput{
+			Bucket:     aws.String(dst),
+			Key:        aws.String(key),
+			CopySource: aws.String(path.Join(src, key)),
+		})
+		if nil != cErr {
+			logging.LogErrorf("copy object [%s] to bucket [%s] failed: %s", key, dst, cErr)
+			errLock.Lock()
+			copyErr = cErr
+			errLock.Unlock()
+		}
+	})
+
+	for filePath := range objInfos {
+		waitGroup.Add(1)
+		err = p.Invoke(filePath)
+		if nil != err {
+			logging.LogErrorf("invoke failed: %s", err)
+			return
+		}
+	}
+	waitGroup.Wait()
+	p.Release()
+	err = copyErr
+	return
+}
+
 func (s3 *S3) UploadObject(filePath string, overwrite bool) (length int64, err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 
-	absFilePath := filepath.Join(s3.Conf.RepoPath, filePath)
+	absFilePath := s3.Conf.LocalPath(filePath)
 	info, err := os.Stat(absFilePath)
 	if nil != err {
 		logging.LogErrorf("stat failed: %s", err)
@@ -86,16 +167,35 @@ func (s3 *S3) UploadObject(filePath string, overwrite bool) (length int64, err e
 	}
 	defer file.Close()
 	key := path.Join("repo", filePath)
-	_, err = svc.PutObject(ctx, &as3.PutObjectInput{
+	input := &as3.PutObjectInput{
 		Bucket:       aws.String(s3.Conf.S3.Bucket),
 		Key:          aws.String(key),
 		CacheControl: aws.String("no-cache"),
 		Body:         file,
-	})
+	}
+	if err = s3.setObjectLock(input, filePath); nil != err {
+		return
+	}
+	if s3.Conf.VerifyUpload {
+		hash := md5.New()
+		if _, err = io.Copy(hash, file); nil != err {
+			return
+		}
+		if _, err = file.Seek(0, io.SeekStart); nil != err {
+			return
+		}
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+	}
+	_, err = svc.PutObject(ctx, input)
 	if nil != err {
 		return
 	}
 
+	if s3.Conf.VerifyUpload {
+		if err = s3.verifyObject(key, length); nil != err {
+			return
+		}
+	}
 	//logging.LogInfof("uploaded object [%s]", key)
 	return
 }
@@ -103,27 +203,47 @@ func (s3 *S3) UploadObject(filePath string, overwrite bool) (length int64, err e
 func (s3 *S3) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
 	length = int64(len(data))
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 
 	key := path.Join("repo", filePath)
-	_, err = svc.PutObject(ctx, &as3.PutObjectInput{
+	input := &as3.PutObjectInput{
 		Bucket:       aws.String(s3.Conf.S3.Bucket),
 		Key:          aws.String(key),
 		CacheControl: aws.String("no-cache"),
 		Body:         bytes.NewReader(data),
-	})
+	}
+	if err = s3.setObjectLock(input, filePath); nil != err {
+		return
+	}
+	if s3.Conf.VerifyUpload {
+		sum := md5.Sum(data)
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	_, err = svc.PutObject(ctx, input)
 	if nil != err {
 		return
 	}
 
+	if s3.Conf.VerifyUpload {
+		if err = s3.verifyObject(key, length); nil != err {
+			return
+		}
+	}
 	//logging.LogInfof("uploaded object [%s]", key)
 	return
 }
 
+// UploadObjects 用于批量上传对象，S3 不支持在一个请求中上传多个对象，这里使用连接池并行上传。
+func (s3 *S3) UploadObjects(filePaths []string, overwrite bool) (length int64, err error) {
+	return uploadObjectsParallel(filePaths, s3.GetConcurrentReqs(), func(filePath string) (int64, error) {
+		return s3.UploadObject(filePath, overwrite)
+	})
+}
+
 func (s3 *S3) DownloadObject(filePath string) (data []byte, err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 	key := path.Join("repo", filePath)
 	input := &as3.GetObjectInput{
@@ -135,6 +255,8 @@ func (s3 *S3) DownloadObject(filePath string) (data []byte, err error) {
 	if nil != err {
 		if s3.isErrNotFound(err) {
 			err = ErrCloudObjectNotFound
+		} else if s3.isErrArchived(err) {
+			err = ErrObjectArchived
 		}
 		return
 	}
@@ -148,10 +270,156 @@ func (s3 *S3) DownloadObject(filePath string) (data []byte, err error) {
 	return
 }
 
+// DownloadObjectRange 使用 Range 请求下载对象的一段数据。
+func (s3 *S3) DownloadObjectRange(filePath string, offset, length int64) (data []byte, size int64, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+	defer cancelFn()
+	resp, err := svc.GetObject(ctx, &as3.GetObjectInput{
+		Bucket:               aws.String(s3.Conf.S3.Bucket),
+		Key:                  aws.String(path.Join("repo", filePath)),
+		Range:                aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		ResponseCacheControl: aws.String("no-cache"),
+	})
+	if nil != err {
+		if s3.isErrNotFound(err) {
+			err = ErrCloudObjectNotFound
+		} else if s3.isErrArchived(err) {
+			err = ErrObjectArchived
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if data, err = io.ReadAll(resp.Body); nil != err {
+		return
+	}
+	size = int64(len(data))
+	if nil != resp.ContentRange {
+		if total := parseContentRangeSize(*resp.ContentRange); 0 <= total {
+			size = total
+		}
+	}
+	return
+}
+
+// RestoreObject 请求将 Glacier 或者 Deep Archive 存储类别的对象恢复到标准存储，恢复后的副本保留 days 天。
+func (s3 *S3) RestoreObject(filePath, tier string, days int) (err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+	defer cancelFn()
+	_, err = svc.RestoreObject(ctx, &as3.RestoreObjectInput{
+		Bucket: aws.String(s3.Conf.S3.Bucket),
+		Key:    aws.String(path.Join("repo", filePath)),
+		RestoreRequest: &as3Types.RestoreRequest{
+			Days:                 aws.Int32(int32(days)),
+			GlacierJobParameters: &as3Types.GlacierJobParameters{Tier: as3Types.Tier(tier)},
+		},
+	})
+	if nil != err {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && "RestoreAlreadyInProgress" == apiErr.ErrorCode() {
+			err = nil
+			return
+		}
+		if s3.isErrNotFound(err) {
+			err = ErrCloudObjectNotFound
+		}
+		return
+	}
+	logging.LogInfof("requested restore of object [%s] with tier [%s]", filePath, tier)
+	return
+}
+
+// GetRestoreStatus 根据对象的存储类别和 x-amz-restore 响应头获取对象的恢复状态。
+func (s3 *S3) GetRestoreStatus(filePath string) (ret *RestoreStatus, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+	defer cancelFn()
+	header, err := svc.HeadObject(ctx, &as3.HeadObjectInput{
+		Bucket: aws.String(s3.Conf.S3.Bucket),
+		Key:    aws.String(path.Join("repo", filePath)),
+	})
+	if nil != err {
+		if s3.isErrNotFound(err) {
+			err = ErrCloudObjectNotFound
+		}
+		return
+	}
+
+	ret = &RestoreStatus{Ready: true}
+	switch header.StorageClass {
+	case as3Types.StorageClassGlacier, as3Types.StorageClassDeepArchive:
+		ret.Archived = true
+	}
+	if "" != header.ArchiveStatus { // 智能分层存储的归档访问层
+		ret.Archived = true
+	}
+	if ret.Archived {
+		ret.Ready = false
+		parseRestoreHeader(aws.ToString(header.Restore), ret)
+	}
+	return
+}
+
+func (s3 *S3) DownloadObjectETag(filePath string) (data []byte, etag string, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+	defer cancelFn()
+	key := path.Join("repo", filePath)
+	resp, err := svc.GetObject(ctx, &as3.GetObjectInput{
+		Bucket:               aws.String(s3.Conf.S3.Bucket),
+		Key:                  aws.String(key),
+		ResponseCacheControl: aws.String("no-cache"),
+	})
+	if nil != err {
+		if s3.isErrNotFound(err) {
+			err = ErrCloudObjectNotFound
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if data, err = io.ReadAll(resp.Body); nil != err {
+		return
+	}
+	etag = aws.ToString(resp.ETag)
+	return
+}
+
+// UploadBytesIfMatch 使用 If-Match 和 If-None-Match 条件写入，需要存储服务支持条件写入（AWS S3 以及兼容的实现）。
+//
+// 存储服务不支持条件写入时返回 ErrConditionalWriteUnsupported。
+func (s3 *S3) UploadBytesIfMatch(filePath string, data []byte, etag string) (length int64, err error) {
+	length = int64(len(data))
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+	defer cancelFn()
+
+	input := &as3.PutObjectInput{
+		Bucket:       aws.String(s3.Conf.S3.Bucket),
+		Key:          aws.String(path.Join("repo", filePath)),
+		CacheControl: aws.String("no-cache"),
+		Body:         bytes.NewReader(data),
+	}
+	if "" == etag {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	if _, err = svc.PutObject(ctx, input); nil != err {
+		if s3.isErrPreconditionFailed(err) {
+			err = ErrCloudPreconditionFailed
+		} else if s3.isErrConditionalUnsupported(err) {
+			logging.LogWarnf("conditional put object [%s] unsupported: %s", filePath, err)
+			err = ErrConditionalWriteUnsupported
+		}
+	}
+	return
+}
+
 func (s3 *S3) RemoveObject(key string) (err error) {
 	key = path.Join("repo", key)
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 	_, err = svc.DeleteObject(ctx, &as3.DeleteObjectInput{
 		Bucket: aws.String(s3.Conf.S3.Bucket),
@@ -313,7 +581,7 @@ func (s3 *S3) ListObjects(pathPrefix string) (ret map[string]*entity.ObjectInfo,
 		pathPrefix += "/"
 	}
 	limit := int32(1000)
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 
 	paginator := as3.NewListObjectsV2Paginator(svc, &as3.ListObjectsV2Input{
@@ -363,14 +631,13 @@ func (s3 *S3) repoIndex(id string) (ret *entity.Index, err error) {
 		logging.LogErrorf("decompress index [%s] failed: %s", id, err)
 		return
 	}
-	ret = &entity.Index{}
-	err = gulu.JSON.UnmarshalJSON(data, ret)
+	ret, err = entity.UnmarshalIndex(data)
 	return
 }
 
 func (s3 *S3) listRepoRefs(refPrefix string) (ret []*Ref, err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 
 	prefix := path.Join("repo", "refs", refPrefix)
@@ -423,7 +690,7 @@ func (s3 *S3) listRepoRefs(refPrefix string) (ret []*Ref, err error) {
 
 func (s3 *S3) listRepos() (ret []*Repo, err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 
 	output, err := svc.ListBuckets(ctx, &as3.ListBucketsInput{})
@@ -449,7 +716,7 @@ func (s3 *S3) listRepos() (ret []*Repo, err error) {
 
 func (s3 *S3) statFile(key string) (info *objectInfo, err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
 	defer cancelFn()
 
 	header, err := svc.HeadObject(ctx, &as3.HeadObjectInput{
@@ -479,6 +746,45 @@ func (s3 *S3) statFile(key string) (info *objectInfo, err error) {
 	return
 }
 
+func (s3 *S3) Ping() (latency time.Duration, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+	defer cancelFn()
+
+	start := time.Now()
+	_, err = svc.HeadBucket(ctx, &as3.HeadBucketInput{Bucket: aws.String(s3.Conf.S3.Bucket)})
+	if nil != err {
+		logging.LogErrorf("ping s3 failed: %s", err)
+		return
+	}
+	latency = time.Since(start)
+	return
+}
+
+// Capabilities 探测 S3 的能力，部分 S3 兼容服务只保证最终一致性，这里按最终一致处理。
+func (s3 *S3) Capabilities() (caps *Capabilities, err error) {
+	caps, err = probeCapabilities(s3, ConsistencyEventual)
+	return
+}
+
+// verifyObject 用于校验刚上传的对象 key 在云端的大小是否为 length。
+//
+// 上传时已通过 Content-MD5 请求头由服务端校验数据完整性，这里再通过 HEAD 请求确认对象未被截断。
+func (s3 *S3) verifyObject(key string, length int64) (err error) {
+	info, err := s3.statFile(key)
+	if nil != err {
+		logging.LogErrorf("stat uploaded object [%s] failed: %s", key, err)
+		return
+	}
+
+	if info.Size != length {
+		logging.LogErrorf("verify uploaded object [%s] failed: expected size [%d], actual size [%d]", key, length, info.Size)
+		err = ErrCloudObjectCorrupted
+		return
+	}
+	return
+}
+
 func (s3 *S3) getNotFound(keys []string) (ret []string, err error) {
 	if 1 > len(keys) {
 		return
@@ -533,6 +839,7 @@ func (s3 *S3) getService() *as3.Client {
 		o.HTTPClient = s3.HTTPClient
 		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		s3.countS3APIOps(o)
 
 		// --- START: S3 Compatibility Fix for SigV4 (Cloudflare Tunnel/Proxies) ---
 		// This fix addresses the 'SignatureDoesNotMatch' error encountered when using
@@ -552,6 +859,106 @@ func (s3 *S3) getService() *as3.Client {
 	return s3.service
 }
 
+func (s3 *S3) isErrPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		return "PreconditionFailed" == code || "ConditionalRequestConflict" == code
+	}
+	return false
+}
+
+// isErrConditionalUnsupported 用于判断条件写入是否因为存储服务不支持 If-Match 和 If-None-Match 请求头而失败。
+//
+// 不支持的存储服务通常返回 501 NotImplemented，部分实现返回 400 InvalidArgument 或者 InvalidRequest。
+func (s3 *S3) isErrConditionalUnsupported(err error) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) && http.StatusNotImplemented == respErr.HTTPStatusCode() {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "NotImplemented":
+		return true
+	case "InvalidArgument", "InvalidRequest":
+		return nil != respErr && http.StatusBadRequest == respErr.HTTPStatusCode()
+	}
+	return false
+}
+
+// setObjectLock 用于在配置了对象锁定时为快照对象（数据对象和索引）设置保留期，保留期内对象不能被覆盖或者删除。
+//
+// refs 和锁等需要更新的对象不锁定。对象锁定模式无效时返回 ErrInvalidObjectLockMode。
+func (s3 *S3) setObjectLock(input *as3.PutObjectInput, filePath string) (err error) {
+	conf := s3.Conf.S3
+	if err = checkObjectLockMode(conf.ObjectLockMode); nil != err {
+		return
+	}
+	if 1 > s3.ObjectLockDays() {
+		return
+	}
+	if !strings.HasPrefix(filePath, "objects/") && !strings.HasPrefix(filePath, "indexes/") {
+		return
+	}
+
+	input.ObjectLockMode = as3Types.ObjectLockMode(conf.ObjectLockMode)
+	input.ObjectLockRetainUntilDate = aws.Time(ObjectLockUntil(time.Now(), conf.ObjectLockDays))
+	return
+}
+
+func (s3 *S3) ObjectLockDays() int {
+	if "" == s3.Conf.S3.ObjectLockMode {
+		return 0
+	}
+	return s3.Conf.S3.ObjectLockDays
+}
+
+func (s3 *S3) ExtendObjectLocks(filePaths []string, until time.Time) (err error) {
+	mode := s3.Conf.S3.ObjectLockMode
+	if err = checkObjectLockMode(mode); nil != err {
+		return
+	}
+	if "" == mode {
+		return
+	}
+
+	svc := s3.getService()
+	_, err = uploadObjectsParallel(filePaths, s3.GetConcurrentReqs(), func(filePath string) (int64, error) {
+		ctx, cancelFn := context.WithTimeout(context.Background(), s3.timeout())
+		defer cancelFn()
+		_, putErr := svc.PutObjectRetention(ctx, &as3.PutObjectRetentionInput{
+			Bucket: aws.String(s3.Conf.S3.Bucket),
+			Key:    aws.String(path.Join("repo", filePath)),
+			Retention: &as3Types.ObjectLockRetention{
+				Mode:            as3Types.ObjectLockRetentionMode(mode),
+				RetainUntilDate: aws.Time(until),
+			},
+		})
+		if nil != putErr {
+			logging.LogErrorf("extend object lock [%s] failed: %s", filePath, putErr)
+		}
+		return 0, putErr
+	})
+	return
+}
+
+func (s3 *S3) isErrArchived(err error) bool {
+	var ios *as3Types.InvalidObjectState
+	if errors.As(err, &ios) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return "InvalidObjectState" == apiErr.ErrorCode()
+	}
+	return false
+}
+
 func (s3 *S3) isErrNotFound(err error) bool {
 	var nsk *as3Types.NoSuchKey
 	if errors.As(err, &nsk) {
@@ -20,15 +20,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/88250/gulu"
+	"github.com/imroc/req/v3"
 	"github.com/qiniu/go-sdk/v7/client"
 	"github.com/qiniu/go-sdk/v7/storage"
 	"github.com/siyuan-note/dejavu/entity"
@@ -51,8 +53,75 @@ func NewSiYuan(baseCloud *BaseCloud) *SiYuan {
 	return &SiYuan{BaseCloud: baseCloud}
 }
 
+var (
+	siyuanClients     = map[string]*req.Client{}
+	siyuanClientsLock = sync.Mutex{}
+)
+
+func (siyuan *SiYuan) newCloudRequest30s() *req.Request {
+	return siyuan.customRequest(httpclient.NewCloudRequest30s())
+}
+
+// newCloudFileRequest2m 用于创建耗时较长的请求，按操作类别区分超时时属于大对象操作。
+func (siyuan *SiYuan) newCloudFileRequest2m() *req.Request {
+	return siyuan.customRequest(httpclient.NewCloudFileRequest2m()).SetContext(withLargeObject(context.Background(), true))
+}
+
+// customRequest 用于在配置了代理、自定义根证书或者按操作类别区分的超时时，使用按配置克隆的客户端重新创建请求 r，克隆的客户端保留原客户端的重试和请求头设置。
+func (siyuan *SiYuan) customRequest(r *req.Request) *req.Request {
+	httpConf, timeouts := siyuan.Conf.HTTP, siyuan.Conf.Timeouts
+	if !httpConf.hasCustomNetwork() && nil == timeouts {
+		return r
+	}
+
+	base := r.GetClient()
+	key := fmt.Sprintf("%p", base)
+	if nil != httpConf {
+		key += fmt.Sprintf("|%s|%s", httpConf.Proxy, httpConf.RootCAs)
+	}
+	if nil != timeouts {
+		key += fmt.Sprintf("|%+v", *timeouts)
+	}
+	siyuanClientsLock.Lock()
+	defer siyuanClientsLock.Unlock()
+	c := siyuanClients[key]
+	if nil == c {
+		c = base.Clone()
+		if nil != httpConf && "" != httpConf.Proxy {
+			c.SetProxyURL(httpConf.Proxy)
+		}
+		if nil != httpConf && "" != httpConf.RootCAs {
+			c.SetRootCertsFromFile(httpConf.RootCAs)
+		}
+		if nil != timeouts {
+			// 按操作类别区分的超时覆盖客户端的整体超时
+			c.SetTimeout(0)
+			c.SetDial(dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}))
+			c.GetTransport().WrapRoundTrip(func(rt http.RoundTripper) http.RoundTripper {
+				return NewTimeoutTransport(rt, timeouts)
+			})
+		}
+		siyuanClients[key] = c
+	}
+	return c.R()
+}
+
+// newFormUploader 用于创建上传对象的上传器，配置了代理、自定义根证书或者按操作类别区分的超时时使用共享连接池。
+func (siyuan *SiYuan) newFormUploader() *storage.FormUploader {
+	cfg := &storage.Config{UseHTTPS: true}
+	if !siyuan.Conf.HTTP.hasCustomNetwork() && nil == siyuan.Conf.Timeouts {
+		return storage.NewFormUploader(cfg)
+	}
+
+	httpClient := NewHTTPClient(siyuan.Conf)
+	if nil == siyuan.Conf.Timeouts {
+		httpClient.Timeout = 2 * time.Minute
+	}
+	return storage.NewFormUploaderEx(cfg, &client.Client{Client: httpClient})
+}
+
 func (siyuan *SiYuan) UploadObject(filePath string, overwrite bool) (length int64, err error) {
-	absFilePath := filepath.Join(siyuan.Conf.RepoPath, filePath)
+	absFilePath := siyuan.Conf.LocalPath(filePath)
 	info, err := os.Stat(absFilePath)
 	if nil != err {
 		logging.LogErrorf("stat failed: %s", err)
@@ -71,9 +140,10 @@ func (siyuan *SiYuan) UploadObject(filePath string, overwrite bool) (length int6
 		uploadToken = scopeUploadToken
 	}
 
-	formUploader := storage.NewFormUploader(&storage.Config{UseHTTPS: true})
+	formUploader := siyuan.newFormUploader()
+	ctx := withLargeObject(context.Background(), IsLargeObject(filePath))
 	ret := storage.PutRet{}
-	err = formUploader.PutFile(context.Background(), &ret, uploadToken, key, absFilePath, nil)
+	err = formUploader.PutFile(ctx, &ret, uploadToken, key, absFilePath, nil)
 	if nil != err {
 		if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
 			err = nil
@@ -90,7 +160,7 @@ func (siyuan *SiYuan) UploadObject(filePath string, overwrite bool) (length int6
 		}
 
 		time.Sleep(1 * time.Second)
-		err = formUploader.PutFile(context.Background(), &ret, uploadToken, key, absFilePath, nil)
+		err = formUploader.PutFile(ctx, &ret, uploadToken, key, absFilePath, nil)
 		if nil != err {
 			if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
 				err = nil
@@ -128,9 +198,10 @@ func (siyuan *SiYuan) UploadBytes(filePath string, data []byte, overwrite bool)
 		uploadToken = scopeUploadToken
 	}
 
-	formUploader := storage.NewFormUploader(&storage.Config{UseHTTPS: true})
+	formUploader := siyuan.newFormUploader()
+	ctx := withLargeObject(context.Background(), IsLargeObject(filePath))
 	ret := storage.PutRet{}
-	err = formUploader.Put(context.Background(), &ret, uploadToken, key, bytes.NewReader(data), length, &storage.PutExtra{})
+	err = formUploader.Put(ctx, &ret, uploadToken, key, bytes.NewReader(data), length, &storage.PutExtra{})
 	if nil != err {
 		if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
 			err = nil
@@ -147,7 +218,7 @@ func (siyuan *SiYuan) UploadBytes(filePath string, data []byte, overwrite bool)
 		}
 
 		time.Sleep(1 * time.Second)
-		err = formUploader.Put(context.Background(), &ret, uploadToken, key, bytes.NewReader(data), length, &storage.PutExtra{})
+		err = formUploader.Put(ctx, &ret, uploadToken, key, bytes.NewReader(data), length, &storage.PutExtra{})
 		if nil != err {
 			if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
 				err = nil
@@ -171,9 +242,27 @@ func (siyuan *SiYuan) UploadBytes(filePath string, data []byte, overwrite bool)
 	return
 }
 
+// UploadObjects 用于批量上传对象，不覆盖已有对象时先获取一次前缀上传凭证，批量中的对象共享该凭证并行上传。
+func (siyuan *SiYuan) UploadObjects(filePaths []string, overwrite bool) (length int64, err error) {
+	if 1 > len(filePaths) {
+		return
+	}
+
+	if !overwrite {
+		key := path.Join("siyuan", siyuan.Conf.UserID, "repo", siyuan.Conf.Dir, filePaths[0])
+		if _, _, err = siyuan.requestScopeKeyUploadToken(key, overwrite); nil != err {
+			return
+		}
+	}
+
+	return uploadObjectsParallel(filePaths, siyuan.GetConcurrentReqs(), func(filePath string) (int64, error) {
+		return siyuan.UploadObject(filePath, overwrite)
+	})
+}
+
 func (siyuan *SiYuan) DownloadObject(filePath string) (ret []byte, err error) {
 	key := path.Join("siyuan", siyuan.Conf.UserID, "repo", siyuan.Conf.Dir, filePath)
-	resp, err := httpclient.NewCloudFileRequest2m().Get(siyuan.Endpoint + key)
+	resp, err := siyuan.newCloudFileRequest2m().SetContext(withLargeObject(context.Background(), IsLargeObject(filePath))).Get(siyuan.Endpoint + key)
 	if nil != err {
 		err = fmt.Errorf("download object [%s] failed: %s", key, err)
 		return
@@ -205,7 +294,7 @@ func (siyuan *SiYuan) RemoveObject(filePath string) (err error) {
 
 	key := path.Join("siyuan", userId, "repo", dir, filePath)
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token, "key": key}).
@@ -241,7 +330,7 @@ func (siyuan *SiYuan) ListObjects(pathPrefix string) (objInfos map[string]*entit
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token, "pathPrefix": pathPrefix}).
@@ -290,7 +379,7 @@ func (siyuan *SiYuan) GetTags() (tags []*Ref, err error) {
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token}).
@@ -339,7 +428,7 @@ func (siyuan *SiYuan) GetIndexes(page int) (indexes []*entity.Index, pageCount,
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]interface{}{"repo": dir, "token": token, "page": page}).
@@ -391,7 +480,7 @@ func (siyuan *SiYuan) GetRefsFiles() (fileIDs []string, refs []*Ref, err error)
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudFileRequest2m()
+	request := siyuan.newCloudFileRequest2m()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token}).
@@ -448,7 +537,7 @@ func (siyuan *SiYuan) GetChunks(excludeChunkIDs []string) (chunkIDs []string, er
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudFileRequest2m()
+	request := siyuan.newCloudFileRequest2m()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]interface{}{"repo": dir, "token": token, "chunks": excludeChunkIDs}).
@@ -486,7 +575,7 @@ func (siyuan *SiYuan) GetStat() (stat *Stat, err error) {
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token}).
@@ -523,6 +612,21 @@ func (siyuan *SiYuan) GetStat() (stat *Stat, err error) {
 	return
 }
 
+func (siyuan *SiYuan) Ping() (latency time.Duration, err error) {
+	start := time.Now()
+	if _, err = siyuan.GetStat(); nil != err {
+		logging.LogErrorf("ping siyuan cloud failed: %s", err)
+		return
+	}
+	latency = time.Since(start)
+	return
+}
+
+func (siyuan *SiYuan) Capabilities() (caps *Capabilities, err error) {
+	caps, err = probeCapabilities(siyuan, ConsistencyEventual)
+	return
+}
+
 func (siyuan *SiYuan) AddTraffic(traffic *Traffic) {
 	if nil == traffic {
 		return
@@ -535,7 +639,7 @@ func (siyuan *SiYuan) AddTraffic(traffic *Traffic) {
 	token := siyuan.Conf.Token
 	server := siyuan.Conf.Server
 
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetBody(map[string]interface{}{
 			"token":         token,
@@ -561,7 +665,7 @@ func (siyuan *SiYuan) RemoveRepo(name string) (err error) {
 	token := siyuan.Conf.Token
 	server := siyuan.Conf.Server
 
-	request := httpclient.NewCloudFileRequest2m()
+	request := siyuan.newCloudFileRequest2m()
 	resp, err := request.
 		SetBody(map[string]string{"name": name, "token": token}).
 		Post(server + "/apis/siyuan/dejavu/removeRepo")
@@ -586,7 +690,7 @@ func (siyuan *SiYuan) CreateRepo(name string) (err error) {
 	server := siyuan.Conf.Server
 
 	result := map[string]interface{}{}
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"name": name, "token": token}).
@@ -619,7 +723,7 @@ func (siyuan *SiYuan) GetRepos() (repos []*Repo, size int64, err error) {
 	userId := siyuan.Conf.UserID
 
 	result := map[string]interface{}{}
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetBody(map[string]interface{}{"token": token}).
 		SetSuccessResult(&result).
@@ -715,11 +819,12 @@ func (siyuan *SiYuan) requestScopeKeyUploadToken(key string, overwrite bool) (ke
 	token := siyuan.Conf.Token
 	server := siyuan.Conf.Server
 	var result map[string]interface{}
-	req := httpclient.NewCloudRequest30s().SetSuccessResult(&result)
+	req := siyuan.newCloudRequest30s().SetSuccessResult(&result)
 	req.SetBody(map[string]interface{}{
 		"token":     token,
 		"key":       key,
 		"keyPrefix": keyPrefix,
+		"deviceID":  siyuan.Conf.DeviceID,
 		"time":      now, // 数据同步加入系统时间校验 https://github.com/siyuan-note/siyuan/issues/7669
 	})
 	resp, err := req.Post(server + "/apis/siyuan/dejavu/getRepoScopeKeyUploadToken?uid=" + userId)
@@ -746,6 +851,8 @@ func (siyuan *SiYuan) requestScopeKeyUploadToken(key string, overwrite bool) (ke
 			err = ErrSystemTimeIncorrect
 		case 2:
 			err = ErrDeprecatedVersion
+		case 3:
+			err = ErrDeviceRevoked
 		case -1:
 			err = ErrCloudCheckFailed
 		}
@@ -0,0 +1,160 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConfTimeout 用于描述一类操作的超时时间，单位：秒，零值字段使用默认值。
+type ConfTimeout struct {
+	Connect int // 建立连接（包括 TLS 握手）的超时时间
+	Read    int // 读取类请求（下载、列举等）从发出到读完响应的超时时间
+	Write   int // 写入类请求（上传、删除等）从发出到读完响应的超时时间
+}
+
+// ConfTimeouts 用于描述按操作类别区分的超时配置。
+//
+// 同一个超时时间很难同时兼顾两类操作：上传较大的数据分块需要更长的时间，而读取 refs 等小对象时应该尽快失败重试。
+// 数据对象（objects/ 下的分块和文件）属于大对象操作，refs、索引、锁等其他对象属于小对象操作。
+type ConfTimeouts struct {
+	Small ConfTimeout // 小对象操作，默认建立连接 10 秒，读写 30 秒
+	Large ConfTimeout // 大对象操作，默认建立连接 30 秒，读写 120 秒
+}
+
+// IsLargeObject 用于判断对象 key 的操作是否属于大对象操作类别。
+func IsLargeObject(key string) bool {
+	return strings.Contains(key, "objects/")
+}
+
+// timeout 用于获取操作类别 large 的读或者写超时时间和建立连接超时时间。
+func (conf *ConfTimeouts) timeout(large, write bool) (timeout, connect time.Duration) {
+	t, defaultConnect, defaultRW := conf.Small, 10, 30
+	if large {
+		t, defaultConnect, defaultRW = conf.Large, 30, 120
+	}
+
+	seconds := t.Read
+	if write {
+		seconds = t.Write
+	}
+	if 1 > seconds {
+		seconds = defaultRW
+	}
+	connectSeconds := t.Connect
+	if 1 > connectSeconds {
+		connectSeconds = defaultConnect
+	}
+	return time.Duration(seconds) * time.Second, time.Duration(connectSeconds) * time.Second
+}
+
+// longest 用于获取所有操作类别中最长的超时时间。
+func (conf *ConfTimeouts) longest() (ret time.Duration) {
+	for _, large := range []bool{false, true} {
+		for _, write := range []bool{false, true} {
+			if timeout, _ := conf.timeout(large, write); timeout > ret {
+				ret = timeout
+			}
+		}
+	}
+	return
+}
+
+type largeObjectCtxKey struct{}
+
+type connectTimeoutCtxKey struct{}
+
+// withLargeObject 用于在 ctx 中显式指定请求的操作类别，用于无法通过请求路径判断对象的情况，比如表单上传。
+func withLargeObject(ctx context.Context, large bool) context.Context {
+	return context.WithValue(ctx, largeObjectCtxKey{}, large)
+}
+
+// dialContext 用于建立连接，ctx 中指定了建立连接超时时间时使用该超时时间。
+func dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if timeout, ok := ctx.Value(connectTimeoutCtxKey{}).(time.Duration); ok {
+			d := *dialer
+			d.Timeout = timeout
+			return d.DialContext(ctx, network, addr)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// TimeoutTransport 描述了一个按操作类别设置超时的 HTTP RoundTripper。
+//
+// 请求的操作类别优先使用 ctx 中显式指定的类别，否则根据请求路径判断；GET、HEAD、PROPFIND 等请求使用读超时，其他请求使用写超时。
+// 读写超时覆盖从发出请求到读完响应体的整个过程，建立连接超时只有在使用 sharedTransport 建立连接时才生效。
+type TimeoutTransport struct {
+	Base     http.RoundTripper // 实际发送请求的 RoundTripper，为 nil 时使用 http.DefaultTransport
+	Timeouts *ConfTimeouts
+}
+
+// NewTimeoutTransport 用于创建一个包装 base 的 TimeoutTransport。
+func NewTimeoutTransport(base http.RoundTripper, timeouts *ConfTimeouts) *TimeoutTransport {
+	return &TimeoutTransport{Base: base, Timeouts: timeouts}
+}
+
+func (transport *TimeoutTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	base := transport.Base
+	if nil == base {
+		base = http.DefaultTransport
+	}
+
+	large, ok := req.Context().Value(largeObjectCtxKey{}).(bool)
+	if !ok {
+		large = IsLargeObject(req.URL.Path)
+	}
+	timeout, connect := transport.Timeouts.timeout(large, !isReadMethod(req.Method))
+
+	ctx := context.WithValue(req.Context(), connectTimeoutCtxKey{}, connect)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err = base.RoundTrip(req.WithContext(ctx))
+	if nil != err {
+		cancel()
+		return
+	}
+
+	// 读完响应体后才能取消，否则会中断响应体的读取
+	resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return
+}
+
+func isReadMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// cancelReadCloser 用于在关闭响应体时释放请求的超时上下文。
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (rc *cancelReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.cancel()
+	return err
+}
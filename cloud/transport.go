@@ -0,0 +1,88 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CompressionTransport 描述了一个协商传输压缩的 HTTP RoundTripper，用于 WebDAV 等基于 HTTP 的云端存储服务。
+//
+// net/http 只会在请求没有设置 Accept-Encoding 时自动协商 gzip 并透明解压，gowebdav 的 PROPFIND 请求显式设置了空的 Accept-Encoding，
+// 所以列举对象时返回的大量 XML 不会被压缩。该 RoundTripper 会为这类请求协商 gzip 并透明解压响应，其他请求保持不变。
+type CompressionTransport struct {
+	Base http.RoundTripper // 实际发送请求的 RoundTripper，为 nil 时使用 http.DefaultTransport
+}
+
+// NewCompressionTransport 用于创建一个包装 base 的 CompressionTransport，可以通过 gowebdav.Client.SetTransport 设置。
+func NewCompressionTransport(base http.RoundTripper) *CompressionTransport {
+	return &CompressionTransport{Base: base}
+}
+
+func (transport *CompressionTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	base := transport.Base
+	if nil == base {
+		base = http.DefaultTransport
+	}
+
+	values, ok := req.Header["Accept-Encoding"]
+	if !ok || "" != strings.Join(values, "") || "" != req.Header.Get("Range") {
+		// 未设置时由 net/http 自动协商，已经设置为其他值时由调用方处理
+		return base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = base.RoundTrip(req)
+	if nil != err {
+		return
+	}
+	if !strings.EqualFold("gzip", resp.Header.Get("Content-Encoding")) {
+		return
+	}
+
+	resp.Body = &gzipReadCloser{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return
+}
+
+// gzipReadCloser 用于延迟创建 gzip.Reader，以便空响应体不会在读取前报错。
+type gzipReadCloser struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (gz *gzipReadCloser) Read(p []byte) (n int, err error) {
+	if nil == gz.zr && nil == gz.err {
+		gz.zr, gz.err = gzip.NewReader(gz.body)
+	}
+	if nil != gz.err {
+		return 0, gz.err
+	}
+	return gz.zr.Read(p)
+}
+
+func (gz *gzipReadCloser) Close() error {
+	return gz.body.Close()
+}
@@ -17,15 +17,18 @@
 package cloud
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"io/fs"
 	"math"
+	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/88250/gulu"
 	"github.com/siyuan-note/dejavu/entity"
@@ -42,6 +45,16 @@ type WebDAV struct {
 }
 
 func NewWebDAV(baseCloud *BaseCloud, client *gowebdav.Client) (ret *WebDAV) {
+	if nil != baseCloud.Conf.HTTP || nil != baseCloud.Conf.Timeouts {
+		// 配置了连接参数时使用共享连接池
+		var transport http.RoundTripper = NewCompressionTransport(sharedTransport(baseCloud.Conf))
+		if nil != baseCloud.Conf.Timeouts {
+			// 按操作类别区分的超时覆盖客户端的整体超时
+			transport = NewTimeoutTransport(transport, baseCloud.Conf.Timeouts)
+			client.SetTimeout(0)
+		}
+		client.SetTransport(transport)
+	}
 	ret = &WebDAV{
 		BaseCloud: baseCloud,
 		Client:    client,
@@ -62,8 +75,20 @@ func (webdav *WebDAV) GetRepos() (repos []*Repo, size int64, err error) {
 	return
 }
 
+func (webdav *WebDAV) RenameRepo(oldName, newName string) (err error) {
+	err = webdav.Client.Rename(path.Join("/", oldName), path.Join("/", newName), false)
+	err = webdav.parseErr(err)
+	return
+}
+
+func (webdav *WebDAV) CopyRepo(src, dst string) (err error) {
+	err = webdav.Client.Copy(path.Join("/", src), path.Join("/", dst), false)
+	err = webdav.parseErr(err)
+	return
+}
+
 func (webdav *WebDAV) UploadObject(filePath string, overwrite bool) (length int64, err error) {
-	absFilePath := filepath.Join(webdav.Conf.RepoPath, filePath)
+	absFilePath := webdav.Conf.LocalPath(filePath)
 	data, err := os.ReadFile(absFilePath)
 	if nil != err {
 		return
@@ -88,14 +113,38 @@ func (webdav *WebDAV) UploadBytes(filePath string, data []byte, overwrite bool)
 		logging.LogErrorf("upload object [%s] failed: %s", key, err)
 		return
 	}
+
+	if webdav.Conf.VerifyUpload {
+		if err = webdav.verifyObject(key, data); nil != err {
+			return
+		}
+	}
 	//logging.LogInfof("uploaded object [%s]", key)
 	return
 }
 
+// UploadObjects 用于批量上传对象，先创建所有对象的父目录，然后并行上传，避免每个对象都检查一次父目录。
+func (webdav *WebDAV) UploadObjects(filePaths []string, overwrite bool) (length int64, err error) {
+	for _, folder := range objectFolders(filePaths) {
+		if err = webdav.mkdirAll(path.Join(webdav.Dir, "siyuan", "repo", folder)); nil != err {
+			return
+		}
+	}
+	cache.Wait() // 等待目录缓存写入，以便并行上传时不再检查父目录
+
+	return uploadObjectsParallel(filePaths, webdav.GetConcurrentReqs(), func(filePath string) (int64, error) {
+		return webdav.UploadObject(filePath, overwrite)
+	})
+}
+
 func (webdav *WebDAV) DownloadObject(filePath string) (data []byte, err error) {
 	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
-	data, err = webdav.Client.Read(key)
-	err = webdav.parseErr(err)
+	if isCachedObjectKey(filePath) {
+		data, err = webdav.readCached(key, nil)
+	} else {
+		data, err = webdav.Client.Read(key)
+		err = webdav.parseErr(err)
+	}
 	if nil != err {
 		return
 	}
@@ -104,6 +153,35 @@ func (webdav *WebDAV) DownloadObject(filePath string) (data []byte, err error) {
 	return
 }
 
+// DownloadObjectRange 先获取对象大小再使用 Range 请求下载，本地缓存的对象直接下载完整数据。
+func (webdav *WebDAV) DownloadObjectRange(filePath string, offset, length int64) (data []byte, size int64, err error) {
+	if isCachedObjectKey(filePath) {
+		if data, err = webdav.DownloadObject(filePath); nil == err {
+			size = int64(len(data))
+		}
+		return
+	}
+
+	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
+	info, err := webdav.Client.Stat(key)
+	if nil != err {
+		err = webdav.parseErr(err)
+		return
+	}
+	size = info.Size()
+	if offset >= size {
+		return
+	}
+	stream, err := webdav.Client.ReadStreamRange(key, offset, min(length, size-offset))
+	if nil != err {
+		err = webdav.parseErr(err)
+		return
+	}
+	defer stream.Close()
+	data, err = io.ReadAll(stream)
+	return
+}
+
 func (webdav *WebDAV) RemoveObject(filePath string) (err error) {
 	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
 	err = webdav.Client.Remove(key)
@@ -378,7 +456,7 @@ func (webdav *WebDAV) repoIndex(repoDir, id string) (ret *entity.Index, err erro
 		return
 	}
 
-	data, err := webdav.Client.Read(indexPath)
+	data, err := webdav.readCached(indexPath, info)
 	if nil != err {
 		return
 	}
@@ -386,8 +464,44 @@ func (webdav *WebDAV) repoIndex(repoDir, id string) (ret *entity.Index, err erro
 	if nil != err {
 		return
 	}
-	ret = &entity.Index{}
-	err = gulu.JSON.UnmarshalJSON(data, ret)
+	ret, err = entity.UnmarshalIndex(data)
+	return
+}
+
+func (webdav *WebDAV) Ping() (latency time.Duration, err error) {
+	start := time.Now()
+	_, err = webdav.Client.Stat(path.Join(webdav.Dir, "siyuan"))
+	err = webdav.parseErr(err)
+	if errors.Is(err, ErrCloudObjectNotFound) { // 仓库目录尚未创建，但服务可达
+		err = nil
+	}
+	if nil != err {
+		logging.LogErrorf("ping webdav failed: %s", err)
+		return
+	}
+	latency = time.Since(start)
+	return
+}
+
+func (webdav *WebDAV) Capabilities() (caps *Capabilities, err error) {
+	caps, err = probeCapabilities(webdav, ConsistencyStrong)
+	return
+}
+
+// verifyObject 用于回读刚上传的对象 key，校验内容是否和上传的数据 data 一致。WebDAV 没有通用的校验和属性，只能下载后比较。
+func (webdav *WebDAV) verifyObject(key string, data []byte) (err error) {
+	uploaded, err := webdav.Client.Read(key)
+	err = webdav.parseErr(err)
+	if nil != err {
+		logging.LogErrorf("read uploaded object [%s] failed: %s", key, err)
+		return
+	}
+
+	if !bytes.Equal(data, uploaded) {
+		logging.LogErrorf("verify uploaded object [%s] failed: expected size [%d], actual size [%d]", key, len(data), len(uploaded))
+		err = ErrCloudObjectCorrupted
+		return
+	}
 	return
 }
 
@@ -404,6 +518,10 @@ func (webdav *WebDAV) parseErr(err error) error {
 				statusErr := e.(gowebdav.StatusError)
 				if 404 == statusErr.Status {
 					return ErrCloudObjectNotFound
+				} else if 401 == statusErr.Status {
+					return ErrCloudAuthFailed
+				} else if 507 == statusErr.Status {
+					return ErrCloudQuotaExceeded
 				} else if 503 == statusErr.Status || 502 == statusErr.Status || 500 == statusErr.Status {
 					return ErrCloudServiceUnavailable
 				} else if 200 == statusErr.Status {
@@ -467,5 +585,8 @@ func (webdav *WebDAV) mkdirAll(folder string) (err error) {
 			cache.Set("webdav.dir."+sub, true, 1)
 		}
 	}
+	if nil == err {
+		cache.Set(cacheKey, true, 1)
+	}
 	return
 }
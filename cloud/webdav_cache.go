@@ -0,0 +1,166 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+	"github.com/studio-b12/gowebdav"
+)
+
+// webdavCachedObject 描述了 WebDAV 本地缓存对象的元数据。
+type webdavCachedObject struct {
+	Key       string `json:"key"`       // 对象完整路径
+	Validator string `json:"validator"` // 对象校验值，优先使用 ETag，没有的话使用大小和修改时间
+	Size      int64  `json:"size"`      // 对象大小
+	Complete  bool   `json:"complete"`  // 是否已经下载完整，未完整时可以使用 Range 请求续传
+}
+
+// isCachedObjectKey 用于判断对象 filePath 是否需要缓存。
+//
+// 索引列表和索引在每次同步和浏览快照时都会下载，数据量随快照数量增长，在慢速链路上缓存后只需要一次 PROPFIND 校验即可复用。
+func isCachedObjectKey(filePath string) bool {
+	filePath = strings.TrimPrefix(filePath, "/")
+	return "indexes-v2.json" == filePath || strings.HasPrefix(filePath, "indexes/") || strings.HasPrefix(filePath, "check/indexes/")
+}
+
+// readCached 用于读取对象 key，对象未变更时直接使用本地缓存，下载中断后下次读取时通过 Range 请求续传。
+//
+// info 为对象的元信息，传入 nil 时会先获取元信息。没有配置本地仓库路径时直接下载。
+func (webdav *WebDAV) readCached(key string, info os.FileInfo) (data []byte, err error) {
+	if "" == webdav.Conf.RepoPath {
+		data, err = webdav.Client.Read(key)
+		err = webdav.parseErr(err)
+		return
+	}
+
+	if nil == info {
+		if info, err = webdav.Client.Stat(key); nil != err {
+			err = webdav.parseErr(err)
+			return
+		}
+	}
+	validator := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixMilli())
+	if f, ok := info.(*gowebdav.File); ok && "" != f.ETag() {
+		validator = f.ETag()
+	}
+
+	cacheDir := filepath.Join(webdav.Conf.RepoPath, "cloud-cache", "webdav")
+	endpoint := ""
+	if nil != webdav.Conf.WebDAV {
+		endpoint = webdav.Conf.WebDAV.Endpoint
+	}
+	hash := sha1.Sum([]byte(endpoint + key))
+	name := hex.EncodeToString(hash[:])
+	metaPath := filepath.Join(cacheDir, name+".json")
+	dataPath := filepath.Join(cacheDir, name)
+
+	meta := &webdavCachedObject{}
+	if metaData, readErr := os.ReadFile(metaPath); nil == readErr {
+		if unmarshalErr := gulu.JSON.UnmarshalJSON(metaData, meta); nil != unmarshalErr {
+			meta = &webdavCachedObject{}
+		}
+	}
+	if meta.Key != key || meta.Validator != validator || meta.Size != info.Size() {
+		// 对象已经变更，丢弃旧缓存
+		meta = &webdavCachedObject{Key: key, Validator: validator, Size: info.Size()}
+		os.Remove(dataPath)
+	}
+
+	if meta.Complete {
+		if data, err = os.ReadFile(dataPath); nil == err && int64(len(data)) == meta.Size {
+			return
+		}
+		meta.Complete = false
+		os.Remove(dataPath)
+	}
+
+	if err = os.MkdirAll(cacheDir, 0755); nil != err {
+		return
+	}
+	metaData, err := gulu.JSON.MarshalJSON(meta)
+	if nil != err {
+		return
+	}
+	if err = gulu.File.WriteFileSafer(metaPath, metaData, 0644); nil != err {
+		return
+	}
+
+	if err = webdav.downloadTo(key, dataPath, meta.Size); nil != err {
+		return
+	}
+	if data, err = os.ReadFile(dataPath); nil != err {
+		return
+	}
+	if int64(len(data)) != meta.Size {
+		os.Remove(dataPath)
+		err = ErrCloudObjectCorrupted
+		return
+	}
+
+	meta.Complete = true
+	if metaData, err = gulu.JSON.MarshalJSON(meta); nil != err {
+		return
+	}
+	if writeErr := gulu.File.WriteFileSafer(metaPath, metaData, 0644); nil != writeErr {
+		logging.LogWarnf("write webdav cache meta [%s] failed: %s", metaPath, writeErr)
+	}
+	return
+}
+
+// downloadTo 用于下载对象 key 并追加写入到文件 dataPath，文件中已有部分数据时使用 Range 请求下载剩余部分。
+func (webdav *WebDAV) downloadTo(key, dataPath string, size int64) (err error) {
+	var offset int64
+	if info, statErr := os.Stat(dataPath); nil == statErr {
+		offset = info.Size()
+	}
+	if offset > size {
+		os.Remove(dataPath)
+		offset = 0
+	}
+
+	var stream io.ReadCloser
+	if 0 < offset {
+		stream, err = webdav.Client.ReadStreamRange(key, offset, 0)
+	} else {
+		stream, err = webdav.Client.ReadStream(key)
+	}
+	if nil != err {
+		err = webdav.parseErr(err)
+		return
+	}
+	defer stream.Close()
+
+	f, err := os.OpenFile(dataPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if nil != err {
+		return
+	}
+	if _, err = io.Copy(f, stream); nil != err {
+		f.Close()
+		return
+	}
+	err = f.Close()
+	return
+}
@@ -0,0 +1,133 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// CloudCheckReport 描述了云端校验报告，云端服务校验上传的校验索引后生成。
+type CloudCheckReport struct {
+	CheckTime      time.Time             // 最近一次校验的时间
+	CheckCount     int                   // 校验次数
+	FixCount       int                   // 修复次数
+	MissingObjects []*CloudMissingObject // 云端缺失的数据对象
+}
+
+// CloudMissingObject 描述了云端缺失的数据对象。
+type CloudMissingObject struct {
+	ID    string // 数据对象 ID
+	Path  string // 数据对象在云端的路径，如 objects/xx/yyyy
+	Local bool   // 本地是否存在该数据对象，存在时可以上传修复
+}
+
+// GetCloudCheckReport 用于获取云端校验报告，还没有校验报告时返回没有缺失对象的空报告。
+//
+// 官方云端服务的校验报告由云端生成，其他云端服务返回本地最近一次计算的校验报告。
+func (repo *Repo) GetCloudCheckReport() (ret *CloudCheckReport, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+
+	var checkReport *entity.CheckReport
+	if _, ok := repo.cloud.(*cloud.SiYuan); ok {
+		trafficStat := &TrafficStat{m: &sync.Mutex{}}
+		if checkReport, err = repo.downloadCloudCheckReport(trafficStat); nil != err {
+			logging.LogErrorf("download check report failed: %s", err)
+			return
+		}
+	} else {
+		checkReport = repo.readLocalCheckReport()
+	}
+	ret = repo.newCloudCheckReport(checkReport)
+	return
+}
+
+// RequestCloudVerify 用于按需校验云端数据对象并上传修复云端缺失的数据对象，返回修复后的校验报告。context 参数用于发布事件时传递调用上下文。
+//
+// 官方云端服务使用云端生成的校验报告，其他云端服务会在本地重新计算最新索引引用的数据对象中云端缺失的对象。
+func (repo *Repo) RequestCloudVerify(context map[string]interface{}) (ret *CloudCheckReport, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+
+	trafficStat := &TrafficStat{m: &sync.Mutex{}}
+	var checkReport *entity.CheckReport
+	if _, ok := repo.cloud.(*cloud.SiYuan); ok {
+		checkReport, err = repo.downloadCloudCheckReport(trafficStat)
+	} else {
+		var latest *entity.Index
+		if latest, err = repo.Latest(); nil != err {
+			return
+		}
+		checkReport, err = repo.computeCloudCheckReport(latest, trafficStat)
+	}
+	if nil != err {
+		logging.LogErrorf("get check report failed: %s", err)
+		return
+	}
+	if nil != checkReport && 0 < len(checkReport.MissingObjects) {
+		if err = repo.fixCloudMissingObjects(checkReport, trafficStat, context); nil != err {
+			logging.LogErrorf("upload cloud missing objects failed: %s", err)
+			return
+		}
+	}
+	go repo.cloud.AddTraffic(&cloud.Traffic{
+		UploadBytes:   trafficStat.UploadBytes,
+		DownloadBytes: trafficStat.DownloadBytes,
+		APIGet:        trafficStat.APIGet,
+		APIPut:        trafficStat.APIPut,
+	})
+
+	ret = repo.newCloudCheckReport(checkReport)
+	return
+}
+
+func (repo *Repo) newCloudCheckReport(checkReport *entity.CheckReport) (ret *CloudCheckReport) {
+	ret = &CloudCheckReport{MissingObjects: []*CloudMissingObject{}}
+	if nil == checkReport {
+		return
+	}
+
+	ret.CheckTime = time.UnixMilli(checkReport.CheckTime)
+	ret.CheckCount = checkReport.CheckCount
+	ret.FixCount = checkReport.FixCount
+	for _, missingObject := range gulu.Str.RemoveDuplicatedElem(checkReport.MissingObjects) {
+		id := strings.ReplaceAll(missingObject, "/", "")
+		ret.MissingObjects = append(ret.MissingObjects, &CloudMissingObject{
+			ID:    id,
+			Path:  "objects/" + missingObject,
+			Local: lexists(repo.store.ObjectPath(id)),
+		})
+	}
+	return
+}
@@ -0,0 +1,294 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	ErrInvalidCloudRepoName = errors.New("invalid cloud repo name")   // ErrInvalidCloudRepoName 描述了云端仓库名称不合法的错误
+	ErrCloudRepoExists      = errors.New("cloud repo already exists") // ErrCloudRepoExists 描述了云端仓库已经存在的错误
+)
+
+// EvtCloudBeforeDuplicateRepo 描述了复制云端仓库前的事件，参数为 context、源仓库名称和目标仓库名称。
+const EvtCloudBeforeDuplicateRepo = "repo.cloudBeforeDuplicateRepo"
+
+const (
+	CloudReposSortByName    = "name"    // 按仓库名称排序
+	CloudReposSortByUpdated = "updated" // 按仓库更新时间排序
+	CloudReposSortBySize    = "size"    // 按仓库大小排序
+
+	defaultCloudReposPageSize = 20
+)
+
+// CloudReposQuery 描述了云端仓库列表的查询条件。
+type CloudReposQuery struct {
+	SortBy   string // 排序字段，可选 name、updated、size，默认按 name 排序
+	Desc     bool   // 是否降序
+	Page     int    // 页码，从 1 开始，小于 1 时返回全部仓库
+	PageSize int    // 每页仓库数量，小于 1 时使用默认值 20
+
+	// 是否读取当前页每个仓库的最新索引信息
+	// S3、WebDAV 等第三方存储服务每个仓库需要额外读取 refs/latest 和最新索引两个对象
+	WithLatest bool
+}
+
+// CloudRepo 描述了云端仓库及其最新索引信息。
+type CloudRepo struct {
+	*cloud.Repo
+	Latest *CloudRepoLatest `json:"latest,omitempty"` // 最新索引信息，未查询、仓库为空或者读取失败时为 nil
+}
+
+// CloudRepoLatest 描述了云端仓库的最新索引信息。
+type CloudRepoLatest struct {
+	ID         string    `json:"id"`         // 索引 ID
+	Created    time.Time `json:"created"`    // 索引时间
+	Count      int       `json:"count"`      // 文件总数
+	Size       int64     `json:"size"`       // 文件总大小
+	SystemID   string    `json:"systemID"`   // 设备 ID
+	SystemName string    `json:"systemName"` // 设备名称
+	SystemOS   string    `json:"systemOS"`   // 设备操作系统
+	AuthorID   string    `json:"authorID"`   // 作者 ID
+	AuthorName string    `json:"authorName"` // 作者名称
+}
+
+// ListCloudRepos 用于按照 query 排序分页获取云端仓库列表，total 为仓库总数，size 为仓库总大小。
+// 相同排序值的仓库按名称排序，保证多次查询的结果顺序稳定。
+func (repo *Repo) ListCloudRepos(query *CloudReposQuery) (ret []*CloudRepo, total int, size int64, err error) {
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+	if nil == query {
+		query = &CloudReposQuery{}
+	}
+
+	repos, size, err := repo.cloud.GetRepos()
+	if nil != err {
+		return
+	}
+	total = len(repos)
+
+	sortCloudRepos(repos, query.SortBy, query.Desc)
+
+	if 0 < query.Page {
+		pageSize := query.PageSize
+		if 1 > pageSize {
+			pageSize = defaultCloudReposPageSize
+		}
+		start := (query.Page - 1) * pageSize
+		if start > len(repos) {
+			start = len(repos)
+		}
+		end := start + pageSize
+		if end > len(repos) {
+			end = len(repos)
+		}
+		repos = repos[start:end]
+	}
+
+	ret = []*CloudRepo{}
+	for _, r := range repos {
+		cloudRepo := &CloudRepo{Repo: r}
+		if query.WithLatest {
+			latest, latestErr := repo.cloudRepoLatest(r.Name)
+			if nil != latestErr {
+				if !errors.Is(latestErr, cloud.ErrCloudObjectNotFound) {
+					logging.LogWarnf("get cloud repo [%s] latest failed: %s", r.Name, latestErr)
+				}
+			} else {
+				cloudRepo.Latest = latest
+			}
+		}
+		ret = append(ret, cloudRepo)
+	}
+	return
+}
+
+func sortCloudRepos(repos []*cloud.Repo, sortBy string, desc bool) {
+	sort.SliceStable(repos, func(i, j int) bool {
+		a, b := repos[i], repos[j]
+		if desc {
+			a, b = b, a
+		}
+
+		switch sortBy {
+		case CloudReposSortByUpdated:
+			if a.Updated != b.Updated {
+				return a.Updated < b.Updated
+			}
+		case CloudReposSortBySize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+func (repo *Repo) cloudRepoLatest(name string) (ret *CloudRepoLatest, err error) {
+	c, err := cloud.ForRepo(repo.cloud, name)
+	if nil != err {
+		return
+	}
+
+	data, err := c.DownloadObject(path.Join("refs", "latest"))
+	if nil != err {
+		return
+	}
+	latestID := strings.TrimSpace(string(data))
+	if 40 != len(latestID) {
+		err = cloud.ErrCloudObjectNotFound
+		return
+	}
+
+	key := path.Join("indexes", latestID)
+	data, err = c.DownloadObject(key)
+	if nil != err {
+		return
+	}
+	data, err = repo.decodeDownloadedData(key, data)
+	if nil != err {
+		return
+	}
+	index, err := entity.UnmarshalIndex(data)
+	if nil != err {
+		return
+	}
+	repo.unsealIndex(index)
+
+	ret = &CloudRepoLatest{
+		ID:         index.ID,
+		Created:    time.UnixMilli(index.Created),
+		Count:      index.Count,
+		Size:       index.Size,
+		SystemID:   index.SystemID,
+		SystemName: index.SystemName,
+		SystemOS:   index.SystemOS,
+		AuthorID:   index.AuthorID,
+		AuthorName: index.AuthorName,
+	}
+	return
+}
+
+// RenameCloudRepo 用于将云端仓库 oldName 重命名为 newName，数据在云端直接移动，不需要重新上传。
+//
+// 重命名的是当前同步的仓库时会先锁定云端，完成后当前仓库切换到 newName。S3 对象存储协议的仓库即存储桶，不支持重命名。
+func (repo *Repo) RenameCloudRepo(oldName, newName string) (err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err = repo.checkCloudRepoNames(oldName, newName); nil != err {
+		return
+	}
+
+	conf := repo.cloud.GetConf()
+	if oldName == conf.Dir {
+		context := map[string]interface{}{}
+		if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+			return
+		}
+		// 锁文件随仓库一起移动，所以切换到 newName 后再解锁
+		defer repo.unlockCloud(context)
+	}
+
+	if err = repo.cloud.RenameRepo(oldName, newName); nil != err {
+		logging.LogErrorf("rename cloud repo [%s] to [%s] failed: %s", oldName, newName, err)
+		return
+	}
+	if oldName == conf.Dir {
+		conf.Dir = newName
+	}
+	logging.LogInfof("renamed cloud repo [%s] to [%s]", oldName, newName)
+	return
+}
+
+// DuplicateCloudRepo 用于将云端仓库 src 复制为新仓库 dst，数据在云端直接复制，不需要重新上传。
+//
+// 复制的是当前同步的仓库时会先锁定云端，保证复制的数据一致。S3 对象存储协议的仓库即存储桶，dst 需要是已经创建好的存储桶。
+func (repo *Repo) DuplicateCloudRepo(src, dst string, context map[string]interface{}) (err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err = repo.checkCloudRepoNames(src, dst); nil != err {
+		return
+	}
+
+	if src == repo.cloud.GetConf().Dir {
+		if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+			return
+		}
+		defer repo.unlockCloud(context)
+	}
+
+	eventbus.Publish(EvtCloudBeforeDuplicateRepo, context, src, dst)
+	if err = repo.cloud.CopyRepo(src, dst); nil != err {
+		logging.LogErrorf("duplicate cloud repo [%s] to [%s] failed: %s", src, dst, err)
+		return
+	}
+
+	// 复制时可能连同同步锁一起复制了，需要移除
+	dstCloud, err := cloud.ForRepo(repo.cloud, dst)
+	if nil != err {
+		return
+	}
+	if removeErr := dstCloud.RemoveObject(lockSyncKey); nil != removeErr && !errors.Is(removeErr, cloud.ErrCloudObjectNotFound) {
+		logging.LogWarnf("remove sync lock of cloud repo [%s] failed: %s", dst, removeErr)
+	}
+	logging.LogInfof("duplicated cloud repo [%s] to [%s]", src, dst)
+	return
+}
+
+func (repo *Repo) checkCloudRepoNames(src, dst string) (err error) {
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+	if !cloud.IsValidCloudDirName(dst) || src == dst {
+		err = ErrInvalidCloudRepoName
+		return
+	}
+
+	repos, _, err := repo.cloud.GetRepos()
+	if nil != err {
+		return
+	}
+	srcExists := false
+	for _, r := range repos {
+		if r.Name == dst {
+			err = ErrCloudRepoExists
+			return
+		}
+		if r.Name == src {
+			srcExists = true
+		}
+	}
+	if !srcExists {
+		err = cloud.ErrCloudObjectNotFound
+	}
+	return
+}
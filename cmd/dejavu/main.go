@@ -0,0 +1,318 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// dejavu 是仓库管理命令行工具，用于在思源笔记以外（比如数据问题导致思源无法启动时）操作仓库。
+//
+// 用法：
+//
+//	dejavu <command> [flags] [args]
+//
+// 命令：
+//
+//	init      创建仓库文件夹
+//	snapshot  索引数据文件夹并创建快照
+//	log       列出快照
+//	diff      比较两个快照，参数为左侧和右侧索引 ID
+//	checkout  迁出快照，参数为索引 ID，指定 -to 时迁出到该文件夹并以只读方式打开仓库
+//	sync      和本地文件夹云端同步
+//	purge     清理仓库中不再被引用的数据
+//	fsck      检查仓库完整性，以只读方式打开仓库
+//	bench     测试云端存储服务速度
+//
+// 密钥通过 -key 传入十六进制格式，或者通过 -password 和 -salt 派生，密码也可以通过环境变量 DEJAVU_PASSWORD 传入。
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/go-humanize"
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/encryption"
+)
+
+// command 描述了一个子命令。
+type command struct {
+	name     string
+	usage    string
+	readOnly bool // 是否以只读方式打开仓库
+	run      func(opts *options, args []string) error
+}
+
+// options 描述了所有子命令共用的参数。
+type options struct {
+	repoPath string
+	dataPath string
+	key      string
+	password string
+	salt     string
+	cloudDir string
+	memo     string
+	to       string
+	page     int
+	pageSize int
+
+	repo *dejavu.Repo
+}
+
+var commands = []*command{
+	{name: "init", usage: "create repo dir", run: runInit},
+	{name: "snapshot", usage: "index data dir and create a snapshot", run: runSnapshot},
+	{name: "log", usage: "list snapshots", readOnly: true, run: runLog},
+	{name: "diff", usage: "diff two snapshots: diff <left> <right>", readOnly: true, run: runDiff},
+	{name: "checkout", usage: "checkout a snapshot: checkout <id>", run: runCheckout},
+	{name: "sync", usage: "sync with a local dir cloud", run: runSync},
+	{name: "purge", usage: "purge unreferenced data", run: runPurge},
+	{name: "fsck", usage: "check repo integrity", readOnly: true, run: runFsck},
+	{name: "bench", usage: "benchmark cloud", run: runBench},
+}
+
+func main() {
+	if err := run(os.Args[1:]); nil != err {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) (err error) {
+	if 1 > len(args) {
+		printUsage()
+		return errors.New("missing command")
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if args[0] == c.name {
+			cmd = c
+		}
+	}
+	if nil == cmd {
+		printUsage()
+		return fmt.Errorf("unknown command [%s]", args[0])
+	}
+
+	opts := &options{}
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.StringVar(&opts.repoPath, "repo", "", "repo dir")
+	flags.StringVar(&opts.dataPath, "data", "", "data dir")
+	flags.StringVar(&opts.key, "key", "", "hex encoded AES key")
+	flags.StringVar(&opts.password, "password", os.Getenv("DEJAVU_PASSWORD"), "password to derive AES key")
+	flags.StringVar(&opts.salt, "salt", "", "salt to derive AES key")
+	flags.StringVar(&opts.cloudDir, "cloud", "", "local dir used as cloud for sync and bench")
+	flags.StringVar(&opts.memo, "memo", "", "snapshot memo")
+	flags.StringVar(&opts.to, "to", "", "checkout to this dir instead of data dir")
+	flags.IntVar(&opts.page, "page", 1, "log page")
+	flags.IntVar(&opts.pageSize, "size", 32, "log page size")
+	if err = flags.Parse(args[1:]); nil != err {
+		return
+	}
+	if "" == opts.repoPath {
+		return errors.New("missing -repo")
+	}
+
+	if "init" != cmd.name {
+		if err = opts.open(cmd.readOnly || ("checkout" == cmd.name && "" != opts.to)); nil != err {
+			return
+		}
+	}
+	err = cmd.run(opts, flags.Args())
+	return
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: dejavu <command> -repo <dir> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", c.name, c.usage)
+	}
+}
+
+func (opts *options) aesKey() (ret []byte, err error) {
+	if "" != opts.key {
+		ret, err = hex.DecodeString(opts.key)
+		return
+	}
+	if "" == opts.password {
+		err = errors.New("missing -key or -password")
+		return
+	}
+	ret, err = encryption.KDF(opts.password, opts.salt)
+	return
+}
+
+func (opts *options) open(readOnly bool) (err error) {
+	aesKey, err := opts.aesKey()
+	if nil != err {
+		return
+	}
+	if readOnly {
+		opts.repo, err = dejavu.OpenRepoReadOnly(opts.repoPath, aesKey)
+		return
+	}
+
+	if "" == opts.dataPath {
+		return errors.New("missing -data")
+	}
+	var c cloud.Cloud
+	if "" != opts.cloudDir {
+		if err = os.MkdirAll(opts.cloudDir, 0755); nil != err {
+			return
+		}
+		c = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "dejavu", UserID: "0", AvailableSize: 1 << 40, Local: &cloud.ConfLocal{Endpoint: opts.cloudDir}}})
+	}
+	hostname, _ := os.Hostname()
+	tempPath := filepath.Join(os.TempDir(), "dejavu-cli")
+	opts.repo, err = dejavu.NewRepo(opts.dataPath, opts.repoPath, filepath.Join(tempPath, "history"), tempPath, "dejavu-cli-"+hostname, hostname, "cli", aesKey, nil, c)
+	return
+}
+
+func runInit(opts *options, args []string) (err error) {
+	if gulu.File.IsExist(opts.repoPath) {
+		return fmt.Errorf("repo dir [%s] already exists", opts.repoPath)
+	}
+	if err = os.MkdirAll(opts.repoPath, 0755); nil != err {
+		return
+	}
+	fmt.Println("initialized repo", opts.repoPath)
+	return
+}
+
+func runSnapshot(opts *options, args []string) (err error) {
+	index, err := opts.repo.Index(opts.memo, true, map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	fmt.Println(index.String())
+	return
+}
+
+func runLog(opts *options, args []string) (err error) {
+	indexes, totalCount, pageCount, err := opts.repo.GetIndexes(opts.page, opts.pageSize)
+	if nil != err {
+		return
+	}
+	for _, index := range indexes {
+		fmt.Printf("%s  %s  %6d files  %10s  %s\n", index.ID, time.UnixMilli(index.Created).Format("2006-01-02 15:04:05"), index.Count, humanize.BytesCustomCeil(uint64(index.Size), 2), index.Memo)
+	}
+	fmt.Printf("page %d/%d, %d snapshots\n", opts.page, pageCount, totalCount)
+	return
+}
+
+func runDiff(opts *options, args []string) (err error) {
+	if 2 != len(args) {
+		return errors.New("usage: diff <left> <right>")
+	}
+	diff, err := opts.repo.DiffIndex(args[0], args[1])
+	if nil != err {
+		return
+	}
+	for _, file := range diff.AddsLeft {
+		fmt.Println("A", file.Path)
+	}
+	for _, file := range diff.UpdatesLeft {
+		fmt.Println("M", file.Path)
+	}
+	for _, file := range diff.RemovesRight {
+		fmt.Println("D", file.Path)
+	}
+	for _, move := range diff.Moves {
+		fmt.Println("R", move.From.Path, "->", move.To.Path)
+	}
+	return
+}
+
+func runCheckout(opts *options, args []string) (err error) {
+	if 1 != len(args) {
+		return errors.New("usage: checkout <id>")
+	}
+	if "" != opts.to {
+		files, checkoutErr := opts.repo.CheckoutTo(args[0], opts.to, map[string]interface{}{})
+		if nil != checkoutErr {
+			return checkoutErr
+		}
+		fmt.Printf("checked out %d files to %s\n", len(files), opts.to)
+		return
+	}
+
+	upserts, removes, err := opts.repo.Checkout(args[0], map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	fmt.Printf("checked out, %d upserts, %d removes\n", len(upserts), len(removes))
+	return
+}
+
+func runSync(opts *options, args []string) (err error) {
+	if "" == opts.cloudDir {
+		return errors.New("missing -cloud")
+	}
+	mergeResult, trafficStat, err := opts.repo.Sync(map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	fmt.Printf("synced, %d upserts, %d removes, %d conflicts, uploaded %s, downloaded %s\n",
+		len(mergeResult.Upserts), len(mergeResult.Removes), len(mergeResult.Conflicts),
+		humanize.BytesCustomCeil(uint64(trafficStat.UploadBytes), 2), humanize.BytesCustomCeil(uint64(trafficStat.DownloadBytes), 2))
+	return
+}
+
+func runPurge(opts *options, args []string) (err error) {
+	stat, err := opts.repo.Purge()
+	if nil != err {
+		return
+	}
+	fmt.Printf("purged %d indexes, %d objects, %s\n", stat.Indexes, stat.Objects, humanize.BytesCustomCeil(uint64(stat.Size), 2))
+	return
+}
+
+func runFsck(opts *options, args []string) (err error) {
+	report, err := opts.repo.Fsck(map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	data, err := gulu.JSON.MarshalIndentJSON(report, "", "  ")
+	if nil != err {
+		return
+	}
+	fmt.Println(string(data))
+	if !report.Healthy() {
+		err = errors.New("repo is not healthy")
+	}
+	return
+}
+
+func runBench(opts *options, args []string) (err error) {
+	if "" == opts.cloudDir {
+		return errors.New("missing -cloud")
+	}
+	report, err := opts.repo.BenchmarkCloud(map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	data, err := gulu.JSON.MarshalIndentJSON(report, "", "  ")
+	if nil != err {
+		return
+	}
+	fmt.Println(string(data))
+	return
+}
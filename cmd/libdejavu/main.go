@@ -0,0 +1,181 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// libdejavu 将 mobile 包的接口导出为 C ABI，供非 Go 编写的桌面端嵌入。
+//
+// 构建：
+//
+//	go build -buildmode=c-shared -o libdejavu.so ./cmd/libdejavu
+//
+// 所有接口都返回 JSON 格式的 {"code": 0, "msg": "", "data": {}}，code 不为 0 时 msg 为错误信息，返回的字符串需要调用 DejavuFree 释放。
+// 进度回调 cb 可以为 NULL，userData 会原样传回回调。
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef void (*dejavu_progress_cb)(const char* event, int count, int total, uintptr_t userData);
+
+static void dejavu_call_progress(dejavu_progress_cb cb, const char* event, int count, int total, uintptr_t userData) {
+	cb(event, count, total, userData);
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/mobile"
+)
+
+var (
+	repos      = map[int64]*mobile.Repo{} // 句柄 -> 仓库
+	reposLock  = sync.Mutex{}
+	nextHandle int64
+)
+
+// cProgressListener 描述了调用 C 回调函数的进度监听器。
+type cProgressListener struct {
+	cb       C.dejavu_progress_cb
+	userData C.uintptr_t
+}
+
+func (listener *cProgressListener) OnProgress(event string, count, total int) {
+	cEvent := C.CString(event)
+	defer C.free(unsafe.Pointer(cEvent))
+	C.dejavu_call_progress(listener.cb, cEvent, C.int(count), C.int(total), listener.userData)
+}
+
+func newListener(cb C.dejavu_progress_cb, userData C.uintptr_t) mobile.ProgressListener {
+	if nil == cb {
+		return nil
+	}
+	return &cProgressListener{cb: cb, userData: userData}
+}
+
+// DejavuOpenRepo 用于打开仓库，conf 为 mobile.OpenRepo 的 JSON 配置，返回 {"handle": 1}。
+//
+//export DejavuOpenRepo
+func DejavuOpenRepo(conf *C.char) *C.char {
+	repo, err := mobile.OpenRepo(C.GoString(conf))
+	if nil != err {
+		return result(nil, err)
+	}
+
+	reposLock.Lock()
+	nextHandle++
+	handle := nextHandle
+	repos[handle] = repo
+	reposLock.Unlock()
+	return result(map[string]interface{}{"handle": handle}, nil)
+}
+
+// DejavuCloseRepo 用于释放仓库句柄。
+//
+//export DejavuCloseRepo
+func DejavuCloseRepo(handle C.longlong) *C.char {
+	reposLock.Lock()
+	delete(repos, int64(handle))
+	reposLock.Unlock()
+	return result(nil, nil)
+}
+
+// DejavuSync 用于同步。
+//
+//export DejavuSync
+func DejavuSync(handle C.longlong, cb C.dejavu_progress_cb, userData C.uintptr_t) *C.char {
+	repo, err := getRepo(handle)
+	if nil != err {
+		return result(nil, err)
+	}
+	return jsonResult(repo.Sync(newListener(cb, userData)))
+}
+
+// DejavuSyncDownload 用于只下载云端变更。
+//
+//export DejavuSyncDownload
+func DejavuSyncDownload(handle C.longlong, cb C.dejavu_progress_cb, userData C.uintptr_t) *C.char {
+	repo, err := getRepo(handle)
+	if nil != err {
+		return result(nil, err)
+	}
+	return jsonResult(repo.SyncDownload(newListener(cb, userData)))
+}
+
+// DejavuSyncUpload 用于只上传本地变更。
+//
+//export DejavuSyncUpload
+func DejavuSyncUpload(handle C.longlong, cb C.dejavu_progress_cb, userData C.uintptr_t) *C.char {
+	repo, err := getRepo(handle)
+	if nil != err {
+		return result(nil, err)
+	}
+	return jsonResult(repo.SyncUpload(newListener(cb, userData)))
+}
+
+// DejavuCheckout 用于迁出索引 id 到数据文件夹。
+//
+//export DejavuCheckout
+func DejavuCheckout(handle C.longlong, id *C.char, cb C.dejavu_progress_cb, userData C.uintptr_t) *C.char {
+	repo, err := getRepo(handle)
+	if nil != err {
+		return result(nil, err)
+	}
+	return jsonResult(repo.Checkout(C.GoString(id), newListener(cb, userData)))
+}
+
+// DejavuFree 用于释放接口返回的字符串。
+//
+//export DejavuFree
+func DejavuFree(p *C.char) {
+	C.free(unsafe.Pointer(p))
+}
+
+func getRepo(handle C.longlong) (ret *mobile.Repo, err error) {
+	reposLock.Lock()
+	defer reposLock.Unlock()
+
+	ret = repos[int64(handle)]
+	if nil == ret {
+		err = fmt.Errorf("invalid repo handle [%d]", handle)
+	}
+	return
+}
+
+func jsonResult(data string, err error) *C.char {
+	if nil != err {
+		return result(nil, err)
+	}
+	return result(json.RawMessage(data), nil)
+}
+
+func result(data interface{}, err error) *C.char {
+	ret := gulu.Ret.NewResult()
+	ret.Data = data
+	if nil != err {
+		ret.Code = -1
+		ret.Msg = err.Error()
+	}
+	buf, _ := gulu.JSON.MarshalJSON(ret)
+	return C.CString(string(buf))
+}
+
+func main() {}
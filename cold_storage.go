@@ -0,0 +1,100 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+const restoreDays = 7 // 归档对象恢复后的副本保留天数，足够完成下载
+
+// RequestRestore 用于请求恢复位于云端归档存储层的数据对象 objectIDs，tier 为恢复速度等级，如 cloud.RestoreTierStandard。
+//
+// 下载数据对象返回 ObjectArchivedError 时可以先调用该方法，再通过 WaitRestored 等待恢复完成后重试。云端存储服务不支持归档存储层时返回 cloud.ErrUnsupported。
+func (repo *Repo) RequestRestore(objectIDs []string, tier string) (err error) {
+	coldCloud, err := repo.coldStorageCloud()
+	if nil != err {
+		return
+	}
+
+	for _, id := range objectIDs {
+		if err = coldCloud.RestoreObject(objectKey(id), tier, restoreDays); nil != err {
+			logging.LogErrorf("request restore of object [%s] failed: %s", id, err)
+			return
+		}
+	}
+	return
+}
+
+// PendingRestores 用于获取 objectIDs 中仍位于归档存储层、尚不能下载的数据对象。
+func (repo *Repo) PendingRestores(objectIDs []string) (ret []string, err error) {
+	coldCloud, err := repo.coldStorageCloud()
+	if nil != err {
+		return
+	}
+
+	for _, id := range objectIDs {
+		status, statusErr := coldCloud.GetRestoreStatus(objectKey(id))
+		if nil != statusErr {
+			err = statusErr
+			return
+		}
+		if !status.Ready {
+			ret = append(ret, id)
+		}
+	}
+	return
+}
+
+// WaitRestored 用于每隔 interval 检查一次 objectIDs 的恢复状态，直到全部可以下载或者 ctx 结束。
+func (repo *Repo) WaitRestored(ctx context.Context, objectIDs []string, interval time.Duration) (err error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := objectIDs
+	for {
+		if pending, err = repo.PendingRestores(pending); nil != err || 1 > len(pending) {
+			return
+		}
+		logging.LogInfof("waiting for [%d] archived objects to be restored", len(pending))
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (repo *Repo) coldStorageCloud() (ret cloud.ColdStorageCloud, err error) {
+	ret, ok := repo.cloud.(cloud.ColdStorageCloud)
+	if !ok {
+		err = cloud.ErrUnsupported
+	}
+	return
+}
+
+// objectKey 返回数据对象 id 在云端的 key。
+func objectKey(id string) string {
+	return path.Join("objects", id[:2], id[2:])
+}
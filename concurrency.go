@@ -0,0 +1,146 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	tunerMaxFactor      = 2                      // 并发数最多可以增加到配置并发数的倍数
+	tunerMaxAttempts    = 3                      // 可重试错误的最大尝试次数
+	tunerSlowFactor     = 4                      // 请求耗时超过最小耗时的倍数时认为网络拥塞
+	tunerSlowThreshold  = 2 * time.Second        // 请求耗时低于该值时不认为网络拥塞，避免小对象的耗时抖动导致误判
+	tunerRetryBaseDelay = 500 * time.Millisecond // 重试前的等待时间，按尝试次数递增
+)
+
+// concurrencyTuner 用于按照 AIMD（加性增、乘性减）算法自适应调整上传下载分块的并发数。
+//
+// 每个请求成功且耗时正常时并发数增加 1/并发数，即每轮并发请求都成功后增加 1；请求出错或者耗时明显变长时并发数减半。
+// 为了避免同一轮的多个请求失败时连续减半，只有在上一次减半之后开始的请求才会触发减半。
+type concurrencyTuner struct {
+	base       int           // 配置的并发数，也是初始并发数
+	limit      float64       // 当前并发数
+	max        int           // 最大并发数
+	inflight   int           // 正在进行的请求数
+	seq        uint64        // 请求序号
+	decreased  uint64        // 最近一次减半时的请求序号
+	minLatency time.Duration // 请求的最小耗时
+
+	lock *sync.Mutex
+	cond *sync.Cond
+}
+
+func newConcurrencyTuner(base int) (ret *concurrencyTuner) {
+	if 1 > base {
+		base = 1
+	}
+	ret = &concurrencyTuner{base: base, limit: float64(base), max: base * tunerMaxFactor, lock: &sync.Mutex{}}
+	ret.cond = sync.NewCond(ret.lock)
+	return
+}
+
+// acquire 用于在并发数允许时开始一个请求，返回请求序号。
+func (tuner *concurrencyTuner) acquire() (seq uint64) {
+	tuner.lock.Lock()
+	defer tuner.lock.Unlock()
+	for tuner.inflight >= tuner.level() {
+		tuner.cond.Wait()
+	}
+	tuner.inflight++
+	tuner.seq++
+	return tuner.seq
+}
+
+// release 用于结束序号为 seq 的请求，根据请求耗时 latency 和错误 err 调整并发数。
+func (tuner *concurrencyTuner) release(seq uint64, latency time.Duration, err error) {
+	tuner.lock.Lock()
+	defer tuner.lock.Unlock()
+	defer tuner.cond.Broadcast()
+
+	tuner.inflight--
+	congested := nil != err
+	if nil == err {
+		if 0 == tuner.minLatency || latency < tuner.minLatency {
+			tuner.minLatency = latency
+		}
+		congested = tunerSlowThreshold < latency && tunerSlowFactor*tuner.minLatency < latency
+	}
+
+	if congested {
+		if seq > tuner.decreased {
+			tuner.limit = max(1, tuner.limit/2)
+			tuner.decreased = tuner.seq
+			logging.LogInfof("decreased concurrency to [%d], latency [%s], err [%v]", tuner.level(), latency, err)
+		}
+		return
+	}
+	tuner.limit = min(float64(tuner.max), tuner.limit+1/tuner.limit)
+}
+
+// level 用于获取当前并发数。
+func (tuner *concurrencyTuner) level() int {
+	return int(tuner.limit)
+}
+
+// Level 用于获取当前并发数。
+func (tuner *concurrencyTuner) Level() int {
+	tuner.lock.Lock()
+	defer tuner.lock.Unlock()
+	return tuner.level()
+}
+
+// do 用于在并发数允许时执行请求 fn，可重试的错误会在减小并发数后重试。
+func (tuner *concurrencyTuner) do(fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		seq := tuner.acquire()
+		start := time.Now()
+		err = fn()
+		tuner.release(seq, time.Since(start), err)
+		if nil == err || tunerMaxAttempts <= attempt || !IsRetryable(classifyErr(err)) {
+			return
+		}
+
+		logging.LogWarnf("request failed [attempt=%d], retry later: %s", attempt, err)
+		incRetry("transfer")
+		time.Sleep(time.Duration(attempt) * tunerRetryBaseDelay)
+	}
+}
+
+type tunerKey struct {
+	target cloud.Cloud
+	upload bool
+}
+
+// concurrencyTuner 用于获取云端存储服务 target 上传或者下载的并发调节器，调整后的并发数会在后续同步中沿用，配置的并发数变化时重新调整。
+func (repo *Repo) concurrencyTuner(target cloud.Cloud, upload bool) *concurrencyTuner {
+	key := tunerKey{target: target, upload: upload}
+	base := target.GetConcurrentReqs()
+	if value, ok := repo.tuners.Load(key); ok {
+		if tuner := value.(*concurrencyTuner); tuner.base == max(1, base) {
+			return tuner
+		}
+	}
+
+	tuner := newConcurrencyTuner(base)
+	repo.tuners.Store(key, tuner)
+	return tuner
+}
@@ -0,0 +1,232 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+const conflictsFile = "conflicts.json" // 未解决的冲突列表文件，位于仓库根目录下
+
+// 冲突解决方式。
+const (
+	ConflictChoiceLocal  = iota // 使用本地版本
+	ConflictChoiceCloud         // 使用云端版本
+	ConflictChoiceMerged        // 使用调用方合并后的内容
+)
+
+var (
+	ErrConflictNotFound      = errors.New("conflict not found")
+	ErrInvalidConflictChoice = errors.New("invalid conflict choice")
+)
+
+const EvtSyncConflictDetected = "repo.syncConflictDetected" // EvtSyncConflictDetected 描述了同步时发现冲突的事件，参数为 context 和 *ConflictEvent
+
+// ConflictEvent 描述了同步时发现的一个冲突的详细信息，每发现一个冲突就发布一次 EvtSyncConflictDetected 事件。
+type ConflictEvent struct {
+	*Conflict
+	LocalUpdated int64 `json:"localUpdated"` // 本地版本的修改时间，毫秒时间戳，本地已删除时为 0
+	CloudUpdated int64 `json:"cloudUpdated"` // 云端版本的修改时间，毫秒时间戳，云端已删除时为 0
+}
+
+// Conflict 描述了同步时产生的一个尚未解决的冲突。
+type Conflict struct {
+	Path         string `json:"path"`         // 冲突文件路径
+	LocalFileID  string `json:"localFileID"`  // 本地版本文件 ID，为空表示本地已删除
+	CloudFileID  string `json:"cloudFileID"`  // 云端版本文件 ID，为空表示云端已删除
+	LocalIndexID string `json:"localIndexID"` // 产生冲突时的本地索引 ID
+	CloudIndexID string `json:"cloudIndexID"` // 产生冲突时的云端索引 ID
+	Time         int64  `json:"time"`         // 产生冲突的时间，毫秒时间戳
+
+	CloudSystemID   string `json:"cloudSystemID,omitempty"`   // 上传云端索引的设备 ID
+	CloudSystemName string `json:"cloudSystemName,omitempty"` // 上传云端索引的设备名称
+	CloudAuthorID   string `json:"cloudAuthorID,omitempty"`   // 云端索引的作者 ID
+	CloudAuthorName string `json:"cloudAuthorName,omitempty"` // 云端索引的作者名称
+}
+
+// GetConflicts 用于获取尚未解决的冲突列表。
+func (repo *Repo) GetConflicts() (ret []*Conflict, err error) {
+	repo.conflictsLock.Lock()
+	defer repo.conflictsLock.Unlock()
+
+	ret, err = repo.readConflicts()
+	return
+}
+
+// ResolveConflict 用于解决路径为 path 的冲突。
+//
+// choice 为 ConflictChoiceMerged 时使用 merged 作为文件内容，否则迁出对应版本的文件。解决后会创建一个新的快照记录此次解决。
+func (repo *Repo) ResolveConflict(path string, choice int, merged []byte, context map[string]interface{}) (ret *entity.Index, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.conflictsLock.Lock()
+	defer repo.conflictsLock.Unlock()
+
+	conflicts, err := repo.readConflicts()
+	if nil != err {
+		return
+	}
+
+	var conflict *Conflict
+	var remains []*Conflict
+	for _, c := range conflicts {
+		if c.Path == path {
+			conflict = c
+			continue
+		}
+		remains = append(remains, c)
+	}
+	if nil == conflict {
+		err = ErrConflictNotFound
+		return
+	}
+
+	absPath := repo.absPath(path)
+	switch choice {
+	case ConflictChoiceLocal:
+		err = repo.checkoutConflictFile(conflict.LocalFileID, absPath, context)
+	case ConflictChoiceCloud:
+		err = repo.checkoutConflictFile(conflict.CloudFileID, absPath, context)
+	case ConflictChoiceMerged:
+		err = writeDataFile(repo.dataFS, absPath, merged)
+	default:
+		err = ErrInvalidConflictChoice
+	}
+	if nil != err {
+		logging.LogErrorf("resolve conflict [%s] failed: %s", path, err)
+		return
+	}
+
+	ret, err = repo.index(repo.options.ResolveConflictMemo+path, false, context)
+	if nil != err {
+		logging.LogErrorf("index after resolving conflict [%s] failed: %s", path, err)
+		return
+	}
+
+	err = repo.writeConflicts(remains)
+	return
+}
+
+func (repo *Repo) checkoutConflictFile(fileID, absPath string, context map[string]interface{}) (err error) {
+	if "" == fileID { // 该版本中文件已被删除
+		if err = repo.dataFS.Remove(absPath); nil != err && os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	file, err := repo.store.GetFile(fileID)
+	if nil != err {
+		return
+	}
+	err = repo.checkoutFile(file, repo.DataPath, 1, 1, context)
+	return
+}
+
+// recordConflicts 用于记录同步产生的冲突，同一路径的冲突只保留最新的一个。
+func (repo *Repo) recordConflicts(conflicts []*Conflict) {
+	if 1 > len(conflicts) {
+		return
+	}
+
+	repo.conflictsLock.Lock()
+	defer repo.conflictsLock.Unlock()
+
+	existing, err := repo.readConflicts()
+	if nil != err {
+		logging.LogWarnf("read conflicts failed, the conflicts will be reset: %s", err)
+	}
+
+	paths := map[string]bool{}
+	for _, c := range conflicts {
+		paths[c.Path] = true
+	}
+	var ret []*Conflict
+	for _, c := range existing {
+		if !paths[c.Path] {
+			ret = append(ret, c)
+		}
+	}
+	ret = append(ret, conflicts...)
+	if err = repo.writeConflicts(ret); nil != err {
+		logging.LogErrorf("write conflicts failed: %s", err)
+	}
+}
+
+// detectConflict 用于创建同步时发现的冲突，并发布 EvtSyncConflictDetected 事件以便界面及时显示冲突。
+func detectConflict(path string, localFile, cloudFile *entity.File, latest, cloudLatest *entity.Index, now time.Time, context map[string]interface{}) (ret *Conflict) {
+	ret = newConflict(path, localFile, cloudFile, latest, cloudLatest, now)
+	evt := &ConflictEvent{Conflict: ret}
+	if nil != localFile {
+		evt.LocalUpdated = localFile.Updated
+	}
+	if nil != cloudFile {
+		evt.CloudUpdated = cloudFile.Updated
+	}
+	eventbus.Publish(EvtSyncConflictDetected, context, evt)
+	return
+}
+
+func newConflict(path string, localFile, cloudFile *entity.File, latest, cloudLatest *entity.Index, now time.Time) (ret *Conflict) {
+	ret = &Conflict{Path: path, LocalIndexID: latest.ID, CloudIndexID: cloudLatest.ID, Time: now.UnixMilli(),
+		CloudSystemID: cloudLatest.SystemID, CloudSystemName: cloudLatest.SystemName, CloudAuthorID: cloudLatest.AuthorID, CloudAuthorName: cloudLatest.AuthorName}
+	if nil != localFile {
+		ret.LocalFileID = localFile.ID
+	}
+	if nil != cloudFile {
+		ret.CloudFileID = cloudFile.ID
+	}
+	return
+}
+
+func (repo *Repo) readConflicts() (ret []*Conflict, err error) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, conflictsFile))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = gulu.JSON.UnmarshalJSON(data, &ret)
+	return
+}
+
+func (repo *Repo) writeConflicts(conflicts []*Conflict) (err error) {
+	if nil == conflicts {
+		conflicts = []*Conflict{}
+	}
+	data, err := gulu.JSON.MarshalJSON(conflicts)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, conflictsFile), data, 0644)
+	return
+}
@@ -0,0 +1,215 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/88250/lute"
+	"github.com/88250/lute/ast"
+	"github.com/88250/lute/parse"
+	"github.com/siyuan-note/dataparser"
+	"github.com/siyuan-note/logging"
+)
+
+var ErrConflictNotSy = errors.New("conflict file is not a .sy file")
+
+// 块差异类型。
+const (
+	BlockDiffLocalOnly = "localOnly" // 块仅存在于本地版本
+	BlockDiffCloudOnly = "cloudOnly" // 块仅存在于云端版本
+	BlockDiffModified  = "modified"  // 块在两个版本中都存在但内容或属性不同
+)
+
+// BlockDiff 描述了冲突文档中一个块在本地版本和云端版本之间的差异。
+type BlockDiff struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	Op           string `json:"op"`           // 差异类型：BlockDiffLocalOnly、BlockDiffCloudOnly 或 BlockDiffModified
+	LocalParent  string `json:"localParent"`  // 本地版本中父块 ID
+	CloudParent  string `json:"cloudParent"`  // 云端版本中父块 ID
+	LocalContent string `json:"localContent"` // 本地版本中块的文本内容
+	CloudContent string `json:"cloudContent"` // 云端版本中块的文本内容
+}
+
+// ConflictMerge 描述了 .sy 文档冲突的合并数据，用于在界面上并排展示两个版本进行合并。
+type ConflictMerge struct {
+	Path  string          `json:"path"`
+	Local json.RawMessage `json:"local"` // 本地版本块树（.sy 文件内容），本地已删除时为 null
+	Cloud json.RawMessage `json:"cloud"` // 云端版本块树（.sy 文件内容），云端已删除时为 null
+	Diffs []*BlockDiff    `json:"diffs"` // 块级差异，先按本地版本块顺序，然后是仅存在于云端版本的块
+}
+
+// GetConflictMerge 用于获取路径为 path 的 .sy 冲突的合并数据。
+func (repo *Repo) GetConflictMerge(path string) (ret *ConflictMerge, err error) {
+	if !strings.HasSuffix(path, ".sy") {
+		err = ErrConflictNotSy
+		return
+	}
+
+	conflicts, err := repo.GetConflicts()
+	if nil != err {
+		return
+	}
+	var conflict *Conflict
+	for _, c := range conflicts {
+		if c.Path == path {
+			conflict = c
+			break
+		}
+	}
+	if nil == conflict {
+		err = ErrConflictNotFound
+		return
+	}
+
+	ret = &ConflictMerge{Path: path, Local: json.RawMessage("null"), Cloud: json.RawMessage("null")}
+	luteEngine := lute.New()
+	var localTree, cloudTree *parse.Tree
+	if "" != conflict.LocalFileID {
+		if ret.Local, localTree, err = repo.loadConflictTree(conflict.LocalFileID, luteEngine); nil != err {
+			return
+		}
+	}
+	if "" != conflict.CloudFileID {
+		if ret.Cloud, cloudTree, err = repo.loadConflictTree(conflict.CloudFileID, luteEngine); nil != err {
+			return
+		}
+	}
+	ret.Diffs = diffTrees(localTree, cloudTree)
+	return
+}
+
+// ApplyConflictMerge 用于将用户合并后的文档 merged（.sy 文件内容）写入数据文件夹并创建快照，同时将冲突标记为已解决。
+func (repo *Repo) ApplyConflictMerge(path string, merged []byte, context map[string]interface{}) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	if !strings.HasSuffix(path, ".sy") {
+		err = ErrConflictNotSy
+		return
+	}
+
+	if _, err = dataparser.ParseJSONWithoutFix(merged, lute.New().ParseOptions); nil != err {
+		logging.LogErrorf("parse merged tree [%s] failed: %s", path, err)
+		return
+	}
+	_, err = repo.ResolveConflict(path, ConflictChoiceMerged, merged, context)
+	return
+}
+
+func (repo *Repo) loadConflictTree(fileID string, luteEngine *lute.Lute) (data []byte, tree *parse.Tree, err error) {
+	file, err := repo.store.GetFile(fileID)
+	if nil != err {
+		logging.LogErrorf("get file failed: %s", err)
+		return
+	}
+	if data, err = repo.openFile(file); nil != err {
+		logging.LogErrorf("open file failed: %s", err)
+		return
+	}
+	if tree, err = dataparser.ParseJSONWithoutFix(data, luteEngine.ParseOptions); nil != err {
+		logging.LogErrorf("parse tree failed: %s", err)
+		return
+	}
+	return
+}
+
+func diffTrees(localTree, cloudTree *parse.Tree) (ret []*BlockDiff) {
+	ret = []*BlockDiff{}
+	localNodes, localIDs := treeBlocks(localTree)
+	cloudNodes, cloudIDs := treeBlocks(cloudTree)
+
+	for _, id := range localIDs {
+		localNode := localNodes[id]
+		cloudNode := cloudNodes[id]
+		if nil == cloudNode {
+			ret = append(ret, newBlockDiff(BlockDiffLocalOnly, localNode, nil))
+			continue
+		}
+		if !equalBlock(localNode, cloudNode) {
+			ret = append(ret, newBlockDiff(BlockDiffModified, localNode, cloudNode))
+		}
+	}
+	for _, id := range cloudIDs {
+		if nil == localNodes[id] {
+			ret = append(ret, newBlockDiff(BlockDiffCloudOnly, nil, cloudNodes[id]))
+		}
+	}
+	return
+}
+
+func treeBlocks(tree *parse.Tree) (nodes map[string]*ast.Node, ids []string) {
+	nodes = map[string]*ast.Node{}
+	if nil == tree {
+		return
+	}
+
+	ast.Walk(tree.Root, func(node *ast.Node, entering bool) ast.WalkStatus {
+		if !entering || !node.IsBlock() || ast.NodeDocument == node.Type || "" == node.ID {
+			return ast.WalkContinue
+		}
+
+		nodes[node.ID] = node
+		ids = append(ids, node.ID)
+		return ast.WalkContinue
+	})
+	return
+}
+
+func newBlockDiff(op string, localNode, cloudNode *ast.Node) (ret *BlockDiff) {
+	ret = &BlockDiff{Op: op}
+	if nil != localNode {
+		ret.ID, ret.Type = localNode.ID, localNode.Type.String()
+		ret.LocalContent = localNode.Content()
+		if nil != localNode.Parent {
+			ret.LocalParent = localNode.Parent.ID
+		}
+	}
+	if nil != cloudNode {
+		ret.ID, ret.Type = cloudNode.ID, cloudNode.Type.String()
+		ret.CloudContent = cloudNode.Content()
+		if nil != cloudNode.Parent {
+			ret.CloudParent = cloudNode.Parent.ID
+		}
+	}
+	return
+}
+
+// equalBlock 比较两个块的类型、内容和属性（忽略更新时间）。
+func equalBlock(n1, n2 *ast.Node) bool {
+	if n1.Type != n2.Type || n1.Content() != n2.Content() {
+		return false
+	}
+
+	n1Attrs := parse.IAL2Map(n1.KramdownIAL)
+	n2Attrs := parse.IAL2Map(n2.KramdownIAL)
+	delete(n1Attrs, "updated")
+	delete(n2Attrs, "updated")
+	if len(n1Attrs) != len(n2Attrs) {
+		return false
+	}
+	for k, v1 := range n1Attrs {
+		if v2, ok := n2Attrs[k]; !ok || v1 != v2 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+// ctxAPIOpsBase 是同步开始时云端累计请求次数在同步上下文 context 中的键，用于计算本次同步的请求次数。
+const ctxAPIOpsBase = "dejavuAPIOpsBase"
+
+// CloudPricing 描述了 S3 类存储服务的计费价格，价格单位由调用方决定（比如美元）。
+type CloudPricing struct {
+	ClassAPer1K       float64 `json:"classAPer1K"`       // LIST、PUT 等 A 类请求每千次的价格
+	ClassBPer1K       float64 `json:"classBPer1K"`       // GET、HEAD 等 B 类请求每千次的价格
+	DeletePer1K       float64 `json:"deletePer1K"`       // DELETE 请求每千次的价格，大多数服务免费
+	StoragePerGBMonth float64 `json:"storagePerGBMonth"` // 每 GB 每月存储的价格
+	EgressPerGB       float64 `json:"egressPerGB"`       // 每 GB 下行流量的价格
+}
+
+// DefaultCloudPricing 为 AWS S3 标准存储的参考价格（美元），其他服务请按实际价格配置。
+var DefaultCloudPricing = CloudPricing{
+	ClassAPer1K:       0.005,
+	ClassBPer1K:       0.0004,
+	StoragePerGBMonth: 0.023,
+	EgressPerGB:       0.09,
+}
+
+// CostEstimate 描述了按最近的同步记录推算的每月费用。
+type CostEstimate struct {
+	Days          float64       `json:"days"`          // 用于推算的同步记录覆盖的天数
+	Syncs         int           `json:"syncs"`         // 用于推算的同步次数
+	MonthlyOps    *cloud.APIOps `json:"monthlyOps"`    // 推算的每月请求次数
+	MonthlyEgress int64         `json:"monthlyEgress"` // 推算的每月下行字节数
+	StoredBytes   int64         `json:"storedBytes"`   // 云端存储字节数，由调用方传入
+	RequestCost   float64       `json:"requestCost"`   // 每月请求费用
+	EgressCost    float64       `json:"egressCost"`    // 每月下行流量费用
+	StorageCost   float64       `json:"storageCost"`   // 每月存储费用
+	Total         float64       `json:"total"`         // 每月总费用
+}
+
+const costEstimateMinDays = 1.0 // 同步记录覆盖不足一天时按一天推算，避免少量同步记录被过度放大
+
+// EstimateMonthlyCost 用于按同步日志中最近 days 天的请求次数和下行流量推算每月（30 天）的费用，days 小于 1 时使用全部同步日志。
+//
+// storedBytes 为云端存储字节数，可以通过云端存储服务的统计信息获取。
+func (repo *Repo) EstimateMonthlyCost(pricing *CloudPricing, days int, storedBytes int64) (ret *CostEstimate, err error) {
+	if nil == pricing {
+		pricing = &DefaultCloudPricing
+	}
+
+	repo.syncJournalLock.Lock()
+	entries, err := repo.readSyncJournal()
+	repo.syncJournalLock.Unlock()
+	if nil != err {
+		return
+	}
+
+	now := time.Now()
+	since := int64(0)
+	if 0 < days {
+		since = now.AddDate(0, 0, -days).UnixMilli()
+	}
+
+	ops := &cloud.APIOps{}
+	var egress, first int64
+	ret = &CostEstimate{StoredBytes: storedBytes}
+	for _, entry := range entries {
+		if entry.Start < since {
+			continue
+		}
+		if 0 == first {
+			first = entry.Start
+		}
+		ret.Syncs++
+		egress += entry.DownloadBytes
+		if nil != entry.APIOps {
+			ops.Add(entry.APIOps)
+		} else {
+			// 旧版本的同步记录没有按请求类型统计，按 GET 和 PUT 估算
+			ops.Get += int64(entry.APIGet)
+			ops.Put += int64(entry.APIPut)
+		}
+	}
+
+	if 0 < first {
+		ret.Days = max(float64(now.UnixMilli()-first)/float64(24*time.Hour/time.Millisecond), costEstimateMinDays)
+	}
+	scale := 0.0
+	if 0 < ret.Days {
+		scale = 30 / ret.Days
+	}
+	ret.MonthlyOps = &cloud.APIOps{
+		List:   int64(float64(ops.List) * scale),
+		Head:   int64(float64(ops.Head) * scale),
+		Get:    int64(float64(ops.Get) * scale),
+		Put:    int64(float64(ops.Put) * scale),
+		Delete: int64(float64(ops.Delete) * scale),
+	}
+	ret.MonthlyEgress = int64(float64(egress) * scale)
+
+	monthly := ret.MonthlyOps
+	ret.RequestCost = float64(monthly.List+monthly.Put)/1000*pricing.ClassAPer1K +
+		float64(monthly.Get+monthly.Head)/1000*pricing.ClassBPer1K +
+		float64(monthly.Delete)/1000*pricing.DeletePer1K
+	ret.EgressCost = float64(ret.MonthlyEgress) / (1 << 30) * pricing.EgressPerGB
+	ret.StorageCost = float64(storedBytes) / (1 << 30) * pricing.StoragePerGBMonth
+	ret.Total = ret.RequestCost + ret.EgressCost + ret.StorageCost
+	return
+}
+
+// cloudAPIOps 用于获取云端存储服务累计的请求次数，不支持统计时返回 nil。
+func (repo *Repo) cloudAPIOps() *cloud.APIOps {
+	if counter, ok := repo.cloud.(cloud.APIOpsCounter); ok {
+		return counter.GetAPIOps()
+	}
+	return nil
+}
+
+// countSyncAPIOps 用于在同步结束时将本次同步按请求类型统计的请求次数记录到 trafficStat。
+func (repo *Repo) countSyncAPIOps(context map[string]interface{}, trafficStat *TrafficStat) {
+	if nil == trafficStat {
+		return
+	}
+	base, _ := context[ctxAPIOpsBase].(*cloud.APIOps)
+	if ops := repo.cloudAPIOps(); nil != ops && nil != base {
+		trafficStat.APIOps = ops.Sub(base)
+	}
+}
@@ -0,0 +1,239 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/logging"
+)
+
+// DataFS 描述了索引和迁出时访问数据文件夹（包括额外根目录）使用的文件系统，默认使用本地文件系统。
+//
+// 嵌入方可以实现该接口将仓库指向非 POSIX 的存储（比如加密保险库、Android 内容提供器），然后通过 Repo.SetDataFS 设置。
+// 路径参数都是数据文件夹下的绝对路径，文件不存在时需要返回 os.ErrNotExist。
+//
+// 使用自定义文件系统时，同步合并逐个应用文件变更，不再通过暂存和回滚日志原子地应用，也不会整体移动或删除目录，
+// 不会读写扩展属性，符号链接会迁出为内容是链接目标的普通文件，也不会从数据对象链接迁出。
+type DataFS interface {
+	WalkDir(root string, fn fs.WalkDirFunc) error
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Create(name string) (DataFile, error) // 创建或者截断文件，迁出时用于写入临时文件
+	Rename(oldPath, newPath string) error // 用临时文件替换目标文件，目标文件存在时需要覆盖
+	Remove(name string) error
+	Chtimes(name string, modTime time.Time) error
+	Chmod(name string, mode os.FileMode) error
+	RemoveEmptyDirs(dir string, excludes ...string) error
+}
+
+// DataFile 描述了 DataFS 创建的可写文件。
+type DataFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// SetDataFS 用于设置访问数据文件夹使用的文件系统，dataFS 为 nil 时使用本地文件系统。
+func (repo *Repo) SetDataFS(dataFS DataFS) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if nil == dataFS {
+		dataFS = &osDataFS{}
+	}
+	repo.dataFS = dataFS
+}
+
+// localData 用于判断数据文件夹是否使用本地文件系统。
+func (repo *Repo) localData() bool {
+	_, ok := repo.dataFS.(*osDataFS)
+	return ok
+}
+
+// checkoutFS 用于获取迁出到 checkoutDir 时使用的文件系统，只有迁出到数据文件夹时使用 DataFS，迁出到暂存文件夹等其他文件夹时使用本地文件系统。
+func (repo *Repo) checkoutFS(checkoutDir string) DataFS {
+	if filepath.Clean(checkoutDir) == filepath.Clean(repo.DataPath) {
+		return repo.dataFS
+	}
+	return &osDataFS{}
+}
+
+// removeEmptyDataDirs 用于清理数据文件夹下的空文件夹。
+func (repo *Repo) removeEmptyDataDirs() {
+	repo.dataFS.RemoveEmptyDirs(repo.DataPath, repo.options.RemoveEmptyDirExcludes...)
+}
+
+// readDataFile 用于通过文件系统 dataFS 读取文件 name 的全部内容。
+func readDataFile(dataFS DataFS, name string) (ret []byte, err error) {
+	reader, err := dataFS.Open(name)
+	if nil != err {
+		return
+	}
+	ret, err = io.ReadAll(reader)
+	if closeErr := reader.Close(); nil == err {
+		err = closeErr
+	}
+	return
+}
+
+// writeDataFile 用于通过文件系统 dataFS 写入文件 name，先写入临时文件再替换目标文件。
+func writeDataFile(dataFS DataFS, name string, data []byte) (err error) {
+	if err = dataFS.MkdirAll(filepath.Dir(name), 0755); nil != err {
+		return
+	}
+
+	tmp := name + gulu.Rand.String(7) + ".tmp"
+	f, err := dataFS.Create(tmp)
+	if nil != err {
+		return
+	}
+	if _, err = f.Write(data); nil == err {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = dataFS.Rename(tmp, name)
+	}
+	if nil != err {
+		dataFS.Remove(tmp)
+	}
+	return
+}
+
+// osDataFS 描述了本地文件系统，读取和删除数据文件时使用 filelock 加锁。
+type osDataFS struct{}
+
+func (*osDataFS) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return filelock.Walk(root, fn)
+}
+
+func (*osDataFS) Open(name string) (ret io.ReadCloser, err error) {
+	f, err := filelock.OpenFile(name, os.O_RDONLY, 0644)
+	if nil != err {
+		filelock.Unlock(name) // 打开失败时 filelock 不会释放锁
+		return
+	}
+	ret = &lockedFile{File: f}
+	return
+}
+
+func (*osDataFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (*osDataFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (*osDataFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (*osDataFS) Create(name string) (DataFile, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+func (*osDataFS) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (*osDataFS) Remove(name string) error {
+	// 不使用 filelock.Remove，它在文件被占用时会直接退出进程，调用方需要按 retryLocked 重试
+	filelock.Lock(name)
+	defer filelock.Unlock(name)
+	return os.RemoveAll(name)
+}
+
+func (*osDataFS) Chtimes(name string, modTime time.Time) error {
+	return os.Chtimes(name, modTime, modTime)
+}
+
+func (*osDataFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (*osDataFS) RemoveEmptyDirs(dir string, excludes ...string) error {
+	return gulu.File.RemoveEmptyDirs(dir, excludes...)
+}
+
+// lockedFile 描述了通过 filelock 打开的文件，关闭时释放锁。
+type lockedFile struct {
+	*os.File
+}
+
+func (f *lockedFile) Close() error {
+	return filelock.CloseFile(f.File)
+}
+
+// applyFilesDirect 用于在数据文件夹使用自定义文件系统时逐个应用文件变更，目录操作会展开为其中文件的移动和删除。
+//
+// 和 applyFiles 不同，应用过程中出错时不会回滚，已经应用的变更会保留，下次同步时会重新比较。
+func (repo *Repo) applyFilesDirect(upserts, removes []*entity.File, moves []*Move, dirOps []*DirOp, context map[string]interface{}) (err error) {
+	for _, op := range dirOps {
+		moves, removes = append(moves, op.Moves...), append(removes, op.Files...)
+	}
+
+	for _, move := range moves {
+		from, to := repo.absPath(move.From.Path), repo.absPath(move.To.Path)
+		if err = repo.dataFS.MkdirAll(filepath.Dir(to), 0755); nil != err {
+			return
+		}
+		if err = retryLocked(func() error { return repo.dataFS.Rename(from, to) }); nil != err {
+			logging.LogErrorf("move [%s] to [%s] failed: %s", move.From.Path, move.To.Path, err)
+			return
+		}
+		// 还原修改时间，使得下次索引时移动后的文件 ID 和云端一致
+		if chtimesErr := repo.dataFS.Chtimes(to, time.UnixMilli(move.To.Updated)); nil != chtimesErr {
+			logging.LogWarnf("change time of moved file [%s] failed: %s", move.To.Path, chtimesErr)
+		}
+		repo.recordCheckoutPath(move.To, repo.DataPath)
+		repo.forgetEscapedPath(move.From.Path)
+	}
+
+	if err = repo.checkoutFiles(upserts, context); nil != err {
+		return
+	}
+
+	total := len(removes)
+	eventbus.Publish(eventbus.EvtCheckoutRemoveFiles, context, total)
+	for i, file := range removes {
+		if err = repo.removeDataFile(repo.absPath(file.Path)); nil != err && !os.IsNotExist(err) {
+			logging.LogErrorf("remove file [%s] failed: %s", file.Path, err)
+			if isFileLockedErr(err) {
+				err = &LockedFilesError{Paths: []string{file.Path}, Err: err}
+			}
+			return
+		}
+		err = nil
+		repo.forgetEscapedPath(file.Path)
+		eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, i+1, total)
+	}
+	return
+}
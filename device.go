@@ -0,0 +1,214 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	ErrDeviceRevoked       = cloud.ErrDeviceRevoked                      // ErrDeviceRevoked 描述了当前设备已被吊销，不能再上传数据
+	ErrDeviceNotFound      = errors.New("device not found")              // ErrDeviceNotFound 描述了云端设备列表中不存在该设备的错误
+	ErrRevokeCurrentDevice = errors.New("can not revoke current device") // ErrRevokeCurrentDevice 描述了不能吊销当前设备的错误
+)
+
+// EvtCloudLatestFromRevokedDevice 描述了同步时发现云端最新索引由已吊销设备上传的事件，参数为 context 和 *Device
+const EvtCloudLatestFromRevokedDevice = "repo.cloudLatestFromRevokedDevice"
+
+// devicesKey 为云端设备列表的对象 key。
+const devicesKey = "devices.json"
+
+// ctxRevokedDevices 为同步上下文中已吊销设备的键，值为设备 ID 到 *Device 的映射。
+const ctxRevokedDevices = "revokedDevices"
+
+// Device 描述了登记在云端仓库中的设备。
+type Device struct {
+	ID          string `json:"id"`                // 设备 ID
+	Name        string `json:"name"`              // 设备名称
+	OS          string `json:"os"`                // 操作系统
+	Fingerprint string `json:"fingerprint"`       // 设备密钥指纹
+	Registered  int64  `json:"registered"`        // 登记时间
+	Revoked     int64  `json:"revoked,omitempty"` // 吊销时间，为 0 时未吊销
+}
+
+// RegisterDevice 用于将当前设备以名称 name 和密钥指纹 fingerprint 登记到云端设备列表中，已登记时更新名称和指纹。
+func (repo *Repo) RegisterDevice(name, fingerprint string, context map[string]interface{}) (device *Device, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+		return
+	}
+	defer repo.unlockCloud(context)
+
+	devices, err := repo.getCloudDevices()
+	if nil != err {
+		return
+	}
+	for _, d := range devices {
+		if d.ID == repo.DeviceID {
+			device = d
+			break
+		}
+	}
+	if nil != device && 0 < device.Revoked {
+		err = ErrDeviceRevoked
+		return
+	}
+	if nil == device {
+		device = &Device{ID: repo.DeviceID, Registered: time.Now().UnixMilli()}
+		devices = append(devices, device)
+	}
+	device.Name, device.OS, device.Fingerprint = name, repo.DeviceOS, fingerprint
+	err = repo.putCloudDevices(devices)
+	return
+}
+
+// GetDevices 用于获取云端设备列表。
+func (repo *Repo) GetDevices() (devices []*Device, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	devices, err = repo.getCloudDevices()
+	return
+}
+
+// RevokeDevice 用于吊销设备 deviceID，吊销后该设备同步时不能再上传数据。
+//
+// 官方存储服务会在服务端拒绝该设备的上传；S3 和 WebDAV 等服务由客户端根据云端设备列表拒绝上传，其他设备同步时如果发现云端最新索引由已吊销的设备上传，
+// 会发布 EvtCloudLatestFromRevokedDevice 事件提示用户。
+func (repo *Repo) RevokeDevice(deviceID string, context map[string]interface{}) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if deviceID == repo.DeviceID {
+		err = ErrRevokeCurrentDevice
+		return
+	}
+
+	if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+		return
+	}
+	defer repo.unlockCloud(context)
+
+	devices, err := repo.getCloudDevices()
+	if nil != err {
+		return
+	}
+	var device *Device
+	for _, d := range devices {
+		if d.ID == deviceID {
+			device = d
+			break
+		}
+	}
+	if nil == device {
+		err = ErrDeviceNotFound
+		return
+	}
+
+	if revoker, ok := repo.cloud.(cloud.DeviceRevoker); ok {
+		if err = revoker.RevokeDevice(deviceID); nil != err {
+			logging.LogErrorf("revoke device [%s] failed: %s", deviceID, err)
+			return
+		}
+	}
+	if 0 < device.Revoked {
+		return
+	}
+	device.Revoked = time.Now().UnixMilli()
+	if err = repo.putCloudDevices(devices); nil != err {
+		return
+	}
+	logging.LogInfof("revoked device [%s, %s]", device.ID, device.Name)
+	return
+}
+
+// getCloudDevices 用于下载云端设备列表，云端没有设备列表时返回空列表。
+func (repo *Repo) getCloudDevices() (devices []*Device, err error) {
+	data, err := repo.cloud.DownloadObject(devicesKey)
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, &devices); nil != err {
+		logging.LogErrorf("unmarshal cloud devices failed: %s", err)
+	}
+	return
+}
+
+func (repo *Repo) putCloudDevices(devices []*Device) (err error) {
+	data, err := gulu.JSON.MarshalJSON(devices)
+	if nil != err {
+		return
+	}
+	if _, err = repo.cloud.UploadBytes(devicesKey, data, true); nil != err {
+		logging.LogErrorf("upload cloud devices failed: %s", err)
+	}
+	return
+}
+
+// checkDeviceRevoked 用于在上传数据前检查当前设备是否已被吊销，并将已吊销的设备记录到同步上下文中。
+func (repo *Repo) checkDeviceRevoked(context map[string]interface{}) (err error) {
+	devices, err := repo.getCloudDevices()
+	if nil != err {
+		logging.LogErrorf("get cloud devices failed: %s", err)
+		return
+	}
+
+	revoked := map[string]*Device{}
+	for _, device := range devices {
+		if 0 < device.Revoked {
+			revoked[device.ID] = device
+		}
+	}
+	context[ctxRevokedDevices] = revoked
+	if device := revoked[repo.DeviceID]; nil != device {
+		logging.LogErrorf("device [%s] has been revoked at [%s]", repo.DeviceID, time.UnixMilli(device.Revoked).Format("2006-01-02 15:04:05"))
+		err = ErrDeviceRevoked
+	}
+	return
+}
+
+// flagRevokedUploader 用于在云端最新索引 cloudLatest 由已吊销的设备在吊销后上传时发布 EvtCloudLatestFromRevokedDevice 事件。
+func (repo *Repo) flagRevokedUploader(cloudLatest *entity.Index, context map[string]interface{}) {
+	revoked, _ := context[ctxRevokedDevices].(map[string]*Device)
+	device := revoked[cloudLatest.SystemID]
+	if nil == device || cloudLatest.Created < device.Revoked {
+		return
+	}
+
+	logging.LogWarnf("cloud latest [%s] is uploaded by revoked device [%s, %s]", cloudLatest.ID, device.ID, device.Name)
+	eventbus.Publish(EvtCloudLatestFromRevokedDevice, context, device)
+}
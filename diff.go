@@ -25,8 +25,8 @@ import (
 
 // diffUpsertRemove 比较 left 多于/变动 right 的文件以及 left 少于 right 的文件。
 func (repo *Repo) diffUpsertRemove(left, right []*entity.File, log bool) (upserts, removes []*entity.File) {
-	l := map[string]*entity.File{}
-	r := map[string]*entity.File{}
+	l := make(map[string]*entity.File, len(left))
+	r := make(map[string]*entity.File, len(right))
 	for _, f := range left {
 		l[f.Path] = f
 	}
@@ -75,6 +75,7 @@ type LeftRightDiff struct {
 	UpdatesLeft  []*entity.File
 	UpdatesRight []*entity.File
 	RemovesRight []*entity.File
+	Moves        []*Move // 从右侧移动到左侧的文件，这些文件不会再出现在 AddsLeft 和 RemovesRight 中
 }
 
 // DiffIndex 返回索引 left 比索引 right 新增、更新和删除的文件列表。
@@ -101,7 +102,12 @@ func (repo *Repo) diffIndex(leftIndex, rightIndex *entity.Index) (ret *LeftRight
 	if nil != err {
 		return
 	}
+	ret = repo.diffFiles(leftIndex, rightIndex, leftFiles, rightFiles)
+	return
+}
 
+// diffFiles 用于比较索引 leftIndex 的文件 leftFiles 和索引 rightIndex 的文件 rightFiles。
+func (repo *Repo) diffFiles(leftIndex, rightIndex *entity.Index, leftFiles, rightFiles []*entity.File) (ret *LeftRightDiff) {
 	l := map[string]*entity.File{}
 	r := map[string]*entity.File{}
 	for _, f := range leftFiles {
@@ -136,6 +142,8 @@ func (repo *Repo) diffIndex(leftIndex, rightIndex *entity.Index) (ret *LeftRight
 			continue
 		}
 	}
+
+	ret.Moves, ret.AddsLeft, ret.RemovesRight = repo.detectMoves(ret.AddsLeft, ret.RemovesRight)
 	return
 }
 
@@ -143,6 +151,13 @@ func equalFile(left, right *entity.File) bool {
 	if left.Path != right.Path {
 		return false
 	}
+	if left.Symlink != right.Symlink {
+		return false
+	}
+	if "" != left.Symlink {
+		// 符号链接的修改时间在迁出时无法还原，链接目标相同即认为相同
+		return true
+	}
 	if left.Updated/1000 != right.Updated/1000 { // Improve data sync file timestamp comparison https://github.com/siyuan-note/siyuan/issues/8573
 		return false
 	}
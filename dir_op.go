@@ -0,0 +1,190 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/logging"
+)
+
+const dirOpMinFiles = 2 // 识别为目录操作的最少文件数
+
+// DirOp 描述了一个目录级别的变更：整个目录被删除或者移动，应用时只需要一次删除或者重命名。
+type DirOp struct {
+	Path  string         // 目录路径
+	To    string         // 移动后的目录路径，为空表示删除目录
+	Count int            // 目录下包含的文件数
+	Files []*entity.File // 删除目录时目录下被删除的文件
+	Moves []*Move        // 移动目录时目录下被移动的文件
+}
+
+// detectDirOps 用于从移动文件 moves 和删除文件 removes 中识别出整个目录的移动和删除，返回目录操作列表以及剩余的 moves 和 removes。
+//
+// 只有数据文件夹中该目录下的文件全部被删除（或者以相同的相对路径移动到同一个不存在的目录下）时才会识别为目录操作，
+// 目录下存在其他文件（比如被忽略的文件）时仍然逐个文件处理，避免误删。额外根目录本身以及跨根目录的移动不做识别。
+func (repo *Repo) detectDirOps(moves []*Move, removes []*entity.File) (dirOps []*DirOp, restMoves []*Move, restRemoves []*entity.File) {
+	restMoves, restRemoves = moves, removes
+	if dirOpMinFiles > len(moves) && dirOpMinFiles > len(removes) {
+		return
+	}
+
+	removeDirs := map[string][]*entity.File{}
+	for _, file := range removes {
+		for dir := path.Dir(file.Path); "/" != dir; dir = path.Dir(dir) {
+			removeDirs[dir] = append(removeDirs[dir], file)
+		}
+	}
+	type dirPair struct{ from, to string }
+	moveDirs := map[dirPair][]*Move{}
+	for _, move := range moves {
+		for dir := path.Dir(move.From.Path); "/" != dir; dir = path.Dir(dir) {
+			rel := strings.TrimPrefix(move.From.Path, dir)
+			if !strings.HasSuffix(move.To.Path, rel) {
+				break
+			}
+			to := strings.TrimSuffix(move.To.Path, rel)
+			if "" == to || "/" == to || to == dir {
+				break
+			}
+			moveDirs[dirPair{dir, to}] = append(moveDirs[dirPair{dir, to}], move)
+		}
+	}
+
+	var candidates []*DirOp
+	for dir, files := range removeDirs {
+		if dirOpMinFiles <= len(files) {
+			candidates = append(candidates, &DirOp{Path: dir, Count: len(files), Files: files})
+		}
+	}
+	for pair, dirMoves := range moveDirs {
+		if dirOpMinFiles <= len(dirMoves) {
+			candidates = append(candidates, &DirOp{Path: pair.from, To: pair.to, Count: len(dirMoves), Moves: dirMoves})
+		}
+	}
+	// 优先识别层级较浅的目录，其下的目录不再重复识别
+	sort.Slice(candidates, func(i, j int) bool {
+		if di, dj := strings.Count(candidates[i].Path, "/"), strings.Count(candidates[j].Path, "/"); di != dj {
+			return di < dj
+		}
+		return candidates[i].Path+candidates[i].To < candidates[j].Path+candidates[j].To
+	})
+
+	covered := func(p string) bool {
+		for _, op := range dirOps {
+			if prefixContains(op.Path, p) || ("" != op.To && prefixContains(op.To, p)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, op := range candidates {
+		if covered(op.Path) || ("" != op.To && covered(op.To)) || !repo.dirOpApplicable(op) {
+			continue
+		}
+		dirOps = append(dirOps, op)
+	}
+	if 1 > len(dirOps) {
+		return
+	}
+
+	handled := map[string]bool{}
+	for _, op := range dirOps {
+		for _, file := range op.Files {
+			handled[file.Path] = true
+		}
+		for _, move := range op.Moves {
+			handled[move.From.Path] = true
+		}
+		logging.LogInfof("detected dir op [%s -> %s], files [%d]", op.Path, op.To, op.Count)
+	}
+	restMoves, restRemoves = nil, nil
+	for _, move := range moves {
+		if !handled[move.From.Path] {
+			restMoves = append(restMoves, move)
+		}
+	}
+	for _, file := range removes {
+		if !handled[file.Path] {
+			restRemoves = append(restRemoves, file)
+		}
+	}
+	return
+}
+
+// dirOpApplicable 用于判断目录操作 op 能否直接作用于整个目录：数据文件夹中该目录下的文件都包含在 op 中，且移动的目标目录不存在。
+func (repo *Repo) dirOpApplicable(op *DirOp) bool {
+	if !repo.localData() {
+		return false
+	}
+
+	for _, root := range repo.roots {
+		if prefixContains(op.Path, root.Prefix) || ("" != op.To && prefixContains(op.To, root.Prefix)) {
+			return false
+		}
+	}
+
+	files := map[string]bool{}
+	for _, file := range op.Files {
+		files[filepath.Clean(repo.absPath(file.Path))] = true
+	}
+	if "" != op.To {
+		if fromRoot, _ := repo.rootOf(op.Path); nil != fromRoot {
+			if toRoot, _ := repo.rootOf(op.To); fromRoot != toRoot {
+				return false
+			}
+		} else if toRoot, _ := repo.rootOf(op.To); nil != toRoot {
+			return false
+		}
+		if lexists(repo.absPath(op.To)) {
+			return false
+		}
+		for _, move := range op.Moves {
+			files[filepath.Clean(repo.absPath(move.From.Path))] = true
+		}
+	}
+
+	absDir := repo.absPath(op.Path)
+	if !filelock.IsExist(absDir) {
+		return false
+	}
+	applicable := true
+	err := filelock.Walk(absDir, func(p string, d fs.DirEntry, err error) error {
+		if nil != err {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !files[filepath.Clean(p)] {
+			applicable = false
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if nil != err {
+		logging.LogWarnf("walk dir [%s] failed: %s", absDir, err)
+		return false
+	}
+	return applicable
+}
@@ -0,0 +1,254 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/encryption"
+	"github.com/siyuan-note/logging"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	EncryptionLegacy = 0 // 直接使用仓库密钥进行 AES-256-GCM 加密，数据格式为 nonce + 密文
+	EncryptionAEAD   = 1 // 使用由仓库密钥和对象 ID 派生的对象密钥进行 AES-256-GCM 加密，数据格式见 encryptAEAD
+)
+
+var ErrUnknownEncryption = errors.New("unknown encryption")
+
+const encryptionFile = "encryption.json" // 数据对象文件夹下记录写入加密方式的文件
+
+// objectEncryption 描述了写入文件和分块对象时使用的加密方式。
+type objectEncryption struct {
+	Version int `json:"version"` // 加密方式
+}
+
+// aeadMagic 为 EncryptionAEAD 加密数据的头部标识，后面紧跟一个字节的格式版本号。
+var aeadMagic = []byte("DJVE")
+
+const (
+	aeadVersion1   = 1
+	aeadHeaderSize = 5  // aeadMagic + 版本号
+	aeadNonceSize  = 12 // AES-GCM 标准 nonce 长度
+	aeadTagSize    = 16 // AES-GCM 认证标签长度
+)
+
+// deriveObjectKey 用于派生对象 id 的加密密钥。
+//
+// 对象密钥 = HKDF-SHA256(IKM=仓库密钥, salt=空, info="dejavu object key v1" + 对象 ID)，长度 32 字节。
+// 每个对象使用独立的密钥，即使随机 nonce 发生碰撞也不会在不同对象之间复用同一个密钥和 nonce。
+func deriveObjectKey(repoKey []byte, id string) (ret []byte, err error) {
+	info := append([]byte("dejavu object key v1"), id...)
+	ret = make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, repoKey, nil, info), ret)
+	return
+}
+
+// encryptAEAD 用于使用 EncryptionAEAD 方式加密对象 id 的数据。
+//
+// 数据格式为：aeadMagic(4) + 版本号(1) + 随机 nonce(12) + 密文 + 认证标签(16)。
+// 认证附加数据为头部（aeadMagic + 版本号）加对象 ID，所以密文被篡改、截断或者被替换为其他对象的密文时都会解密失败。
+func encryptAEAD(repoKey []byte, id string, data []byte) (ret []byte, err error) {
+	aead, err := newObjectAEAD(repoKey, id)
+	if nil != err {
+		return
+	}
+
+	ret = make([]byte, aeadHeaderSize+aeadNonceSize, aeadHeaderSize+aeadNonceSize+len(data)+aeadTagSize)
+	copy(ret, aeadMagic)
+	ret[len(aeadMagic)] = aeadVersion1
+	nonce := ret[aeadHeaderSize:]
+	if _, err = rand.Read(nonce); nil != err {
+		return
+	}
+	ret = aead.Seal(ret, nonce, data, aeadAdditionalData(ret[:aeadHeaderSize], id))
+	return
+}
+
+// decryptAEAD 用于解密 encryptAEAD 加密的对象 id 的数据。
+func decryptAEAD(repoKey []byte, id string, data []byte) (ret []byte, err error) {
+	if !isAEADEncrypted(data) {
+		err = ErrUnknownEncryption
+		return
+	}
+
+	aead, err := newObjectAEAD(repoKey, id)
+	if nil != err {
+		return
+	}
+	nonce := data[aeadHeaderSize : aeadHeaderSize+aeadNonceSize]
+	ret, err = aead.Open(nil, nonce, data[aeadHeaderSize+aeadNonceSize:], aeadAdditionalData(data[:aeadHeaderSize], id))
+	return
+}
+
+// isAEADEncrypted 用于判断数据是否为 EncryptionAEAD 格式。
+//
+// 旧格式数据以随机 nonce 开头，有极小的概率和头部标识相同，所以调用方在按 EncryptionAEAD 解密失败时还需要尝试按旧格式解密。
+func isAEADEncrypted(data []byte) bool {
+	return aeadHeaderSize+aeadNonceSize+aeadTagSize <= len(data) && bytes.HasPrefix(data, aeadMagic) && aeadVersion1 == data[len(aeadMagic)]
+}
+
+func newObjectAEAD(repoKey []byte, id string) (ret cipher.AEAD, err error) {
+	key, err := deriveObjectKey(repoKey, id)
+	if nil != err {
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return
+	}
+	ret, err = cipher.NewGCM(block)
+	return
+}
+
+func aeadAdditionalData(header []byte, id string) []byte {
+	return append(append([]byte{}, header...), id...)
+}
+
+// encrypt 用于按照 version 加密对象 id 的数据。
+func encrypt(version int, repoKey []byte, id string, data []byte) ([]byte, error) {
+	switch version {
+	case EncryptionLegacy:
+		return encryption.AesEncrypt(data, repoKey)
+	case EncryptionAEAD:
+		return encryptAEAD(repoKey, id, data)
+	}
+	return nil, ErrUnknownEncryption
+}
+
+// decrypt 用于解密对象 id 的数据，自动识别加密方式，version 为识别出的加密方式。
+func decrypt(repoKey []byte, id string, data []byte) (ret []byte, version int, err error) {
+	if isAEADEncrypted(data) {
+		if ret, err = decryptAEAD(repoKey, id, data); nil == err {
+			version = EncryptionAEAD
+			return
+		}
+	}
+
+	if aeadNonceSize+aeadTagSize > len(data) { // 数据不完整时 AesDecrypt 会越界
+		if nil == err {
+			err = errors.New("invalid encrypted data")
+		}
+		return
+	}
+	legacy, legacyErr := encryption.AesDecrypt(data, repoKey)
+	if nil != legacyErr {
+		if nil == err {
+			err = legacyErr
+		}
+		return
+	}
+	ret, version, err = legacy, EncryptionLegacy, nil
+	return
+}
+
+// MigrateEncryption 将本地所有文件和分块对象重新加密为 version 方式，后续写入也使用该方式，返回重新加密的对象数。
+//
+// 重新加密时对象 ID 不变，已经是 version 方式加密的对象会被跳过，所以迁移中断后再次调用即可继续。
+func (store *Store) MigrateEncryption(version int) (objects int, err error) {
+	logging.LogInfof("migrating data repo [%s] to encryption [%d]", store.Path, version)
+
+	// 按照目标加密方式检查并提升仓库格式版本，迁移成功前后续写入仍然使用原来的加密方式
+	previous := store.Encryption
+	store.Encryption = version
+	err = store.checkWritable()
+	store.Encryption = previous
+	if nil != err {
+		return
+	}
+	err = store.walkObjects(func(id, absPath string) error {
+		data, readErr := store.fs.ReadFile(absPath)
+		if nil != readErr {
+			return readErr
+		}
+		plain, current, decryptErr := decrypt(store.AesKey, id, data)
+		if nil != decryptErr {
+			return &LocalCorruptError{ObjectID: id, Err: decryptErr}
+		}
+		if current == version {
+			return nil
+		}
+
+		if data, err = encrypt(version, store.AesKey, id, plain); nil != err {
+			return err
+		}
+		if err = store.fs.WriteFile(absPath, data); nil != err {
+			return err
+		}
+		objects++
+		return nil
+	})
+	if nil != err {
+		logging.LogErrorf("migrate data repo [%s] to encryption [%d] failed: %s", store.Path, version, err)
+		return
+	}
+
+	store.Encryption = version
+	if err = store.saveEncryption(); nil != err {
+		logging.LogErrorf("save encryption failed: %s", err)
+		return
+	}
+
+	logging.LogInfof("migrated data repo [%s] to encryption [%d], [%d] objects", store.Path, version, objects)
+	return
+}
+
+// loadEncryption 用于从数据对象文件夹中加载写入时使用的加密方式，没有记录时使用 EncryptionLegacy。
+func (store *Store) loadEncryption() {
+	store.Encryption = EncryptionLegacy
+
+	encryptionPath := filepath.Join(store.ObjectsPath, encryptionFile)
+	if !store.exist(encryptionPath) {
+		return
+	}
+
+	data, err := store.fs.ReadFile(encryptionPath)
+	if nil != err {
+		logging.LogErrorf("read encryption [%s] failed: %s", encryptionPath, err)
+		return
+	}
+	encryption := &objectEncryption{}
+	if err = gulu.JSON.UnmarshalJSON(data, encryption); nil != err {
+		logging.LogErrorf("unmarshal encryption [%s] failed: %s", encryptionPath, err)
+		return
+	}
+	if EncryptionLegacy == encryption.Version || EncryptionAEAD == encryption.Version {
+		store.Encryption = encryption.Version
+	}
+}
+
+func (store *Store) saveEncryption() (err error) {
+	if err = store.fs.MkdirAll(store.ObjectsPath); nil != err {
+		return
+	}
+
+	data, err := gulu.JSON.MarshalJSON(&objectEncryption{Version: store.Encryption})
+	if nil != err {
+		return
+	}
+	err = store.fs.WriteFile(filepath.Join(store.ObjectsPath, encryptionFile), data)
+	return
+}
@@ -0,0 +1,101 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package entity
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/88250/gulu"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 索引和文件对象的编码格式版本。
+const (
+	FormatJSON   = 2 // JSON 编码，旧版本客户端和云端服务仅支持该格式
+	FormatBinary = 3 // 二进制编码（msgpack），解析大索引时 CPU 和内存开销更小
+)
+
+// binaryMagic 是二进制编码数据的前缀，JSON 编码数据总是以 '{' 开头，所以可以据此区分格式。
+var binaryMagic = []byte{'D', 'J', 'V', FormatBinary}
+
+var ErrUnknownFormat = errors.New("unknown object format")
+
+// MarshalIndex 使用 format 指定的格式编码索引。
+func MarshalIndex(index *Index, format int) (ret []byte, err error) {
+	return marshal(index, format)
+}
+
+// UnmarshalIndex 解码索引，自动识别编码格式。
+func UnmarshalIndex(data []byte) (ret *Index, err error) {
+	ret = &Index{}
+	if err = unmarshal(data, ret); nil != err {
+		ret = nil
+	}
+	return
+}
+
+// MarshalFile 使用 format 指定的格式编码文件。
+func MarshalFile(file *File, format int) (ret []byte, err error) {
+	return marshal(file, format)
+}
+
+// UnmarshalFile 解码文件，自动识别编码格式。
+func UnmarshalFile(data []byte) (ret *File, err error) {
+	ret = &File{}
+	if err = unmarshal(data, ret); nil != err {
+		ret = nil
+	}
+	return
+}
+
+// DataFormat 返回编码数据 data 的格式版本。
+func DataFormat(data []byte) int {
+	if bytes.HasPrefix(data, binaryMagic) {
+		return FormatBinary
+	}
+	return FormatJSON
+}
+
+func marshal(v interface{}, format int) (ret []byte, err error) {
+	switch format {
+	case FormatJSON:
+		return gulu.JSON.MarshalJSON(v)
+	case FormatBinary:
+		buf := bytes.Buffer{}
+		buf.Write(binaryMagic)
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json") // 字段名和 JSON 保持一致，新增字段时能够兼容
+		if err = enc.Encode(v); nil != err {
+			return
+		}
+		ret = buf.Bytes()
+		return
+	default:
+		err = ErrUnknownFormat
+		return
+	}
+}
+
+func unmarshal(data []byte, v interface{}) (err error) {
+	if FormatBinary == DataFormat(data) {
+		dec := msgpack.NewDecoder(bytes.NewReader(data[len(binaryMagic):]))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return gulu.JSON.UnmarshalJSON(data, v)
+}
@@ -30,17 +30,39 @@ type File struct {
 	Size    int64    `json:"size"`    // 文件大小
 	Updated int64    `json:"updated"` // 最后更新时间
 	Chunks  []string `json:"chunks"`  // 文件分块列表
+
+	// 以下字段在旧版本编码的文件对象中不存在，解码后为零值，即普通文件且使用默认权限
+
+	Mode    uint32 `json:"mode,omitempty"`    // 文件权限位，仅在包含可执行权限时记录
+	Symlink string `json:"symlink,omitempty"` // 符号链接目标，不为空时该文件是一个符号链接
+
+	Xattrs map[string][]byte `json:"xattrs,omitempty"` // 扩展属性，如 macOS 的 Finder 标签，Windows 上记录 NTFS 备用数据流名称（属性值为空）
 }
 
 func NewFile(path string, size int64, updated int64) (ret *File) {
+	return NewFileWithMode(path, size, updated, 0, "")
+}
+
+// NewFileWithMode 创建一个带有权限位 mode 和符号链接目标 symlink 的文件，mode 为 0 且 symlink 为空时和 NewFile 相同。
+//
+// 权限位不参与计算 ID，避免升级后已有的可执行文件 ID 变化而重新上传，所以只修改权限位而没有修改文件时不会产生新的文件。
+func NewFileWithMode(path string, size int64, updated int64, mode uint32, symlink string) (ret *File) {
 	ret = &File{
 		Path:    path,
 		Size:    size,
 		Updated: updated,
+		Mode:    mode,
+		Symlink: symlink,
 	}
 	buf := bytes.Buffer{}
 	buf.WriteString(ret.Path)
-	buf.WriteString(strconv.FormatInt(ret.Updated/1000, 10))
+	if "" != symlink {
+		// 符号链接的修改时间在迁出时无法还原，所以使用链接目标而不是修改时间计算 ID
+		buf.WriteString("->")
+		buf.WriteString(symlink)
+	} else {
+		buf.WriteString(strconv.FormatInt(ret.Updated/1000, 10))
+	}
 	ret.ID = util.Hash(buf.Bytes())
 	return
 }
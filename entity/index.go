@@ -25,16 +25,21 @@ import (
 
 // Index 描述了快照索引。
 type Index struct {
-	ID           string   `json:"id"`           // Hash
-	Memo         string   `json:"memo"`         // 索引备注
-	Created      int64    `json:"created"`      // 索引时间
-	Files        []string `json:"files"`        // 文件列表
-	Count        int      `json:"count"`        // 文件总数
-	Size         int64    `json:"size"`         // 文件总大小
-	SystemID     string   `json:"systemID"`     // 系统 ID
-	SystemName   string   `json:"systemName"`   // 系统名称
-	SystemOS     string   `json:"systemOS"`     // 系统操作系统
-	CheckIndexID string   `json:"checkIndexID"` // Check Index ID
+	ID           string   `json:"id"`                   // Hash
+	Memo         string   `json:"memo"`                 // 索引备注
+	Created      int64    `json:"created"`              // 索引时间
+	Files        []string `json:"files"`                // 文件列表
+	Count        int      `json:"count"`                // 文件总数
+	Size         int64    `json:"size"`                 // 文件总大小
+	SystemID     string   `json:"systemID"`             // 系统 ID
+	SystemName   string   `json:"systemName"`           // 系统名称
+	SystemOS     string   `json:"systemOS"`             // 系统操作系统
+	AuthorID     string   `json:"authorID,omitempty"`   // 作者 ID，多人共享仓库时用于区分创建快照的用户
+	AuthorName   string   `json:"authorName,omitempty"` // 作者名称
+	CheckIndexID string   `json:"checkIndexID"`         // Check Index ID
+	Sealed       string   `json:"sealed,omitempty"`     // 加密后的系统 ID、名称、操作系统和作者信息，开启元数据隐私模式时云端索引不保存明文的系统信息
+
+	Warnings []*Warning `json:"-"` // 索引时产生的警告，不持久化
 }
 
 func (index *Index) String() string {
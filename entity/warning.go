@@ -0,0 +1,31 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package entity
+
+// 警告类型。
+const (
+	WarningLargeFile    = "largeFile"    // 单个文件超过大小软限制
+	WarningTooManyFiles = "tooManyFiles" // 文件总数超过软限制
+)
+
+// Warning 描述了索引或者同步时发现的、已知会导致性能下降的数据情况，不影响索引和同步的结果。
+type Warning struct {
+	Code  string `json:"code"`           // 警告类型
+	Path  string `json:"path,omitempty"` // 相关的文件路径，仅大文件警告有值
+	Value int64  `json:"value"`          // 实际的文件大小或者文件总数
+	Limit int64  `json:"limit"`          // 软限制
+}
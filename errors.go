@@ -0,0 +1,170 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+// 以下错误类别用于调用方区分同步失败的原因，使用 errors.Is 判断，例如 errors.Is(err, ErrQuota)。
+var (
+	ErrAuth           = cloud.ErrCloudAuthFailed             // ErrAuth 描述了鉴权失败，需要用户重新登录或者检查密钥配置
+	ErrQuota          = cloud.ErrCloudQuotaExceeded          // ErrQuota 描述了云端存储空间或者备份数量超过限制
+	ErrNetworkTimeout = cloud.ErrCloudNetworkTimeout         // ErrNetworkTimeout 描述了网络请求超时，可以自动重试
+	ErrLocalCorrupt   = errors.New("local object corrupted") // ErrLocalCorrupt 描述了本地仓库中的对象已经损坏，需要重建数据仓库
+
+	ErrCloudObjectCorrupted = cloud.ErrCloudObjectCorrupted // ErrCloudObjectCorrupted 描述了云端对象的内容和对象 ID 不匹配，需要修复云端仓库
+)
+
+// CloudLockedError 描述了云端仓库正被其他设备锁定的错误，可以使用 errors.Is(err, ErrCloudLocked) 判断。
+type CloudLockedError struct {
+	Owner string    // 持有锁的设备 ID
+	Since time.Time // 加锁时间
+}
+
+func (e *CloudLockedError) Error() string {
+	return fmt.Sprintf("cloud repo is locked by device [%s] since [%s]", e.Owner, e.Since.Format("2006-01-02 15:04:05"))
+}
+
+func (e *CloudLockedError) Is(target error) bool {
+	return ErrCloudLocked == target
+}
+
+// RepoFormatError 描述了仓库格式版本高于当前支持版本的错误，可以使用 errors.Is(err, ErrRepoFormatTooNew) 判断。
+type RepoFormatError struct {
+	Path      string // 仓库路径
+	Required  int    // 仓库要求的最低格式版本
+	Supported int    // 当前支持的最高格式版本
+	Write     bool   // 是否仅写入受限，为 true 时仓库仍然可以读取
+}
+
+func (e *RepoFormatError) Error() string {
+	op := "read"
+	if e.Write {
+		op = "write"
+	}
+	return fmt.Sprintf("repo [%s] requires format [%d] to %s, supported format is [%d], please upgrade", e.Path, e.Required, op, e.Supported)
+}
+
+func (e *RepoFormatError) Is(target error) bool {
+	return ErrRepoFormatTooNew == target
+}
+
+// LocalCorruptError 描述了本地仓库对象损坏的错误，可以使用 errors.Is(err, ErrLocalCorrupt) 判断。
+type LocalCorruptError struct {
+	ObjectID string // 损坏的对象 ID
+	Err      error  // 解码对象时的原始错误
+}
+
+func (e *LocalCorruptError) Error() string {
+	return fmt.Sprintf("local object [%s] corrupted: %s", e.ObjectID, e.Err)
+}
+
+func (e *LocalCorruptError) Is(target error) bool {
+	return ErrLocalCorrupt == target
+}
+
+func (e *LocalCorruptError) Unwrap() error {
+	return e.Err
+}
+
+// ObjectArchivedError 描述了云端数据对象位于归档存储层需要先恢复的错误，可以使用 errors.Is(err, cloud.ErrObjectArchived) 判断。
+type ObjectArchivedError struct {
+	ObjectID string // 数据对象 ID，可以传给 RequestRestore
+}
+
+func (e *ObjectArchivedError) Error() string {
+	return fmt.Sprintf("cloud object [%s] archived, request restore first", e.ObjectID)
+}
+
+func (e *ObjectArchivedError) Is(target error) bool {
+	return cloud.ErrObjectArchived == target
+}
+
+// CloudObjectCorruptedError 描述了下载的云端对象内容和对象 ID 不匹配的错误，可以使用 errors.Is(err, ErrCloudObjectCorrupted) 判断。
+type CloudObjectCorruptedError struct {
+	Key    string // 云端对象 key，如 objects/xx/yyyy
+	Actual string // 根据下载的内容计算得到的对象 ID
+}
+
+func (e *CloudObjectCorruptedError) Error() string {
+	return fmt.Sprintf("cloud object [%s] corrupted: content id [%s] mismatch", e.Key, e.Actual)
+}
+
+func (e *CloudObjectCorruptedError) Is(target error) bool {
+	return ErrCloudObjectCorrupted == target
+}
+
+// categoryError 用于把已有的错误归入 ErrQuota 等错误类别，同时保持原有的错误信息和判等方式不变。
+type categoryError struct {
+	msg      string
+	category error
+}
+
+func (e *categoryError) Error() string {
+	return e.msg
+}
+
+func (e *categoryError) Is(target error) bool {
+	return e.category == target
+}
+
+// IsRetryable 用于判断同步错误 err 是否是暂时性的，调用方可以据此决定是否自动重试。
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrNetworkTimeout) || errors.Is(err, ErrCloudLocked) || errors.Is(err, ErrCloudLatestChanged) ||
+		errors.Is(err, cloud.ErrCloudServiceUnavailable) || errors.Is(err, cloud.ErrCloudTooManyRequests)
+}
+
+// classifyErr 用于将云端存储服务返回的错误归入错误类别，原始错误仍然保留在错误链中。
+//
+// 只根据类型化错误、HTTP 状态码和存储服务的错误码分类，不匹配错误信息文本，避免对象 key 等内容中的数字被误判。
+func classifyErr(err error) error {
+	if nil == err {
+		return nil
+	}
+
+	categories := []error{ErrAuth, ErrQuota, ErrNetworkTimeout, ErrCloudLocked, ErrCloudLatestChanged, ErrLocalCorrupt, ErrFileLocked, ErrCloudObjectCorrupted,
+		cloud.ErrCloudServiceUnavailable, cloud.ErrCloudTooManyRequests, cloud.ErrCloudForbidden, cloud.ErrSystemTimeIncorrect, ErrDeviceRevoked, ErrRepoFormatTooNew, cloud.ErrObjectArchived}
+	for _, category := range categories {
+		if errors.Is(err, category) {
+			return err
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", ErrNetworkTimeout, err)
+	}
+
+	status, code := cloud.ErrStatus(err)
+	switch {
+	case http.StatusRequestTimeout == status || http.StatusGatewayTimeout == status || "RequestTimeout" == code:
+		return fmt.Errorf("%w: %w", ErrNetworkTimeout, err)
+	case http.StatusInsufficientStorage == status || "QuotaExceeded" == code:
+		return fmt.Errorf("%w: %w", ErrQuota, err)
+	case http.StatusUnauthorized == status || "InvalidAccessKeyId" == code || "SignatureDoesNotMatch" == code || "ExpiredToken" == code:
+		return fmt.Errorf("%w: %w", ErrAuth, err)
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sync"
+
+	"github.com/siyuan-note/logging"
+)
+
+// 同步流程中可以注入故障的位置。
+const (
+	FaultAfterUploadChunk        = "afterUploadChunk"        // 每上传一个分块到云端之后
+	FaultBeforeUpdateCloudLatest = "beforeUpdateCloudLatest" // 上传最新索引之后、更新云端 refs/latest 之前
+	FaultAfterUpdateCloudLatest  = "afterUpdateCloudLatest"  // 更新云端 refs/latest 之后
+	FaultBeforeApplyFiles        = "beforeApplyFiles"        // 合并云端变更到数据文件夹之前
+	FaultBeforeUpdateLocalLatest = "beforeUpdateLocalLatest" // 更新本地最新索引之前
+)
+
+// FaultInjector 用于在同步流程中注入故障，测试同步中途中止（比如进程被杀死）后的崩溃一致性。
+type FaultInjector interface {
+
+	// Fault 在同步执行到故障点 point 时调用，n 为设置注入器后到达该故障点的次数（从 1 开始）。返回非 nil 时同步在该处以该错误中止。
+	Fault(point string, n int) error
+}
+
+// FaultInjectorFunc 用于将函数转换为 FaultInjector。
+type FaultInjectorFunc func(point string, n int) error
+
+func (f FaultInjectorFunc) Fault(point string, n int) error {
+	return f(point, n)
+}
+
+type faultState struct {
+	lock     sync.Mutex
+	injector FaultInjector
+	counts   map[string]int
+}
+
+// SetFaultInjector 用于设置同步流程的故障注入器，传入 nil 时关闭故障注入。仅用于测试。
+func (repo *Repo) SetFaultInjector(injector FaultInjector) {
+	if nil == injector {
+		repo.faults = nil
+		return
+	}
+	repo.faults = &faultState{injector: injector, counts: map[string]int{}}
+}
+
+// fault 用于在故障点 point 调用故障注入器，返回注入的错误。
+func (repo *Repo) fault(point string) (err error) {
+	state := repo.faults
+	if nil == state {
+		return
+	}
+
+	state.lock.Lock()
+	state.counts[point]++
+	n := state.counts[point]
+	state.lock.Unlock()
+
+	if err = state.injector.Fault(point, n); nil != err {
+		logging.LogWarnf("injected fault at [%s, %d]: %s", point, n, err)
+	}
+	return
+}
@@ -0,0 +1,129 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// EvtFsckIndex 描述了检查本地仓库时开始检查一个索引的事件，参数为 context、索引 ID、当前索引序号和索引总数。
+const EvtFsckIndex = "repo.fsckIndex"
+
+// FsckReport 描述了本地仓库完整性检查的结果。
+type FsckReport struct {
+	Indexes        int      `json:"indexes"`        // 检查的索引数
+	Files          int      `json:"files"`          // 检查的文件对象数
+	Chunks         int      `json:"chunks"`         // 检查的分块对象数
+	MissingIndexes []string `json:"missingIndexes"` // 索引日志中存在但是索引文件不存在的索引
+	CorruptIndexes []string `json:"corruptIndexes"` // 无法解码的索引
+	MissingObjects []string `json:"missingObjects"` // 被索引引用但是不存在的数据对象
+	CorruptObjects []string `json:"corruptObjects"` // 无法解码或者分块内容哈希和 ID 不一致的数据对象
+}
+
+// Healthy 用于判断检查结果中是否没有任何问题。
+func (report *FsckReport) Healthy() bool {
+	return 1 > len(report.MissingIndexes) && 1 > len(report.CorruptIndexes) && 1 > len(report.MissingObjects) && 1 > len(report.CorruptObjects)
+}
+
+// Fsck 用于检查本地仓库中所有索引及其引用的文件和分块对象是否存在并且可以解码，分块还会校验内容哈希。
+//
+// 按需迁出的占位文件的分块不在本地，不做检查。检查发现的损坏对象在可写仓库中会被移动到隔离文件夹，
+// 需要保留现场时请使用 OpenRepoReadOnly 打开仓库后再检查。
+func (repo *Repo) Fsck(context map[string]interface{}) (ret *FsckReport, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	entries, err := repo.store.readIndexLog()
+	if nil != err {
+		return
+	}
+	placeholders, err := repo.readPlaceholders()
+	if nil != err {
+		return
+	}
+	lazyFiles := map[string]bool{}
+	for _, placeholder := range placeholders {
+		lazyFiles[placeholder.FileID] = true
+	}
+
+	ret = &FsckReport{}
+	checked := map[string]bool{}
+	for i, entry := range entries {
+		eventbus.Publish(EvtFsckIndex, context, entry.ID, i+1, len(entries))
+		ret.Indexes++
+		index, getErr := repo.store.GetIndex(entry.ID)
+		if nil != getErr {
+			if os.IsNotExist(getErr) {
+				ret.MissingIndexes = append(ret.MissingIndexes, entry.ID)
+			} else {
+				ret.CorruptIndexes = append(ret.CorruptIndexes, entry.ID)
+			}
+			continue
+		}
+
+		for _, fileID := range index.Files {
+			if checked[fileID] {
+				continue
+			}
+			checked[fileID] = true
+			ret.Files++
+			file, getFileErr := repo.store.GetFile(fileID)
+			if nil != getFileErr {
+				ret.addObjectErr(fileID, getFileErr)
+				continue
+			}
+			if lazyFiles[fileID] {
+				continue
+			}
+			repo.fsckChunks(file, checked, ret)
+		}
+	}
+	logging.LogInfof("fsck repo [%s] [indexes=%d, files=%d, chunks=%d, healthy=%v]", repo.Path, ret.Indexes, ret.Files, ret.Chunks, ret.Healthy())
+	return
+}
+
+// fsckChunks 用于检查文件 file 引用的分块对象，checked 为已经检查过的对象。
+func (repo *Repo) fsckChunks(file *entity.File, checked map[string]bool, report *FsckReport) {
+	for _, chunkID := range file.Chunks {
+		if checked[chunkID] {
+			continue
+		}
+		checked[chunkID] = true
+		report.Chunks++
+		chunk, err := repo.store.GetChunk(chunkID)
+		if nil != err {
+			report.addObjectErr(chunkID, err)
+			continue
+		}
+		if util.Hash(chunk.Data) != chunkID {
+			report.CorruptObjects = append(report.CorruptObjects, chunkID)
+		}
+	}
+}
+
+func (report *FsckReport) addObjectErr(id string, err error) {
+	if os.IsNotExist(err) {
+		report.MissingObjects = append(report.MissingObjects, id)
+		return
+	}
+	report.CorruptObjects = append(report.CorruptObjects, id)
+}
@@ -0,0 +1,217 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// HistoryRetention 描述了同步生成的数据历史文件夹（如冲突文件副本）的保留策略。
+type HistoryRetention struct {
+	MaxAge   time.Duration // 超过该时长的历史文件夹会被清理，0 表示不按时长清理
+	MaxCount int           // 最多保留的历史文件夹数量，超出的较旧文件夹会被清理，0 表示不按数量清理
+	Snapshot bool          // 清理前是否将历史文件夹转换为仓库快照，这样清理后仍然可以通过快照找回文件
+}
+
+// HistoryCompactStat 描述了清理数据历史文件夹的统计信息。
+type HistoryCompactStat struct {
+	Removed   int      // 清理的历史文件夹数量
+	Snapshots []string // 转换生成的快照索引 ID
+}
+
+// 同步生成的历史文件夹名称，如 2006-01-02-150405-sync，应用生成的其他历史文件夹不受清理影响。
+var syncHistoryDirPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}-\d{6}-sync$`)
+
+// CompactHistory 用于按保留策略 retention 清理同步生成的数据历史文件夹。
+func (repo *Repo) CompactHistory(retention *HistoryRetention) (ret *HistoryCompactStat, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	ret = &HistoryCompactStat{}
+	entries, err := os.ReadDir(repo.HistoryPath)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	type historyDir struct {
+		name    string
+		created time.Time
+	}
+	var dirs []*historyDir
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !syncHistoryDirPattern.MatchString(name) {
+			continue
+		}
+
+		created, parseErr := time.ParseInLocation("2006-01-02-150405", name[:len("2006-01-02-150405")], time.Local)
+		if nil != parseErr {
+			continue
+		}
+		dirs = append(dirs, &historyDir{name: name, created: created})
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].created.After(dirs[j].created) })
+
+	now := time.Now()
+	for i, dir := range dirs {
+		expired := 0 < retention.MaxCount && retention.MaxCount <= i
+		expired = expired || (0 < retention.MaxAge && retention.MaxAge < now.Sub(dir.created))
+		if !expired {
+			continue
+		}
+
+		absPath := filepath.Join(repo.HistoryPath, dir.name)
+		if retention.Snapshot {
+			index, snapshotErr := repo.snapshotHistoryDir(absPath, "[History] "+dir.name, dir.created)
+			if nil != snapshotErr {
+				logging.LogErrorf("snapshot history [%s] failed: %s", absPath, snapshotErr)
+				err = snapshotErr
+				return
+			}
+			if nil != index {
+				ret.Snapshots = append(ret.Snapshots, index.ID)
+			}
+		}
+
+		if err = os.RemoveAll(absPath); nil != err {
+			logging.LogErrorf("remove history [%s] failed: %s", absPath, err)
+			return
+		}
+		ret.Removed++
+	}
+	logging.LogInfof("compacted history [removed=%d, snapshots=%d]", ret.Removed, len(ret.Snapshots))
+	return
+}
+
+// snapshotHistoryDir 用于将历史文件夹 dir 转换为一个快照索引，该索引不会成为本地最新索引。历史文件夹为空时返回 nil。
+func (repo *Repo) snapshotHistoryDir(dir, memo string, created time.Time) (ret *entity.Index, err error) {
+	history := *repo
+	history.DataPath = filepath.Clean(dir) + string(os.PathSeparator)
+	history.roots = nil
+
+	var files []*entity.File
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if nil != err {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if nil != err {
+			return err
+		}
+		files = append(files, entity.NewFile(history.relPath(path), info.Size(), info.ModTime().UnixMilli()))
+		return nil
+	})
+	if nil != err || 1 > len(files) {
+		return
+	}
+
+	ret = &entity.Index{
+		ID:         util.RandHash(),
+		Memo:       memo,
+		Created:    created.UnixMilli(),
+		SystemID:   repo.DeviceID,
+		SystemName: repo.DeviceName,
+		SystemOS:   repo.DeviceOS,
+		AuthorID:   repo.authorID,
+		AuthorName: repo.authorName,
+	}
+	for i, file := range files {
+		if err = history.putFileChunks(file, map[string]interface{}{}, i+1, len(files)); nil != err {
+			return
+		}
+		ret.Files = append(ret.Files, file.ID)
+		ret.Size += file.Size
+	}
+	ret.Count = len(ret.Files)
+	err = repo.store.PutIndex(ret)
+	return
+}
+
+// HistorySink 描述了同步冲突时生成的数据历史的写入目标，调用方可以实现该接口将历史写入自己的历史数据库，或者跳过部分文件。
+type HistorySink interface {
+
+	// Accept 用于判断是否需要为冲突文件 file 生成历史，返回 false 时跳过该文件，比如跳过较大的二进制资源文件。
+	Accept(file *entity.File) bool
+
+	// Write 用于写入冲突文件 file 的历史，absPath 为迁出到临时文件夹中的文件，now 为同步时间。
+	Write(now time.Time, file *entity.File, absPath string) error
+}
+
+// DirHistorySink 将冲突文件复制到 Dir 下按同步时间命名的文件夹中（如 2006-01-02-150405-sync），这是默认的历史写入方式。
+type DirHistorySink struct {
+	Dir string // 数据历史文件夹
+}
+
+func (sink *DirHistorySink) Accept(file *entity.File) bool {
+	return true
+}
+
+func (sink *DirHistorySink) Write(now time.Time, file *entity.File, absPath string) (err error) {
+	historyDir := filepath.Join(sink.Dir, now.Format("2006-01-02-150405")+"-sync")
+	if err = os.MkdirAll(historyDir, 0755); nil != err {
+		return
+	}
+	err = gulu.File.Copy(absPath, filepath.Join(historyDir, file.Path))
+	return
+}
+
+// MaxSizeHistorySink 跳过大小超过 MaxSize 的文件，其他文件交给 Sink 写入。
+type MaxSizeHistorySink struct {
+	Sink    HistorySink
+	MaxSize int64 // 生成历史的文件大小上限
+}
+
+func (sink *MaxSizeHistorySink) Accept(file *entity.File) bool {
+	return file.Size <= sink.MaxSize && sink.Sink.Accept(file)
+}
+
+func (sink *MaxSizeHistorySink) Write(now time.Time, file *entity.File, absPath string) error {
+	return sink.Sink.Write(now, file, absPath)
+}
+
+// SetHistorySink 用于设置同步冲突历史的写入目标，传入 nil 时恢复为写入数据历史文件夹 HistoryPath。
+func (repo *Repo) SetHistorySink(sink HistorySink) {
+	repo.historySink = sink
+}
+
+func (repo *Repo) getHistorySink() HistorySink {
+	if nil != repo.historySink {
+		return repo.historySink
+	}
+	return &DirHistorySink{Dir: repo.HistoryPath}
+}
@@ -0,0 +1,137 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/siyuan-note/logging"
+)
+
+// PathUsage 描述了一个路径在所有快照中的历史版本占用的存储空间。
+type PathUsage struct {
+	Path           string `json:"path"`           // 文件路径
+	Versions       int    `json:"versions"`       // 历史版本数（不同的文件对象数）
+	StoredBytes    int64  `json:"storedBytes"`    // 分摊后占用的存储空间，多个路径共用的数据对象按路径数平分
+	ExclusiveBytes int64  `json:"exclusiveBytes"` // 仅被该路径引用的数据对象占用的存储空间，即排除或清理该路径后可回收的空间
+}
+
+// objectOwners 描述了一个数据对象被哪些路径引用。
+type objectOwners struct {
+	size  int64
+	paths []string
+}
+
+// GetHistoryUsage 用于统计所有快照中各路径历史版本占用的存储空间，按分摊后的占用空间倒序返回前 limit 个路径，limit 小于 1 时返回全部路径。
+//
+// 相同的数据对象只计算一次：被多个路径引用的文件和分块按引用路径数平分，所以所有路径的 StoredBytes 之和等于快照引用的数据对象总大小。
+func (repo *Repo) GetHistoryUsage(limit int) (ret []*PathUsage, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(repo.Path, "indexes"))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	usages := map[string]*PathUsage{}
+	owners := map[string]*objectOwners{}
+	visitedFiles := map[string]bool{}
+	for _, entry := range entries {
+		if 40 != len(entry.Name()) {
+			continue
+		}
+
+		index, getErr := repo.store.GetIndex(entry.Name())
+		if nil != getErr {
+			logging.LogWarnf("get index [%s] failed: %s", entry.Name(), getErr)
+			continue
+		}
+
+		for _, fileID := range index.Files {
+			if visitedFiles[fileID] {
+				continue // 未修改的文件在多个快照中共用同一个文件对象
+			}
+			visitedFiles[fileID] = true
+
+			file, getFileErr := repo.store.GetFile(fileID)
+			if nil != getFileErr {
+				logging.LogWarnf("get file [%s] failed: %s", fileID, getFileErr)
+				continue
+			}
+
+			usage := usages[file.Path]
+			if nil == usage {
+				usage = &PathUsage{Path: file.Path}
+				usages[file.Path] = usage
+			}
+			usage.Versions++
+
+			repo.ownObject(owners, fileID, file.Path)
+			for _, chunkID := range file.Chunks {
+				repo.ownObject(owners, chunkID, file.Path)
+			}
+		}
+	}
+
+	for _, owner := range owners {
+		share := owner.size / int64(len(owner.paths))
+		for _, p := range owner.paths {
+			usages[p].StoredBytes += share
+		}
+		if 1 == len(owner.paths) {
+			usages[owner.paths[0]].ExclusiveBytes += owner.size
+		}
+	}
+
+	for _, usage := range usages {
+		ret = append(ret, usage)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].StoredBytes != ret[j].StoredBytes {
+			return ret[i].StoredBytes > ret[j].StoredBytes
+		}
+		return ret[i].Path < ret[j].Path
+	})
+	if 0 < limit && limit < len(ret) {
+		ret = ret[:limit]
+	}
+	return
+}
+
+// ownObject 用于记录数据对象 id 被路径 p 引用，首次记录时读取对象占用的存储空间。
+func (repo *Repo) ownObject(owners map[string]*objectOwners, id, p string) {
+	owner := owners[id]
+	if nil == owner {
+		owner = &objectOwners{}
+		if info, statErr := repo.store.Stat(id); nil == statErr {
+			owner.size = info.Size()
+		}
+		owners[id] = owner
+	}
+	for _, ownerPath := range owner.paths {
+		if ownerPath == p {
+			return
+		}
+	}
+	owner.paths = append(owner.paths, p)
+}
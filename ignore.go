@@ -0,0 +1,196 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/siyuan-note/logging"
+)
+
+// syncIgnoreFile 是数据文件夹各级目录下的忽略规则文件名，规则仅对所在目录及其子目录生效。
+//
+// 以 . 开头的文件不会被索引，所以该文件不会同步到其他设备，需要多设备共享的规则请写在 /.siyuan/syncignore 中。
+const syncIgnoreFile = ".syncignore"
+
+// IgnoreRule 描述了一条忽略规则。
+type IgnoreRule struct {
+	Source string `json:"source"` // 规则来源，即忽略文件相对数据文件夹的路径，通过 Repo.IgnoreLines 传入的规则为空
+	LineNo int    `json:"lineNo"` // 规则在来源中的行号，从 1 开始
+	Line   string `json:"line"`   // 规则原文
+	Negate bool   `json:"negate"` // 是否是以 ! 开头的取反规则
+
+	base    string            // 规则生效的目录，根目录为空
+	pattern *ignore.GitIgnore // 去掉 ! 后的规则
+}
+
+// ignoreMatcher 实现了 gitignore 风格的忽略规则匹配。
+//
+// 规则按添加顺序生效，后添加的规则优先级更高，所以深层目录中的规则会覆盖上层目录中的规则。
+// 和 git 一样，如果父目录已经被忽略，那么无法通过取反规则重新包含其中的文件。
+type ignoreMatcher struct {
+	rules  []*IgnoreRule
+	dirs   map[string]*IgnoreRule // 已经匹配过的目录，值为忽略该目录的规则，未忽略时为 nil
+	dataFS DataFS                 // 读取忽略规则文件使用的文件系统，为 nil 时使用本地文件系统
+}
+
+func newIgnoreMatcher(lines []string) (ret *ignoreMatcher) {
+	ret = &ignoreMatcher{dirs: map[string]*IgnoreRule{}}
+	ret.addLines("", "", lines)
+	return
+}
+
+func (matcher *ignoreMatcher) addLines(source, base string, lines []string) {
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.Trim(line, " ")
+		if "" == trimmed || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		rule := &IgnoreRule{Source: source, LineNo: i + 1, Line: line, base: base}
+		if strings.HasPrefix(trimmed, "!") {
+			rule.Negate = true
+			trimmed = trimmed[1:]
+		}
+		rule.pattern = ignore.CompileIgnoreLines(trimmed)
+		matcher.rules = append(matcher.rules, rule)
+	}
+	matcher.dirs = map[string]*IgnoreRule{}
+}
+
+// loadDir 用于加载数据文件夹中目录 relDir 下的忽略规则文件，absDir 为该目录的本地绝对路径。
+func (matcher *ignoreMatcher) loadDir(absDir, relDir string) {
+	relDir = cleanRelPath(relDir)
+	if "/" == relDir {
+		relDir = ""
+	}
+	source := relDir + "/" + syncIgnoreFile
+	dataFS := matcher.dataFS
+	if nil == dataFS {
+		dataFS = &osDataFS{}
+	}
+	data, err := readDataFile(dataFS, filepath.Join(absDir, syncIgnoreFile))
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogWarnf("read ignore file [%s] failed: %s", source, err)
+		}
+		return
+	}
+	matcher.addLines(source, relDir, strings.Split(string(data), "\n"))
+}
+
+// enterDir 在遍历数据文件夹进入本地绝对路径为 absDir 的目录 relDir 时调用，目录被忽略时返回 filepath.SkipDir，否则加载该目录下的忽略规则文件。
+func (matcher *ignoreMatcher) enterDir(absDir, relDir string) error {
+	relDir = cleanRelPath(relDir)
+	if "/" != relDir {
+		if ignored, _ := matcher.match(relDir, true); ignored {
+			return filepath.SkipDir
+		}
+	}
+	matcher.loadDir(absDir, relDir)
+	return nil
+}
+
+// MatchesPath 用于判断路径 p 是否被忽略，p 为相对数据文件夹的文件路径。
+func (matcher *ignoreMatcher) MatchesPath(p string) bool {
+	ignored, _ := matcher.match(p, false)
+	return ignored
+}
+
+// match 用于判断路径 p 是否被忽略，rule 为最终决定匹配结果的规则，没有规则匹配时为 nil。
+func (matcher *ignoreMatcher) match(p string, isDir bool) (ignored bool, rule *IgnoreRule) {
+	p = cleanRelPath(p)
+	for i := 1; i < len(p); i++ {
+		if '/' != p[i] {
+			continue
+		}
+		if rule = matcher.matchDir(p[:i]); nil != rule {
+			ignored = true
+			return
+		}
+	}
+	ignored, rule = matcher.matchRules(p, isDir)
+	return
+}
+
+func (matcher *ignoreMatcher) matchDir(dir string) *IgnoreRule {
+	if rule, ok := matcher.dirs[dir]; ok {
+		return rule
+	}
+
+	ignored, rule := matcher.matchRules(dir, true)
+	if !ignored {
+		rule = nil
+	}
+	matcher.dirs[dir] = rule
+	return rule
+}
+
+func (matcher *ignoreMatcher) matchRules(p string, isDir bool) (ignored bool, rule *IgnoreRule) {
+	for _, r := range matcher.rules {
+		rel := p
+		if "" != r.base {
+			if !strings.HasPrefix(p, r.base+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(p, r.base)
+		}
+		if isDir {
+			rel += "/" // 以 / 结尾的规则只匹配目录
+		}
+		if r.pattern.MatchesPath(rel) {
+			ignored = !r.Negate
+			rule = r
+		}
+	}
+	return
+}
+
+func cleanRelPath(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+// pathIgnoreMatcher 用于创建加载了路径 p 的所有上级目录中忽略规则文件的匹配器，p 为 cleanRelPath 处理后的路径。
+func (repo *Repo) pathIgnoreMatcher(p string) (ret *ignoreMatcher) {
+	ret = repo.ignoreMatcher()
+	ret.loadDir(repo.DataPath, "/")
+	for i := 1; i < len(p); i++ {
+		if '/' == p[i] {
+			ret.loadDir(repo.absPath(p[:i]), p[:i])
+		}
+	}
+	return
+}
+
+// TestIgnore 用于调试忽略规则，返回数据文件夹中的路径 p 是否被忽略以及最终决定匹配结果的规则。
+//
+// 除了 Repo.IgnoreLines 以外，还会加载 p 所在各级目录下的 .syncignore 文件。
+func (repo *Repo) TestIgnore(p string) (ignored bool, rule *IgnoreRule) {
+	p = cleanRelPath(p)
+	matcher := repo.pathIgnoreMatcher(p)
+	isDir := false
+	if info, err := repo.dataFS.Stat(repo.absPath(p)); nil == err {
+		isDir = info.IsDir()
+	}
+	ignored, rule = matcher.match(p, isDir)
+	return
+}
@@ -0,0 +1,214 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrImmutable 描述了开启不可变模式时尝试删除保留期内的快照。
+var ErrImmutable = errors.New("snapshots are immutable within retention")
+
+// SetImmutableRetention 用于设置快照的不可变保留时长，大于 0 时开启不可变（WORM）模式，默认不启用。
+//
+// 开启后 Purge 和 PurgeCloud 不会清理创建时间在保留期内的索引及其引用的数据对象，Reset 返回 ErrImmutable。
+// 使用 S3 时还应该配置 cloud.ConfS3 的 ObjectLockMode 和 ObjectLockDays，由存储服务保证上传的快照对象在保留期内不能被覆盖或者删除，
+// ObjectLockDays 不应该小于这里设置的保留时长。
+func (repo *Repo) SetImmutableRetention(retention time.Duration) {
+	repo.immutableRetention = retention
+}
+
+// checkImmutable 用于在删除所有快照前检查是否开启了不可变模式。
+func (repo *Repo) checkImmutable() (err error) {
+	if 0 < repo.immutableRetention {
+		err = ErrImmutable
+	}
+	return
+}
+
+// withinRetention 用于判断创建时间为 created（毫秒时间戳）的索引是否位于不可变保留期内。
+func (repo *Repo) withinRetention(created int64) bool {
+	if 1 > repo.immutableRetention {
+		return false
+	}
+	return time.Since(time.UnixMilli(created)) < repo.immutableRetention
+}
+
+// retainedIndexIDs 用于获取本地位于不可变保留期内的索引 ID 列表。
+func (repo *Repo) retainedIndexIDs() (ret []string, err error) {
+	if 1 > repo.immutableRetention {
+		return
+	}
+
+	entries, err := repo.store.readIndexLog()
+	if nil != err {
+		return
+	}
+	for _, entry := range entries {
+		if repo.withinRetention(entry.Created) {
+			ret = append(ret, entry.ID)
+		}
+	}
+	return
+}
+
+// retainCloudIndexes 用于将云端未引用索引 unreferencedIndexIDs 中位于不可变保留期内的索引移动到引用索引 refIndexIDs 中。
+//
+// 无法获取的索引无法确定创建时间，也会保留。
+func (repo *Repo) retainCloudIndexes(unreferencedIndexIDs, refIndexIDs map[string]bool) {
+	for indexID := range unreferencedIndexIDs {
+		index, getErr := repo.cloud.GetIndex(indexID)
+		if nil != getErr {
+			logging.LogWarnf("get index [%s] failed, retain it: %s", indexID, getErr)
+		} else if !repo.withinRetention(index.Created) {
+			continue
+		}
+
+		delete(unreferencedIndexIDs, indexID)
+		refIndexIDs[indexID] = true
+	}
+}
+
+// purgedCloudObjects 用于获取云端待清理索引 indexIDs 引用的所有数据对象。
+//
+// 不可变模式下只清理这些数据对象：没有被任何索引引用的数据对象无法确定上传时间，可能仍然位于存储服务的对象锁定保留期内。
+func (repo *Repo) purgedCloudObjects(indexIDs map[string]bool) (ret map[string]bool, err error) {
+	ret = map[string]bool{}
+	fileIDs := map[string]bool{}
+	for indexID := range indexIDs {
+		index, getErr := repo.cloud.GetIndex(indexID)
+		if nil != getErr {
+			err = getErr
+			logging.LogErrorf("get index [%s] failed: %s", indexID, err)
+			return
+		}
+
+		for _, fileID := range index.Files {
+			ret[fileID] = true
+			fileIDs[fileID] = true
+		}
+	}
+
+	var files []*entity.File
+	var downloadIDs []string
+	for fileID := range fileIDs {
+		if f, _ := repo.GetFile(fileID); nil != f {
+			files = append(files, f)
+			continue
+		}
+		downloadIDs = append(downloadIDs, fileID)
+	}
+
+	_, dFiles, err := repo.downloadCloudFilesPut(downloadIDs, map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone})
+	if nil != err {
+		logging.LogErrorf("download cloud files failed: %s", err)
+		return
+	}
+	files = append(files, dFiles...)
+
+	for _, f := range files {
+		for _, chunkID := range f.Chunks {
+			ret[chunkID] = true
+		}
+	}
+	return
+}
+
+// objectLocksFile 描述了本地记录的云端数据对象的对象锁定保留截止时间（毫秒时间戳），位于仓库根目录下，用于避免重复延长保留期。
+const objectLocksFile = "object-locks.json"
+
+// extendObjectLocks 用于在发布新的云端最新索引 latest 前延长其引用的云端数据对象（文件 files 及其分块）的对象锁定保留期。
+//
+// 数据对象按内容寻址，云端已经存在的对象不会重新上传，只有延长保留期才能保证新快照引用的所有对象在快照创建后至少 ObjectLockDays 天内不能被删除。
+// 本地记录的保留截止时间已经足够的对象不会重复延长。云端存储服务不支持或者没有开启对象锁定时直接返回。
+func (repo *Repo) extendObjectLocks(latest *entity.Index, files []*entity.File) (err error) {
+	lockCloud, ok := repo.cloud.(cloud.ObjectLockCloud)
+	if !ok {
+		return
+	}
+	days := lockCloud.ObjectLockDays()
+	if 1 > days {
+		return
+	}
+
+	objectIDs := append(append([]string{}, latest.Files...), repo.getChunks(files)...)
+	objectIDs = gulu.Str.RemoveDuplicatedElem(objectIDs)
+
+	locks := repo.readObjectLocks()
+	now := time.Now()
+	required := now.AddDate(0, 0, days).UnixMilli()
+	var paths []string
+	for _, id := range objectIDs {
+		if locks[id] < required {
+			paths = append(paths, objectKey(id))
+		}
+	}
+	if 0 < len(paths) {
+		until := cloud.ObjectLockUntil(now, days)
+		if err = lockCloud.ExtendObjectLocks(paths, until); nil != err {
+			logging.LogErrorf("extend object locks failed: %s", err)
+			return
+		}
+		logging.LogInfof("extended object locks of [%d] objects until [%s]", len(paths), until.Format("2006-01-02 15:04:05"))
+	}
+
+	// 只记录最新索引引用的对象，避免记录无限增长
+	newLocks := map[string]int64{}
+	until := cloud.ObjectLockUntil(now, days).UnixMilli()
+	for _, id := range objectIDs {
+		if locks[id] >= required {
+			newLocks[id] = locks[id]
+		} else {
+			newLocks[id] = until
+		}
+	}
+	repo.writeObjectLocks(newLocks)
+	return
+}
+
+func (repo *Repo) readObjectLocks() (ret map[string]int64) {
+	ret = map[string]int64{}
+	data, err := os.ReadFile(filepath.Join(repo.Path, objectLocksFile))
+	if nil != err {
+		return
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, &ret); nil != err {
+		logging.LogWarnf("unmarshal object locks failed: %s", err)
+		ret = map[string]int64{}
+	}
+	return
+}
+
+func (repo *Repo) writeObjectLocks(locks map[string]int64) {
+	data, err := gulu.JSON.MarshalJSON(locks)
+	if nil != err {
+		logging.LogErrorf("marshal object locks failed: %s", err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, objectLocksFile), data, 0644); nil != err {
+		logging.LogErrorf("write object locks failed: %s", err)
+	}
+}
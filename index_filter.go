@@ -0,0 +1,111 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// IndexFilter 描述了查找快照索引的过滤条件，零值字段表示不按该条件过滤。
+type IndexFilter struct {
+	Memo            string // 备注包含的子串，不区分大小写，备注被修改过时匹配修改后的备注
+	From            int64  // 创建时间下限（含），毫秒时间戳
+	To              int64  // 创建时间上限（含），毫秒时间戳
+	SystemID        string // 创建快照的设备 ID
+	MinChangedFiles int    // 与前一个快照相比新增或变动的文件数下限
+	Limit           int    // 最多返回的索引数
+}
+
+// FindIndexes 用于查找符合过滤条件 filter 的快照索引，按创建时间倒序返回。
+func (repo *Repo) FindIndexes(filter *IndexFilter) (ret []*entity.Index, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	dir := filepath.Join(repo.Path, "indexes")
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		logging.LogErrorf("read dir [%s] failed: %s", dir, err)
+		return
+	}
+
+	var indexes []*entity.Index
+	for _, entry := range entries {
+		if 40 != len(entry.Name()) {
+			continue
+		}
+
+		index, getErr := repo.store.GetIndex(entry.Name())
+		if nil != getErr {
+			err = getErr
+			return
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Created > indexes[j].Created })
+
+	memo := strings.ToLower(filter.Memo)
+	for i, index := range indexes {
+		if "" != memo && !strings.Contains(strings.ToLower(repo.indexMemo(index)), memo) {
+			continue
+		}
+		if (0 < filter.From && index.Created < filter.From) || (0 < filter.To && index.Created > filter.To) {
+			continue
+		}
+		if "" != filter.SystemID && index.SystemID != filter.SystemID {
+			continue
+		}
+		if 0 < filter.MinChangedFiles {
+			var previous *entity.Index
+			if i+1 < len(indexes) {
+				previous = indexes[i+1]
+			}
+			if changedFiles(index, previous) < filter.MinChangedFiles {
+				continue
+			}
+		}
+
+		ret = append(ret, index)
+		if 0 < filter.Limit && filter.Limit <= len(ret) {
+			break
+		}
+	}
+	return
+}
+
+// changedFiles 用于计算索引 index 相比前一个索引 previous 新增或变动的文件数，文件变动后文件 ID 也会改变。
+func changedFiles(index, previous *entity.Index) (ret int) {
+	if nil == previous {
+		return len(index.Files)
+	}
+
+	previousFiles := make(map[string]bool, len(previous.Files))
+	for _, fileID := range previous.Files {
+		previousFiles[fileID] = true
+	}
+	for _, fileID := range index.Files {
+		if !previousFiles[fileID] {
+			ret++
+		}
+	}
+	return
+}
@@ -0,0 +1,342 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// indexLogFile 描述了本地索引日志文件，位于仓库根目录下。
+//
+// 每写入一个索引追加一行 "ID 创建时间"，分页获取索引时只需要读取日志而不用遍历索引文件夹并获取每个索引文件的元数据。
+const indexLogFile = "index.log"
+
+// indexLogEntry 描述了索引日志中的一条记录。
+type indexLogEntry struct {
+	ID      string
+	Created int64
+}
+
+// GetIndexesPage 用于按创建时间倒序获取从第 offset 个开始的最多 limit 个索引，total 为本地索引总数。
+//
+// 只会读取返回的索引对象，适合快照数量很多的仓库分页展示历史。
+func (repo *Repo) GetIndexesPage(offset, limit int) (ret []*entity.Index, total int, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	entries, err := repo.store.readIndexLog()
+	if nil != err {
+		return
+	}
+	total = len(entries)
+	offset = min(max(offset, 0), total)
+	end := total
+	if 0 < limit {
+		end = min(offset+limit, total)
+	}
+	ret, err = repo.store.getLoggedIndexes(entries[offset:end])
+	return
+}
+
+// IterateIndexes 用于按创建时间倒序逐个读取本地索引并回调 fn，fn 返回 false 时停止遍历。
+//
+// 索引对象在遍历到时才读取，遍历期间不持有仓库锁，fn 中可以调用仓库的其他方法。
+func (repo *Repo) IterateIndexes(fn func(index *entity.Index) bool) (err error) {
+	repo.lock.Lock()
+	entries, err := repo.store.readIndexLog()
+	repo.lock.Unlock()
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		index, getErr := repo.store.GetIndex(entry.ID)
+		if nil != getErr {
+			if os.IsNotExist(getErr) {
+				continue // 索引已经被清理
+			}
+			err = getErr
+			return
+		}
+		if !fn(index) {
+			return
+		}
+	}
+	return
+}
+
+// IndexLogCompaction 描述了压缩修复索引日志的结果。
+type IndexLogCompaction struct {
+	Kept       int      // 压缩后日志中的索引数
+	Dangling   []string // 索引对象已经不存在而被移除的记录
+	Invalid    []string // 索引对象无法读取而被移除的记录
+	Duplicates []string // 重复而被移除的记录，同一个索引重复多次时出现多次
+	Recovered  []string // 索引文件夹中存在但是日志中缺失而被补充的索引
+	Reordered  bool     // 日志记录是否没有按创建时间排列而被重新排序
+}
+
+// Removed 返回被移除的记录数。
+func (compaction *IndexLogCompaction) Removed() int {
+	return len(compaction.Dangling) + len(compaction.Invalid) + len(compaction.Duplicates)
+}
+
+// CompactIndexLog 用于压缩修复本地索引日志。
+//
+// 程序崩溃等原因可能导致日志中出现重复、悬空（索引已经被清理）或者顺序错误的记录，也可能缺失已经写入的索引。
+// 压缩时逐条校验记录对应的索引对象，去除重复和无效记录，补充缺失的索引，使用索引对象中的创建时间重新排序后覆盖写入日志。
+func (repo *Repo) CompactIndexLog() (ret *IndexLogCompaction, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	ret, err = repo.store.compactIndexLog()
+	if nil != err {
+		return
+	}
+	logging.LogInfof("compacted index log [kept=%d, dangling=%d, invalid=%d, duplicates=%d, recovered=%d, reordered=%v]",
+		ret.Kept, len(ret.Dangling), len(ret.Invalid), len(ret.Duplicates), len(ret.Recovered), ret.Reordered)
+	return
+}
+
+func (store *Store) compactIndexLog() (ret *IndexLogCompaction, err error) {
+	store.indexLogLock.Lock()
+	defer store.indexLogLock.Unlock()
+
+	ret = &IndexLogCompaction{}
+	var logged []*indexLogEntry
+	file := filepath.Join(store.Path, indexLogFile)
+	if store.exist(file) {
+		data, readErr := store.fs.ReadFile(file)
+		if nil != readErr {
+			err = readErr
+			logging.LogErrorf("read index log failed: %s", err)
+			return
+		}
+		logged = parseIndexLog(data)
+	}
+
+	seen := map[string]bool{}
+	var entries []*indexLogEntry
+	for i, entry := range logged {
+		if 0 < i && entry.Created < logged[i-1].Created {
+			ret.Reordered = true
+		}
+		if seen[entry.ID] {
+			ret.Duplicates = append(ret.Duplicates, entry.ID)
+			continue
+		}
+		seen[entry.ID] = true
+
+		index, getErr := store.GetIndex(entry.ID)
+		if nil != getErr {
+			if os.IsNotExist(getErr) {
+				ret.Dangling = append(ret.Dangling, entry.ID)
+			} else {
+				logging.LogWarnf("get index [%s] in index log failed: %s", entry.ID, getErr)
+				ret.Invalid = append(ret.Invalid, entry.ID)
+			}
+			continue
+		}
+		if index.Created != entry.Created {
+			ret.Reordered = true
+		}
+		entries = append(entries, &indexLogEntry{ID: index.ID, Created: index.Created})
+	}
+
+	dirEntries, err := store.fs.ReadDir(filepath.Join(store.Path, "indexes"))
+	if nil != err && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	for _, dirEntry := range dirEntries {
+		id := dirEntry.Name()
+		if 40 != len(id) || seen[id] {
+			continue
+		}
+		index, getErr := store.GetIndex(id)
+		if nil != getErr {
+			logging.LogWarnf("get index [%s] failed: %s", id, getErr)
+			continue
+		}
+		ret.Recovered = append(ret.Recovered, id)
+		entries = append(entries, &indexLogEntry{ID: index.ID, Created: index.Created})
+	}
+
+	entries = sortIndexLog(entries)
+	ret.Kept = len(entries)
+	err = store.writeIndexLog(entries)
+	return
+}
+
+// getLoggedIndexes 用于读取索引日志记录 entries 对应的索引，跳过已经被清理的索引。
+func (store *Store) getLoggedIndexes(entries []*indexLogEntry) (ret []*entity.Index, err error) {
+	for _, entry := range entries {
+		index, getErr := store.GetIndex(entry.ID)
+		if nil != getErr {
+			if os.IsNotExist(getErr) {
+				logging.LogWarnf("index [%s] in index log not found", entry.ID)
+				continue
+			}
+			err = getErr
+			return
+		}
+		ret = append(ret, index)
+	}
+	return
+}
+
+// readIndexLog 用于读取索引日志，返回按创建时间倒序排列并去重后的记录。索引日志不存在时根据索引文件夹重建。
+func (store *Store) readIndexLog() (ret []*indexLogEntry, err error) {
+	store.indexLogLock.Lock()
+	defer store.indexLogLock.Unlock()
+
+	file := filepath.Join(store.Path, indexLogFile)
+	if !store.exist(file) {
+		if store.readOnly {
+			// 只读时不重建日志文件，直接使用根据索引文件夹生成的记录
+			ret, err = store.scanIndexLog()
+			ret = sortIndexLog(ret)
+			return
+		}
+		if err = store.rebuildIndexLog(); nil != err {
+			return
+		}
+	}
+
+	data, err := store.fs.ReadFile(file)
+	if nil != err {
+		logging.LogErrorf("read index log failed: %s", err)
+		return
+	}
+	ret = sortIndexLog(parseIndexLog(data))
+	return
+}
+
+// appendIndexLog 用于在索引日志中追加索引 index 的记录。
+func (store *Store) appendIndexLog(index *entity.Index) (err error) {
+	store.indexLogLock.Lock()
+	defer store.indexLogLock.Unlock()
+
+	file := filepath.Join(store.Path, indexLogFile)
+	if !store.exist(file) {
+		// 升级前已有的索引不在日志中，首次写入时根据索引文件夹重建，此时新索引文件已经写入
+		err = store.rebuildIndexLog()
+		return
+	}
+
+	err = store.fs.AppendFile(file, []byte(formatIndexLogEntry(&indexLogEntry{ID: index.ID, Created: index.Created})))
+	return
+}
+
+// rebuildIndexLog 用于根据索引文件夹重建索引日志，索引文件的修改时间即为索引创建时间。
+func (store *Store) rebuildIndexLog() (err error) {
+	entries, err := store.scanIndexLog()
+	if nil != err {
+		return
+	}
+	err = store.writeIndexLog(sortIndexLog(entries))
+	return
+}
+
+// scanIndexLog 用于根据索引文件夹生成索引日志记录，创建时间使用索引文件的修改时间。
+func (store *Store) scanIndexLog() (ret []*indexLogEntry, err error) {
+	dir := filepath.Join(store.Path, "indexes")
+	dirEntries, err := store.fs.ReadDir(dir)
+	if nil != err && !os.IsNotExist(err) {
+		logging.LogErrorf("read dir [%s] failed: %s", dir, err)
+		return
+	}
+	err = nil
+	for _, dirEntry := range dirEntries {
+		if 40 != len(dirEntry.Name()) {
+			continue
+		}
+		info, infoErr := dirEntry.Info()
+		if nil != infoErr {
+			continue
+		}
+		ret = append(ret, &indexLogEntry{ID: dirEntry.Name(), Created: info.ModTime().UnixMilli()})
+	}
+	return
+}
+
+// writeIndexLog 用于使用记录 entries 覆盖写入索引日志，日志按创建时间正序保存。
+func (store *Store) writeIndexLog(entries []*indexLogEntry) (err error) {
+	if err = store.fs.MkdirAll(store.Path); nil != err {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	for i := len(entries) - 1; 0 <= i; i-- {
+		buf.WriteString(formatIndexLogEntry(entries[i]))
+	}
+	err = store.fs.WriteFile(filepath.Join(store.Path, indexLogFile), buf.Bytes())
+	return
+}
+
+func formatIndexLogEntry(entry *indexLogEntry) string {
+	return entry.ID + " " + strconv.FormatInt(entry.Created, 10) + "\n"
+}
+
+// parseIndexLog 用于按行解析索引日志，忽略格式错误的行。
+func parseIndexLog(data []byte) (ret []*indexLogEntry) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		id, created, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found || 40 != len(id) {
+			continue
+		}
+		createdMillis, parseErr := strconv.ParseInt(created, 10, 64)
+		if nil != parseErr {
+			continue
+		}
+		ret = append(ret, &indexLogEntry{ID: id, Created: createdMillis})
+	}
+	return
+}
+
+// sortIndexLog 用于将记录 entries 去重并按创建时间倒序排列，重复的记录保留最后一条。
+func sortIndexLog(entries []*indexLogEntry) (ret []*indexLogEntry) {
+	positions := map[string]int{}
+	for _, entry := range entries {
+		if i, ok := positions[entry.ID]; ok {
+			ret[i] = entry
+			continue
+		}
+		positions[entry.ID] = len(ret)
+		ret = append(ret, entry)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Created != ret[j].Created {
+			return ret[i].Created > ret[j].Created
+		}
+		return ret[i].ID > ret[j].ID
+	})
+	return
+}
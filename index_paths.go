@@ -0,0 +1,216 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// IndexPaths 用于只索引数据文件夹中的路径 paths 并创建快照，适用于调用方已经知道哪些文件发生了变化的情况，比如编辑器的保存事件。
+//
+// paths 为相对数据文件夹的路径（如 /20220101000000-abcdefg/20220101000000-hijklmn.sy），可以是文件或者文件夹，不存在的路径视为已经删除。
+// 其他路径下的文件直接沿用最新索引中的文件对象，不会遍历数据文件夹，所以调用方需要保证 paths 覆盖了所有变化。
+// paths 为空时返回最新索引，没有最新索引或者 paths 包含根路径时等同于 Index。
+func (repo *Repo) IndexPaths(paths []string, memo string, context map[string]interface{}) (ret *entity.Index, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	paths = cleanIndexPaths(paths)
+	if 1 > len(paths) {
+		ret, err = repo.Latest()
+		return
+	}
+	if "/" == paths[0] {
+		ret, err = repo.index(memo, true, context)
+		return
+	}
+
+	ret, err = retryIndex(func() (*entity.Index, error) {
+		return repo.indexPaths0(paths, memo, context)
+	})
+	return
+}
+
+func (repo *Repo) indexPaths0(paths []string, memo string, context map[string]interface{}) (ret *entity.Index, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			ret, err = repo.index0(memo, true, true, context)
+			return
+		}
+		logging.LogErrorf("get latest index failed: %s", err)
+		return
+	}
+
+	var latestFiles []*entity.File
+	if fullLatest := repo.getFullLatest(latest); nil != fullLatest {
+		latestFiles = fullLatest.Files
+	} else if latestFiles, err = repo.getFiles(latest.Files); nil != err {
+		logging.LogErrorf("get latest files failed: %s", err)
+		return
+	}
+
+	start := time.Now()
+	excluded := map[string]bool{}
+	walked, err := repo.walkIndexPaths(paths, excluded, context)
+	if nil != err {
+		logging.LogErrorf("walk paths failed: %s", err)
+		return
+	}
+	placeholders, err := repo.placeholderFiles(walked)
+	if nil != err {
+		logging.LogErrorf("get placeholder files failed: %s", err)
+		return
+	}
+	logging.LogInfof("walk paths [paths=%d, files=%d] cost [%s]", len(paths), len(walked), time.Since(start))
+
+	var files []*entity.File
+	for _, file := range latestFiles {
+		if !underIndexPaths(file.Path, paths) {
+			files = append(files, file)
+		}
+	}
+	files = append(files, walked...)
+	files = append(files, excludedLatestFiles(excluded, latestFiles)...)
+	placeholderIDs := map[string]bool{}
+	for _, placeholder := range placeholders {
+		// 其他路径下的占位文件已经沿用最新索引中的文件对象
+		if underIndexPaths(placeholder.Path, paths) {
+			placeholderIDs[placeholder.ID] = true
+			files = append(files, placeholder)
+		}
+	}
+	if 1 > len(files) {
+		err = ErrEmptyIndex
+		logging.LogErrorf("empty index [%s]", repo.DataPath)
+		return
+	}
+
+	inheritModes(walked, latestFiles)
+	upserts, removes := repo.diffUpsertRemove(files, latestFiles, false)
+	if 1 > len(upserts) && 1 > len(removes) {
+		ret = latest
+		return
+	}
+
+	ret = repo.newIndex(memo)
+	if err = repo.putUpsertFiles(upserts, placeholderIDs, context); nil != err {
+		return
+	}
+	for _, file := range files {
+		ret.Files = append(ret.Files, file.ID)
+		ret.Size += file.Size
+	}
+	ret.Count = len(ret.Files)
+
+	if err = repo.store.PutIndex(ret); nil != err {
+		logging.LogErrorf("put index failed: %s", err)
+		return
+	}
+	if err = repo.updateLatest(ret, RefOpIndex); nil != err {
+		logging.LogErrorf("update latest failed: %s", err)
+		return
+	}
+	logging.LogInfof("indexed paths [paths=%d, upserts=%d, removes=%d] to [%s]", len(paths), len(upserts), len(removes), ret.ID)
+	return
+}
+
+// walkIndexPaths 用于遍历数据文件夹中的路径 paths，返回其中未被忽略和过滤的文件，被过滤的文件路径记录到 excluded 中。
+func (repo *Repo) walkIndexPaths(paths []string, excluded map[string]bool, context map[string]interface{}) (ret []*entity.File, err error) {
+	for _, p := range paths {
+		if hiddenIndexPath(p) {
+			continue
+		}
+
+		absPath := repo.absPath(p)
+		info, statErr := repo.dataFS.Lstat(absPath)
+		if nil != statErr {
+			if os.IsNotExist(statErr) {
+				continue // 路径已经被删除
+			}
+			err = statErr
+			return
+		}
+
+		matcher := repo.pathIgnoreMatcher(p)
+		if ignored, _ := matcher.match(p, info.IsDir()); ignored {
+			continue
+		}
+		walkFn := repo.indexWalkFunc(matcher, &ret, excluded, context)
+		if info.IsDir() {
+			err = repo.dataFS.WalkDir(absPath, walkFn)
+		} else {
+			err = walkFn(absPath, fs.FileInfoToDirEntry(info), nil)
+		}
+		if nil != err {
+			return
+		}
+	}
+	return
+}
+
+// hiddenIndexPath 用于判断路径 p 是否位于遍历数据文件夹时会跳过的上级目录中，参考 builtInIgnore。
+func hiddenIndexPath(p string) bool {
+	segments := strings.Split(p, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		if (strings.HasPrefix(segment, ".") && ".siyuan" != segment) || "filesys_status_check" == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanIndexPaths 用于规范化路径 paths，去掉重复的路径和位于其他路径下的路径，结果按字典序排列。
+func cleanIndexPaths(paths []string) (ret []string) {
+	var cleaned []string
+	for _, p := range paths {
+		if "" == strings.TrimSpace(p) {
+			continue
+		}
+		cleaned = append(cleaned, cleanRelPath(p))
+	}
+	sort.Strings(cleaned)
+	for _, p := range cleaned {
+		if underIndexPaths(p, ret) {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return
+}
+
+// underIndexPaths 用于判断文件路径 p 是否是 paths 中的某个路径或者位于其下。
+func underIndexPaths(p string, paths []string) bool {
+	for _, dir := range paths {
+		if p == dir || "/" == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
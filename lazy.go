@@ -0,0 +1,285 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+const placeholdersFile = "placeholders.json" // 尚未迁出的占位文件列表文件，位于仓库根目录下
+
+var ErrPlaceholderNotFound = errors.New("placeholder not found")
+
+// LazyPolicy 描述了云端文件按需迁出策略。
+//
+// 同步时符合条件且本地缺失分块的云端文件不会下载分块和迁出到数据文件夹，仅记录为占位文件，
+// 占位文件仍然保留在索引中，应用打开文件时再通过 Repo.Materialize 下载分块并迁出。
+type LazyPolicy struct {
+	MinFileSize  int64    // 文件大小不小于该值时按需迁出，0 表示不按大小判断
+	PathPrefixes []string // 路径以这些前缀开头的文件按需迁出，如 /assets/
+}
+
+// SetLazyPolicy 用于设置云端文件按需迁出策略，传入 nil 时关闭按需迁出，已有的占位文件仍然可以迁出。
+func (repo *Repo) SetLazyPolicy(policy *LazyPolicy) {
+	repo.lazy = policy
+}
+
+func (policy *LazyPolicy) matches(file *entity.File) bool {
+	if 0 < policy.MinFileSize && policy.MinFileSize <= file.Size {
+		return true
+	}
+	p := cleanRelPath(file.Path)
+	for _, prefix := range policy.PathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Placeholder 描述了一个已经同步到索引中但是尚未迁出到数据文件夹的云端文件。
+type Placeholder struct {
+	Path   string `json:"path"`   // 文件路径
+	FileID string `json:"fileID"` // 文件 ID
+	Size   int64  `json:"size"`   // 文件大小
+}
+
+// GetPlaceholders 用于获取尚未迁出的占位文件列表。
+func (repo *Repo) GetPlaceholders() (ret []*Placeholder, err error) {
+	repo.placeholdersLock.Lock()
+	defer repo.placeholdersLock.Unlock()
+
+	ret, err = repo.readPlaceholders()
+	return
+}
+
+// Materialize 用于迁出路径为 path 的占位文件，本地缺失的分块会从云端下载。
+func (repo *Repo) Materialize(path string, context map[string]interface{}) (ret *entity.File, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.placeholdersLock.Lock()
+	defer repo.placeholdersLock.Unlock()
+
+	placeholders, err := repo.readPlaceholders()
+	if nil != err {
+		return
+	}
+
+	var placeholder *Placeholder
+	var remains []*Placeholder
+	for _, p := range placeholders {
+		if cleanRelPath(p.Path) == cleanRelPath(path) {
+			placeholder = p
+			continue
+		}
+		remains = append(remains, p)
+	}
+	if nil == placeholder {
+		err = ErrPlaceholderNotFound
+		return
+	}
+
+	ret, err = repo.store.GetFile(placeholder.FileID)
+	if nil != err {
+		logging.LogErrorf("get file [%s] failed: %s", placeholder.FileID, err)
+		return
+	}
+
+	fetchChunkIDs, err := repo.localNotFoundChunks(ret.Chunks)
+	if nil != err {
+		logging.LogErrorf("get local not found chunks failed: %s", err)
+		return
+	}
+	if 0 < len(fetchChunkIDs) {
+		if nil == repo.cloud {
+			err = cloud.ErrUnsupported
+			return
+		}
+
+		if _, err = repo.downloadCloudChunksPut(fetchChunkIDs, context); nil != err {
+			logging.LogErrorf("download cloud chunks put failed: %s", err)
+			return
+		}
+	}
+
+	if err = repo.checkoutFile(ret, repo.DataPath, 1, 1, context); nil != err {
+		logging.LogErrorf("checkout file [%s] failed: %s", ret.Path, err)
+		return
+	}
+
+	err = repo.writePlaceholders(remains)
+	return
+}
+
+// lazyFiles 用于从 files 中分离出需要按需迁出的文件，即符合按需迁出策略并且本地缺失分块的文件。
+func (repo *Repo) lazyFiles(files []*entity.File) (eager, lazy []*entity.File, err error) {
+	if nil == repo.lazy {
+		eager = files
+		return
+	}
+
+	for _, file := range files {
+		if !repo.lazy.matches(file) {
+			eager = append(eager, file)
+			continue
+		}
+
+		var notFoundChunkIDs []string
+		notFoundChunkIDs, err = repo.localNotFoundChunks(file.Chunks)
+		if nil != err {
+			return
+		}
+		if 1 > len(notFoundChunkIDs) {
+			eager = append(eager, file)
+			continue
+		}
+		lazy = append(lazy, file)
+	}
+	return
+}
+
+// eagerChunks 用于获取同步时需要下载的分块，按需迁出的文件独占的分块不需要下载。
+func (repo *Repo) eagerChunks(files []*entity.File) (ret []string) {
+	if nil == repo.lazy {
+		ret = repo.getChunks(files)
+		return
+	}
+
+	var eager []*entity.File
+	for _, file := range files {
+		if !repo.lazy.matches(file) {
+			eager = append(eager, file)
+		}
+	}
+	ret = repo.getChunks(eager)
+	return
+}
+
+// updatePlaceholders 用于在同步还原文件后更新占位文件列表。
+//
+// lazy 中的文件记录为占位文件并移除数据文件夹中对应的旧文件，upserts 和 removes 中的文件不再是占位文件。
+func (repo *Repo) updatePlaceholders(lazy, upserts, removes []*entity.File) (err error) {
+	repo.placeholdersLock.Lock()
+	defer repo.placeholdersLock.Unlock()
+
+	placeholders, err := repo.readPlaceholders()
+	if nil != err {
+		logging.LogWarnf("read placeholders failed, the placeholders will be reset: %s", err)
+	}
+	if 1 > len(placeholders) && 1 > len(lazy) {
+		return
+	}
+
+	paths := map[string]bool{}
+	for _, files := range [][]*entity.File{lazy, upserts, removes} {
+		for _, file := range files {
+			paths[cleanRelPath(file.Path)] = true
+		}
+	}
+
+	var ret []*Placeholder
+	for _, p := range placeholders {
+		if !paths[cleanRelPath(p.Path)] {
+			ret = append(ret, p)
+		}
+	}
+	for _, file := range lazy {
+		if err = repo.dataFS.Remove(repo.absPath(file.Path)); nil != err && !os.IsNotExist(err) {
+			logging.LogErrorf("remove file [%s] failed: %s", file.Path, err)
+			return
+		}
+		ret = append(ret, &Placeholder{Path: file.Path, FileID: file.ID, Size: file.Size})
+	}
+	err = repo.writePlaceholders(ret)
+	return
+}
+
+// placeholderFiles 用于获取数据文件夹中不存在的占位文件，walked 为遍历数据文件夹得到的文件。
+//
+// 数据文件夹中已经存在的占位文件说明已经被迁出或者被覆盖，这些占位文件会被移除。
+func (repo *Repo) placeholderFiles(walked []*entity.File) (ret []*entity.File, err error) {
+	repo.placeholdersLock.Lock()
+	defer repo.placeholdersLock.Unlock()
+
+	placeholders, err := repo.readPlaceholders()
+	if nil != err || 1 > len(placeholders) {
+		return
+	}
+
+	paths := map[string]bool{}
+	for _, file := range walked {
+		paths[cleanRelPath(file.Path)] = true
+	}
+
+	var remains []*Placeholder
+	for _, p := range placeholders {
+		if paths[cleanRelPath(p.Path)] {
+			continue
+		}
+
+		var file *entity.File
+		file, err = repo.store.GetFile(p.FileID)
+		if nil != err {
+			logging.LogErrorf("get placeholder file [%s, %s] failed: %s", p.FileID, p.Path, err)
+			return
+		}
+		ret = append(ret, file)
+		remains = append(remains, p)
+	}
+	if len(remains) < len(placeholders) {
+		err = repo.writePlaceholders(remains)
+	}
+	return
+}
+
+func (repo *Repo) readPlaceholders() (ret []*Placeholder, err error) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, placeholdersFile))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = gulu.JSON.UnmarshalJSON(data, &ret)
+	return
+}
+
+func (repo *Repo) writePlaceholders(placeholders []*Placeholder) (err error) {
+	if nil == placeholders {
+		placeholders = []*Placeholder{}
+	}
+	data, err := gulu.JSON.MarshalJSON(placeholders)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, placeholdersFile), data, 0644)
+	return
+}
@@ -0,0 +1,97 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// LinkCheckout 描述了迁出文件时从数据对象链接的方式。
+type LinkCheckout int
+
+const (
+	LinkCheckoutNone     LinkCheckout = 0 // 不链接，按分块写入文件
+	LinkCheckoutClone    LinkCheckout = 1 // 写时复制克隆（APFS、Btrfs、XFS 等文件系统支持），不支持时按分块写入文件
+	LinkCheckoutHardlink LinkCheckout = 2 // 优先写时复制克隆，不支持时创建硬链接，都失败时按分块写入文件
+)
+
+var ErrLinkCheckoutWithCloud = errors.New("link checkout can not be used with cloud") // 配置了云端存储服务的仓库不能开启链接迁出
+
+// SetLinkCheckout 用于设置迁出文件时从数据对象链接的方式，默认为 LinkCheckoutNone。
+//
+// 开启后分块对象不再压缩和加密，只有一个分块的文件迁出时直接从数据对象克隆或者硬链接，不需要读取和写入文件内容，所以大量文件的全量迁出几乎是瞬间完成的。
+// 开启前写入的分块对象仍然是压缩加密的，迁出这些分块时按分块写入文件。
+// 不加密的分块对象不能上传到云端，所以配置了云端存储服务（包括副本和转存）的仓库不能开启，否则返回 ErrLinkCheckoutWithCloud。
+//
+// 硬链接的数据文件和数据对象是同一个文件，原地修改数据文件会损坏数据对象。损坏的数据对象在读取时会被隔离，参考 Repo.GetRepairQueue。
+// 迁出硬链接的数据文件时不会恢复文件权限，以免只读或者不可读的权限导致数据对象无法读取。
+//
+// 关闭后之前写入的不加密的分块对象仍然保留在存储库中，上传前会重新压缩加密，参考 Store.sealPlainChunk。
+func (repo *Repo) SetLinkCheckout(mode LinkCheckout) (err error) {
+	if LinkCheckoutNone != mode && (nil != repo.cloud || nil != repo.replica || (nil != repo.offload && nil != repo.offload.Cloud)) {
+		err = ErrLinkCheckoutWithCloud
+		return
+	}
+
+	repo.linkCheckout = mode
+	repo.store.Plain = LinkCheckoutNone != mode
+	return
+}
+
+// linkCheckoutFile 用于将只有一个分块的文件 file 从数据对象链接到 target，分块对象不是不压缩不加密的或者链接失败时返回 false。
+//
+// 创建的是硬链接时 hardlinked 为 true，这时 target 和数据对象共用同一个文件，调用方不能修改 target 的权限。
+func (repo *Repo) linkCheckoutFile(file *entity.File, target string) (linked, hardlinked bool) {
+	if LinkCheckoutNone == repo.linkCheckout || 1 != len(file.Chunks) {
+		return
+	}
+
+	id := file.Chunks[0]
+	objPath := repo.store.ObjectPath(id)
+	info, err := os.Stat(objPath)
+	if nil != err || info.Size() != file.Size {
+		return
+	}
+	data, err := os.ReadFile(objPath)
+	if nil != err || !repo.store.isPlainChunk(id, data) {
+		// 开启前写入的分块对象或者已经损坏的分块对象
+		return
+	}
+
+	if err = util.CloneFile(objPath, target); nil == err {
+		linked = true
+		return
+	}
+	if !errors.Is(err, util.ErrCloneUnsupported) {
+		logging.LogWarnf("clone [%s] to [%s] failed: %s", objPath, target, err)
+	}
+
+	if LinkCheckoutHardlink != repo.linkCheckout {
+		return
+	}
+	if err = os.Link(objPath, target); nil != err {
+		logging.LogWarnf("link [%s] to [%s] failed: %s", objPath, target, err)
+		return
+	}
+	linked, hardlinked = true, true
+	return
+}
@@ -0,0 +1,203 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+const cloudListingFile = "cloud-listing.json" // 云端列举结果缓存文件，位于仓库根目录下
+
+// cloudListing 描述了云端列举结果的本地缓存。
+//
+// 持有云端锁期间其他设备不会修改云端数据，所以每次加锁时递增代数 Generation，同一代的列举结果可以直接复用，
+// 本设备上传和删除对象后按增量更新缓存的列举结果，不需要重新列举；未持有云端锁时不使用缓存。
+type cloudListing struct {
+	lock       sync.Mutex
+	loaded     bool
+	active     bool                      // 是否持有云端锁
+	Cloud      string                    `json:"cloud"`      // 云端存储服务标识，更换云端存储服务后丢弃缓存
+	Generation int64                     `json:"generation"` // 当前代数
+	Prefixes   map[string]*cachedListing `json:"prefixes"`   // 列举前缀到列举结果的映射
+}
+
+// cachedListing 描述了一个前缀的列举结果。
+type cachedListing struct {
+	Generation int64                         `json:"generation"` // 列举时的代数
+	Objects    map[string]*entity.ObjectInfo `json:"objects"`    // 相对列举前缀的路径到对象信息的映射
+}
+
+// beginCloudListing 用于在持有云端锁后开始新的一代缓存。
+func (repo *Repo) beginCloudListing() {
+	listing := repo.listing
+	listing.lock.Lock()
+	defer listing.lock.Unlock()
+
+	repo.loadCloudListing()
+	listing.Generation++
+	listing.active = true
+	repo.saveCloudListing()
+}
+
+// endCloudListing 用于在释放云端锁后停用缓存。
+func (repo *Repo) endCloudListing() {
+	listing := repo.listing
+	listing.lock.Lock()
+	defer listing.lock.Unlock()
+
+	listing.active = false
+}
+
+// invalidateCloudListing 用于在云端数据可能被其他设备修改时使当前代的缓存失效，比如同步时发现云端最新索引已经变化。
+func (repo *Repo) invalidateCloudListing() {
+	listing := repo.listing
+	listing.lock.Lock()
+	defer listing.lock.Unlock()
+
+	if !listing.active {
+		return
+	}
+	listing.Generation++
+	repo.saveCloudListing()
+}
+
+// listCloudObjects 用于列出云端前缀为 pathPrefix 的对象，持有云端锁时复用同一代的列举结果。
+func (repo *Repo) listCloudObjects(pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
+	listing := repo.listing
+	listing.lock.Lock()
+	if listing.active {
+		if cached := listing.Prefixes[pathPrefix]; nil != cached && listing.Generation == cached.Generation {
+			ret = copyObjectInfos(cached.Objects)
+			listing.lock.Unlock()
+			return
+		}
+	}
+	generation := listing.Generation
+	listing.lock.Unlock()
+
+	ret, err = repo.cloud.ListObjects(pathPrefix)
+	if nil != err {
+		return
+	}
+
+	listing.lock.Lock()
+	defer listing.lock.Unlock()
+	if !listing.active || generation != listing.Generation {
+		return // 列举期间缓存已经失效
+	}
+	listing.Prefixes[pathPrefix] = &cachedListing{Generation: generation, Objects: copyObjectInfos(ret)}
+	repo.saveCloudListing()
+	return
+}
+
+// updateCloudListing 用于在本设备上传（removed 为 false）或删除（removed 为 true）云端对象 key 后增量更新缓存的列举结果。
+func (repo *Repo) updateCloudListing(key string, size int64, removed bool) {
+	listing := repo.listing
+	listing.lock.Lock()
+	defer listing.lock.Unlock()
+
+	if !listing.active {
+		return
+	}
+
+	updated := false
+	for prefix, cached := range listing.Prefixes {
+		if listing.Generation != cached.Generation {
+			continue
+		}
+		rel, ok := strings.CutPrefix(key, prefix)
+		if !ok || strings.Contains(rel, "/") {
+			continue // 只缓存了前缀下直接包含的对象
+		}
+		if removed {
+			delete(cached.Objects, rel)
+		} else {
+			cached.Objects[rel] = &entity.ObjectInfo{Path: rel, Size: size}
+		}
+		updated = true
+	}
+	if updated {
+		repo.saveCloudListing()
+	}
+}
+
+func (repo *Repo) loadCloudListing() {
+	listing := repo.listing
+	cloudID := repo.cloudListingID()
+	if listing.loaded && cloudID == listing.Cloud {
+		return
+	}
+
+	listing.loaded = true
+	listing.Cloud, listing.Prefixes = cloudID, map[string]*cachedListing{}
+	data, err := os.ReadFile(filepath.Join(repo.Path, cloudListingFile))
+	if nil != err {
+		return
+	}
+	saved := &cloudListing{}
+	if err = gulu.JSON.UnmarshalJSON(data, saved); nil != err {
+		logging.LogWarnf("unmarshal cloud listing failed: %s", err)
+		return
+	}
+	listing.Generation = saved.Generation // 代数单调递增，更换云端存储服务后也不会复用旧的列举结果
+	if cloudID == saved.Cloud && nil != saved.Prefixes {
+		listing.Prefixes = saved.Prefixes
+	}
+}
+
+func (repo *Repo) saveCloudListing() {
+	data, err := gulu.JSON.MarshalJSON(repo.listing)
+	if nil != err {
+		logging.LogWarnf("marshal cloud listing failed: %s", err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, cloudListingFile), data, 0644); nil != err {
+		logging.LogWarnf("write cloud listing failed: %s", err)
+	}
+}
+
+// cloudListingID 用于获取当前云端存储服务的标识。
+func (repo *Repo) cloudListingID() string {
+	conf := repo.cloud.GetConf()
+	endpoint := conf.Endpoint
+	if nil != conf.S3 {
+		endpoint = conf.S3.Endpoint + "/" + conf.S3.Bucket
+	} else if nil != conf.WebDAV {
+		endpoint = conf.WebDAV.Endpoint
+	} else if nil != conf.Local {
+		endpoint = conf.Local.Endpoint
+	}
+	return fmt.Sprintf("%T:%s", repo.cloud, path.Join(endpoint, conf.UserID, conf.Dir))
+}
+
+func copyObjectInfos(objInfos map[string]*entity.ObjectInfo) (ret map[string]*entity.ObjectInfo) {
+	ret = make(map[string]*entity.ObjectInfo, len(objInfos))
+	for p, info := range objInfos {
+		copied := *info
+		ret[p] = &copied
+	}
+	return
+}
@@ -0,0 +1,100 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+var ErrFileLocked = errors.New("file locked by another process") // ErrFileLocked 描述了数据文件被其他进程（比如杀毒软件）占用而无法更新的错误
+
+// LockedFilesError 描述了数据文件被其他进程占用而无法更新的错误，可以使用 errors.Is(err, ErrFileLocked) 判断，调用方可以据此提示用户关闭占用文件的程序后重试。
+type LockedFilesError struct {
+	Paths []string // 无法更新的文件路径
+	Err   error    // 最后一次更新时的原始错误
+}
+
+func (e *LockedFilesError) Error() string {
+	return fmt.Sprintf("files [%s] are locked by another process: %s", strings.Join(e.Paths, ", "), e.Err)
+}
+
+func (e *LockedFilesError) Is(target error) bool {
+	return ErrFileLocked == target
+}
+
+func (e *LockedFilesError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	lockedRetryTimes    = 5                      // 文件被占用时的最大重试次数
+	lockedRetryInterval = 100 * time.Millisecond // 文件被占用时的首次重试间隔，之后每次翻倍
+	lockedRemoveSuffix  = ".dejavu-removed"      // 先重命名再删除时重命名后的文件后缀
+)
+
+// SetRenameLockedRemoves 用于设置删除被占用的数据文件失败时是否先重命名再删除，默认不启用。
+//
+// Windows 上以共享删除方式打开的文件虽然不能删除但是可以重命名，重命名后原路径立即可用，重命名后的文件会在占用解除后的下次索引时删除。
+func (repo *Repo) SetRenameLockedRemoves(enabled bool) {
+	repo.renameLockedRemoves = enabled
+}
+
+// removeDataFile 用于删除数据文件 absPath，文件被占用时按指数退避重试。
+func (repo *Repo) removeDataFile(absPath string) (err error) {
+	err = retryLocked(func() error { return repo.dataFS.Remove(absPath) })
+	if !isFileLockedErr(err) || !repo.renameLockedRemoves {
+		return
+	}
+
+	aside := absPath + "." + gulu.Rand.String(7) + lockedRemoveSuffix
+	if renameErr := repo.dataFS.Rename(absPath, aside); nil != renameErr {
+		logging.LogWarnf("rename locked file [%s] failed: %s", absPath, renameErr)
+		return
+	}
+	err = nil
+	if removeErr := repo.dataFS.Remove(aside); nil != removeErr {
+		logging.LogWarnf("remove renamed locked file [%s] failed, it will be removed later: %s", aside, removeErr)
+	}
+	return
+}
+
+// retryLocked 用于执行文件操作 op，文件被其他进程占用时按指数退避重试。
+//
+// op 中不能使用 filelock 的删除和重命名，它们在文件被占用时会直接退出进程，需要使用 os 包中的函数。
+func retryLocked(op func() error) (err error) {
+	interval := lockedRetryInterval
+	for i := 0; ; i++ {
+		if err = op(); !isFileLockedErr(err) || lockedRetryTimes <= i {
+			return
+		}
+		logging.LogWarnf("file is locked, retry after [%s]: %s", interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// isFileLockedErr 用于判断 err 是否是文件被其他进程占用导致的错误。
+func isFileLockedErr(err error) bool {
+	return nil != err && util.IsFileLockedErr(err)
+}
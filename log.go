@@ -29,19 +29,22 @@ import (
 )
 
 type Log struct {
-	ID          string         `json:"id"`          // 索引 ID
-	Memo        string         `json:"memo"`        // 索引备注
-	Created     int64          `json:"created"`     // 索引时间
-	HCreated    string         `json:"hCreated"`    // 索引时间 "2006-01-02 15:04:05"
-	Files       []*entity.File `json:"files"`       // 文件列表
-	Count       int            `json:"count"`       // 文件总数
-	Size        int64          `json:"size"`        // 文件总大小
-	HSize       string         `json:"hSize"`       // 格式化好的文件总大小 "10.00 MB"
-	SystemID    string         `json:"systemID"`    // 设备 ID
-	SystemName  string         `json:"systemName"`  // 设备名称
-	SystemOS    string         `json:"systemOS"`    // 设备操作系统
-	Tag         string         `json:"tag"`         // 索引标记名称
-	HTagUpdated string         `json:"hTagUpdated"` // 标记时间 "2006-01-02 15:04:05"
+	ID          string            `json:"id"`          // 索引 ID
+	Memo        string            `json:"memo"`        // 索引备注
+	Created     int64             `json:"created"`     // 索引时间
+	HCreated    string            `json:"hCreated"`    // 索引时间 "2006-01-02 15:04:05"
+	Files       []*entity.File    `json:"files"`       // 文件列表
+	Count       int               `json:"count"`       // 文件总数
+	Size        int64             `json:"size"`        // 文件总大小
+	HSize       string            `json:"hSize"`       // 格式化好的文件总大小 "10.00 MB"
+	SystemID    string            `json:"systemID"`    // 设备 ID
+	SystemName  string            `json:"systemName"`  // 设备名称
+	SystemOS    string            `json:"systemOS"`    // 设备操作系统
+	AuthorID    string            `json:"authorID"`    // 作者 ID
+	AuthorName  string            `json:"authorName"`  // 作者名称
+	Annotations map[string]string `json:"annotations"` // 快照标注
+	Tag         string            `json:"tag"`         // 索引标记名称
+	HTagUpdated string            `json:"hTagUpdated"` // 标记时间 "2006-01-02 15:04:05"
 }
 
 func (log *Log) String() string {
@@ -59,6 +62,7 @@ func (repo *Repo) GetCloudRepoLogs(page int) (ret []*Log, pageCount, totalCount
 	}
 
 	for _, index := range cloudIndexes {
+		repo.unsealIndex(index)
 		var log *Log
 		log, err = repo.getLog(index, true)
 		if nil != err {
@@ -175,6 +179,16 @@ func (repo *Repo) getLog(index *entity.Index, fetchFiles bool) (ret *Log, err er
 		SystemID:   index.SystemID,
 		SystemName: index.SystemName,
 		SystemOS:   index.SystemOS,
+		AuthorID:   index.AuthorID,
+		AuthorName: index.AuthorName,
+	}
+	if annotations, getErr := repo.getAnnotations(index.ID); nil == getErr {
+		if "" != annotations.Memo {
+			ret.Memo = annotations.Memo
+		}
+		if 0 < len(annotations.Annotations) {
+			ret.Annotations = annotations.Annotations
+		}
 	}
 	return
 }
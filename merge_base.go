@@ -0,0 +1,128 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+const mergeBasesFile = "merge-bases.json" // 逐文件合并基准数据库文件，位于仓库根目录下
+
+// mergeBases 描述了逐文件的合并基准。
+//
+// 同步点 latest-sync 是全局的，同步中途出错时已经应用到数据文件夹的云端变更不会反映到同步点上，下次同步时这些文件会被误认为本地变更。
+// 所以在同步点之后应用云端变更时逐文件记录最后一次和云端一致的文件 ID，计算本地变更时优先使用这里记录的文件作为基准。
+type mergeBases struct {
+	SyncID string            `json:"syncID"` // 记录时的同步点索引 ID，同步点变化后记录作废
+	Files  map[string]string `json:"files"`  // 文件路径到文件 ID 的映射，文件 ID 为空表示该文件已经随云端删除
+}
+
+// resetMergeBases 用于在更新同步点 latestSync 后清空逐文件合并基准，此时所有文件的基准都是同步点。
+func (repo *Repo) resetMergeBases(latestSync *entity.Index) {
+	if err := repo.writeMergeBases(&mergeBases{SyncID: latestSync.ID}); nil != err {
+		logging.LogErrorf("reset merge bases failed: %s", err)
+	}
+}
+
+// recordMergeBases 用于记录已经应用到数据文件夹的云端变更 upserts 和 removes，这些文件此时和云端一致。
+func (repo *Repo) recordMergeBases(upserts, removes []*entity.File) {
+	if 1 > len(upserts) && 1 > len(removes) {
+		return
+	}
+
+	latestSync := repo.latestSync()
+	bases := repo.readMergeBases()
+	if nil == bases || bases.SyncID != latestSync.ID {
+		bases = &mergeBases{SyncID: latestSync.ID}
+	}
+	if nil == bases.Files {
+		bases.Files = map[string]string{}
+	}
+	for _, file := range upserts {
+		bases.Files[file.Path] = file.ID
+	}
+	for _, file := range removes {
+		bases.Files[file.Path] = ""
+	}
+	if err := repo.writeMergeBases(bases); nil != err {
+		logging.LogErrorf("record merge bases failed: %s", err)
+	}
+}
+
+// mergeBaseFiles 用于返回计算本地变更时使用的基准文件列表，即同步点 latestSync 的文件列表 latestSyncFiles 叠加逐文件合并基准。
+func (repo *Repo) mergeBaseFiles(latestSync *entity.Index, latestSyncFiles []*entity.File) (ret []*entity.File) {
+	ret = latestSyncFiles
+	bases := repo.readMergeBases()
+	if nil == bases || bases.SyncID != latestSync.ID || 1 > len(bases.Files) {
+		return
+	}
+
+	ret = nil
+	for _, file := range latestSyncFiles {
+		if _, ok := bases.Files[file.Path]; !ok {
+			ret = append(ret, file)
+		}
+	}
+	for p, id := range bases.Files {
+		if "" == id {
+			continue
+		}
+
+		file, err := repo.store.GetFile(id)
+		if nil != err {
+			// 基准文件丢失时退回同步点中的文件
+			logging.LogWarnf("get merge base file [%s, %s] failed: %s", id, p, err)
+			if file = repo.getFile(latestSyncFiles, &entity.File{Path: p}); nil == file {
+				continue
+			}
+		}
+		ret = append(ret, file)
+	}
+	logging.LogInfof("got merge base files [%d], overridden [%d]", len(ret), len(bases.Files))
+	return
+}
+
+func (repo *Repo) readMergeBases() (ret *mergeBases) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, mergeBasesFile))
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogWarnf("read merge bases failed: %s", err)
+		}
+		return
+	}
+
+	ret = &mergeBases{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		logging.LogWarnf("unmarshal merge bases failed: %s", err)
+		ret = nil
+	}
+	return
+}
+
+func (repo *Repo) writeMergeBases(bases *mergeBases) (err error) {
+	data, err := gulu.JSON.MarshalJSON(bases)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, mergeBasesFile), data, 0644)
+	return
+}
@@ -0,0 +1,143 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyncMetrics 描述了一次同步操作的度量数据。
+type SyncMetrics struct {
+	Kind      string        // 同步类型：sync、download、upload
+	Duration  time.Duration // 同步耗时
+	Failed    bool          // 是否同步失败
+	Upserts   int           // 更新的文件数
+	Removes   int           // 删除的文件数
+	Conflicts int           // 冲突的文件数
+
+	DownloadTrafficStat
+	UploadTrafficStat
+	APITrafficStat
+}
+
+// MetricsRecorder 用于接收同步过程中的度量数据，调用方可以实现该接口将数据导出到 Prometheus 等监控系统。
+type MetricsRecorder interface {
+
+	// ObserveSync 在每次同步结束后调用。
+	ObserveSync(metrics *SyncMetrics)
+
+	// IncRetry 在操作 op 重试时调用，比如锁定云端仓库时重试。
+	IncRetry(op string)
+}
+
+var (
+	metricsRecorder     MetricsRecorder
+	metricsRecorderLock = sync.RWMutex{}
+)
+
+// SetMetricsRecorder 用于设置度量数据接收器，传入 nil 时关闭度量采集。
+func SetMetricsRecorder(recorder MetricsRecorder) {
+	metricsRecorderLock.Lock()
+	defer metricsRecorderLock.Unlock()
+	metricsRecorder = recorder
+}
+
+func getMetricsRecorder() MetricsRecorder {
+	metricsRecorderLock.RLock()
+	defer metricsRecorderLock.RUnlock()
+	return metricsRecorder
+}
+
+func observeSync(kind string, start time.Time, mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+	recorder := getMetricsRecorder()
+	if nil == recorder {
+		return
+	}
+
+	metrics := &SyncMetrics{Kind: kind, Duration: time.Since(start), Failed: nil != err}
+	if nil != mergeResult {
+		metrics.Upserts = len(mergeResult.Upserts)
+		metrics.Removes = len(mergeResult.Removes)
+		metrics.Conflicts = len(mergeResult.Conflicts)
+	}
+	if nil != trafficStat {
+		metrics.DownloadTrafficStat = trafficStat.DownloadTrafficStat
+		metrics.UploadTrafficStat = trafficStat.UploadTrafficStat
+		metrics.APITrafficStat = trafficStat.APITrafficStat
+	}
+	recorder.ObserveSync(metrics)
+}
+
+func incRetry(op string) {
+	if recorder := getMetricsRecorder(); nil != recorder {
+		recorder.IncRetry(op)
+	}
+}
+
+// syncDurationBuckets 为同步耗时直方图的桶上界（秒），桶是累积的，le_N 为耗时不超过 N 秒的同步次数，le_+Inf 为同步总次数。
+var syncDurationBuckets = []int{1, 5, 10, 30, 60, 300, 600}
+
+// ExpvarMetrics 将同步度量数据发布到 expvar，可以通过 /debug/vars 获取。
+type ExpvarMetrics struct {
+	vars *expvar.Map
+}
+
+// NewExpvarMetrics 创建一个发布到 expvar 变量 name 下的度量数据接收器，同一个 name 只能创建一次。
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{vars: expvar.NewMap(name)}
+}
+
+func (metrics *ExpvarMetrics) ObserveSync(m *SyncMetrics) {
+	prefix := m.Kind + "."
+	metrics.vars.Add(prefix+"count", 1)
+	if m.Failed {
+		metrics.vars.Add(prefix+"failed", 1)
+	}
+	metrics.vars.Add(prefix+"duration_ms", m.Duration.Milliseconds())
+	for _, upper := range syncDurationBuckets {
+		if m.Duration <= time.Duration(upper)*time.Second {
+			metrics.vars.Add(prefix+"duration_bucket.le_"+strconv.Itoa(upper), 1)
+		}
+	}
+	metrics.vars.Add(prefix+"duration_bucket.le_+Inf", 1)
+	metrics.vars.Add(prefix+"upserts", int64(m.Upserts))
+	metrics.vars.Add(prefix+"removes", int64(m.Removes))
+	metrics.vars.Add(prefix+"conflicts", int64(m.Conflicts))
+	metrics.vars.Add(prefix+"download_bytes", m.DownloadBytes)
+	metrics.vars.Add(prefix+"upload_bytes", m.UploadBytes)
+	metrics.vars.Add(prefix+"download_files", int64(m.DownloadFileCount))
+	metrics.vars.Add(prefix+"upload_files", int64(m.UploadFileCount))
+	metrics.vars.Add(prefix+"download_chunks", int64(m.DownloadChunkCount))
+	metrics.vars.Add(prefix+"upload_chunks", int64(m.UploadChunkCount))
+	metrics.vars.Add(prefix+"api_get", int64(m.APIGet))
+	metrics.vars.Add(prefix+"api_put", int64(m.APIPut))
+}
+
+func (metrics *ExpvarMetrics) IncRetry(op string) {
+	metrics.vars.Add("retry."+op, 1)
+}
+
+// Get 用于获取已发布的度量值，key 形如 sync.count，不存在时返回 0。
+func (metrics *ExpvarMetrics) Get(key string) int64 {
+	if v, ok := metrics.vars.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,256 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/88250/gulu"
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// EvtCloudMigrateObject 描述了迁移云端仓库时复制一个对象的事件，参数为 context、已处理对象数和对象总数。
+const EvtCloudMigrateObject = "repo.cloudMigrateObject"
+
+var ErrCloudMigrateVerifyFailed = errors.New("cloud migrate verify failed")
+
+// MigrateStat 描述了迁移云端仓库的统计信息。
+type MigrateStat struct {
+	Indexes int   // 迁移的索引数
+	Objects int   // 复制的数据对象数
+	Skipped int   // 目标云端已经存在而跳过的数据对象数
+	Bytes   int64 // 复制的字节数
+}
+
+// MigrateCloud 用于将当前云端仓库的索引、引用和所有索引可达的数据对象复制到云端存储服务 dst。
+//
+// 对象按原始加密数据复制，不需要本地存在这些数据。复制数据对象前会向 dst 查询已经存在的对象并跳过，所以迁移中断后再次调用即可继续。
+// 引用最后复制，复制完成后会校验 dst 中的数据对象和 refs/latest，校验失败返回 ErrCloudMigrateVerifyFailed。
+func (repo *Repo) MigrateCloud(dst cloud.Cloud, context map[string]interface{}) (ret *MigrateStat, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	ret = &MigrateStat{}
+	dst.GetConf().RepoPath = repo.Path
+	dst.GetConf().DeviceID = repo.DeviceID
+	dst.GetConf().LocalObjectPath = repo.store.ObjectPath
+
+	if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+		return
+	}
+	defer repo.unlockCloud(context)
+
+	// 收集索引
+	indexIDs := map[string]bool{}
+	for page, pageCount := 1, 1; page <= pageCount; page++ {
+		var indexes []*entity.Index
+		indexes, pageCount, _, err = repo.cloud.GetIndexes(page)
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) { // 没有索引列表
+			err = nil
+			break
+		}
+		if nil != err {
+			logging.LogErrorf("get cloud indexes failed: %s", err)
+			return
+		}
+		for _, index := range indexes {
+			indexIDs[index.ID] = true
+		}
+	}
+	var refs []*cloud.Ref
+	if _, refs, err = repo.cloud.GetRefsFiles(); nil != err {
+		logging.LogErrorf("get cloud refs failed: %s", err)
+		return
+	}
+	tags, err := repo.cloud.GetTags()
+	if nil != err && (os.IsNotExist(err) || errors.Is(err, cloud.ErrCloudObjectNotFound)) { // 没有标记过快照
+		err = nil
+	}
+	if nil != err {
+		logging.LogErrorf("get cloud tags failed: %s", err)
+		return
+	}
+	refKeys := map[string]string{}
+	for _, ref := range refs {
+		refKeys[path.Join("refs", ref.Name)] = ref.ID
+		indexIDs[ref.ID] = true
+	}
+	for _, tag := range tags {
+		refKeys[path.Join("refs", "tags", tag.Name)] = tag.ID
+		indexIDs[tag.ID] = true
+	}
+
+	// 收集索引可达的文件和分块
+	objects := map[string]bool{}
+	for indexID := range indexIDs {
+		_, index, downloadErr := repo.downloadCloudIndex(indexID, context)
+		if nil != downloadErr {
+			logging.LogErrorf("download cloud index [%s] failed: %s", indexID, downloadErr)
+			err = downloadErr
+			return
+		}
+		for _, fileID := range index.Files {
+			objects[fileID] = true
+		}
+	}
+	var fileIDs []string
+	for fileID := range objects {
+		fileIDs = append(fileIDs, fileID)
+	}
+	for i, fileID := range fileIDs {
+		_, file, downloadErr := repo.downloadCloudFile(fileID, i+1, len(fileIDs), context)
+		if nil != downloadErr {
+			logging.LogErrorf("download cloud file [%s] failed: %s", fileID, downloadErr)
+			err = downloadErr
+			return
+		}
+		for _, chunkID := range file.Chunks {
+			objects[chunkID] = true
+		}
+	}
+	var objectIDs []string
+	for id := range objects {
+		objectIDs = append(objectIDs, id)
+	}
+
+	// 跳过目标云端已经存在的数据对象
+	missingIDs, err := dst.GetChunks(objectIDs)
+	if nil != err {
+		if !errors.Is(err, cloud.ErrUnsupported) {
+			logging.LogErrorf("get dst cloud missing objects failed: %s", err)
+			return
+		}
+		missingIDs, err = objectIDs, nil
+	}
+	ret.Skipped = len(objectIDs) - len(missingIDs)
+
+	var keys []string
+	for _, id := range missingIDs {
+		keys = append(keys, path.Join("objects", id[:2], id[2:]))
+	}
+	for indexID := range indexIDs {
+		keys = append(keys, path.Join("indexes", indexID))
+	}
+	keys = append(keys, "indexes-v2.json")
+	if err = repo.copyCloudObjects(dst, keys, ret, context); nil != err {
+		return
+	}
+	ret.Objects = len(missingIDs)
+	ret.Indexes = len(indexIDs)
+
+	// 最后复制引用，这样迁移中断时目标云端不会出现引用了缺失索引的情况
+	for key, id := range refKeys {
+		if _, err = dst.UploadBytes(key, []byte(id), true); nil != err {
+			logging.LogErrorf("upload dst cloud ref [%s] failed: %s", key, err)
+			return
+		}
+	}
+
+	// 校验
+	if remains, getErr := dst.GetChunks(objectIDs); nil == getErr && 0 < len(remains) {
+		logging.LogErrorf("dst cloud still misses [%d] objects after migration", len(remains))
+		err = ErrCloudMigrateVerifyFailed
+		return
+	}
+	if latestID, ok := refKeys["refs/latest"]; ok {
+		data, downloadErr := dst.DownloadObject("refs/latest")
+		if nil != downloadErr || !bytes.Equal([]byte(latestID), data) {
+			logging.LogErrorf("verify dst cloud [refs/latest] failed: %v", downloadErr)
+			err = ErrCloudMigrateVerifyFailed
+			return
+		}
+	}
+	logging.LogInfof("migrated cloud repo [indexes=%d, objects=%d, skipped=%d, bytes=%d]", ret.Indexes, ret.Objects, ret.Skipped, ret.Bytes)
+	return
+}
+
+// copyCloudObjects 用于将对象 keys 的原始数据从当前云端存储服务复制到 dst，当前云端不存在的对象会被忽略。
+func (repo *Repo) copyCloudObjects(dst cloud.Cloud, keys []string, stat *MigrateStat, context map[string]interface{}) (err error) {
+	keys = gulu.Str.RemoveDuplicatedElem(keys)
+	waitGroup := &sync.WaitGroup{}
+	var copyErr error
+	errLock := sync.Mutex{}
+	copied := atomic.Int64{}
+	count := atomic.Int32{}
+	total := len(keys)
+	poolSize := repo.cloud.GetConcurrentReqs()
+	if poolSize > total {
+		poolSize = total
+	}
+	if 1 > poolSize {
+		return
+	}
+
+	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		if nil != copyErr {
+			return // 快速失败
+		}
+
+		key := arg.(string)
+		count.Add(1)
+		eventbus.Publish(EvtCloudMigrateObject, context, int(count.Load()), total)
+		data, downloadErr := repo.cloud.DownloadObject(key)
+		if nil != downloadErr {
+			if errors.Is(downloadErr, cloud.ErrCloudObjectNotFound) {
+				logging.LogWarnf("cloud object [%s] not found, skip migrating it", key)
+				return
+			}
+
+			errLock.Lock()
+			copyErr = downloadErr
+			errLock.Unlock()
+			logging.LogErrorf("download cloud object [%s] failed: %s", key, downloadErr)
+			return
+		}
+
+		length, uploadErr := dst.UploadBytes(key, data, true)
+		if nil != uploadErr {
+			errLock.Lock()
+			copyErr = uploadErr
+			errLock.Unlock()
+			logging.LogErrorf("upload dst cloud object [%s] failed: %s", key, uploadErr)
+			return
+		}
+		copied.Add(length)
+	})
+	if nil != err {
+		return
+	}
+
+	for _, key := range keys {
+		waitGroup.Add(1)
+		if err = p.Invoke(key); nil != err {
+			logging.LogErrorf("invoke failed: %s", err)
+			return
+		}
+	}
+	waitGroup.Wait()
+	p.Release()
+	stat.Bytes += copied.Load()
+	err = copyErr
+	return
+}
@@ -0,0 +1,288 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package mobile 为 iOS、Android 以及非 Go 编写的桌面端提供仓库同步和迁出接口，可以直接通过 gomobile bind 生成绑定，
+// cmd/libdejavu 在此基础上导出 C ABI。
+//
+// 为了保持接口稳定并满足 gomobile 的类型限制，导出接口只使用 string、int 和接口类型，复杂的参数和返回值都使用 JSON 字符串。
+package mobile
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+	"github.com/studio-b12/gowebdav"
+)
+
+// 云端存储服务提供方。
+const (
+	ProviderNone   = ""       // 不使用云端存储服务，只能迁出
+	ProviderSiYuan = "siyuan" // 思源官方存储服务
+	ProviderS3     = "s3"     // S3 对象存储协议
+	ProviderWebDAV = "webdav" // WebDAV 协议
+	ProviderLocal  = "local"  // 本地文件系统
+)
+
+// ErrUnknownProvider 描述了配置的云端存储服务提供方不存在。
+var ErrUnknownProvider = errors.New("unknown cloud provider")
+
+// ProgressListener 描述了进度监听器，由调用方实现。
+//
+// event 为进度事件名（比如 repo.cloudBeforeUploadChunk），count 为已经处理的数量，total 为总数。
+// 进度在同步或迁出的工作协程中回调，实现方需要自行切换到界面线程。
+type ProgressListener interface {
+	OnProgress(event string, count, total int)
+}
+
+// Repo 描述了绑定的仓库。
+type Repo struct {
+	repo *dejavu.Repo
+}
+
+// repoConf 描述了打开仓库的配置，字段和 dejavu.NewRepo 的参数对应。
+type repoConf struct {
+	DataPath    string      `json:"dataPath"`
+	RepoPath    string      `json:"repoPath"`
+	HistoryPath string      `json:"historyPath"`
+	TempPath    string      `json:"tempPath"`
+	DeviceID    string      `json:"deviceID"`
+	DeviceName  string      `json:"deviceName"`
+	DeviceOS    string      `json:"deviceOS"`
+	AESKey      string      `json:"aesKey"` // 十六进制格式
+	IgnoreLines []string    `json:"ignoreLines"`
+	Provider    string      `json:"provider"`
+	Cloud       *cloud.Conf `json:"cloud"`
+}
+
+// OpenRepo 用于按 JSON 格式的配置 confJSON 打开仓库，配置示例：
+//
+//	{
+//	  "dataPath": "/path/to/data/", "repoPath": "/path/to/repo/", "historyPath": "/path/to/history/", "tempPath": "/path/to/temp/",
+//	  "deviceID": "", "deviceName": "", "deviceOS": "android", "aesKey": "hex encoded key",
+//	  "provider": "s3", "cloud": {"Dir": "main", "UserID": "0", "S3": {"Endpoint": "", "AccessKey": "", "SecretKey": "", "Bucket": ""}}
+//	}
+//
+// 仓库文件夹不存在时会自动创建，cloud 字段即 cloud.Conf，RepoPath 和 DeviceID 为空时使用仓库的配置。
+func OpenRepo(confJSON string) (ret *Repo, err error) {
+	defer recoverErr(&err)
+
+	conf := &repoConf{}
+	if err = gulu.JSON.UnmarshalJSON([]byte(confJSON), conf); nil != err {
+		return
+	}
+
+	aesKey, err := hex.DecodeString(conf.AESKey)
+	if nil != err {
+		return
+	}
+
+	if err = os.MkdirAll(conf.RepoPath, 0755); nil != err {
+		return
+	}
+
+	c, err := newCloud(conf)
+	if nil != err {
+		return
+	}
+
+	repo, err := dejavu.NewRepo(conf.DataPath, conf.RepoPath, conf.HistoryPath, conf.TempPath, conf.DeviceID, conf.DeviceName, conf.DeviceOS, aesKey, conf.IgnoreLines, c)
+	if nil != err {
+		return
+	}
+	ret = &Repo{repo: repo}
+	return
+}
+
+func newCloud(conf *repoConf) (ret cloud.Cloud, err error) {
+	if ProviderNone == conf.Provider {
+		return
+	}
+	if nil == conf.Cloud {
+		err = fmt.Errorf("missing cloud conf for provider [%s]", conf.Provider)
+		return
+	}
+
+	cloudConf := conf.Cloud
+	if "" == cloudConf.RepoPath {
+		cloudConf.RepoPath = conf.RepoPath
+	}
+	if "" == cloudConf.DeviceID {
+		cloudConf.DeviceID = conf.DeviceID
+	}
+	baseCloud := &cloud.BaseCloud{Conf: cloudConf}
+	switch conf.Provider {
+	case ProviderSiYuan:
+		ret = cloud.NewSiYuan(baseCloud)
+	case ProviderS3:
+		if nil == cloudConf.S3 {
+			err = errors.New("missing S3 conf")
+			return
+		}
+		ret = cloud.NewS3(baseCloud, &http.Client{Timeout: time.Duration(cloudConf.S3.Timeout) * time.Second})
+	case ProviderWebDAV:
+		if nil == cloudConf.WebDAV {
+			err = errors.New("missing WebDAV conf")
+			return
+		}
+		client := gowebdav.NewClient(cloudConf.WebDAV.Endpoint, cloudConf.WebDAV.Username, cloudConf.WebDAV.Password)
+		client.SetTimeout(time.Duration(cloudConf.WebDAV.Timeout) * time.Second)
+		ret = cloud.NewWebDAV(baseCloud, client)
+	case ProviderLocal:
+		if nil == cloudConf.Local {
+			err = errors.New("missing local conf")
+			return
+		}
+		ret = cloud.NewLocal(baseCloud)
+	default:
+		err = ErrUnknownProvider
+	}
+	return
+}
+
+// Sync 用于同步，返回 JSON 格式的 {"mergeResult": {}, "trafficStat": {}}，listener 可以为空。
+func (repo *Repo) Sync(listener ProgressListener) (ret string, err error) {
+	defer recoverErr(&err)
+
+	context, done := progressContext(listener)
+	defer done()
+	mergeResult, trafficStat, err := repo.repo.Sync(context)
+	if nil != err {
+		return
+	}
+	ret, err = marshal(map[string]interface{}{"mergeResult": mergeResult, "trafficStat": trafficStat})
+	return
+}
+
+// SyncDownload 用于只下载云端变更，返回 JSON 格式的 {"mergeResult": {}, "trafficStat": {}}，listener 可以为空。
+func (repo *Repo) SyncDownload(listener ProgressListener) (ret string, err error) {
+	defer recoverErr(&err)
+
+	context, done := progressContext(listener)
+	defer done()
+	mergeResult, trafficStat, err := repo.repo.SyncDownload(context)
+	if nil != err {
+		return
+	}
+	ret, err = marshal(map[string]interface{}{"mergeResult": mergeResult, "trafficStat": trafficStat})
+	return
+}
+
+// SyncUpload 用于只上传本地变更，返回 JSON 格式的 {"trafficStat": {}}，listener 可以为空。
+func (repo *Repo) SyncUpload(listener ProgressListener) (ret string, err error) {
+	defer recoverErr(&err)
+
+	context, done := progressContext(listener)
+	defer done()
+	trafficStat, err := repo.repo.SyncUpload(context)
+	if nil != err {
+		return
+	}
+	ret, err = marshal(map[string]interface{}{"trafficStat": trafficStat})
+	return
+}
+
+// Checkout 用于迁出索引 id 到数据文件夹，返回 JSON 格式的 {"upserts": [], "removes": []}，listener 可以为空。
+func (repo *Repo) Checkout(id string, listener ProgressListener) (ret string, err error) {
+	defer recoverErr(&err)
+
+	context, done := progressContext(listener)
+	defer done()
+	upserts, removes, err := repo.repo.Checkout(id, context)
+	if nil != err {
+		return
+	}
+	ret, err = marshal(map[string]interface{}{"upserts": upserts, "removes": removes})
+	return
+}
+
+func marshal(v interface{}) (ret string, err error) {
+	data, err := gulu.JSON.MarshalJSON(v)
+	if nil != err {
+		return
+	}
+	ret = string(data)
+	return
+}
+
+// recoverErr 用于将绑定接口中的 panic 转换为错误返回，避免宿主应用崩溃。
+func recoverErr(err *error) {
+	if e := recover(); nil != e {
+		logging.LogErrorf("mobile call panic: %v\n%s", e, logging.ShortStack())
+		*err = fmt.Errorf("panic: %v", e)
+	}
+}
+
+// ctxProgressID 为进度监听器 ID 在事件上下文中的键。
+const ctxProgressID = "mobileProgressID"
+
+// progressEvents 为参数是 (context, count, total) 的进度事件。
+var progressEvents = []string{
+	eventbus.EvtIndexGetLatestFile,
+	eventbus.EvtIndexUpsertFile,
+	eventbus.EvtCheckoutUpsertFile,
+	eventbus.EvtCheckoutRemoveFile,
+	eventbus.EvtCloudBeforeUploadFile,
+	eventbus.EvtCloudBeforeUploadChunk,
+	eventbus.EvtCloudBeforeDownloadFile,
+	eventbus.EvtCloudBeforeDownloadChunk,
+	eventbus.EvtCloudBeforeFixObjects,
+}
+
+var (
+	listeners      = sync.Map{} // 进度监听器 ID -> ProgressListener
+	listenerID     atomic.Int64
+	subscribeEvent = sync.Once{}
+)
+
+// progressContext 用于创建携带进度监听器的事件上下文，调用结束后需要调用 done 注销监听器。
+func progressContext(listener ProgressListener) (context map[string]interface{}, done func()) {
+	context = map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	done = func() {}
+	if nil == listener {
+		return
+	}
+
+	subscribeEvent.Do(func() {
+		for _, evt := range progressEvents {
+			eventbus.Subscribe(evt, func(context map[string]interface{}, count, total int) {
+				id, ok := context[ctxProgressID]
+				if !ok {
+					return
+				}
+				if l, ok := listeners.Load(id); ok {
+					l.(ProgressListener).OnProgress(evt, count, total)
+				}
+			})
+		}
+	})
+
+	id := listenerID.Add(1)
+	listeners.Store(id, listener)
+	context[ctxProgressID] = id
+	done = func() { listeners.Delete(id) }
+	return
+}
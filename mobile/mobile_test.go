@@ -0,0 +1,230 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/encryption"
+	"github.com/siyuan-note/eventbus"
+)
+
+// recordingListener 记录收到的进度事件。
+type recordingListener struct {
+	lock   sync.Mutex
+	events map[string]int
+}
+
+func (l *recordingListener) OnProgress(event string, count, total int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events[event]++
+}
+
+func testConf(t *testing.T, provider string, cloudConf map[string]interface{}) (ret map[string]interface{}) {
+	aesKey, err := encryption.KDF("pass", "salt")
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dir := t.TempDir()
+	// cloud.Conf 包含函数字段无法直接序列化，所以这里使用 map 构造配置
+	dataPath := filepath.Join(dir, "data") + string(os.PathSeparator)
+	ret = map[string]interface{}{
+		"dataPath":    dataPath,
+		"repoPath":    filepath.Join(dir, "repo") + string(os.PathSeparator),
+		"historyPath": filepath.Join(dir, "history") + string(os.PathSeparator),
+		"tempPath":    filepath.Join(dir, "temp") + string(os.PathSeparator),
+		"deviceID":    "mobile-device",
+		"deviceName":  "mobile",
+		"deviceOS":    "android",
+		"aesKey":      hex.EncodeToString(aesKey),
+		"provider":    provider,
+	}
+	if nil != cloudConf {
+		ret["cloud"] = cloudConf
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "a.txt"), []byte("mobile"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	return
+}
+
+func localCloudConf(t *testing.T) map[string]interface{} {
+	return map[string]interface{}{"Dir": "main", "UserID": "0", "Local": map[string]interface{}{"Endpoint": t.TempDir()}}
+}
+
+func openTestRepo(t *testing.T, conf map[string]interface{}) (ret *Repo, err error) {
+	data, err := json.Marshal(conf)
+	if nil != err {
+		t.Fatalf("marshal conf failed: %s", err)
+		return
+	}
+	ret, err = OpenRepo(string(data))
+	return
+}
+
+func TestOpenRepo(t *testing.T) {
+	if _, err := OpenRepo("{"); nil == err {
+		t.Fatalf("open repo with invalid conf should fail")
+		return
+	}
+
+	conf := testConf(t, ProviderLocal, nil)
+	conf["aesKey"] = "not hex"
+	if _, err := openTestRepo(t, conf); nil == err {
+		t.Fatalf("open repo with invalid aes key should fail")
+		return
+	}
+
+	conf = testConf(t, "ftp", map[string]interface{}{})
+	if _, err := openTestRepo(t, conf); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("open repo with unknown provider should fail: %v", err)
+		return
+	}
+
+	conf = testConf(t, ProviderLocal, nil)
+	if _, err := openTestRepo(t, conf); nil == err {
+		t.Fatalf("open repo without cloud conf should fail")
+		return
+	}
+	conf = testConf(t, ProviderLocal, map[string]interface{}{"Dir": "main", "UserID": "0"})
+	if _, err := openTestRepo(t, conf); nil == err {
+		t.Fatalf("open repo without local conf should fail")
+		return
+	}
+
+	conf = testConf(t, ProviderLocal, localCloudConf(t))
+	if _, err := openTestRepo(t, conf); nil != err {
+		t.Fatalf("open repo failed: %s", err)
+		return
+	}
+	if _, err := os.Stat(conf["repoPath"].(string)); nil != err {
+		t.Fatalf("repo dir should be created: %s", err)
+		return
+	}
+
+	// 云端配置中的仓库路径和设备 ID 为空时使用仓库的配置
+	parsed := &repoConf{}
+	data, _ := json.Marshal(conf)
+	if err := json.Unmarshal(data, parsed); nil != err {
+		t.Fatalf("unmarshal conf failed: %s", err)
+		return
+	}
+	c, err := newCloud(parsed)
+	if nil != err {
+		t.Fatalf("new cloud failed: %s", err)
+		return
+	}
+	if _, ok := c.(*cloud.Local); !ok {
+		t.Fatalf("cloud should be local")
+		return
+	}
+	cloudConf := c.GetConf()
+	if parsed.RepoPath != cloudConf.RepoPath || parsed.DeviceID != cloudConf.DeviceID {
+		t.Fatalf("cloud conf should inherit repo path and device id: %+v", cloudConf)
+		return
+	}
+
+	if c, err = newCloud(&repoConf{Provider: ProviderNone}); nil != err || nil != c {
+		t.Fatalf("provider none should not create cloud: %v", err)
+		return
+	}
+}
+
+func TestSync(t *testing.T) {
+	conf := testConf(t, ProviderLocal, localCloudConf(t))
+	repo, err := openTestRepo(t, conf)
+	if nil != err {
+		t.Fatalf("open repo failed: %s", err)
+		return
+	}
+	if _, err = repo.repo.Index("mobile", true, map[string]interface{}{}); nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	listener := &recordingListener{events: map[string]int{}}
+	ret, err := repo.Sync(listener)
+	if nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	result := map[string]json.RawMessage{}
+	if err = json.Unmarshal([]byte(ret), &result); nil != err {
+		t.Fatalf("unmarshal sync result failed: %s", err)
+		return
+	}
+	if 2 != len(result) || nil == result["mergeResult"] || nil == result["trafficStat"] {
+		t.Fatalf("unexpected sync result: %s", ret)
+		return
+	}
+	trafficStat := map[string]interface{}{}
+	if err = json.Unmarshal(result["trafficStat"], &trafficStat); nil != err {
+		t.Fatalf("unmarshal traffic stat failed: %s", err)
+		return
+	}
+	if uploadFileCount, _ := trafficStat["UploadFileCount"].(float64); 1 > uploadFileCount {
+		t.Fatalf("sync should upload files: %s", ret)
+		return
+	}
+
+	listener.lock.Lock()
+	uploads := listener.events[eventbus.EvtCloudBeforeUploadFile]
+	listener.lock.Unlock()
+	if 1 > uploads {
+		t.Fatalf("listener should receive upload progress: %v", listener.events)
+		return
+	}
+
+	// 同步结束后注销监听器，后续事件不再回调
+	count := 0
+	listeners.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	if 0 != count {
+		t.Fatalf("listener should be removed after sync, [%d] left", count)
+		return
+	}
+	eventbus.Publish(eventbus.EvtCloudBeforeUploadFile, map[string]interface{}{ctxProgressID: int64(1)}, 1, 1)
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	if uploads != listener.events[eventbus.EvtCloudBeforeUploadFile] {
+		t.Fatalf("removed listener should not receive progress")
+		return
+	}
+
+	if _, err = repo.Sync(nil); nil != err {
+		t.Fatalf("sync without listener failed: %s", err)
+		return
+	}
+}
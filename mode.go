@@ -0,0 +1,91 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/filelock"
+)
+
+// ErrUnsafeSymlink 描述了符号链接的目标是绝对路径或者位于迁出文件夹外。
+var ErrUnsafeSymlink = errors.New("unsafe symlink")
+
+// newFile 用于根据遍历到的数据文件 info 创建文件，可执行文件会记录权限位，符号链接会记录链接目标。
+func newFile(absPath, relPath string, info os.FileInfo) (ret *entity.File, err error) {
+	var mode uint32
+	var symlink string
+	if 0 != info.Mode()&os.ModeSymlink {
+		if symlink, err = os.Readlink(absPath); nil != err {
+			return
+		}
+	} else if perm := info.Mode().Perm(); 0 != perm&0111 {
+		mode = uint32(perm)
+	}
+	ret = entity.NewFileWithMode(relPath, info.Size(), info.ModTime().UnixMilli(), mode, symlink)
+	return
+}
+
+// inheritModes 用于在不支持权限位和符号链接的平台上从 latestFiles 中继承路径和修改时间都相同的文件的权限位和符号链接目标，
+// 避免在 Windows 上迁出后再次索引时丢失其他平台上记录的信息。
+func inheritModes(files, latestFiles []*entity.File) {
+	if "windows" != runtime.GOOS {
+		return
+	}
+
+	latest := map[string]*entity.File{}
+	for _, f := range latestFiles {
+		if 0 != f.Mode || "" != f.Symlink {
+			latest[f.Path] = f
+		}
+	}
+	if 1 > len(latest) {
+		return
+	}
+
+	for i, f := range files {
+		if l := latest[f.Path]; nil != l && l.SecUpdated() == f.SecUpdated() && l.Size == f.Size {
+			files[i] = entity.NewFileWithMode(f.Path, f.Size, f.Updated, l.Mode, l.Symlink)
+		}
+	}
+}
+
+// checkoutSymlink 用于在 absPath 上创建指向 file.Symlink 的符号链接，已经存在的文件会被替换。
+//
+// 链接目标必须是相对路径并且解析后位于迁出文件夹 checkoutDir 下，否则返回 ErrUnsafeSymlink，避免之后的迁出通过该链接写入迁出文件夹外。
+func checkoutSymlink(file *entity.File, absPath, checkoutDir string) (err error) {
+	if filepath.IsAbs(file.Symlink) || !isSubPath(filepath.Join(filepath.Dir(absPath), file.Symlink), checkoutDir) {
+		err = ErrUnsafeSymlink
+		return
+	}
+
+	filelock.Lock(absPath)
+	defer filelock.Unlock(absPath)
+
+	if target, readErr := os.Readlink(absPath); nil == readErr && target == file.Symlink {
+		return
+	}
+	if err = os.Remove(absPath); nil != err && !os.IsNotExist(err) {
+		return
+	}
+	err = os.Symlink(file.Symlink, absPath)
+	return
+}
@@ -0,0 +1,115 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// Move 描述了一个文件的移动（重命名），From 和 To 的内容相同而路径不同。
+type Move struct {
+	From *entity.File // 移动前的文件
+	To   *entity.File // 移动后的文件
+}
+
+// detectMoves 用于从新增（或者更新）文件 upserts 和删除文件 removes 中识别出移动的文件，返回移动列表以及剩余的 upserts 和 removes。
+//
+// 文件内容相同（分块列表、大小、权限和符号链接目标都相同）即认为是同一个文件，只有在 upserts 和 removes 中都唯一的内容才会被识别为移动，
+// 空文件的内容无法区分，不做识别。启用按需迁出时被删除的文件可能是占位文件，不做识别。
+func (repo *Repo) detectMoves(upserts, removes []*entity.File) (moves []*Move, restUpserts, restRemoves []*entity.File) {
+	restUpserts, restRemoves = upserts, removes
+	if nil != repo.lazy || 1 > len(upserts) || 1 > len(removes) {
+		return
+	}
+
+	upsertKeys, removeKeys := map[string][]*entity.File{}, map[string][]*entity.File{}
+	for _, file := range upserts {
+		if key := moveKey(file); "" != key {
+			upsertKeys[key] = append(upsertKeys[key], file)
+		}
+	}
+	for _, file := range removes {
+		if key := moveKey(file); "" != key {
+			removeKeys[key] = append(removeKeys[key], file)
+		}
+	}
+
+	moved := map[*entity.File]bool{}
+	for key, tos := range upsertKeys {
+		froms := removeKeys[key]
+		if 1 != len(tos) || 1 != len(froms) {
+			continue
+		}
+		moves = append(moves, &Move{From: froms[0], To: tos[0]})
+		moved[froms[0]], moved[tos[0]] = true, true
+	}
+	if 1 > len(moves) {
+		return
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].To.Path < moves[j].To.Path })
+
+	restUpserts, restRemoves = nil, nil
+	for _, file := range upserts {
+		if !moved[file] {
+			restUpserts = append(restUpserts, file)
+		}
+	}
+	for _, file := range removes {
+		if !moved[file] {
+			restRemoves = append(restRemoves, file)
+		}
+	}
+	for _, move := range moves {
+		logging.LogInfof("detected move [%s -> %s]", move.From.Path, move.To.Path)
+	}
+	return
+}
+
+func moveKey(file *entity.File) string {
+	if 1 > file.Size && "" == file.Symlink {
+		return ""
+	}
+
+	buf := strings.Builder{}
+	buf.WriteString(strings.Join(file.Chunks, ","))
+	buf.WriteString(":")
+	buf.WriteString(strconv.FormatInt(file.Size, 10))
+	buf.WriteString(":")
+	buf.WriteString(strconv.FormatUint(uint64(file.Mode), 8))
+	buf.WriteString(":")
+	buf.WriteString(file.Symlink)
+	return buf.String()
+}
+
+func movesFrom(moves []*Move) (ret []*entity.File) {
+	for _, move := range moves {
+		ret = append(ret, move.From)
+	}
+	return
+}
+
+func movesTo(moves []*Move) (ret []*entity.File) {
+	for _, move := range moves {
+		ret = append(ret, move.To)
+	}
+	return
+}
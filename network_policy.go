@@ -0,0 +1,79 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+
+	"github.com/siyuan-note/logging"
+)
+
+var ErrUploadDeferred = errors.New("upload deferred by network policy") // ErrUploadDeferred 描述了当前网络下分块上传被网络策略推迟的错误
+
+// Transfer 描述了一次待传输的分块。
+type Transfer struct {
+	Upload bool   // 是否为上传，否则为下载
+	ID     string // 分块 ID
+	Size   int64  // 传输的字节数，下载时本地还没有分块，为 0
+}
+
+// NetworkPolicy 用于在传输分块前根据当前网络状态判断是否允许传输 transfer，由调用方根据系统网络状态实现。
+//
+// 只有分块会经过网络策略，引用、索引和文件对象都很小，总是允许传输，所以在计费网络下仍然可以刷新云端最新状态。
+type NetworkPolicy func(transfer *Transfer) bool
+
+// MeteredUploadLimit 用于创建在计费网络下禁止上传大于 maxSize 字节的分块的网络策略，metered 用于判断当前网络是否为计费网络（比如移动数据）。
+func MeteredUploadLimit(metered func() bool, maxSize int64) NetworkPolicy {
+	return func(transfer *Transfer) bool {
+		return !transfer.Upload || transfer.Size <= maxSize || !metered()
+	}
+}
+
+// SetNetworkPolicy 用于设置传输分块前的网络策略，传入 nil 时不限制。
+//
+// 同步时有分块上传被禁止时本次同步不上传任何数据，只合并云端变更，并在 MergeResult.UploadDeferred 中标记，本地变更会在之后允许上传时同步到云端。
+// 仅上传时返回 ErrUploadDeferred。预取占位文件的分块时被禁止下载的分块会被跳过。
+func (repo *Repo) SetNetworkPolicy(policy NetworkPolicy) {
+	repo.networkPolicy = policy
+}
+
+// allowTransfer 用于判断网络策略是否允许传输分块 id。
+func (repo *Repo) allowTransfer(upload bool, id string) bool {
+	policy := repo.networkPolicy
+	if nil == policy {
+		return true
+	}
+
+	var size int64
+	if info, err := os.Stat(repo.store.ObjectPath(id)); nil == err {
+		size = info.Size()
+	}
+	return policy(&Transfer{Upload: upload, ID: id, Size: size})
+}
+
+// checkUploadAllowed 用于在上传分块 chunkIDs 前检查网络策略，任意一个分块被禁止上传时返回 ErrUploadDeferred。
+func (repo *Repo) checkUploadAllowed(chunkIDs []string) (err error) {
+	for _, id := range chunkIDs {
+		if !repo.allowTransfer(true, id) {
+			logging.LogInfof("upload of chunk [%s] is deferred by network policy", id)
+			err = ErrUploadDeferred
+			return
+		}
+	}
+	return
+}
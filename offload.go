@@ -0,0 +1,198 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// OffloadPolicy 描述了大文件分块转存策略。
+//
+// 同步时符合条件的文件的分块会上传到次级云端存储服务（比如 S3 低频访问存储桶），文件和索引等元数据仍然保存在主云端存储服务中。
+// 下载分块时如果主云端存储服务中不存在，则从次级云端存储服务中获取。云端备份不受该策略影响，
+// 清理云端（参考 Repo.PurgeCloud）时同时清理次级云端存储服务中未引用的分块，校验云端时转存的分块不视为缺失。
+type OffloadPolicy struct {
+	Cloud        cloud.Cloud // 次级云端存储服务
+	MinFileSize  int64       // 文件大小不小于该值时转存分块，0 表示不按大小转存
+	PathPrefixes []string    // 路径以这些前缀开头的文件转存分块，如 /assets/
+}
+
+// SetOffloadPolicy 用于设置大文件分块转存策略，传入 nil 时关闭转存。开启链接迁出时不能设置，参考 Repo.SetLinkCheckout。
+func (repo *Repo) SetOffloadPolicy(policy *OffloadPolicy) {
+	if nil != policy && nil != policy.Cloud && LinkCheckoutNone != repo.linkCheckout {
+		logging.LogErrorf("set offload policy failed: %s", ErrLinkCheckoutWithCloud)
+		return
+	}
+	if nil != policy && nil != policy.Cloud {
+		policy.Cloud.GetConf().RepoPath = repo.Path
+		policy.Cloud.GetConf().LocalObjectPath = repo.store.ObjectPath
+	}
+	repo.offload = policy
+}
+
+func (policy *OffloadPolicy) matches(file *entity.File) bool {
+	if 0 < policy.MinFileSize && policy.MinFileSize <= file.Size {
+		return true
+	}
+	p := cleanRelPath(file.Path)
+	for _, prefix := range policy.PathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFileChunks 用于上传文件 files 的分块 chunkIDs，按转存策略将分块上传到主云端存储服务或者次级云端存储服务。
+func (repo *Repo) uploadFileChunks(files []*entity.File, chunkIDs []string, context map[string]interface{}) (uploadBytes int64, err error) {
+	if err = repo.checkUploadAllowed(chunkIDs); nil != err {
+		return
+	}
+
+	if nil == repo.offload || nil == repo.offload.Cloud {
+		uploadBytes, err = repo.uploadChunks(chunkIDs, context)
+		return
+	}
+
+	offloaded := map[string]bool{}
+	for _, file := range files {
+		if repo.offload.matches(file) {
+			for _, chunkID := range file.Chunks {
+				offloaded[chunkID] = true
+			}
+		}
+	}
+
+	var primaryChunkIDs, offloadChunkIDs []string
+	for _, chunkID := range chunkIDs {
+		if offloaded[chunkID] {
+			offloadChunkIDs = append(offloadChunkIDs, chunkID)
+		} else {
+			primaryChunkIDs = append(primaryChunkIDs, chunkID)
+		}
+	}
+
+	length, err := repo.uploadChunks(primaryChunkIDs, context)
+	if nil != err {
+		return
+	}
+	uploadBytes += length
+
+	length, err = repo.uploadChunksTo(repo.offload.Cloud, offloadChunkIDs, context)
+	if nil != err {
+		logging.LogErrorf("upload offloaded chunks failed: %s", err)
+		return
+	}
+	uploadBytes += length
+	return
+}
+
+// purgeOffloadObjects 用于删除次级云端存储服务中没有被 referencedObjIDs 引用的分块，purgedObjIDs 不为 nil 时只删除其中的分块（不可变模式）。
+// 删除的分块数量和大小累加到 stat 中。
+func (repo *Repo) purgeOffloadObjects(referencedObjIDs, purgedObjIDs map[string]bool, stat *entity.PurgeStat) (err error) {
+	if nil == repo.offload || nil == repo.offload.Cloud {
+		return
+	}
+
+	objInfos, err := listCloudObjectIDs(repo.offload.Cloud)
+	if nil != err {
+		return
+	}
+
+	var unreferencedObjPaths []string
+	for id, info := range objInfos {
+		if referencedObjIDs[id] || (nil != purgedObjIDs && !purgedObjIDs[id]) {
+			continue
+		}
+		unreferencedObjPaths = append(unreferencedObjPaths, path.Join("objects", id[:2], id[2:]))
+		stat.Objects++
+		stat.Size += info.Size
+	}
+	if err = removeCloudObjectsFrom(repo.offload.Cloud, unreferencedObjPaths); nil != err {
+		return
+	}
+	logging.LogInfof("purged offload cloud, [%d] objects", len(unreferencedObjPaths))
+	return
+}
+
+// filterOffloadedMissing 用于从主云端存储服务缺失的数据对象 missingObjects（xx/yyyy）中去掉已经转存到次级云端存储服务的分块。
+func (repo *Repo) filterOffloadedMissing(missingObjects []string) (ret []string) {
+	if nil == repo.offload || nil == repo.offload.Cloud || 1 > len(missingObjects) {
+		return missingObjects
+	}
+
+	var ids []string
+	for _, missingObject := range missingObjects {
+		ids = append(ids, strings.ReplaceAll(missingObject, "/", ""))
+	}
+	notFound, err := repo.offload.Cloud.GetChunks(ids)
+	if nil != err {
+		logging.LogWarnf("check offload cloud objects failed: %s", err)
+		return missingObjects
+	}
+	for _, id := range notFound {
+		ret = append(ret, id[:2]+"/"+id[2:])
+	}
+	return
+}
+
+// listCloudObjectIDs 用于列出云端存储服务 target 中的所有数据对象，返回以对象 ID 为键的对象信息，云端还没有数据对象时返回空。
+//
+// 不支持递归列出的云端存储服务（比如本地存储）只返回分片文件夹，此时逐个列出分片文件夹。
+func listCloudObjectIDs(target cloud.Cloud) (ret map[string]*entity.ObjectInfo, err error) {
+	ret = map[string]*entity.ObjectInfo{}
+	objInfos, err := target.ListObjects("objects/")
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) || errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	if listedObjects(objInfos) {
+		for p, info := range objInfos {
+			ret[strings.ReplaceAll(p, "/", "")] = info
+		}
+		return
+	}
+	for shard := range objInfos {
+		var shardInfos map[string]*entity.ObjectInfo
+		if shardInfos, err = target.ListObjects(path.Join("objects", shard)); nil != err {
+			return
+		}
+		for name, info := range shardInfos {
+			ret[shard+name] = info
+		}
+	}
+	return
+}
+
+func (repo *Repo) downloadOffloadedObject(key string) (ret []byte, err error) {
+	data, err := repo.offload.Cloud.DownloadObject(key)
+	if nil != err {
+		return
+	}
+	ret, err = repo.decodeDownloadedData(key, data)
+	return
+}
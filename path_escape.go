@@ -0,0 +1,195 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// PathEscaping 描述了迁出文件时本地路径的转义方案。
+type PathEscaping int
+
+const (
+	PathEscapingNone    PathEscaping = iota // 不转义，原样使用文件路径
+	PathEscapingWindows                     // 使用 %XX 转义 Windows 上的非法字符、保留名称以及结尾的点和空格
+)
+
+const pathEscapesFile = "escapes.json" // 转义后的本地路径与原始文件路径的对照文件，位于仓库根目录下
+
+// SetPathEscaping 用于设置迁出文件时本地路径的转义方案，Windows 上默认为 PathEscapingWindows，其他平台默认为 PathEscapingNone。
+//
+// 比如在 Linux 上创建的 aux.md 在 Windows 上会迁出为 au%78.md，转义后的本地路径会记录在仓库中，
+// 再次索引时会还原为原始路径，所以在不同平台之间往返同步不会丢失文件名信息。
+func (repo *Repo) SetPathEscaping(escaping PathEscaping) {
+	repo.pathEscaping = escaping
+}
+
+// checkoutAbsPath 用于获取文件 path 迁出到 checkoutDir 时的本地绝对路径，迁出到数据文件夹时额外根目录中的文件会迁出到对应的根目录下。
+func (repo *Repo) checkoutAbsPath(checkoutDir, path string) string {
+	if filepath.Clean(checkoutDir) == filepath.Clean(repo.DataPath) {
+		return util.LongPath(repo.dataAbsPath(repo.localPath(path)))
+	}
+	return util.LongPath(filepath.Join(checkoutDir, repo.localPath(path)))
+}
+
+// localPath 用于按照转义方案将文件路径 path 转换为本地路径，不需要转义时原样返回。
+func (repo *Repo) localPath(path string) string {
+	if PathEscapingWindows != repo.pathEscaping {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escapeWindowsName(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// originalPath 用于获取本地路径 localPath 对应的原始文件路径，没有转义过时原样返回。
+func (repo *Repo) originalPath(localPath string) string {
+	if PathEscapingNone == repo.pathEscaping {
+		return localPath
+	}
+
+	repo.pathEscapesLock.Lock()
+	defer repo.pathEscapesLock.Unlock()
+	if original, ok := repo.loadPathEscapes()[localPath]; ok {
+		return original
+	}
+	return localPath
+}
+
+// recordCheckoutPath 用于在文件 file 迁出到数据文件夹时记录其转义后的本地路径。
+func (repo *Repo) recordCheckoutPath(file *entity.File, checkoutDir string) {
+	if localPath := repo.localPath(file.Path); localPath != file.Path && filepath.Clean(checkoutDir) == filepath.Clean(repo.DataPath) {
+		repo.recordEscapedPath(localPath, file.Path)
+	}
+}
+
+// recordEscapedPath 用于记录文件 path 转义后的本地路径 localPath。
+func (repo *Repo) recordEscapedPath(localPath, path string) {
+	repo.pathEscapesLock.Lock()
+	defer repo.pathEscapesLock.Unlock()
+
+	escapes := repo.loadPathEscapes()
+	if path == escapes[localPath] {
+		return
+	}
+	escapes[localPath] = path
+	repo.savePathEscapes(escapes)
+}
+
+// forgetEscapedPath 用于在文件 path 从数据文件夹中移除后删除其转义记录。
+func (repo *Repo) forgetEscapedPath(path string) {
+	localPath := repo.localPath(path)
+	if localPath == path {
+		return
+	}
+
+	repo.pathEscapesLock.Lock()
+	defer repo.pathEscapesLock.Unlock()
+
+	escapes := repo.loadPathEscapes()
+	if _, ok := escapes[localPath]; !ok {
+		return
+	}
+	delete(escapes, localPath)
+	repo.savePathEscapes(escapes)
+}
+
+func (repo *Repo) loadPathEscapes() map[string]string {
+	if nil != repo.pathEscapes {
+		return repo.pathEscapes
+	}
+
+	repo.pathEscapes = map[string]string{}
+	data, err := os.ReadFile(filepath.Join(repo.Path, pathEscapesFile))
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogErrorf("read path escapes failed: %s", err)
+		}
+		return repo.pathEscapes
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, &repo.pathEscapes); nil != err {
+		logging.LogErrorf("unmarshal path escapes failed: %s", err)
+		repo.pathEscapes = map[string]string{}
+	}
+	return repo.pathEscapes
+}
+
+func (repo *Repo) savePathEscapes(escapes map[string]string) {
+	data, err := gulu.JSON.MarshalJSON(escapes)
+	if nil != err {
+		logging.LogErrorf("marshal path escapes failed: %s", err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, pathEscapesFile), data, 0644); nil != err {
+		logging.LogErrorf("write path escapes failed: %s", err)
+	}
+}
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// escapeWindowsName 用于转义在 Windows 上不能使用的文件名 name，可以使用的文件名原样返回。
+func escapeWindowsName(name string) string {
+	if "" == name || "." == name || ".." == name {
+		return name
+	}
+
+	base := name
+	if i := strings.Index(name, "."); 0 <= i {
+		base = name[:i]
+	}
+	reserved := windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+	if !reserved && !strings.ContainsFunc(name, isWindowsInvalidRune) && !strings.HasSuffix(name, ".") && !strings.HasSuffix(name, " ") {
+		return name
+	}
+
+	buf := strings.Builder{}
+	for i, r := range name {
+		escape := '%' == r || isWindowsInvalidRune(r)
+		if reserved && i == len(base)-1 {
+			// 保留名称转义最后一个字符，如 aux.md 转义为 au%78.md
+			escape = true
+		}
+		if i == len(name)-1 && ('.' == r || ' ' == r) {
+			escape = true
+		}
+		if escape {
+			buf.WriteString(fmt.Sprintf("%%%02X", r))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func isWindowsInvalidRune(r rune) bool {
+	return 0x20 > r || strings.ContainsRune(`<>:"\|?*`, r)
+}
@@ -0,0 +1,168 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	prefetchWaitGroup = sync.WaitGroup{} // 用于等待后台预取结束
+)
+
+const prefetchBusyWait = time.Second // 仓库正忙时等待多久后再尝试预取下一个文件
+
+// PrefetchPolicy 描述了占位文件分块的预取策略。
+//
+// 同步成功后会在后台下载路径符合前缀的占位文件在本地缺失的分块，之后迁出这些文件时不需要再从云端下载。
+// 预取只在仓库空闲时进行：每个文件预取前都会尝试获取仓库锁，有同步、迁出等操作进行时等待其结束后再继续。
+type PrefetchPolicy struct {
+	PathPrefixes []string // 路径以这些前缀开头的占位文件需要预取，如 /assets/
+	MaxBytes     int64    // 每次预取最多下载的字节数，0 表示不限制
+
+	// Metered 用于判断当前网络是否为计费网络（比如移动数据），为 nil 时视为非计费网络，由调用方根据系统网络状态实现
+	Metered func() bool
+	// AllowMetered 为 true 时在计费网络下也进行预取
+	AllowMetered bool
+}
+
+// PrefetchStat 描述了一次预取的结果。
+type PrefetchStat struct {
+	Files   int   // 预取的文件数
+	Chunks  int   // 下载的分块数
+	Bytes   int64 // 下载的字节数
+	Stopped bool  // 是否因为网络状态或者下载量限制提前停止
+}
+
+// SetPrefetchPolicy 用于设置占位文件分块的预取策略，传入 nil 时关闭预取。
+func (repo *Repo) SetPrefetchPolicy(policy *PrefetchPolicy) {
+	repo.prefetch = policy
+}
+
+func (policy *PrefetchPolicy) matches(p string) bool {
+	p = cleanRelPath(p)
+	for _, prefix := range policy.PathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed 用于判断当前网络状态下是否允许预取。
+func (policy *PrefetchPolicy) allowed() bool {
+	return policy.AllowMetered || nil == policy.Metered || !policy.Metered()
+}
+
+// prefetchAsync 用于在后台预取占位文件的分块，上一次预取还未结束时跳过本次预取。
+func (repo *Repo) prefetchAsync() {
+	if nil == repo.prefetch || nil == repo.cloud {
+		return
+	}
+
+	prefetchWaitGroup.Add(1)
+	go func() {
+		defer prefetchWaitGroup.Done()
+
+		if _, err := repo.Prefetch(map[string]interface{}{}); nil != err {
+			logging.LogWarnf("prefetch failed: %s", err)
+		}
+	}()
+}
+
+// Prefetch 用于按预取策略下载占位文件在本地缺失的分块，没有设置预取策略或者上一次预取还未结束时直接返回。
+func (repo *Repo) Prefetch(context map[string]interface{}) (ret *PrefetchStat, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	ret = &PrefetchStat{}
+	policy := repo.prefetch
+	if nil == policy {
+		return
+	}
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+	if !repo.prefetchLock.TryLock() {
+		logging.LogInfof("prefetch is in progress, skip prefetching")
+		return
+	}
+	defer repo.prefetchLock.Unlock()
+
+	placeholders, err := repo.GetPlaceholders()
+	if nil != err {
+		return
+	}
+
+	for _, placeholder := range placeholders {
+		if !policy.matches(placeholder.Path) {
+			continue
+		}
+		if !policy.allowed() || (0 < policy.MaxBytes && policy.MaxBytes <= ret.Bytes) {
+			ret.Stopped = true
+			break
+		}
+
+		for !repo.lock.TryLock() {
+			time.Sleep(prefetchBusyWait)
+		}
+		chunks, downloadBytes, prefetchErr := repo.prefetchFile(placeholder, context)
+		repo.lock.Unlock()
+		if nil != prefetchErr {
+			logging.LogWarnf("prefetch file [%s] failed: %s", placeholder.Path, prefetchErr)
+			err = prefetchErr
+			return
+		}
+		if 0 < chunks {
+			ret.Files++
+			ret.Chunks += chunks
+			ret.Bytes += downloadBytes
+		}
+	}
+	if 0 < ret.Files {
+		logging.LogInfof("prefetched [%d] files, [%d] chunks, [%d] bytes", ret.Files, ret.Chunks, ret.Bytes)
+	}
+	return
+}
+
+// prefetchFile 用于下载占位文件 placeholder 在本地缺失的分块。
+func (repo *Repo) prefetchFile(placeholder *Placeholder, context map[string]interface{}) (chunks int, downloadBytes int64, err error) {
+	file, err := repo.store.GetFile(placeholder.FileID)
+	if nil != err {
+		return
+	}
+	fetchChunkIDs, err := repo.localNotFoundChunks(file.Chunks)
+	if nil != err {
+		return
+	}
+	for _, id := range fetchChunkIDs {
+		if !repo.allowTransfer(false, id) {
+			logging.LogInfof("prefetch of file [%s] is skipped by network policy", file.Path)
+			return
+		}
+	}
+	chunks = len(fetchChunkIDs)
+	downloadBytes, err = repo.downloadCloudChunksPut(fetchChunkIDs, context)
+	return
+}
@@ -0,0 +1,180 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"path"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// SetMetadataPrivacy 用于开启或关闭元数据隐私模式，尽量减少云端存储服务可以看到的元数据。
+//
+// 开启后：
+//   - 云端仓库名称使用 PrivateCloudRepoName 计算的哈希名称，存储服务无法从目录名得知仓库名称
+//   - 上传到云端的索引和 indexes-v2.json 不保存明文的系统 ID、名称和操作系统，而是加密后保存在 Sealed 字段中
+//
+// 开启后创建、删除云端仓库时调用方需要传入 PrivateCloudRepoName 计算的名称。
+// 旧版本客户端读取加密后的索引时系统信息为空。S3 对象存储协议的仓库即存储桶，存储桶名称由用户指定，不会被哈希。
+// 开启前已经上传到云端的索引不会被重写。
+func (repo *Repo) SetMetadataPrivacy(enabled bool) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if enabled == repo.metadataPrivacy {
+		return
+	}
+	repo.metadataPrivacy = enabled
+	if nil == repo.cloud {
+		return
+	}
+
+	conf := repo.cloud.GetConf()
+	if enabled {
+		repo.plainCloudDir = conf.Dir
+		conf.Dir = repo.PrivateCloudRepoName(conf.Dir)
+	} else {
+		conf.Dir = repo.plainCloudDir
+	}
+}
+
+// PrivateCloudRepoName 用于获取仓库 name 在元数据隐私模式下的云端名称。
+//
+// 云端名称 = HMAC-SHA256(仓库密钥, "dejavu repo name:" + name) 的前 32 个十六进制字符，没有仓库密钥无法从云端名称反推仓库名称。
+func (repo *Repo) PrivateCloudRepoName(name string) string {
+	mac := hmac.New(sha256.New, repo.store.AesKey)
+	mac.Write([]byte("dejavu repo name:" + name))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// sealedSystemInfo 描述了索引中需要加密的系统信息。
+type sealedSystemInfo struct {
+	SystemID   string `json:"systemID"`
+	SystemName string `json:"systemName"`
+	SystemOS   string `json:"systemOS"`
+	AuthorID   string `json:"authorID,omitempty"`
+	AuthorName string `json:"authorName,omitempty"`
+}
+
+// sealedInfoID 用于获取加密索引 id 的系统信息时派生密钥使用的 ID，和数据对象的密钥区分开。
+func sealedInfoID(id string) string {
+	return "index-system:" + id
+}
+
+// sealSystemInfo 用于加密索引 index 的系统信息和作者信息，加密时绑定索引 ID，所以无法被挪用到其他索引上。
+func (repo *Repo) sealSystemInfo(index *entity.Index) (ret string, err error) {
+	data, err := gulu.JSON.MarshalJSON(&sealedSystemInfo{SystemID: index.SystemID, SystemName: index.SystemName, SystemOS: index.SystemOS,
+		AuthorID: index.AuthorID, AuthorName: index.AuthorName})
+	if nil != err {
+		return
+	}
+	data, err = encryptAEAD(repo.store.AesKey, sealedInfoID(index.ID), data)
+	if nil != err {
+		return
+	}
+	ret = base64.StdEncoding.EncodeToString(data)
+	return
+}
+
+func (repo *Repo) unsealSystemInfo(id, sealed string) (ret *sealedSystemInfo, err error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if nil != err {
+		return
+	}
+	data, err = decryptAEAD(repo.store.AesKey, sealedInfoID(id), data)
+	if nil != err {
+		return
+	}
+	ret = &sealedSystemInfo{}
+	err = gulu.JSON.UnmarshalJSON(data, ret)
+	return
+}
+
+// sealIndex 用于获取待上传到云端的索引，开启元数据隐私模式时返回系统信息已经加密的索引副本。
+func (repo *Repo) sealIndex(index *entity.Index) (ret *entity.Index, err error) {
+	if !repo.metadataPrivacy {
+		ret = index
+		return
+	}
+
+	sealed, err := repo.sealSystemInfo(index)
+	if nil != err {
+		return
+	}
+	copied := *index
+	copied.SystemID, copied.SystemName, copied.SystemOS = "", "", ""
+	copied.AuthorID, copied.AuthorName = "", ""
+	copied.Sealed = sealed
+	ret = &copied
+	return
+}
+
+// unsealIndex 用于还原从云端下载的索引中加密的系统信息，解密失败时保留空的系统信息。
+func (repo *Repo) unsealIndex(index *entity.Index) {
+	if nil == index || "" == index.Sealed {
+		return
+	}
+
+	info, err := repo.unsealSystemInfo(index.ID, index.Sealed)
+	if nil != err {
+		logging.LogWarnf("unseal index [%s] system info failed: %s", index.ID, err)
+		return
+	}
+	index.SystemID, index.SystemName, index.SystemOS = info.SystemID, info.SystemName, info.SystemOS
+	index.AuthorID, index.AuthorName = info.AuthorID, info.AuthorName
+	index.Sealed = ""
+}
+
+// cloudIndexEntry 用于获取 indexes-v2.json 中索引 index 的条目。
+func (repo *Repo) cloudIndexEntry(index *entity.Index) (ret *cloud.Index, err error) {
+	ret = &cloud.Index{ID: index.ID}
+	if !repo.metadataPrivacy {
+		ret.SystemID, ret.SystemName, ret.SystemOS = index.SystemID, index.SystemName, index.SystemOS
+		ret.AuthorID, ret.AuthorName = index.AuthorID, index.AuthorName
+		return
+	}
+	ret.Sealed, err = repo.sealSystemInfo(index)
+	return
+}
+
+// uploadIndexTo 用于将本地索引 index 上传到云端存储服务 target，开启元数据隐私模式时上传系统信息已经加密的索引。
+func (repo *Repo) uploadIndexTo(target cloud.Cloud, index *entity.Index) (uploadBytes int64, err error) {
+	key := path.Join("indexes", index.ID)
+	if !repo.metadataPrivacy {
+		uploadBytes, err = target.UploadObject(key, false)
+		return
+	}
+
+	sealed, err := repo.sealIndex(index)
+	if nil != err {
+		return
+	}
+	data, err := entity.MarshalIndex(sealed, repo.store.Format)
+	if nil != err {
+		return
+	}
+	data = repo.store.compressEncoder.EncodeAll(data, nil)
+	uploadBytes, err = target.UploadBytes(key, data, false)
+	return
+}
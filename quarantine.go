@@ -0,0 +1,194 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// QuarantinedObject 描述了因为损坏被隔离的本地数据对象，隔离的对象会记录在修复队列中，可以从云端重新下载修复。
+type QuarantinedObject struct {
+	ID      string `json:"id"`      // 对象 ID
+	Reason  string `json:"reason"`  // 损坏原因
+	Created int64  `json:"created"` // 隔离时间，Unix 毫秒时间戳
+}
+
+// maxQuarantined 描述了修复队列中最多隔离的对象数，大量对象同时损坏通常是密钥错误等原因导致的，此时不再继续隔离。
+const maxQuarantined = 128
+
+// quarantineDir 用于获取隔离文件夹的绝对路径，损坏的对象会移动到该文件夹下，修复队列也保存在该文件夹下。
+func (store *Store) quarantineDir() string {
+	return filepath.Join(store.Path, "quarantine")
+}
+
+// quarantine 用于将解码失败的对象 id 移动到隔离文件夹并记录到修复队列，后续操作会把该对象视为不存在，不是必需的对象不会导致操作失败。
+func (store *Store) quarantine(id string, cause error) {
+	if store.readOnly {
+		return
+	}
+
+	store.quarantineLock.Lock()
+	defer store.quarantineLock.Unlock()
+	queue, err := store.readRepairQueue()
+	if nil != err {
+		return
+	}
+	for _, object := range queue {
+		if id == object.ID {
+			return
+		}
+	}
+	if maxQuarantined <= len(queue) {
+		logging.LogErrorf("too many quarantined objects, skip quarantining object [%s]: %s", id, cause)
+		return
+	}
+
+	_, file := store.AbsPath(id)
+	dir := store.quarantineDir()
+	if err := store.fs.MkdirAll(dir); nil != err {
+		logging.LogErrorf("create quarantine dir failed: %s", err)
+		return
+	}
+	if err := store.fs.Rename(file, filepath.Join(dir, id)); nil != err {
+		logging.LogErrorf("quarantine object [%s] failed: %s", id, err)
+		return
+	}
+	fileCache.Del(id)
+
+	queue = append(queue, &QuarantinedObject{ID: id, Reason: cause.Error(), Created: time.Now().UnixMilli()})
+	if err = store.writeRepairQueue(queue); nil != err {
+		return
+	}
+	logging.LogWarnf("quarantined corrupted object [%s]: %s", id, cause)
+}
+
+func (store *Store) readRepairQueue() (ret []*QuarantinedObject, err error) {
+	ret = []*QuarantinedObject{}
+	queuePath := filepath.Join(store.quarantineDir(), "queue.json")
+	if !store.exist(queuePath) {
+		return
+	}
+
+	data, err := store.fs.ReadFile(queuePath)
+	if nil != err {
+		logging.LogErrorf("read repair queue failed: %s", err)
+		return
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, &ret); nil != err {
+		logging.LogErrorf("unmarshal repair queue failed: %s", err)
+	}
+	return
+}
+
+func (store *Store) writeRepairQueue(queue []*QuarantinedObject) (err error) {
+	data, err := gulu.JSON.MarshalIndentJSON(queue, "", "  ")
+	if nil != err {
+		logging.LogErrorf("marshal repair queue failed: %s", err)
+		return
+	}
+	if err = store.fs.WriteFile(filepath.Join(store.quarantineDir(), "queue.json"), data); nil != err {
+		logging.LogErrorf("write repair queue failed: %s", err)
+	}
+	return
+}
+
+// GetRepairQueue 用于获取修复队列中因为损坏被隔离的本地数据对象。
+func (repo *Repo) GetRepairQueue() (ret []*QuarantinedObject, err error) {
+	repo.store.quarantineLock.Lock()
+	defer repo.store.quarantineLock.Unlock()
+	ret, err = repo.store.readRepairQueue()
+	return
+}
+
+// RepairQuarantined 用于从云端重新下载修复队列中的对象，修复成功的对象会从修复队列和隔离文件夹中移除。
+//
+// 云端也不存在或者云端对象同样损坏的对象会保留在修复队列中，repaired 为修复成功的对象数。
+func (repo *Repo) RepairQuarantined(context map[string]interface{}) (repaired int, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if nil == repo.cloud {
+		err = cloud.ErrUnsupported
+		return
+	}
+
+	repo.store.quarantineLock.Lock()
+	defer repo.store.quarantineLock.Unlock()
+	queue, err := repo.store.readRepairQueue()
+	if nil != err {
+		return
+	}
+
+	var remains []*QuarantinedObject
+	for _, object := range queue {
+		if repairErr := repo.repairObject(object.ID); nil != repairErr {
+			logging.LogWarnf("repair quarantined object [%s] failed: %s", object.ID, repairErr)
+			remains = append(remains, object)
+			continue
+		}
+
+		if removeErr := os.Remove(filepath.Join(repo.store.quarantineDir(), object.ID)); nil != removeErr && !os.IsNotExist(removeErr) {
+			logging.LogWarnf("remove quarantined object [%s] failed: %s", object.ID, removeErr)
+		}
+		repaired++
+	}
+	if repaired == len(queue) {
+		remains = []*QuarantinedObject{}
+	}
+	err = repo.store.writeRepairQueue(remains)
+	logging.LogInfof("repaired quarantined objects [%d/%d]", repaired, len(queue))
+	return
+}
+
+// repairObject 用于从云端下载对象 id 并入库，下载的内容是分块还是文件对象由对象 ID 校验确定。
+func (repo *Repo) repairObject(id string) (err error) {
+	key := path.Join("objects", id[:2], id[2:])
+	data, err := repo.downloadCloudObject(key)
+	if nil != err {
+		return
+	}
+
+	if util.Hash(data) == id {
+		err = repo.store.PutChunk(&entity.Chunk{ID: id, Data: data})
+		return
+	}
+
+	file, unmarshalErr := entity.UnmarshalFile(data)
+	if nil != unmarshalErr || id != file.ID {
+		actual := ""
+		if nil != file {
+			actual = file.ID
+		}
+		err = &CloudObjectCorruptedError{Key: key, Actual: actual}
+		return
+	}
+	err = repo.store.PutFile(file)
+	return
+}
@@ -0,0 +1,114 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+// SetRangeDownload 用于设置分段下载的段大小 partSize（字节），大于一段的对象会按段并发下载，用于加快高带宽高延迟链路上的下载。
+//
+// 仅对支持范围下载的云端存储服务生效，partSize 小于 1 时关闭分段下载。
+func (repo *Repo) SetRangeDownload(partSize int64) {
+	repo.rangePartSize = max(partSize, 0)
+}
+
+// isRangeDownloadKey 用于判断对象 key 是否可以分段下载。
+//
+// 分段之间可能被其他设备覆盖写入，只有内容寻址的 objects/ 下的对象不可变，引用、锁、indexes-v2.json 等可变对象不分段下载。
+func isRangeDownloadKey(key string) bool {
+	return strings.HasPrefix(key, "objects/")
+}
+
+// downloadCloudData 用于下载云端对象 key 的原始数据，开启分段下载时按段并发下载大对象。
+func (repo *Repo) downloadCloudData(key string) (ret []byte, err error) {
+	rangeCloud, ok := repo.cloud.(cloud.RangeCloud)
+	if !ok || 1 > repo.rangePartSize || !isRangeDownloadKey(key) {
+		return repo.cloud.DownloadObject(key)
+	}
+
+	partSize := repo.rangePartSize
+	first, size, err := rangeCloud.DownloadObjectRange(key, 0, partSize)
+	if nil != err {
+		return
+	}
+	if int64(len(first)) >= size {
+		ret = first // 对象不超过一段，或者存储服务忽略了范围请求
+		return
+	}
+	if int64(len(first)) != partSize {
+		logging.LogErrorf("download object [%s] range [0, %d) got [%d] bytes", key, partSize, len(first))
+		err = cloud.ErrCloudObjectCorrupted
+		return
+	}
+
+	ret = make([]byte, size)
+	copy(ret, first)
+	var offsets []int64
+	for offset := partSize; offset < size; offset += partSize {
+		offsets = append(offsets, offset)
+	}
+
+	concurrency := min(max(repo.cloud.GetConcurrentReqs(), 1), len(offsets))
+	offsetCh := make(chan int64, len(offsets))
+	for _, offset := range offsets {
+		offsetCh <- offset
+	}
+	close(offsetCh)
+
+	var errLock sync.Mutex
+	var waitGroup sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for offset := range offsetCh {
+				errLock.Lock()
+				failed := nil != err
+				errLock.Unlock()
+				if failed {
+					return
+				}
+
+				length := min(partSize, size-offset)
+				data, _, downloadErr := rangeCloud.DownloadObjectRange(key, offset, length)
+				if nil == downloadErr && int64(len(data)) != length {
+					logging.LogErrorf("download object [%s] range [%d, %d) got [%d] bytes", key, offset, offset+length, len(data))
+					downloadErr = cloud.ErrCloudObjectCorrupted
+				}
+				if nil != downloadErr {
+					errLock.Lock()
+					if nil == err {
+						err = downloadErr
+					}
+					errLock.Unlock()
+					return
+				}
+				copy(ret[offset:], data)
+			}
+		}()
+	}
+	waitGroup.Wait()
+	if nil != err {
+		ret = nil
+	}
+	return
+}
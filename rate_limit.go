@@ -0,0 +1,88 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sync"
+	"time"
+)
+
+const rateLimitBurst = time.Second // 限速器允许的突发量，空闲后最多可以立即传输 1 秒的额度
+
+// RateLimiter 描述了云端传输的限速器，用于限制数据传输的总带宽和请求频率。
+//
+// 限速器可以在多个仓库之间共享，此时所有仓库的传输共用同一份额度，参考 SyncRepos。
+type RateLimiter struct {
+	bytesPerSecond    int64 // 每秒传输字节数上限，0 表示不限制
+	requestsPerSecond int   // 每秒请求数上限，0 表示不限制
+
+	lock         *sync.Mutex
+	bytesNext    time.Time // 字节额度的下一个可用时间
+	requestsNext time.Time // 请求额度的下一个可用时间
+}
+
+// NewRateLimiter 用于创建一个限速器，bytesPerSecond 为每秒传输字节数上限，requestsPerSecond 为每秒请求数上限，小于 1 时表示不限制。
+func NewRateLimiter(bytesPerSecond int64, requestsPerSecond int) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSecond:    max(bytesPerSecond, 0),
+		requestsPerSecond: max(requestsPerSecond, 0),
+		lock:              &sync.Mutex{},
+	}
+}
+
+// SetRateLimiter 用于设置云端传输的限速器，传入 nil 时不限速。
+//
+// 限速只作用于数据对象和索引等对象的上传下载，每次传输完成后扣除额度，额度不足时等待后再继续下一次传输。
+func (repo *Repo) SetRateLimiter(limiter *RateLimiter) {
+	repo.rateLimiter = limiter
+}
+
+// rateLimit 用于在完成一次传输 bytes 字节的请求后扣除限速额度，额度不足时等待。
+func (repo *Repo) rateLimit(bytes int64) {
+	if nil == repo.rateLimiter {
+		return
+	}
+	repo.rateLimiter.wait(1, bytes)
+}
+
+// wait 用于扣除 requests 个请求和 bytes 字节的额度，额度不足时阻塞到额度恢复。
+func (limiter *RateLimiter) wait(requests int, bytes int64) {
+	limiter.lock.Lock()
+	now := time.Now()
+	var delay time.Duration
+	if 0 < limiter.bytesPerSecond && 0 < bytes {
+		delay = max(delay, reserveRate(&limiter.bytesNext, now, float64(bytes)/float64(limiter.bytesPerSecond)))
+	}
+	if 0 < limiter.requestsPerSecond && 0 < requests {
+		delay = max(delay, reserveRate(&limiter.requestsNext, now, float64(requests)/float64(limiter.requestsPerSecond)))
+	}
+	limiter.lock.Unlock()
+
+	if 0 < delay {
+		time.Sleep(delay)
+	}
+}
+
+// reserveRate 用于从下一个可用时间 next 开始预留 seconds 秒的额度，返回需要等待的时间。
+func reserveRate(next *time.Time, now time.Time, seconds float64) (ret time.Duration) {
+	if start := now.Add(-rateLimitBurst); next.Before(start) {
+		*next = start
+	}
+	*next = next.Add(time.Duration(seconds * float64(time.Second)))
+	ret = max(next.Sub(now), 0)
+	return
+}
@@ -0,0 +1,113 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	// ErrRepoReadOnly 描述了仓库以只读方式打开时调用了会修改仓库的方法。
+	ErrRepoReadOnly = errors.New("repo is read only")
+	// ErrInvalidCheckoutDir 描述了迁出文件夹位于仓库文件夹或者数据文件夹下。
+	ErrInvalidCheckoutDir = errors.New("invalid checkout dir")
+)
+
+// OpenRepoReadOnly 用于以只读方式打开位于 repoPath 的仓库，用于检查用户仓库的副本。
+//
+// 只读仓库不会写入引用、索引日志、统计缓存和修复队列等任何文件，也不会创建临时文件夹，调用 Index、Checkout、Sync 等会修改仓库的方法时返回 ErrRepoReadOnly。
+// 只读仓库没有数据文件夹，可以通过 GetIndexes、DiffIndex 等方法查看快照，通过 CheckoutTo 将快照迁出到仓库外的文件夹中。
+func OpenRepoReadOnly(repoPath string, aesKey []byte) (ret *Repo, err error) {
+	if !gulu.File.IsDir(repoPath) {
+		err = &os.PathError{Op: "open", Path: repoPath, Err: os.ErrNotExist}
+		return
+	}
+
+	ret, err = newRepo("", repoPath, "", "", "", "", "", aesKey, nil, nil, true)
+	if nil != err {
+		return
+	}
+	ret.DataPath, ret.HistoryPath, ret.TempPath = "", "", ""
+	logging.LogInfof("opened repo [%s] read only", ret.Path)
+	return
+}
+
+// IsReadOnly 用于判断仓库是否以只读方式打开。
+func (repo *Repo) IsReadOnly() bool {
+	return repo.store.readOnly
+}
+
+// CheckoutTo 用于将索引 id 对应快照中的所有文件迁出到文件夹 dir 中，不会修改数据文件夹和仓库，只读仓库也可以调用。
+//
+// dir 不能位于仓库文件夹或者数据文件夹下，否则返回 ErrInvalidCheckoutDir。
+func (repo *Repo) CheckoutTo(id, dir string, context map[string]interface{}) (ret []*entity.File, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if dir, err = filepath.Abs(dir); nil != err {
+		return
+	}
+	if isSubPath(dir, repo.Path) || ("" != repo.DataPath && isSubPath(dir, repo.DataPath)) {
+		err = ErrInvalidCheckoutDir
+		return
+	}
+
+	index, err := repo.store.GetIndex(id)
+	if nil != err {
+		return
+	}
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+	if err = repo.checkoutFilesTo(files, dir, context); nil != err {
+		logging.LogErrorf("checkout index [%s] to [%s] failed: %s", id, dir, err)
+		return
+	}
+	ret = files
+	return
+}
+
+// checkMutable 用于在修改仓库前检查仓库是否可以写入。
+func (repo *Repo) checkMutable() (err error) {
+	if repo.store.readOnly {
+		err = ErrRepoReadOnly
+		return
+	}
+	err = repo.store.formatErr
+	return
+}
+
+// isSubPath 用于判断 p 是否为 dir 或者位于 dir 下。
+func isSubPath(p, dir string) bool {
+	if abs, err := filepath.Abs(p); nil == err {
+		p = abs
+	}
+	if abs, err := filepath.Abs(dir); nil == err {
+		dir = abs
+	}
+	return pathContains(dir, p)
+}
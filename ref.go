@@ -62,15 +62,20 @@ type FullIndex struct {
 }
 
 func (repo *Repo) UpdateLatest(index *entity.Index) (err error) {
-	start := time.Now()
+	return repo.updateLatest(index, RefOpUpdate)
+}
 
-	refs := filepath.Join(repo.Path, "refs")
-	err = os.MkdirAll(refs, 0755)
-	if nil != err {
+func (repo *Repo) updateLatest(index *entity.Index, op string) (err error) {
+	if err = repo.checkMutable(); nil != err {
 		return
 	}
-	err = gulu.File.WriteFileSafer(filepath.Join(refs, "latest"), []byte(index.ID), 0644)
-	if nil != err {
+
+	start := time.Now()
+	if err = repo.store.checkWritable(); nil != err {
+		return
+	}
+
+	if err = repo.updateRef("latest", index.ID, op); nil != err {
 		return
 	}
 
@@ -112,6 +117,9 @@ func (repo *Repo) getFullLatest(latest *entity.Index) (ret *FullIndex) {
 	if err = msgpack.Unmarshal(data, ret); nil != err {
 		logging.LogErrorf("unmarshal full latest [%s] failed: %s", fullLatestPath, err)
 		ret = nil
+		if repo.store.readOnly {
+			return
+		}
 		if err = os.RemoveAll(fullLatestPath); nil != err {
 			logging.LogErrorf("remove full latest [%s] failed: %s", fullLatestPath, err)
 		}
@@ -121,6 +129,9 @@ func (repo *Repo) getFullLatest(latest *entity.Index) (ret *FullIndex) {
 	if ret.ID != latest.ID {
 		logging.LogErrorf("full latest ID [%s] not match latest ID [%s]", ret.ID, latest.ID)
 		ret = nil
+		if repo.store.readOnly {
+			return
+		}
 		if err = os.RemoveAll(fullLatestPath); nil != err {
 			logging.LogErrorf("remove full latest [%s] failed: %s", fullLatestPath, err)
 		}
@@ -152,6 +163,10 @@ func (repo *Repo) GetTag(tag string) (id string, err error) {
 }
 
 func (repo *Repo) AddTag(id, tag string) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
 	if !gulu.File.IsValidFilename(tag) {
 		return errors.New("invalid tag name")
 	}
@@ -161,16 +176,15 @@ func (repo *Repo) AddTag(id, tag string) (err error) {
 		return
 	}
 
-	tags := filepath.Join(repo.Path, "refs", "tags")
-	if err = os.MkdirAll(tags, 0755); nil != err {
-		return
-	}
-	tag = filepath.Join(tags, tag)
-	err = gulu.File.WriteFileSafer(tag, []byte(id), 0644)
+	err = repo.updateRef(filepath.Join("tags", tag), id, RefOpUpdate)
 	return
 }
 
 func (repo *Repo) RemoveTag(tag string) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
 	tag = filepath.Join(repo.Path, "refs", "tags", tag)
 	if !gulu.File.IsExist(tag) {
 		return
@@ -17,7 +17,15 @@
 package dejavu
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/encryption"
 )
 
 func TestTag(t *testing.T) {
@@ -48,3 +56,130 @@ func TestTag(t *testing.T) {
 		return
 	}
 }
+
+func TestRefWAL(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	missingID := strings.Repeat("f", 40)
+	if err := repo.UpdateLatest(&entity.Index{ID: missingID}); !errors.Is(err, ErrNotFoundIndex) {
+		t.Fatalf("update latest to missing index should fail, got [%v]", err)
+		return
+	}
+	if latest, err := repo.Latest(); nil != err || index.ID != latest.ID {
+		t.Fatalf("latest should not change: %v", err)
+		return
+	}
+
+	// 模拟写入引用后崩溃，引用指向的索引不存在时回滚
+	latestPath := filepath.Join(testRepoPath, "refs", "latest")
+	if err := os.WriteFile(latestPath, []byte(missingID), 0644); nil != err {
+		t.Fatalf("write ref failed: %s", err)
+		return
+	}
+	writeRefWAL(t, &refWAL{Ref: "latest", ID: missingID, Prev: index.ID})
+	repo = reopenRepo(t)
+	if latest, err := repo.Latest(); nil != err || index.ID != latest.ID {
+		t.Fatalf("latest should be rolled back: %v", err)
+		return
+	}
+
+	// 模拟写入引用前崩溃，索引存在时重做
+	writeRefWAL(t, &refWAL{Ref: "latest-sync", ID: index.ID})
+	repo = reopenRepo(t)
+	if latestSync := repo.latestSync(); nil == latestSync || index.ID != latestSync.ID {
+		t.Fatalf("latest sync should be rolled forward")
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(testRepoPath, refWALFile)) {
+		t.Fatalf("ref wal should be removed after recovery")
+		return
+	}
+}
+
+func writeRefWAL(t *testing.T, wal *refWAL) {
+	data, err := gulu.JSON.MarshalJSON(wal)
+	if nil != err {
+		t.Fatalf("marshal ref wal failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(testRepoPath, refWALFile), data, 0644); nil != err {
+		t.Fatalf("write ref wal failed: %s", err)
+		return
+	}
+}
+
+func reopenRepo(t *testing.T) (ret *Repo) {
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	ret, err = NewRepo(testDataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	return
+}
+
+func TestReflog(t *testing.T) {
+	clearTestdata(t)
+
+	dataPath := filepath.Join(testDataCheckoutPath, "reflog")
+	if err := os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	var indexes []*entity.Index
+	for _, content := range []string{"v1", "v2"} {
+		if err = os.WriteFile(filepath.Join(dataPath, content+".txt"), []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		index, indexErr := repo.Index(content, true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		indexes = append(indexes, index)
+	}
+
+	reflog, err := repo.Reflog()
+	if nil != err || 2 != len(reflog) {
+		t.Fatalf("reflog should have 2 entries, got [%d]: %v", len(reflog), err)
+		return
+	}
+	if "latest" != reflog[0].Ref || indexes[0].ID != reflog[0].Old || indexes[1].ID != reflog[0].New || RefOpIndex != reflog[0].Op || "" != reflog[1].Old {
+		t.Fatalf("reflog entries not match")
+		return
+	}
+
+	if err = repo.ResetToReflogEntry(1); nil != err {
+		t.Fatalf("reset to reflog entry failed: %s", err)
+		return
+	}
+	if latest, latestErr := repo.Latest(); nil != latestErr || indexes[0].ID != latest.ID {
+		t.Fatalf("latest should be reset: %v", latestErr)
+		return
+	}
+	if reflog, err = repo.Reflog(); nil != err || 3 != len(reflog) || RefOpReset != reflog[0].Op || indexes[1].ID != reflog[0].Old {
+		t.Fatalf("reset should be recorded in reflog: %v", err)
+		return
+	}
+	if err = repo.ResetToReflogEntry(len(reflog)); !errors.Is(err, ErrReflogEntryNotFound) {
+		t.Fatalf("reset to missing reflog entry should fail, got [%v]", err)
+		return
+	}
+}
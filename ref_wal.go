@@ -0,0 +1,122 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+)
+
+const refWALFile = "refs-wal.json" // 引用更新预写日志文件，位于仓库根目录下
+
+// refWAL 描述了一次本地引用更新的预写日志。
+type refWAL struct {
+	Ref  string `json:"ref"`  // 相对 refs 文件夹的引用路径，如 latest、latest-sync、tags/v1
+	ID   string `json:"id"`   // 更新后指向的索引 ID
+	Prev string `json:"prev"` // 更新前指向的索引 ID，为空表示更新前引用不存在
+}
+
+// updateRef 用于将引用 ref 更新为指向索引 id，op 为变更引用的操作，会记录到引用变更日志中。
+//
+// 更新按以下顺序进行，每一步都落盘后再进行下一步：确认索引已经落盘、写入预写日志、写入引用、删除预写日志。
+// 如果在写入引用时崩溃，下次打开仓库时会根据预写日志重做或者回滚，保证引用不会指向不存在的索引。
+func (repo *Repo) updateRef(ref, id, op string) (err error) {
+	if err = repo.store.syncIndex(id); nil != err {
+		return
+	}
+
+	refPath := filepath.Join(repo.Path, "refs", ref)
+	if err = os.MkdirAll(filepath.Dir(refPath), 0755); nil != err {
+		return
+	}
+
+	wal := &refWAL{Ref: ref, ID: id, Prev: readRef(refPath)}
+	data, err := gulu.JSON.MarshalJSON(wal)
+	if nil != err {
+		return
+	}
+	walPath := filepath.Join(repo.Path, refWALFile)
+	if err = gulu.File.WriteFileSafer(walPath, data, 0644); nil != err {
+		return
+	}
+
+	if err = gulu.File.WriteFileSafer(refPath, []byte(id), 0644); nil != err {
+		return
+	}
+	if err = os.Remove(walPath); nil != err {
+		logging.LogErrorf("remove ref wal failed: %s", err)
+		return
+	}
+	repo.appendReflog(ref, wal.Prev, id, op)
+	return
+}
+
+// recoverRefs 用于在打开仓库时根据预写日志完成因崩溃而中断的引用更新。
+//
+// 更新后的索引存在则重做更新，否则回滚为更新前的索引，两者都不存在时保留引用现状。
+func (repo *Repo) recoverRefs() {
+	walPath := filepath.Join(repo.Path, refWALFile)
+	data, err := os.ReadFile(walPath)
+	if nil != err {
+		return
+	}
+
+	wal := &refWAL{}
+	if err = gulu.JSON.UnmarshalJSON(data, wal); nil != err || "" == wal.Ref || !gulu.File.IsValidFilename(filepath.Base(wal.Ref)) || strings.Contains(wal.Ref, "..") {
+		logging.LogErrorf("invalid ref wal [%s], discarded", data)
+		os.Remove(walPath)
+		return
+	}
+
+	refPath := filepath.Join(repo.Path, "refs", wal.Ref)
+	id := wal.ID
+	if _, getErr := repo.store.GetIndex(id); nil != getErr {
+		id = wal.Prev
+		if _, getErr = repo.store.GetIndex(id); "" == id || nil != getErr {
+			logging.LogErrorf("recover ref [%s] failed: neither index [%s] nor [%s] is available", wal.Ref, wal.ID, wal.Prev)
+			os.Remove(walPath)
+			return
+		}
+	}
+
+	if readRef(refPath) != id {
+		logging.LogWarnf("found unfinished ref update, recovering ref [%s] to [%s]", wal.Ref, id)
+		if err = os.MkdirAll(filepath.Dir(refPath), 0755); nil != err {
+			logging.LogErrorf("recover ref [%s] failed: %s", wal.Ref, err)
+			return
+		}
+		if err = gulu.File.WriteFileSafer(refPath, []byte(id), 0644); nil != err {
+			logging.LogErrorf("recover ref [%s] failed: %s", wal.Ref, err)
+			return
+		}
+	}
+	if err = os.Remove(walPath); nil != err {
+		logging.LogErrorf("remove ref wal failed: %s", err)
+	}
+}
+
+func readRef(refPath string) string {
+	data, err := os.ReadFile(refPath)
+	if nil != err {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
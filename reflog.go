@@ -0,0 +1,153 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	reflogFile = "reflog.json" // 引用变更日志文件，位于仓库根目录下
+	reflogMax  = 256           // 引用变更日志最多保留的条数
+)
+
+// 变更引用的操作。
+const (
+	RefOpIndex   = "index"   // 创建快照
+	RefOpSync    = "sync"    // 同步合并
+	RefOpUpload  = "upload"  // 单向上传
+	RefOpMigrate = "migrate" // 迁移仓库
+	RefOpSplit   = "split"   // 拆分仓库
+	RefOpImport  = "import"  // 导入归档
+	RefOpReset   = "reset"   // 通过 ResetToReflogEntry 重置
+	RefOpUpdate  = "update"  // 调用方直接调用 UpdateLatest 或者 UpdateLatestSync
+)
+
+// ErrReflogEntryNotFound 描述了引用变更日志中不存在指定条目的错误。
+var ErrReflogEntryNotFound = errors.New("reflog entry not found")
+
+// ReflogEntry 描述了一次 refs/latest 或者 refs/latest-sync 的变更记录。
+type ReflogEntry struct {
+	Ref  string `json:"ref"`  // 引用：latest 或者 latest-sync
+	Old  string `json:"old"`  // 变更前的索引 ID，为空表示变更前引用不存在
+	New  string `json:"new"`  // 变更后的索引 ID
+	Op   string `json:"op"`   // 变更引用的操作，参考 RefOpIndex 等
+	Time int64  `json:"time"` // 变更时间，毫秒时间戳
+}
+
+// Reflog 用于获取最近的引用变更记录，按时间倒序排列，第 0 条为最近一次变更。
+func (repo *Repo) Reflog() (ret []*ReflogEntry, err error) {
+	repo.reflogLock.Lock()
+	defer repo.reflogLock.Unlock()
+
+	entries, err := repo.readReflog()
+	if nil != err {
+		return
+	}
+
+	ret = []*ReflogEntry{}
+	for i := len(entries) - 1; 0 <= i; i-- {
+		ret = append(ret, entries[i])
+	}
+	return
+}
+
+// ResetToReflogEntry 用于将引用重置为 Reflog 返回的第 n 条记录变更后的索引，比如 n 为 1 时撤销最近一次变更。
+//
+// 只会移动引用，不会修改数据文件夹，需要还原数据时请再调用 Checkout。
+func (repo *Repo) ResetToReflogEntry(n int) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	entries, err := repo.Reflog()
+	if nil != err {
+		return
+	}
+	if 0 > n || len(entries) <= n {
+		err = ErrReflogEntryNotFound
+		return
+	}
+
+	entry := entries[n]
+	index, err := repo.store.GetIndex(entry.New)
+	if nil != err {
+		logging.LogErrorf("get reflog entry [%d] index [%s] failed: %s", n, entry.New, err)
+		return
+	}
+
+	switch entry.Ref {
+	case "latest":
+		err = repo.updateLatest(index, RefOpReset)
+	case "latest-sync":
+		err = repo.updateLatestSync(index, RefOpReset)
+	default:
+		err = ErrReflogEntryNotFound
+	}
+	return
+}
+
+func (repo *Repo) appendReflog(ref, oldID, newID, op string) {
+	if oldID == newID || ("latest" != ref && "latest-sync" != ref) {
+		return
+	}
+
+	repo.reflogLock.Lock()
+	defer repo.reflogLock.Unlock()
+
+	entries, err := repo.readReflog()
+	if nil != err {
+		logging.LogWarnf("read reflog failed, the reflog will be reset: %s", err)
+		entries = nil
+	}
+
+	entries = append(entries, &ReflogEntry{Ref: ref, Old: oldID, New: newID, Op: op, Time: time.Now().UnixMilli()})
+	if reflogMax < len(entries) {
+		entries = entries[len(entries)-reflogMax:]
+	}
+
+	data, err := gulu.JSON.MarshalJSON(entries)
+	if nil != err {
+		logging.LogErrorf("marshal reflog failed: %s", err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, reflogFile), data, 0644); nil != err {
+		logging.LogErrorf("write reflog failed: %s", err)
+	}
+}
+
+func (repo *Repo) readReflog() (ret []*ReflogEntry, err error) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, reflogFile))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = gulu.JSON.UnmarshalJSON(data, &ret)
+	return
+}
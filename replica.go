@@ -0,0 +1,112 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sync"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	replicaWaitGroup = sync.WaitGroup{} // 用于等待后台副本复制结束
+)
+
+// SetReplica 用于设置副本云端存储服务，传入 nil 时关闭副本。
+//
+// 每次同步或上传成功后会在后台将本地最新索引及其数据对象复制到副本，副本维护自己的 refs/latest。
+// 复制是尽力而为的：失败时仅记录日志，不影响同步结果，下次同步成功后会重新补齐副本中缺失的对象。
+// 开启链接迁出时不能设置副本，参考 Repo.SetLinkCheckout。
+func (repo *Repo) SetReplica(replica cloud.Cloud) {
+	if nil != replica && LinkCheckoutNone != repo.linkCheckout {
+		logging.LogErrorf("set replica failed: %s", ErrLinkCheckoutWithCloud)
+		return
+	}
+	if nil != replica {
+		replica.GetConf().RepoPath = repo.Path
+		replica.GetConf().LocalObjectPath = repo.store.ObjectPath
+	}
+	repo.replica = replica
+}
+
+// replicateAsync 用于在后台将本地最新索引复制到副本，上一次复制还未结束时跳过本次复制。
+func (repo *Repo) replicateAsync() {
+	replica := repo.replica
+	if nil == replica {
+		return
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		logging.LogWarnf("get latest for replica failed: %s", err)
+		return
+	}
+
+	replicaWaitGroup.Add(1)
+	go func() {
+		defer replicaWaitGroup.Done()
+
+		if !repo.replicaLock.TryLock() {
+			logging.LogInfof("replica is in progress, skip replicating index [%s]", latest.ID)
+			return
+		}
+		defer repo.replicaLock.Unlock()
+
+		if replicateErr := repo.replicate(replica, latest); nil != replicateErr {
+			logging.LogWarnf("replicate index [%s] failed: %s", latest.ID, replicateErr)
+		}
+	}()
+}
+
+// replicate 用于将索引 latest 及其数据对象复制到副本 replica，所有对象都复制成功后才更新副本的 refs/latest。
+func (repo *Repo) replicate(replica cloud.Cloud, latest *entity.Index) (err error) {
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+
+	objectIDs := append([]string{}, latest.Files...)
+	objectIDs = append(objectIDs, repo.getChunks(files)...)
+	missingIDs, err := replica.GetChunks(objectIDs)
+	if nil != err {
+		return
+	}
+
+	// 按需迁出的占位文件等本地不存在的分块无法复制，此时不更新副本的 refs/latest
+	localMissingIDs, err := repo.localNotFoundChunks(missingIDs)
+	if nil != err {
+		return
+	}
+	if 0 < len(localMissingIDs) {
+		err = ErrNotFoundObject
+		return
+	}
+
+	if _, err = repo.uploadChunksTo(replica, missingIDs, map[string]interface{}{}); nil != err {
+		return
+	}
+	if _, err = repo.uploadIndexTo(replica, latest); nil != err {
+		return
+	}
+	if _, err = replica.UploadBytes("refs/latest", []byte(latest.ID), true); nil != err {
+		return
+	}
+	logging.LogInfof("replicated index [%s], uploaded objects [%d]", latest.ID, len(missingIDs))
+	return
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -32,9 +33,9 @@ import (
 	"time"
 
 	"github.com/88250/gulu"
+	"github.com/dgraph-io/ristretto"
 	"github.com/panjf2000/ants/v2"
 	"github.com/restic/chunker"
-	ignore "github.com/sabhiram/go-gitignore"
 	"github.com/siyuan-note/dejavu/cloud"
 	"github.com/siyuan-note/dejavu/entity"
 	"github.com/siyuan-note/dejavu/util"
@@ -54,15 +55,115 @@ type Repo struct {
 	DeviceOS    string   // 操作系统
 	IgnoreLines []string // 忽略配置文件内容行，是用 .gitignore 语法
 
-	store    *Store      // 仓库的存储
-	chunkPol chunker.Pol // 文件分块多项式值
-	cloud    cloud.Cloud // 云端存储服务
+	SyncOptions SyncOptions // 按文件大小和类型过滤数据文件的选项
+	SoftLimits  SoftLimits  // 索引时的软限制，超过时在索引和同步结果中返回警告
+
+	store    *Store         // 仓库的存储
+	chunkPol chunker.Pol    // 文件分块多项式值
+	cloud    cloud.Cloud    // 云端存储服务
+	offload  *OffloadPolicy // 大文件分块转存策略
+	lazy     *LazyPolicy    // 云端文件按需迁出策略
+	replica  cloud.Cloud    // 副本云端存储服务
+
+	xattrs           bool              // 是否记录和还原数据文件的扩展属性
+	preMergeSnapshot bool              // 同步变更数据文件夹前是否创建安全快照
+	pathEscaping     PathEscaping      // 迁出文件时本地路径的转义方案
+	pathEscapes      map[string]string // 转义后的本地路径与原始文件路径的对照，按需加载
+	metadataPrivacy  bool              // 是否开启元数据隐私模式
+	plainCloudDir    string            // 开启元数据隐私模式前的云端仓库名称
+
+	tuners         *sync.Map       // 云端存储服务上传下载的并发调节器
+	syncPause      *syncPauseState // 同步的暂停状态
+	uploadPriority UploadPriority  // 上传文件的优先级，为 nil 时使用 DefaultUploadPriority
+	roots          []*Root         // 数据文件夹以外的额外根目录
+	linkCheckout   LinkCheckout    // 迁出文件时从数据对象链接的方式
+	faults         *faultState     // 同步流程的故障注入，仅用于测试
+	trashRetention time.Duration   // 回收站的保留时长，大于 0 时同步删除的文件会移动到回收站
+
+	renameLockedRemoves bool            // 删除被占用的数据文件失败时是否先重命名再删除
+	stat                *statCache      // 统计信息缓存
+	listing             *cloudListing   // 云端列举结果缓存
+	rangePartSize       int64           // 分段下载的段大小，为 0 时不分段下载
+	prefetch            *PrefetchPolicy // 占位文件分块预取策略，为 nil 时不预取
+	historySink         HistorySink     // 同步冲突历史的写入目标，为 nil 时写入 HistoryPath
+	checkoutConcurrency int             // 并发迁出文件的协程数，为 0 时使用默认值
+	authorID            string          // 创建快照的作者 ID
+	authorName          string          // 创建快照的作者名称
+	lockFreeSync        bool            // 是否开启无锁同步
+	syncQueue           *syncQueue      // 离线同步队列
+	networkPolicy       NetworkPolicy   // 传输分块前的网络策略，为 nil 时不限制
+	options             *RepoOptions    // 仓库策略选项
+	rateLimiter         *RateLimiter    // 云端传输限速器，为 nil 时不限速，可以在多个仓库之间共享
+	syncNotifier        SyncNotifier    // 同步成功后的通知接收方，为 nil 时不通知
+	dataFS              DataFS          // 访问数据文件夹使用的文件系统
+	tempManager         *TempManager    // 同步临时文件夹管理器
+	immutableRetention  time.Duration   // 快照的不可变保留时长，大于 0 时开启不可变模式
+
+	lock             *sync.Mutex // 仓库锁，同一仓库的 Checkout、Index 和 Sync 等不能同时执行，不同仓库之间互不影响，同一仓库路径的多个实例共享
+	endRefreshLock   chan bool   // 用于结束定时刷新云端锁
+	conflictsLock    *sync.Mutex // 冲突列表读写锁
+	placeholdersLock *sync.Mutex // 占位文件列表读写锁
+	pathEscapesLock  *sync.Mutex // 路径转义对照表读写锁
+	syncJournalLock  *sync.Mutex // 同步日志读写锁
+	reflogLock       *sync.Mutex // 引用变更日志读写锁
+	prefetchLock     *sync.Mutex // 同一时间只进行一次预取
+	replicaLock      *sync.Mutex // 同一时间只进行一次副本复制
+}
+
+// repoLocks 描述了同一仓库路径的所有 Repo 实例共享的锁。
+//
+// 调用方可能为每次操作创建新的 Repo 实例，所以仓库锁和仓库文件的读写锁不能属于实例，否则同一仓库的 Checkout 和 Sync 等可能同时执行。
+type repoLocks struct {
+	lock             *sync.Mutex
+	conflictsLock    *sync.Mutex
+	placeholdersLock *sync.Mutex
+	pathEscapesLock  *sync.Mutex
+	syncJournalLock  *sync.Mutex
+	reflogLock       *sync.Mutex
+	prefetchLock     *sync.Mutex
+	replicaLock      *sync.Mutex
+}
+
+var (
+	allRepoLocks     = map[string]*repoLocks{} // 仓库绝对路径到共享锁的映射
+	allRepoLocksLock = sync.Mutex{}
+)
+
+// getRepoLocks 用于获取位于 repoPath 的仓库共享的锁，不存在时创建。
+func getRepoLocks(repoPath string) (ret *repoLocks) {
+	key := filepath.Clean(repoPath)
+	if abs, err := filepath.Abs(key); nil == err {
+		key = abs
+	}
+
+	allRepoLocksLock.Lock()
+	defer allRepoLocksLock.Unlock()
+	ret = allRepoLocks[key]
+	if nil == ret {
+		ret = &repoLocks{
+			lock:             &sync.Mutex{},
+			conflictsLock:    &sync.Mutex{},
+			placeholdersLock: &sync.Mutex{},
+			pathEscapesLock:  &sync.Mutex{},
+			syncJournalLock:  &sync.Mutex{},
+			reflogLock:       &sync.Mutex{},
+			prefetchLock:     &sync.Mutex{},
+			replicaLock:      &sync.Mutex{},
+		}
+		allRepoLocks[key] = ret
+	}
+	return
 }
 
 // NewRepo 创建一个新的仓库。
 func NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS string, aesKey []byte, ignoreLines []string, cloud cloud.Cloud) (ret *Repo, err error) {
+	return newRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines, cloud, false)
+}
+
+func newRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS string, aesKey []byte, ignoreLines []string, cloud cloud.Cloud, readOnly bool) (ret *Repo, err error) {
 	if nil != cloud {
 		cloud.GetConf().RepoPath = repoPath
+		cloud.GetConf().DeviceID = deviceID
 	}
 	ret = &Repo{
 		DataPath:    filepath.Clean(dataPath),
@@ -74,6 +175,24 @@ func NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, de
 		DeviceOS:    deviceOS,
 		cloud:       cloud,
 		chunkPol:    chunker.Pol(0x3DA3358B4DC173), // 固定分块多项式值
+		tuners:      &sync.Map{},
+		syncPause:   newSyncPauseState(),
+		SoftLimits:  DefaultSoftLimits,
+		stat:        &statCache{},
+		listing:     &cloudListing{},
+		syncQueue:   &syncQueue{},
+		options:     DefaultRepoOptions(),
+		dataFS:      &osDataFS{},
+		tempManager: getTempManager(filepath.Join(filepath.Clean(tempPath), "repo", "sync")),
+
+		endRefreshLock: make(chan bool),
+	}
+	locks := getRepoLocks(repoPath)
+	ret.lock, ret.conflictsLock, ret.placeholdersLock = locks.lock, locks.conflictsLock, locks.placeholdersLock
+	ret.pathEscapesLock, ret.syncJournalLock, ret.reflogLock = locks.pathEscapesLock, locks.syncJournalLock, locks.reflogLock
+	ret.prefetchLock, ret.replicaLock = locks.prefetchLock, locks.replicaLock
+	if "windows" == runtime.GOOS {
+		ret.pathEscaping = PathEscapingWindows
 	}
 	if !strings.HasSuffix(ret.DataPath, string(os.PathSeparator)) {
 		ret.DataPath += string(os.PathSeparator)
@@ -86,7 +205,20 @@ func NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, de
 	}
 	ignoreLines = gulu.Str.RemoveDuplicatedElem(ignoreLines)
 	ret.IgnoreLines = ignoreLines
-	ret.store, err = NewStore(ret.Path, aesKey)
+	ret.store, err = newStore(ret.Path, aesKey, readOnly, &osFS{})
+	if nil != err {
+		return
+	}
+	if !readOnly {
+		ret.recoverRefs()
+		ret.recoverCheckout()
+		if "" != tempPath {
+			ret.tempManager.Clean() // 清理上次同步中断遗留的临时文件夹
+		}
+	}
+	if nil != cloud {
+		cloud.GetConf().LocalObjectPath = ret.store.ObjectPath
+	}
 	return
 }
 
@@ -98,8 +230,6 @@ var (
 	ErrIndexFileChanged = errors.New("file changed")
 )
 
-var lock = sync.Mutex{} // 仓库锁，Checkout、Index 和 Sync 等不能同时执行
-
 func (repo *Repo) CountIndexes() (ret int, err error) {
 	dir := filepath.Join(repo.Path, "indexes")
 	files, err := os.ReadDir(dir)
@@ -121,14 +251,22 @@ func (repo *Repo) CountIndexes() (ret int, err error) {
 	return
 }
 
-// Reset 重置仓库，清空所有数据。
+// Reset 重置仓库，清空所有数据。开启不可变模式时返回 ErrImmutable。
 func (repo *Repo) Reset() (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+	if err = repo.checkImmutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	if err = os.RemoveAll(repo.Path); nil != err {
 		return
 	}
+	clearCache()
 	if err = os.MkdirAll(repo.Path, 0755); nil != err {
 		return
 	}
@@ -136,17 +274,113 @@ func (repo *Repo) Reset() (err error) {
 }
 
 // Purge 清理所有未引用数据，retentionIndexIDs 为保留的索引 ID 列表，如果不传入的话则清理所有未引用数据。
+//
+// 开启不可变模式时总是保留创建时间在保留期内的索引。
 func (repo *Repo) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
-	return repo.store.Purge(retentionIndexIDs...)
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	retainedIDs, err := repo.retainedIndexIDs()
+	if nil != err {
+		return
+	}
+	retentionIndexIDs = append(retentionIndexIDs, retainedIDs...)
+	ret, err = repo.store.Purge(retentionIndexIDs...)
+	if nil == err {
+		repo.purgeAnnotations()
+		if _, compactErr := repo.store.compactIndexLog(); nil != compactErr {
+			logging.LogWarnf("compact index log failed: %s", compactErr)
+		}
+	}
+	return
+}
+
+// SetAuthor 设置创建快照的作者 ID 和名称，多人通过 S3 等存储服务共享仓库时用于区分每个快照由谁创建、冲突由谁的修改产生。
+//
+// 作者信息记录在之后创建的索引中，开启元数据隐私模式时和系统信息一起加密上传。
+func (repo *Repo) SetAuthor(id, name string) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	repo.authorID, repo.authorName = id, name
+}
+
+// SetObjectFormat 设置写入索引和文件对象时使用的编码格式，读取时总是会自动识别格式。
+//
+// 旧版本客户端和思源官方云端服务只能解析 entity.FormatJSON 格式，所以只有在所有设备都已经升级并且使用第三方存储服务时才应该切换为 entity.FormatBinary。
+func (repo *Repo) SetObjectFormat(format int) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	repo.store.Format = format
+}
+
+// MigrateObjectFormat 将本地仓库中的索引和文件对象重写为 format 格式，后续写入也使用该格式。
+func (repo *Repo) MigrateObjectFormat(format int) (indexes, files int, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if entity.FormatJSON != format && entity.FormatBinary != format {
+		err = entity.ErrUnknownFormat
+		return
+	}
+
+	indexes, files, err = repo.store.Migrate(format)
+	return
+}
+
+// SetObjectEncryption 设置写入文件和分块对象时使用的加密方式，读取时总是会自动识别加密方式。
+//
+// 旧版本客户端只能解密 EncryptionLegacy 方式加密的对象，所以只有在所有设备都已经升级后才应该切换为 EncryptionAEAD。设置会保存在仓库中，重新打开仓库后仍然生效。
+func (repo *Repo) SetObjectEncryption(version int) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	repo.store.Encryption = version
+	if repo.store.readOnly {
+		return
+	}
+	if err := repo.store.saveEncryption(); nil != err {
+		logging.LogErrorf("save encryption failed: %s", err)
+	}
+}
+
+// MigrateObjectEncryption 将本地仓库中的文件和分块对象重新加密为 version 方式，后续写入也使用该方式。
+//
+// 云端已经存在的对象不会被重新上传，读取时会自动识别加密方式。
+func (repo *Repo) MigrateObjectEncryption(version int) (objects int, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if EncryptionLegacy != version && EncryptionAEAD != version {
+		err = ErrUnknownEncryption
+		return
+	}
+
+	objects, err = repo.store.MigrateEncryption(version)
+	return
 }
 
 // PurgeCloud 清理云端所有未引用数据。
 // Support manual purge of unreferenced data snapshots in the S3/WebDAV cloud storage https://github.com/siyuan-note/siyuan/issues/10081
+//
+// 开启不可变模式时保留创建时间在保留期内的索引，并且只清理待清理索引引用的数据对象。
 func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	lockCtx := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
 	err = repo.tryLockCloud("purge", lockCtx)
@@ -154,6 +388,9 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		return
 	}
 	defer repo.unlockCloud(lockCtx)
+	if err = repo.waitLockFreeSyncs(); nil != err {
+		return
+	}
 
 	logging.LogInfof("purging cloud...")
 	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBarAndProgress}
@@ -185,7 +422,7 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	}
 
 	eventbus.Publish(eventbus.EvtCloudPurgeListRefs, context)
-	refs, listErr := repo.cloud.ListObjects("refs/")
+	refs, listErr := repo.listCloudObjects("refs/")
 	if nil != listErr {
 		logging.LogErrorf("list refs failed: %s", listErr)
 		err = listErr
@@ -212,6 +449,15 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		}
 	}
 
+	var purgedObjIDs map[string]bool
+	if 0 < repo.immutableRetention {
+		// 不可变模式下保留期内的索引视为引用索引
+		repo.retainCloudIndexes(unreferencedIndexIDs, refIndexIDs)
+		if purgedObjIDs, err = repo.purgedCloudObjects(unreferencedIndexIDs); nil != err {
+			return
+		}
+	}
+
 	eventbus.Publish(eventbus.EvtCloudPurgeDownloadIndexes, context)
 	referencedFileIDs := map[string]bool{}
 	referencedObjIDs := map[string]bool{}
@@ -257,9 +503,13 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 
 	unreferencedIDs := map[string]bool{}
 	for objID := range objIDs {
-		if !referencedObjIDs[objID] {
-			unreferencedIDs[objID] = true
+		if referencedObjIDs[objID] {
+			continue
 		}
+		if nil != purgedObjIDs && !purgedObjIDs[objID] {
+			continue
+		}
+		unreferencedIDs[objID] = true
 	}
 
 	ret = &entity.PurgeStat{}
@@ -331,12 +581,18 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		return
 	}
 
+	// 转存到次级云端存储服务的分块同样需要清理
+	if err = repo.purgeOffloadObjects(referencedObjIDs, purgedObjIDs, ret); nil != err {
+		logging.LogErrorf("purge offloaded objects failed: %s", err)
+		return
+	}
+
 	logging.LogInfof("purged cloud, [%d] indexes, [%d] objects, [%d] bytes", ret.Indexes, ret.Objects, ret.Size)
 	return
 }
 
 func (repo *Repo) purgeIndexesV2(refIndexIDs map[string]bool) (err error) {
-	data, err := repo.cloud.DownloadObject("indexes-v2.json")
+	data, err := repo.downloadCloudData("indexes-v2.json")
 	if nil != err {
 		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
 			return
@@ -381,38 +637,46 @@ func (repo *Repo) purgeIndexesV2(refIndexIDs map[string]bool) (err error) {
 
 // GetIndex 从仓库根据 id 获取索引。
 func (repo *Repo) GetIndex(id string) (index *entity.Index, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 	return repo.store.GetIndex(id)
 }
 
 // PutIndex 将索引 index 写入仓库。
 func (repo *Repo) PutIndex(index *entity.Index) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 	return repo.store.PutIndex(index)
 }
 
 var workspaceDataDirs = []string{"assets", "emojis", "snippets", "storage", "templates", "widgets", "plugins", "public", "snippets"}
-var removeEmptyDirExcludes = append(workspaceDataDirs, ".git")
 
 // Checkout 将仓库中的数据迁出到 repo 数据文件夹下。context 参数用于发布事件时传递调用上下文。
 func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts, removes []*entity.File, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	index, err := repo.store.GetIndex(id)
 	if nil != err {
 		return
 	}
 
-	if err = os.MkdirAll(repo.DataPath, 0755); nil != err {
+	if err = repo.dataFS.MkdirAll(repo.DataPath, 0755); nil != err {
 		return
 	}
 	var files []*entity.File
+	excluded := map[string]bool{}
 	ignoreMatcher := repo.ignoreMatcher()
 	eventbus.Publish(eventbus.EvtCheckoutBeforeWalkData, context, repo.DataPath)
-	err = filelock.Walk(repo.DataPath, func(path string, d fs.DirEntry, err error) error {
+	err = repo.walkData(func(path string, d fs.DirEntry, err error) error {
 		if nil != err {
 			logging.LogErrorf("walk data failed: %s", err)
 			return err
@@ -423,6 +687,11 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 			logging.LogErrorf("walk data failed: %s", err)
 			return err
 		}
+		if info.IsDir() {
+			if skipErr := ignoreMatcher.enterDir(path, repo.relPath(path)); nil != skipErr {
+				return skipErr
+			}
+		}
 		if ignored, ignoreResult := repo.builtInIgnore(info, path); ignored || nil != ignoreResult {
 			return ignoreResult
 		}
@@ -431,8 +700,17 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 		if ignoreMatcher.MatchesPath(p) {
 			return nil
 		}
+		if repo.SyncOptions.Excluded(p, info.Size()) {
+			excluded[p] = true
+			return nil
+		}
 
-		files = append(files, entity.NewFile(p, info.Size(), info.ModTime().UnixMilli()))
+		file, err := newFile(path, p, info)
+		if nil != err {
+			logging.LogErrorf("walk data failed: %s", err)
+			return err
+		}
+		files = append(files, file)
 		eventbus.Publish(eventbus.EvtCheckoutWalkData, context, p)
 		return nil
 	})
@@ -440,19 +718,35 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 		return
 	}
 
-	defer gulu.File.RemoveEmptyDirs(repo.DataPath, removeEmptyDirExcludes...)
+	defer repo.removeEmptyDataDirs()
 
 	latestFiles, err := repo.getFiles(index.Files)
 	if nil != err {
 		return
 	}
+	inheritModes(files, latestFiles)
 
 	upserts, removes = repo.diffUpsertRemove(latestFiles, files, false)
+	if 0 < len(excluded) {
+		// 被过滤的数据文件不受迁出影响，参考 keptExcludedFiles
+		var kept []*entity.File
+		for _, upsert := range upserts {
+			if !excluded[upsert.Path] {
+				kept = append(kept, upsert)
+			}
+		}
+		upserts = kept
+	}
 	if 1 > len(upserts) && 1 > len(removes) {
 		return
 	}
 
+	// 被其他进程占用的文件跳过，最后统一报告
+	lockedErr := &LockedFilesError{}
 	err = repo.checkoutFiles(upserts, context)
+	if errors.As(err, &lockedErr) {
+		err = nil
+	}
 	if nil != err {
 		return
 	}
@@ -461,18 +755,31 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 	eventbus.Publish(eventbus.EvtCheckoutRemoveFiles, context, total)
 	for i, f := range removes {
 		absPath := repo.absPath(f.Path)
-		if err = filelock.Remove(absPath); nil != err {
-			return
+		if err = repo.removeDataFile(absPath); nil != err {
+			if !isFileLockedErr(err) {
+				return
+			}
+			lockedErr.Paths, lockedErr.Err, err = append(lockedErr.Paths, f.Path), err, nil
+			continue
 		}
+		repo.forgetEscapedPath(f.Path)
 		eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, i+1, total)
 	}
+	if 0 < len(lockedErr.Paths) {
+		logging.LogErrorf("checkout [%s] failed: %s", id, lockedErr)
+		err = lockedErr
+	}
 	return
 }
 
 // Index 将 repo 数据文件夹中的文件索引到仓库中。context 参数用于发布事件时传递调用上下文。
 func (repo *Repo) Index(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	ret, err = repo.index(memo, checkChunks, context)
 	return
@@ -495,66 +802,31 @@ func (repo *Repo) OpenFile(file *entity.File) (ret []byte, err error) {
 }
 
 func (repo *Repo) GetIndexes(page, pageSize int) (ret []*entity.Index, totalCount, pageCount int, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
-	dir := filepath.Join(repo.Path, "indexes")
-	entries, err := os.ReadDir(dir)
+	entries, err := repo.store.readIndexLog()
 	if nil != err {
-		logging.LogErrorf("read dir [%s] failed: %s", dir, err)
 		return
 	}
-
-	sort.Slice(entries, func(i, j int) bool {
-		infoI, _ := entries[i].Info()
-		infoJ, _ := entries[j].Info()
-		if nil == infoI || nil == infoJ {
-			return false
-		}
-		return infoI.ModTime().After(infoJ.ModTime())
-	})
-
-	i := 0
-	for _, entry := range entries {
-		name := entry.Name()
-		if 40 == len(name) {
-			entries[i] = entry
-			i++
-		}
-	}
-	for j := i; j < len(entries); j++ {
-		entries[j] = nil
-	}
-	entries = entries[:i]
-	totalCount = i
+	totalCount = len(entries)
 	pageCount = int(math.Ceil(float64(totalCount) / float64(pageSize)))
 
-	start := (page - 1) * pageSize
-	end := page * pageSize
-
-	if start > totalCount {
-		start = totalCount
-	}
-	if end > totalCount {
-		end = totalCount
-	}
-
-	for _, entry := range entries[start:end] {
-		index, getErr := repo.store.GetIndex(entry.Name())
-		if nil != getErr {
-			err = getErr
-			return
-		}
-
-		ret = append(ret, index)
-	}
+	start := min(max((page-1)*pageSize, 0), totalCount)
+	end := min(max(page*pageSize, 0), totalCount)
+	ret, err = repo.store.getLoggedIndexes(entries[start:end])
 	return
 }
 
 func (repo *Repo) removeCloudObjects(objects []string) (err error) {
+	return removeCloudObjectsFrom(repo.cloud, objects)
+}
+
+// removeCloudObjectsFrom 用于并发删除云端存储服务 target 中的对象 objects。
+func removeCloudObjectsFrom(target cloud.Cloud, objects []string) (err error) {
 	waitGroup := &sync.WaitGroup{}
 	var removeErr error
-	poolSize := repo.cloud.GetConcurrentReqs()
+	poolSize := target.GetConcurrentReqs()
 	if poolSize > len(objects) {
 		poolSize = len(objects)
 	}
@@ -566,7 +838,7 @@ func (repo *Repo) removeCloudObjects(objects []string) (err error) {
 		}
 
 		fileID := arg.(string)
-		rmErr := repo.cloud.RemoveObject(fileID)
+		rmErr := target.RemoveObject(fileID)
 		if nil != rmErr {
 			removeErr = rmErr
 			return
@@ -597,8 +869,20 @@ func (repo *Repo) removeCloudObjects(objects []string) (err error) {
 }
 
 func (repo *Repo) index(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
+	return repo.indexWith(memo, checkChunks, true, context)
+}
+
+// indexWith 用于索引数据文件夹，updateLatest 为 false 时创建的索引不会成为本地最新索引。
+func (repo *Repo) indexWith(memo string, checkChunks, updateLatest bool, context map[string]interface{}) (ret *entity.Index, err error) {
+	return retryIndex(func() (*entity.Index, error) {
+		return repo.index0(memo, checkChunks, updateLatest, context)
+	})
+}
+
+// retryIndex 用于执行创建索引的函数 index，索引过程中文件发生变化时重试。
+func retryIndex(index func() (*entity.Index, error)) (ret *entity.Index, err error) {
 	for i := 0; i < 7; i++ {
-		ret, err = repo.index0(memo, checkChunks, context)
+		ret, err = index()
 		if nil == err {
 			return
 		}
@@ -614,45 +898,46 @@ func (repo *Repo) index(memo string, checkChunks bool, context map[string]interf
 	return
 }
 
-func (repo *Repo) index0(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
+func (repo *Repo) index0(memo string, checkChunks, updateLatest bool, context map[string]interface{}) (ret *entity.Index, err error) {
 	var files []*entity.File
-	ignoreMatcher := repo.ignoreMatcher()
+	excluded := map[string]bool{}
 	eventbus.Publish(eventbus.EvtIndexBeforeWalkData, context, repo.DataPath)
 	start := time.Now()
-	err = filelock.Walk(repo.DataPath, func(path string, d fs.DirEntry, err error) error {
-		if nil != err {
-			if isNoSuchFileOrDirErr(err) {
-				// An error `Failed to create data snapshot` is occasionally reported during automatic data sync https://github.com/siyuan-note/siyuan/issues/8998
-				logging.LogInfof("ignore not exist err [%s]", err)
-				return nil
-			}
-			logging.LogErrorf("walk data failed: %s", err)
-			return err
-		}
-
-		info, err := d.Info()
-		if nil != err {
-			logging.LogErrorf("walk data failed: %s", err)
-			return err
-		}
-		if ignored, ignoreErr := repo.builtInIgnore(info, path); ignored || nil != ignoreErr {
-			return ignoreErr
-		}
+	err = repo.walkData(repo.indexWalkFunc(repo.ignoreMatcher(), &files, excluded, context))
+	if nil != err {
+		logging.LogErrorf("walk data failed: %s", err)
+		return
+	}
+	logging.LogInfof("walk data [files=%d] cost [%s]", len(files), time.Since(start))
 
-		p := repo.relPath(path)
-		if ignoreMatcher.MatchesPath(p) {
-			return nil
+	if 0 < len(excluded) {
+		var kept []*entity.File
+		if kept, err = repo.keptExcludedFiles(excluded); nil != err {
+			return
 		}
+		files = append(files, kept...)
+	}
 
-		files = append(files, entity.NewFile(p, info.Size(), info.ModTime().UnixMilli()))
-		eventbus.Publish(eventbus.EvtIndexWalkData, context, p)
-		return nil
-	})
+	placeholders, err := repo.placeholderFiles(files)
 	if nil != err {
-		logging.LogErrorf("walk data failed: %s", err)
+		logging.LogErrorf("get placeholder files failed: %s", err)
 		return
 	}
-	logging.LogInfof("walk data [files=%d] cost [%s]", len(files), time.Since(start))
+	placeholderIDs := map[string]bool{}
+	for _, placeholder := range placeholders {
+		placeholderIDs[placeholder.ID] = true
+	}
+	files = append(files, placeholders...)
+	if warnings := repo.softLimitWarnings(files); 0 < len(warnings) {
+		defer func() {
+			if nil == err && nil != ret {
+				// 返回的索引可能是缓存中的最新索引，复制后再设置警告
+				warned := *ret
+				warned.Warnings = warnings
+				ret = &warned
+			}
+		}()
+	}
 	//sort.Slice(files, func(i, j int) bool { return files[i].Updated > files[j].Updated })
 	//for _, f := range files {
 	//	logging.LogInfof("walked data [file=%s]", f.Path)
@@ -673,14 +958,7 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		}
 
 		// 如果没有索引，则创建第一个索引
-		latest = &entity.Index{
-			ID:         util.RandHash(),
-			Memo:       memo,
-			Created:    time.Now().UnixMilli(),
-			SystemID:   repo.DeviceID,
-			SystemName: repo.DeviceName,
-			SystemOS:   repo.DeviceOS,
-		}
+		latest = repo.newIndex(memo)
 		init = true
 	}
 
@@ -706,6 +984,11 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 
 				fileID := arg.(string)
 				file, getErr := repo.store.GetFile(fileID)
+				if errors.Is(getErr, ErrLocalCorrupt) {
+					// 损坏的文件对象已经被隔离，跳过后该文件会作为新文件重新索引
+					logging.LogWarnf("skip corrupted file [%s]: %s", fileID, getErr)
+					return
+				}
 				if nil != getErr {
 					logging.LogErrorf("get file [%s] failed: %s", fileID, getErr)
 					workerErrLock.Lock()
@@ -718,7 +1001,7 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 				latestFiles = append(latestFiles, file)
 				lock.Unlock()
 
-				if checkChunks { // 仅在非移动端校验，因为移动端私有数据空间不会存在外部操作导致分块损坏的情况 https://github.com/siyuan-note/siyuan/issues/13216
+				if checkChunks && !placeholderIDs[file.ID] { // 仅在非移动端校验，因为移动端私有数据空间不会存在外部操作导致分块损坏的情况 https://github.com/siyuan-note/siyuan/issues/13216
 					// Check local data chunk integrity before data synchronization https://github.com/siyuan-note/siyuan/issues/8853
 					for _, chunk := range file.Chunks {
 						info, statErr := repo.store.Stat(chunk)
@@ -774,6 +1057,7 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		}
 	}
 
+	inheritModes(files, latestFiles)
 	upserts, removes = repo.diffUpsertRemove(files, latestFiles, false)
 	if 1 > len(upserts) && 1 > len(removes) {
 		ret = latest
@@ -783,16 +1067,52 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 	if init {
 		ret = latest
 	} else {
-		ret = &entity.Index{
-			ID:         util.RandHash(),
-			Memo:       memo,
-			Created:    time.Now().UnixMilli(),
-			SystemID:   repo.DeviceID,
-			SystemName: repo.DeviceName,
-			SystemOS:   repo.DeviceOS,
-		}
+		ret = repo.newIndex(memo)
 	}
 
+	if err = repo.putUpsertFiles(upserts, placeholderIDs, context); nil != err {
+		return
+	}
+
+	for _, file := range files {
+		ret.Files = append(ret.Files, file.ID)
+		ret.Size += file.Size
+	}
+	ret.Count = len(ret.Files)
+
+	err = repo.store.PutIndex(ret)
+	if nil != err {
+		logging.LogErrorf("put index failed: %s", err)
+		return
+	}
+
+	if !updateLatest {
+		return
+	}
+	err = repo.updateLatest(ret, RefOpIndex)
+	if nil != err {
+		logging.LogErrorf("update latest failed: %s", err)
+		return
+	}
+	return
+}
+
+// newIndex 用于创建一个当前设备和作者的新索引。
+func (repo *Repo) newIndex(memo string) *entity.Index {
+	return &entity.Index{
+		ID:         util.RandHash(),
+		Memo:       memo,
+		Created:    time.Now().UnixMilli(),
+		SystemID:   repo.DeviceID,
+		SystemName: repo.DeviceName,
+		SystemOS:   repo.DeviceOS,
+		AuthorID:   repo.authorID,
+		AuthorName: repo.authorName,
+	}
+}
+
+// putUpsertFiles 用于并发读取新增和修改的文件 upserts 并写入文件和分块对象，placeholderIDs 中的占位文件会被跳过。
+func (repo *Repo) putUpsertFiles(upserts []*entity.File, placeholderIDs map[string]bool, context map[string]interface{}) (err error) {
 	count := atomic.Int32{}
 	total := len(upserts)
 	var workerErrs []error
@@ -804,6 +1124,10 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 
 		count.Add(1)
 		file := arg.(*entity.File)
+		if placeholderIDs[file.ID] { // 占位文件的分块已经在仓库中记录，不需要从数据文件夹读取
+			return
+		}
+
 		putErr := repo.putFileChunks(file, context, int(count.Load()), total)
 		if nil != putErr {
 			workerErrLock.Lock()
@@ -844,25 +1168,54 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		logging.LogErrorf("put file chunks failed: %s", err)
 		return
 	}
+	return
+}
 
-	for _, file := range files {
-		ret.Files = append(ret.Files, file.ID)
-		ret.Size += file.Size
-	}
-	ret.Count = len(ret.Files)
+// indexWalkFunc 用于创建索引时遍历数据文件的回调函数，未被忽略和过滤的文件会追加到 files 中，被过滤的文件路径记录到 excluded 中。
+func (repo *Repo) indexWalkFunc(ignoreMatcher *ignoreMatcher, files *[]*entity.File, excluded map[string]bool, context map[string]interface{}) fs.WalkDirFunc {
+	return func(path string, d fs.DirEntry, err error) error {
+		if nil != err {
+			if isNoSuchFileOrDirErr(err) {
+				// An error `Failed to create data snapshot` is occasionally reported during automatic data sync https://github.com/siyuan-note/siyuan/issues/8998
+				logging.LogInfof("ignore not exist err [%s]", err)
+				return nil
+			}
+			logging.LogErrorf("walk data failed: %s", err)
+			return err
+		}
 
-	err = repo.store.PutIndex(ret)
-	if nil != err {
-		logging.LogErrorf("put index failed: %s", err)
-		return
-	}
+		info, err := d.Info()
+		if nil != err {
+			logging.LogErrorf("walk data failed: %s", err)
+			return err
+		}
+		if info.IsDir() {
+			if skipErr := ignoreMatcher.enterDir(path, repo.relPath(path)); nil != skipErr {
+				return skipErr
+			}
+		}
+		if ignored, ignoreErr := repo.builtInIgnore(info, path); ignored || nil != ignoreErr {
+			return ignoreErr
+		}
 
-	err = repo.UpdateLatest(ret)
-	if nil != err {
-		logging.LogErrorf("update latest failed: %s", err)
-		return
+		p := repo.relPath(path)
+		if ignoreMatcher.MatchesPath(p) {
+			return nil
+		}
+		if repo.SyncOptions.Excluded(p, info.Size()) {
+			excluded[p] = true
+			return nil
+		}
+
+		file, err := newFile(path, p, info)
+		if nil != err {
+			logging.LogErrorf("walk data failed: %s", err)
+			return err
+		}
+		*files = append(*files, file)
+		eventbus.Publish(eventbus.EvtIndexWalkData, context, p)
+		return nil
 	}
-	return
 }
 
 func (repo *Repo) builtInIgnore(info os.FileInfo, absPath string) (ignored bool, err error) {
@@ -880,7 +1233,12 @@ func (repo *Repo) builtInIgnore(info os.FileInfo, absPath string) (ignored bool,
 		}
 		return true, nil
 	} else {
-		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") {
+		if strings.HasPrefix(name, ".") || repo.options.isTmpFile(name) {
+			return true, nil
+		}
+		if strings.HasSuffix(name, lockedRemoveSuffix) {
+			// 之前因为被占用而先重命名的待删除文件，再次尝试删除
+			repo.dataFS.Remove(absPath)
 			return true, nil
 		}
 
@@ -895,35 +1253,118 @@ func (repo *Repo) builtInIgnore(info os.FileInfo, absPath string) (ignored bool,
 		}
 	}
 
-	if gulu.File.IsHidden(absPath) {
+	if repo.localData() && gulu.File.IsHidden(absPath) {
 		return true, nil
 	}
 
-	if !info.Mode().IsRegular() {
+	if !info.Mode().IsRegular() && 0 == info.Mode()&os.ModeSymlink {
 		return true, nil
 	}
 	return false, nil
 }
 
-func (repo *Repo) ignoreMatcher() *ignore.GitIgnore {
-	return ignore.CompileIgnoreLines(repo.IgnoreLines...)
+// SyncOptions 描述了按文件大小和类型过滤数据文件的选项，被过滤的文件不会被索引，所以也不会被同步。
+//
+// 已经同步过的文件被过滤后（比如变大超过上限）继续沿用最新索引中的文件对象，不会被视为删除，迁出时也不会覆盖这些文件。
+// 和忽略规则一样，多个设备应该使用相同的选项，否则被过滤的文件的变更只会在部分设备之间同步。
+type SyncOptions struct {
+	MaxFileSize        int64    // 文件大小上限字节数，超过该大小的文件不会被索引，0 表示不限制
+	ExcludedExtensions []string // 不索引的文件扩展名，如 .mp4，不区分大小写
+}
+
+// Excluded 用于判断路径为 p、大小为 size 的文件是否被过滤。
+func (opts *SyncOptions) Excluded(p string, size int64) bool {
+	if 0 < opts.MaxFileSize && opts.MaxFileSize < size {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(p))
+	if "" == ext {
+		return false
+	}
+	for _, excluded := range opts.ExcludedExtensions {
+		excluded = strings.ToLower(excluded)
+		if !strings.HasPrefix(excluded, ".") {
+			excluded = "." + excluded
+		}
+		if ext == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// keptExcludedFiles 用于获取被过滤的数据文件 excluded 在最新索引中的文件对象。
+//
+// 已经同步过的文件变大超过上限或者扩展名被过滤后继续沿用最新索引中的文件对象，否则这些文件会被视为本地删除，同步后其他设备上的文件也会被删除。
+func (repo *Repo) keptExcludedFiles(excluded map[string]bool) (ret []*entity.File, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+
+	var latestFiles []*entity.File
+	if fullLatest := repo.getFullLatest(latest); nil != fullLatest {
+		latestFiles = fullLatest.Files
+	} else if latestFiles, err = repo.getFiles(latest.Files); nil != err {
+		logging.LogErrorf("get latest files failed: %s", err)
+		return
+	}
+	ret = excludedLatestFiles(excluded, latestFiles)
+	return
+}
+
+// excludedLatestFiles 用于获取路径在 excluded 中的最新索引文件 latestFiles。
+func excludedLatestFiles(excluded map[string]bool, latestFiles []*entity.File) (ret []*entity.File) {
+	for _, file := range latestFiles {
+		if excluded[file.Path] {
+			logging.LogInfof("keep excluded file [%s, %s] in index", file.ID, file.Path)
+			ret = append(ret, file)
+		}
+	}
+	return
+}
+
+func (repo *Repo) ignoreMatcher() (ret *ignoreMatcher) {
+	ret = newIgnoreMatcher(repo.IgnoreLines)
+	ret.dataFS = repo.dataFS
+	return
 }
 
 func (repo *Repo) absPath(relPath string) string {
-	return filepath.Join(repo.DataPath, relPath)
+	return repo.checkoutAbsPath(repo.DataPath, relPath)
 }
 
 func (repo *Repo) relPath(absPath string) string {
-	absPath = filepath.Clean(absPath)
-	return "/" + filepath.ToSlash(strings.TrimPrefix(absPath, repo.DataPath))
+	return repo.originalPath(repo.dataRelPath(absPath))
 }
 
 func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{}, count, total int) (err error) {
 	absPath := repo.absPath(file.Path)
 
+	if "" != file.Symlink {
+		// 符号链接使用链接目标作为文件内容，迁出时无法创建符号链接的话会写入该内容
+		data := []byte(file.Symlink)
+		chunkHash := util.Hash(data)
+		file.Chunks = append(file.Chunks, chunkHash)
+		chunk := &entity.Chunk{ID: chunkHash, Data: data}
+		if err = repo.store.PutChunk(chunk); nil != err {
+			logging.LogErrorf("put chunk [%s] failed: %s", chunkHash, err)
+			return
+		}
+
+		repo.captureXattrs(file, absPath)
+		eventbus.Publish(eventbus.EvtIndexUpsertFile, context, count, total)
+		err = repo.store.PutFile(file)
+		return
+	}
+
 	if chunker.MinSize > file.Size {
 		var data []byte
-		data, err = filelock.ReadFile(absPath)
+		data, err = readDataFile(repo.dataFS, absPath)
 		if nil != err {
 			logging.LogErrorf("read file [%s] failed: %s", absPath, err)
 			return
@@ -937,7 +1378,7 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 			return
 		}
 
-		newInfo, statErr := os.Stat(absPath)
+		newInfo, statErr := repo.dataFS.Stat(absPath)
 		if nil != statErr {
 			logging.LogErrorf("stat file [%s] failed: %s", absPath, statErr)
 			err = statErr
@@ -952,6 +1393,7 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 			return
 		}
 
+		repo.captureXattrs(file, absPath)
 		eventbus.Publish(eventbus.EvtIndexUpsertFile, context, count, total)
 		err = repo.store.PutFile(file)
 		if nil != err {
@@ -960,7 +1402,7 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 		return
 	}
 
-	reader, err := filelock.OpenFile(absPath, os.O_RDONLY, 0644)
+	reader, err := repo.dataFS.Open(absPath)
 	if nil != err {
 		logging.LogErrorf("open file [%s] failed: %s", absPath, err)
 		return
@@ -976,7 +1418,7 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 		if nil != chnkErr {
 			err = chnkErr
 			logging.LogErrorf("chunk file [%s] failed: %s", absPath, chnkErr)
-			if closeErr := filelock.CloseFile(reader); nil != closeErr {
+			if closeErr := reader.Close(); nil != closeErr {
 				logging.LogErrorf("close file [%s] failed: %s", absPath, closeErr)
 			}
 			return
@@ -987,19 +1429,19 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 		chunk := &entity.Chunk{ID: chunkHash, Data: chnk.Data}
 		if err = repo.store.PutChunk(chunk); nil != err {
 			logging.LogErrorf("put chunk [%s] failed: %s", chunkHash, err)
-			if closeErr := filelock.CloseFile(reader); nil != closeErr {
+			if closeErr := reader.Close(); nil != closeErr {
 				logging.LogErrorf("close file [%s] failed: %s", absPath, closeErr)
 			}
 			return
 		}
 	}
 
-	if err = filelock.CloseFile(reader); nil != err {
+	if err = reader.Close(); nil != err {
 		logging.LogErrorf("close file [%s] failed: %s", absPath, err)
 		return
 	}
 
-	newInfo, statErr := os.Stat(absPath)
+	newInfo, statErr := repo.dataFS.Stat(absPath)
 	if nil != statErr {
 		logging.LogErrorf("stat file [%s] failed: %s", absPath, statErr)
 		err = statErr
@@ -1014,20 +1456,82 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 		return
 	}
 
+	repo.captureXattrs(file, absPath)
 	eventbus.Publish(eventbus.EvtIndexUpsertFile, context, count, total)
 	err = repo.store.PutFile(file)
 	return
 }
 
 func (repo *Repo) getFiles(fileIDs []string) (ret []*entity.File, err error) {
-	for _, fileID := range fileIDs {
-		file, getErr := repo.store.GetFile(fileID)
+	return repo.getFilesCached(fileIDs, nil)
+}
+
+// getFilesCached 用于加载文件 fileIDs，cache 不为 nil 时优先从中获取已解码的文件，并将新解码的文件加入其中。
+func (repo *Repo) getFilesCached(fileIDs []string, cache *ristretto.Cache) (ret []*entity.File, err error) {
+	getFile := func(id string) (file *entity.File, getErr error) {
+		if nil != cache {
+			if cached, ok := cache.Get(id); ok {
+				file = cached.(*entity.File)
+				return
+			}
+		}
+		if file, getErr = repo.store.GetFile(id); nil == getErr && nil != cache {
+			cache.Set(id, file, 1)
+		}
+		return
+	}
+
+	if 1024 > len(fileIDs) {
+		for _, fileID := range fileIDs {
+			file, getErr := getFile(fileID)
+			if nil != getErr {
+				err = getErr
+				return
+			}
+			ret = append(ret, file)
+		}
+		return
+	}
+
+	// 大量文件时使用协程池并发加载，解码后的文件实体会被缓存在 fileCache 中供后续调用复用
+	files := make([]*entity.File, len(fileIDs))
+	var workerErrs []error
+	workerErrLock := sync.Mutex{}
+	waitGroup := &sync.WaitGroup{}
+	p, err := ants.NewPoolWithFunc(8, func(arg interface{}) {
+		defer waitGroup.Done()
+
+		i := arg.(int)
+		file, getErr := getFile(fileIDs[i])
 		if nil != getErr {
-			err = getErr
+			workerErrLock.Lock()
+			workerErrs = append(workerErrs, getErr)
+			workerErrLock.Unlock()
 			return
 		}
-		ret = append(ret, file)
+		files[i] = file
+	})
+	if nil != err {
+		return
 	}
+	defer p.Release()
+
+	for i := range fileIDs {
+		waitGroup.Add(1)
+		if err = p.Invoke(i); nil != err {
+			logging.LogErrorf("invoke failed: %s", err)
+			waitGroup.Done()
+			waitGroup.Wait()
+			return
+		}
+	}
+	waitGroup.Wait()
+
+	if 0 < len(workerErrs) {
+		err = workerErrs[0]
+		return
+	}
+	ret = files
 	return
 }
 
@@ -1043,30 +1547,18 @@ func (repo *Repo) openFile(file *entity.File) (ret []byte, err error) {
 	return
 }
 
-func (repo *Repo) removeFiles(files []*entity.File, context map[string]interface{}) (err error) {
-	total := len(files)
-	if 1 > total {
-		return
-	}
+func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interface{}) (err error) {
+	return repo.checkoutFilesTo(files, repo.DataPath, context)
+}
 
-	eventbus.Publish(eventbus.EvtCheckoutRemoveFiles, context, total)
-	for i, file := range files {
-		absPath := repo.absPath(file.Path)
-		if err = filelock.Remove(absPath); nil != err {
-			return
-		}
-		eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, i+1, total)
-	}
+// checkoutFilesTo 用于将文件 files 迁出到 checkoutDir 中，遇到被占用以外的错误时停止迁出。
+func (repo *Repo) checkoutFilesTo(files []*entity.File, checkoutDir string, context map[string]interface{}) (err error) {
+	_, err = repo.checkoutFilesBatch(files, checkoutDir, true, context)
 	return
 }
 
-func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interface{}) (err error) {
-	if 1 > len(files) {
-		return
-	}
-
-	//now := time.Now()
-
+// sortCheckoutFiles 用于按照迁出顺序排列文件，.siyuan 等配置文件优先迁出，同一类文件中浅层的文件优先迁出。
+func sortCheckoutFiles(files []*entity.File) []*entity.File {
 	var dotSiYuans, assets, emojis, storage, plugins, widgets, templates, public, others, all []*entity.File
 	for _, file := range files {
 		if strings.Contains(file.Path, ".siyuan") {
@@ -1131,81 +1623,93 @@ func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interfa
 	all = append(all, others...)
 	others = nil
 
-	files = all
-	count, total := 0, len(files)
-	eventbus.Publish(eventbus.EvtCheckoutUpsertFiles, context, total)
-	for _, file := range files {
-		count++
-		err = repo.checkoutFile(file, repo.DataPath, count, total, context)
-		if nil != err {
-			return
-		}
-	}
-
-	//logging.LogInfof("checkout files done, total: %d, cost: %s", total, time.Since(now))
-	return
+	return all
 }
 
 func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, total int, context map[string]interface{}) (err error) {
-	absPath := filepath.Join(checkoutDir, file.Path)
+	absPath := repo.checkoutAbsPath(checkoutDir, file.Path)
 	dir, name := filepath.Split(absPath)
-	if err = os.MkdirAll(dir, 0755); nil != err {
+	dataFS := repo.checkoutFS(checkoutDir)
+	_, local := dataFS.(*osDataFS)
+	if err = dataFS.MkdirAll(dir, 0755); nil != err {
+		logging.LogErrorf("mkdir [%s] failed: %s", dir, err)
 		return
 	}
 
-	tmp := filepath.Join(dir, name+gulu.Rand.String(7)+".tmp")
-	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
-	if nil != err {
-		return
+	if "" != file.Symlink && local {
+		if err = checkoutSymlink(file, absPath, checkoutDir); nil == err {
+			repo.restoreXattrs(file, absPath)
+			repo.recordCheckoutPath(file, checkoutDir)
+			eventbus.Publish(eventbus.EvtCheckoutUpsertFile, context, count, total)
+			return
+		}
+		// 无法创建符号链接时（比如 Windows 上没有权限或者链接目标不安全）迁出为内容是链接目标的普通文件
+		logging.LogWarnf("create symlink [%s -> %s] failed, checkout as regular file: %s", absPath, file.Symlink, err)
 	}
 
-	for _, c := range file.Chunks {
-		var chunk *entity.Chunk
-		chunk, err = repo.store.GetChunk(c)
+	tmp := filepath.Join(dir, name+gulu.Rand.String(7)+".tmp")
+	var linked, hardlinked bool
+	if local {
+		linked, hardlinked = repo.linkCheckoutFile(file, tmp)
+	}
+	if !linked {
+		var f DataFile
+		f, err = dataFS.Create(tmp)
 		if nil != err {
 			return
 		}
 
-		if _, err = f.Write(chunk.Data); nil != err {
+		if osFile, ok := f.(*os.File); ok {
+			err = repo.assembleFile(file, osFile)
+		} else {
+			err = repo.writeChunks(file, f)
+		}
+		if nil != err {
 			logging.LogErrorf("write file [%s] failed: %s", absPath, err)
+			f.Close()
+			dataFS.Remove(tmp)
 			return
 		}
-	}
 
-	if err = f.Sync(); nil != err {
-		logging.LogErrorf("write file [%s] failed: %s", absPath, err)
-		return
-	}
-	if err = f.Close(); nil != err {
-		logging.LogErrorf("write file [%s] failed: %s", absPath, err)
-		return
+		if err = f.Sync(); nil != err {
+			logging.LogErrorf("write file [%s] failed: %s", absPath, err)
+			return
+		}
+		if err = f.Close(); nil != err {
+			logging.LogErrorf("write file [%s] failed: %s", absPath, err)
+			return
+		}
 	}
 
 	filelock.Lock(absPath)
 	defer filelock.Unlock(absPath)
 
-	for i := 0; i < 3; i++ {
-		err = os.Rename(f.Name(), absPath) // Windows 上重命名是非原子的
-		if nil == err {
-			os.Remove(f.Name())
-			break
-		}
-
-		if errMsg := strings.ToLower(err.Error()); strings.Contains(errMsg, "access is denied") || strings.Contains(errMsg, "used by another process") { // 文件可能是被锁定
-			time.Sleep(200 * time.Millisecond)
-			continue
-		}
-		break
+	err = retryLocked(func() error { return dataFS.Rename(tmp, absPath) }) // Windows 上重命名是非原子的，文件可能被其他进程占用
+	if isFileLockedErr(err) {
+		logging.LogErrorf("write file [%s] failed: %s", absPath, err)
+		dataFS.Remove(tmp)
+		err = &LockedFilesError{Paths: []string{file.Path}, Err: err}
+		return
 	}
 	if nil != err {
 		logging.LogFatalf(logging.ExitCodeFileSysErr, "write file [%s] failed: %s", absPath, err)
 	}
 
 	updated := time.UnixMilli(file.Updated)
-	if err = os.Chtimes(absPath, updated, updated); nil != err {
+	if err = dataFS.Chtimes(absPath, updated); nil != err {
 		logging.LogErrorf("change [%s] time [file.Updated=%d, updated=%v] failed: %s", absPath, file.Updated, updated, err)
 		return
 	}
+	if 0 != file.Mode && !hardlinked { // 硬链接的数据文件和数据对象共用权限，修改权限可能导致数据对象无法读取
+		if err = dataFS.Chmod(absPath, os.FileMode(file.Mode).Perm()); nil != err {
+			logging.LogErrorf("chmod [%s] to [%04o] failed: %s", absPath, file.Mode, err)
+			return
+		}
+	}
+	if local {
+		repo.restoreXattrs(file, absPath)
+	}
+	repo.recordCheckoutPath(file, checkoutDir)
 	eventbus.Publish(eventbus.EvtCheckoutUpsertFile, context, count, total)
 	return
 }
@@ -0,0 +1,258 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// EvtCopyRepoFile 描述了复制仓库时复制一个文件的事件，参数为 context、文件相对仓库文件夹的路径、当前文件序号和文件总数。
+const EvtCopyRepoFile = "repo.copyFile"
+
+var (
+	// ErrInvalidCopyDst 描述了复制仓库的目标文件夹不为空，或者和仓库文件夹互相包含。
+	ErrInvalidCopyDst = errors.New("invalid copy destination")
+	// ErrCopyHashMismatch 描述了复制后的文件哈希和源文件不一致。
+	ErrCopyHashMismatch = errors.New("copy hash mismatch")
+)
+
+// RepoCopy 描述了复制仓库的结果。
+type RepoCopy struct {
+	Path    string // 新仓库文件夹的绝对路径
+	Objects int    // 复制的数据对象数
+	Files   int    // 复制的其他文件数，包括索引、引用和配置等
+	Bytes   int64  // 复制的总字节数
+}
+
+// repoCopyEntry 描述了复制仓库时需要复制的一个文件。
+type repoCopyEntry struct {
+	src    string // 源文件的绝对路径
+	rel    string // 相对新仓库文件夹的路径
+	object bool   // 是否为数据对象
+}
+
+// CopyTo 用于将仓库复制到新位置 dstPath，包括数据对象、索引、引用和配置，每个文件复制后都会校验哈希，只读仓库也可以调用。
+//
+// 复制时先写入 dstPath 同级的临时文件夹，全部校验通过后再重命名为 dstPath，失败时删除临时文件夹，不会留下不完整的仓库。
+// dstPath 必须不存在或者为空文件夹，且不能和仓库文件夹互相包含，否则返回 ErrInvalidCopyDst。
+// 使用共享数据对象文件夹的仓库会复制共享文件夹中的所有数据对象，新仓库不再共享。
+func (repo *Repo) CopyTo(dstPath string, context map[string]interface{}) (ret *RepoCopy, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if dstPath, err = filepath.Abs(dstPath); nil != err {
+		return
+	}
+	if err = repo.checkCopyDst(dstPath); nil != err {
+		return
+	}
+
+	entries, err := repo.copyEntries()
+	if nil != err {
+		logging.LogErrorf("list repo [%s] files failed: %s", repo.Path, err)
+		return
+	}
+
+	staging := stagingPath(dstPath)
+	if err = os.RemoveAll(staging); nil != err {
+		return
+	}
+	defer func() {
+		if nil != err {
+			if removeErr := os.RemoveAll(staging); nil != removeErr {
+				logging.LogErrorf("remove copy staging dir [%s] failed: %s", staging, removeErr)
+			}
+		}
+	}()
+
+	ret = &RepoCopy{Path: dstPath}
+	for i, entry := range entries {
+		eventbus.Publish(EvtCopyRepoFile, context, entry.rel, i+1, len(entries))
+		var size int64
+		if size, err = copyVerifiedFile(entry.src, filepath.Join(staging, entry.rel)); nil != err {
+			logging.LogErrorf("copy [%s] failed: %s", entry.src, err)
+			return
+		}
+		if entry.object {
+			ret.Objects++
+		} else {
+			ret.Files++
+		}
+		ret.Bytes += size
+	}
+
+	if err = renameStaging(staging, dstPath); nil != err {
+		return
+	}
+	logging.LogInfof("copied repo [%s] to [%s], objects [%d], files [%d], bytes [%d]", repo.Path, dstPath, ret.Objects, ret.Files, ret.Bytes)
+	return
+}
+
+// checkCopyDst 用于检查复制仓库的目标文件夹 dstPath 是否可用。
+func (repo *Repo) checkCopyDst(dstPath string) (err error) {
+	if isSubPath(dstPath, repo.Path) || isSubPath(repo.Path, dstPath) || isSubPath(dstPath, repo.store.ObjectsPath) {
+		err = ErrInvalidCopyDst
+		return
+	}
+	if !gulu.File.IsExist(dstPath) {
+		return
+	}
+	if !gulu.File.IsDir(dstPath) {
+		err = ErrInvalidCopyDst
+		return
+	}
+	dirEntries, err := os.ReadDir(dstPath)
+	if nil != err {
+		return
+	}
+	if 0 < len(dirEntries) {
+		err = ErrInvalidCopyDst
+	}
+	return
+}
+
+// stagingPath 用于获取写入新仓库 dstPath 时使用的临时文件夹，该文件夹和 dstPath 位于同一文件夹下。
+func stagingPath(dstPath string) string {
+	return filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".copying")
+}
+
+// renameStaging 用于将写入完成的临时文件夹 staging 重命名为 dstPath，dstPath 为空文件夹时先删除。
+func renameStaging(staging, dstPath string) (err error) {
+	if gulu.File.IsDir(dstPath) {
+		if err = os.Remove(dstPath); nil != err {
+			return
+		}
+	}
+	if err = os.Rename(staging, dstPath); nil != err {
+		logging.LogErrorf("rename staging dir [%s] to [%s] failed: %s", staging, dstPath, err)
+	}
+	return
+}
+
+// copyEntries 用于列出复制仓库时需要复制的所有文件，数据对象统一复制到新仓库的 objects 文件夹下。
+func (repo *Repo) copyEntries() (ret []*repoCopyEntry, err error) {
+	ownObjects := filepath.Join(repo.Path, "objects")
+	err = filepath.WalkDir(repo.Path, func(path string, d fs.DirEntry, walkErr error) error {
+		if nil != walkErr {
+			return walkErr
+		}
+		if d.IsDir() {
+			if filepath.Clean(path) == filepath.Clean(ownObjects) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(repo.Path, path)
+		if nil != relErr {
+			return relErr
+		}
+		ret = append(ret, &repoCopyEntry{src: path, rel: rel})
+		return nil
+	})
+	if nil != err {
+		return
+	}
+
+	for _, name := range []string{shardLayoutFile, encryptionFile} {
+		layoutPath := filepath.Join(repo.store.ObjectsPath, name)
+		if gulu.File.IsExist(layoutPath) {
+			ret = append(ret, &repoCopyEntry{src: layoutPath, rel: filepath.Join("objects", name)})
+		}
+	}
+	err = repo.store.walkObjects(func(id, absPath string) error {
+		rel, relErr := filepath.Rel(repo.store.ObjectsPath, absPath)
+		if nil != relErr {
+			return relErr
+		}
+		ret = append(ret, &repoCopyEntry{src: absPath, rel: filepath.Join("objects", rel), object: true})
+		return nil
+	})
+	return
+}
+
+// copyVerifiedFile 用于将文件 src 复制到 dst 并保留修改时间，复制后重新读取 dst 校验哈希。
+func copyVerifiedFile(src, dst string) (size int64, err error) {
+	info, err := os.Stat(src)
+	if nil != err {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); nil != err {
+		return
+	}
+
+	in, err := os.Open(src)
+	if nil != err {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if nil != err {
+		return
+	}
+	srcHash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(out, srcHash), in)
+	if nil == err {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); nil == err {
+		err = closeErr
+	}
+	if nil != err {
+		return
+	}
+
+	dstHash, err := hashFile(dst)
+	if nil != err {
+		return
+	}
+	if !bytes.Equal(srcHash.Sum(nil), dstHash) {
+		err = fmt.Errorf("%w: [%s]", ErrCopyHashMismatch, src)
+		return
+	}
+	err = os.Chtimes(dst, info.ModTime(), info.ModTime()) // 索引日志重建时使用索引文件的修改时间
+	return
+}
+
+// hashFile 用于计算文件 p 内容的 SHA-256 哈希。
+func hashFile(p string) (ret []byte, err error) {
+	f, err := os.Open(p)
+	if nil != err {
+		return
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); nil != err {
+		return
+	}
+	ret = hash.Sum(nil)
+	return
+}
@@ -0,0 +1,147 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrRepoFormatTooNew 描述了仓库由更新版本的 dejavu 写入，当前版本无法安全读取或者写入的错误，具体信息参考 RepoFormatError。
+var ErrRepoFormatTooNew = errors.New("repo format too new")
+
+const repoFormatFile = "format.json" // 仓库格式版本文件，位于仓库根目录下
+
+// 仓库格式版本。
+const (
+	RepoFormatLegacy   = 1 // JSON 索引和文件对象、EncryptionLegacy 加密、单层分片
+	RepoFormatExtended = 2 // 使用了 entity.FormatBinary 编码、EncryptionAEAD 加密或者多层分片中的至少一项
+
+	RepoFormatVersion = RepoFormatExtended // 当前版本支持读写的最高仓库格式版本
+)
+
+// RepoFormat 描述了仓库格式版本，用于防止回退到旧版本后误读或者写坏由新版本写入的仓库。
+//
+// 打开仓库时如果 MinReader 高于当前支持的版本则拒绝打开；如果只有 MinWriter 高于当前支持的版本则以只读方式打开，写入时返回错误。
+type RepoFormat struct {
+	Version   int `json:"version"`   // 最近写入仓库的 dejavu 支持的格式版本
+	MinReader int `json:"minReader"` // 读取仓库需要的最低格式版本
+	MinWriter int `json:"minWriter"` // 写入仓库需要的最低格式版本
+}
+
+// GetRepoFormat 用于获取仓库格式版本。
+func (repo *Repo) GetRepoFormat() (ret *RepoFormat) {
+	repo.store.formatLock.Lock()
+	defer repo.store.formatLock.Unlock()
+
+	ret = &RepoFormat{}
+	*ret = *repo.store.format
+	return
+}
+
+// loadRepoFormat 用于加载仓库格式版本，没有记录时按照旧版格式创建。读取需要的版本高于当前支持的版本时返回 RepoFormatError。
+func (store *Store) loadRepoFormat() (err error) {
+	file := filepath.Join(store.Path, repoFormatFile)
+	if !store.exist(file) {
+		store.format = &RepoFormat{Version: RepoFormatVersion, MinReader: RepoFormatLegacy, MinWriter: RepoFormatLegacy}
+		return
+	}
+
+	data, err := store.fs.ReadFile(file)
+	if nil != err {
+		logging.LogErrorf("read repo format [%s] failed: %s", file, err)
+		return
+	}
+	format := &RepoFormat{}
+	if err = gulu.JSON.UnmarshalJSON(data, format); nil != err {
+		logging.LogErrorf("unmarshal repo format [%s] failed: %s", file, err)
+		return
+	}
+	store.format = format
+	store.formatSaved = true
+
+	if RepoFormatVersion < format.MinReader {
+		err = &RepoFormatError{Path: store.Path, Required: format.MinReader, Supported: RepoFormatVersion}
+		logging.LogErrorf("open repo failed: %s", err)
+		return
+	}
+	if RepoFormatVersion < format.MinWriter {
+		store.formatErr = &RepoFormatError{Path: store.Path, Required: format.MinWriter, Supported: RepoFormatVersion, Write: true}
+		logging.LogWarnf("open repo as read only: %s", store.formatErr)
+	}
+	return
+}
+
+// checkWritable 用于在写入仓库前检查格式版本，仓库由更新版本写入时返回错误。
+//
+// 写入使用了新格式特性的对象前会先提升并保存仓库格式版本，之后旧版本无法读取仓库时会得到明确的错误而不是误读数据。
+func (store *Store) checkWritable() (err error) {
+	if store.readOnly {
+		err = ErrRepoReadOnly
+		return
+	}
+
+	store.formatLock.Lock()
+	defer store.formatLock.Unlock()
+
+	if nil != store.formatErr {
+		err = store.formatErr
+		return
+	}
+
+	required := store.requiredFormat()
+	if required <= store.format.MinReader && RepoFormatVersion <= store.format.Version && store.formatSaved {
+		return
+	}
+
+	format := &RepoFormat{Version: max(store.format.Version, RepoFormatVersion), MinReader: max(store.format.MinReader, required), MinWriter: max(store.format.MinWriter, required)}
+	if err = store.saveRepoFormat(format); nil != err {
+		logging.LogErrorf("save repo format failed: %s", err)
+		return
+	}
+	if store.format.MinReader < format.MinReader {
+		logging.LogInfof("raised repo format to [%d]", format.MinReader)
+	}
+	store.format = format
+	store.formatSaved = true
+	return
+}
+
+// requiredFormat 用于根据当前的写入设置计算读取仓库需要的最低格式版本。
+func (store *Store) requiredFormat() int {
+	if entity.FormatBinary == store.Format || EncryptionAEAD == store.Encryption || 1 < store.ShardDepth {
+		return RepoFormatExtended
+	}
+	return RepoFormatLegacy
+}
+
+func (store *Store) saveRepoFormat(format *RepoFormat) (err error) {
+	if err = store.fs.MkdirAll(store.Path); nil != err {
+		return
+	}
+
+	data, err := gulu.JSON.MarshalJSON(format)
+	if nil != err {
+		return
+	}
+	err = store.fs.WriteFile(filepath.Join(store.Path, repoFormatFile), data)
+	return
+}
@@ -0,0 +1,238 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// EvtMigrateStep 描述了升级本地仓库布局时开始一个步骤的事件，参数为 context、步骤名称、当前步骤序号和步骤总数。
+const EvtMigrateStep = "repo.migrateStep"
+
+// 升级本地仓库布局的步骤。
+const (
+	MigrateStepBackup     = "backup"     // 备份将被替换的元数据
+	MigrateStepShard      = "shard"      // 完成中断的分片迁移
+	MigrateStepFormat     = "format"     // 将索引和文件对象重写为当前编码格式
+	MigrateStepEncryption = "encryption" // 将文件和分块对象重新加密为当前加密方式
+	MigrateStepCheckIndex = "checkIndex" // 为本地最新索引生成校验索引
+	MigrateStepFullLatest = "fullLatest" // 重建本地最新索引的完整文件列表缓存
+	MigrateStepIndexLog   = "indexLog"   // 压缩修复索引日志
+	MigrateStepSeqNum     = "seqNum"     // 为云端 refs/latest 补充 refs/latest-seqNum-id
+	MigrateStepRepoFormat = "repoFormat" // 保存仓库格式版本
+)
+
+const migrateBackupDir = "migrate-backup" // 升级前备份元数据的文件夹，位于仓库根目录下
+
+// RepoMigration 描述了升级本地仓库布局的结果。
+type RepoMigration struct {
+	BackupPath   string // 被替换元数据的备份文件夹绝对路径
+	ShardObjects int    // 完成分片迁移时移动的数据对象数
+	Indexes      int    // 重写编码格式的索引数
+	Files        int    // 重写编码格式的文件对象数
+	Objects      int    // 重新加密的数据对象数
+	CheckIndex   bool   // 是否为本地最新索引生成了校验索引
+	FullLatest   bool   // 是否重建了完整文件列表缓存
+	SeqNumRef    bool   // 是否为云端补充了 refs/latest-seqNum-id
+	IndexLog     *IndexLogCompaction
+}
+
+// Migrate 用于将旧版本布局的本地仓库原地升级为当前格式。
+//
+// 旧版本仓库通常只在用到时才被动升级，比如切换编码格式后只有新写入的索引使用新格式，这样会留下混合格式的仓库。
+// 升级会依次完成中断的分片迁移，将索引和对象重写为当前设置的编码格式和加密方式，为缺少校验索引的最新索引生成校验索引，
+// 重建完整文件列表缓存和索引日志，为只有 refs/latest 的 S3 或思源云端补充 refs/latest-seqNum-id，最后保存仓库格式版本。
+//
+// 升级前会将引用、最新索引、完整文件列表缓存、索引日志、格式版本和分片布局等将被替换的元数据备份到仓库 migrate-backup 文件夹下，
+// 编码格式和加密方式的重写是无损的，所以不备份被重写的对象。每个步骤都可以重复执行，升级中断后再次调用即可继续。
+func (repo *Repo) Migrate(context map[string]interface{}) (ret *RepoMigration, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err = repo.store.checkWritable(); nil != err {
+		return
+	}
+
+	ret = &RepoMigration{}
+	steps := []string{MigrateStepBackup, MigrateStepShard, MigrateStepFormat, MigrateStepEncryption, MigrateStepCheckIndex, MigrateStepFullLatest, MigrateStepIndexLog, MigrateStepSeqNum, MigrateStepRepoFormat}
+	for i, step := range steps {
+		eventbus.Publish(EvtMigrateStep, context, step, i+1, len(steps))
+		if err = repo.migrateStep(step, ret, context); nil != err {
+			logging.LogErrorf("migrate repo step [%s] failed: %s", step, err)
+			return
+		}
+	}
+	logging.LogInfof("migrated repo [%s], backup [%s]", repo.Path, ret.BackupPath)
+	return
+}
+
+func (repo *Repo) migrateStep(step string, migration *RepoMigration, context map[string]interface{}) (err error) {
+	store := repo.store
+	switch step {
+	case MigrateStepBackup:
+		migration.BackupPath, err = repo.backupMetadata()
+	case MigrateStepShard:
+		if store.migratingShard {
+			migration.ShardObjects, err = store.migrateShardDepth(store.ShardDepth)
+		}
+	case MigrateStepFormat:
+		migration.Indexes, migration.Files, err = store.Migrate(store.Format)
+	case MigrateStepEncryption:
+		if EncryptionLegacy != store.Encryption {
+			migration.Objects, err = store.MigrateEncryption(store.Encryption)
+		}
+	case MigrateStepCheckIndex:
+		migration.CheckIndex, err = repo.migrateCheckIndex()
+	case MigrateStepFullLatest:
+		migration.FullLatest, err = repo.migrateFullLatest()
+	case MigrateStepIndexLog:
+		migration.IndexLog, err = store.compactIndexLog()
+	case MigrateStepSeqNum:
+		migration.SeqNumRef, err = repo.migrateSeqNumRef(context)
+	case MigrateStepRepoFormat:
+		err = store.checkWritable()
+	}
+	return
+}
+
+// backupMetadata 用于备份升级时可能被替换的元数据，返回备份文件夹的绝对路径。
+func (repo *Repo) backupMetadata() (ret string, err error) {
+	ret = filepath.Join(repo.Path, migrateBackupDir, time.Now().Format("2006-01-02-150405"))
+	if err = os.MkdirAll(ret, 0755); nil != err {
+		return
+	}
+
+	paths := []string{"refs", "full-latest.json", indexLogFile, repoFormatFile}
+	if latest, latestErr := repo.Latest(); nil == latestErr {
+		paths = append(paths, filepath.Join("indexes", latest.ID))
+	}
+	for _, p := range paths {
+		src := filepath.Join(repo.Path, p)
+		if !gulu.File.IsExist(src) {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(filepath.Join(ret, p)), 0755); nil != err {
+			return
+		}
+		if err = gulu.File.Copy(src, filepath.Join(ret, p)); nil != err {
+			logging.LogErrorf("backup [%s] failed: %s", src, err)
+			return
+		}
+	}
+
+	shardLayoutPath := filepath.Join(repo.store.ObjectsPath, shardLayoutFile)
+	if gulu.File.IsExist(shardLayoutPath) {
+		if err = gulu.File.Copy(shardLayoutPath, filepath.Join(ret, shardLayoutFile)); nil != err {
+			logging.LogErrorf("backup [%s] failed: %s", shardLayoutPath, err)
+			return
+		}
+	}
+	return
+}
+
+// migrateCheckIndex 用于为缺少校验索引的本地最新索引生成校验索引，旧版本创建的索引没有校验索引。
+func (repo *Repo) migrateCheckIndex() (migrated bool, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	if "" != latest.CheckIndexID && gulu.File.IsExist(filepath.Join(repo.Path, "check", "indexes", latest.CheckIndexID)) {
+		return
+	}
+
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+	checkIndex := newCheckIndex(latest, files)
+	if err = repo.putCheckIndex(checkIndex); nil != err {
+		return
+	}
+	latest.CheckIndexID = checkIndex.ID
+	if err = repo.store.PutIndex(latest); nil != err {
+		return
+	}
+	migrated = true
+	return
+}
+
+// migrateFullLatest 用于在完整文件列表缓存缺失或者和本地最新索引不一致时重建缓存。
+func (repo *Repo) migrateFullLatest() (migrated bool, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	if nil != repo.getFullLatest(latest) {
+		return
+	}
+
+	if err = repo.updateLatest(latest, RefOpMigrate); nil != err {
+		return
+	}
+	migrated = true
+	return
+}
+
+// migrateSeqNumRef 用于为只有 refs/latest 的 S3 或思源云端补充 refs/latest-seqNum-id，旧版本同步时不上传该引用。
+func (repo *Repo) migrateSeqNumRef(context map[string]interface{}) (migrated bool, err error) {
+	if nil == repo.cloud || !(repo.isCloudS3() || repo.isCloudSiYuan()) {
+		return
+	}
+
+	if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+		return
+	}
+	defer repo.unlockCloud(context)
+
+	data, err := repo.cloud.DownloadObject("refs/latest")
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+	if seqNumLatestID, _, _ := repo.getSeqNumLatest(); "" != seqNumLatestID {
+		return
+	}
+
+	latestID := string(data)
+	seqNumKey := "refs/latest-1-" + latestID
+	if _, err = repo.cloud.UploadBytes(seqNumKey, data, true); nil != err {
+		return
+	}
+	repo.updateCloudListing(seqNumKey, int64(len(latestID)), false)
+	migrated = true
+	return
+}
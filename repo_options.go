@@ -0,0 +1,108 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"path"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+// RepoOptions 描述了仓库级别的策略选项，在构造仓库时传入，同一进程中的多个仓库可以使用不同的策略。
+type RepoOptions struct {
+	MergeMemo              string   // 同步合并索引的备注，实际备注会追加合并耗时
+	PreMergeSnapshotMemo   string   // 同步合并前安全快照的备注
+	ResolveConflictMemo    string   // 解决冲突后创建索引的备注前缀，实际备注会追加冲突文件路径
+	TmpFileSuffixes        []string // 临时文件后缀，匹配的文件不会被索引，也不会从云端迁出
+	RemoveEmptyDirExcludes []string // 清理数据文件夹下的空文件夹时需要排除的文件夹
+}
+
+// DefaultRepoOptions 返回默认的仓库策略选项。
+func DefaultRepoOptions() *RepoOptions {
+	return &RepoOptions{
+		MergeMemo:              "[Sync] Cloud sync merge",
+		PreMergeSnapshotMemo:   "[Sync] pre-merge safety",
+		ResolveConflictMemo:    "[Sync] Resolve conflict ",
+		TmpFileSuffixes:        []string{".tmp"},
+		RemoveEmptyDirExcludes: append(append([]string{}, workspaceDataDirs...), ".git"),
+	}
+}
+
+// NewRepoWithOptions 和 NewRepo 一样创建一个新的仓库，并使用 opts 作为仓库策略选项。opts 为 nil 时使用默认选项，
+// 未设置的字段使用默认值。
+func NewRepoWithOptions(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS string, aesKey []byte, ignoreLines []string, cloud cloud.Cloud, opts *RepoOptions) (ret *Repo, err error) {
+	ret, err = NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines, cloud)
+	if nil != err {
+		return
+	}
+	ret.options = normalizeRepoOptions(opts)
+	return
+}
+
+// GetOptions 返回仓库策略选项的副本。
+func (repo *Repo) GetOptions() (ret *RepoOptions) {
+	ret = repo.options.clone()
+	return
+}
+
+func normalizeRepoOptions(opts *RepoOptions) (ret *RepoOptions) {
+	ret = DefaultRepoOptions()
+	if nil == opts {
+		return
+	}
+
+	if "" != opts.MergeMemo {
+		ret.MergeMemo = opts.MergeMemo
+	}
+	if "" != opts.PreMergeSnapshotMemo {
+		ret.PreMergeSnapshotMemo = opts.PreMergeSnapshotMemo
+	}
+	if "" != opts.ResolveConflictMemo {
+		ret.ResolveConflictMemo = opts.ResolveConflictMemo
+	}
+	if nil != opts.TmpFileSuffixes {
+		ret.TmpFileSuffixes = append([]string{}, opts.TmpFileSuffixes...)
+	}
+	if nil != opts.RemoveEmptyDirExcludes {
+		ret.RemoveEmptyDirExcludes = gulu.Str.RemoveDuplicatedElem(append([]string{}, opts.RemoveEmptyDirExcludes...))
+	}
+	return
+}
+
+func (opts *RepoOptions) clone() (ret *RepoOptions) {
+	ret = &RepoOptions{
+		MergeMemo:              opts.MergeMemo,
+		PreMergeSnapshotMemo:   opts.PreMergeSnapshotMemo,
+		ResolveConflictMemo:    opts.ResolveConflictMemo,
+		TmpFileSuffixes:        append([]string{}, opts.TmpFileSuffixes...),
+		RemoveEmptyDirExcludes: append([]string{}, opts.RemoveEmptyDirExcludes...),
+	}
+	return
+}
+
+// isTmpFile 用于判断路径 p 是否为临时文件。
+func (opts *RepoOptions) isTmpFile(p string) bool {
+	name := path.Base(p)
+	for _, suffix := range opts.TmpFileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
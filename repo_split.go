@@ -0,0 +1,246 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// EvtSplitRepoIndex 描述了拆分仓库时开始重写一个索引的事件，参数为 context、原索引 ID、当前索引序号和索引总数。
+const EvtSplitRepoIndex = "repo.splitIndex"
+
+// ErrInvalidSplitPrefix 描述了拆分仓库的路径前缀为空或者为根路径。
+var ErrInvalidSplitPrefix = errors.New("invalid split prefix")
+
+// RepoSplit 描述了拆分仓库的结果。
+type RepoSplit struct {
+	Path    string            // 新仓库文件夹的绝对路径
+	Indexes map[string]string // 原索引 ID 到新索引 ID 的映射，过滤后没有文件的索引不会写入新仓库
+	Files   int               // 复制的文件对象数
+	Chunks  int               // 复制的分块对象数
+	Bytes   int64             // 复制的总字节数
+}
+
+// SplitTo 用于将路径前缀 prefix（如 /20220101000000-abcdefg/）下的文件拆分到位于 dstPath 的新仓库中，并保留这些文件的快照历史。
+//
+// indexIDs 为空时拆分所有索引，否则只拆分指定的索引。每个索引只保留 prefix 下的文件并使用新的索引 ID 写入新仓库，
+// 文件路径保持不变，文件和分块对象原样复制，新仓库使用相同的密钥。原仓库的最新索引和标签会指向对应的新索引，原最新索引没有被拆分时新仓库的最新索引为创建时间最晚的新索引。
+// 新仓库先写入 dstPath 同级的临时文件夹，完成后再重命名为 dstPath，dstPath 的要求和 CopyTo 相同。
+func (repo *Repo) SplitTo(dstPath, prefix string, indexIDs []string, context map[string]interface{}) (ret *RepoSplit, err error) {
+	prefix = path.Clean("/" + strings.TrimSpace(prefix))
+	if "/" == prefix {
+		err = ErrInvalidSplitPrefix
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if dstPath, err = filepath.Abs(dstPath); nil != err {
+		return
+	}
+	if err = repo.checkCopyDst(dstPath); nil != err {
+		return
+	}
+
+	indexes, err := repo.splitIndexes(indexIDs)
+	if nil != err {
+		return
+	}
+
+	staging := stagingPath(dstPath)
+	if err = os.RemoveAll(staging); nil != err {
+		return
+	}
+	defer func() {
+		if nil != err {
+			if removeErr := os.RemoveAll(staging); nil != removeErr {
+				logging.LogErrorf("remove split staging dir [%s] failed: %s", staging, removeErr)
+			}
+		}
+	}()
+
+	dst, err := NewRepo("", staging, "", "", repo.DeviceID, repo.DeviceName, repo.DeviceOS, repo.store.AesKey, repo.IgnoreLines, nil)
+	if nil != err {
+		return
+	}
+	dst.store.Format, dst.store.Encryption = repo.store.Format, repo.store.Encryption
+
+	ret = &RepoSplit{Path: dstPath, Indexes: map[string]string{}}
+	copied := map[string]bool{}
+	var newest *entity.Index
+	for i, index := range indexes {
+		eventbus.Publish(EvtSplitRepoIndex, context, index.ID, i+1, len(indexes))
+		var splitIndex *entity.Index
+		if splitIndex, err = repo.splitIndex(dst, index, prefix, copied, ret); nil != err {
+			logging.LogErrorf("split index [%s] failed: %s", index.ID, err)
+			return
+		}
+		if nil == splitIndex {
+			continue
+		}
+		ret.Indexes[index.ID] = splitIndex.ID
+		if nil == newest || newest.Created <= splitIndex.Created {
+			newest = splitIndex
+		}
+	}
+	if nil == newest {
+		err = ErrEmptyIndex
+		return
+	}
+
+	if latest, latestErr := repo.Latest(); nil == latestErr {
+		if id := ret.Indexes[latest.ID]; "" != id {
+			newest, _ = dst.store.GetIndex(id)
+		}
+	}
+	if err = dst.updateLatest(newest, RefOpSplit); nil != err {
+		return
+	}
+	if err = repo.splitTags(dst, ret.Indexes); nil != err {
+		return
+	}
+
+	if err = renameStaging(staging, dstPath); nil != err {
+		return
+	}
+	logging.LogInfof("split [%s] of repo [%s] to [%s], indexes [%d], files [%d], chunks [%d], bytes [%d]", prefix, repo.Path, dstPath, len(ret.Indexes), ret.Files, ret.Chunks, ret.Bytes)
+	return
+}
+
+// splitIndexes 用于获取需要拆分的索引，indexIDs 为空时返回所有索引，结果按创建时间正序排列。
+func (repo *Repo) splitIndexes(indexIDs []string) (ret []*entity.Index, err error) {
+	if 1 > len(indexIDs) {
+		var entries []*indexLogEntry
+		if entries, err = repo.store.readIndexLog(); nil != err {
+			return
+		}
+		if ret, err = repo.store.getLoggedIndexes(entries); nil != err {
+			return
+		}
+	} else {
+		for _, id := range gulu.Str.RemoveDuplicatedElem(indexIDs) {
+			var index *entity.Index
+			if index, err = repo.store.GetIndex(id); nil != err {
+				return
+			}
+			ret = append(ret, index)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Created < ret[j].Created })
+	return
+}
+
+// splitIndex 用于将索引 index 中位于 prefix 下的文件写入新仓库 dst，返回新索引，没有文件位于 prefix 下时返回 nil。
+func (repo *Repo) splitIndex(dst *Repo, index *entity.Index, prefix string, copied map[string]bool, stat *RepoSplit) (ret *entity.Index, err error) {
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+
+	ret = &entity.Index{
+		ID:         util.RandHash(),
+		Memo:       index.Memo,
+		Created:    index.Created,
+		SystemID:   index.SystemID,
+		SystemName: index.SystemName,
+		SystemOS:   index.SystemOS,
+		AuthorID:   index.AuthorID,
+		AuthorName: index.AuthorName,
+	}
+	for _, file := range files {
+		if file.Path != prefix && !strings.HasPrefix(file.Path, prefix+"/") {
+			continue
+		}
+
+		if err = repo.splitObject(dst, file.ID, false, copied, stat); nil != err {
+			return
+		}
+		for _, chunk := range file.Chunks {
+			if err = repo.splitObject(dst, chunk, true, copied, stat); nil != err {
+				return
+			}
+		}
+		ret.Files = append(ret.Files, file.ID)
+		ret.Size += file.Size
+	}
+	if 1 > len(ret.Files) {
+		ret = nil
+		return
+	}
+	ret.Count = len(ret.Files)
+	err = dst.store.PutIndex(ret)
+	return
+}
+
+// splitObject 用于将数据对象 id 原样复制到新仓库 dst 中，已经复制过的对象会跳过。
+func (repo *Repo) splitObject(dst *Repo, id string, chunk bool, copied map[string]bool, stat *RepoSplit) (err error) {
+	if copied[id] {
+		return
+	}
+
+	size, err := copyVerifiedFile(repo.store.ObjectPath(id), dst.store.ObjectPath(id))
+	if nil != err {
+		return
+	}
+	copied[id] = true
+	if chunk {
+		stat.Chunks++
+	} else {
+		stat.Files++
+	}
+	stat.Bytes += size
+	return
+}
+
+// splitTags 用于在新仓库 dst 中为拆分后的索引创建原仓库中指向对应原索引的标签。
+func (repo *Repo) splitTags(dst *Repo, indexes map[string]string) (err error) {
+	entries, err := os.ReadDir(filepath.Join(repo.Path, "refs", "tags"))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		id, getErr := repo.GetTag(entry.Name())
+		if nil != getErr {
+			logging.LogWarnf("get tag [%s] failed: %s", entry.Name(), getErr)
+			continue
+		}
+		if newID := indexes[id]; "" != newID {
+			if err = dst.AddTag(newID, entry.Name()); nil != err {
+				return
+			}
+		}
+	}
+	return
+}
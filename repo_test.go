@@ -17,14 +17,27 @@
 package dejavu
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
 	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
 	"github.com/siyuan-note/encryption"
 	"github.com/siyuan-note/eventbus"
 )
@@ -85,6 +98,98 @@ func TestPurge(t *testing.T) {
 	t.Logf("purge stat: %#v", stat)
 }
 
+func TestResetClearCache(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if _, err := repo.GetIndex(index.ID); nil != err {
+		t.Fatalf("get index failed: %s", err)
+		return
+	}
+	indexCache.Wait()
+
+	if err := repo.Reset(); nil != err {
+		t.Fatalf("reset failed: %s", err)
+		return
+	}
+
+	if _, err := repo.GetIndex(index.ID); nil == err {
+		t.Fatalf("get index should be failed after reset")
+		return
+	}
+}
+
+func TestRemoveClearCache(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if _, err := repo.GetIndex(index.ID); nil != err {
+		t.Fatalf("get index failed: %s", err)
+		return
+	}
+	fileID := index.Files[0]
+	if _, err := repo.GetFile(fileID); nil != err {
+		t.Fatalf("get file failed: %s", err)
+		return
+	}
+	indexCache.Wait()
+	fileCache.Wait()
+
+	for _, id := range []string{index.ID, fileID} {
+		if err := repo.store.Remove(id); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+	}
+	if _, ok := indexCache.Get(index.ID); ok {
+		t.Fatalf("removed index should be evicted from cache")
+		return
+	}
+	if _, ok := fileCache.Get(fileID); ok {
+		t.Fatalf("removed file should be evicted from cache")
+		return
+	}
+}
+
+func TestMigrateObjectFormat(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	indexes, files, err := repo.MigrateObjectFormat(entity.FormatBinary)
+	if nil != err {
+		t.Fatalf("migrate failed: %s", err)
+		return
+	}
+	if 1 != indexes || len(index.Files) != files {
+		t.Fatalf("migrated count not match: [%d] indexes, [%d] files", indexes, files)
+		return
+	}
+
+	_, f := repo.store.IndexAbsPath(index.ID)
+	data, _ := os.ReadFile(f)
+	data, _ = repo.store.compressDecoder.DecodeAll(data, nil)
+	if entity.FormatBinary != entity.DataFormat(data) {
+		t.Fatalf("index format not match")
+		return
+	}
+
+	index2, err := repo.GetIndex(index.ID)
+	if nil != err {
+		t.Fatalf("get index failed: %s", err)
+		return
+	}
+	files2, err := repo.GetFiles(index2)
+	if nil != err || len(files2) != len(index.Files) {
+		t.Fatalf("get files failed: %v", err)
+		return
+	}
+
+	if indexes, files, err = repo.MigrateObjectFormat(entity.FormatBinary); nil != err || 0 != indexes || 0 != files {
+		t.Fatalf("migrate again should be no-op: [%d] indexes, [%d] files, %v", indexes, files, err)
+		return
+	}
+}
+
 func TestIndexCheckout(t *testing.T) {
 	clearTestdata(t)
 	subscribeEvents(t)
@@ -194,3 +299,2467 @@ func initIndex(t *testing.T) (repo *Repo, index *entity.Index) {
 func ignoreLines() []string {
 	return []string{"bar"}
 }
+
+func TestIgnoreRules(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "ignore-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	for name, content := range map[string]string{
+		"a.log": "a", "keep.log": "keep", "logs/x.log": "x", "logs/keep.log": "keep", "sub/b.log": "b", "sub/.syncignore": "!b.log",
+	} {
+		absPath := filepath.Join(dataPath, name)
+		if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	ignoreLines := []string{"*.log", "!keep.log", "logs/", "!logs/keep.log"}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	cases := []struct {
+		path    string
+		ignored bool
+		line    string
+	}{
+		{"/a.log", true, "*.log"},
+		{"/keep.log", false, "!keep.log"},
+		{"/logs/keep.log", true, "logs/"},
+		{"/sub/b.log", false, "!b.log"},
+	}
+	for _, c := range cases {
+		ignored, rule := repo.TestIgnore(c.path)
+		if c.ignored != ignored || nil == rule || c.line != rule.Line {
+			t.Fatalf("test ignore [%s] failed: ignored [%v], rule [%+v]", c.path, ignored, rule)
+			return
+		}
+	}
+
+	index, err := repo.Index("", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if 2 != len(index.Files) {
+		t.Fatalf("expected 2 indexed files, got [%d]", len(index.Files))
+		return
+	}
+}
+
+func TestSyncOptionsExcluded(t *testing.T) {
+	opts := &SyncOptions{MaxFileSize: 1024, ExcludedExtensions: []string{".mp4", "mov"}}
+	cases := []struct {
+		path     string
+		size     int64
+		excluded bool
+	}{
+		{"/assets/a.png", 512, false},
+		{"/assets/a.png", 2048, true},
+		{"/assets/a.MP4", 1, true},
+		{"/assets/a.mov", 1, true},
+		{"/assets/mov", 1, false},
+	}
+	for _, c := range cases {
+		if c.excluded != opts.Excluded(c.path, c.size) {
+			t.Fatalf("excluded [%s, %d] should be [%v]", c.path, c.size, c.excluded)
+			return
+		}
+	}
+
+	clearTestdata(t)
+	repo, index := initIndex(t)
+	repo.SyncOptions = SyncOptions{MaxFileSize: 1}
+	// 已经索引的文件被过滤后沿用最新索引中的文件对象
+	latest, err := repo.Index("", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if index.ID != latest.ID {
+		t.Fatalf("excluded files should be kept in latest index")
+		return
+	}
+	if err = os.RemoveAll(testRepoPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if repo, err = NewRepo(repo.DataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, repo.store.AesKey, ignoreLines(), nil); nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repo.SyncOptions = SyncOptions{MaxFileSize: 1}
+	if _, err = repo.Index("", true, map[string]interface{}{}); !errors.Is(err, ErrEmptyIndex) {
+		t.Fatalf("all files should be excluded: %v", err)
+		return
+	}
+}
+
+func TestListIndexTree(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "tree-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	for p, content := range map[string]string{"a/b.txt": "b", "a/c/d.txt": "dd", "e.txt": "eee"} {
+		absPath := filepath.Join(dataPath, p)
+		if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	index, err := repo.Index("tree", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	entries, err := repo.ListIndexTree(index.ID, "/")
+	if nil != err {
+		t.Fatalf("list index tree failed: %s", err)
+		return
+	}
+	if 2 != len(entries) || "a" != entries[0].Name || !entries[0].IsDir || 3 != entries[0].Size || "e.txt" != entries[1].Name || "" == entries[1].FileID {
+		t.Fatalf("root entries not match")
+		return
+	}
+
+	entries, err = repo.ListIndexTree(index.ID, "a")
+	if nil != err {
+		t.Fatalf("list index tree failed: %s", err)
+		return
+	}
+	if 2 != len(entries) || "/a/c" != entries[0].Path || "/a/b.txt" != entries[1].Path {
+		t.Fatalf("dir entries not match")
+		return
+	}
+}
+
+func TestSnapshotFS(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	fsys, err := repo.SnapshotFS(index.ID)
+	if nil != err {
+		t.Fatalf("snapshot fs failed: %s", err)
+		return
+	}
+	if err = fstest.TestFS(fsys, "foo"); nil != err {
+		t.Fatalf("test fs failed: %s", err)
+		return
+	}
+
+	data, err := fs.ReadFile(fsys, "foo")
+	if nil != err {
+		t.Fatalf("read file failed: %s", err)
+		return
+	}
+	expected, err := os.ReadFile(filepath.Join(testDataPath, "foo"))
+	if nil != err || !bytes.Equal(expected, data) {
+		t.Fatalf("file data not match: %v", err)
+		return
+	}
+}
+
+func TestCronSpec(t *testing.T) {
+	base := time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"0 * * * *":       time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC),
+		"@daily":          time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"*/20 9-17 * * *": time.Date(2024, 1, 31, 10, 40, 0, 0, time.UTC),
+		"0 0 29 2 *":      time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 12 * * 7":      time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC),
+		"0 0 1 * 1":       time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for spec, expected := range cases {
+		cron, err := parseCronSpec(spec)
+		if nil != err {
+			t.Fatalf("parse cron spec [%s] failed: %s", spec, err)
+			return
+		}
+		if next := cron.next(base); !next.Equal(expected) {
+			t.Fatalf("cron spec [%s] next [%s] not match [%s]", spec, next, expected)
+			return
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCronSpec(spec); nil == err {
+			t.Fatalf("parse cron spec [%s] should be failed", spec)
+			return
+		}
+	}
+}
+
+func TestSnapshotter(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "snapshotter-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "a.txt"), []byte("a"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	if _, err = NewSnapshotter(repo, []*Schedule{{Name: "bad", Spec: "bad"}}); !errors.Is(err, ErrInvalidCronSpec) {
+		t.Fatalf("new snapshotter should be failed: %v", err)
+		return
+	}
+
+	snapshotter, err := NewSnapshotter(repo, []*Schedule{{Name: "hourly", Spec: "@hourly", Memo: "{name} {time}"}})
+	if nil != err {
+		t.Fatalf("new snapshotter failed: %s", err)
+		return
+	}
+	snapshotter.Start()
+	defer snapshotter.Stop()
+
+	now := time.Date(2024, 1, 31, 11, 0, 0, 0, time.Local)
+	if s := snapshotter.snapshot(now); nil == s || "hourly" != s.Name {
+		t.Fatalf("schedule should be triggered")
+		return
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	if "hourly 2024-01-31 11:00" != latest.Memo {
+		t.Fatalf("memo [%s] not match", latest.Memo)
+		return
+	}
+	if nil != snapshotter.snapshot(now.Add(time.Minute)) {
+		t.Fatalf("schedule should not be triggered")
+		return
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	if err := os.RemoveAll(testHistoryPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	now := time.Now()
+	var names []string
+	for i := 0; i < 3; i++ {
+		name := now.Add(-time.Duration(i)*time.Hour).Format("2006-01-02-150405") + "-sync"
+		absPath := filepath.Join(testHistoryPath, name, "conflict.txt")
+		if err := os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err := os.WriteFile(absPath, []byte(name), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		names = append(names, name)
+	}
+	other := filepath.Join(testHistoryPath, "2000-01-01-000000-delete")
+	if err := os.MkdirAll(other, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+
+	stat, err := repo.CompactHistory(&HistoryRetention{MaxCount: 2, Snapshot: true})
+	if nil != err {
+		t.Fatalf("compact history failed: %s", err)
+		return
+	}
+	if 1 != stat.Removed || 1 != len(stat.Snapshots) {
+		t.Fatalf("compact stat not match")
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(testHistoryPath, names[2])) || !gulu.File.IsExist(filepath.Join(testHistoryPath, names[1])) || !gulu.File.IsExist(other) {
+		t.Fatalf("history dirs not match")
+		return
+	}
+
+	index, err := repo.GetIndex(stat.Snapshots[0])
+	if nil != err {
+		t.Fatalf("get index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err || 1 != len(files) || "/conflict.txt" != files[0].Path {
+		t.Fatalf("snapshot files not match: %v", err)
+		return
+	}
+	data, err := repo.OpenFile(files[0])
+	if nil != err || names[2] != string(data) {
+		t.Fatalf("snapshot file data not match: %v", err)
+		return
+	}
+
+	if stat, err = repo.CompactHistory(&HistoryRetention{MaxAge: 30 * time.Minute}); nil != err || 1 != stat.Removed {
+		t.Fatalf("compact history by age failed: %v", err)
+		return
+	}
+}
+
+func TestFindIndexes(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	older := &entity.Index{ID: util.RandHash(), Memo: "Older snapshot", Created: index.Created - 1000, SystemID: "other", Files: index.Files}
+	if err := repo.PutIndex(older); nil != err {
+		t.Fatalf("put index failed: %s", err)
+		return
+	}
+
+	indexes, err := repo.FindIndexes(&IndexFilter{})
+	if nil != err || 2 != len(indexes) || index.ID != indexes[0].ID {
+		t.Fatalf("find all indexes failed: %v", err)
+		return
+	}
+	if indexes, err = repo.FindIndexes(&IndexFilter{Memo: "older"}); nil != err || 1 != len(indexes) || older.ID != indexes[0].ID {
+		t.Fatalf("find indexes by memo failed: %v", err)
+		return
+	}
+	if indexes, err = repo.FindIndexes(&IndexFilter{SystemID: deviceID, From: index.Created}); nil != err || 1 != len(indexes) || index.ID != indexes[0].ID {
+		t.Fatalf("find indexes by system id failed: %v", err)
+		return
+	}
+	if indexes, err = repo.FindIndexes(&IndexFilter{MinChangedFiles: 1}); nil != err || 1 != len(indexes) || older.ID != indexes[0].ID {
+		t.Fatalf("find indexes by changed files failed: %v", err)
+		return
+	}
+}
+
+func TestPathEscaping(t *testing.T) {
+	clearTestdata(t)
+
+	for name, expected := range map[string]string{"aux.md": "au%78.md", "CON": "CO%4E", "a:b%.md": "a%3Ab%25.md", "a.": "a%2E", "100%.md": "100%.md", "auxiliary.md": "auxiliary.md"} {
+		if escaped := escapeWindowsName(name); expected != escaped {
+			t.Fatalf("escape [%s] expected [%s], got [%s]", name, expected, escaped)
+			return
+		}
+	}
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "escape-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	for _, p := range []string{"aux.md", "a:b/c?.md"} {
+		absPath := filepath.Join(dataPath, p)
+		if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(absPath, []byte(p), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repo.SetPathEscaping(PathEscapingNone)
+	index, err := repo.Index("escape", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	// 模拟在 Windows 上迁出 Linux 上创建的文件
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo.SetPathEscaping(PathEscapingWindows)
+	if _, _, err = repo.Checkout(index.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	for _, p := range []string{"au%78.md", "a%3Ab/c%3F.md"} {
+		if !gulu.File.IsExist(filepath.Join(dataPath, p)) {
+			t.Fatalf("escaped file [%s] should exist", p)
+			return
+		}
+	}
+
+	// 再次索引时还原为原始路径
+	reindex, err := repo.Index("escape again", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if reindex.ID != index.ID {
+		t.Fatalf("escaped paths should round-trip without changes")
+		return
+	}
+}
+
+func TestFileModeSymlink(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "mode-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	script := filepath.Join(dataPath, "run.sh")
+	if err = os.WriteFile(script, []byte("#!/bin/sh\necho ok\n"), 0755); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = os.Chmod(script, 0755); nil != err {
+		t.Fatalf("chmod failed: %s", err)
+		return
+	}
+	link := filepath.Join(dataPath, "link.sh")
+	if err = os.Symlink("run.sh", link); nil != err {
+		t.Fatalf("symlink failed: %s", err)
+		return
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	index, err := repo.Index("mode", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if _, _, err = repo.Checkout(index.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if info, statErr := os.Stat(script); nil != statErr || 0755 != info.Mode().Perm() {
+		t.Fatalf("executable bits should be restored: %v", statErr)
+		return
+	}
+	if target, readErr := os.Readlink(link); nil != readErr || "run.sh" != target {
+		t.Fatalf("symlink should be restored: %v", readErr)
+		return
+	}
+
+	reindex, err := repo.Index("mode again", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if reindex.ID != index.ID {
+		t.Fatalf("checked out files should not be changed")
+		return
+	}
+
+	// 权限位不参与计算文件 ID，升级前记录的可执行文件 ID 不变
+	if entity.NewFile("/run.sh", 1, 1000).ID != entity.NewFileWithMode("/run.sh", 1, 1000, 0755, "").ID {
+		t.Fatalf("mode should not change file id")
+		return
+	}
+
+	if err = os.Chmod(script, 0644); nil != err {
+		t.Fatalf("chmod failed: %s", err)
+		return
+	}
+	if err = os.Chtimes(script, time.Now(), time.Now().Add(time.Hour)); nil != err {
+		t.Fatalf("chtimes failed: %s", err)
+		return
+	}
+	reindex, err = repo.Index("mode changed", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if reindex.ID == index.ID {
+		t.Fatalf("mode change should be indexed")
+		return
+	}
+
+	// 指向迁出文件夹外的符号链接迁出为普通文件
+	escape := filepath.Join(dataPath, "escape.sh")
+	if err = os.Symlink("../outside.sh", escape); nil != err {
+		t.Fatalf("symlink failed: %s", err)
+		return
+	}
+	escapeIndex, err := repo.Index("escape", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if _, _, err = repo.Checkout(escapeIndex.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if info, statErr := os.Lstat(escape); nil != statErr || 0 != info.Mode()&os.ModeSymlink {
+		t.Fatalf("unsafe symlink should be checked out as regular file: %v", statErr)
+		return
+	}
+}
+
+func TestPreserveXattrs(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "xattr-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	p := filepath.Join(dataPath, "tagged.md")
+	if err = os.WriteFile(p, []byte("tagged"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = util.WriteXattrs(p, map[string][]byte{"user.tags": []byte("red")}); nil != err {
+		t.Skipf("xattrs are not supported: %s", err)
+		return
+	}
+	if xattrs, _ := util.ReadXattrs(p); "red" != string(xattrs["user.tags"]) {
+		t.Skipf("xattrs are not supported")
+		return
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repo.SetPreserveXattrs(true)
+	index, err := repo.Index("xattr", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if _, _, err = repo.Checkout(index.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	xattrs, err := util.ReadXattrs(p)
+	if nil != err || "red" != string(xattrs["user.tags"]) {
+		t.Fatalf("xattrs should be restored: %v", err)
+		return
+	}
+}
+
+func TestExtraRoots(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "roots-data")
+	rootPath, err := filepath.Abs(filepath.Join(testTempPath, "roots-templates"))
+	if nil != err {
+		t.Fatalf("abs failed: %s", err)
+		return
+	}
+	tplPath := filepath.Join(rootPath, "tpl", "b.md")
+	for name, content := range map[string]string{filepath.Join(dataPath, "a.md"): "a", tplPath: "b"} {
+		if err = os.RemoveAll(filepath.Dir(name)); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+		if err = os.MkdirAll(filepath.Dir(name), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(name, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if err = repo.SetRoots([]*Root{{Path: rootPath, Prefix: "/templates-ext"}, {Path: filepath.Join(rootPath, "tpl"), Prefix: "/other"}}); !errors.Is(err, ErrInvalidRoot) {
+		t.Fatalf("overlapped roots should be rejected: %v", err)
+		return
+	}
+	if err = repo.SetRoots([]*Root{{Path: rootPath, Prefix: "/templates-ext"}}); nil != err {
+		t.Fatalf("set roots failed: %s", err)
+		return
+	}
+
+	index, err := repo.Index("roots", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	if "/a.md,/templates-ext/tpl/b.md" != strings.Join(paths, ",") {
+		t.Fatalf("unexpected indexed paths [%s]", strings.Join(paths, ","))
+		return
+	}
+
+	if err = os.WriteFile(tplPath, []byte("changed"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = os.Chtimes(tplPath, time.Now().Add(time.Hour), time.Now().Add(time.Hour)); nil != err {
+		t.Fatalf("chtimes failed: %s", err)
+		return
+	}
+	extra := filepath.Join(rootPath, "extra.md")
+	if err = os.WriteFile(extra, []byte("extra"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if _, _, err = repo.Checkout(index.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if data, readErr := os.ReadFile(tplPath); nil != readErr || "b" != string(data) {
+		t.Fatalf("file in root should be restored: %v", readErr)
+		return
+	}
+	if gulu.File.IsExist(extra) {
+		t.Fatalf("file not in snapshot should be removed from root")
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(dataPath, "templates-ext")) {
+		t.Fatalf("file in root should not be checked out to data path")
+		return
+	}
+}
+
+func TestLinkCheckout(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "link-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	content := []byte("link checkout")
+	dataFile := filepath.Join(dataPath, "a.txt")
+	if err = os.WriteFile(dataFile, content, 0444); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+
+	cloudDir := t.TempDir()
+	cloudRepo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "link", UserID: "0", RepoPath: testRepoPath, Local: &cloud.ConfLocal{Endpoint: cloudDir}}}))
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if err = cloudRepo.SetLinkCheckout(LinkCheckoutHardlink); !errors.Is(err, ErrLinkCheckoutWithCloud) {
+		t.Fatalf("link checkout should be rejected with cloud: %v", err)
+		return
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if err = repo.SetLinkCheckout(LinkCheckoutHardlink); nil != err {
+		t.Fatalf("set link checkout failed: %s", err)
+		return
+	}
+	index, err := repo.Index("link", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err || 1 != len(files) || 1 != len(files[0].Chunks) {
+		t.Fatalf("get files failed: %v", err)
+		return
+	}
+	objPath := repo.store.ObjectPath(files[0].Chunks[0])
+	if data, readErr := os.ReadFile(objPath); nil != readErr || !bytes.Equal(content, data) {
+		t.Fatalf("chunk should be stored plain: %v", readErr)
+		return
+	}
+
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if _, _, err = repo.Checkout(index.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if data, readErr := os.ReadFile(dataFile); nil != readErr || !bytes.Equal(content, data) {
+		t.Fatalf("file should be checked out: %v", readErr)
+		return
+	}
+	objInfo, err := os.Stat(objPath)
+	if nil != err {
+		t.Fatalf("stat failed: %s", err)
+		return
+	}
+	dataInfo, err := os.Stat(dataFile)
+	if nil != err {
+		t.Fatalf("stat failed: %s", err)
+		return
+	}
+	if !os.SameFile(objInfo, dataInfo) && nil != util.CloneFile(objPath, filepath.Join(testTempPath, "link-clone")) {
+		t.Fatalf("file should be linked from chunk object")
+		return
+	}
+	if os.SameFile(objInfo, dataInfo) && 0644 != objInfo.Mode().Perm() {
+		// 硬链接的数据文件不恢复权限，否则会修改数据对象的权限
+		t.Fatalf("chunk object mode should not be changed by hardlinked checkout: %04o", objInfo.Mode().Perm())
+		return
+	}
+
+	if err = repo.SetLinkCheckout(LinkCheckoutNone); nil != err {
+		t.Fatalf("set link checkout failed: %s", err)
+		return
+	}
+	if chunk, getErr := repo.store.GetChunk(files[0].Chunks[0]); nil != getErr || !bytes.Equal(content, chunk.Data) {
+		t.Fatalf("plain chunk should be readable after disabling link checkout: %v", getErr)
+		return
+	}
+
+	// 关闭后配置云端存储服务，上传前明文分块对象需要重新压缩加密
+	linkCloud := cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "link", UserID: "0", RepoPath: testRepoPath, Local: &cloud.ConfLocal{Endpoint: cloudDir}}})
+	cloudRepo, err = NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), linkCloud)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if _, _, err = cloudRepo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	chunkID := files[0].Chunks[0]
+	uploaded, err := linkCloud.DownloadObject("objects/" + chunkID[:2] + "/" + chunkID[2:])
+	if nil != err {
+		t.Fatalf("download chunk failed: %s", err)
+		return
+	}
+	if bytes.Equal(content, uploaded) || cloudRepo.store.isPlainChunk(chunkID, uploaded) {
+		t.Fatalf("plain chunk should not be uploaded")
+		return
+	}
+	if chunk, getErr := cloudRepo.store.GetChunk(chunkID); nil != getErr || !bytes.Equal(content, chunk.Data) {
+		t.Fatalf("sealed chunk should be readable: %v", getErr)
+		return
+	}
+	if data, readErr := os.ReadFile(dataFile); nil != readErr || !bytes.Equal(content, data) {
+		t.Fatalf("hardlinked data file should not be changed by sealing: %v", readErr)
+		return
+	}
+}
+
+func TestAssembleFile(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	content := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(367)).Read(content)
+	for _, plain := range []bool{false, true} {
+		dataPath := filepath.Join(testTempPath, "assemble-data")
+		if err = os.RemoveAll(dataPath); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+		if err = os.RemoveAll(testRepoPath); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+		if err = os.MkdirAll(dataPath, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		dataFile := filepath.Join(dataPath, "big.bin")
+		if err = os.WriteFile(dataFile, content, 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+
+		repo, newErr := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+		if nil != newErr {
+			t.Fatalf("new repo failed: %s", newErr)
+			return
+		}
+		if plain {
+			if err = repo.SetLinkCheckout(LinkCheckoutClone); nil != err {
+				t.Fatalf("set link checkout failed: %s", err)
+				return
+			}
+		}
+		index, indexErr := repo.Index("assemble", true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		files, getErr := repo.GetFiles(index)
+		if nil != getErr || 1 != len(files) || 2 > len(files[0].Chunks) {
+			t.Fatalf("file should be split into chunks: %v", getErr)
+			return
+		}
+
+		if err = os.RemoveAll(dataPath); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+		if _, _, err = repo.Checkout(index.ID, map[string]interface{}{}); nil != err {
+			t.Fatalf("checkout failed: %s", err)
+			return
+		}
+		if data, readErr := os.ReadFile(dataFile); nil != readErr || !bytes.Equal(content, data) {
+			t.Fatalf("assembled file [plain=%v] mismatch: %v", plain, readErr)
+			return
+		}
+	}
+}
+
+func TestRetryLocked(t *testing.T) {
+	var lockedErr error = &fs.PathError{Op: "remove", Path: "/foo", Err: syscall.EBUSY}
+	if "windows" == runtime.GOOS {
+		lockedErr = &fs.PathError{Op: "remove", Path: "/foo", Err: syscall.Errno(32)} // ERROR_SHARING_VIOLATION
+	}
+	attempts := 0
+	err := retryLocked(func() error {
+		if attempts++; 3 > attempts {
+			return lockedErr
+		}
+		return nil
+	})
+	if nil != err || 3 != attempts {
+		t.Fatalf("retry locked should succeed after [3] attempts, got [%d]: %v", attempts, err)
+		return
+	}
+
+	attempts = 0
+	notLockedErr := errors.New("The process cannot access the file because it is being used by another process.") // 不按错误信息判断
+	if err = retryLocked(func() error { attempts++; return notLockedErr }); notLockedErr != err || 1 != attempts {
+		t.Fatalf("retry locked should not retry other errors, attempts [%d]: %v", attempts, err)
+		return
+	}
+
+	err = &LockedFilesError{Paths: []string{"/foo"}, Err: lockedErr}
+	if !errors.Is(err, ErrFileLocked) || !errors.Is(err, lockedErr) {
+		t.Fatalf("locked files error should match [%s] and the original error", ErrFileLocked)
+		return
+	}
+}
+
+func TestSoftLimitWarnings(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	repo.SoftLimits = SoftLimits{MaxFileSize: 1}
+	index, err := repo.Index("soft limits", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if 1 != len(index.Warnings) || entity.WarningLargeFile != index.Warnings[0].Code || "/foo" != index.Warnings[0].Path {
+		t.Fatalf("large file warning expected, got [%d]", len(index.Warnings))
+		return
+	}
+	latest, err := repo.Latest()
+	if nil != err || 0 != len(latest.Warnings) {
+		t.Fatalf("warnings should not be kept in cached index: %v", err)
+		return
+	}
+
+	repo.SoftLimits = DefaultSoftLimits
+	if index, err = repo.Index("soft limits", true, map[string]interface{}{}); nil != err || 0 != len(index.Warnings) {
+		t.Fatalf("no warnings expected with default soft limits: %v", err)
+		return
+	}
+}
+
+func TestGetStat(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	stat, err := repo.GetStat()
+	if nil != err {
+		t.Fatalf("get stat failed: %s", err)
+		return
+	}
+	if 1 != stat.Snapshots || 1 != stat.Files || 5 != stat.LogicalBytes || 1 != stat.Chunks || 5 != stat.AvgChunkSize {
+		t.Fatalf("unexpected stat: %+v", stat)
+		return
+	}
+	if 1 > stat.Objects || 1 > stat.StoredBytes || index.Created != stat.LastIndex || 0 != stat.LastSync {
+		t.Fatalf("unexpected stat: %+v", stat)
+		return
+	}
+	if 1 != len(stat.LargestFiles) || "/foo" != stat.LargestFiles[0].Path {
+		t.Fatalf("unexpected largest files")
+		return
+	}
+
+	objects := stat.Objects
+	if _, err = repo.Index("stat", true, map[string]interface{}{}); nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if stat, err = repo.GetStat(); nil != err {
+		t.Fatalf("get stat failed: %s", err)
+		return
+	}
+	if 1 != stat.Snapshots || objects != stat.Objects {
+		t.Fatalf("unexpected stat: %+v", stat)
+		return
+	}
+}
+
+func TestGetHistoryUsage(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	usages, err := repo.GetHistoryUsage(10)
+	if nil != err {
+		t.Fatalf("get history usage failed: %s", err)
+		return
+	}
+	if 1 != len(usages) || "/foo" != usages[0].Path || 1 != usages[0].Versions {
+		t.Fatalf("unexpected history usage [%d]", len(usages))
+		return
+	}
+	if 1 > usages[0].StoredBytes || usages[0].StoredBytes != usages[0].ExclusiveBytes {
+		t.Fatalf("unexpected history usage bytes [%d, %d]", usages[0].StoredBytes, usages[0].ExclusiveBytes)
+		return
+	}
+}
+
+func TestCheckoutFiles(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dataPath := filepath.Join(testTempPath, "checkout-files-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	for i := 0; i < 32; i++ {
+		dir := filepath.Join(dataPath, "dir"+strconv.Itoa(i%4))
+		if err = os.MkdirAll(dir, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(filepath.Join(dir, strconv.Itoa(i)+".txt"), []byte("file "+strconv.Itoa(i)), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repo.SetCheckoutConcurrency(4)
+	index, err := repo.Index("checkout files", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err || 32 != len(files) {
+		t.Fatalf("get files failed: %v", err)
+		return
+	}
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+
+	var progress int64
+	eventbus.Subscribe(eventbus.EvtCheckoutUpsertFile, func(context map[string]interface{}, count, total int) {
+		if nil != context["checkoutFiles"] {
+			atomic.AddInt64(&progress, 1)
+		}
+	})
+	missing := entity.NewFile("/missing.txt", 4, time.Now().UnixMilli())
+	missing.Chunks = []string{"0000000000000000000000000000000000000000"}
+	failed, err := repo.CheckoutFiles(append(files, missing), map[string]interface{}{"checkoutFiles": true})
+	if nil == err || 1 != len(failed) || "/missing.txt" != failed[0] {
+		t.Fatalf("unexpected failed files %v: %v", failed, err)
+		return
+	}
+	if 32 != atomic.LoadInt64(&progress) {
+		t.Fatalf("unexpected progress events [%d]", progress)
+		return
+	}
+	for _, file := range files {
+		data, readErr := os.ReadFile(filepath.Join(dataPath, file.Path))
+		if nil != readErr || !strings.HasPrefix(string(data), "file ") {
+			t.Fatalf("file [%s] not checked out: %v", file.Path, readErr)
+			return
+		}
+	}
+}
+
+func TestRepoOptions(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "options-data")
+	for name, content := range map[string]string{"a.tmp": "a", "b.part": "b", "c.sy": "c"} {
+		absPath := filepath.Join(dataPath, name)
+		if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	indexPaths := func(repo *Repo) (ret map[string]bool) {
+		ret = map[string]bool{}
+		index, indexErr := repo.Index("options", true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		files, indexErr := repo.GetFiles(index)
+		if nil != indexErr {
+			t.Fatalf("get files failed: %s", indexErr)
+			return
+		}
+		for _, file := range files {
+			ret[file.Path] = true
+		}
+		return
+	}
+
+	defaultRepo, err := NewRepo(dataPath, filepath.Join(testTempPath, "options-repo-default"), testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	paths := indexPaths(defaultRepo)
+	if paths["/a.tmp"] || !paths["/b.part"] || !paths["/c.sy"] {
+		t.Fatalf("unexpected default indexed files: %v", paths)
+		return
+	}
+
+	opts := &RepoOptions{MergeMemo: "[Custom] merge", TmpFileSuffixes: []string{".part"}}
+	customRepo, err := NewRepoWithOptions(dataPath, filepath.Join(testTempPath, "options-repo-custom"), testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil, opts)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	paths = indexPaths(customRepo)
+	if !paths["/a.tmp"] || paths["/b.part"] || !paths["/c.sy"] {
+		t.Fatalf("unexpected custom indexed files: %v", paths)
+		return
+	}
+
+	got := customRepo.GetOptions()
+	if "[Custom] merge" != got.MergeMemo || DefaultRepoOptions().PreMergeSnapshotMemo != got.PreMergeSnapshotMemo {
+		t.Fatalf("unexpected options: %+v", got)
+		return
+	}
+	if "[Sync] Cloud sync merge" != defaultRepo.GetOptions().MergeMemo {
+		t.Fatalf("default repo options changed")
+		return
+	}
+}
+
+func TestPerRepoLock(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	repoA, err := NewRepo(testDataPath, filepath.Join(testTempPath, "lock-repo-a"), testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repoB, err := NewRepo(testDataPath, filepath.Join(testTempPath, "lock-repo-b"), testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	// 仓库 A 正忙时仓库 B 仍然可以建立索引
+	repoA.lock.Lock()
+	defer repoA.lock.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, indexErr := repoB.Index("Index B", true, map[string]interface{}{})
+		done <- indexErr
+	}()
+
+	select {
+	case err = <-done:
+		if nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("index of repo B is blocked by repo A")
+		return
+	}
+}
+
+func TestIndexAnnotations(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if t.Failed() {
+		return
+	}
+	_, indexFile := repo.store.IndexAbsPath(index.ID)
+	before, err := os.ReadFile(indexFile)
+	if nil != err {
+		t.Fatalf("read index failed: %s", err)
+		return
+	}
+
+	if err = repo.SetIndexMemo(index.ID, "verified restore tested"); nil != err {
+		t.Fatalf("set memo failed: %s", err)
+		return
+	}
+	if err = repo.SetAnnotation(index.ID, "release", "v1.0.0"); nil != err {
+		t.Fatalf("set annotation failed: %s", err)
+		return
+	}
+	if err = repo.SetAnnotation(index.ID, "bad key", "x"); !errors.Is(err, ErrInvalidAnnotationKey) {
+		t.Fatalf("invalid key should be rejected: %v", err)
+		return
+	}
+
+	after, err := os.ReadFile(indexFile)
+	if nil != err {
+		t.Fatalf("read index failed: %s", err)
+		return
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("index object should not be changed")
+		return
+	}
+
+	logs, _, _, err := repo.GetIndexLogs(1, 10)
+	if nil != err || 1 > len(logs) {
+		t.Fatalf("get index logs failed: %v", err)
+		return
+	}
+	if "verified restore tested" != logs[0].Memo || "v1.0.0" != logs[0].Annotations["release"] {
+		t.Fatalf("unexpected log [%s]", logs[0])
+		return
+	}
+	found, err := repo.FindIndexes(&IndexFilter{Memo: "restore tested"})
+	if nil != err || 1 != len(found) {
+		t.Fatalf("find indexes by edited memo failed: %v", err)
+		return
+	}
+
+	if err = repo.SetIndexMemo(index.ID, ""); nil != err {
+		t.Fatalf("reset memo failed: %s", err)
+		return
+	}
+	if err = repo.SetAnnotation(index.ID, "release", ""); nil != err {
+		t.Fatalf("remove annotation failed: %s", err)
+		return
+	}
+	annotations, err := repo.GetAnnotations(index.ID)
+	if nil != err {
+		t.Fatalf("get annotations failed: %s", err)
+		return
+	}
+	if "" != annotations.Memo || 0 != len(annotations.Annotations) {
+		t.Fatalf("unexpected annotations: %+v", annotations)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(repo.Path, "annotations", index.ID+".json")) {
+		t.Fatalf("empty annotations should be removed")
+		return
+	}
+}
+
+func TestGetIndexesPage(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "page-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		if err = os.WriteFile(filepath.Join(dataPath, strconv.Itoa(i)+".txt"), []byte(strconv.Itoa(i)), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		index, indexErr := repo.Index("page "+strconv.Itoa(i), true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		ids = append([]string{index.ID}, ids...)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	check := func() {
+		page, total, pageErr := repo.GetIndexesPage(1, 2)
+		if nil != pageErr {
+			t.Fatalf("get indexes page failed: %s", pageErr)
+			return
+		}
+		if 5 != total || 2 != len(page) || ids[1] != page[0].ID || ids[2] != page[1].ID {
+			t.Fatalf("unexpected page, total [%d], count [%d]", total, len(page))
+			return
+		}
+
+		var iterated []string
+		if err = repo.IterateIndexes(func(index *entity.Index) bool {
+			iterated = append(iterated, index.ID)
+			return 3 > len(iterated)
+		}); nil != err {
+			t.Fatalf("iterate indexes failed: %s", err)
+			return
+		}
+		if 3 != len(iterated) || ids[0] != iterated[0] || ids[2] != iterated[2] {
+			t.Fatalf("unexpected iterated indexes %v", iterated)
+			return
+		}
+	}
+	check()
+
+	// 重复记录去重，日志丢失后根据索引文件夹重建
+	f, err := os.OpenFile(filepath.Join(repo.Path, indexLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if nil != err {
+		t.Fatalf("open index log failed: %s", err)
+		return
+	}
+	latest, _ := repo.store.GetIndex(ids[0])
+	f.WriteString(formatIndexLogEntry(&indexLogEntry{ID: latest.ID, Created: latest.Created}))
+	f.Close()
+	check()
+	if err = os.Remove(filepath.Join(repo.Path, indexLogFile)); nil != err {
+		t.Fatalf("remove index log failed: %s", err)
+		return
+	}
+	check()
+}
+
+func TestCompactIndexLog(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "compact-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "1.txt"), []byte("1"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	index, err := repo.Index("Index 1", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	// 模拟崩溃后的日志：重复、悬空、顺序错误的记录，并且缺失已经写入的索引
+	dangling := strings.Repeat("a", 40)
+	entries := []*indexLogEntry{
+		{ID: index.ID, Created: index.Created},
+		{ID: dangling, Created: index.Created - 1000},
+		{ID: index.ID, Created: index.Created},
+	}
+	var data []byte
+	for _, entry := range entries {
+		data = append(data, formatIndexLogEntry(entry)...)
+	}
+	if err = os.WriteFile(filepath.Join(repo.Path, indexLogFile), data, 0644); nil != err {
+		t.Fatalf("write index log failed: %s", err)
+		return
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err = os.WriteFile(filepath.Join(dataPath, "2.txt"), []byte("2"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	second, err := repo.Index("Index 2", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if second.ID == index.ID {
+		t.Fatalf("expected a new index")
+		return
+	}
+	if err = os.WriteFile(filepath.Join(repo.Path, indexLogFile), data, 0644); nil != err {
+		t.Fatalf("write index log failed: %s", err)
+		return
+	}
+
+	compaction, err := repo.CompactIndexLog()
+	if nil != err {
+		t.Fatalf("compact index log failed: %s", err)
+		return
+	}
+	if 2 != compaction.Kept || 2 != compaction.Removed() || 1 != len(compaction.Dangling) || dangling != compaction.Dangling[0] ||
+		1 != len(compaction.Duplicates) || 1 != len(compaction.Recovered) || second.ID != compaction.Recovered[0] || !compaction.Reordered {
+		t.Fatalf("unexpected compaction: %+v", compaction)
+		return
+	}
+
+	indexes, total, err := repo.GetIndexesPage(0, 10)
+	if nil != err || 2 != total || 2 != len(indexes) || second.ID != indexes[0].ID || index.ID != indexes[1].ID {
+		t.Fatalf("unexpected indexes after compaction: %v", err)
+		return
+	}
+
+	compaction, err = repo.CompactIndexLog()
+	if nil != err || 0 != compaction.Removed() || 0 != len(compaction.Recovered) || compaction.Reordered {
+		t.Fatalf("compacted log should be stable: %+v, %v", compaction, err)
+		return
+	}
+}
+
+func TestMigrateRepo(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if t.Failed() {
+		return
+	}
+	defer clearTestdata(t) // 避免二进制格式的仓库影响后续测试
+
+	// 模拟旧版本仓库：没有校验索引和完整文件列表缓存，切换编码格式后留下旧格式的索引
+	if err := os.Remove(filepath.Join(repo.Path, "full-latest.json")); nil != err {
+		t.Fatalf("remove full latest failed: %s", err)
+		return
+	}
+	repo.SetObjectFormat(entity.FormatBinary)
+
+	var steps []string
+	eventbus.Subscribe(EvtMigrateStep, func(context map[string]interface{}, step string, current, total int) {
+		steps = append(steps, step)
+	})
+	migration, err := repo.Migrate(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("migrate failed: %s", err)
+		return
+	}
+	if !migration.CheckIndex || !migration.FullLatest || 1 > migration.Indexes || 9 != len(steps) {
+		t.Fatalf("unexpected migration: %+v, steps %v", migration, steps)
+		return
+	}
+	if !gulu.File.IsExist(filepath.Join(migration.BackupPath, "refs", "latest")) || !gulu.File.IsExist(filepath.Join(migration.BackupPath, "indexes", index.ID)) {
+		t.Fatalf("metadata should be backed up")
+		return
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	if "" == latest.CheckIndexID || nil == repo.getFullLatest(latest) {
+		t.Fatalf("latest should be migrated")
+		return
+	}
+	_, indexFile := repo.store.IndexAbsPath(latest.ID)
+	data, err := os.ReadFile(indexFile)
+	if nil != err {
+		t.Fatalf("read index failed: %s", err)
+		return
+	}
+	if data, err = repo.store.compressDecoder.DecodeAll(data, nil); nil != err || entity.FormatBinary != entity.DataFormat(data) {
+		t.Fatalf("index should be rewritten in binary format")
+		return
+	}
+
+	migration, err = repo.Migrate(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("migrate again failed: %s", err)
+		return
+	}
+	if migration.CheckIndex || migration.FullLatest || 0 != migration.Indexes || 0 != migration.Files {
+		t.Fatalf("migration should be idempotent: %+v", migration)
+		return
+	}
+}
+
+func TestOpenRepoReadOnly(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if t.Failed() {
+		return
+	}
+	if err := os.Remove(filepath.Join(testRepoPath, indexLogFile)); nil != err {
+		t.Fatalf("remove index log failed: %s", err)
+		return
+	}
+	snapshot := func() (ret map[string]string) {
+		ret = map[string]string{}
+		filepath.WalkDir(testRepoPath, func(path string, d fs.DirEntry, err error) error {
+			if nil != err {
+				return err
+			}
+			info, err := d.Info()
+			if nil != err {
+				return err
+			}
+			ret[path] = strconv.FormatInt(info.Size(), 10) + " " + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+			return nil
+		})
+		return
+	}
+	before := snapshot()
+
+	readOnly, err := OpenRepoReadOnly(testRepoPath, repo.store.AesKey)
+	if nil != err {
+		t.Fatalf("open repo read only failed: %s", err)
+		return
+	}
+	if !readOnly.IsReadOnly() {
+		t.Fatalf("repo should be read only")
+		return
+	}
+	if _, err = OpenRepoReadOnly(filepath.Join(testTempPath, "readonly-missing"), repo.store.AesKey); !os.IsNotExist(err) {
+		t.Fatalf("open missing repo should fail: %v", err)
+		return
+	}
+
+	indexes, _, _, err := readOnly.GetIndexes(1, 10)
+	if nil != err || 1 != len(indexes) || index.ID != indexes[0].ID {
+		t.Fatalf("get indexes failed: %v", err)
+		return
+	}
+	if _, err = readOnly.DiffIndex(index.ID, index.ID); nil != err {
+		t.Fatalf("diff index failed: %s", err)
+		return
+	}
+	if _, err = readOnly.GetStat(); nil != err {
+		t.Fatalf("get stat failed: %s", err)
+		return
+	}
+
+	checkoutDir := filepath.Join(testTempPath, "readonly-checkout")
+	files, err := readOnly.CheckoutTo(index.ID, checkoutDir, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("checkout to failed: %s", err)
+		return
+	}
+	if len(files) != index.Count {
+		t.Fatalf("checkout files [%d] not match index count [%d]", len(files), index.Count)
+		return
+	}
+	for _, file := range files {
+		if !gulu.File.IsExist(filepath.Join(checkoutDir, file.Path)) {
+			t.Fatalf("file [%s] not checked out", file.Path)
+			return
+		}
+	}
+	if _, err = readOnly.CheckoutTo(index.ID, filepath.Join(testRepoPath, "checkout"), map[string]interface{}{}); !errors.Is(err, ErrInvalidCheckoutDir) {
+		t.Fatalf("checkout into repo should be rejected: %v", err)
+		return
+	}
+
+	if _, err = readOnly.Index("read only", true, map[string]interface{}{}); !errors.Is(err, ErrRepoReadOnly) {
+		t.Fatalf("index should be rejected: %v", err)
+		return
+	}
+	if err = readOnly.AddTag(index.ID, "v1"); !errors.Is(err, ErrRepoReadOnly) {
+		t.Fatalf("add tag should be rejected: %v", err)
+		return
+	}
+	if _, _, err = readOnly.Checkout(index.ID, map[string]interface{}{}); !errors.Is(err, ErrRepoReadOnly) {
+		t.Fatalf("checkout should be rejected: %v", err)
+		return
+	}
+	if err = readOnly.PutIndex(index); !errors.Is(err, ErrRepoReadOnly) {
+		t.Fatalf("put index should be rejected: %v", err)
+		return
+	}
+
+	after := snapshot()
+	if len(before) != len(after) {
+		t.Fatalf("repo files changed [%d -> %d]", len(before), len(after))
+		return
+	}
+	for path, stat := range before {
+		if after[path] != stat {
+			t.Fatalf("repo file [%s] changed", path)
+			return
+		}
+	}
+}
+
+func TestCopyRepo(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if t.Failed() {
+		return
+	}
+	if err := repo.AddTag(index.ID, "v1"); nil != err {
+		t.Fatalf("add tag failed: %s", err)
+		return
+	}
+
+	if _, err := repo.CopyTo(filepath.Join(testRepoPath, "copy"), map[string]interface{}{}); !errors.Is(err, ErrInvalidCopyDst) {
+		t.Fatalf("copy into repo should be rejected: %v", err)
+		return
+	}
+	dir := t.TempDir()
+	nonEmpty := filepath.Join(dir, "copy-non-empty")
+	if err := os.MkdirAll(nonEmpty, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err := gulu.File.WriteFileSafer(filepath.Join(nonEmpty, "foo"), []byte("foo"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if _, err := repo.CopyTo(nonEmpty, map[string]interface{}{}); !errors.Is(err, ErrInvalidCopyDst) {
+		t.Fatalf("copy into non-empty dir should be rejected: %v", err)
+		return
+	}
+
+	dstPath := filepath.Join(dir, "copy-repo")
+	copied, err := repo.CopyTo(dstPath, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("copy repo failed: %s", err)
+		return
+	}
+	if 1 > copied.Objects || 1 > copied.Files || 1 > copied.Bytes {
+		t.Fatalf("unexpected copy result: %+v", copied)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(dir, ".copy-repo.copying")) {
+		t.Fatalf("copy staging dir should be removed")
+		return
+	}
+
+	dst, err := OpenRepoReadOnly(dstPath, repo.store.AesKey)
+	if nil != err {
+		t.Fatalf("open copied repo failed: %s", err)
+		return
+	}
+	latest, err := dst.Latest()
+	if nil != err || index.ID != latest.ID {
+		t.Fatalf("copied latest mismatch: %v", err)
+		return
+	}
+	if id, tagErr := dst.GetTag("v1"); nil != tagErr || index.ID != id {
+		t.Fatalf("copied tag mismatch: %v", tagErr)
+		return
+	}
+	files, err := dst.CheckoutTo(index.ID, filepath.Join(dir, "copy-checkout"), map[string]interface{}{})
+	if nil != err || len(files) != index.Count {
+		t.Fatalf("checkout copied repo failed: %v", err)
+		return
+	}
+}
+
+func TestSplitRepo(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "split-data")
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	var indexes []*entity.Index
+	for i, write := range []map[string]string{
+		{"a/1.txt": "1", "b/2.txt": "2"},
+		{"a/1.txt": "11"},
+		{"b/2.txt": "22"},
+	} {
+		for p, data := range write {
+			if err = os.MkdirAll(filepath.Dir(filepath.Join(dataPath, p)), 0755); nil != err {
+				t.Fatalf("mkdir failed: %s", err)
+				return
+			}
+			if err = os.WriteFile(filepath.Join(dataPath, p), []byte(data), 0644); nil != err {
+				t.Fatalf("write file failed: %s", err)
+				return
+			}
+			updated := time.Now().Add(time.Duration(i) * time.Minute)
+			if err = os.Chtimes(filepath.Join(dataPath, p), updated, updated); nil != err {
+				t.Fatalf("change time failed: %s", err)
+				return
+			}
+		}
+		index, indexErr := repo.Index("Index "+strconv.Itoa(i+1), true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		indexes = append(indexes, index)
+	}
+	if err = repo.AddTag(indexes[0].ID, "v1"); nil != err {
+		t.Fatalf("add tag failed: %s", err)
+		return
+	}
+
+	dstPath := filepath.Join(dir, "split-repo")
+	if _, err = repo.SplitTo(dstPath, "/", nil, map[string]interface{}{}); !errors.Is(err, ErrInvalidSplitPrefix) {
+		t.Fatalf("split root should be rejected: %v", err)
+		return
+	}
+	split, err := repo.SplitTo(dstPath, "/a/", nil, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("split repo failed: %s", err)
+		return
+	}
+	if 3 != len(split.Indexes) || 2 != split.Files || 2 != split.Chunks {
+		t.Fatalf("unexpected split result: %+v", split)
+		return
+	}
+
+	dst, err := OpenRepoReadOnly(dstPath, aesKey)
+	if nil != err {
+		t.Fatalf("open split repo failed: %s", err)
+		return
+	}
+	latest, err := dst.Latest()
+	if nil != err || split.Indexes[indexes[2].ID] != latest.ID || indexes[2].Created != latest.Created {
+		t.Fatalf("split latest mismatch: %v", err)
+		return
+	}
+	files, err := dst.GetFiles(latest)
+	if nil != err || 1 != len(files) || "/a/1.txt" != files[0].Path {
+		t.Fatalf("split latest files mismatch: %v", err)
+		return
+	}
+	data, err := dst.OpenFile(files[0])
+	if nil != err || "11" != string(data) {
+		t.Fatalf("split file content mismatch: %v", err)
+		return
+	}
+	if id, tagErr := dst.GetTag("v1"); nil != tagErr || split.Indexes[indexes[0].ID] != id {
+		t.Fatalf("split tag mismatch: %v", tagErr)
+		return
+	}
+	if splitIndexes, _, _, getErr := dst.GetIndexes(1, 10); nil != getErr || 3 != len(splitIndexes) {
+		t.Fatalf("split indexes mismatch: %v", getErr)
+		return
+	}
+}
+
+func TestIndexPaths(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dataPath := filepath.Join(testTempPath, "index-paths-data")
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	write := func(p, data string, updated time.Time) bool {
+		absPath := filepath.Join(dataPath, p)
+		if err := os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return false
+		}
+		if err := os.WriteFile(absPath, []byte(data), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return false
+		}
+		if err := os.Chtimes(absPath, updated, updated); nil != err {
+			t.Fatalf("change time failed: %s", err)
+			return false
+		}
+		return true
+	}
+	now := time.Now()
+	if !write("a/1.txt", "1", now) || !write("b/2.txt", "2", now) || !write("c/3.txt", "3", now) {
+		return
+	}
+	first, err := repo.Index("Index 1", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	firstFiles, err := repo.GetFiles(first)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+
+	later := now.Add(time.Minute)
+	if !write("a/1.txt", "11", later) || !write("a/new.txt", "new", later) || !write("b/2.txt", "22", later) {
+		return
+	}
+	if err = os.Remove(filepath.Join(dataPath, "c", "3.txt")); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+		return
+	}
+
+	index, err := repo.IndexPaths([]string{"a", "/a/1.txt", "/c/3.txt"}, "Index paths", map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index paths failed: %s", err)
+		return
+	}
+	if first.ID == index.ID || 3 != index.Count {
+		t.Fatalf("unexpected index [count=%d]", index.Count)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	paths := map[string]*entity.File{}
+	for _, file := range files {
+		paths[file.Path] = file
+	}
+	if nil == paths["/a/1.txt"] || nil == paths["/a/new.txt"] || nil != paths["/c/3.txt"] {
+		t.Fatalf("unexpected files: %v", paths)
+		return
+	}
+	for _, file := range firstFiles {
+		if "/b/2.txt" == file.Path && file.ID != paths["/b/2.txt"].ID {
+			t.Fatalf("file not in paths should reuse latest file object")
+			return
+		}
+	}
+	if data, openErr := repo.OpenFile(paths["/a/1.txt"]); nil != openErr || "11" != string(data) {
+		t.Fatalf("indexed file content mismatch: %v", openErr)
+		return
+	}
+
+	unchanged, err := repo.IndexPaths([]string{"/a"}, "Index paths again", map[string]interface{}{})
+	if nil != err || index.ID != unchanged.ID {
+		t.Fatalf("unchanged paths should return latest: %v", err)
+		return
+	}
+	full, err := repo.Index("Index 3", true, map[string]interface{}{})
+	if nil != err || index.ID == full.ID {
+		t.Fatalf("full index should pick up changes outside paths: %v", err)
+		return
+	}
+}
+
+func TestChanges(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dataPath := filepath.Join(t.TempDir(), "changes-data")
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	now := time.Now()
+	for p, data := range map[string]string{"a/1.txt": "1", "b/2.txt": "2"} {
+		absPath := filepath.Join(dataPath, p)
+		if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(absPath, []byte(data), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if err = os.Chtimes(absPath, now, now); nil != err {
+			t.Fatalf("change time failed: %s", err)
+			return
+		}
+	}
+	first, err := repo.Index("Index 1", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	later := now.Add(time.Minute)
+	if err = os.WriteFile(filepath.Join(dataPath, "a", "1.txt"), []byte("11"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = os.Chtimes(filepath.Join(dataPath, "a", "1.txt"), later, later); nil != err {
+		t.Fatalf("change time failed: %s", err)
+		return
+	}
+	if err = os.Rename(filepath.Join(dataPath, "b", "2.txt"), filepath.Join(dataPath, "b", "3.txt")); nil != err {
+		t.Fatalf("rename file failed: %s", err)
+		return
+	}
+	second, err := repo.Index("Index 2", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	changes, err := repo.Changes("")
+	if nil != err {
+		t.Fatalf("get changes failed: %s", err)
+		return
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.IndexID[:7]+" "+change.Type+" "+change.OldPath+">"+change.Path)
+	}
+	expected := []string{
+		first.ID[:7] + " upsert >/a/1.txt",
+		first.ID[:7] + " upsert >/b/2.txt",
+		second.ID[:7] + " upsert >/a/1.txt",
+		second.ID[:7] + " rename /b/2.txt>/b/3.txt",
+	}
+	if strings.Join(expected, "\n") != strings.Join(got, "\n") {
+		t.Fatalf("unexpected changes:\n%s", strings.Join(got, "\n"))
+		return
+	}
+	if "" != changes[0].PrevIndexID || first.ID != changes[2].PrevIndexID {
+		t.Fatalf("unexpected previous index IDs")
+		return
+	}
+
+	changes, err = repo.Changes(first.ID)
+	if nil != err || 2 != len(changes) || second.ID != changes[0].IndexID {
+		t.Fatalf("get changes since first index failed: %v", err)
+		return
+	}
+	if changes, err = repo.Changes(second.ID); nil != err || 0 != len(changes) {
+		t.Fatalf("get changes since latest index failed: %v", err)
+		return
+	}
+	if _, err = repo.Changes(strings.Repeat("a", 40)); !errors.Is(err, ErrNotFoundIndex) {
+		t.Fatalf("unknown index should be rejected: %v", err)
+		return
+	}
+}
+
+func TestFsck(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dataPath := filepath.Join(testTempPath, "fsck-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err = os.WriteFile(filepath.Join(dataPath, name), []byte(name), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	index, err := repo.Index("Index 1", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	report, err := repo.Fsck(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("fsck failed: %s", err)
+		return
+	}
+	if !report.Healthy() || 1 != report.Indexes || index.Count != report.Files || 1 > report.Chunks {
+		t.Fatalf("unexpected fsck report: %+v", report)
+		return
+	}
+
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	missing, corrupt := files[0].Chunks[0], files[1].Chunks[0]
+	if err = os.Remove(repo.store.ObjectPath(missing)); nil != err {
+		t.Fatalf("remove chunk failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(repo.store.ObjectPath(corrupt), []byte("corrupt"), 0644); nil != err {
+		t.Fatalf("write chunk failed: %s", err)
+		return
+	}
+
+	readOnly, err := OpenRepoReadOnly(testRepoPath, repo.store.AesKey)
+	if nil != err {
+		t.Fatalf("open repo read only failed: %s", err)
+		return
+	}
+	report, err = readOnly.Fsck(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("fsck failed: %s", err)
+		return
+	}
+	if report.Healthy() || 1 != len(report.MissingObjects) || missing != report.MissingObjects[0] || 1 != len(report.CorruptObjects) || corrupt != report.CorruptObjects[0] {
+		t.Fatalf("unexpected fsck report: %+v", report)
+		return
+	}
+	if !gulu.File.IsExist(repo.store.ObjectPath(corrupt)) {
+		t.Fatalf("read only fsck should not quarantine objects")
+		return
+	}
+}
+
+// recordingDataFS 描述了记录操作次数的数据文件系统，用于测试数据文件夹的访问都经过 DataFS。
+type recordingDataFS struct {
+	*osDataFS
+	opens, creates, renames, removes atomic.Int32
+}
+
+func (dataFS *recordingDataFS) Open(name string) (io.ReadCloser, error) {
+	dataFS.opens.Add(1)
+	return dataFS.osDataFS.Open(name)
+}
+
+func (dataFS *recordingDataFS) Create(name string) (DataFile, error) {
+	dataFS.creates.Add(1)
+	return dataFS.osDataFS.Create(name)
+}
+
+func (dataFS *recordingDataFS) Rename(oldPath, newPath string) error {
+	dataFS.renames.Add(1)
+	return dataFS.osDataFS.Rename(oldPath, newPath)
+}
+
+func (dataFS *recordingDataFS) Remove(name string) error {
+	dataFS.removes.Add(1)
+	return dataFS.osDataFS.Remove(name)
+}
+
+func TestDataFS(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "datafs-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err = os.WriteFile(filepath.Join(dataPath, name), []byte(name), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	dataFS := &recordingDataFS{osDataFS: &osDataFS{}}
+	repo.SetDataFS(dataFS)
+	if repo.localData() {
+		t.Fatalf("custom data fs should not be local")
+		return
+	}
+
+	index1, err := repo.Index("datafs 1", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if 3 != dataFS.opens.Load() { // 两个数据文件和根目录下的忽略规则文件
+		t.Fatalf("index should read data files through data fs, opens [%d]", dataFS.opens.Load())
+		return
+	}
+
+	if err = os.Remove(filepath.Join(dataPath, "a.txt")); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "c.txt"), []byte("c.txt"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	index2, err := repo.Index("datafs 2", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	if _, _, err = repo.Checkout(index1.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if data, readErr := os.ReadFile(filepath.Join(dataPath, "a.txt")); nil != readErr || "a.txt" != string(data) {
+		t.Fatalf("checkout file not match: %v", readErr)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(dataPath, "c.txt")) {
+		t.Fatalf("checkout should remove file")
+		return
+	}
+	if 1 != dataFS.creates.Load() || 1 != dataFS.renames.Load() || 1 != dataFS.removes.Load() {
+		t.Fatalf("checkout should write data files through data fs, creates [%d], renames [%d], removes [%d]", dataFS.creates.Load(), dataFS.renames.Load(), dataFS.removes.Load())
+		return
+	}
+
+	// 同步合并逐个应用变更
+	files, err := repo.GetFiles(index2)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	latestFiles, err := repo.GetFiles(index1)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	mergeResult := &MergeResult{}
+	for _, file := range files {
+		if "/c.txt" == file.Path {
+			mergeResult.Upserts = append(mergeResult.Upserts, file)
+		}
+	}
+	for _, file := range latestFiles {
+		if "/b.txt" == file.Path {
+			mergeResult.Removes = append(mergeResult.Removes, file)
+		}
+	}
+	if err = repo.restoreFiles(mergeResult, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if !gulu.File.IsExist(filepath.Join(dataPath, "c.txt")) || gulu.File.IsExist(filepath.Join(dataPath, "b.txt")) {
+		t.Fatalf("restore files not applied")
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(testRepoPath, checkoutJournalFile)) {
+		t.Fatalf("checkout journal should not be used")
+		return
+	}
+}
+
+func TestExportArchive(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dataPath := filepath.Join(testDataCheckoutPath, "archive-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	// 完整归档和增量归档组成归档链
+	var archives []*bytes.Buffer
+	var indexes []*entity.Index
+	var manifests []*ArchiveManifest
+	base := ""
+	for _, name := range []string{"v1.txt", "v2.txt"} {
+		if err = os.WriteFile(filepath.Join(dataPath, name), []byte(name), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		index, indexErr := repo.Index(name, true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		buf := &bytes.Buffer{}
+		manifest, exportErr := repo.ExportArchive(buf, base)
+		if nil != exportErr {
+			t.Fatalf("export archive failed: %s", exportErr)
+			return
+		}
+		if base != manifest.Base || index.ID != manifest.Head || 1 != len(manifest.Indexes) {
+			t.Fatalf("archive manifest not match: %+v", manifest)
+			return
+		}
+		archives = append(archives, buf)
+		indexes = append(indexes, index)
+		manifests = append(manifests, manifest)
+		base = index.ID
+	}
+	full, err := repo.ExportArchive(&bytes.Buffer{}, "")
+	if nil != err || 2 != len(full.Indexes) || full.Objects != manifests[0].Objects+manifests[1].Objects {
+		t.Fatalf("incremental archive should only contain new objects: %v", err)
+		return
+	}
+	if _, err = repo.ExportArchive(&bytes.Buffer{}, strings.Repeat("f", 40)); !errors.Is(err, ErrNotFoundIndex) {
+		t.Fatalf("export archive with missing base should fail, got [%v]", err)
+		return
+	}
+
+	// 按顺序导入归档链重建仓库
+	restoredPath := filepath.Join(testDataCheckoutPath, "archive-repo")
+	restoredDataPath := filepath.Join(testDataCheckoutPath, "archive-restored")
+	restored, err := NewRepo(restoredDataPath, restoredPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if _, err = restored.ImportArchive(bytes.NewReader(archives[1].Bytes())); !errors.Is(err, ErrArchiveBaseMissing) {
+		t.Fatalf("import incremental archive without base should fail, got [%v]", err)
+		return
+	}
+	for _, archive := range archives {
+		if _, err = restored.ImportArchive(archive); nil != err {
+			t.Fatalf("import archive failed: %s", err)
+			return
+		}
+	}
+	latest, err := restored.Latest()
+	if nil != err || indexes[1].ID != latest.ID {
+		t.Fatalf("restored latest should be the head of the archive chain: %v", err)
+		return
+	}
+	if _, _, err = restored.Checkout(latest.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	for _, name := range []string{"v1.txt", "v2.txt"} {
+		if data, readErr := os.ReadFile(filepath.Join(restoredDataPath, name)); nil != readErr || name != string(data) {
+			t.Fatalf("restored file [%s] not match: %v", name, readErr)
+			return
+		}
+	}
+}
+
+func TestVerifyRestore(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	report, err := repo.VerifyRestore(index.ID, 1)
+	if nil != err {
+		t.Fatalf("verify restore failed: %s", err)
+		return
+	}
+	if !report.Healthy() || report.Total != report.Verified || index.Count != report.Total {
+		t.Fatalf("all files should be restored and verified: %+v", report)
+		return
+	}
+
+	report, err = repo.VerifyRestore(index.ID, 0.5)
+	if nil != err {
+		t.Fatalf("verify restore failed: %s", err)
+		return
+	}
+	if !report.Healthy() || (report.Total+1)/2 != report.Verified {
+		t.Fatalf("half of the files should be sampled: %+v", report)
+		return
+	}
+
+	// 删除分块后还原失败
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	_, chunkPath := repo.store.AbsPath(files[0].Chunks[0])
+	if err = os.Remove(chunkPath); nil != err {
+		t.Fatalf("remove chunk failed: %s", err)
+		return
+	}
+	clearCache()
+	report, err = repo.VerifyRestore(index.ID, 1)
+	if nil != err {
+		t.Fatalf("verify restore failed: %s", err)
+		return
+	}
+	if report.Healthy() || files[0].Path != report.Failures[0].Path {
+		t.Fatalf("missing chunk should be reported: %+v", report)
+		return
+	}
+}
+
+func TestImmutableRetention(t *testing.T) {
+	clearTestdata(t)
+
+	dataPath := filepath.Join(testDataCheckoutPath, "immutable")
+	if err := os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	var indexes []*entity.Index
+	for _, content := range []string{"v1", "v2"} {
+		if err = os.WriteFile(filepath.Join(dataPath, content+".txt"), []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		index, indexErr := repo.Index(content, true, map[string]interface{}{})
+		if nil != indexErr {
+			t.Fatalf("index failed: %s", indexErr)
+			return
+		}
+		indexes = append(indexes, index)
+	}
+
+	repo.SetImmutableRetention(time.Hour)
+	if _, err = repo.Purge(); nil != err {
+		t.Fatalf("purge failed: %s", err)
+		return
+	}
+	if !repo.store.indexExist(indexes[0].ID) {
+		t.Fatalf("index within retention should not be purged")
+		return
+	}
+	if err = repo.Reset(); !errors.Is(err, ErrImmutable) {
+		t.Fatalf("reset should be refused: %v", err)
+		return
+	}
+
+	repo.SetImmutableRetention(0)
+	if _, err = repo.Purge(); nil != err {
+		t.Fatalf("purge failed: %s", err)
+		return
+	}
+	if repo.store.indexExist(indexes[0].ID) {
+		t.Fatalf("index without retention should be purged")
+		return
+	}
+}
+
+func TestSharedRepoLock(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	repoA, err := NewRepo(testDataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repoB, err := NewRepo(testDataPath, testRepoPath+string(os.PathSeparator), testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	// 同一仓库路径的另一个实例正忙时需要等待
+	repoA.lock.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, indexErr := repoB.Index("Index B", true, map[string]interface{}{})
+		done <- indexErr
+	}()
+
+	select {
+	case <-done:
+		repoA.lock.Unlock()
+		t.Fatalf("index of repo B should wait for repo A")
+		return
+	case <-time.After(500 * time.Millisecond):
+	}
+	repoA.lock.Unlock()
+
+	select {
+	case err = <-done:
+		if nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("index of repo B is blocked")
+		return
+	}
+}
@@ -0,0 +1,152 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/siyuan-note/logging"
+)
+
+var ErrInvalidRoot = errors.New("invalid root") // 额外根目录配置无效
+
+// Root 描述了数据文件夹以外的一个额外根目录，其中的文件会和数据文件夹一起索引、迁出和同步。
+type Root struct {
+	Path   string `json:"path"`   // 根目录的绝对路径，如：F:\\SiYuan\\templates\\
+	Prefix string `json:"prefix"` // 根目录下的文件在文件实体中的路径前缀，如：/templates-ext
+}
+
+// SetRoots 用于设置数据文件夹以外的额外根目录，传入 nil 时清空。
+//
+// 根目录下的文件在快照中的路径为 Prefix 加上相对根目录的路径，所以 Prefix 之间不能互相包含，也不能和数据文件夹中已有的路径重名，
+// 否则迁出时无法确定文件所属的根目录。根目录之间以及根目录和数据文件夹、仓库文件夹之间也不能互相包含。
+func (repo *Repo) SetRoots(roots []*Root) (err error) {
+	var ret []*Root
+	for _, root := range roots {
+		if nil == root {
+			continue
+		}
+
+		r := &Root{Path: filepath.Clean(root.Path), Prefix: cleanRelPath(root.Prefix)}
+		if !filepath.IsAbs(r.Path) {
+			err = fmt.Errorf("%w: path [%s] is not absolute", ErrInvalidRoot, root.Path)
+			return
+		}
+		if "/" == r.Prefix {
+			err = fmt.Errorf("%w: prefix of [%s] is empty", ErrInvalidRoot, root.Path)
+			return
+		}
+		for _, dir := range []string{repo.DataPath, repo.Path} {
+			if dir, err = filepath.Abs(dir); nil != err {
+				return
+			}
+			if pathContains(dir, r.Path) || pathContains(r.Path, dir) {
+				err = fmt.Errorf("%w: path [%s] overlaps [%s]", ErrInvalidRoot, r.Path, dir)
+				return
+			}
+		}
+		for _, other := range ret {
+			if pathContains(other.Path, r.Path) || pathContains(r.Path, other.Path) {
+				err = fmt.Errorf("%w: path [%s] overlaps [%s]", ErrInvalidRoot, r.Path, other.Path)
+				return
+			}
+			if prefixContains(other.Prefix, r.Prefix) || prefixContains(r.Prefix, other.Prefix) {
+				err = fmt.Errorf("%w: prefix [%s] overlaps [%s]", ErrInvalidRoot, r.Prefix, other.Prefix)
+				return
+			}
+		}
+		ret = append(ret, r)
+	}
+	repo.roots = ret
+	return
+}
+
+// Roots 用于获取数据文件夹以外的额外根目录。
+func (repo *Repo) Roots() (ret []*Root) {
+	for _, root := range repo.roots {
+		ret = append(ret, &Root{Path: root.Path, Prefix: root.Prefix})
+	}
+	return
+}
+
+// rootOf 用于获取本地路径 localPath 所属的额外根目录以及相对根目录的路径，属于数据文件夹时返回 nil。
+func (repo *Repo) rootOf(localPath string) (root *Root, rel string) {
+	for _, r := range repo.roots {
+		if prefixContains(r.Prefix, localPath) {
+			root, rel = r, strings.TrimPrefix(localPath, r.Prefix)
+			return
+		}
+	}
+	return
+}
+
+// dataAbsPath 用于获取本地路径 localPath 在数据文件夹或者所属额外根目录中的绝对路径。
+func (repo *Repo) dataAbsPath(localPath string) string {
+	if root, rel := repo.rootOf(localPath); nil != root {
+		return filepath.Join(root.Path, rel)
+	}
+	return filepath.Join(repo.DataPath, localPath)
+}
+
+// dataRelPath 用于获取数据文件夹或者额外根目录中的绝对路径 absPath 对应的本地路径。
+func (repo *Repo) dataRelPath(absPath string) string {
+	absPath = filepath.Clean(absPath)
+	for _, root := range repo.roots {
+		if pathContains(root.Path, absPath) {
+			return root.Prefix + filepath.ToSlash(strings.TrimPrefix(absPath, root.Path))
+		}
+	}
+	return "/" + filepath.ToSlash(strings.TrimPrefix(absPath, repo.DataPath))
+}
+
+// walkData 用于遍历数据文件夹和所有额外根目录，不存在的额外根目录会被跳过。
+func (repo *Repo) walkData(fn fs.WalkDirFunc) (err error) {
+	if err = repo.dataFS.WalkDir(repo.DataPath, fn); nil != err {
+		return
+	}
+
+	for _, root := range repo.roots {
+		if _, statErr := repo.dataFS.Stat(root.Path); nil != statErr {
+			if os.IsNotExist(statErr) {
+				logging.LogInfof("skip not exist root [%s]", root.Path)
+				continue
+			}
+			err = statErr
+			return
+		}
+		if err = repo.dataFS.WalkDir(root.Path, fn); nil != err {
+			return
+		}
+	}
+	return
+}
+
+// pathContains 用于判断本地路径 p 是否是 dir 或者位于 dir 下。
+func pathContains(dir, p string) bool {
+	dir, p = filepath.Clean(dir), filepath.Clean(p)
+	return dir == p || strings.HasPrefix(p, dir+string(os.PathSeparator))
+}
+
+// prefixContains 用于判断文件路径 p 是否是 prefix 或者位于 prefix 下。
+func prefixContains(prefix, p string) bool {
+	return prefix == p || strings.HasPrefix(p, prefix+"/")
+}
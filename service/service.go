@@ -0,0 +1,218 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package service 将仓库的常用操作通过本地 HTTP 接口暴露给其他语言编写的应用（比如 Electron 前端和脚本），不需要 cgo 绑定。
+//
+// 所有接口都使用 POST 方法，请求和响应都是 JSON，响应格式为 {"code": 0, "msg": "", "data": {}}，code 不为 0 时 msg 为错误信息。
+// 请求需要携带 Authorization: Bearer <token> 请求头。
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	// ErrEmptyToken 描述了创建服务时没有设置鉴权令牌。
+	ErrEmptyToken = errors.New("empty service token")
+	// ErrNonLocalAddr 描述了服务监听的地址不是本机回环地址。
+	ErrNonLocalAddr = errors.New("service must listen on loopback address")
+	// ErrBodyTooLarge 描述了请求体超过 maxRequestBody。
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// maxRequestBody 为请求体的最大字节数，超过时返回 413。
+const maxRequestBody = 1024 * 1024
+
+// Service 描述了仓库的本地 HTTP 服务，实现了 http.Handler，也可以挂载到调用方自己的 HTTP 服务中。
+//
+// 接口列表：
+//
+//   - /api/sync：同步，参数为空，返回 {"mergeResult": {}, "trafficStat": {}}
+//   - /api/indexes：分页获取索引，参数为 {"page": 1, "pageSize": 32}，返回 {"indexes": [], "totalCount": 0, "pageCount": 0}
+//   - /api/checkout：迁出索引，参数为 {"id": "", "dir": ""}，dir 为空时迁出到数据文件夹，否则迁出到 dir（只读仓库也可以调用）
+//   - /api/diff：比较索引，参数为 {"left": "", "right": ""}，返回 Repo.DiffIndex 的结果
+//   - /api/purge：清理仓库，参数为 {"retentionIndexIDs": []}，返回清理统计
+type Service struct {
+	repo  *dejavu.Repo
+	token string
+	mux   *http.ServeMux
+}
+
+// New 用于创建仓库 repo 的服务，token 为请求鉴权令牌，不能为空。
+func New(repo *dejavu.Repo, token string) (ret *Service, err error) {
+	if "" == token {
+		err = ErrEmptyToken
+		return
+	}
+
+	ret = &Service{repo: repo, token: token, mux: http.NewServeMux()}
+	ret.mux.HandleFunc("/api/sync", ret.handle(ret.sync))
+	ret.mux.HandleFunc("/api/indexes", ret.handle(ret.indexes))
+	ret.mux.HandleFunc("/api/checkout", ret.handle(ret.checkout))
+	ret.mux.HandleFunc("/api/diff", ret.handle(ret.diff))
+	ret.mux.HandleFunc("/api/purge", ret.handle(ret.purge))
+	return
+}
+
+// ListenAndServe 用于在本机回环地址 addr（如 127.0.0.1:6806）上启动服务，addr 不是回环地址时返回 ErrNonLocalAddr。
+func (service *Service) ListenAndServe(addr string) (err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		return
+	}
+	if ip := net.ParseIP(host); "localhost" != host && (nil == ip || !ip.IsLoopback()) {
+		err = ErrNonLocalAddr
+		return
+	}
+
+	logging.LogInfof("repo service listening on [%s]", addr)
+	err = http.ListenAndServe(addr, service)
+	return
+}
+
+func (service *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !service.authorized(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if http.MethodPost != r.Method {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	service.mux.ServeHTTP(w, r)
+}
+
+func (service *Service) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && 1 == subtle.ConstantTimeCompare([]byte(token), []byte(service.token))
+}
+
+// handle 用于将接口函数 fn 包装为 HTTP 处理函数，fn 的参数为解析后的请求体。
+func (service *Service) handle(fn func(arg map[string]interface{}) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := gulu.Ret.NewResult()
+		arg := map[string]interface{}{}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+		if nil == err && maxRequestBody < len(body) {
+			http.Error(w, ErrBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if nil == err && 0 < len(strings.TrimSpace(string(body))) {
+			err = json.Unmarshal(body, &arg)
+		}
+		if nil == err {
+			result.Data, err = call(fn, arg)
+		}
+		if nil != err {
+			logging.LogErrorf("handle [%s] failed: %s", r.URL.Path, err)
+			result.Code, result.Msg, result.Data = -1, err.Error(), nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(result); nil != err {
+			logging.LogErrorf("write response [%s] failed: %s", r.URL.Path, err)
+		}
+	}
+}
+
+// call 用于调用接口函数 fn，fn 中的 panic 会转换为错误返回，避免中断连接。
+func call(fn func(arg map[string]interface{}) (interface{}, error), arg map[string]interface{}) (ret interface{}, err error) {
+	defer func() {
+		if e := recover(); nil != e {
+			logging.LogErrorf("call panicked: %v\n%s", e, logging.ShortStack())
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	ret, err = fn(arg)
+	return
+}
+
+func (service *Service) sync(arg map[string]interface{}) (ret interface{}, err error) {
+	mergeResult, trafficStat, err := service.repo.Sync(map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	ret = map[string]interface{}{"mergeResult": mergeResult, "trafficStat": trafficStat}
+	return
+}
+
+func (service *Service) indexes(arg map[string]interface{}) (ret interface{}, err error) {
+	page, pageSize := intArg(arg, "page", 1), intArg(arg, "pageSize", 32)
+	indexes, totalCount, pageCount, err := service.repo.GetIndexes(page, pageSize)
+	if nil != err {
+		return
+	}
+	ret = map[string]interface{}{"indexes": indexes, "totalCount": totalCount, "pageCount": pageCount}
+	return
+}
+
+func (service *Service) checkout(arg map[string]interface{}) (ret interface{}, err error) {
+	id, _ := arg["id"].(string)
+	if dir, _ := arg["dir"].(string); "" != dir {
+		files, checkoutErr := service.repo.CheckoutTo(id, dir, map[string]interface{}{})
+		if nil != checkoutErr {
+			err = checkoutErr
+			return
+		}
+		ret = map[string]interface{}{"files": len(files)}
+		return
+	}
+
+	upserts, removes, err := service.repo.Checkout(id, map[string]interface{}{})
+	if nil != err {
+		return
+	}
+	ret = map[string]interface{}{"upserts": upserts, "removes": removes}
+	return
+}
+
+func (service *Service) diff(arg map[string]interface{}) (ret interface{}, err error) {
+	left, _ := arg["left"].(string)
+	right, _ := arg["right"].(string)
+	ret, err = service.repo.DiffIndex(left, right)
+	return
+}
+
+func (service *Service) purge(arg map[string]interface{}) (ret interface{}, err error) {
+	var retentionIndexIDs []string
+	ids, _ := arg["retentionIndexIDs"].([]interface{})
+	for _, id := range ids {
+		if s, ok := id.(string); ok {
+			retentionIndexIDs = append(retentionIndexIDs, s)
+		}
+	}
+	ret, err = service.repo.Purge(retentionIndexIDs...)
+	return
+}
+
+// intArg 用于获取参数 arg 中的整数 key，不存在或者不大于 0 时返回 defaultValue。
+func intArg(arg map[string]interface{}, key string, defaultValue int) int {
+	if v, ok := arg[key].(float64); ok && 0 < v {
+		return int(v)
+	}
+	return defaultValue
+}
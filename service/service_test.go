@@ -0,0 +1,162 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siyuan-note/dejavu"
+	"github.com/siyuan-note/encryption"
+)
+
+const testToken = "test-token"
+
+func newTestService(t *testing.T) (ret *Service, index string) {
+	aesKey, err := encryption.KDF("pass", "salt")
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "a.txt"), []byte("service"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	repo, err := dejavu.NewRepo(dataPath, filepath.Join(dir, "repo"), filepath.Join(dir, "history"), filepath.Join(dir, "temp"), "device", "device-name", "linux", aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	latest, err := repo.Index("service", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	if _, err = New(repo, ""); !errors.Is(err, ErrEmptyToken) {
+		t.Fatalf("new service without token should fail: %v", err)
+		return
+	}
+	if ret, err = New(repo, testToken); nil != err {
+		t.Fatalf("new service failed: %s", err)
+		return
+	}
+	index = latest.ID
+	return
+}
+
+func request(service *Service, method, path, token string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if "" != token {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, r)
+	return w
+}
+
+func TestServiceAuth(t *testing.T) {
+	service, _ := newTestService(t)
+	if nil == service {
+		return
+	}
+
+	if w := request(service, http.MethodPost, "/api/indexes", "", nil); http.StatusUnauthorized != w.Code {
+		t.Fatalf("missing token should be rejected, got [%d]", w.Code)
+		return
+	}
+	if w := request(service, http.MethodPost, "/api/indexes", "wrong-token", nil); http.StatusUnauthorized != w.Code {
+		t.Fatalf("wrong token should be rejected, got [%d]", w.Code)
+		return
+	}
+	if w := request(service, http.MethodGet, "/api/indexes", testToken, nil); http.StatusMethodNotAllowed != w.Code {
+		t.Fatalf("non-POST request should be rejected, got [%d]", w.Code)
+		return
+	}
+	if w := request(service, http.MethodPost, "/api/indexes", testToken, bytes.Repeat([]byte(" "), maxRequestBody+1)); http.StatusRequestEntityTooLarge != w.Code {
+		t.Fatalf("request body over limit should be rejected, got [%d]", w.Code)
+		return
+	}
+}
+
+func TestServiceIndexes(t *testing.T) {
+	service, index := newTestService(t)
+	if nil == service {
+		return
+	}
+
+	w := request(service, http.MethodPost, "/api/indexes", testToken, []byte(`{"page": 1, "pageSize": 10}`))
+	if http.StatusOK != w.Code {
+		t.Fatalf("get indexes failed [%d]: %s", w.Code, w.Body.String())
+		return
+	}
+	result := struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+		Data struct {
+			Indexes []struct {
+				ID string `json:"id"`
+			} `json:"indexes"`
+			TotalCount int `json:"totalCount"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); nil != err {
+		t.Fatalf("unmarshal response failed: %s", err)
+		return
+	}
+	if 0 != result.Code || 1 != result.Data.TotalCount || 1 != len(result.Data.Indexes) || index != result.Data.Indexes[0].ID {
+		t.Fatalf("unexpected indexes response: %s", w.Body.String())
+		return
+	}
+
+	w = request(service, http.MethodPost, "/api/indexes", testToken, []byte(`{`))
+	if err := json.Unmarshal(w.Body.Bytes(), &result); nil != err || 0 == result.Code {
+		t.Fatalf("invalid request body should return an error code: %s", w.Body.String())
+		return
+	}
+}
+
+func TestServiceLoopbackOnly(t *testing.T) {
+	service, _ := newTestService(t)
+	if nil == service {
+		return
+	}
+
+	for _, addr := range []string{"0.0.0.0:0", "192.0.2.1:6806", "example.com:6806"} {
+		if err := service.ListenAndServe(addr); !errors.Is(err, ErrNonLocalAddr) {
+			t.Fatalf("listen on [%s] should be rejected: %v", addr, err)
+			return
+		}
+	}
+	if err := service.ListenAndServe("127.0.0.1"); nil == err || errors.Is(err, ErrNonLocalAddr) {
+		t.Fatalf("address without port should fail to parse: %v", err)
+		return
+	}
+}
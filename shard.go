@@ -0,0 +1,196 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	shardLayoutFile = "shard.json" // 数据对象文件夹下记录分片布局的文件
+	maxShardDepth   = 4            // 数据对象文件夹的最大分片层数
+)
+
+var ErrInvalidShardDepth = errors.New("invalid shard depth")
+
+// shardLayout 描述了数据对象文件夹的分片布局。
+type shardLayout struct {
+	Depth     int  `json:"depth"`     // 分片层数
+	Migrating bool `json:"migrating"` // 是否正在迁移分片
+}
+
+// MigrateShardDepth 用于将数据对象文件夹的分片层数迁移为 depth，返回移动的数据对象数量。
+//
+// 对象数量巨大时单层分片的文件夹下文件过多，可以加深分片层数，比如 depth 为 2 时对象路径为 objects/xx/yy/zzzz。
+// 迁移过程中会在数据对象文件夹下记录迁移状态，迁移中断后读取对象仍然兼容旧的分片路径，再次调用可以继续迁移。
+func (repo *Repo) MigrateShardDepth(depth int) (moved int, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if 1 > depth || maxShardDepth < depth {
+		err = ErrInvalidShardDepth
+		return
+	}
+
+	moved, err = repo.store.migrateShardDepth(depth)
+	return
+}
+
+func (store *Store) migrateShardDepth(depth int) (moved int, err error) {
+	store.ShardDepth = depth
+	store.migratingShard = true
+	if err = store.checkWritable(); nil != err {
+		return
+	}
+	if err = store.saveShardLayout(); nil != err {
+		logging.LogErrorf("save shard layout failed: %s", err)
+		return
+	}
+
+	err = store.walkObjects(func(id, absPath string) error {
+		dir, file := store.shardPath(id, depth)
+		if absPath == file {
+			return nil
+		}
+
+		if store.exist(file) {
+			return store.fs.RemoveAll(absPath)
+		}
+		if mkdirErr := store.fs.MkdirAll(dir); nil != mkdirErr {
+			return mkdirErr
+		}
+		if renameErr := store.fs.Rename(absPath, file); nil != renameErr {
+			return renameErr
+		}
+		moved++
+		return nil
+	})
+	if nil != err {
+		logging.LogErrorf("migrate shard depth to [%d] failed: %s", depth, err)
+		return
+	}
+
+	if _, err = store.removeEmptyDirs(store.ObjectsPath); nil != err {
+		logging.LogErrorf("remove empty dirs in [%s] failed: %s", store.ObjectsPath, err)
+		return
+	}
+	store.migratingShard = false
+	if err = store.saveShardLayout(); nil != err {
+		logging.LogErrorf("save shard layout failed: %s", err)
+		return
+	}
+	logging.LogInfof("migrated shard depth to [%d], moved [%d] objects", depth, moved)
+	return
+}
+
+// loadShardLayout 用于从数据对象文件夹中加载分片布局，没有记录时使用默认的单层分片。
+func (store *Store) loadShardLayout() {
+	store.ShardDepth, store.migratingShard = 1, false
+
+	layoutPath := filepath.Join(store.ObjectsPath, shardLayoutFile)
+	if !store.exist(layoutPath) {
+		return
+	}
+
+	data, err := store.fs.ReadFile(layoutPath)
+	if nil != err {
+		logging.LogErrorf("read shard layout [%s] failed: %s", layoutPath, err)
+		return
+	}
+	layout := &shardLayout{}
+	if err = gulu.JSON.UnmarshalJSON(data, layout); nil != err {
+		logging.LogErrorf("unmarshal shard layout [%s] failed: %s", layoutPath, err)
+		return
+	}
+	if 1 <= layout.Depth && maxShardDepth >= layout.Depth {
+		store.ShardDepth = layout.Depth
+	}
+	store.migratingShard = layout.Migrating
+}
+
+func (store *Store) saveShardLayout() (err error) {
+	if err = store.fs.MkdirAll(store.ObjectsPath); nil != err {
+		return
+	}
+
+	data, err := gulu.JSON.MarshalJSON(&shardLayout{Depth: store.ShardDepth, Migrating: store.migratingShard})
+	if nil != err {
+		return
+	}
+	err = store.fs.WriteFile(filepath.Join(store.ObjectsPath, shardLayoutFile), data)
+	return
+}
+
+// shardPath 用于获取数据对象 id 在分片层数为 depth 时的文件夹和文件路径。
+func (store *Store) shardPath(id string, depth int) (dir, file string) {
+	if 1 > depth {
+		depth = 1
+	}
+
+	dir = store.ObjectsPath
+	for i := 0; i < depth; i++ {
+		dir = filepath.Join(dir, id[2*i:2*i+2])
+	}
+	file = filepath.Join(dir, id[2*depth:])
+	return
+}
+
+// walkObjects 用于遍历数据对象文件夹中的所有数据对象，兼容不同分片层数混合存放的情况。
+func (store *Store) walkObjects(fn func(id, absPath string) error) (err error) {
+	if !store.isDir(store.ObjectsPath) {
+		return
+	}
+
+	err = store.walkFiles(store.ObjectsPath, func(path string) error {
+		rel, relErr := filepath.Rel(store.ObjectsPath, path)
+		if nil != relErr {
+			return relErr
+		}
+		id := strings.ReplaceAll(rel, string(os.PathSeparator), "")
+		if 40 != len(id) || !strings.Contains(rel, string(os.PathSeparator)) {
+			// 跳过 repos.json、shard.json 等非数据对象文件
+			return nil
+		}
+		return fn(id, path)
+	})
+	return
+}
+
+// moveObjects 用于将数据对象移动到 dst 的数据对象文件夹中，dst 中已经存在的对象不会被覆盖。
+func (store *Store) moveObjects(dst *Store) (err error) {
+	err = store.walkObjects(func(id, absPath string) error {
+		dir, file := dst.shardPath(id, dst.ShardDepth)
+		if dst.exist(file) {
+			return store.fs.RemoveAll(absPath)
+		}
+		if mkdirErr := dst.fs.MkdirAll(dir); nil != mkdirErr {
+			return mkdirErr
+		}
+		return dst.fs.Rename(absPath, file)
+	})
+	return
+}
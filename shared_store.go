@@ -0,0 +1,142 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+)
+
+const sharedReposFile = "repos.json" // 共享数据对象文件夹下记录共享仓库路径列表的文件
+
+var sharedReposLock = sync.Mutex{}
+
+// ShareObjects 用于让仓库使用共享数据对象文件夹 dir，多个仓库（如不同的笔记本）共享后相同的文件和分块在本地只存储一份。
+//
+// 共享的仓库必须使用相同的密钥，共享设置不会持久化，每次创建仓库后都需要调用。仓库原有的数据对象会被移动到共享文件夹中，
+// 清理仓库时会统计其他共享仓库对数据对象的引用，被其他仓库引用的数据对象不会被清理。
+//
+// 注意文件对象 ID 由文件路径和修改时间生成，所以共享仓库的数据文件夹中不应该存在路径和修改时间都相同但内容不同的文件。
+func (repo *Repo) ShareObjects(dir string) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	dir = filepath.Clean(dir)
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+	if err = registerSharedRepo(dir, repo.Path); nil != err {
+		logging.LogErrorf("register shared repo [%s] failed: %s", repo.Path, err)
+		return
+	}
+
+	// 仓库自己的数据对象移动到共享文件夹中，已经共享的仓库切换共享文件夹时不移动，避免影响其他仓库
+	own := filepath.Join(repo.Path, "objects")
+	if filepath.Clean(repo.store.ObjectsPath) == filepath.Clean(own) && filepath.Clean(own) != dir {
+		shared := *repo.store
+		shared.ObjectsPath = dir
+		shared.loadShardLayout()
+		if err = repo.store.moveObjects(&shared); nil != err {
+			logging.LogErrorf("move objects to shared dir [%s] failed: %s", dir, err)
+			return
+		}
+		if err = os.RemoveAll(own); nil != err {
+			return
+		}
+		logging.LogInfof("moved objects of repo [%s] to shared dir [%s]", repo.Path, dir)
+	}
+
+	repo.store.ObjectsPath = dir
+	repo.store.loadShardLayout()
+	return
+}
+
+// sharedRefs 用于统计共享数据对象文件夹的其他仓库引用数据对象的次数，每个仓库最多计一次。
+func (store *Store) sharedRefs() (ret map[string]int, err error) {
+	ret = map[string]int{}
+	repos, err := readSharedRepos(store.ObjectsPath)
+	if nil != err {
+		return
+	}
+
+	for _, repoPath := range repos {
+		if filepath.Clean(repoPath) == filepath.Clean(store.Path) {
+			continue
+		}
+		if !gulu.File.IsDir(repoPath) {
+			logging.LogWarnf("shared repo [%s] not found", repoPath)
+			continue
+		}
+
+		other := *store
+		other.Path = repoPath
+		refIndexIDs, readErr := other.readRefs()
+		if nil != readErr {
+			err = readErr
+			return
+		}
+		for objID := range other.referencedObjects(refIndexIDs) {
+			ret[objID]++
+		}
+	}
+	return
+}
+
+func registerSharedRepo(dir, repoPath string) (err error) {
+	sharedReposLock.Lock()
+	defer sharedReposLock.Unlock()
+
+	repos, err := readSharedRepos(dir)
+	if nil != err {
+		return
+	}
+	repoPath = filepath.Clean(repoPath)
+	for _, p := range repos {
+		if filepath.Clean(p) == repoPath {
+			return
+		}
+	}
+	repos = append(repos, repoPath)
+
+	data, err := gulu.JSON.MarshalJSON(repos)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(filepath.Join(dir, sharedReposFile), data, 0644)
+	return
+}
+
+func readSharedRepos(dir string) (ret []string, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, sharedReposFile))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = gulu.JSON.UnmarshalJSON(data, &ret)
+	return
+}
@@ -0,0 +1,105 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/siyuan-note/dejavu/util"
+)
+
+// CtxSyncID 是同步 ID 在同步上下文 context 中的键，调用方可以预先传入以便和自己的日志关联。
+const CtxSyncID = "syncID"
+
+// ctxSyncLogger 是附带同步 ID 的结构化日志记录器在同步上下文 context 中的键。
+const ctxSyncLogger = "syncLogger"
+
+var structuredLogger atomic.Pointer[slog.Logger]
+
+// SetStructuredLogger 用于开启结构化日志，同步过程中的关键事件会附带同步 ID 输出到 logger，传入 nil 时关闭。
+func SetStructuredLogger(logger *slog.Logger) {
+	structuredLogger.Store(logger)
+}
+
+// NewJSONLogger 用于创建输出 JSON 格式日志的结构化日志记录器。
+func NewJSONLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// syncLogger 返回附带同步 ID 的结构化日志记录器，未开启结构化日志时返回的记录器会丢弃所有日志。
+//
+// 同步过程中使用 beginSync 创建的记录器，同一次同步的所有结构化日志都附带相同的同步 ID。
+func syncLogger(context map[string]interface{}) *slog.Logger {
+	if logger, ok := context[ctxSyncLogger].(*slog.Logger); ok {
+		return logger
+	}
+
+	logger := structuredLogger.Load()
+	if nil == logger {
+		return slog.New(slog.DiscardHandler)
+	}
+	if syncID, ok := context[CtxSyncID].(string); ok {
+		logger = logger.With(CtxSyncID, syncID)
+	}
+	return logger
+}
+
+// beginSync 用于为一次同步分配同步 ID 并记录开始日志。
+//
+// 返回的同步上下文是 context 的副本，附带同步 ID 和同步使用的结构化日志记录器，调用方传入的 context 不会被修改。
+func beginSync(kind string, context map[string]interface{}) (ret map[string]interface{}) {
+	ret = make(map[string]interface{}, len(context)+2)
+	for k, v := range context {
+		ret[k] = v
+	}
+	if _, ok := ret[CtxSyncID].(string); !ok {
+		ret[CtxSyncID] = util.RandHash()[:16]
+	}
+	delete(ret, ctxSyncLogger)
+	logger := syncLogger(ret)
+	ret[ctxSyncLogger] = logger
+	logger.Info("sync started", "kind", kind)
+	return
+}
+
+// endSync 用于记录同步结束日志、同步日志并上报度量数据。
+func (repo *Repo) endSync(kind string, start time.Time, context map[string]interface{}, mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+	repo.releaseSyncTemp(context)
+	repo.countSyncAPIOps(context, trafficStat)
+	observeSync(kind, start, mergeResult, trafficStat, err)
+	repo.journalSync(kind, start, context, mergeResult, trafficStat, err)
+
+	attrs := []any{"kind", kind, "duration", time.Since(start)}
+	if nil != mergeResult {
+		attrs = append(attrs, "upserts", len(mergeResult.Upserts), "removes", len(mergeResult.Removes), "conflicts", len(mergeResult.Conflicts), "moves", len(mergeResult.Moves), "dirOps", len(mergeResult.DirOps))
+	}
+	if nil != trafficStat {
+		attrs = append(attrs, "uploadBytes", trafficStat.UploadBytes, "downloadBytes", trafficStat.DownloadBytes,
+			"uploadChunks", trafficStat.UploadChunkCount, "downloadChunks", trafficStat.DownloadChunkCount)
+	}
+
+	logger := syncLogger(context)
+	if nil != err {
+		logger.Error("sync failed", append(attrs, "error", err.Error(), "retryable", IsRetryable(err))...)
+		return
+	}
+	logger.Info("sync finished", attrs...)
+	repo.notifySync(kind, context, mergeResult, trafficStat)
+}
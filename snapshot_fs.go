@@ -0,0 +1,195 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+// SnapshotFS 用于获取索引 indexID 对应快照的只读文件系统视图，文件内容在读取时才从仓库中解码，不会迁出任何文件。
+//
+// 返回值实现了 fs.FS，可以直接交给 http.FileServer、fs.WalkDir 等使用，也可以作为 FUSE/WinFsp 挂载适配层的后端，
+// 这样用户可以像访问普通文件夹一样浏览历史快照并复制其中的文件。
+func (repo *Repo) SnapshotFS(indexID string) (ret fs.FS, err error) {
+	index, err := repo.GetIndex(indexID)
+	if nil != err {
+		return
+	}
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+
+	snapshot := &snapshotFS{
+		repo:     repo,
+		modTime:  time.UnixMilli(index.Created),
+		files:    map[string]*entity.File{},
+		children: map[string]map[string]bool{".": {}},
+	}
+	for _, file := range files {
+		name := strings.TrimPrefix(cleanRelPath(file.Path), "/")
+		snapshot.files[name] = file
+		for child := name; "." != child; child = path.Dir(child) {
+			dir := path.Dir(child)
+			if nil == snapshot.children[dir] {
+				snapshot.children[dir] = map[string]bool{}
+			}
+			snapshot.children[dir][path.Base(child)] = true
+		}
+	}
+	ret = snapshot
+	return
+}
+
+type snapshotFS struct {
+	repo     *Repo
+	modTime  time.Time                  // 快照创建时间，作为文件夹的修改时间
+	files    map[string]*entity.File    // 文件路径到文件的映射，路径不以 / 开头
+	children map[string]map[string]bool // 文件夹路径到其子文件名集合的映射，根目录为 .
+}
+
+func (snapshot *snapshotFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if file := snapshot.files[name]; nil != file {
+		return &snapshotFile{repo: snapshot.repo, file: file, info: snapshot.fileInfo(name, file)}, nil
+	}
+
+	children := snapshot.children[name]
+	if nil == children {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var names []string
+	for child := range children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	dir := &snapshotDir{info: snapshot.fileInfo(name, nil)}
+	for _, child := range names {
+		p := path.Join(name, child)
+		dir.entries = append(dir.entries, fs.FileInfoToDirEntry(snapshot.fileInfo(p, snapshot.files[p])))
+	}
+	return dir, nil
+}
+
+func (snapshot *snapshotFS) fileInfo(name string, file *entity.File) *snapshotFileInfo {
+	ret := &snapshotFileInfo{name: path.Base(name), modTime: snapshot.modTime, mode: fs.ModeDir | 0555}
+	if nil != file {
+		ret.size = file.Size
+		ret.modTime = time.UnixMilli(file.Updated)
+		ret.mode = 0444
+	}
+	return ret
+}
+
+type snapshotFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (info *snapshotFileInfo) Name() string       { return info.name }
+func (info *snapshotFileInfo) Size() int64        { return info.size }
+func (info *snapshotFileInfo) Mode() fs.FileMode  { return info.mode }
+func (info *snapshotFileInfo) ModTime() time.Time { return info.modTime }
+func (info *snapshotFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *snapshotFileInfo) Sys() interface{}   { return nil }
+
+// snapshotFile 描述了快照中打开的文件，首次读取时才解码文件内容。
+type snapshotFile struct {
+	repo   *Repo
+	file   *entity.File
+	info   *snapshotFileInfo
+	reader *bytes.Reader
+}
+
+func (f *snapshotFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *snapshotFile) Close() error               { return nil }
+
+func (f *snapshotFile) Read(p []byte) (n int, err error) {
+	if err = f.open(); nil != err {
+		return
+	}
+	return f.reader.Read(p)
+}
+
+func (f *snapshotFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if err = f.open(); nil != err {
+		return
+	}
+	return f.reader.ReadAt(p, off)
+}
+
+func (f *snapshotFile) Seek(offset int64, whence int) (ret int64, err error) {
+	if err = f.open(); nil != err {
+		return
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *snapshotFile) open() (err error) {
+	if nil != f.reader {
+		return
+	}
+
+	data, err := f.repo.OpenFile(f.file)
+	if nil != err {
+		return &fs.PathError{Op: "read", Path: f.file.Path, Err: err}
+	}
+	f.reader = bytes.NewReader(data)
+	return
+}
+
+// snapshotDir 描述了快照中打开的文件夹。
+type snapshotDir struct {
+	info    *snapshotFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *snapshotDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *snapshotDir) Close() error               { return nil }
+
+func (d *snapshotDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *snapshotDir) ReadDir(count int) (ret []fs.DirEntry, err error) {
+	remains := d.entries[d.offset:]
+	if 0 < count && 1 > len(remains) {
+		err = io.EOF
+		return
+	}
+	if 0 < count && count < len(remains) {
+		remains = remains[:count]
+	}
+	d.offset += len(remains)
+	ret = remains
+	return
+}
@@ -0,0 +1,261 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/logging"
+)
+
+var ErrInvalidCronSpec = errors.New("invalid cron spec")
+
+// Schedule 描述了一个定时本地快照计划。
+type Schedule struct {
+	Name string // 计划名称，如 hourly、daily
+	Spec string // 五段式 cron 表达式（分 时 日 月 周），如 0 * * * *，也支持 @hourly、@daily、@weekly、@monthly
+	Memo string // 快照备注模板，{name} 会被替换为计划名称，{time} 会被替换为触发时间，为空时使用 [Snapshot] {name}
+}
+
+// Snapshotter 用于按计划定时创建本地快照，不依赖云端同步，所以未启用云端同步时也能保留本地历史。
+type Snapshotter struct {
+	repo      *Repo
+	schedules []*schedule
+	stop      chan struct{}
+	waitGroup sync.WaitGroup
+	once      sync.Once
+}
+
+type schedule struct {
+	*Schedule
+	spec *cronSpec
+}
+
+// NewSnapshotter 用于创建一个按计划 schedules 为仓库 repo 创建快照的 Snapshotter，需要调用 Start 后才会开始运行。
+func NewSnapshotter(repo *Repo, schedules []*Schedule) (ret *Snapshotter, err error) {
+	ret = &Snapshotter{repo: repo, stop: make(chan struct{})}
+	for _, s := range schedules {
+		spec, parseErr := parseCronSpec(s.Spec)
+		if nil != parseErr {
+			err = fmt.Errorf("%w: schedule [%s]: %w", ErrInvalidCronSpec, s.Name, parseErr)
+			ret = nil
+			return
+		}
+		ret.schedules = append(ret.schedules, &schedule{Schedule: s, spec: spec})
+	}
+	return
+}
+
+// Start 用于启动定时快照。
+func (snapshotter *Snapshotter) Start() {
+	snapshotter.waitGroup.Add(1)
+	go func() {
+		defer snapshotter.waitGroup.Done()
+
+		for {
+			now := time.Now()
+			next := snapshotter.next(now)
+			if next.IsZero() {
+				return
+			}
+
+			timer := time.NewTimer(next.Sub(now))
+			select {
+			case <-snapshotter.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				snapshotter.snapshot(next)
+			}
+		}
+	}()
+}
+
+// Stop 用于停止定时快照，会等待正在创建的快照完成。
+func (snapshotter *Snapshotter) Stop() {
+	snapshotter.once.Do(func() { close(snapshotter.stop) })
+	snapshotter.waitGroup.Wait()
+}
+
+// next 用于计算 now 之后最近的触发时间，没有计划时返回零值。
+func (snapshotter *Snapshotter) next(now time.Time) (ret time.Time) {
+	for _, s := range snapshotter.schedules {
+		t := s.spec.next(now)
+		if !t.IsZero() && (ret.IsZero() || t.Before(ret)) {
+			ret = t
+		}
+	}
+	return
+}
+
+// snapshot 用于为在 t 时刻触发的计划创建快照，同一时刻触发多个计划时只创建一个快照，备注使用第一个计划的模板。
+func (snapshotter *Snapshotter) snapshot(t time.Time) (ret *schedule) {
+	for _, s := range snapshotter.schedules {
+		if s.spec.matches(t) {
+			ret = s
+			break
+		}
+	}
+	if nil == ret {
+		return
+	}
+
+	memo := ret.Memo
+	if "" == memo {
+		memo = "[Snapshot] {name}"
+	}
+	memo = strings.NewReplacer("{name}", ret.Name, "{time}", t.Format("2006-01-02 15:04")).Replace(memo)
+	if _, err := snapshotter.repo.Index(memo, true, map[string]interface{}{}); nil != err {
+		if errors.Is(err, ErrEmptyIndex) {
+			logging.LogInfof("skip scheduled snapshot [%s]: %s", ret.Name, err)
+			return
+		}
+		logging.LogErrorf("scheduled snapshot [%s] failed: %s", ret.Name, err)
+		return
+	}
+	logging.LogInfof("created scheduled snapshot [%s]", ret.Name)
+	return
+}
+
+// cronSpec 描述了解析后的 cron 表达式，各字段使用位集表示允许的取值。
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCronSpec(spec string) (ret *cronSpec, err error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if 5 != len(fields) {
+		err = fmt.Errorf("expected 5 fields but got %d", len(fields))
+		return
+	}
+
+	ret = &cronSpec{domStar: "*" == fields[2], dowStar: "*" == fields[4]}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	bits := []*uint64{&ret.minute, &ret.hour, &ret.dom, &ret.month, &ret.dow}
+	for i, field := range fields {
+		if *bits[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); nil != err {
+			ret = nil
+			return
+		}
+	}
+	if 0 != ret.dow&(1<<7) { // 7 和 0 都表示周日
+		ret.dow |= 1
+	}
+	return
+}
+
+// parseCronField 用于解析 cron 表达式中的一个字段，支持 *、数值、列表 a,b、范围 a-b 和步长 */n、a-b/n。
+func parseCronField(field string, min, max int) (ret uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepStr); nil != err || 1 > step {
+				err = fmt.Errorf("invalid step [%s]", part)
+				return
+			}
+		}
+
+		start, end := min, max
+		if "*" != rng {
+			startStr, endStr, isRange := strings.Cut(rng, "-")
+			if start, err = strconv.Atoi(startStr); nil != err {
+				err = fmt.Errorf("invalid value [%s]", part)
+				return
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endStr); nil != err {
+					err = fmt.Errorf("invalid value [%s]", part)
+					return
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			err = fmt.Errorf("value [%s] out of range [%d-%d]", part, min, max)
+			return
+		}
+
+		for v := start; v <= end; v += step {
+			ret |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+func (spec *cronSpec) matches(t time.Time) bool {
+	if 0 == spec.minute&(1<<uint(t.Minute())) || 0 == spec.hour&(1<<uint(t.Hour())) || 0 == spec.month&(1<<uint(t.Month())) {
+		return false
+	}
+	return spec.matchesDay(t)
+}
+
+// matchesDay 按 cron 语义判断日期是否匹配：日和周都有限制时满足其一即可，否则都需要满足。
+func (spec *cronSpec) matchesDay(t time.Time) bool {
+	domMatch := 0 != spec.dom&(1<<uint(t.Day()))
+	dowMatch := 0 != spec.dow&(1<<uint(t.Weekday()))
+	if !spec.domStar && !spec.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// next 用于计算 t 之后（不含 t 所在的分钟）最近的匹配时间，五年内没有匹配时返回零值。
+func (spec *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if 0 == spec.month&(1<<uint(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if 0 == spec.hour&(1<<uint(t.Hour())) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if 0 == spec.minute&(1<<uint(t.Minute())) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,50 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// SoftLimits 描述了已知会导致性能下降的数据规模，超过时不影响索引和同步，只在结果中返回警告，0 表示不限制。
+type SoftLimits struct {
+	MaxFileSize  int64 // 单个文件大小的软限制字节数
+	MaxFileCount int   // 文件总数的软限制
+}
+
+// DefaultSoftLimits 是默认的软限制。
+var DefaultSoftLimits = SoftLimits{MaxFileSize: 1024 * 1024 * 1024, MaxFileCount: 100000}
+
+// softLimitWarnings 用于检查文件列表 files 是否超过软限制。
+func (repo *Repo) softLimitWarnings(files []*entity.File) (ret []*entity.Warning) {
+	limits := repo.SoftLimits
+	if 0 < limits.MaxFileSize {
+		for _, file := range files {
+			if limits.MaxFileSize < file.Size {
+				ret = append(ret, &entity.Warning{Code: entity.WarningLargeFile, Path: file.Path, Value: file.Size, Limit: limits.MaxFileSize})
+			}
+		}
+	}
+	if 0 < limits.MaxFileCount && limits.MaxFileCount < len(files) {
+		ret = append(ret, &entity.Warning{Code: entity.WarningTooManyFiles, Value: int64(len(files)), Limit: int64(limits.MaxFileCount)})
+	}
+	if 0 < len(ret) {
+		logging.LogWarnf("exceeded soft limits [warnings=%d]", len(ret))
+	}
+	return
+}
@@ -0,0 +1,221 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	statCacheFile    = "stat.json" // 统计信息缓存文件，位于仓库根目录下
+	statLargestFiles = 10          // 统计信息中返回的最大文件数
+)
+
+// RepoStat 描述了本地仓库的统计信息。
+type RepoStat struct {
+	Snapshots    int            `json:"snapshots"`    // 快照总数
+	Files        int            `json:"files"`        // 本地最新快照中的文件数
+	LogicalBytes int64          `json:"logicalBytes"` // 本地最新快照中的文件总大小
+	StoredBytes  int64          `json:"storedBytes"`  // 数据对象（文件和分块）压缩加密后占用的存储空间
+	Objects      int            `json:"objects"`      // 数据对象总数
+	Chunks       int            `json:"chunks"`       // 本地最新快照引用的分块数（去重后）
+	AvgChunkSize int64          `json:"avgChunkSize"` // 本地最新快照中分块的平均大小
+	LargestFiles []*entity.File `json:"largestFiles"` // 本地最新快照中最大的文件，按大小倒序
+	LastIndex    int64          `json:"lastIndex"`    // 最近一次索引的时间，毫秒时间戳
+	LastSync     int64          `json:"lastSync"`     // 最近一次同步成功的时间，毫秒时间戳，没有同步过时为 0
+}
+
+// statCache 描述了统计信息的缓存。
+//
+// 数据对象按照分片文件夹统计，文件夹的修改时间没有变化时直接使用缓存的统计结果，所以只需要重新统计有对象增删的分片文件夹；
+// 和本地最新快照相关的统计结果在最新快照变化前一直有效。
+type statCache struct {
+	lock     sync.Mutex
+	Dirs     map[string]*statDir `json:"dirs"` // 分片文件夹相对数据对象文件夹的路径到统计结果的映射
+	LatestID string              `json:"latestID"`
+	Latest   *RepoStat           `json:"latest"` // 和本地最新快照相关的统计结果
+}
+
+// statDir 描述了一个分片文件夹中直接包含的数据对象的统计结果。
+type statDir struct {
+	ModTime int64    `json:"modTime"` // 统计时文件夹的修改时间，纳秒时间戳
+	Objects int      `json:"objects"`
+	Bytes   int64    `json:"bytes"`
+	Dirs    []string `json:"dirs"` // 子文件夹名称
+}
+
+// GetStat 用于获取本地仓库的统计信息，统计结果会增量计算并缓存。
+func (repo *Repo) GetStat() (ret *RepoStat, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	cache := repo.stat
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if nil == cache.Dirs {
+		repo.loadStatCache(cache)
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		return
+	}
+	if latest.ID != cache.LatestID || nil == cache.Latest {
+		if cache.Latest, err = repo.latestStat(latest); nil != err {
+			return
+		}
+		cache.LatestID = latest.ID
+	}
+	copied := *cache.Latest
+	ret = &copied
+
+	dirs := map[string]*statDir{}
+	if err = repo.scanStatDir(cache.Dirs, dirs, ""); nil != err {
+		logging.LogErrorf("scan objects failed: %s", err)
+		return
+	}
+	cache.Dirs = dirs
+	for rel, dir := range dirs {
+		if "" == rel {
+			continue // 跳过 repos.json、shard.json 等非数据对象文件
+		}
+		ret.Objects += dir.Objects
+		ret.StoredBytes += dir.Bytes
+	}
+
+	if entries, readErr := os.ReadDir(filepath.Join(repo.Path, "indexes")); nil == readErr {
+		for _, entry := range entries {
+			if 40 == len(entry.Name()) {
+				ret.Snapshots++
+			}
+		}
+	}
+	if journal, journalErr := repo.readSyncJournal(); nil == journalErr {
+		for i := len(journal) - 1; 0 <= i; i-- {
+			if journal[i].Succeeded {
+				ret.LastSync = journal[i].End
+				break
+			}
+		}
+	}
+
+	if repo.store.readOnly {
+		return
+	}
+	if saveErr := repo.saveStatCache(cache); nil != saveErr {
+		logging.LogWarnf("save stat cache failed: %s", saveErr)
+	}
+	return
+}
+
+func (repo *Repo) latestStat(latest *entity.Index) (ret *RepoStat, err error) {
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+
+	ret = &RepoStat{Files: len(files), LastIndex: latest.Created}
+	chunks := map[string]bool{}
+	for _, file := range files {
+		ret.LogicalBytes += file.Size
+		for _, chunk := range file.Chunks {
+			chunks[chunk] = true
+		}
+	}
+	ret.Chunks = len(chunks)
+	if 0 < ret.Chunks {
+		ret.AvgChunkSize = ret.LogicalBytes / int64(ret.Chunks)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	if statLargestFiles < len(files) {
+		files = files[:statLargestFiles]
+	}
+	ret.LargestFiles = files
+	return
+}
+
+// scanStatDir 用于统计数据对象文件夹下相对路径为 rel 的文件夹，修改时间没有变化时使用缓存 cached 中的结果，统计结果写入 dirs。
+func (repo *Repo) scanStatDir(cached, dirs map[string]*statDir, rel string) (err error) {
+	absDir := filepath.Join(repo.store.ObjectsPath, rel)
+	info, err := os.Stat(absDir)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	dir := cached[rel]
+	if nil == dir || dir.ModTime != info.ModTime().UnixNano() {
+		entries, readErr := os.ReadDir(absDir)
+		if nil != readErr {
+			err = readErr
+			return
+		}
+
+		dir = &statDir{ModTime: info.ModTime().UnixNano()}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dir.Dirs = append(dir.Dirs, entry.Name())
+				continue
+			}
+			entryInfo, infoErr := entry.Info()
+			if nil != infoErr {
+				continue // 统计时对象可能被清理
+			}
+			dir.Objects++
+			dir.Bytes += entryInfo.Size()
+		}
+	}
+	dirs[rel] = dir
+
+	for _, sub := range dir.Dirs {
+		if err = repo.scanStatDir(cached, dirs, filepath.Join(rel, sub)); nil != err {
+			return
+		}
+	}
+	return
+}
+
+func (repo *Repo) loadStatCache(cache *statCache) {
+	cache.Dirs = map[string]*statDir{}
+	data, err := os.ReadFile(filepath.Join(repo.Path, statCacheFile))
+	if nil != err {
+		return
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, cache); nil != err {
+		logging.LogWarnf("unmarshal stat cache failed: %s", err)
+		cache.Dirs, cache.LatestID, cache.Latest = map[string]*statDir{}, "", nil
+	}
+}
+
+func (repo *Repo) saveStatCache(cache *statCache) (err error) {
+	data, err := gulu.JSON.MarshalJSON(cache)
+	if nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, statCacheFile), data, 0644)
+	return
+}
@@ -21,13 +21,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/88250/gulu"
 	"github.com/dgraph-io/ristretto"
 	"github.com/klauspost/compress/zstd"
 	"github.com/siyuan-note/dejavu/entity"
-	"github.com/siyuan-note/encryption"
+	"github.com/siyuan-note/dejavu/util"
 	"github.com/siyuan-note/logging"
 )
 
@@ -37,13 +38,39 @@ var ErrNotFoundObject = errors.New("not found object")
 type Store struct {
 	Path   string // 存储库文件夹的绝对路径，如：F:\\SiYuan\\repo\\
 	AesKey []byte
+	Format int // 写入索引和文件对象时使用的编码格式，默认为 entity.FormatJSON，读取时会自动识别格式
+
+	Encryption int // 写入文件和分块对象时使用的加密方式，默认为 EncryptionLegacy，读取时会自动识别加密方式
+
+	ObjectsPath string // 数据对象文件夹的绝对路径，默认为 Path 下的 objects 文件夹，多个仓库可以共享同一个数据对象文件夹
+	ShardDepth  int    // 数据对象文件夹的分片层数，每层使用 ID 的两个字符作为文件夹名，默认为 1 即 objects/xx/yyyy
+
+	migratingShard bool // 分片迁移是否尚未完成，未完成时读取对象会兼容查找其他分片层数下的路径
+
+	Plain bool // 写入分块对象时是否不压缩不加密，开启后只有一个分块的文件可以直接从数据对象链接迁出，参考 Repo.SetLinkCheckout
+
+	readOnly bool // 是否以只读方式打开，只读时不会写入仓库文件夹下的任何文件，参考 OpenRepoReadOnly
+
+	fs StoreFS // 读写存储库文件使用的文件系统，参考 NewStoreWithFS
+
+	quarantineLock *sync.Mutex // 修复队列读写锁
+	indexLogLock   *sync.Mutex // 索引日志读写锁
+
+	format      *RepoFormat // 仓库格式版本
+	formatErr   error       // 仓库由更新版本写入而只能读取时的错误，写入时返回该错误
+	formatSaved bool        // 仓库格式版本是否已经保存
+	formatLock  *sync.Mutex // 仓库格式版本读写锁
 
 	compressEncoder *zstd.Encoder
 	compressDecoder *zstd.Decoder
 }
 
 func NewStore(path string, aesKey []byte) (ret *Store, err error) {
-	ret = &Store{Path: path, AesKey: aesKey}
+	return newStore(path, aesKey, false, &osFS{})
+}
+
+func newStore(path string, aesKey []byte, readOnly bool, storeFS StoreFS) (ret *Store, err error) {
+	ret = &Store{Path: path, AesKey: aesKey, Format: entity.FormatJSON, ObjectsPath: filepath.Join(path, "objects"), readOnly: readOnly, fs: storeFS, quarantineLock: &sync.Mutex{}, indexLogLock: &sync.Mutex{}, formatLock: &sync.Mutex{}}
 
 	ret.compressEncoder, err = zstd.NewWriter(nil,
 		zstd.WithEncoderLevel(zstd.SpeedDefault),
@@ -54,51 +81,47 @@ func NewStore(path string, aesKey []byte) (ret *Store, err error) {
 	}
 	ret.compressDecoder, err = zstd.NewReader(nil,
 		zstd.WithDecoderMaxMemory(16*1024*1024*1024))
+	if nil != err {
+		return
+	}
+
+	ret.loadShardLayout()
+	ret.loadEncryption()
+	if err = ret.loadRepoFormat(); nil != err {
+		return
+	}
+	if !readOnly {
+		ret.recoverBatches()
+	}
 	return
 }
 
 func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
 	logging.LogInfof("purging data repo [%s], retention indexes [%d]", store.Path, len(retentionIndexIDs))
 
-	objectsDir := filepath.Join(store.Path, "objects")
-	if !gulu.File.IsDir(objectsDir) {
+	objectsDir := store.ObjectsPath
+	if !store.isDir(objectsDir) {
 		logging.LogWarnf("objects dir [%s] is not a dir", objectsDir)
 		return
 	}
 
-	entries, err := os.ReadDir(objectsDir)
-	if nil != err {
-		logging.LogErrorf("read objects dir [%s] failed: %s", objectsDir, err)
-		return
-	}
-
 	// 收集所有数据对象
+	var entries []os.DirEntry
 	objIDs := map[string]bool{}
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-
-		dirName := entry.Name()
-		dir := filepath.Join(objectsDir, dirName)
-		objs, readErr := os.ReadDir(dir)
-		if nil != readErr {
-			err = readErr
-			logging.LogErrorf("read objects dir [%s] failed: %s", dir, err)
-			return
-		}
-
-		for _, obj := range objs {
-			id := dirName + obj.Name()
-			objIDs[id] = true
-		}
+	err = store.walkObjects(func(id, absPath string) error {
+		objIDs[id] = true
+		return nil
+	})
+	if nil != err {
+		logging.LogErrorf("walk objects dir [%s] failed: %s", objectsDir, err)
+		return
 	}
 
 	// 收集所有索引对象
 	indexIDs := map[string]bool{}
 	indexesDir := filepath.Join(store.Path, "indexes")
-	if gulu.File.IsDir(indexesDir) {
-		entries, err = os.ReadDir(indexesDir)
+	if store.isDir(indexesDir) {
+		entries, err = store.fs.ReadDir(indexesDir)
 		if nil != err {
 			logging.LogErrorf("read indexes dir [%s] failed: %s", indexesDir, err)
 			return
@@ -133,32 +156,19 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 	}
 
 	// 收集所有引用的数据对象
-	referencedObjIDs := map[string]bool{}
-	for refID := range refIndexIDs {
-		index, getErr := store.GetIndex(refID)
-		if nil != getErr {
-			logging.LogWarnf("get index [%s] failed: %s", refID, getErr)
-			continue
-		}
-
-		for _, fileID := range index.Files {
-			referencedObjIDs[fileID] = true
-			file, getFileErr := store.GetFile(fileID)
-			if nil != getFileErr {
-				logging.LogWarnf("get file [%s] failed: %s", fileID, getFileErr)
-				continue
-			}
+	referencedObjIDs := store.referencedObjects(refIndexIDs)
 
-			for _, chunkID := range file.Chunks {
-				referencedObjIDs[chunkID] = true
-			}
-		}
+	// 共享数据对象文件夹时，其他仓库引用的数据对象不能清理
+	sharedRefs, err := store.sharedRefs()
+	if nil != err {
+		logging.LogErrorf("read shared refs failed: %s", err)
+		return
 	}
 
 	// 收集所有未引用的数据对象
 	unreferencedObjIDs := map[string]bool{}
 	for objID := range objIDs {
-		if !referencedObjIDs[objID] {
+		if !referencedObjIDs[objID] && 1 > sharedRefs[objID] {
 			unreferencedObjIDs[objID] = true
 		}
 	}
@@ -169,7 +179,7 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 	// 清理未引用的索引对象
 	for unreferencedIndexID := range unreferencedIndexIDs {
 		indexPath := filepath.Join(store.Path, "indexes", unreferencedIndexID)
-		if err = os.RemoveAll(indexPath); nil != err {
+		if err = store.fs.RemoveAll(indexPath); nil != err {
 			logging.LogErrorf("remove unreferenced index [%s] failed: %s", unreferencedIndexID, err)
 			return
 		}
@@ -178,8 +188,8 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 	// 清理校验索引
 	// Clear check index when purging data repo https://github.com/siyuan-note/siyuan/issues/9665
 	checkIndexesDir := filepath.Join(store.Path, "check", "indexes")
-	if gulu.File.IsDir(checkIndexesDir) {
-		entries, err = os.ReadDir(checkIndexesDir)
+	if store.isDir(checkIndexesDir) {
+		entries, err = store.fs.ReadDir(checkIndexesDir)
 		if nil != err {
 			logging.LogErrorf("read check indexes dir [%s] failed: %s", checkIndexesDir, err)
 		} else {
@@ -189,7 +199,7 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 					continue
 				}
 
-				data, readErr := os.ReadFile(filepath.Join(checkIndexesDir, id))
+				data, readErr := store.fs.ReadFile(filepath.Join(checkIndexesDir, id))
 				if nil != readErr {
 					logging.LogErrorf("read check index [%s] failed: %s", id, readErr)
 					continue
@@ -210,8 +220,8 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 					continue
 				}
 
-				if _, statErr := os.Stat(filepath.Join(store.Path, "indexes", checkIndex.IndexID)); os.IsNotExist(statErr) {
-					if removeErr := os.RemoveAll(filepath.Join(store.Path, "check", "indexes", checkIndex.ID)); nil != removeErr {
+				if _, statErr := store.fs.Stat(filepath.Join(store.Path, "indexes", checkIndex.IndexID)); os.IsNotExist(statErr) {
+					if removeErr := store.fs.RemoveAll(filepath.Join(store.Path, "check", "indexes", checkIndex.ID)); nil != removeErr {
 						logging.LogErrorf("remove check index [%s] failed: %s", checkIndex.ID, removeErr)
 					}
 				}
@@ -236,39 +246,164 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 		}
 	}
 
-	fileCache.Clear()
-	indexCache.Clear()
+	clearCache()
 
 	logging.LogInfof("purged data repo [%s], [%d] indexes, [%d] objects, [%d] bytes", store.Path, ret.Indexes, ret.Objects, ret.Size)
 	return
 }
 
+// Migrate 将本地所有索引以及索引引用的文件对象重写为 format 格式，返回重写的索引数和文件数。
+func (store *Store) Migrate(format int) (indexes, files int, err error) {
+	logging.LogInfof("migrating data repo [%s] to format [%d]", store.Path, format)
+
+	store.Format = format
+	if err = store.checkWritable(); nil != err {
+		return
+	}
+	indexesDir := filepath.Join(store.Path, "indexes")
+	if !store.isDir(indexesDir) {
+		return
+	}
+
+	entries, err := store.fs.ReadDir(indexesDir)
+	if nil != err {
+		logging.LogErrorf("read indexes dir [%s] failed: %s", indexesDir, err)
+		return
+	}
+
+	migratedFiles := map[string]bool{}
+	for _, entry := range entries {
+		id := entry.Name()
+		if 40 != len(id) {
+			continue
+		}
+
+		var index *entity.Index
+		var migrated bool
+		if index, migrated, err = store.migrateIndex(id, format); nil != err {
+			logging.LogErrorf("migrate index [%s] failed: %s", id, err)
+			return
+		}
+		if migrated {
+			indexes++
+		}
+
+		for _, fileID := range index.Files {
+			if migratedFiles[fileID] {
+				continue
+			}
+			migratedFiles[fileID] = true
+
+			if migrated, err = store.migrateFile(fileID, format); nil != err {
+				logging.LogErrorf("migrate file [%s] failed: %s", fileID, err)
+				return
+			}
+			if migrated {
+				files++
+			}
+		}
+	}
+
+	clearCache()
+	logging.LogInfof("migrated data repo [%s] to format [%d], [%d] indexes, [%d] files", store.Path, format, indexes, files)
+	return
+}
+
+func (store *Store) migrateIndex(id string, format int) (index *entity.Index, migrated bool, err error) {
+	_, file := store.IndexAbsPath(id)
+	data, err := store.fs.ReadFile(file)
+	if nil != err {
+		return
+	}
+	if data, err = store.compressDecoder.DecodeAll(data, nil); nil != err {
+		return
+	}
+	if index, err = entity.UnmarshalIndex(data); nil != err {
+		return
+	}
+	if format == entity.DataFormat(data) {
+		return
+	}
+
+	err = store.PutIndex(index)
+	migrated = nil == err
+	return
+}
+
+func (store *Store) migrateFile(id string, format int) (migrated bool, err error) {
+	_, f := store.AbsPath(id)
+	data, err := store.fs.ReadFile(f)
+	if nil != err {
+		return
+	}
+	if data, err = store.decodeData(id, data); nil != err {
+		return
+	}
+	if format == entity.DataFormat(data) {
+		return
+	}
+
+	file, err := entity.UnmarshalFile(data)
+	if nil != err {
+		return
+	}
+	if data, err = entity.MarshalFile(file, format); nil != err {
+		return
+	}
+	if data, err = store.encodeData(id, data); nil != err {
+		return
+	}
+	if err = store.fs.WriteFile(f, data); nil != err {
+		return
+	}
+	migrated = true
+	return
+}
+
+// referencedObjects 用于获取索引 indexIDs 引用的文件和分块。
+func (store *Store) referencedObjects(indexIDs map[string]bool) (ret map[string]bool) {
+	ret = map[string]bool{}
+	for indexID := range indexIDs {
+		index, getErr := store.GetIndex(indexID)
+		if nil != getErr {
+			logging.LogWarnf("get index [%s] failed: %s", indexID, getErr)
+			continue
+		}
+
+		for _, fileID := range index.Files {
+			ret[fileID] = true
+			file, getFileErr := store.GetFile(fileID)
+			if nil != getFileErr {
+				logging.LogWarnf("get file [%s] failed: %s", fileID, getFileErr)
+				continue
+			}
+
+			for _, chunkID := range file.Chunks {
+				ret[chunkID] = true
+			}
+		}
+	}
+	return
+}
+
 func (store *Store) readRefs() (ret map[string]bool, err error) {
 	ret = map[string]bool{}
 	refsDir := filepath.Join(store.Path, "refs")
-	if !gulu.File.IsDir(refsDir) {
+	if !store.isDir(refsDir) {
 		return
 	}
 
-	err = filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+	err = store.walkFiles(refsDir, func(path string) error {
+		data, err := store.fs.ReadFile(path)
 		if nil != err {
 			return err
 		}
 
-		if info.IsDir() {
-			return nil
-		}
-
-		if 42 < info.Size() {
+		if 42 < len(data) {
 			logging.LogWarnf("ref file [%s] is invalid", path)
 			return nil
 		}
 
-		data, err := os.ReadFile(path)
-		if nil != err {
-			return err
-		}
-
 		content := strings.TrimSpace(string(data))
 		if 40 != len(content) {
 			logging.LogWarnf("ref file [%s] is invalid", path)
@@ -285,30 +420,48 @@ func (store *Store) PutIndex(index *entity.Index) (err error) {
 	if "" == index.ID {
 		return errors.New("invalid id")
 	}
+	if err = store.checkWritable(); nil != err {
+		return
+	}
 	dir, file := store.IndexAbsPath(index.ID)
-	if err = os.MkdirAll(dir, 0755); nil != err {
+	if err = store.fs.MkdirAll(dir); nil != err {
 		return errors.New("put index failed: " + err.Error())
 	}
 
-	data, err := gulu.JSON.MarshalJSON(index)
+	data, err := entity.MarshalIndex(index, store.Format)
 	if nil != err {
 		return errors.New("put index failed: " + err.Error())
 	}
+	cost := int64(len(data))
 
 	// Index 仅压缩，不加密
 	data = store.compressEncoder.EncodeAll(data, nil)
 
-	err = gulu.File.WriteFileSafer(file, data, 0644)
+	err = store.fs.WriteFile(file, data)
 	if nil != err {
 		return errors.New("put index failed: " + err.Error())
 	}
 
-	created := time.UnixMilli(index.Created)
-	if err = os.Chtimes(file, created, created); nil != err {
+	if err = store.fs.Chtimes(file, time.UnixMilli(index.Created)); nil != err {
 		logging.LogWarnf("change index [%s] time failed: %s", index.ID, err.Error())
 	}
+	if err = store.appendIndexLog(index); nil != err {
+		logging.LogWarnf("append index log [%s] failed: %s", index.ID, err)
+		err = nil
+	}
+
+	indexCache.Set(index.ID, index, cost)
+	return
+}
 
-	indexCache.Set(index.ID, index, int64(len(data)))
+// syncIndex 用于确认索引 id 已经写入并落盘，更新引用前调用，避免崩溃后引用指向不存在的索引。
+func (store *Store) syncIndex(id string) (err error) {
+	_, file := store.IndexAbsPath(id)
+	if !store.exist(file) {
+		err = ErrNotFoundIndex
+		return
+	}
+	err = store.fs.SyncFiles([]string{file})
 	return
 }
 
@@ -321,7 +474,7 @@ func (store *Store) GetIndex(id string) (ret *entity.Index, err error) {
 
 	_, file := store.IndexAbsPath(id)
 	var data []byte
-	data, err = os.ReadFile(file)
+	data, err = store.fs.ReadFile(file)
 	if nil != err {
 		return
 	}
@@ -329,8 +482,7 @@ func (store *Store) GetIndex(id string) (ret *entity.Index, err error) {
 	// Index 没有加密，直接解压
 	data, err = store.compressDecoder.DecodeAll(data, nil)
 	if nil == err {
-		ret = &entity.Index{}
-		err = gulu.JSON.UnmarshalJSON(data, ret)
+		ret, err = entity.UnmarshalIndex(data)
 	}
 	if nil != err {
 		return
@@ -344,28 +496,32 @@ func (store *Store) PutFile(file *entity.File) (err error) {
 	if "" == file.ID {
 		return errors.New("invalid id")
 	}
+	if err = store.checkWritable(); nil != err {
+		return
+	}
 	dir, f := store.AbsPath(file.ID)
-	if gulu.File.IsExist(f) {
+	if store.exist(f) {
 		return
 	}
-	if err = os.MkdirAll(dir, 0755); nil != err {
+	if err = store.fs.MkdirAll(dir); nil != err {
 		return errors.New("put failed: " + err.Error())
 	}
 
-	data, err := gulu.JSON.MarshalJSON(file)
+	data, err := entity.MarshalFile(file, store.Format)
 	if nil != err {
 		return errors.New("put file failed: " + err.Error())
 	}
-	if data, err = store.encodeData(data); nil != err {
+	cost := int64(len(data))
+	if data, err = store.encodeData(file.ID, data); nil != err {
 		return
 	}
 
-	err = gulu.File.WriteFileSafer(f, data, 0644)
+	err = store.fs.WriteFile(f, data)
 	if nil != err {
 		return errors.New("put file failed: " + err.Error())
 	}
 
-	fileCache.Set(file.ID, file, int64(len(data)))
+	fileCache.Set(file.ID, file, cost)
 	return
 }
 
@@ -377,17 +533,19 @@ func (store *Store) GetFile(id string) (ret *entity.File, err error) {
 	}
 
 	_, file := store.AbsPath(id)
-	data, err := os.ReadFile(file)
+	data, err := store.fs.ReadFile(file)
 	if nil != err {
 		return
 	}
-	if data, err = store.decodeData(data); nil != err {
+	if data, err = store.decodeData(id, data); nil != err {
+		err = &LocalCorruptError{ObjectID: id, Err: err}
+		store.quarantine(id, err)
 		return
 	}
-	ret = &entity.File{}
-	err = gulu.JSON.UnmarshalJSON(data, ret)
+	ret, err = entity.UnmarshalFile(data)
 	if nil != err {
-		ret = nil
+		err = &LocalCorruptError{ObjectID: id, Err: err}
+		store.quarantine(id, err)
 		return
 	}
 
@@ -399,34 +557,203 @@ func (store *Store) PutChunk(chunk *entity.Chunk) (err error) {
 	if "" == chunk.ID {
 		return errors.New("invalid id")
 	}
+	if err = store.checkWritable(); nil != err {
+		return
+	}
 	dir, file := store.AbsPath(chunk.ID)
-	if gulu.File.IsExist(file) {
+	if store.exist(file) {
 		return
 	}
 
-	if err = os.MkdirAll(dir, 0755); nil != err {
+	if err = store.fs.MkdirAll(dir); nil != err {
 		return errors.New("put chunk failed: " + err.Error())
 	}
 
 	data := chunk.Data
-	if data, err = store.encodeData(data); nil != err {
+	if data, err = store.encodeChunk(chunk.ID, data); nil != err {
 		return
 	}
 
-	err = gulu.File.WriteFileSafer(file, data, 0644)
+	err = store.fs.WriteFile(file, data)
 	if nil != err {
 		return errors.New("put chunk failed: " + err.Error())
 	}
 	return
 }
 
+// PutFiles 批量写入文件对象，多个对象共用一次落盘同步。
+func (store *Store) PutFiles(files []*entity.File) (err error) {
+	if err = store.checkWritable(); nil != err {
+		return
+	}
+
+	var ids []string
+	var data [][]byte
+	for _, file := range files {
+		if "" == file.ID {
+			return errors.New("invalid id")
+		}
+
+		var d []byte
+		if d, err = entity.MarshalFile(file, store.Format); nil != err {
+			return errors.New("put files failed: " + err.Error())
+		}
+		if d, err = store.encodeData(file.ID, d); nil != err {
+			return
+		}
+		ids = append(ids, file.ID)
+		data = append(data, d)
+	}
+
+	if err = store.putObjects(ids, data); nil != err {
+		return errors.New("put files failed: " + err.Error())
+	}
+
+	for _, file := range files {
+		store.cacheFile(file)
+	}
+	return
+}
+
+// PutChunks 批量写入分块对象，多个对象共用一次落盘同步。
+func (store *Store) PutChunks(chunks []*entity.Chunk) (err error) {
+	if err = store.checkWritable(); nil != err {
+		return
+	}
+
+	var ids []string
+	var data [][]byte
+	for _, chunk := range chunks {
+		if "" == chunk.ID {
+			return errors.New("invalid id")
+		}
+
+		var d []byte
+		if d, err = store.encodeChunk(chunk.ID, chunk.Data); nil != err {
+			return
+		}
+		ids = append(ids, chunk.ID)
+		data = append(data, d)
+	}
+
+	if err = store.putObjects(ids, data); nil != err {
+		return errors.New("put chunks failed: " + err.Error())
+	}
+	return
+}
+
+// putObjects 批量写入已编码的对象数据。
+//
+// 逐个对象 fsync 在 Windows 和 Android 上非常慢，这里先把所有对象写入（不落盘）并重命名到位，最后统一落盘一次。
+// 为了保证崩溃安全，写入前会先落盘一个批次日志记录本批次的对象 ID，统一落盘对象和所在的分片文件夹后再删除日志。
+// 如果写入过程中崩溃，下次打开存储库时会根据遗留的日志校验这些对象，删除损坏的对象以便后续重新写入，参考 recoverBatches()。
+func (store *Store) putObjects(ids []string, data [][]byte) (err error) {
+	var pendingIDs []string
+	var pendingData [][]byte
+	for i, id := range ids {
+		if _, file := store.AbsPath(id); store.exist(file) {
+			continue
+		}
+		pendingIDs = append(pendingIDs, id)
+		pendingData = append(pendingData, data[i])
+	}
+	if 1 > len(pendingIDs) {
+		return
+	}
+
+	batchesDir := filepath.Join(store.Path, "batches")
+	if err = store.fs.MkdirAll(batchesDir); nil != err {
+		return
+	}
+	batch := filepath.Join(batchesDir, util.RandHash())
+	if err = store.fs.WriteFile(batch, []byte(strings.Join(pendingIDs, "\n"))); nil != err {
+		return
+	}
+
+	var written, dirs []string
+	dirSet := map[string]bool{}
+	objectsPath := filepath.Clean(store.ObjectsPath)
+	for i, id := range pendingIDs {
+		dir, file := store.AbsPath(id)
+		if err = store.fs.MkdirAll(dir); nil != err {
+			return
+		}
+		if err = store.fs.WriteFileNoSync(file, pendingData[i]); nil != err {
+			return
+		}
+		written = append(written, file)
+		// 分片文件夹可能是新建的，所以上级文件夹直到对象文件夹也需要落盘
+		for d := dir; !dirSet[d] && strings.HasPrefix(d, objectsPath); d = filepath.Dir(d) {
+			dirSet[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+
+	if err = store.fs.SyncFiles(written); nil != err {
+		return
+	}
+	// 重命名到位的目录项也需要落盘，否则崩溃后对象可能丢失而批次日志已被删除
+	if err = store.fs.SyncDirs(dirs); nil != err {
+		return
+	}
+
+	if removeErr := store.fs.RemoveAll(batch); nil != removeErr {
+		logging.LogWarnf("remove batch [%s] failed: %s", batch, removeErr)
+	}
+	return
+}
+
+// recoverBatches 校验未完成批次中写入的对象，删除因崩溃而损坏的对象。
+func (store *Store) recoverBatches() {
+	batchesDir := filepath.Join(store.Path, "batches")
+	entries, err := store.fs.ReadDir(batchesDir)
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		batch := filepath.Join(batchesDir, entry.Name())
+		data, readErr := store.fs.ReadFile(batch)
+		if nil != readErr {
+			logging.LogWarnf("read batch [%s] failed: %s", batch, readErr)
+			continue
+		}
+
+		for _, id := range strings.Split(string(data), "\n") {
+			if 40 != len(id) {
+				continue
+			}
+
+			_, file := store.AbsPath(id)
+			objData, readObjErr := store.fs.ReadFile(file)
+			if nil != readObjErr {
+				continue
+			}
+			if _, decodeErr := store.decodeData(id, objData); nil == decodeErr || store.isPlainChunk(id, objData) {
+				continue
+			}
+
+			logging.LogWarnf("remove corrupted object [%s] written by unfinished batch [%s]", id, entry.Name())
+			if removeErr := store.Remove(id); nil != removeErr {
+				logging.LogErrorf("remove corrupted object [%s] failed: %s", id, removeErr)
+			}
+		}
+
+		if removeErr := store.fs.RemoveAll(batch); nil != removeErr {
+			logging.LogWarnf("remove batch [%s] failed: %s", batch, removeErr)
+		}
+	}
+}
+
 func (store *Store) GetChunk(id string) (ret *entity.Chunk, err error) {
 	_, file := store.AbsPath(id)
-	data, err := os.ReadFile(file)
+	data, err := store.fs.ReadFile(file)
 	if nil != err {
 		return
 	}
-	if data, err = store.decodeData(data); nil != err {
+	if data, err = store.decodeChunk(id, data); nil != err {
+		err = &LocalCorruptError{ObjectID: id, Err: err}
+		store.quarantine(id, err)
 		return
 	}
 	ret = &entity.Chunk{ID: id, Data: data}
@@ -435,13 +762,15 @@ func (store *Store) GetChunk(id string) (ret *entity.Chunk, err error) {
 
 func (store *Store) Remove(id string) (err error) {
 	_, file := store.AbsPath(id)
-	err = os.RemoveAll(file)
+	err = store.fs.RemoveAll(file)
+	fileCache.Del(id)
+	indexCache.Del(id)
 	return
 }
 
 func (store *Store) Stat(id string) (stat os.FileInfo, err error) {
 	_, file := store.AbsPath(id)
-	stat, err = os.Stat(file)
+	stat, err = store.fs.Stat(file)
 	return
 }
 
@@ -451,20 +780,37 @@ func (store *Store) IndexAbsPath(id string) (dir, file string) {
 	return
 }
 
+// indexExist 用于判断索引 id 的文件是否存在，不会读取索引缓存。
+func (store *Store) indexExist(id string) bool {
+	_, file := store.IndexAbsPath(id)
+	return store.exist(file)
+}
+
 func (store *Store) AbsPath(id string) (dir, file string) {
-	dir, file = id[0:2], id[2:]
-	dir = filepath.Join(store.Path, "objects", dir)
-	file = filepath.Join(dir, file)
+	dir, file = store.shardPath(id, store.ShardDepth)
+	if store.migratingShard && !store.exist(file) {
+		for depth := 1; depth <= maxShardDepth; depth++ {
+			if legacyDir, legacyFile := store.shardPath(id, depth); store.exist(legacyFile) {
+				return legacyDir, legacyFile
+			}
+		}
+	}
 	return
 }
 
-func (store *Store) encodeData(data []byte) ([]byte, error) {
+// ObjectPath 用于获取数据对象 id 的本地文件绝对路径。
+func (store *Store) ObjectPath(id string) string {
+	_, file := store.AbsPath(id)
+	return file
+}
+
+func (store *Store) encodeData(id string, data []byte) ([]byte, error) {
 	data = store.compressEncoder.EncodeAll(data, nil)
-	return encryption.AesEncrypt(data, store.AesKey)
+	return encrypt(store.Encryption, store.AesKey, id, data)
 }
 
-func (store *Store) decodeData(data []byte) (ret []byte, err error) {
-	ret, err = encryption.AesDecrypt(data, store.AesKey)
+func (store *Store) decodeData(id string, data []byte) (ret []byte, err error) {
+	ret, _, err = decrypt(store.AesKey, id, data)
 	if nil != err {
 		return
 	}
@@ -472,6 +818,60 @@ func (store *Store) decodeData(data []byte) (ret []byte, err error) {
 	return
 }
 
+// encodeChunk 用于编码分块对象 id 的数据，开启 Plain 时原样返回。
+func (store *Store) encodeChunk(id string, data []byte) ([]byte, error) {
+	if store.Plain {
+		return data, nil
+	}
+	return store.encodeData(id, data)
+}
+
+// decodeChunk 用于解码分块对象 id 的数据。
+//
+// 分块 ID 是分块数据的哈希值，所以不压缩不加密的分块对象可以通过哈希值识别，关闭 Plain 后之前写入的分块对象仍然可以读取。
+func (store *Store) decodeChunk(id string, data []byte) (ret []byte, err error) {
+	if store.Plain && store.isPlainChunk(id, data) {
+		ret = data
+		return
+	}
+	if ret, err = store.decodeData(id, data); nil != err && store.isPlainChunk(id, data) {
+		ret, err = data, nil
+	}
+	return
+}
+
+// sealPlainChunk 用于将不压缩不加密的分块对象 id 重新压缩加密后写回，上传分块对象前调用，以免开启链接迁出时写入的明文分块对象被上传到云端。
+//
+// 写回时替换数据对象文件，所以已经硬链接到数据文件的数据对象不受影响。
+func (store *Store) sealPlainChunk(id string) (err error) {
+	_, file := store.AbsPath(id)
+	data, err := store.fs.ReadFile(file)
+	if nil != err {
+		return
+	}
+	if !store.isPlainChunk(id, data) {
+		return
+	}
+
+	if data, err = store.encodeData(id, data); nil != err {
+		return
+	}
+	if err = store.fs.WriteFile(file, data); nil != err {
+		return
+	}
+	logging.LogInfof("sealed plain chunk [%s] before upload", id)
+	return
+}
+
+// isPlainChunk 用于判断数据 data 是否是不压缩不加密的分块对象 id。
+func (store *Store) isPlainChunk(id string, data []byte) bool {
+	return util.Hash(data) == id
+}
+
+// fileCache 和 indexCache 缓存已经解码的文件和索引对象，键为对象 ID。
+//
+// 缓存为进程级别，多个 Store 实例共享（调用方通常每次操作都会新建仓库实例），对象 ID 是内容哈希所以不会冲突。
+// 缓存按解码后的 JSON 字节数计算开销，超过 MaxCost 后自动淘汰。
 var fileCache, _ = ristretto.NewCache(&ristretto.Config{
 	NumCounters: 200000,
 	MaxCost:     1000 * 1000 * 32, // 1 个文件按 300 字节计算，32MB 大概可以缓存 10W 个文件实例
@@ -484,6 +884,11 @@ var indexCache, _ = ristretto.NewCache(&ristretto.Config{
 	BufferItems: 64,
 })
 
+func clearCache() {
+	fileCache.Clear()
+	indexCache.Clear()
+}
+
 func (store *Store) cacheFile(file *entity.File) {
 	fileCache.Set(file.ID, file, 256 /* 直接使用合理的均值以免进行实际计算消耗性能 */)
 }
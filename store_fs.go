@@ -0,0 +1,378 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/util"
+)
+
+// StoreFS 描述了存储库读写索引、数据对象和元数据文件时使用的文件系统，默认使用本地文件系统。
+//
+// 在浏览器或者扩展等没有本地文件系统的环境（比如编译为 WASM）中，可以基于 OPFS 或者 IndexedDB 实现该接口，
+// 然后通过 NewStoreWithFS 创建存储库来读取快照和下载云端数据。路径参数都是存储库下的绝对路径，文件不存在时需要返回 os.ErrNotExist。
+//
+// 清理、迁移格式和迁移分片等维护操作仍然直接访问本地文件系统。
+type StoreFS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error       // 原子写入并落盘
+	WriteFileNoSync(name string, data []byte) error // 原子写入但不落盘，之后通过 SyncFiles 批量落盘
+	SyncFiles(names []string) error
+	SyncDirs(dirs []string) error              // 落盘文件夹的目录项，保证 WriteFileNoSync 重命名到位的文件在崩溃后仍然存在
+	AppendFile(name string, data []byte) error // 追加写入，文件不存在时创建
+	MkdirAll(path string) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldPath, newPath string) error
+	RemoveAll(path string) error
+	Chtimes(name string, modTime time.Time) error
+}
+
+// NewStoreWithFS 和 NewStore 一样创建存储库，并使用 storeFS 读写存储库文件。
+func NewStoreWithFS(path string, aesKey []byte, storeFS StoreFS) (ret *Store, err error) {
+	return newStore(path, aesKey, false, storeFS)
+}
+
+// exist 用于判断存储库文件 name 是否存在。
+func (store *Store) exist(name string) bool {
+	_, err := store.fs.Stat(name)
+	return nil == err
+}
+
+// isDir 用于判断存储库文件夹 name 是否存在。
+func (store *Store) isDir(name string) bool {
+	info, err := store.fs.Stat(name)
+	return nil == err && info.IsDir()
+}
+
+// walkFiles 用于按文件名顺序递归遍历存储库文件夹 dir 下的所有文件。
+func (store *Store) walkFiles(dir string, fn func(path string) error) (err error) {
+	entries, err := store.fs.ReadDir(dir)
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			err = store.walkFiles(path, fn)
+		} else {
+			err = fn(path)
+		}
+		if nil != err {
+			return
+		}
+	}
+	return
+}
+
+// removeEmptyDirs 用于删除存储库文件夹 dir 下的所有空文件夹，dir 本身不删除。
+func (store *Store) removeEmptyDirs(dir string) (empty bool, err error) {
+	entries, err := store.fs.ReadDir(dir)
+	if nil != err {
+		return
+	}
+
+	empty = true
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			empty = false
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		subEmpty, subErr := store.removeEmptyDirs(path)
+		if nil != subErr {
+			err = subErr
+			return
+		}
+		if !subEmpty {
+			empty = false
+			continue
+		}
+		if err = store.fs.RemoveAll(path); nil != err {
+			return
+		}
+	}
+	return
+}
+
+// osFS 描述了本地文件系统。
+type osFS struct{}
+
+func (*osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (*osFS) WriteFile(name string, data []byte) error {
+	return gulu.File.WriteFileSafer(name, data, 0644)
+}
+
+func (*osFS) WriteFileNoSync(name string, data []byte) (err error) {
+	tmp := name + gulu.Rand.String(7) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); nil != err {
+		return
+	}
+	if err = os.Rename(tmp, name); nil != err {
+		os.Remove(tmp)
+	}
+	return
+}
+
+func (*osFS) SyncFiles(names []string) error {
+	return util.SyncFiles(names)
+}
+
+func (*osFS) SyncDirs(dirs []string) error {
+	return util.SyncDirs(dirs)
+}
+
+func (*osFS) AppendFile(name string, data []byte) (err error) {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if nil != err {
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	return
+}
+
+func (*osFS) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (*osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (*osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (*osFS) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (*osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (*osFS) Chtimes(name string, modTime time.Time) error {
+	return os.Chtimes(name, modTime, modTime)
+}
+
+// MemStoreFS 描述了内存文件系统，数据只保存在内存中，可以用于在没有持久化存储的环境中临时读取快照，也可以作为实现其他 StoreFS 的参考。
+type MemStoreFS struct {
+	files map[string]*memFile
+	dirs  map[string]bool
+	lock  sync.RWMutex
+}
+
+// memFile 描述了内存文件系统中的文件。
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemStoreFS 用于创建一个空的内存文件系统。
+func NewMemStoreFS() *MemStoreFS {
+	return &MemStoreFS{files: map[string]*memFile{}, dirs: map[string]bool{}}
+}
+
+func (memFS *MemStoreFS) ReadFile(name string) (ret []byte, err error) {
+	memFS.lock.RLock()
+	defer memFS.lock.RUnlock()
+
+	f := memFS.files[filepath.Clean(name)]
+	if nil == f {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		return
+	}
+	ret = append([]byte{}, f.data...)
+	return
+}
+
+func (memFS *MemStoreFS) WriteFile(name string, data []byte) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if !memFS.dirs[filepath.Dir(name)] {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	memFS.files[name] = &memFile{data: append([]byte{}, data...), modTime: time.Now()}
+	return nil
+}
+
+func (memFS *MemStoreFS) WriteFileNoSync(name string, data []byte) error {
+	return memFS.WriteFile(name, data)
+}
+
+func (memFS *MemStoreFS) SyncFiles(names []string) error {
+	return nil
+}
+
+func (memFS *MemStoreFS) SyncDirs(dirs []string) error {
+	return nil
+}
+
+func (memFS *MemStoreFS) AppendFile(name string, data []byte) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if !memFS.dirs[filepath.Dir(name)] {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f := memFS.files[name]
+	if nil == f {
+		f = &memFile{}
+		memFS.files[name] = f
+	}
+	f.data = append(f.data, data...)
+	f.modTime = time.Now()
+	return nil
+}
+
+func (memFS *MemStoreFS) MkdirAll(path string) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	for dir := filepath.Clean(path); !memFS.dirs[dir]; dir = filepath.Dir(dir) {
+		memFS.dirs[dir] = true
+	}
+	return nil
+}
+
+func (memFS *MemStoreFS) ReadDir(name string) (ret []os.DirEntry, err error) {
+	memFS.lock.RLock()
+	defer memFS.lock.RUnlock()
+
+	name = filepath.Clean(name)
+	if !memFS.dirs[name] {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		return
+	}
+	for p, f := range memFS.files {
+		if name == filepath.Dir(p) {
+			ret = append(ret, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(p), size: int64(len(f.data)), modTime: f.modTime}))
+		}
+	}
+	for p := range memFS.dirs {
+		if name == filepath.Dir(p) && name != p {
+			ret = append(ret, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(p), dir: true}))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return
+}
+
+func (memFS *MemStoreFS) Stat(name string) (ret os.FileInfo, err error) {
+	memFS.lock.RLock()
+	defer memFS.lock.RUnlock()
+
+	name = filepath.Clean(name)
+	if f := memFS.files[name]; nil != f {
+		ret = &memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), modTime: f.modTime}
+		return
+	}
+	if memFS.dirs[name] {
+		ret = &memFileInfo{name: filepath.Base(name), dir: true}
+		return
+	}
+	err = &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	return
+}
+
+func (memFS *MemStoreFS) Rename(oldPath, newPath string) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	f := memFS.files[oldPath]
+	if nil == f {
+		return &fs.PathError{Op: "rename", Path: oldPath, Err: fs.ErrNotExist}
+	}
+	if !memFS.dirs[filepath.Dir(newPath)] {
+		return &fs.PathError{Op: "rename", Path: newPath, Err: fs.ErrNotExist}
+	}
+	delete(memFS.files, oldPath)
+	memFS.files[newPath] = f
+	return nil
+}
+
+func (memFS *MemStoreFS) RemoveAll(path string) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for p := range memFS.files {
+		if path == p || strings.HasPrefix(p, prefix) {
+			delete(memFS.files, p)
+		}
+	}
+	for p := range memFS.dirs {
+		if path == p || strings.HasPrefix(p, prefix) {
+			delete(memFS.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (memFS *MemStoreFS) Chtimes(name string, modTime time.Time) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	f := memFS.files[filepath.Clean(name)]
+	if nil == f {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	f.modTime = modTime
+	return nil
+}
+
+// memFileInfo 描述了内存文件系统中文件的信息。
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (info *memFileInfo) Name() string       { return info.name }
+func (info *memFileInfo) Size() int64        { return info.size }
+func (info *memFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memFileInfo) IsDir() bool        { return info.dir }
+func (info *memFileInfo) Sys() interface{}   { return nil }
+
+func (info *memFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -18,8 +18,13 @@ package dejavu
 
 import (
 	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/88250/gulu"
 	"github.com/siyuan-note/dejavu/entity"
 	"github.com/siyuan-note/dejavu/util"
 	"github.com/siyuan-note/encryption"
@@ -70,3 +75,586 @@ func TestPutGet(t *testing.T) {
 		return
 	}
 }
+
+func TestStoreWithMemFS(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	memFS := NewMemStoreFS()
+	store, err := NewStoreWithFS(testRepoPath, aesKey, memFS)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+
+	data := []byte("Hello!")
+	chunk := &entity.Chunk{ID: util.Hash(data), Data: data}
+	if err = store.PutChunks([]*entity.Chunk{chunk}); nil != err {
+		t.Fatalf("put chunks failed: %s", err)
+		return
+	}
+	file := entity.NewFile("/foo", int64(len(data)), 0)
+	file.Chunks = []string{chunk.ID}
+	if err = store.PutFile(file); nil != err {
+		t.Fatalf("put file failed: %s", err)
+		return
+	}
+	index := &entity.Index{ID: util.RandHash(), Memo: "mem", Created: 1, Files: []string{file.ID}, Count: 1, Size: file.Size}
+	if err = store.PutIndex(index); nil != err {
+		t.Fatalf("put index failed: %s", err)
+		return
+	}
+
+	if gulu.File.IsExist(testRepoPath) {
+		t.Fatalf("store should not write to local file system")
+		return
+	}
+
+	chunk, err = store.GetChunk(chunk.ID)
+	if nil != err {
+		t.Fatalf("get chunk failed: %s", err)
+		return
+	}
+	if !bytes.Equal(data, chunk.Data) {
+		t.Fatalf("data not match")
+		return
+	}
+	clearCache()
+	if file, err = store.GetFile(file.ID); nil != err || 1 != len(file.Chunks) {
+		t.Fatalf("get file failed: %v", err)
+		return
+	}
+	if index, err = store.GetIndex(index.ID); nil != err || "mem" != index.Memo {
+		t.Fatalf("get index failed: %v", err)
+		return
+	}
+	entries, err := store.readIndexLog()
+	if nil != err {
+		t.Fatalf("read index log failed: %s", err)
+		return
+	}
+	if 1 != len(entries) || index.ID != entries[0].ID || 1 != entries[0].Created {
+		t.Fatalf("index log not match")
+		return
+	}
+	if batches, _ := memFS.ReadDir(filepath.Join(testRepoPath, "batches")); 0 != len(batches) {
+		t.Fatalf("batch should be removed")
+		return
+	}
+
+	// 迁移和清理也只通过 StoreFS 读写
+	if moved, migrateErr := store.migrateShardDepth(2); nil != migrateErr || 2 != moved {
+		t.Fatalf("migrate shard depth failed: %v, moved [%d]", migrateErr, moved)
+		return
+	}
+	if objects, migrateErr := store.MigrateEncryption(EncryptionAEAD); nil != migrateErr || 2 != objects {
+		t.Fatalf("migrate encryption failed: %v, objects [%d]", migrateErr, objects)
+		return
+	}
+	if indexes, files, migrateErr := store.Migrate(entity.FormatBinary); nil != migrateErr || 1 != indexes || 1 != files {
+		t.Fatalf("migrate format failed: %v, indexes [%d], files [%d]", migrateErr, indexes, files)
+		return
+	}
+	clearCache()
+	if chunk, err = store.GetChunk(chunk.ID); nil != err || !bytes.Equal(data, chunk.Data) {
+		t.Fatalf("get migrated chunk failed: %v", err)
+		return
+	}
+
+	if err = store.Remove(chunk.ID); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if _, err = store.GetChunk(chunk.ID); !os.IsNotExist(err) {
+		t.Fatalf("get removed chunk should be not exist: %v", err)
+		return
+	}
+
+	purgeStat, err := store.Purge()
+	if nil != err || 1 != purgeStat.Indexes || 1 != purgeStat.Objects {
+		t.Fatalf("purge failed: %v", err)
+		return
+	}
+	if gulu.File.IsExist(testRepoPath) {
+		t.Fatalf("store should not write to local file system")
+		return
+	}
+}
+
+func TestPutChunksRecoverBatches(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	store, err := NewStore(testRepoPath, aesKey)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+
+	var chunks []*entity.Chunk
+	for _, data := range [][]byte{[]byte("Hello!"), []byte("World!")} {
+		chunks = append(chunks, &entity.Chunk{ID: util.Hash(data), Data: data})
+	}
+	if err = store.PutChunks(chunks); nil != err {
+		t.Fatalf("put chunks failed: %s", err)
+		return
+	}
+	for _, chunk := range chunks {
+		if _, err = store.GetChunk(chunk.ID); nil != err {
+			t.Fatalf("get chunk failed: %s", err)
+			return
+		}
+	}
+
+	// 模拟批量写入过程中崩溃：遗留批次日志并且对象内容损坏
+	corrupted := chunks[0].ID
+	_, file := store.AbsPath(corrupted)
+	if err = os.WriteFile(file, []byte("torn"), 0644); nil != err {
+		t.Fatalf("write corrupted object failed: %s", err)
+		return
+	}
+	batchesDir := filepath.Join(testRepoPath, "batches")
+	if err = os.MkdirAll(batchesDir, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(batchesDir, "crashed"), []byte(corrupted+"\n"+chunks[1].ID), 0644); nil != err {
+		t.Fatalf("write batch failed: %s", err)
+		return
+	}
+
+	store, err = NewStore(testRepoPath, aesKey)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+	if _, err = store.Stat(corrupted); !os.IsNotExist(err) {
+		t.Fatalf("corrupted object should be removed")
+		return
+	}
+	if _, err = store.GetChunk(chunks[1].ID); nil != err {
+		t.Fatalf("get chunk failed: %s", err)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(batchesDir, "crashed")) {
+		t.Fatalf("batch should be removed")
+		return
+	}
+}
+
+// syncDirsFS 记录落盘的文件夹以及落盘时遗留的批次日志数。
+type syncDirsFS struct {
+	*MemStoreFS
+	batchesDir string
+	dirs       []string
+	batches    int
+}
+
+func (fs *syncDirsFS) SyncDirs(dirs []string) error {
+	fs.dirs = append(fs.dirs, dirs...)
+	entries, _ := fs.ReadDir(fs.batchesDir)
+	fs.batches = len(entries)
+	return fs.MemStoreFS.SyncDirs(dirs)
+}
+
+func TestPutChunksSyncDirs(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	fs := &syncDirsFS{MemStoreFS: NewMemStoreFS(), batchesDir: filepath.Join(testRepoPath, "batches")}
+	store, err := NewStoreWithFS(testRepoPath, aesKey, fs)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+
+	var chunks []*entity.Chunk
+	for _, data := range [][]byte{[]byte("Hello!"), []byte("World!")} {
+		chunks = append(chunks, &entity.Chunk{ID: util.Hash(data), Data: data})
+	}
+	if err = store.PutChunks(chunks); nil != err {
+		t.Fatalf("put chunks failed: %s", err)
+		return
+	}
+
+	// 分片文件夹和对象文件夹都需要在删除批次日志前落盘
+	synced := map[string]bool{}
+	for _, dir := range fs.dirs {
+		synced[dir] = true
+	}
+	if len(synced) != len(fs.dirs) {
+		t.Fatalf("dirs should be synced once: %v", fs.dirs)
+		return
+	}
+	if !synced[filepath.Clean(store.ObjectsPath)] {
+		t.Fatalf("objects dir should be synced: %v", fs.dirs)
+		return
+	}
+	for _, chunk := range chunks {
+		if dir, _ := store.AbsPath(chunk.ID); !synced[dir] {
+			t.Fatalf("shard dir [%s] should be synced: %v", dir, fs.dirs)
+			return
+		}
+	}
+	if 1 != fs.batches {
+		t.Fatalf("batch should be removed after dirs synced")
+		return
+	}
+	if batches, _ := fs.ReadDir(fs.batchesDir); 0 != len(batches) {
+		t.Fatalf("batch should be removed")
+		return
+	}
+}
+
+func TestGetCorruptedChunk(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	store, err := NewStore(testRepoPath, aesKey)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+
+	data := []byte("Hello!")
+	chunk := &entity.Chunk{ID: util.Hash(data), Data: data}
+	if err = store.PutChunk(chunk); nil != err {
+		t.Fatalf("put failed: %s", err)
+		return
+	}
+	_, file := store.AbsPath(chunk.ID)
+	if err = os.WriteFile(file, bytes.Repeat([]byte("x"), 64), 0644); nil != err {
+		t.Fatalf("write corrupted object failed: %s", err)
+		return
+	}
+
+	_, err = store.GetChunk(chunk.ID)
+	if !errors.Is(err, ErrLocalCorrupt) {
+		t.Fatalf("get should be failed with corrupt error: %v", err)
+		return
+	}
+	var corruptErr *LocalCorruptError
+	if !errors.As(err, &corruptErr) || chunk.ID != corruptErr.ObjectID {
+		t.Fatalf("corrupt error object id not match: %v", err)
+		return
+	}
+}
+
+func TestShareObjects(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	sharedDir := filepath.Join(testTempPath, "shared-objects")
+	dataA, dataB := filepath.Join(testTempPath, "shared-data-a"), filepath.Join(testTempPath, "shared-data-b")
+	repoPathB := filepath.Join(testTempPath, "shared-repo-b")
+	for _, dir := range []string{sharedDir, dataA, dataB, repoPathB} {
+		if err = os.RemoveAll(dir); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+	}
+	newRepo := func(dataPath, repoPath, name, content string) *Repo {
+		if err = os.MkdirAll(dataPath, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+		}
+		if err = os.WriteFile(filepath.Join(dataPath, name), []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+		repo, newErr := NewRepo(dataPath, repoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+		if nil != newErr {
+			t.Fatalf("new repo failed: %s", newErr)
+		}
+		return repo
+	}
+
+	repoA := newRepo(dataA, testRepoPath, "a.txt", "shared")
+	if _, err = repoA.Index("a", true, map[string]interface{}{}); nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if err = repoA.ShareObjects(sharedDir); nil != err {
+		t.Fatalf("share objects failed: %s", err)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(testRepoPath, "objects")) {
+		t.Fatalf("objects should be moved to shared dir")
+		return
+	}
+
+	repoB := newRepo(dataB, repoPathB, "b.txt", "shared only by b")
+	if err = repoB.ShareObjects(sharedDir); nil != err {
+		t.Fatalf("share objects failed: %s", err)
+		return
+	}
+	indexB, err := repoB.Index("b", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	// 仓库 A 清理时不能清理仓库 B 引用的数据对象
+	if _, err = repoA.Purge(); nil != err {
+		t.Fatalf("purge failed: %s", err)
+		return
+	}
+	filesB, err := repoB.GetFiles(indexB)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	data, err := repoB.OpenFile(filesB[0])
+	if nil != err || "shared only by b" != string(data) {
+		t.Fatalf("object referenced by other repo should be kept: %v", err)
+		return
+	}
+}
+
+func TestMigrateShardDepth(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if _, err := repo.MigrateShardDepth(maxShardDepth + 1); !errors.Is(err, ErrInvalidShardDepth) {
+		t.Fatalf("invalid shard depth should be rejected: %v", err)
+		return
+	}
+
+	moved, err := repo.MigrateShardDepth(2)
+	if nil != err {
+		t.Fatalf("migrate shard depth failed: %s", err)
+		return
+	}
+	if 1 > moved {
+		t.Fatalf("objects should be moved")
+		return
+	}
+
+	fileID := index.Files[0]
+	if _, file := repo.store.shardPath(fileID, 2); !gulu.File.IsExist(file) {
+		t.Fatalf("object [%s] should be at depth 2", fileID)
+		return
+	}
+	if _, err = repo.GetFiles(index); nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+
+	store, err := NewStore(testRepoPath, repo.store.AesKey)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+	if 2 != store.ShardDepth {
+		t.Fatalf("shard depth should be persisted, got [%d]", store.ShardDepth)
+		return
+	}
+
+	// 迁移中断时仍然可以读取旧分片路径下的对象
+	_, from := store.shardPath(fileID, 2)
+	dir, to := store.shardPath(fileID, 1)
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.Rename(from, to); nil != err {
+		t.Fatalf("rename failed: %s", err)
+		return
+	}
+	store.migratingShard = true
+	clearCache()
+	if _, err = store.GetFile(fileID); nil != err {
+		t.Fatalf("get legacy object failed: %s", err)
+		return
+	}
+}
+
+func TestMigrateObjectEncryption(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if _, err := repo.MigrateObjectEncryption(EncryptionAEAD + 1); !errors.Is(err, ErrUnknownEncryption) {
+		t.Fatalf("unknown encryption should be rejected: %v", err)
+		return
+	}
+
+	objects, err := repo.MigrateObjectEncryption(EncryptionAEAD)
+	if nil != err {
+		t.Fatalf("migrate object encryption failed: %s", err)
+		return
+	}
+	if 1 > objects {
+		t.Fatalf("objects should be re-encrypted")
+		return
+	}
+	if objects, err = repo.MigrateObjectEncryption(EncryptionAEAD); nil != err || 0 != objects {
+		t.Fatalf("migrated objects should be skipped [%d]: %v", objects, err)
+		return
+	}
+
+	// 加密方式会保存在仓库中，重新打开后仍然生效
+	reopened, err := NewStore(repo.Path, repo.store.AesKey)
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+	if EncryptionAEAD != reopened.Encryption {
+		t.Fatalf("encryption should be loaded after reopen [%d]", reopened.Encryption)
+		return
+	}
+
+	// 只读仓库迁移失败时不会改变后续写入的加密方式
+	readOnly, err := newStore(repo.Path, repo.store.AesKey, true, &osFS{})
+	if nil != err {
+		t.Fatalf("new store failed: %s", err)
+		return
+	}
+	if _, err = readOnly.MigrateEncryption(EncryptionLegacy); !errors.Is(err, ErrRepoReadOnly) || EncryptionAEAD != readOnly.Encryption {
+		t.Fatalf("read only migration should not change encryption [%d]: %v", readOnly.Encryption, err)
+		return
+	}
+
+	fileID := index.Files[0]
+	_, file := repo.store.AbsPath(fileID)
+	data, err := os.ReadFile(file)
+	if nil != err {
+		t.Fatalf("read object failed: %s", err)
+		return
+	}
+	if !isAEADEncrypted(data) {
+		t.Fatalf("object [%s] should be encrypted with AEAD", fileID)
+		return
+	}
+
+	// 密文绑定了对象 ID，替换为其他对象的密文或者篡改后都无法解密
+	if _, err = repo.store.decodeData(strings.Repeat("0", 40), data); nil == err {
+		t.Fatalf("decode with another object id should fail")
+		return
+	}
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err = repo.store.decodeData(fileID, tampered); nil == err {
+		t.Fatalf("decode tampered data should fail")
+		return
+	}
+
+	clearCache()
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	for _, f := range files {
+		for _, chunkID := range f.Chunks {
+			if _, err = repo.store.GetChunk(chunkID); nil != err {
+				t.Fatalf("get chunk failed: %s", err)
+				return
+			}
+		}
+	}
+
+	// 旧格式对象仍然可以读取
+	if _, err = repo.MigrateObjectEncryption(EncryptionLegacy); nil != err {
+		t.Fatalf("migrate object encryption failed: %s", err)
+		return
+	}
+	clearCache()
+	if _, err = repo.store.GetFile(fileID); nil != err {
+		t.Fatalf("get legacy object failed: %s", err)
+		return
+	}
+	if reopened, err = NewStore(repo.Path, repo.store.AesKey); nil != err || EncryptionLegacy != reopened.Encryption {
+		t.Fatalf("legacy encryption should be loaded after reopen: %v", err)
+		return
+	}
+}
+
+func TestRepoFormat(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if t.Failed() {
+		return
+	}
+	formatPath := filepath.Join(repo.Path, repoFormatFile)
+	defer clearTestdata(t) // 避免限制格式版本的仓库影响后续测试
+	if !gulu.File.IsExist(formatPath) {
+		t.Fatalf("repo format should be saved on first write")
+		return
+	}
+	if format := repo.GetRepoFormat(); RepoFormatLegacy != format.MinReader || RepoFormatVersion != format.Version {
+		t.Fatalf("unexpected repo format: %+v", format)
+		return
+	}
+
+	// 使用新格式特性写入后提升格式版本
+	repo.SetObjectFormat(entity.FormatBinary)
+	if err := repo.PutIndex(index); nil != err {
+		t.Fatalf("put index failed: %s", err)
+		return
+	}
+	if format := repo.GetRepoFormat(); RepoFormatExtended != format.MinReader || RepoFormatExtended != format.MinWriter {
+		t.Fatalf("repo format should be raised: %+v", format)
+		return
+	}
+
+	aesKey := repo.store.AesKey
+	writeFormat := func(format *RepoFormat) {
+		data, err := gulu.JSON.MarshalJSON(format)
+		if nil != err {
+			t.Fatalf("marshal format failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(formatPath, data, 0644); nil != err {
+			t.Fatalf("write format failed: %s", err)
+		}
+	}
+
+	// 更新版本只限制写入时可以只读打开
+	writeFormat(&RepoFormat{Version: RepoFormatVersion + 1, MinReader: RepoFormatExtended, MinWriter: RepoFormatVersion + 1})
+	readOnly, err := NewRepo(testDataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("open read only repo failed: %s", err)
+		return
+	}
+	if _, err = readOnly.GetIndex(index.ID); nil != err {
+		t.Fatalf("read index failed: %s", err)
+		return
+	}
+	err = readOnly.PutIndex(index)
+	var formatErr *RepoFormatError
+	if !errors.Is(err, ErrRepoFormatTooNew) || !errors.As(err, &formatErr) || !formatErr.Write || RepoFormatVersion+1 != formatErr.Required {
+		t.Fatalf("write should be rejected: %v", err)
+		return
+	}
+
+	// 更新版本限制读取时拒绝打开
+	writeFormat(&RepoFormat{Version: RepoFormatVersion + 1, MinReader: RepoFormatVersion + 1, MinWriter: RepoFormatVersion + 1})
+	if _, err = NewRepo(testDataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil); !errors.Is(err, ErrRepoFormatTooNew) {
+		t.Fatalf("open repo should be rejected: %v", err)
+		return
+	}
+}
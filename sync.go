@@ -23,6 +23,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,7 +35,6 @@ import (
 	"github.com/88250/lute/ast"
 	"github.com/88250/lute/parse"
 	"github.com/panjf2000/ants/v2"
-	ignore "github.com/sabhiram/go-gitignore"
 	"github.com/siyuan-note/dataparser"
 	"github.com/siyuan-note/dejavu/cloud"
 	"github.com/siyuan-note/dejavu/entity"
@@ -45,39 +45,55 @@ import (
 )
 
 var (
-	ErrCloudStorageSizeExceeded = errors.New("cloud storage limit size exceeded")
-	ErrCloudBackupCountExceeded = errors.New("cloud backup count exceeded")
+	ErrCloudStorageSizeExceeded error = &categoryError{"cloud storage limit size exceeded", ErrQuota}
+	ErrCloudBackupCountExceeded error = &categoryError{"cloud backup count exceeded", ErrQuota}
 
 	ErrCloudGenerateConflictHistory = errors.New("generate conflict history failed")
+	ErrCloudLatestChanged           = errors.New("cloud latest changed") // ErrCloudLatestChanged 描述了同步期间云端 refs/latest 已经被其他设备更新的错误，重新同步即可合并
+)
+
+const (
+	putBatchSize  = 128              // 下载对象后批量入库的对象数
+	putBatchBytes = 32 * 1024 * 1024 // 下载分块后批量入库的字节数
 )
 
 type MergeResult struct {
 	Time                        time.Time
 	Upserts, Removes, Conflicts []*entity.File
+	Moves                       []*Move  // 移动（重命名）的文件，这些文件不会再出现在 Upserts 和 Removes 中
+	DirOps                      []*DirOp // 整个目录的删除和移动，目录下的文件不会再出现在 Removes 和 Moves 中
 
 	UpsertPetals []string // storage/petal/petals.json 中变更的插件，在思源中计算并填充
 	RemovePetals []string // storage/petal/petals.json 中删除的插件，在思源中计算并填充
+
+	PreMergeIndexID string // 变更数据文件夹前创建的安全快照索引 ID，未启用安全快照或者数据文件夹没有变更时为空
+	UploadDeferred  bool   // 本地变更的上传是否被网络策略推迟，推迟时只合并了云端变更，本地变更会在之后的同步中上传
+
+	Warnings []*entity.Warning // 本地最新索引超过软限制的警告
 }
 
 func (mr *MergeResult) DataChanged() bool {
-	return len(mr.Upserts) > 0 || len(mr.Removes) > 0 || len(mr.Conflicts) > 0
+	return len(mr.Upserts) > 0 || len(mr.Removes) > 0 || len(mr.Conflicts) > 0 || len(mr.Moves) > 0 || len(mr.DirOps) > 0
 }
 
 type DownloadTrafficStat struct {
-	DownloadFileCount  int
-	DownloadChunkCount int
-	DownloadBytes      int64
+	DownloadFileCount   int
+	DownloadChunkCount  int
+	DownloadBytes       int64
+	DownloadConcurrency int // 下载分块时自适应调整后的并发数
 }
 
 type UploadTrafficStat struct {
-	UploadFileCount  int
-	UploadChunkCount int
-	UploadBytes      int64
+	UploadFileCount   int
+	UploadChunkCount  int
+	UploadBytes       int64
+	UploadConcurrency int // 上传分块时自适应调整后的并发数
 }
 
 type APITrafficStat struct {
 	APIGet int
 	APIPut int
+	APIOps *cloud.APIOps // 按请求类型统计的实际请求次数（包括加锁、列举等），云端存储服务不支持统计时为 nil
 }
 
 type TrafficStat struct {
@@ -89,33 +105,67 @@ type TrafficStat struct {
 }
 
 func (repo *Repo) GetSyncCloudFiles(cloudLatest *entity.Index, context map[string]interface{}) (fetchedFiles []*entity.File, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	fetchedFiles, err = repo.getSyncCloudFiles(cloudLatest, context)
 	return
 }
 
 func (repo *Repo) GetCloudLatest(context map[string]interface{}) (cloudLatest *entity.Index, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	_, cloudLatest, err = repo.downloadCloudLatest(context)
 	return
 }
 
 func (repo *Repo) Sync(context map[string]interface{}) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	start := time.Now()
+	context = beginSync("sync", context)
+	context[ctxAPIOpsBase] = repo.cloudAPIOps()
+	defer func() { repo.endSync("sync", start, context, mergeResult, trafficStat, err) }()
+	defer func() { err = classifyErr(err) }()
+	defer func() {
+		if nil == err {
+			repo.clearSyncQueue()
+			repo.replicateAsync()
+			repo.prefetchAsync()
+		}
+	}()
 
 	// 锁定云端，防止其他设备并发上传数据
-	err = repo.tryLockCloud(repo.DeviceID, context)
+	release, err := repo.lockSyncCloud(context)
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer release()
+
+	if err = repo.checkDeviceRevoked(context); nil != err {
+		return
+	}
 
 	mergeResult, trafficStat, err = repo.sync(context)
+	retries := 1
+	if repo.isLockFreeSync() {
+		retries = lockFreeSyncRetries
+	}
+	for i := 0; i < retries && errors.Is(err, ErrCloudLatestChanged); i++ {
+		// 云端锁失效或者无锁同步时其他设备可能在本次同步期间更新了云端，此时本地最新索引还没有更新，重新同步即可合并其他设备的更新
+		logging.LogWarnf("cloud latest changed during sync, sync again")
+		syncLogger(context).Warn("cloud latest changed during sync", "attempt", i+1)
+		repo.invalidateCloudListing()
+		if repo.isLockFreeSync() {
+			time.Sleep(lockFreeRetryWait(i + 1))
+		}
+		mergeResult, trafficStat, err = repo.sync(context)
+	}
 	if e, ok := err.(*os.PathError); ok && isNoSuchFileOrDirErr(err) {
 		p := e.Path
 		if !strings.Contains(p, "objects") {
@@ -124,6 +174,7 @@ func (repo *Repo) Sync(context map[string]interface{}) (mergeResult *MergeResult
 
 		// 索引时正常，但是上传时可能因为外部变更导致对象（文件或者分块）不存在，此时需要告知用户数据仓库已经损坏，需要重置数据仓库
 		logging.LogErrorf("sync failed: %s", err)
+		syncLogger(context).Error("repo object missing", "path", p, "error", err.Error())
 		err = ErrRepoFatal
 	}
 	return
@@ -151,6 +202,7 @@ func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult
 	trafficStat.DownloadFileCount++
 	trafficStat.DownloadBytes += length
 	trafficStat.APIGet++
+	repo.flagRevokedUploader(cloudLatest, context)
 
 	if cloudLatest.ID == latest.ID {
 		// 数据一致，直接返回
@@ -185,6 +237,41 @@ func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult
 	return
 }
 
+// loadSyncFiles 用于并发加载云端最新索引 cloudLatest、本地最新索引 latest 和同步点 latestSync 的文件列表。
+//
+// 三个文件列表大部分文件相同，共享一个已解码文件缓存，相同的文件只需要读取和解码一次。
+func (repo *Repo) loadSyncFiles(cloudLatest, latest, latestSync *entity.Index) (cloudLatestFiles, latestFiles, latestSyncFiles []*entity.File, err error) {
+	cache, err := newSyncFileCache(syncFileCacheSize)
+	if nil != err {
+		logging.LogWarnf("new sync file cache failed: %s", err)
+		cache, err = nil, nil
+	} else {
+		defer cache.Close()
+	}
+	indexes := []*entity.Index{cloudLatest, latest, latestSync}
+	files := make([][]*entity.File, len(indexes))
+	errs := make([]error, len(indexes))
+	waitGroup := sync.WaitGroup{}
+	for i, index := range indexes {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			files[i], errs[i] = repo.getFilesCached(index.Files, cache)
+		}()
+	}
+	waitGroup.Wait()
+
+	for i, name := range []string{"cloud latest", "latest", "latest sync"} {
+		if nil != errs[i] {
+			err = errs[i]
+			logging.LogErrorf("get %s files failed: %s", name, err)
+			return
+		}
+	}
+	cloudLatestFiles, latestFiles, latestSyncFiles = files[0], files[1], files[2]
+	return
+}
+
 // sync0 实现了数据同步的核心逻辑。
 //
 // fetchedFiles 已从云端下载的文件
@@ -194,10 +281,10 @@ func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult
 // trafficStat 待返回的流量统计
 func (repo *Repo) sync0(context map[string]interface{},
 	fetchedFiles []*entity.File, cloudLatest *entity.Index, latest *entity.Index, mergeResult *MergeResult, trafficStat *TrafficStat) (err error) {
-	// 组装还原云端最新文件列表
-	cloudLatestFiles, err := repo.getFiles(cloudLatest.Files)
+	// 组装还原云端最新、本地最新和同步点的文件列表
+	latestSync := repo.latestSync()
+	cloudLatestFiles, latestFiles, latestSyncFiles, err := repo.loadSyncFiles(cloudLatest, latest, latestSync)
 	if nil != err {
-		logging.LogErrorf("get cloud latest files failed: %s", err)
 		return
 	}
 
@@ -210,7 +297,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 	go func() { // 从云端下载缺失分块并入库
 		defer waitGroup.Done()
 
-		fetchChunkIDs, downloadErr := repo.localNotFoundChunks(cloudChunkIDs)
+		fetchChunkIDs, downloadErr := repo.localNotFoundChunks(repo.eagerChunks(cloudLatestFiles))
 		if nil != downloadErr {
 			logging.LogErrorf("get local not found chunks failed: %s", downloadErr)
 			errs = append(errs, downloadErr)
@@ -226,6 +313,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 		trafficStat.DownloadBytes += length
 		trafficStat.DownloadChunkCount += len(fetchChunkIDs)
 		trafficStat.APIGet += trafficStat.DownloadChunkCount
+		trafficStat.DownloadConcurrency = repo.concurrencyTuner(repo.cloud, false).Level()
 	}()
 
 	waitGroup.Add(1)
@@ -233,6 +321,10 @@ func (repo *Repo) sync0(context map[string]interface{},
 		defer waitGroup.Done()
 
 		uploadErr := repo.uploadCloud(context, latest, cloudLatest, cloudChunkIDs, trafficStat)
+		if errors.Is(uploadErr, ErrUploadDeferred) {
+			mergeResult.UploadDeferred = true
+			return
+		}
 		if nil != uploadErr {
 			logging.LogErrorf("upload cloud failed: %s", uploadErr)
 			errs = append(errs, uploadErr)
@@ -246,18 +338,10 @@ func (repo *Repo) sync0(context map[string]interface{},
 	}
 
 	// 计算本地相比上一个同步点的 upsert 和 remove 差异
-	latestFiles, err := repo.getFiles(latest.Files)
-	if nil != err {
-		logging.LogErrorf("get latest files failed: %s", err)
-		return
-	}
 	logging.LogInfof("got local latest [%s] files [%d]", latest.ID, len(latestFiles))
-	latestSync := repo.latestSync()
-	latestSyncFiles, err := repo.getFiles(latestSync.Files)
-	if nil != err {
-		logging.LogErrorf("get latest sync files failed: %s", err)
-		return
-	}
+	mergeResult.Warnings = repo.softLimitWarnings(latestFiles)
+	// 同步点之后已经应用的云端变更使用逐文件合并基准，避免被误认为本地变更
+	latestSyncFiles = repo.mergeBaseFiles(latestSync, latestSyncFiles)
 	localUpserts, localRemoves := repo.diffUpsertRemove(latestFiles, latestSyncFiles, false)
 
 	latestFileMap := map[string]*entity.File{}
@@ -308,6 +392,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 	// 计算冲突的 upsert 和无冲突能够合并的 upsert
 	// 冲突的文件尽量以本地 upsert 和 remove 为准
 	var tmpMergeConflicts []*entity.File
+	var conflicts []*Conflict
 	var cloudUpsertIgnore *entity.File
 	for _, cloudUpsert := range cloudUpserts {
 		if "/.siyuan/syncignore" == cloudUpsert.Path {
@@ -330,13 +415,14 @@ func (repo *Repo) sync0(context map[string]interface{},
 
 				// 云端有更新的 upsert 从而导致了冲突，在外部单独处理生成副本
 				mergeResult.Conflicts = append(mergeResult.Conflicts, cloudUpsert)
+				conflicts = append(conflicts, detectConflict(cloudUpsert.Path, localUpsert, cloudUpsert, latest, cloudLatest, mergeResult.Time, context))
 				logging.LogInfof("sync merge conflict [%s, %s, %s]", cloudUpsert.ID, cloudUpsert.Path, time.UnixMilli(cloudUpsert.Updated).Format("2006-01-02 15:04:05"))
 			}
 			continue
 		}
 
 		if nil == repo.getFile(localRemoves, cloudUpsert) {
-			if strings.HasSuffix(cloudUpsert.Path, ".tmp") {
+			if repo.options.isTmpFile(cloudUpsert.Path) {
 				// 数据仓库不迁出 `.tmp` 临时文件 https://github.com/siyuan-note/siyuan/issues/7087
 				logging.LogWarnf("ignored tmp file [%s]", cloudUpsert.Path)
 				continue
@@ -368,13 +454,13 @@ func (repo *Repo) sync0(context map[string]interface{},
 		coDir := filepath.Join(repo.DataPath)
 		if nil != localUpsertIgnore {
 			// 本地 syncignore 存在变更，则临时迁出
-			coDir = filepath.Join(repo.TempPath, "repo", "sync", "ignore")
+			coDir = repo.syncTemp(context, "ignore")
 		}
 		if err = repo.checkoutFile(cloudUpsertIgnore, coDir, 1, 1, context); nil != err {
 			logging.LogErrorf("checkout ignore file failed: %s", err)
 			return
 		}
-		data, readErr := filelock.ReadFile(filepath.Join(coDir, cloudUpsertIgnore.Path))
+		data, readErr := readDataFile(repo.checkoutFS(coDir), filepath.Join(coDir, cloudUpsertIgnore.Path))
 		if nil != readErr {
 			logging.LogErrorf("read ignore file failed: %s", readErr)
 			err = readErr
@@ -386,7 +472,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 		//logging.LogInfof("sync merge ignore rules: \n  %s", strings.Join(ignoreLines, "\n  "))
 	}
 
-	ignoreMatcher := ignore.CompileIgnoreLines(ignoreLines...)
+	ignoreMatcher := newIgnoreMatcher(ignoreLines)
 	var mergeResultRemovesTmp []*entity.File
 	for _, remove := range mergeResult.Removes {
 		if !ignoreMatcher.MatchesPath(remove.Path) {
@@ -399,7 +485,8 @@ func (repo *Repo) sync0(context map[string]interface{},
 
 	// 冲突文件复制到数据历史文件夹
 	if 0 < len(tmpMergeConflicts) {
-		temp := filepath.Join(repo.TempPath, "repo", "sync", "conflicts", nowStr)
+		temp := filepath.Join(repo.syncTemp(context, "conflicts"), nowStr)
+		historySink := repo.getHistorySink()
 		for i, file := range tmpMergeConflicts {
 			var checkoutTmp *entity.File
 			checkoutTmp, err = repo.store.GetFile(file.ID)
@@ -407,6 +494,10 @@ func (repo *Repo) sync0(context map[string]interface{},
 				logging.LogErrorf("get file failed: %s", err)
 				return
 			}
+			if !historySink.Accept(checkoutTmp) {
+				logging.LogInfof("skip generating sync history [%s]", checkoutTmp.Path)
+				continue
+			}
 
 			err = repo.checkoutFile(checkoutTmp, temp, i+1, len(tmpMergeConflicts), context)
 			if nil != err {
@@ -415,7 +506,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 			}
 
 			absPath := filepath.Join(temp, checkoutTmp.Path)
-			err = repo.genSyncHistory(nowStr, file.Path, absPath)
+			err = historySink.Write(mergeResult.Time, checkoutTmp, absPath)
 			if nil != err {
 				logging.LogErrorf("generate sync history failed: %s", err)
 				err = ErrCloudGenerateConflictHistory
@@ -431,11 +522,12 @@ func (repo *Repo) sync0(context map[string]interface{},
 	}
 
 	// 处理合并
-	err = repo.mergeSync(mergeResult, localChanged, true, latest, cloudLatest, cloudChunkIDs, trafficStat, context)
+	err = repo.mergeSync(mergeResult, localChanged, !mergeResult.UploadDeferred, latest, cloudLatest, cloudChunkIDs, trafficStat, context)
 	if nil != err {
 		logging.LogErrorf("merge sync failed: %s", err)
 		return
 	}
+	repo.recordConflicts(conflicts)
 
 	// 统计流量
 	go repo.cloud.AddTraffic(&cloud.Traffic{
@@ -446,7 +538,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 	})
 
 	// 移除空目录
-	gulu.File.RemoveEmptyDirs(repo.DataPath, removeEmptyDirExcludes...)
+	repo.removeEmptyDataDirs()
 	return
 }
 
@@ -463,7 +555,7 @@ func (repo *Repo) ignoreLocalUpsert(localUpsert *entity.File, latestSyncFiles []
 	// 如果是变更 .sy 文件则需要解析并进行内容对比
 
 	luteEngine := lute.New()
-	temp := filepath.Join(repo.TempPath, "repo", "sync", "resolves", now)
+	temp := filepath.Join(repo.syncTemp(context, "resolves"), now)
 	localTree, err := repo.checkoutTree(localUpsert, temp, luteEngine, context)
 	if nil != err {
 		return false
@@ -548,7 +640,7 @@ func (repo *Repo) checkoutTree(file *entity.File, checkoutDir string, luteEngine
 		logging.LogErrorf("checkout file failed: %s", err)
 		return
 	}
-	absPath := filepath.Join(checkoutDir, checkoutTmp.Path)
+	absPath := repo.checkoutAbsPath(checkoutDir, checkoutTmp.Path)
 	data, err := os.ReadFile(absPath)
 	if nil != err {
 		logging.LogErrorf("read file failed: %s", err)
@@ -562,17 +654,96 @@ func (repo *Repo) checkoutTree(file *entity.File, checkoutDir string, luteEngine
 	return
 }
 
+// SetPreMergeSnapshot 用于设置同步变更数据文件夹前是否自动创建安全快照，默认不启用。
+//
+// 安全快照不会成为本地最新索引，快照索引 ID 记录在 MergeResult.PreMergeIndexID 中，合并出错时迁出该快照即可还原。
+// 最近 preMergeRefsMax 个安全快照通过 refs/pre-merge/<ID> 引用，不会被 Purge 清理。
+func (repo *Repo) SetPreMergeSnapshot(enabled bool) {
+	repo.preMergeSnapshot = enabled
+}
+
+const (
+	preMergeRefsDir = "pre-merge" // 安全快照的引用文件夹，位于 refs 下
+	preMergeRefsMax = 16          // 保留引用的安全快照数量
+)
+
+// addPreMergeRef 用于添加安全快照 id 的引用，并删除超过 preMergeRefsMax 个的最旧的安全快照引用。
+func (repo *Repo) addPreMergeRef(id string) (err error) {
+	if err = repo.updateRef(path.Join(preMergeRefsDir, id), id, RefOpIndex); nil != err {
+		return
+	}
+
+	dir := filepath.Join(repo.Path, "refs", preMergeRefsDir)
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		return
+	}
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if info, infoErr := entry.Info(); nil == infoErr && !info.IsDir() {
+			infos = append(infos, info)
+		}
+	}
+	if preMergeRefsMax >= len(infos) {
+		return
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+	for _, info := range infos[preMergeRefsMax:] {
+		if removeErr := os.Remove(filepath.Join(dir, info.Name())); nil != removeErr {
+			logging.LogWarnf("remove pre-merge ref [%s] failed: %s", info.Name(), removeErr)
+		}
+	}
+	return
+}
+
 func (repo *Repo) restoreFiles(mergeResult *MergeResult, context map[string]interface{}) (err error) {
-	err = repo.checkoutFiles(mergeResult.Upserts, context)
+	// 内容相同的删除和新增识别为移动，直接在数据文件夹中重命名
+	moves, restUpserts, restRemoves := repo.detectMoves(mergeResult.Upserts, mergeResult.Removes)
+	mergeResult.Moves, mergeResult.Upserts, mergeResult.Removes = append(mergeResult.Moves, moves...), restUpserts, restRemoves
+	// 整个目录的删除和移动只需要一次删除或者重命名
+	dirOps, restMoves, restRemoves := repo.detectDirOps(mergeResult.Moves, mergeResult.Removes)
+	mergeResult.DirOps, mergeResult.Moves, mergeResult.Removes = append(mergeResult.DirOps, dirOps...), restMoves, restRemoves
+
+	if repo.preMergeSnapshot && (0 < len(mergeResult.Upserts) || 0 < len(mergeResult.Removes) || 0 < len(mergeResult.Moves) || 0 < len(mergeResult.DirOps)) {
+		// 变更数据文件夹前创建安全快照，合并出错时可以通过迁出该快照还原
+		var snapshot *entity.Index
+		snapshot, err = repo.indexWith(repo.options.PreMergeSnapshotMemo, false, false, context)
+		if nil != err {
+			logging.LogErrorf("create pre-merge snapshot failed: %s", err)
+			return
+		}
+		if err = repo.addPreMergeRef(snapshot.ID); nil != err {
+			logging.LogErrorf("add pre-merge snapshot ref failed: %s", err)
+			return
+		}
+		mergeResult.PreMergeIndexID = snapshot.ID
+		logging.LogInfof("created pre-merge snapshot [%s]", snapshot.ID)
+	}
+
+	upserts, lazy, err := repo.lazyFiles(mergeResult.Upserts)
+	if nil != err {
+		logging.LogErrorf("get lazy files failed: %s", err)
+		return
+	}
+	if err = repo.fault(FaultBeforeApplyFiles); nil != err {
+		return
+	}
+	err = repo.applyFiles(upserts, mergeResult.Removes, mergeResult.Moves, mergeResult.DirOps, context)
 	if nil != err {
-		logging.LogErrorf("checkout files failed: %s", err)
+		logging.LogErrorf("apply files failed: %s", err)
 		return
 	}
-	err = repo.removeFiles(mergeResult.Removes, context)
+	allMoves, allRemoves := mergeResult.Moves, mergeResult.Removes
+	for _, op := range mergeResult.DirOps {
+		allMoves, allRemoves = append(allMoves, op.Moves...), append(allRemoves, op.Files...)
+	}
+	err = repo.updatePlaceholders(lazy, upserts, allRemoves)
 	if nil != err {
-		logging.LogErrorf("remove files failed: %s", err)
+		logging.LogErrorf("update placeholders failed: %s", err)
 		return
 	}
+	repo.recordMergeBases(append(mergeResult.Upserts, movesTo(allMoves)...), append(allRemoves, movesFrom(allMoves)...))
 	return
 }
 
@@ -581,7 +752,7 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 		if localChanged { // 如果云端和本地都改变了，则需要创建合并索引并再次同步
 			logging.LogInfof("creating merge index [%s]", latest.ID)
 			mergeStart := time.Now()
-			mergedLatest, mergeIndexErr := repo.index("[Sync] Cloud sync merge", false, context)
+			mergedLatest, mergeIndexErr := repo.index(repo.options.MergeMemo, false, context)
 			if nil != mergeIndexErr {
 				logging.LogErrorf("merge index failed: %s", mergeIndexErr)
 				err = mergeIndexErr
@@ -600,10 +771,13 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 			for _, update := range diff.UpdatesLeft {
 				logging.LogInfof("merge index update [%s, %s, %s]", update.ID, update.Path, time.UnixMilli(update.Updated).Format("2006-01-02 15:04:05"))
 			}
+			for _, move := range diff.Moves {
+				logging.LogInfof("merge index move [%s, %s -> %s]", move.To.ID, move.From.Path, move.To.Path)
+			}
 
 			latest = mergedLatest
 			mergeElapsed := time.Since(mergeStart)
-			mergeMemo := fmt.Sprintf("[Sync] Cloud sync merge, completed in %.2fs", mergeElapsed.Seconds())
+			mergeMemo := fmt.Sprintf("%s, completed in %.2fs", repo.options.MergeMemo, mergeElapsed.Seconds())
 			latest.Memo = mergeMemo
 			err = repo.store.PutIndex(latest)
 			if nil != err {
@@ -624,8 +798,8 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 		}
 	}
 
-	if (localChanged && needSyncCloud) || "" == cloudLatest.ID {
-		err = repo.updateCloudIndexes(latest, trafficStat, context)
+	if (localChanged && needSyncCloud) || ("" == cloudLatest.ID && !mergeResult.UploadDeferred) {
+		err = repo.updateCloudIndexes(latest, cloudLatest.ID, trafficStat, context)
 		if nil != err {
 			logging.LogErrorf("update cloud indexes failed: %s", err)
 			return
@@ -633,17 +807,26 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 	}
 
 	// 更新本地最新索引
-	if err = repo.UpdateLatest(latest); nil != err {
-		logging.LogErrorf("update latest failed: %s", err)
+	if err = repo.fault(FaultBeforeUpdateLocalLatest); nil != err {
 		return
 	}
-	if err = repo.store.PutIndex(latest); nil != err {
+	if err = repo.store.PutIndex(latest); nil != err { // 先写入索引再更新引用，避免崩溃后引用指向不存在的索引
 		logging.LogErrorf("put index failed: %s", err)
 		return
 	}
+	if err = repo.updateLatest(latest, RefOpSync); nil != err {
+		logging.LogErrorf("update latest failed: %s", err)
+		return
+	}
+
+	if mergeResult.UploadDeferred {
+		// 本地变更还没有上传，保留同步点以便之后的同步仍然能识别出本地变更
+		logging.LogInfof("upload deferred by network policy, keep latest sync")
+		return
+	}
 
 	// 更新本地同步点
-	err = repo.UpdateLatestSync(latest)
+	err = repo.updateLatestSync(latest, RefOpSync)
 	if nil != err {
 		logging.LogErrorf("update latest sync failed: %s", err)
 		return
@@ -651,7 +834,8 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 	return
 }
 
-func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficStat, context map[string]interface{}) (err error) {
+// updateCloudIndexes 用于将本地最新索引 latest 更新到云端，cloudLatestID 是本次同步开始时下载到的云端最新索引 ID。
+func (repo *Repo) updateCloudIndexes(latest *entity.Index, cloudLatestID string, trafficStat *TrafficStat, context map[string]interface{}) (err error) {
 	// 生成校验索引
 	files, getErr := repo.getFiles(latest.Files)
 	if nil != getErr {
@@ -660,10 +844,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 		return
 	}
 
-	checkIndex := &entity.CheckIndex{ID: util.RandHash(), IndexID: latest.ID}
-	for _, file := range files {
-		checkIndex.Files = append(checkIndex.Files, &entity.CheckIndexFile{ID: file.ID, Chunks: file.Chunks})
-	}
+	checkIndex := newCheckIndex(latest, files)
 
 	// 更新本地 latest 的关联的 checkIndexID，后续会将本地 latest 上传到云端
 	latest.CheckIndexID = checkIndex.ID
@@ -672,6 +853,11 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 		return
 	}
 
+	// 发布新的云端 refs/latest 前延长新索引引用的云端数据对象的对象锁定保留期
+	if err = repo.extendObjectLocks(latest, files); nil != err {
+		return
+	}
+
 	// 以下步骤是更新云端相关索引数据
 
 	var errs []error
@@ -701,7 +887,9 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 		trafficStat.m.Unlock()
 
 		// 更新 refs/latest
-		length, uploadErr = repo.updateCloudRef("refs/latest", context)
+		if uploadErr = repo.fault(FaultBeforeUpdateCloudLatest); nil == uploadErr {
+			length, uploadErr = repo.updateCloudLatest(cloudLatestID, context)
+		}
 		if nil != uploadErr {
 			logging.LogErrorf("update cloud [refs/latest] failed: %s", uploadErr)
 			errLock.Lock()
@@ -709,6 +897,12 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 			errLock.Unlock()
 			return
 		}
+		if uploadErr = repo.fault(FaultAfterUpdateCloudLatest); nil != uploadErr {
+			errLock.Lock()
+			errs = append(errs, uploadErr)
+			errLock.Unlock()
+			return
+		}
 		trafficStat.m.Lock()
 		trafficStat.UploadFileCount++
 		trafficStat.UploadBytes += length
@@ -728,7 +922,8 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 
 			_, maxSeqNum, seqNumLatests := repo.getSeqNumLatest()
 			seqNum := maxSeqNum + 1
-			_, uploadErr := repo.cloud.UploadBytes("refs/latest-"+strconv.Itoa(seqNum)+"-"+latest.ID, []byte(latest.ID), true)
+			seqNumKey := "refs/latest-" + strconv.Itoa(seqNum) + "-" + latest.ID
+			_, uploadErr := repo.cloud.UploadBytes(seqNumKey, []byte(latest.ID), true)
 			if nil != uploadErr {
 				logging.LogErrorf("update cloud [refs/latest-%d] failed: %s", seqNum, uploadErr)
 				errLock.Lock()
@@ -736,6 +931,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 				errLock.Unlock()
 				return
 			}
+			repo.updateCloudListing(seqNumKey, int64(len(latest.ID)), false)
 
 			// 删除旧的 refs/latest-*
 			go func() {
@@ -745,6 +941,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 						logging.LogWarnf("delete cloud [%s] failed: %s", seqNumLatest, deleteErr)
 						continue
 					}
+					repo.updateCloudListing(seqNumLatest, 0, true)
 				}
 			}()
 		}()
@@ -794,7 +991,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 	go func() {
 		defer waitGroup.Done()
 
-		repo.uploadCloudMissingObjects(trafficStat, context)
+		repo.uploadCloudMissingObjects(latest, trafficStat, context)
 	}()
 
 	waitGroup.Wait()
@@ -900,31 +1097,72 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 
 	waitGroup := &sync.WaitGroup{}
 	var downloadErr error
-	poolSize := repo.cloud.GetConcurrentReqs()
+	errLock := sync.Mutex{}
+	tuner := repo.concurrencyTuner(repo.cloud, false)
+	poolSize := tuner.max
 	if poolSize > len(chunkIDs) {
 		poolSize = len(chunkIDs)
 	}
 	count := atomic.Int32{}
 	dBytes := atomic.Int64{}
 	total := len(chunkIDs)
+	lock := &sync.Mutex{}
+	var pending []*entity.Chunk
+	pendingBytes := 0
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
-		if nil != downloadErr {
+		errLock.Lock()
+		failed := nil != downloadErr
+		errLock.Unlock()
+		if failed {
 			return // 快速失败
 		}
+		if wipErr := repo.waitIfPaused(); nil != wipErr {
+			errLock.Lock()
+			if nil == downloadErr {
+				downloadErr = wipErr
+			}
+			errLock.Unlock()
+			return
+		}
 
 		chunkID := arg.(string)
 		count.Add(1)
-		length, chunk, dccErr := repo.downloadCloudChunk(chunkID, int(count.Load()), total, context)
-		if nil != dccErr {
-			downloadErr = dccErr
+		var length int64
+		var chunk *entity.Chunk
+		dccErr := tuner.do(func() (doErr error) {
+			length, chunk, doErr = repo.downloadCloudChunk(chunkID, int(count.Load()), total, context)
 			return
-		}
-		if pcErr := repo.store.PutChunk(chunk); nil != pcErr {
-			downloadErr = pcErr
+		})
+		if nil != dccErr {
+			errLock.Lock()
+			if nil == downloadErr {
+				downloadErr = dccErr
+			}
+			errLock.Unlock()
 			return
 		}
 		dBytes.Add(length)
+
+		// 攒够一批后再入库，合并落盘同步
+		var batch []*entity.Chunk
+		lock.Lock()
+		pending = append(pending, chunk)
+		pendingBytes += len(chunk.Data)
+		if putBatchSize <= len(pending) || putBatchBytes <= pendingBytes {
+			batch, pending, pendingBytes = pending, nil, 0
+		}
+		lock.Unlock()
+		if 0 < len(batch) {
+			if pcErr := repo.store.PutChunks(batch); nil != pcErr {
+				errLock.Lock()
+				if nil == downloadErr {
+					downloadErr = pcErr
+				}
+				errLock.Unlock()
+				return
+			}
+		}
 	})
 	if nil != err {
 		return
@@ -937,8 +1175,10 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 			logging.LogErrorf("invoke failed: %s", err)
 			return
 		}
-		if nil != downloadErr {
-			err = downloadErr
+		errLock.Lock()
+		err = downloadErr
+		errLock.Unlock()
+		if nil != err {
 			return
 		}
 	}
@@ -949,6 +1189,8 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 		err = downloadErr
 		return
 	}
+
+	err = repo.store.PutChunks(pending)
 	return
 }
 
@@ -958,8 +1200,10 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 	}
 
 	lock := &sync.Mutex{}
+	var pending []*entity.File
 	waitGroup := &sync.WaitGroup{}
 	var downloadErr error
+	errLock := sync.Mutex{}
 	poolSize := repo.cloud.GetConcurrentReqs()
 	if poolSize > len(fileIDs) {
 		poolSize = len(fileIDs)
@@ -969,26 +1213,53 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 	total := len(fileIDs)
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
-		if nil != downloadErr {
+		errLock.Lock()
+		failed := nil != downloadErr
+		errLock.Unlock()
+		if failed {
 			return // 快速失败
 		}
+		if wipErr := repo.waitIfPaused(); nil != wipErr {
+			errLock.Lock()
+			if nil == downloadErr {
+				downloadErr = wipErr
+			}
+			errLock.Unlock()
+			return
+		}
 
 		fileID := arg.(string)
 		count.Add(1)
 		length, file, dcfErr := repo.downloadCloudFile(fileID, int(count.Load()), total, context)
 		if nil != dcfErr {
-			downloadErr = dcfErr
-			return
-		}
-		if pfErr := repo.store.PutFile(file); nil != pfErr {
-			downloadErr = pfErr
+			errLock.Lock()
+			if nil == downloadErr {
+				downloadErr = dcfErr
+			}
+			errLock.Unlock()
 			return
 		}
 		dBytes.Add(length)
 
+		// 攒够一批后再入库，合并落盘同步
+		var batch []*entity.File
 		lock.Lock()
 		ret = append(ret, file)
+		pending = append(pending, file)
+		if putBatchSize <= len(pending) {
+			batch, pending = pending, nil
+		}
 		lock.Unlock()
+		if 0 < len(batch) {
+			if pfErr := repo.store.PutFiles(batch); nil != pfErr {
+				errLock.Lock()
+				if nil == downloadErr {
+					downloadErr = pfErr
+				}
+				errLock.Unlock()
+				return
+			}
+		}
 	})
 	if nil != err {
 		return
@@ -1001,8 +1272,10 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 			logging.LogErrorf("invoke failed: %s", err)
 			return
 		}
-		if nil != downloadErr {
-			err = downloadErr
+		errLock.Lock()
+		err = downloadErr
+		errLock.Unlock()
+		if nil != err {
 			return
 		}
 	}
@@ -1013,6 +1286,8 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 		err = downloadErr
 		return
 	}
+
+	err = repo.store.PutFiles(pending)
 	return
 }
 
@@ -1040,28 +1315,131 @@ func (repo *Repo) updateCloudRef(ref string, context map[string]interface{}) (up
 	return
 }
 
-var uploadedCloudMissingObjects = false
+// updateCloudLatest 用于将云端 refs/latest 从 baseID 更新为本地 refs/latest，云端没有 refs/latest 时 baseID 为空。
+//
+// 云端锁失效时多个设备可能同时同步，直接覆盖 refs/latest 会丢失其他设备上传的索引，所以更新前需要确认云端 refs/latest 仍然是 baseID：
+// 支持条件写入的云端存储服务使用比较并交换更新，其他云端存储服务只能在更新前检查一次。
+// 部分 S3 兼容的存储服务不支持条件写入，锁定云端同步时回退到检查后直接写入。
+// 云端 refs/latest 已经被其他设备更新时返回 ErrCloudLatestChanged，不覆盖云端。
+func (repo *Repo) updateCloudLatest(baseID string, context map[string]interface{}) (uploadBytes int64, err error) {
+	ref := "refs/latest"
+	conditional, ok := repo.cloud.(cloud.ConditionalCloud)
+	if !ok {
+		if repo.cloudLatestChanged(baseID) {
+			err = ErrCloudLatestChanged
+			return
+		}
+		return repo.updateCloudRef(ref, context)
+	}
 
-func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context map[string]interface{}) {
-	if uploadedCloudMissingObjects {
+	eventbus.Publish(eventbus.EvtCloudBeforeUploadRef, context, ref)
+	data, err := os.ReadFile(filepath.Join(repo.cloud.GetConf().RepoPath, ref))
+	if nil != err {
+		logging.LogErrorf("read ref [%s] failed: %s", ref, err)
 		return
 	}
-	uploadedCloudMissingObjects = true
 
-	if _, ok := repo.cloud.(*cloud.SiYuan); !ok {
+	current, etag, err := conditional.DownloadObjectETag(ref)
+	if nil != err {
+		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			logging.LogErrorf("download cloud ref [%s] failed: %s", ref, err)
+			return
+		}
+		err = nil
+	}
+	if currentID := strings.TrimSpace(string(current)); 40 == len(currentID) && currentID != baseID {
+		logging.LogWarnf("cloud latest [%s] changed, expected [%s]", currentID, baseID)
+		err = ErrCloudLatestChanged
 		return
 	}
 
-	defer eventbus.Publish(eventbus.EvtCloudAfterFixObjects, context)
+	if uploadBytes, err = conditional.UploadBytesIfMatch(ref, data, etag); nil != err {
+		if errors.Is(err, cloud.ErrCloudPreconditionFailed) {
+			logging.LogWarnf("cloud latest changed while updating, expected [%s]", baseID)
+			err = ErrCloudLatestChanged
+			return
+		}
+		if !errors.Is(err, cloud.ErrConditionalWriteUnsupported) || repo.isLockFreeSync() {
+			// 无锁同步没有锁定云端，不能回退到检查后写入
+			return
+		}
 
-	checkReportKey := "check/indexes-report"
-	data, err := repo.cloud.DownloadObject(checkReportKey)
-	if nil != err {
-		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		// 上面已经检查过云端 refs/latest 仍然是 baseID，直接写入
+		logging.LogWarnf("cloud does not support conditional writes, update ref [%s] without compare and swap", ref)
+		if uploadBytes, err = repo.cloud.UploadBytes(ref, data, true); nil != err {
 			return
 		}
+	}
+	logging.LogInfof("uploaded cloud ref [%s, id=%s]", ref, data)
+	return
+}
 
-		logging.LogErrorf("download check report failed: %s", err)
+// cloudLatestChanged 用于在不支持条件写入的云端存储服务上判断云端 refs/latest 是否已经不是 baseID。
+//
+// 思源云端下载 refs/latest 时可能命中缓存返回旧数据，此时以 refs/latest-seqNum-id 为准。
+func (repo *Repo) cloudLatestChanged(baseID string) bool {
+	data, err := repo.downloadCloudObject("refs/latest")
+	if nil != err {
+		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			// 无法确认时按照未改变处理，和引入检查前的行为一致
+			logging.LogWarnf("download cloud latest failed: %s", err)
+		}
+		return false
+	}
+
+	currentID := strings.TrimSpace(string(data))
+	if 40 != len(currentID) || currentID == baseID {
+		return false
+	}
+	if repo.isCloudS3() || repo.isCloudSiYuan() {
+		if seqNumLatestID, _, _ := repo.getSeqNumLatest(); seqNumLatestID == baseID {
+			return false
+		}
+	}
+	logging.LogWarnf("cloud latest [%s] changed, expected [%s]", currentID, baseID)
+	return true
+}
+
+const (
+	cloudCheckReportKey = "check/indexes-report" // 云端校验报告，官方云端服务校验校验索引后生成，其他云端服务在本地计算生成
+	fixedCheckTimeKey   = "check/fixed-time"     // 本地记录的最近一次尝试修复的云端校验报告的校验时间
+	cloudVerifyInterval = 24 * time.Hour         // 其他云端服务同步时本地计算校验报告的最小间隔
+)
+
+// uploadCloudMissingObjects 用于在同步时根据云端校验报告上传修复云端缺失的数据对象，同一份校验报告只会尝试修复一次。
+//
+// 官方云端服务的校验报告由云端生成，其他云端服务的校验报告在本地根据最新索引 latest 计算，计算间隔不小于 cloudVerifyInterval。
+func (repo *Repo) uploadCloudMissingObjects(latest *entity.Index, trafficStat *TrafficStat, context map[string]interface{}) {
+	var checkReport *entity.CheckReport
+	var err error
+	if _, ok := repo.cloud.(*cloud.SiYuan); ok {
+		checkReport, err = repo.downloadCloudCheckReport(trafficStat)
+	} else {
+		checkReport = repo.readLocalCheckReport()
+		if nil == checkReport || cloudVerifyInterval < time.Since(time.UnixMilli(checkReport.CheckTime)) {
+			checkReport, err = repo.computeCloudCheckReport(latest, trafficStat)
+		}
+	}
+	if nil != err {
+		logging.LogErrorf("get check report failed: %s", err)
+		return
+	}
+	if nil == checkReport || 1 > len(checkReport.MissingObjects) || checkReport.CheckTime == repo.readFixedCheckTime() {
+		return
+	}
+
+	if err = repo.fixCloudMissingObjects(checkReport, trafficStat, context); nil != err {
+		logging.LogWarnf("upload cloud missing objects failed: %s", err)
+	}
+}
+
+// downloadCloudCheckReport 用于下载云端校验报告，云端没有校验报告时返回 nil。
+func (repo *Repo) downloadCloudCheckReport(trafficStat *TrafficStat) (ret *entity.CheckReport, err error) {
+	data, err := repo.cloud.DownloadObject(cloudCheckReportKey)
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			err = nil
+		}
 		return
 	}
 	trafficStat.m.Lock()
@@ -1076,15 +1454,131 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 		return
 	}
 
-	checkReport := &entity.CheckReport{}
-	if err = gulu.JSON.UnmarshalJSON(data, checkReport); nil != err {
+	ret = &entity.CheckReport{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
 		logging.LogErrorf("unmarshal check report failed: %s", err)
+		ret = nil
+		return
+	}
+	// 云端生成校验报告时不知道转存到次级云端存储服务的分块
+	ret.MissingObjects = repo.filterOffloadedMissing(ret.MissingObjects)
+	return
+}
+
+// computeCloudCheckReport 用于在本地计算云端缺失的索引 index 引用的数据对象并生成校验报告，用于不生成校验报告的 S3、WebDAV 等云端服务。
+func (repo *Repo) computeCloudCheckReport(index *entity.Index, trafficStat *TrafficStat) (ret *entity.CheckReport, err error) {
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
 		return
 	}
+	objectIDs := append(append([]string{}, index.Files...), repo.getChunks(files)...)
+	objectIDs = gulu.Str.RemoveDuplicatedElem(objectIDs)
+
+	var missingObjectIDs []string
+	objInfos, listErr := repo.cloud.ListObjects("objects/")
+	if nil == listErr && listedObjects(objInfos) {
+		// 支持递归列出数据对象的云端服务（比如 S3）通过列表比对，避免逐个检查对象是否存在
+		for _, id := range objectIDs {
+			if _, ok := objInfos[id[:2]+"/"+id[2:]]; !ok {
+				missingObjectIDs = append(missingObjectIDs, id)
+			}
+		}
+	} else if missingObjectIDs, err = repo.cloud.GetChunks(objectIDs); nil != err {
+		return
+	}
+	trafficStat.m.Lock()
+	trafficStat.APIGet++
+	trafficStat.m.Unlock()
+
+	ret = repo.readLocalCheckReport()
+	if nil == ret {
+		ret = &entity.CheckReport{}
+	}
+	ret.CheckTime = time.Now().UnixMilli()
+	ret.CheckCount++
+	ret.MissingObjects = nil
+	for _, id := range missingObjectIDs {
+		ret.MissingObjects = append(ret.MissingObjects, id[:2]+"/"+id[2:])
+	}
+	ret.MissingObjects = repo.filterOffloadedMissing(ret.MissingObjects)
+	logging.LogInfof("computed cloud check report [objects=%d, missing=%d]", len(objectIDs), len(ret.MissingObjects))
+
+	err = repo.writeLocalCheckReport(ret)
+	return
+}
 
-	if 1 > len(checkReport.MissingObjects) {
+// listedObjects 用于判断 ListObjects("objects/") 的结果是否是递归列出的数据对象（xx/yyyy），而不是分片文件夹。
+func listedObjects(objInfos map[string]*entity.ObjectInfo) bool {
+	for p := range objInfos {
+		return strings.Contains(p, "/")
+	}
+	return false
+}
+
+// readFixedCheckTime 用于读取最近一次尝试修复的云端校验报告的校验时间，没有记录时返回 0。
+//
+// 调用方可能为每次同步创建新的 Repo 实例，所以需要持久化，避免每次同步都重复修复同一份校验报告。
+func (repo *Repo) readFixedCheckTime() (ret int64) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, fixedCheckTimeKey))
+	if nil != err {
 		return
 	}
+	ret, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return
+}
+
+// writeFixedCheckTime 用于记录最近一次尝试修复的云端校验报告的校验时间 checkTime。
+func (repo *Repo) writeFixedCheckTime(checkTime int64) {
+	absPath := filepath.Join(repo.Path, fixedCheckTimeKey)
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+		logging.LogErrorf("mkdir [%s] failed: %s", filepath.Dir(absPath), err)
+		return
+	}
+	if err := gulu.File.WriteFileSafer(absPath, []byte(strconv.FormatInt(checkTime, 10)), 0644); nil != err {
+		logging.LogErrorf("write fixed check time failed: %s", err)
+	}
+}
+
+func (repo *Repo) readLocalCheckReport() (ret *entity.CheckReport) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, cloudCheckReportKey))
+	if nil != err {
+		return
+	}
+	if data, err = repo.store.compressDecoder.DecodeAll(data, nil); nil != err {
+		logging.LogErrorf("decompress check report failed: %s", err)
+		return
+	}
+
+	ret = &entity.CheckReport{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		logging.LogErrorf("unmarshal check report failed: %s", err)
+		ret = nil
+	}
+	return
+}
+
+func (repo *Repo) writeLocalCheckReport(checkReport *entity.CheckReport) (err error) {
+	data, err := gulu.JSON.MarshalJSON(checkReport)
+	if nil != err {
+		logging.LogErrorf("marshal check report failed: %s", err)
+		return
+	}
+
+	data = repo.store.compressEncoder.EncodeAll(data, nil)
+	absPath := filepath.Join(repo.Path, cloudCheckReportKey)
+	if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+		return
+	}
+	if err = gulu.File.WriteFileSafer(absPath, data, 0644); nil != err {
+		logging.LogErrorf("write check report failed: %s", err)
+	}
+	return
+}
+
+// fixCloudMissingObjects 用于上传校验报告 checkReport 中云端缺失的数据对象，上传后更新校验报告中仍然缺失的数据对象并上传校验报告。
+func (repo *Repo) fixCloudMissingObjects(checkReport *entity.CheckReport, trafficStat *TrafficStat, context map[string]interface{}) (err error) {
+	defer eventbus.Publish(eventbus.EvtCloudAfterFixObjects, context)
+	repo.writeFixedCheckTime(checkReport.CheckTime)
 
 	var missingObjects []string
 	stillMissingObjects := map[string]bool{}
@@ -1092,7 +1586,7 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 		logging.LogInfof("cloud missing object [%s]", missingObject)
 		stillMissingObjects[missingObject] = true
 
-		absFilePath := filepath.Join(repo.Path, "objects", missingObject)
+		absFilePath := repo.store.ObjectPath(strings.ReplaceAll(missingObject, "/", ""))
 		info, statErr := os.Stat(absFilePath)
 		if nil != statErr {
 			// 本地没有该文件，忽略
@@ -1109,61 +1603,66 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 	}
 	missingObjects = gulu.Str.RemoveDuplicatedElem(missingObjects)
 
-	waitGroup := &sync.WaitGroup{}
-	var uploadErr error
-	poolSize := repo.cloud.GetConcurrentReqs()
-	if poolSize > len(missingObjects) {
-		poolSize = len(missingObjects)
-	}
-	count := atomic.Int32{}
-	total := len(missingObjects)
-	lock := sync.Mutex{}
-	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
-		defer waitGroup.Done()
-		if nil != uploadErr {
-			return // 快速失败
-		}
+	if 0 < len(missingObjects) {
+		waitGroup := &sync.WaitGroup{}
+		var uploadErr error
+		poolSize := repo.cloud.GetConcurrentReqs()
+		if poolSize > len(missingObjects) {
+			poolSize = len(missingObjects)
+		}
+		count := atomic.Int32{}
+		total := len(missingObjects)
+		lock := sync.Mutex{}
+		var p *ants.PoolWithFunc
+		p, err = ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+			defer waitGroup.Done()
+			if nil != uploadErr {
+				return // 快速失败
+			}
 
-		objectPath := arg.(string)
-		filePath := "objects/" + objectPath
-		count.Add(1)
-		eventbus.Publish(eventbus.EvtCloudBeforeFixObjects, context, int(count.Load()), total)
-		_, uoErr := repo.cloud.UploadObject(filePath, false)
-		if nil != uoErr {
-			uploadErr = uoErr
-			err = uploadErr
-			logging.LogErrorf("upload cloud missing object [%s] failed: %s", filePath, uploadErr)
+			objectPath := arg.(string)
+			if sealErr := repo.store.sealPlainChunk(strings.ReplaceAll(objectPath, "/", "")); nil != sealErr {
+				uploadErr = sealErr
+				logging.LogErrorf("seal plain chunk [%s] failed: %s", objectPath, uploadErr)
+				return
+			}
+			filePath := "objects/" + objectPath
+			count.Add(1)
+			eventbus.Publish(eventbus.EvtCloudBeforeFixObjects, context, int(count.Load()), total)
+			_, uoErr := repo.cloud.UploadObject(filePath, false)
+			if nil != uoErr {
+				uploadErr = uoErr
+				logging.LogErrorf("upload cloud missing object [%s] failed: %s", filePath, uploadErr)
+				return
+			}
+
+			lock.Lock()
+			delete(stillMissingObjects, objectPath)
+			lock.Unlock()
+			logging.LogInfof("uploaded cloud missing object [%s]", filePath)
+		})
+		if nil != err {
 			return
 		}
 
-		lock.Lock()
-		delete(stillMissingObjects, objectPath)
-		lock.Unlock()
-		logging.LogInfof("uploaded cloud missing object [%s]", filePath)
-	})
-	if nil != err {
-		logging.LogWarnf("upload cloud missing objects failed: %s", err)
-		return
-	}
-
-	for _, missingObject := range missingObjects {
-		waitGroup.Add(1)
-		if err = p.Invoke(missingObject); nil != err {
-			logging.LogErrorf("invoke failed: %s", err)
-			return
+		for _, missingObject := range missingObjects {
+			waitGroup.Add(1)
+			if err = p.Invoke(missingObject); nil != err {
+				logging.LogErrorf("invoke failed: %s", err)
+				return
+			}
+			if nil != uploadErr {
+				break
+			}
 		}
+		waitGroup.Wait()
+		p.Release()
+
 		if nil != uploadErr {
 			err = uploadErr
 			return
 		}
 	}
-	waitGroup.Wait()
-	p.Release()
-
-	if nil != err {
-		logging.LogWarnf("upload cloud missing objects failed: %s", err)
-		return
-	}
 
 	checkReport.FixCount++
 	checkReport.MissingObjects = nil
@@ -1179,38 +1678,30 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 		logging.LogInfof("cloud missing objects fixed")
 	}
 
-	data, err = gulu.JSON.MarshalJSON(checkReport)
-	if nil != err {
-		logging.LogErrorf("marshal check report failed: %s", err)
+	if err = repo.writeLocalCheckReport(checkReport); nil != err {
 		return
 	}
 
-	data = repo.store.compressEncoder.EncodeAll(data, nil)
-
-	absPath := filepath.Join(repo.Path, checkReportKey)
-	if err = gulu.File.WriteFileSafer(absPath, data, 0644); nil != err {
-		logging.LogErrorf("write check report failed: %s", err)
-		return
-	}
-
-	if _, err = repo.cloud.UploadObject(checkReportKey, true); nil != err {
+	if _, err = repo.cloud.UploadObject(cloudCheckReportKey, true); nil != err {
 		logging.LogErrorf("upload check report failed: %s", err)
 	}
 	return
 }
 
-func (repo *Repo) updateCloudCheckIndex(checkIndex *entity.CheckIndex, context map[string]interface{}) (err error) {
-	if _, ok := repo.cloud.(*cloud.SiYuan); !ok {
-		// S3/WebDAV 不上传校验索引 S3/WebDAV data sync no longer uploads check index https://github.com/siyuan-note/siyuan/issues/10180
-		return
+// newCheckIndex 用于根据索引 latest 和其文件列表 files 生成校验索引。
+func newCheckIndex(latest *entity.Index, files []*entity.File) (ret *entity.CheckIndex) {
+	ret = &entity.CheckIndex{ID: util.RandHash(), IndexID: latest.ID}
+	for _, file := range files {
+		ret.Files = append(ret.Files, &entity.CheckIndexFile{ID: file.ID, Chunks: file.Chunks})
 	}
+	return
+}
 
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadCheckIndex, context)
-
-	data, marshalErr := gulu.JSON.MarshalIndentJSON(checkIndex, "", "\t")
-	if nil != marshalErr {
-		logging.LogErrorf("marshal check index failed: %s", marshalErr)
-		err = marshalErr
+// putCheckIndex 用于将校验索引 checkIndex 写入本地仓库的 check/indexes 文件夹。
+func (repo *Repo) putCheckIndex(checkIndex *entity.CheckIndex) (err error) {
+	data, err := gulu.JSON.MarshalIndentJSON(checkIndex, "", "\t")
+	if nil != err {
+		logging.LogErrorf("marshal check index failed: %s", err)
 		return
 	}
 
@@ -1225,6 +1716,20 @@ func (repo *Repo) updateCloudCheckIndex(checkIndex *entity.CheckIndex, context m
 		logging.LogErrorf("write check index failed: %s", err)
 		return
 	}
+	return
+}
+
+func (repo *Repo) updateCloudCheckIndex(checkIndex *entity.CheckIndex, context map[string]interface{}) (err error) {
+	if _, ok := repo.cloud.(*cloud.SiYuan); !ok {
+		// S3/WebDAV 不上传校验索引 S3/WebDAV data sync no longer uploads check index https://github.com/siyuan-note/siyuan/issues/10180
+		return
+	}
+
+	eventbus.Publish(eventbus.EvtCloudBeforeUploadCheckIndex, context)
+
+	if err = repo.putCheckIndex(checkIndex); nil != err {
+		return
+	}
 
 	if _, err = repo.cloud.UploadObject("check/indexes/"+checkIndex.ID, false); nil != err {
 		logging.LogErrorf("upload check index failed: %s", err)
@@ -1236,7 +1741,11 @@ func (repo *Repo) updateCloudCheckIndex(checkIndex *entity.CheckIndex, context m
 func (repo *Repo) updateCloudIndexesV2(latest *entity.Index, context map[string]interface{}) (downloadBytes, uploadBytes int64, err error) {
 	eventbus.Publish(eventbus.EvtCloudBeforeUploadIndexes, context)
 
-	data, err := repo.cloud.DownloadObject("indexes-v2.json")
+	if conditional, ok := repo.cloud.(cloud.ConditionalCloud); ok && repo.isLockFreeSync() {
+		return repo.updateCloudIndexesV2CAS(conditional, latest)
+	}
+
+	data, err := repo.downloadCloudData("indexes-v2.json")
 	if nil != err {
 		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
 			return
@@ -1245,6 +1754,22 @@ func (repo *Repo) updateCloudIndexesV2(latest *entity.Index, context map[string]
 	}
 	downloadBytes = int64(len(data))
 
+	data, found, err := repo.addCloudIndexEntry(data, latest)
+	if nil != err || found {
+		return
+	}
+
+	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, "indexes-v2.json"), data, 0644); nil != err {
+		return
+	}
+
+	length, err := repo.cloud.UploadObject("indexes-v2.json", true)
+	uploadBytes = length
+	return
+}
+
+// addCloudIndexEntry 用于将索引 latest 加入压缩后的云端索引列表 data 中，found 为 true 时 latest 已经在列表中，不需要更新。
+func (repo *Repo) addCloudIndexEntry(data []byte, latest *entity.Index) (ret []byte, found bool, err error) {
 	data, err = repo.store.compressDecoder.DecodeAll(data, nil)
 	if nil != err {
 		return
@@ -1257,7 +1782,6 @@ func (repo *Repo) updateCloudIndexesV2(latest *entity.Index, context map[string]
 		}
 
 		// Deduplication when uploading cloud snapshot indexes https://github.com/siyuan-note/siyuan/issues/8424
-		found := false
 		tmp := &cloud.Indexes{}
 		added := map[string]bool{}
 		for _, index := range indexes.Indexes {
@@ -1276,55 +1800,97 @@ func (repo *Repo) updateCloudIndexesV2(latest *entity.Index, context map[string]
 		indexes = tmp
 	}
 
-	indexes.Indexes = append([]*cloud.Index{
-		{
-			ID:         latest.ID,
-			SystemID:   latest.SystemID,
-			SystemName: latest.SystemName,
-			SystemOS:   latest.SystemOS,
-		},
-	}, indexes.Indexes...)
-	if data, err = gulu.JSON.MarshalIndentJSON(indexes, "", "\t"); nil != err {
+	entry, err := repo.cloudIndexEntry(latest)
+	if nil != err {
 		return
 	}
-
-	data = repo.store.compressEncoder.EncodeAll(data, nil)
-
-	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, "indexes-v2.json"), data, 0644); nil != err {
+	indexes.Indexes = append([]*cloud.Index{entry}, indexes.Indexes...)
+	if data, err = gulu.JSON.MarshalIndentJSON(indexes, "", "\t"); nil != err {
 		return
 	}
 
-	length, err := repo.cloud.UploadObject("indexes-v2.json", true)
-	uploadBytes = length
+	ret = repo.store.compressEncoder.EncodeAll(data, nil)
 	return
 }
 
 func (repo *Repo) uploadIndex(index *entity.Index, context map[string]interface{}) (uploadBytes int64, err error) {
 	eventbus.Publish(eventbus.EvtCloudBeforeUploadIndex, context, index.ID)
-	length, err := repo.cloud.UploadObject(path.Join("indexes", index.ID), false)
+	length, err := repo.uploadIndexTo(repo.cloud, index)
 	uploadBytes += length
 	logging.LogInfof("uploaded index [%s]", index.String())
 	return
 }
 
+// uploadFilesBatchSize 描述了批量上传文件对象时每批的对象数。
+const uploadFilesBatchSize = 64
+
+// uploadFiles 用于上传文件对象，云端存储服务支持批量上传时分批上传，否则逐个上传。
 func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]interface{}) (uploadBytes int64, err error) {
 	if 1 > len(upsertFiles) {
 		return
 	}
 
+	if _, probeErr := repo.cloud.UploadObjects(nil, false); errors.Is(probeErr, cloud.ErrUnsupported) {
+		return repo.uploadFilesEach(upsertFiles, context)
+	}
+
+	total := len(upsertFiles)
+	eventbus.Publish(eventbus.EvtCloudBeforeUploadFiles, context, total)
+	for i := 0; i < total; i += uploadFilesBatchSize {
+		if err = repo.waitIfPaused(); nil != err {
+			return
+		}
+
+		batch := upsertFiles[i:min(i+uploadFilesBatchSize, total)]
+		var filePaths []string
+		for j, upsertFile := range batch {
+			eventbus.Publish(eventbus.EvtCloudBeforeUploadFile, context, i+j+1, total)
+			filePaths = append(filePaths, path.Join("objects", upsertFile.ID[:2], upsertFile.ID[2:]))
+		}
+
+		length, uoErr := repo.cloud.UploadObjects(filePaths, false)
+		uploadBytes += length
+		if nil != uoErr {
+			err = uoErr
+			return
+		}
+		repo.rateLimit(length)
+	}
+	return
+}
+
+// uploadFilesEach 用于逐个上传文件对象。
+func (repo *Repo) uploadFilesEach(upsertFiles []*entity.File, context map[string]interface{}) (uploadBytes int64, err error) {
+	if 1 > len(upsertFiles) {
+		return
+	}
+
 	waitGroup := &sync.WaitGroup{}
 	var uploadErr error
+	errLock := sync.Mutex{}
 	poolSize := repo.cloud.GetConcurrentReqs()
 	if poolSize > len(upsertFiles) {
 		poolSize = len(upsertFiles)
 	}
 	count, uploadedCount := atomic.Int32{}, atomic.Int32{}
+	uBytes := atomic.Int64{}
 	total := len(upsertFiles)
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
-		if nil != uploadErr {
+		errLock.Lock()
+		failed := nil != uploadErr
+		errLock.Unlock()
+		if failed {
 			return // 快速失败
 		}
+		if wipErr := repo.waitIfPaused(); nil != wipErr {
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = wipErr
+			}
+			errLock.Unlock()
+			return
+		}
 
 		upsertFileID := arg.(string)
 		filePath := path.Join("objects", upsertFileID[:2], upsertFileID[2:])
@@ -1332,12 +1898,16 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 		eventbus.Publish(eventbus.EvtCloudBeforeUploadFile, context, int(count.Load()), total)
 		length, uoErr := repo.cloud.UploadObject(filePath, false)
 		if nil != uoErr {
-			uploadErr = uoErr
-			err = uploadErr
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = uoErr
+			}
+			errLock.Unlock()
 			return
 		}
-		uploadBytes += length
+		uBytes.Add(length)
 		uploadedCount.Add(1)
+		repo.rateLimit(length)
 		//logging.LogInfof("uploaded file [%s, %d/%d]", filePath, int(uploadedCount.Load()), total)
 	})
 	if nil != err {
@@ -1351,47 +1921,95 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 			logging.LogErrorf("invoke failed: %s", err)
 			return
 		}
-		if nil != uploadErr {
-			err = uploadErr
+		errLock.Lock()
+		err = uploadErr
+		errLock.Unlock()
+		if nil != err {
 			return
 		}
 	}
 	waitGroup.Wait()
 	p.Release()
+	uploadBytes = uBytes.Load()
+	err = uploadErr
 	return
 }
 
 func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]interface{}) (uploadBytes int64, err error) {
+	return repo.uploadChunksTo(repo.cloud, upsertChunkIDs, context)
+}
+
+// uploadChunksTo 用于将分块上传到云端存储服务 target。
+func (repo *Repo) uploadChunksTo(target cloud.Cloud, upsertChunkIDs []string, context map[string]interface{}) (uploadBytes int64, err error) {
 	if 1 > len(upsertChunkIDs) {
 		return
 	}
 
 	waitGroup := &sync.WaitGroup{}
 	var uploadErr error
-	poolSize := repo.cloud.GetConcurrentReqs()
+	errLock := sync.Mutex{}
+	tuner := repo.concurrencyTuner(target, true)
+	poolSize := tuner.max
 	if poolSize > len(upsertChunkIDs) {
 		poolSize = len(upsertChunkIDs)
 	}
 	count, uploadedCount := atomic.Int32{}, atomic.Int32{}
+	uBytes := atomic.Int64{}
 	total := len(upsertChunkIDs)
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
-		if nil != uploadErr {
+		errLock.Lock()
+		failed := nil != uploadErr
+		errLock.Unlock()
+		if failed {
 			return // 快速失败
 		}
+		if wipErr := repo.waitIfPaused(); nil != wipErr {
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = wipErr
+			}
+			errLock.Unlock()
+			return
+		}
 
 		upsertChunkID := arg.(string)
+		if sealErr := repo.store.sealPlainChunk(upsertChunkID); nil != sealErr {
+			logging.LogErrorf("seal plain chunk [%s] failed: %s", upsertChunkID, sealErr)
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = sealErr
+			}
+			errLock.Unlock()
+			return
+		}
 		filePath := path.Join("objects", upsertChunkID[:2], upsertChunkID[2:])
 		count.Add(1)
 		eventbus.Publish(eventbus.EvtCloudBeforeUploadChunk, context, int(count.Load()), total)
-		length, uoErr := repo.cloud.UploadObject(filePath, false)
+		var length int64
+		uoErr := tuner.do(func() (doErr error) {
+			length, doErr = target.UploadObject(filePath, false)
+			return
+		})
 		if nil != uoErr {
-			uploadErr = uoErr
-			err = uploadErr
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = uoErr
+			}
+			errLock.Unlock()
 			return
 		}
-		uploadBytes += length
+		uBytes.Add(length)
 		uploadedCount.Add(1)
+		repo.rateLimit(length)
+		if faultErr := repo.fault(FaultAfterUploadChunk); nil != faultErr {
+			errLock.Lock()
+			if nil == uploadErr {
+				uploadErr = faultErr
+			}
+			errLock.Unlock()
+			return
+		}
 		//logging.LogInfof("uploaded chunk [%s, %d/%d]", filePath, int(uploadedCount.Load()), total)
 	})
 	if nil != err {
@@ -1405,13 +2023,17 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 			logging.LogErrorf("invoke failed: %s", err)
 			return
 		}
-		if nil != uploadErr {
-			err = uploadErr
+		errLock.Lock()
+		err = uploadErr
+		errLock.Unlock()
+		if nil != err {
 			return
 		}
 	}
 	waitGroup.Wait()
 	p.Release()
+	uploadBytes = uBytes.Load()
+	err = uploadErr
 	return
 }
 
@@ -1453,24 +2075,24 @@ func (repo *Repo) getChunks(files []*entity.File) (chunkIDs []string) {
 	return
 }
 
+// localUpsertChunkIDs 用于计算文件 localFiles 中云端不存在的分块，分块按照文件的顺序返回，以便按照上传优先级上传。
 func (repo *Repo) localUpsertChunkIDs(localFiles []*entity.File, cloudChunkIDs []string) (ret []string, err error) {
-	chunks := map[string]bool{}
+	excluded := map[string]bool{}
+	for _, cloudChunkID := range cloudChunkIDs {
+		excluded[cloudChunkID] = true
+	}
+
 	for _, file := range localFiles {
 		//logging.LogInfof("upsert file [%s, %s, %s] chunk [%s]",
 		//	file.ID, file.Path, time.UnixMilli(file.Updated).Format("2006-01-02 15:04:05"), strings.Join(file.Chunks, ","))
 		for _, chunkID := range file.Chunks {
-			chunks[chunkID] = true
+			if !excluded[chunkID] {
+				excluded[chunkID] = true
+				ret = append(ret, chunkID)
+			}
 		}
 	}
 
-	for _, cloudChunkID := range cloudChunkIDs {
-		delete(chunks, cloudChunkID)
-	}
-
-	for chunkID := range chunks {
-		ret = append(ret, chunkID)
-	}
-
 	//for _, c := range ret {
 	//	logging.LogInfof("upsert chunk [%s]", c)
 	//}
@@ -1504,16 +2126,19 @@ func (repo *Repo) localUpsertFiles(latest *entity.Index, cloudLatest *entity.Ind
 }
 
 func (repo *Repo) UpdateLatestSync(index *entity.Index) (err error) {
-	refs := filepath.Join(repo.Path, "refs")
-	err = os.MkdirAll(refs, 0755)
-	if nil != err {
+	return repo.updateLatestSync(index, RefOpUpdate)
+}
+
+func (repo *Repo) updateLatestSync(index *entity.Index, op string) (err error) {
+	if err = repo.checkMutable(); nil != err {
 		return
 	}
-	err = gulu.File.WriteFileSafer(filepath.Join(refs, "latest-sync"), []byte(index.ID), 0644)
-	if nil != err {
+
+	if err = repo.updateRef("latest-sync", index.ID, op); nil != err {
 		return
 	}
 	logging.LogInfof("updated latest sync [%s]", index.String())
+	repo.resetMergeBases(index)
 	return
 }
 
@@ -1529,6 +2154,7 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 	if 1 > len(upsertFiles) {
 		return
 	}
+	repo.sortUploadFiles(upsertFiles)
 
 	// 计算待上传云端的分块
 	upsertChunkIDs, err := repo.localUpsertChunkIDs(upsertFiles, cloudChunkIDs)
@@ -1538,7 +2164,7 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 	}
 
 	// 上传分块
-	length, err := repo.uploadChunks(upsertChunkIDs, context)
+	length, err := repo.uploadFileChunks(upsertFiles, upsertChunkIDs, context)
 	if nil != err {
 		logging.LogErrorf("upload chunks failed: %s", err)
 		return
@@ -1546,6 +2172,7 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 	trafficStat.UploadChunkCount += len(upsertChunkIDs)
 	trafficStat.UploadBytes += length
 	trafficStat.APIPut += trafficStat.UploadChunkCount
+	trafficStat.UploadConcurrency = repo.concurrencyTuner(repo.cloud, true).Level()
 
 	// 上传文件
 	length, err = repo.uploadFiles(upsertFiles, context)
@@ -1594,10 +2221,21 @@ func (repo *Repo) downloadCloudChunk(id string, count, total int, context map[st
 
 	key := path.Join("objects", id[:2], id[2:])
 	data, err := repo.downloadCloudObject(key)
+	if errors.Is(err, cloud.ErrCloudObjectNotFound) && nil != repo.offload {
+		// 分块可能已经转存到次级云端存储
+		data, err = repo.downloadOffloadedObject(key)
+	}
 	if nil != err {
 		logging.LogErrorf("download cloud chunk [%s] failed: %s", id, err)
 		return
 	}
+
+	// 分块 ID 是分块内容的哈希，入库前校验下载的内容
+	if actual := util.Hash(data); actual != id {
+		err = &CloudObjectCorruptedError{Key: key, Actual: actual}
+		logging.LogErrorf("download cloud chunk [%s] failed: %s", id, err)
+		return
+	}
 	length = int64(len(data))
 	ret = &entity.Chunk{ID: id, Data: data}
 	return
@@ -1613,16 +2251,30 @@ func (repo *Repo) downloadCloudFile(id string, count, total int, context map[str
 		return
 	}
 	length = int64(len(data))
-	ret = &entity.File{}
-	err = gulu.JSON.UnmarshalJSON(data, ret)
+	ret, err = entity.UnmarshalFile(data)
+	if nil != err {
+		return
+	}
+
+	// 文件对象的 ID 由文件元数据计算，入库前确认下载的是该 ID 对应的文件对象
+	if ret.ID != id {
+		err = &CloudObjectCorruptedError{Key: key, Actual: ret.ID}
+		logging.LogErrorf("download cloud file [%s] failed: %s", id, err)
+		ret = nil
+		return
+	}
 	return
 }
 
 func (repo *Repo) downloadCloudObject(filePath string) (ret []byte, err error) {
-	data, err := repo.cloud.DownloadObject(filePath)
+	data, err := repo.downloadCloudData(filePath)
 	if nil != err {
+		if errors.Is(err, cloud.ErrObjectArchived) && strings.HasPrefix(filePath, "objects/") {
+			err = &ObjectArchivedError{ObjectID: path.Base(path.Dir(filePath)) + path.Base(filePath)}
+		}
 		return
 	}
+	repo.rateLimit(int64(len(data)))
 
 	ret, err = repo.decodeDownloadedData(filePath, data)
 	if nil != err {
@@ -1635,7 +2287,7 @@ func (repo *Repo) downloadCloudObject(filePath string) (ret []byte, err error) {
 func (repo *Repo) decodeDownloadedData(key string, data []byte) (ret []byte, err error) {
 	ret = data
 	if strings.Contains(key, "objects") {
-		ret, err = repo.store.decodeData(ret)
+		ret, err = repo.store.decodeData(path.Base(path.Dir(key))+path.Base(key), ret)
 		if nil != err {
 			logging.LogErrorf("decode downloaded data [%s] failed: %s", key, err)
 			return
@@ -1659,10 +2311,12 @@ func (repo *Repo) downloadCloudIndex(id string, context map[string]interface{})
 	if nil != err {
 		return
 	}
-	err = gulu.JSON.UnmarshalJSON(data, index)
+	decoded, err := entity.UnmarshalIndex(data)
 	if nil != err {
 		return
 	}
+	repo.unsealIndex(decoded)
+	index = decoded
 	downloadBytes += int64(len(data))
 	return
 }
@@ -1734,7 +2388,7 @@ func (repo *Repo) downloadCloudLatest(context map[string]interface{}) (downloadB
 }
 
 func (repo *Repo) getSeqNumLatest() (id string, maxSeqNum int, seqNumLatests []string) {
-	refs, listErr := repo.cloud.ListObjects("refs/")
+	refs, listErr := repo.listCloudObjects("refs/")
 	if nil != listErr {
 		logging.LogErrorf("list refs failed: %s", listErr)
 		return
@@ -1747,7 +2401,9 @@ func (repo *Repo) getSeqNumLatest() (id string, maxSeqNum int, seqNumLatests []s
 		p := strings.TrimPrefix(ref.Path, "latest-")
 		parts := strings.Split(p, "-")
 		if 2 > len(parts) {
-			repo.cloud.RemoveObject("refs/" + ref.Path)
+			if nil == repo.cloud.RemoveObject("refs/"+ref.Path) {
+				repo.updateCloudListing("refs/"+ref.Path, 0, true)
+			}
 			continue
 		}
 
@@ -1762,26 +2418,11 @@ func (repo *Repo) getSeqNumLatest() (id string, maxSeqNum int, seqNumLatests []s
 	return
 }
 
-func (repo *Repo) genSyncHistory(now, relPath, absPath string) (err error) {
-	historyDir, err := repo.getHistoryDirNow(now, "sync")
-	if nil != err {
-		return
-	}
-
-	historyPath := filepath.Join(historyDir, relPath)
-	if err = gulu.File.Copy(absPath, historyPath); nil != err {
+func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[string]interface{}) (stat *DownloadTrafficStat, err error) {
+	if err = repo.checkMutable(); nil != err {
 		return
 	}
-	return
-}
 
-func (repo *Repo) getHistoryDirNow(now, suffix string) (ret string, err error) {
-	ret = filepath.Join(repo.HistoryPath, now+"-"+suffix)
-	err = os.MkdirAll(ret, 0755)
-	return
-}
-
-func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[string]interface{}) (stat *DownloadTrafficStat, err error) {
 	stat = &DownloadTrafficStat{}
 
 	chunkIDs := repo.getChunks(files)
@@ -1801,8 +2442,8 @@ func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[strin
 }
 
 func (repo *Repo) RemoveCloudRepo(name string) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar}
 	err = repo.tryLockCloud("remove", context)
@@ -1815,8 +2456,8 @@ func (repo *Repo) RemoveCloudRepo(name string) (err error) {
 }
 
 func (repo *Repo) CreateCloudRepo(name string) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
 	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar}
 	err = repo.tryLockCloud("create", context)
@@ -1839,3 +2480,9 @@ func (repo *Repo) GetCloudAvailableSize() (ret int64) {
 func (repo *Repo) GetCloudRepoStat() (stat *cloud.Stat, err error) {
 	return repo.cloud.GetStat()
 }
+
+// CheckCloudConnection 用于检查云端存储服务是否可达并探测其能力，可在保存云端配置时调用以便尽早发现配置错误。
+func (repo *Repo) CheckCloudConnection() (caps *cloud.Capabilities, err error) {
+	caps, err = repo.cloud.Capabilities()
+	return
+}
@@ -0,0 +1,97 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"maps"
+	"sync"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrDuplicateSyncRepo 描述了同一个仓库在一次并发同步中出现多次的错误。
+var ErrDuplicateSyncRepo = errors.New("repo scheduled more than once")
+
+// RepoSyncResult 描述了并发同步中单个仓库的同步结果。
+type RepoSyncResult struct {
+	Repo        *Repo
+	MergeResult *MergeResult
+	TrafficStat *TrafficStat
+	Err         error
+}
+
+// SyncRepos 用于并发同步多个互相独立的仓库（比如多个工作空间），返回结果的顺序和 repos 一致。
+//
+// concurrency 为同时同步的仓库数，小于 1 时同时同步全部仓库。limiter 不为 nil 时会设置为所有仓库的限速器，
+// 所有仓库的传输共用同一份带宽和请求额度。每个仓库使用 context 的副本发布事件，单个仓库同步失败不影响其他仓库。
+func SyncRepos(repos []*Repo, limiter *RateLimiter, concurrency int, context map[string]interface{}) (ret []*RepoSyncResult) {
+	ret = make([]*RepoSyncResult, len(repos))
+	if 1 > len(repos) {
+		return
+	}
+	if 1 > concurrency || concurrency > len(repos) {
+		concurrency = len(repos)
+	}
+
+	scheduled := map[string]bool{}
+	var indexes []int
+	for i, repo := range repos {
+		ret[i] = &RepoSyncResult{Repo: repo}
+		if scheduled[repo.Path] {
+			ret[i].Err = ErrDuplicateSyncRepo
+			continue
+		}
+		scheduled[repo.Path] = true
+		if nil != limiter {
+			repo.SetRateLimiter(limiter)
+		}
+		indexes = append(indexes, i)
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	p, err := ants.NewPoolWithFunc(concurrency, func(arg interface{}) {
+		defer waitGroup.Done()
+		result := ret[arg.(int)]
+		repoContext := maps.Clone(context)
+		if nil == repoContext {
+			repoContext = map[string]interface{}{}
+		}
+		result.MergeResult, result.TrafficStat, result.Err = result.Repo.Sync(repoContext)
+		if nil != result.Err {
+			logging.LogErrorf("sync repo [%s] failed: %s", result.Repo.Path, result.Err)
+		}
+	})
+	if nil != err {
+		for _, i := range indexes {
+			ret[i].Err = err
+		}
+		return
+	}
+	defer p.Release()
+
+	for _, i := range indexes {
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(i); nil != invokeErr {
+			waitGroup.Done()
+			ret[i].Err = invokeErr
+		}
+	}
+	waitGroup.Wait()
+	return
+}
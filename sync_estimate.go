@@ -0,0 +1,137 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+// SyncSizeEstimate 描述了同步前估算的云端空间需求。
+type SyncSizeEstimate struct {
+	UploadFileCount  int   `json:"uploadFileCount"`  // 待上传的文件数
+	UploadChunkCount int   `json:"uploadChunkCount"` // 待上传的分块数（已经排除云端存在的分块）
+	UploadBytes      int64 `json:"uploadBytes"`      // 待上传到云端的字节数，按本地仓库中加密压缩后的对象大小计算
+	OffloadBytes     int64 `json:"offloadBytes"`     // 待上传到次级云端存储的字节数，不占用云端空间
+	CloudSize        int64 `json:"cloudSize"`        // 云端最新索引的数据大小
+	AvailableSize    int64 `json:"availableSize"`    // 云端存储可用空间字节数
+	Exceeded         bool  `json:"exceeded"`         // 同步后是否会超出云端存储可用空间
+}
+
+// EstimateSyncSize 用于估算同步需要上传到云端的数据大小，不会上传任何数据。
+//
+// 估算时会下载本地缺失的云端文件对象用于计算分块差异，这些文件在同步时本来也需要下载。
+func (repo *Repo) EstimateSyncSize(context map[string]interface{}) (ret *SyncSizeEstimate, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	ret = &SyncSizeEstimate{AvailableSize: repo.cloud.GetAvailableSize()}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		logging.LogErrorf("get latest failed: %s", err)
+		return
+	}
+
+	_, cloudLatest, err := repo.downloadCloudLatest(context)
+	if nil != err {
+		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			logging.LogErrorf("download cloud latest failed: %s", err)
+			return
+		}
+		err = nil
+	}
+	ret.CloudSize = cloudLatest.Size
+	if cloudLatest.ID == latest.ID {
+		return
+	}
+
+	fetchFileIDs, err := repo.localNotFoundFiles(cloudLatest.Files)
+	if nil != err {
+		logging.LogErrorf("get local not found files failed: %s", err)
+		return
+	}
+	if _, _, err = repo.downloadCloudFilesPut(fetchFileIDs, context); nil != err {
+		logging.LogErrorf("download cloud files put failed: %s", err)
+		return
+	}
+	cloudLatestFiles, err := repo.getFiles(cloudLatest.Files)
+	if nil != err {
+		logging.LogErrorf("get cloud latest files failed: %s", err)
+		return
+	}
+
+	upsertFiles, err := repo.localUpsertFiles(latest, cloudLatest)
+	if nil != err {
+		logging.LogErrorf("get local upsert files failed: %s", err)
+		return
+	}
+	upsertChunkIDs, err := repo.localUpsertChunkIDs(upsertFiles, repo.getChunks(cloudLatestFiles))
+	if nil != err {
+		logging.LogErrorf("get local upsert chunk ids failed: %s", err)
+		return
+	}
+	ret.UploadFileCount = len(upsertFiles)
+	ret.UploadChunkCount = len(upsertChunkIDs)
+
+	offloaded := map[string]bool{}
+	if nil != repo.offload && nil != repo.offload.Cloud {
+		for _, file := range upsertFiles {
+			if repo.offload.matches(file) {
+				for _, chunkID := range file.Chunks {
+					offloaded[chunkID] = true
+				}
+			}
+		}
+	}
+
+	for _, file := range upsertFiles {
+		size, statErr := repo.objectSize(file.ID)
+		if nil != statErr {
+			err = statErr
+			return
+		}
+		ret.UploadBytes += size
+	}
+	for _, chunkID := range upsertChunkIDs {
+		size, statErr := repo.objectSize(chunkID)
+		if nil != statErr {
+			err = statErr
+			return
+		}
+		if offloaded[chunkID] {
+			ret.OffloadBytes += size
+		} else {
+			ret.UploadBytes += size
+		}
+	}
+
+	ret.Exceeded = ret.AvailableSize <= ret.CloudSize+ret.UploadBytes || ret.AvailableSize <= latest.Size
+	return
+}
+
+func (repo *Repo) objectSize(id string) (ret int64, err error) {
+	info, err := repo.store.Stat(id)
+	if nil != err {
+		logging.LogErrorf("stat object [%s] failed: %s", id, err)
+		return
+	}
+	ret = info.Size()
+	return
+}
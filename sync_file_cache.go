@@ -0,0 +1,36 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"github.com/dgraph-io/ristretto"
+)
+
+// syncFileCacheSize 为同步时共享的已解码文件缓存的最大文件数，足够容纳 30W 文件的仓库。
+const syncFileCacheSize = 1 << 19
+
+// newSyncFileCache 用于创建同步时共享的已解码文件缓存，每个文件的开销计为 1，最多缓存 maxFiles 个文件，用完后需要调用 Close 释放。
+//
+// 进程级别的 fileCache 会被其他操作淘汰，同步时加载的几个文件列表大部分文件相同，使用独立的缓存尽量保证相同的文件只解码一次。
+func newSyncFileCache(maxFiles int64) (*ristretto.Cache, error) {
+	return ristretto.NewCache(&ristretto.Config{
+		NumCounters:        maxFiles * 10,
+		MaxCost:            maxFiles,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+}
@@ -0,0 +1,144 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	syncJournalFile = "sync-journal.json" // 同步日志文件，位于仓库根目录下
+	syncJournalMax  = 512                 // 同步日志最多保留的条数
+)
+
+// SyncJournalEntry 描述了一次同步尝试的记录。
+type SyncJournalEntry struct {
+	SyncID    string `json:"syncID"`    // 同步 ID
+	Kind      string `json:"kind"`      // 同步类型：sync、download、upload
+	Start     int64  `json:"start"`     // 开始时间，毫秒时间戳
+	End       int64  `json:"end"`       // 结束时间，毫秒时间戳
+	Succeeded bool   `json:"succeeded"` // 是否同步成功
+	Error     string `json:"error"`     // 同步失败时的错误信息
+	Upserts   int    `json:"upserts"`   // 更新的文件数
+	Removes   int    `json:"removes"`   // 删除的文件数
+	Conflicts int    `json:"conflicts"` // 冲突的文件数
+
+	DownloadFileCount  int   `json:"downloadFileCount"`
+	DownloadChunkCount int   `json:"downloadChunkCount"`
+	DownloadBytes      int64 `json:"downloadBytes"`
+	UploadFileCount    int   `json:"uploadFileCount"`
+	UploadChunkCount   int   `json:"uploadChunkCount"`
+	UploadBytes        int64 `json:"uploadBytes"`
+	APIGet             int   `json:"apiGet"`
+	APIPut             int   `json:"apiPut"`
+
+	APIOps *cloud.APIOps `json:"apiOps,omitempty"` // 按请求类型统计的实际请求次数
+}
+
+// GetSyncJournal 用于获取最近 limit 次同步尝试的记录，按时间倒序排列，limit 小于 1 时返回全部记录。
+func (repo *Repo) GetSyncJournal(limit int) (ret []*SyncJournalEntry, err error) {
+	repo.syncJournalLock.Lock()
+	defer repo.syncJournalLock.Unlock()
+
+	entries, err := repo.readSyncJournal()
+	if nil != err {
+		return
+	}
+
+	ret = []*SyncJournalEntry{}
+	for i := len(entries) - 1; 0 <= i; i-- {
+		if 0 < limit && limit <= len(ret) {
+			break
+		}
+		ret = append(ret, entries[i])
+	}
+	return
+}
+
+func (repo *Repo) appendSyncJournal(entry *SyncJournalEntry) {
+	repo.syncJournalLock.Lock()
+	defer repo.syncJournalLock.Unlock()
+
+	entries, err := repo.readSyncJournal()
+	if nil != err {
+		logging.LogWarnf("read sync journal failed, the journal will be reset: %s", err)
+		entries = nil
+	}
+
+	entries = append(entries, entry)
+	if syncJournalMax < len(entries) {
+		entries = entries[len(entries)-syncJournalMax:]
+	}
+
+	data, err := gulu.JSON.MarshalJSON(entries)
+	if nil != err {
+		logging.LogErrorf("marshal sync journal failed: %s", err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(repo.Path, syncJournalFile), data, 0644); nil != err {
+		logging.LogErrorf("write sync journal failed: %s", err)
+	}
+}
+
+func (repo *Repo) readSyncJournal() (ret []*SyncJournalEntry, err error) {
+	data, err := os.ReadFile(filepath.Join(repo.Path, syncJournalFile))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = gulu.JSON.UnmarshalJSON(data, &ret)
+	return
+}
+
+func (repo *Repo) journalSync(kind string, start time.Time, context map[string]interface{}, mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+	entry := &SyncJournalEntry{
+		Kind:      kind,
+		Start:     start.UnixMilli(),
+		End:       time.Now().UnixMilli(),
+		Succeeded: nil == err,
+	}
+	entry.SyncID, _ = context[CtxSyncID].(string)
+	if nil != err {
+		entry.Error = err.Error()
+	}
+	if nil != mergeResult {
+		entry.Upserts = len(mergeResult.Upserts)
+		entry.Removes = len(mergeResult.Removes)
+		entry.Conflicts = len(mergeResult.Conflicts)
+	}
+	if nil != trafficStat {
+		entry.DownloadFileCount = trafficStat.DownloadFileCount
+		entry.DownloadChunkCount = trafficStat.DownloadChunkCount
+		entry.DownloadBytes = trafficStat.DownloadBytes
+		entry.UploadFileCount = trafficStat.UploadFileCount
+		entry.UploadChunkCount = trafficStat.UploadChunkCount
+		entry.UploadBytes = trafficStat.UploadBytes
+		entry.APIGet = trafficStat.APIGet
+		entry.APIPut = trafficStat.APIPut
+		entry.APIOps = trafficStat.APIOps
+	}
+	repo.appendSyncJournal(entry)
+}
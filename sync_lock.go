@@ -38,7 +38,9 @@ const (
 )
 
 func (repo *Repo) unlockCloud(context map[string]interface{}) {
-	endRefreshLock <- true
+	repo.endRefreshLock <- true
+	repo.setCloudLocked("")
+	repo.endCloudListing()
 	var err error
 	for i := 0; i < 3; i++ {
 		eventbus.Publish(eventbus.EvtCloudUnlock, context)
@@ -56,14 +58,13 @@ func (repo *Repo) unlockCloud(context map[string]interface{}) {
 	return
 }
 
-var endRefreshLock = make(chan bool)
-
 func (repo *Repo) tryLockCloud(currentDeviceID string, context map[string]interface{}) (err error) {
 	for i := 0; i < 3; i++ {
 		err = repo.lockCloud(currentDeviceID, context)
 		if nil != err {
 			if errors.Is(err, ErrCloudLocked) {
 				logging.LogInfof("cloud repo is locked, retry after 5s")
+				incRetry("lock")
 				time.Sleep(5 * time.Second)
 				continue
 			}
@@ -71,14 +72,19 @@ func (repo *Repo) tryLockCloud(currentDeviceID string, context map[string]interf
 		}
 
 		// 锁定成功，定时刷新锁
+		repo.setCloudLocked(currentDeviceID)
+		repo.beginCloudListing()
 		go func() {
 			ticker := time.NewTicker(30 * time.Second)
 			defer ticker.Stop()
 			for {
 				select {
-				case <-endRefreshLock:
+				case <-repo.endRefreshLock:
 					return
 				case <-ticker.C:
+					if repo.isCloudLockReleased() {
+						continue // 暂停同步期间已经释放了云端锁
+					}
 					if refershErr := repo.lockCloud0(currentDeviceID); nil != refershErr {
 						logging.LogErrorf("refresh cloud repo lock failed: %s", refershErr)
 					}
@@ -128,7 +134,8 @@ func (repo *Repo) lockCloud(currentDeviceID string, context map[string]interface
 	}
 
 	logging.LogWarnf("cloud repo is locked by device [%s] at [%s], will retry after 30s", content["deviceID"].(string), lockTime.Format("2006-01-02 15:04:05"))
-	err = ErrCloudLocked
+	syncLogger(context).Warn("cloud repo is locked", "owner", deviceID, "since", lockTime)
+	err = &CloudLockedError{Owner: deviceID, Since: lockTime}
 	return
 }
 
@@ -154,7 +161,7 @@ func (repo *Repo) lockCloud0(currentDeviceID string) (err error) {
 	_, err = repo.cloud.UploadObject(lockSyncKey, true)
 	if nil != err {
 		if errors.Is(err, cloud.ErrSystemTimeIncorrect) || errors.Is(err, cloud.ErrCloudAuthFailed) || errors.Is(err, cloud.ErrDeprecatedVersion) ||
-			errors.Is(err, cloud.ErrCloudCheckFailed) {
+			errors.Is(err, cloud.ErrCloudCheckFailed) || errors.Is(err, cloud.ErrDeviceRevoked) {
 			return
 		}
 
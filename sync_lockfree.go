@@ -0,0 +1,270 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"io/fs"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// lockFreeSyncRetries 为无锁同步时云端 refs/latest 被其他设备更新后重新同步的最大次数。
+const lockFreeSyncRetries = 5
+
+// syncLeaseDir 为无锁同步租约所在的云端文件夹，每个正在无锁同步的设备在其中写入 sync-<设备 ID>，同步期间定时刷新，同步结束后删除。
+//
+// 清理等会删除云端对象的管理操作锁定云端后需要等待这些租约过期或者被删除，避免删除正在同步的设备已经上传但是还没有被 refs/latest 引用的对象。
+const syncLeaseDir = "lock"
+
+// SetLockFreeSync 用于设置是否开启无锁同步。
+//
+// 开启后同步不再锁定云端，多个设备可以同时同步：更新云端 refs/latest 和 indexes-v2.json 时使用比较并交换，
+// 云端 refs/latest 已经被其他设备更新时，重新下载云端最新索引和本地索引合并后再次上传。清理、迁移等管理操作仍然会锁定云端，
+// 无锁同步开始前会等待这些操作释放云端锁。
+//
+// 只有支持条件写入的云端存储服务（参考 cloud.ConditionalCloud）才能开启，否则返回 cloud.ErrUnsupported。
+// 存储服务实际不支持条件写入时（部分 S3 兼容实现）同步返回 cloud.ErrConditionalWriteUnsupported，需要关闭无锁同步。
+// 共享仓库的设备可以只有部分开启：未开启的设备同步时仍然会锁定云端，开启的设备同步开始前也会等待这些设备释放云端锁。
+func (repo *Repo) SetLockFreeSync(enabled bool) (err error) {
+	if _, ok := repo.cloud.(cloud.ConditionalCloud); enabled && !ok {
+		err = cloud.ErrUnsupported
+		return
+	}
+	repo.lockFreeSync = enabled
+	return
+}
+
+// isLockFreeSync 用于判断当前是否使用无锁同步。
+func (repo *Repo) isLockFreeSync() bool {
+	_, ok := repo.cloud.(cloud.ConditionalCloud)
+	return repo.lockFreeSync && ok
+}
+
+// lockSyncCloud 用于在同步前锁定云端，同步结束后调用 release 释放。无锁同步时只等待管理操作释放云端锁，不锁定云端。
+func (repo *Repo) lockSyncCloud(context map[string]interface{}) (release func(), err error) {
+	if !repo.isLockFreeSync() {
+		if err = repo.tryLockCloud(repo.DeviceID, context); nil != err {
+			return
+		}
+		release = func() { repo.unlockCloud(context) }
+		return
+	}
+
+	// 先写入租约再检查云端锁，和先锁定云端再检查租约的管理操作之间至少有一方能够发现对方
+	for i := 0; i < 3; i++ {
+		if err = repo.putSyncLease(); nil != err {
+			return
+		}
+		if err = repo.checkCloudUnlocked(); !errors.Is(err, ErrCloudLocked) {
+			break
+		}
+		repo.removeSyncLease()
+		logging.LogInfof("cloud repo is locked, retry after 5s")
+		var lockedErr *CloudLockedError
+		if errors.As(err, &lockedErr) {
+			syncLogger(context).Warn("cloud repo is locked", "owner", lockedErr.Owner, "since", lockedErr.Since)
+		}
+		incRetry("lock")
+		time.Sleep(5 * time.Second)
+	}
+	if nil != err {
+		repo.removeSyncLease()
+		return
+	}
+
+	endRefresh := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-endRefresh:
+				return
+			case <-ticker.C:
+				if refreshErr := repo.putSyncLease(); nil != refreshErr {
+					logging.LogErrorf("refresh sync lease failed: %s", refreshErr)
+				}
+			}
+		}
+	}()
+	release = func() {
+		close(endRefresh)
+		repo.removeSyncLease()
+	}
+	return
+}
+
+// syncLeaseKey 用于获取当前设备的无锁同步租约在云端的路径。
+func (repo *Repo) syncLeaseKey() string {
+	return path.Join(syncLeaseDir, "sync-"+repo.DeviceID)
+}
+
+// putSyncLease 用于写入或者刷新当前设备的无锁同步租约。
+func (repo *Repo) putSyncLease() (err error) {
+	data, err := gulu.JSON.MarshalJSON(map[string]interface{}{
+		"deviceID": repo.DeviceID,
+		"time":     time.Now().UnixMilli(),
+	})
+	if nil != err {
+		return
+	}
+	if _, err = repo.cloud.UploadBytes(repo.syncLeaseKey(), data, true); nil != err {
+		logging.LogErrorf("upload sync lease failed: %s", err)
+	}
+	return
+}
+
+// removeSyncLease 用于删除当前设备的无锁同步租约。
+func (repo *Repo) removeSyncLease() {
+	if err := repo.cloud.RemoveObject(repo.syncLeaseKey()); nil != err {
+		logging.LogWarnf("remove sync lease failed: %s", err)
+	}
+}
+
+// waitLockFreeSyncs 用于在锁定云端后等待其他设备正在进行的无锁同步结束，仍有同步进行时返回 *CloudLockedError。
+//
+// 云端存储服务不支持条件写入时不会有设备进行无锁同步，直接返回。
+func (repo *Repo) waitLockFreeSyncs() (err error) {
+	if _, ok := repo.cloud.(cloud.ConditionalCloud); !ok {
+		return
+	}
+
+	for i := 0; ; i++ {
+		owner, since, activeErr := repo.activeSyncLease()
+		if nil != activeErr || "" == owner {
+			err = activeErr
+			return
+		}
+		if 3 <= i {
+			err = &CloudLockedError{Owner: owner, Since: since}
+			return
+		}
+		logging.LogInfof("device [%s] is syncing lock-free since [%s], retry after 5s", owner, since.Format("2006-01-02 15:04:05"))
+		incRetry("lock")
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// activeSyncLease 用于获取其他设备尚未过期的无锁同步租约，没有时 owner 为空。
+func (repo *Repo) activeSyncLease() (owner string, since time.Time, err error) {
+	leases, err := repo.cloud.ListObjects(syncLeaseDir + "/")
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) || errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	for name := range leases {
+		if !strings.HasPrefix(path.Base(name), "sync-") {
+			continue
+		}
+
+		data, downloadErr := repo.cloud.DownloadObject(path.Join(syncLeaseDir, path.Base(name)))
+		if nil != downloadErr {
+			if errors.Is(downloadErr, cloud.ErrCloudObjectNotFound) {
+				continue // 同步刚刚结束
+			}
+			err = downloadErr
+			return
+		}
+
+		content := map[string]interface{}{}
+		if unmarshalErr := gulu.JSON.UnmarshalJSON(data, &content); nil != unmarshalErr {
+			logging.LogWarnf("unmarshal sync lease [%s] failed: %s", name, unmarshalErr)
+			continue
+		}
+		deviceID, _ := content["deviceID"].(string)
+		t, _ := content["time"].(float64)
+		leaseTime := time.UnixMilli(int64(t))
+		if deviceID == repo.DeviceID || time.Now().After(leaseTime.Add(65*time.Second)) {
+			continue
+		}
+		owner, since = deviceID, leaseTime
+		return
+	}
+	return
+}
+
+// checkCloudUnlocked 用于检查云端是否没有被其他设备锁定，锁定时返回 *CloudLockedError。
+func (repo *Repo) checkCloudUnlocked() (err error) {
+	data, err := repo.cloud.DownloadObject(lockSyncKey)
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	content := map[string]interface{}{}
+	if err = gulu.JSON.UnmarshalJSON(data, &content); nil != err {
+		logging.LogWarnf("unmarshal lock sync failed: %s", err)
+		err = nil
+		return
+	}
+	deviceID, _ := content["deviceID"].(string)
+	t, _ := content["time"].(float64)
+	lockTime := time.UnixMilli(int64(t))
+	if time.Now().After(lockTime.Add(65*time.Second)) || deviceID == repo.DeviceID {
+		return
+	}
+	logging.LogWarnf("cloud repo is locked by device [%s] at [%s]", deviceID, lockTime.Format("2006-01-02 15:04:05"))
+	err = &CloudLockedError{Owner: deviceID, Since: lockTime}
+	return
+}
+
+// lockFreeRetryWait 用于获取无锁同步第 attempt 次重试前的等待时长，加入随机抖动避免多个设备同时重试。
+func lockFreeRetryWait(attempt int) time.Duration {
+	base := time.Duration(attempt) * 200 * time.Millisecond
+	return base + time.Duration(rand.Int63n(int64(200*time.Millisecond)))
+}
+
+// updateCloudIndexesV2CAS 用于无锁同步时使用比较并交换将本地最新索引 latest 加入云端 indexes-v2.json，其他设备同时更新时重试。
+func (repo *Repo) updateCloudIndexesV2CAS(conditional cloud.ConditionalCloud, latest *entity.Index) (downloadBytes, uploadBytes int64, err error) {
+	for i := 0; i < lockFreeSyncRetries; i++ {
+		data, etag, downloadErr := conditional.DownloadObjectETag("indexes-v2.json")
+		if nil != downloadErr && !errors.Is(downloadErr, cloud.ErrCloudObjectNotFound) {
+			err = downloadErr
+			return
+		}
+		downloadBytes += int64(len(data))
+
+		var found bool
+		if data, found, err = repo.addCloudIndexEntry(data, latest); nil != err || found {
+			return
+		}
+
+		var length int64
+		length, err = conditional.UploadBytesIfMatch("indexes-v2.json", data, etag)
+		uploadBytes += length
+		if !errors.Is(err, cloud.ErrCloudPreconditionFailed) {
+			return
+		}
+		logging.LogWarnf("cloud indexes changed while updating, retry")
+		time.Sleep(lockFreeRetryWait(i + 1))
+	}
+	err = ErrCloudLatestChanged
+	return
+}
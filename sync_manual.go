@@ -29,15 +29,29 @@ import (
 )
 
 func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	start := time.Now()
+	context = beginSync("download", context)
+	context[ctxAPIOpsBase] = repo.cloudAPIOps()
+	defer func() { repo.endSync("download", start, context, mergeResult, trafficStat, err) }()
+	defer func() { err = classifyErr(err) }()
+	defer func() {
+		if nil == err {
+			repo.prefetchAsync()
+		}
+	}()
 
 	// 锁定云端，防止其他设备并发上传数据
-	err = repo.tryLockCloud(repo.DeviceID, context)
+	release, err := repo.lockSyncCloud(context)
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer release()
 
 	mergeResult = &MergeResult{Time: time.Now()}
 	trafficStat = &TrafficStat{m: &sync.Mutex{}}
@@ -94,7 +108,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	cloudChunkIDs := repo.getChunks(cloudLatestFiles)
 
 	// 计算本地缺失的分块
-	fetchChunkIDs, err := repo.localNotFoundChunks(cloudChunkIDs)
+	fetchChunkIDs, err := repo.localNotFoundChunks(repo.eagerChunks(cloudLatestFiles))
 	if nil != err {
 		logging.LogErrorf("get local not found chunks failed: %s", err)
 		return
@@ -105,6 +119,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	trafficStat.DownloadBytes += length
 	trafficStat.DownloadChunkCount += len(fetchChunkIDs)
 	trafficStat.APIGet += trafficStat.DownloadChunkCount
+	trafficStat.DownloadConcurrency = repo.concurrencyTuner(repo.cloud, false).Level()
 
 	// 计算本地相比上一个同步点的 upsert 和 remove 差异
 	latestFiles, err := repo.getFiles(latest.Files)
@@ -112,12 +127,14 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 		logging.LogErrorf("get latest files failed: %s", err)
 		return
 	}
+	mergeResult.Warnings = repo.softLimitWarnings(latestFiles)
 	latestSync := repo.latestSync()
 	latestSyncFiles, err := repo.getFiles(latestSync.Files)
 	if nil != err {
 		logging.LogErrorf("get latest sync files failed: %s", err)
 		return
 	}
+	latestSyncFiles = repo.mergeBaseFiles(latestSync, latestSyncFiles)
 	localUpserts, localRemoves := repo.diffUpsertRemove(latestFiles, latestSyncFiles, false)
 	localChanged := 0 < len(localUpserts) || 0 < len(localRemoves)
 
@@ -132,9 +149,11 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 
 	// 计算冲突的 upsert
 	// 冲突的文件以云端 upsert 和 remove 为准
+	var conflicts []*Conflict
 	for _, localUpsert := range localUpserts {
-		if nil != repo.getFile(mergeResult.Upserts, localUpsert) || nil != repo.getFile(mergeResult.Removes, localUpsert) {
+		if cloudUpsert := repo.getFile(mergeResult.Upserts, localUpsert); nil != cloudUpsert || nil != repo.getFile(mergeResult.Removes, localUpsert) {
 			mergeResult.Conflicts = append(mergeResult.Conflicts, localUpsert)
+			conflicts = append(conflicts, detectConflict(localUpsert.Path, localUpsert, cloudUpsert, latest, cloudLatest, mergeResult.Time, context))
 			logging.LogInfof("sync download conflict [%s, %s, %s]", localUpsert.ID, localUpsert.Path, time.UnixMilli(localUpsert.Updated).Format("2006-01-02 15:04:05"))
 		}
 	}
@@ -142,7 +161,8 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	// 冲突文件复制到数据历史文件夹
 	if 0 < len(mergeResult.Conflicts) {
 		now := mergeResult.Time.Format("2006-01-02-150405")
-		temp := filepath.Join(repo.TempPath, "repo", "sync", "conflicts", now)
+		temp := filepath.Join(repo.syncTemp(context, "conflicts"), now)
+		historySink := repo.getHistorySink()
 		for i, file := range mergeResult.Conflicts {
 			var checkoutTmp *entity.File
 			checkoutTmp, err = repo.store.GetFile(file.ID)
@@ -150,6 +170,10 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 				logging.LogErrorf("get file failed: %s", err)
 				return
 			}
+			if !historySink.Accept(checkoutTmp) {
+				logging.LogInfof("skip generating sync history [%s]", checkoutTmp.Path)
+				continue
+			}
 
 			err = repo.checkoutFile(checkoutTmp, temp, i+1, len(mergeResult.Conflicts), context)
 			if nil != err {
@@ -157,8 +181,8 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 				return
 			}
 
-			absPath := filepath.Join(temp, checkoutTmp.Path)
-			err = repo.genSyncHistory(now, file.Path, absPath)
+			absPath := repo.checkoutAbsPath(temp, checkoutTmp.Path)
+			err = historySink.Write(mergeResult.Time, checkoutTmp, absPath)
 			if nil != err {
 				logging.LogErrorf("generate sync history failed: %s", err)
 				err = ErrCloudGenerateConflictHistory
@@ -179,6 +203,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 		logging.LogErrorf("merge sync failed: %s", err)
 		return
 	}
+	repo.recordConflicts(conflicts)
 
 	// 统计流量
 	go repo.cloud.AddTraffic(&cloud.Traffic{
@@ -187,20 +212,38 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	})
 
 	// 移除空目录
-	gulu.File.RemoveEmptyDirs(repo.DataPath, removeEmptyDirExcludes...)
+	repo.removeEmptyDataDirs()
 	return
 }
 
 func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *TrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	start := time.Now()
+	context = beginSync("upload", context)
+	context[ctxAPIOpsBase] = repo.cloudAPIOps()
+	defer func() { repo.endSync("upload", start, context, nil, trafficStat, err) }()
+	defer func() { err = classifyErr(err) }()
+	defer func() {
+		if nil == err {
+			repo.replicateAsync()
+		}
+	}()
 
 	// 锁定云端，防止其他设备并发上传数据
-	err = repo.tryLockCloud(repo.DeviceID, context)
+	release, err := repo.lockSyncCloud(context)
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer release()
+
+	if err = repo.checkDeviceRevoked(context); nil != err {
+		return
+	}
 
 	trafficStat = &TrafficStat{m: &sync.Mutex{}}
 
@@ -247,6 +290,8 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 		}
 	}
 
+	repo.sortUploadFiles(uploadFiles)
+
 	// 从文件列表中得到去重后的分块列表
 	uploadChunkIDs := repo.getChunks(uploadFiles)
 
@@ -258,7 +303,7 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 	//}
 
 	// 上传分块
-	length, err = repo.uploadChunks(uploadChunkIDs, context)
+	length, err = repo.uploadFileChunks(uploadFiles, uploadChunkIDs, context)
 	if nil != err {
 		logging.LogErrorf("upload chunks failed: %s", err)
 		return
@@ -266,6 +311,7 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 	trafficStat.UploadChunkCount += len(uploadChunkIDs)
 	trafficStat.UploadBytes += length
 	trafficStat.APIPut += trafficStat.UploadChunkCount
+	trafficStat.UploadConcurrency = repo.concurrencyTuner(repo.cloud, true).Level()
 
 	// 上传文件
 	length, err = repo.uploadFiles(uploadFiles, context)
@@ -278,14 +324,14 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 	trafficStat.APIPut += trafficStat.UploadChunkCount
 
 	// 更新云端索引信息
-	err = repo.updateCloudIndexes(latest, trafficStat, context)
+	err = repo.updateCloudIndexes(latest, cloudLatest.ID, trafficStat, context)
 	if nil != err {
 		logging.LogErrorf("update cloud indexes failed: %s", err)
 		return
 	}
 
 	// 更新本地同步点
-	err = repo.UpdateLatestSync(latest)
+	err = repo.updateLatestSync(latest, RefOpUpload)
 	if nil != err {
 		logging.LogErrorf("update latest sync failed: %s", err)
 		return
@@ -0,0 +1,138 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+)
+
+// SyncNotification 描述了同步成功后发送的通知，包括合并结果的摘要和本地最新索引。
+type SyncNotification struct {
+	Kind            string `json:"kind"`            // 同步类型，sync、download 或者 upload
+	SyncID          string `json:"syncID"`          // 同步 ID，参考 CtxSyncID
+	DeviceID        string `json:"deviceID"`        // 设备 ID
+	IndexID         string `json:"indexID"`         // 同步后的本地最新索引 ID
+	Time            int64  `json:"time"`            // 同步完成时间
+	DataChanged     bool   `json:"dataChanged"`     // 数据文件夹是否发生了变更
+	Upserts         int    `json:"upserts"`         // 新增和更新的文件数
+	Removes         int    `json:"removes"`         // 删除的文件数
+	Conflicts       int    `json:"conflicts"`       // 冲突的文件数
+	Moves           int    `json:"moves"`           // 移动的文件数
+	PreMergeIndexID string `json:"preMergeIndexID"` // 变更数据文件夹前创建的安全快照索引 ID
+	UploadDeferred  bool   `json:"uploadDeferred"`  // 本地变更的上传是否被推迟
+	UploadBytes     int64  `json:"uploadBytes"`     // 上传的字节数
+	DownloadBytes   int64  `json:"downloadBytes"`   // 下载的字节数
+}
+
+// SyncNotifier 描述了同步成功后的通知接收方，调用方可以实现该接口在数据变更后触发自动化任务（比如重新生成静态站点）而不需要轮询。
+//
+// 通知在同步结束后异步发送，不会阻塞同步，发送失败只记录日志。
+type SyncNotifier interface {
+	Notify(notification *SyncNotification) error
+}
+
+// FuncSyncNotifier 使用函数接收同步通知。
+type FuncSyncNotifier func(notification *SyncNotification) error
+
+func (notifier FuncSyncNotifier) Notify(notification *SyncNotification) error {
+	return notifier(notification)
+}
+
+// WebhookSyncNotifier 将同步通知以 JSON 格式 POST 到 URL，响应状态码不是 2xx 时视为失败。
+type WebhookSyncNotifier struct {
+	URL             string            // Webhook 地址
+	Header          map[string]string // 额外的请求头，比如鉴权信息
+	Timeout         time.Duration     // 请求超时，为 0 时使用 10 秒
+	OnlyDataChanged bool              // 是否只在数据文件夹发生变更时通知
+}
+
+func (notifier *WebhookSyncNotifier) Notify(notification *SyncNotification) (err error) {
+	if notifier.OnlyDataChanged && !notification.DataChanged {
+		return
+	}
+
+	data, err := gulu.JSON.MarshalJSON(notification)
+	if nil != err {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, notifier.URL, bytes.NewReader(data))
+	if nil != err {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range notifier.Header {
+		req.Header.Set(k, v)
+	}
+
+	timeout := notifier.Timeout
+	if 0 >= timeout {
+		timeout = 10 * time.Second
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if nil != err {
+		return
+	}
+	resp.Body.Close()
+	if 200 > resp.StatusCode || 299 < resp.StatusCode {
+		err = fmt.Errorf("webhook [%s] responded [%d]", notifier.URL, resp.StatusCode)
+	}
+	return
+}
+
+// SetSyncNotifier 用于设置同步成功后的通知接收方，传入 nil 时不通知。
+func (repo *Repo) SetSyncNotifier(notifier SyncNotifier) {
+	repo.syncNotifier = notifier
+}
+
+// notifySync 用于在同步成功后异步通知 syncNotifier。
+func (repo *Repo) notifySync(kind string, context map[string]interface{}, mergeResult *MergeResult, trafficStat *TrafficStat) {
+	notifier := repo.syncNotifier
+	if nil == notifier {
+		return
+	}
+
+	notification := &SyncNotification{Kind: kind, DeviceID: repo.DeviceID, Time: time.Now().UnixMilli()}
+	notification.SyncID, _ = context[CtxSyncID].(string)
+	if latest, err := repo.Latest(); nil == err {
+		notification.IndexID = latest.ID
+	}
+	if nil != mergeResult {
+		notification.DataChanged = mergeResult.DataChanged()
+		notification.Upserts = len(mergeResult.Upserts)
+		notification.Removes = len(mergeResult.Removes)
+		notification.Conflicts = len(mergeResult.Conflicts)
+		notification.Moves = len(mergeResult.Moves)
+		notification.PreMergeIndexID = mergeResult.PreMergeIndexID
+		notification.UploadDeferred = mergeResult.UploadDeferred
+	}
+	if nil != trafficStat {
+		notification.UploadBytes = trafficStat.UploadBytes
+		notification.DownloadBytes = trafficStat.DownloadBytes
+	}
+
+	go func() {
+		if err := notifier.Notify(notification); nil != err {
+			logging.LogWarnf("notify sync [%s] failed: %s", notification.SyncID, err)
+		}
+	}()
+}
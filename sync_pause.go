@@ -0,0 +1,225 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+var (
+	ErrSyncNotPaused           = errors.New("sync is not paused")                   // ErrSyncNotPaused 描述了恢复同步时同步并未暂停的错误
+	ErrCloudChangedWhilePaused = errors.New("cloud repo changed while sync paused") // ErrCloudChangedWhilePaused 描述了暂停同步期间云端仓库被其他设备更新的错误，需要重新同步
+)
+
+const (
+	EvtSyncPaused  = "repo.syncPaused"  // EvtSyncPaused 描述了同步暂停的事件，参数为 context
+	EvtSyncResumed = "repo.syncResumed" // EvtSyncResumed 描述了同步恢复的事件，参数为 context
+)
+
+// syncPauseLockHold 描述了暂停同步后继续持有云端锁的时间，超过该时间后释放云端锁，以便其他设备可以在暂停期间同步。
+var syncPauseLockHold = 5 * time.Minute
+
+// syncPauseState 用于记录同步的暂停状态和当前持有的云端锁。
+type syncPauseState struct {
+	lock *sync.Mutex
+
+	session  *pauseSession // 当前的暂停，未暂停时为 nil
+	deviceID string        // 持有云端锁的设备 ID，未持有云端锁时为空
+	released bool          // 是否因为暂停时间过长释放了云端锁，释放期间不刷新云端锁
+}
+
+// pauseSession 用于描述一次暂停，暂停期间所有在分块边界等待的上传下载任务共享该暂停。
+type pauseSession struct {
+	context map[string]interface{}
+	resumed chan struct{} // 恢复同步时关闭
+
+	releaseOnce   sync.Once
+	reacquireOnce sync.Once
+	cloudLatestID string // 释放云端锁时云端最新索引 ID
+	released      bool   // 是否释放了云端锁
+	err           error  // 恢复同步时重新锁定云端仓库的错误
+}
+
+func newSyncPauseState() *syncPauseState {
+	return &syncPauseState{lock: &sync.Mutex{}}
+}
+
+// PauseSync 用于暂停正在进行的同步。
+//
+// 暂停后上传下载任务会在当前分块完成后等待，已经计算的差异保留在内存中，恢复后继续传输而不需要重新计算。
+// 暂停期间继续刷新云端锁，超过 5 分钟后释放云端锁，恢复时重新锁定云端仓库，如果暂停期间云端仓库被其他设备更新则同步失败并返回 ErrCloudChangedWhilePaused。
+func (repo *Repo) PauseSync(context map[string]interface{}) {
+	state := repo.syncPause
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if nil != state.session {
+		return
+	}
+
+	state.session = &pauseSession{context: context, resumed: make(chan struct{})}
+	eventbus.Publish(EvtSyncPaused, context)
+	logging.LogInfof("sync paused")
+}
+
+// ResumeSync 用于恢复暂停的同步，同步未暂停时返回 ErrSyncNotPaused。
+func (repo *Repo) ResumeSync() (err error) {
+	state := repo.syncPause
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	session := state.session
+	if nil == session {
+		err = ErrSyncNotPaused
+		return
+	}
+
+	state.session = nil
+	close(session.resumed)
+	eventbus.Publish(EvtSyncResumed, session.context)
+	logging.LogInfof("sync resumed")
+	return
+}
+
+// IsSyncPaused 用于判断同步是否已经暂停。
+func (repo *Repo) IsSyncPaused() bool {
+	state := repo.syncPause
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return nil != state.session
+}
+
+// waitIfPaused 用于在分块边界等待恢复同步，暂停时间过长时释放云端锁，恢复时重新锁定云端仓库。
+func (repo *Repo) waitIfPaused() (err error) {
+	state := repo.syncPause
+	state.lock.Lock()
+	session := state.session
+	state.lock.Unlock()
+	if nil == session {
+		return
+	}
+
+	timer := time.NewTimer(syncPauseLockHold)
+	defer timer.Stop()
+	select {
+	case <-session.resumed:
+	case <-timer.C:
+		session.releaseOnce.Do(func() { repo.releaseCloudLockForPause(session) })
+		<-session.resumed
+	}
+
+	session.reacquireOnce.Do(func() {
+		if session.released {
+			session.err = repo.reacquireCloudLockAfterPause(session)
+		}
+	})
+	err = session.err
+	return
+}
+
+// releaseCloudLockForPause 用于在暂停时间过长时释放当前持有的云端锁，并记录释放时云端最新索引 ID。
+func (repo *Repo) releaseCloudLockForPause(session *pauseSession) {
+	state := repo.syncPause
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if "" == state.deviceID {
+		return // 没有持有云端锁的操作不需要释放
+	}
+
+	cloudLatestID, err := repo.cloudLatestID()
+	if nil != err {
+		logging.LogWarnf("get cloud latest before releasing lock failed: %s", err)
+		return
+	}
+	if err = repo.cloud.RemoveObject(lockSyncKey); nil != err {
+		logging.LogWarnf("release cloud lock for paused sync failed: %s", err)
+		return
+	}
+
+	state.released = true
+	session.released = true
+	session.cloudLatestID = cloudLatestID
+	logging.LogInfof("released cloud lock for paused sync")
+}
+
+// reacquireCloudLockAfterPause 用于在恢复同步时重新锁定云端仓库，并确认释放云端锁期间云端仓库没有被更新。
+func (repo *Repo) reacquireCloudLockAfterPause(session *pauseSession) (err error) {
+	state := repo.syncPause
+	state.lock.Lock()
+	deviceID := state.deviceID
+	state.lock.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if err = repo.lockCloud(deviceID, session.context); !errors.Is(err, ErrCloudLocked) {
+			break
+		}
+		incRetry("lock")
+		time.Sleep(5 * time.Second)
+	}
+	if nil != err {
+		logging.LogErrorf("reacquire cloud lock after pause failed: %s", err)
+		return
+	}
+
+	state.lock.Lock()
+	state.released = false
+	state.lock.Unlock()
+	repo.invalidateCloudListing() // 释放云端锁期间其他设备可能修改了云端
+
+	cloudLatestID, err := repo.cloudLatestID()
+	if nil != err {
+		return
+	}
+	if cloudLatestID != session.cloudLatestID {
+		logging.LogWarnf("cloud latest changed from [%s] to [%s] while sync paused", session.cloudLatestID, cloudLatestID)
+		err = ErrCloudChangedWhilePaused
+	}
+	return
+}
+
+// cloudLatestID 用于获取云端最新索引 ID，云端仓库还没有索引时返回空。
+func (repo *Repo) cloudLatestID() (ret string, err error) {
+	data, err := repo.downloadCloudObject("refs/latest")
+	if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		err = nil
+		return
+	}
+	ret = strings.TrimSpace(string(data))
+	return
+}
+
+// setCloudLocked 用于记录当前持有云端锁的设备 ID，解锁时传入空。
+func (repo *Repo) setCloudLocked(deviceID string) {
+	state := repo.syncPause
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.deviceID = deviceID
+	state.released = false
+}
+
+// isCloudLockReleased 用于判断云端锁是否因为暂停同步已经释放，释放期间不刷新云端锁。
+func (repo *Repo) isCloudLockReleased() bool {
+	state := repo.syncPause
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.released
+}
@@ -0,0 +1,275 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+var ErrSyncQueued = errors.New("sync queued") // ErrSyncQueued 描述了离线时同步请求已经加入队列，恢复连接后会自动同步
+
+const (
+	EvtSyncQueued       = "repo.syncQueued"       // EvtSyncQueued 描述了离线时同步请求加入队列的事件，参数为 context 和 *SyncQueueState
+	EvtSyncQueueDrained = "repo.syncQueueDrained" // EvtSyncQueueDrained 描述了恢复连接后队列中的同步请求已经完成的事件，参数为 context 和 *MergeResult
+)
+
+const syncQueueFile = "sync-queue.json" // 离线同步队列文件，位于仓库根目录下
+
+// defaultSyncQueueProbeInterval 为离线时检查是否恢复连接的默认间隔。
+const defaultSyncQueueProbeInterval = 30 * time.Second
+
+var syncQueueWaitGroup = sync.WaitGroup{} // 用于等待后台排空同步队列结束
+
+// SyncQueueState 描述了离线同步队列的状态。
+//
+// 离线期间的多次同步请求会合并为一次同步，恢复连接后只同步一次。
+type SyncQueueState struct {
+	Requests         int      `json:"requests"`         // 离线期间合并的同步请求数，为 0 时队列为空
+	FirstRequested   int64    `json:"firstRequested"`   // 第一次请求同步的时间，毫秒时间戳
+	LastRequested    int64    `json:"lastRequested"`    // 最近一次请求同步的时间，毫秒时间戳
+	PendingSnapshots []string `json:"pendingSnapshots"` // 离线期间创建、尚未同步到云端的本地快照 ID
+	LastError        string   `json:"lastError"`        // 最近一次同步失败的原因
+	Draining         bool     `json:"-"`                // 是否正在后台等待恢复连接后同步
+}
+
+type syncQueue struct {
+	lock     sync.Mutex
+	state    *SyncQueueState // 按需从 syncQueueFile 加载
+	interval time.Duration   // 检查是否恢复连接的间隔，为 0 时使用默认值
+}
+
+// SetSyncQueueProbeInterval 用于设置离线时检查是否恢复连接的间隔 interval，小于等于 0 时使用默认值 30 秒。
+func (repo *Repo) SetSyncQueueProbeInterval(interval time.Duration) {
+	queue := repo.syncQueue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.interval = max(interval, 0)
+}
+
+// GetSyncQueue 用于获取离线同步队列的状态。
+func (repo *Repo) GetSyncQueue() (ret *SyncQueueState) {
+	queue := repo.syncQueue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	state := *repo.loadSyncQueue()
+	state.PendingSnapshots = append([]string{}, state.PendingSnapshots...)
+	ret = &state
+	return
+}
+
+// SyncOrQueue 用于执行同步，离线时将同步请求加入队列并返回包装了原始错误的 ErrSyncQueued，之后在后台定时检查连接，恢复连接后自动同步。
+//
+// 离线期间的多次请求会合并，恢复连接后只同步一次。任何一次同步成功后队列都会被清空。
+func (repo *Repo) SyncOrQueue(context map[string]interface{}) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	mergeResult, trafficStat, err = repo.Sync(context)
+	if !isOfflineErr(err) {
+		return
+	}
+
+	state := repo.enqueueSync(err)
+	logging.LogWarnf("offline, sync queued [requests=%d, pendingSnapshots=%d]: %s", state.Requests, len(state.PendingSnapshots), err)
+	eventbus.Publish(EvtSyncQueued, context, state)
+	repo.drainSyncQueueAsync()
+	err = fmt.Errorf("%w: %w", ErrSyncQueued, err)
+	return
+}
+
+// ResumeSyncQueue 用于在启动后恢复上次退出时尚未完成的离线同步队列，队列为空时不做任何操作。
+func (repo *Repo) ResumeSyncQueue() {
+	if 0 < repo.GetSyncQueue().Requests {
+		repo.drainSyncQueueAsync()
+	}
+}
+
+// enqueueSync 用于将一次因为离线失败的同步请求合并到队列中，并记录尚未同步的本地最新快照。
+func (repo *Repo) enqueueSync(syncErr error) (ret *SyncQueueState) {
+	latestID := ""
+	if latest, err := repo.Latest(); nil == err {
+		latestID = latest.ID
+	}
+
+	queue := repo.syncQueue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	state := repo.loadSyncQueue()
+	now := time.Now().UnixMilli()
+	if 1 > state.Requests {
+		state.FirstRequested = now
+	}
+	state.Requests++
+	state.LastRequested = now
+	state.LastError = syncErr.Error()
+	if "" != latestID && !gulu.Str.Contains(latestID, state.PendingSnapshots) {
+		state.PendingSnapshots = append(state.PendingSnapshots, latestID)
+	}
+	repo.saveSyncQueue()
+
+	copied := *state
+	copied.PendingSnapshots = append([]string{}, state.PendingSnapshots...)
+	ret = &copied
+	return
+}
+
+// clearSyncQueue 用于在同步成功后清空队列。
+func (repo *Repo) clearSyncQueue() {
+	queue := repo.syncQueue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	state := repo.loadSyncQueue()
+	if 1 > state.Requests {
+		return
+	}
+	queue.state = &SyncQueueState{Draining: state.Draining}
+	repo.saveSyncQueue()
+	return
+}
+
+// drainSyncQueueAsync 用于在后台定时检查连接，恢复连接后执行一次同步，已经在后台等待时直接返回。
+func (repo *Repo) drainSyncQueueAsync() {
+	queue := repo.syncQueue
+	queue.lock.Lock()
+	state := repo.loadSyncQueue()
+	if state.Draining {
+		queue.lock.Unlock()
+		return
+	}
+	state.Draining = true
+	interval := queue.interval
+	queue.lock.Unlock()
+	if 1 > interval {
+		interval = defaultSyncQueueProbeInterval
+	}
+
+	syncQueueWaitGroup.Add(1)
+	go func() {
+		defer syncQueueWaitGroup.Done()
+
+		for {
+			time.Sleep(interval)
+			if 1 > repo.GetSyncQueue().Requests {
+				break // 其他同步已经成功
+			}
+			if _, pingErr := repo.cloud.Ping(); nil != pingErr && !errors.Is(pingErr, cloud.ErrUnsupported) {
+				continue
+			}
+
+			context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar}
+			mergeResult, _, err := repo.Sync(context)
+			if nil == err {
+				logging.LogInfof("drained sync queue")
+				eventbus.Publish(EvtSyncQueueDrained, context, mergeResult)
+				break
+			}
+			if isOfflineErr(err) {
+				continue
+			}
+
+			// 恢复连接后同步仍然失败时保留队列，由调用方处理错误后重新同步
+			logging.LogErrorf("drain sync queue failed: %s", err)
+			queue.lock.Lock()
+			repo.loadSyncQueue().LastError = err.Error()
+			repo.saveSyncQueue()
+			queue.lock.Unlock()
+			break
+		}
+
+		queue.lock.Lock()
+		repo.loadSyncQueue().Draining = false
+		queue.lock.Unlock()
+	}()
+}
+
+// isOfflineErr 用于判断同步错误 err 是否是因为无法连接云端存储服务。
+func isOfflineErr(err error) bool {
+	if nil == err {
+		return false
+	}
+	if errors.Is(err, ErrNetworkTimeout) || errors.Is(err, cloud.ErrCloudServiceUnavailable) {
+		return true
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "no such host") ||
+		strings.Contains(msg, "network is unreachable") || strings.Contains(msg, "no route to host")
+}
+
+// loadSyncQueue 用于获取队列状态，首次获取时从 syncQueueFile 加载，调用方需要持有队列锁。
+func (repo *Repo) loadSyncQueue() *SyncQueueState {
+	queue := repo.syncQueue
+	if nil != queue.state {
+		return queue.state
+	}
+
+	queue.state = &SyncQueueState{}
+	data, err := os.ReadFile(filepath.Join(repo.Path, syncQueueFile))
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogWarnf("read sync queue failed: %s", err)
+		}
+		return queue.state
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, queue.state); nil != err {
+		logging.LogWarnf("unmarshal sync queue failed: %s", err)
+		queue.state = &SyncQueueState{}
+	}
+	return queue.state
+}
+
+// saveSyncQueue 用于保存队列状态，队列为空时删除 syncQueueFile，调用方需要持有队列锁。
+func (repo *Repo) saveSyncQueue() {
+	p := filepath.Join(repo.Path, syncQueueFile)
+	state := repo.syncQueue.state
+	if 1 > state.Requests {
+		if err := os.Remove(p); nil != err && !os.IsNotExist(err) {
+			logging.LogWarnf("remove sync queue failed: %s", err)
+		}
+		return
+	}
+
+	data, err := gulu.JSON.MarshalJSON(state)
+	if nil != err {
+		logging.LogWarnf("marshal sync queue failed: %s", err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(p, data, 0644); nil != err {
+		logging.LogWarnf("write sync queue failed: %s", err)
+	}
+}
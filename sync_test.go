@@ -17,9 +17,38 @@
 package dejavu
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/88250/gulu"
+	"github.com/aws/smithy-go"
 	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/encryption"
+	"github.com/siyuan-note/eventbus"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
 )
 
 func TestSync(t *testing.T) {
@@ -46,3 +75,3911 @@ func TestSync(t *testing.T) {
 	_ = mergeResult
 	_ = trafficStat
 }
+
+func TestCheckCloudConnection(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "cloud")
+	if err := os.MkdirAll(endpoint, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:    "test",
+		UserID: "0",
+		Local:  &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+
+	caps, err := repo.CheckCloudConnection()
+	if nil != err {
+		t.Fatalf("check cloud connection failed: %s", err)
+		return
+	}
+	if !caps.Writable || !caps.Listable || cloud.ConsistencyStrong != caps.Consistency {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+		return
+	}
+
+	repo.cloud.GetConf().Local.Endpoint = filepath.Join(testTempPath, "not-exist")
+	if _, err = repo.CheckCloudConnection(); nil == err {
+		t.Fatalf("check cloud connection should fail")
+		return
+	}
+}
+
+func TestClassifyErr(t *testing.T) {
+	if !errors.Is(classifyErr(fmt.Errorf("get object failed: %w", context.DeadlineExceeded)), ErrNetworkTimeout) {
+		t.Fatalf("deadline exceeded should be classified as network timeout")
+		return
+	}
+	if !errors.Is(classifyErr(fmt.Errorf("put object failed: %w", &smithy.GenericAPIError{Code: "InvalidAccessKeyId"})), ErrAuth) {
+		t.Fatalf("invalid access key should be classified as auth error")
+		return
+	}
+	if !errors.Is(classifyErr(&fs.PathError{Op: "Write", Path: "objects/ab/cd", Err: gowebdav.StatusError{Status: 507}}), ErrQuota) {
+		t.Fatalf("insufficient storage should be classified as quota error")
+		return
+	}
+	if errors.Is(classifyErr(errors.New("upload object [objects/40/1507] failed [401]")), ErrAuth) {
+		t.Fatalf("error message should not be classified by text")
+		return
+	}
+	if !errors.Is(ErrCloudStorageSizeExceeded, ErrQuota) || !IsRetryable(classifyErr(context.DeadlineExceeded)) {
+		t.Fatalf("classify errors failed")
+		return
+	}
+
+	lockedErr := classifyErr(&CloudLockedError{Owner: "device", Since: time.Now()})
+	if !errors.Is(lockedErr, ErrCloudLocked) || !IsRetryable(lockedErr) {
+		t.Fatalf("locked error should be retryable")
+		return
+	}
+	if IsRetryable(classifyErr(errors.New("unknown"))) {
+		t.Fatalf("unknown error should not be retryable")
+		return
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	metrics := NewExpvarMetrics("dejavu-test")
+	SetMetricsRecorder(metrics)
+	defer SetMetricsRecorder(nil)
+
+	trafficStat := &TrafficStat{}
+	trafficStat.UploadBytes = 1024
+	mergeResult := &MergeResult{Conflicts: []*entity.File{{}}}
+	observeSync("sync", time.Now().Add(-2*time.Second), mergeResult, trafficStat, nil)
+	observeSync("sync", time.Now(), nil, nil, errors.New("failed"))
+	incRetry("lock")
+
+	if 2 != metrics.Get("sync.count") || 1 != metrics.Get("sync.failed") || 1024 != metrics.Get("sync.upload_bytes") ||
+		1 != metrics.Get("sync.conflicts") || 1 != metrics.Get("retry.lock") {
+		t.Fatalf("unexpected metrics: %s", metrics.vars.String())
+		return
+	}
+
+	// 耗时直方图的桶是累积的
+	if 1 != metrics.Get("sync.duration_bucket.le_1") || 2 != metrics.Get("sync.duration_bucket.le_5") || 2 != metrics.Get("sync.duration_bucket.le_600") || 2 != metrics.Get("sync.duration_bucket.le_+Inf") {
+		t.Fatalf("duration buckets should be cumulative: %s", metrics.vars.String())
+		return
+	}
+}
+
+func TestStructuredLogSyncID(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	buf := &bytes.Buffer{}
+	SetStructuredLogger(NewJSONLogger(buf))
+	defer SetStructuredLogger(nil)
+
+	callerContext := map[string]interface{}{}
+	context := beginSync("sync", callerContext)
+	syncID, _ := context[CtxSyncID].(string)
+	if "" == syncID {
+		t.Fatalf("sync id should be generated")
+		return
+	}
+	if 0 != len(callerContext) {
+		t.Fatalf("caller context should not be modified: %v", callerContext)
+		return
+	}
+	syncLogger(context).Warn("cloud latest changed during sync", "attempt", 1)
+	repo.endSync("sync", time.Now(), context, nil, nil, ErrNetworkTimeout)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if 3 != len(lines) {
+		t.Fatalf("expected 3 log records, got [%d]", len(lines))
+		return
+	}
+	for _, line := range lines {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); nil != err {
+			t.Fatalf("unmarshal log record failed: %s", err)
+			return
+		}
+		if syncID != record[CtxSyncID] {
+			t.Fatalf("log record sync id not match: %s", line)
+			return
+		}
+	}
+}
+
+func TestSyncJournal(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	journal, err := repo.GetSyncJournal(10)
+	if nil != err || 0 != len(journal) {
+		t.Fatalf("journal should be empty: %v", err)
+		return
+	}
+
+	trafficStat := &TrafficStat{}
+	trafficStat.UploadBytes = 1024
+	repo.endSync("sync", time.Now(), beginSync("sync", nil), &MergeResult{}, trafficStat, nil)
+	repo.endSync("upload", time.Now(), beginSync("upload", nil), nil, nil, ErrCloudLocked)
+
+	journal, err = repo.GetSyncJournal(1)
+	if nil != err {
+		t.Fatalf("get sync journal failed: %s", err)
+		return
+	}
+	if 1 != len(journal) || "upload" != journal[0].Kind || journal[0].Succeeded || ErrCloudLocked.Error() != journal[0].Error {
+		t.Fatalf("unexpected latest journal entry: %+v", journal)
+		return
+	}
+
+	journal, err = repo.GetSyncJournal(0)
+	if nil != err {
+		t.Fatalf("get sync journal failed: %s", err)
+		return
+	}
+	if 2 != len(journal) || !journal[1].Succeeded || 1024 != journal[1].UploadBytes || "" == journal[1].SyncID {
+		t.Fatalf("unexpected journal entries: %+v", journal)
+		return
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "conflict-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	absPath := filepath.Join(dataPath, "a.txt")
+	indexVersion := func(content string, updated time.Time) (index *entity.Index, file *entity.File) {
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if err = os.Chtimes(absPath, updated, updated); nil != err {
+			t.Fatalf("change file time failed: %s", err)
+			return
+		}
+		if index, err = repo.Index(content, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		files, getErr := repo.GetFiles(index)
+		if nil != getErr || 1 != len(files) {
+			t.Fatalf("get files failed: %v", getErr)
+			return
+		}
+		file = files[0]
+		return
+	}
+	cloudIndex, cloudFile := indexVersion("cloud version", time.Now().Add(-time.Hour))
+	localIndex, localFile := indexVersion("local", time.Now())
+
+	repo.recordConflicts([]*Conflict{newConflict(localFile.Path, localFile, cloudFile, localIndex, cloudIndex, time.Now())})
+	conflicts, err := repo.GetConflicts()
+	if nil != err || 1 != len(conflicts) || cloudFile.ID != conflicts[0].CloudFileID {
+		t.Fatalf("get conflicts failed: %v", err)
+		return
+	}
+
+	if _, err = repo.ResolveConflict("/not-exist", ConflictChoiceCloud, nil, map[string]interface{}{}); !errors.Is(err, ErrConflictNotFound) {
+		t.Fatalf("resolve should be failed with not found: %v", err)
+		return
+	}
+	index, err := repo.ResolveConflict(localFile.Path, ConflictChoiceCloud, nil, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("resolve conflict failed: %s", err)
+		return
+	}
+	data, err := os.ReadFile(absPath)
+	if nil != err || "cloud version" != string(data) {
+		t.Fatalf("data not match: %s", data)
+		return
+	}
+	if index.ID == localIndex.ID {
+		t.Fatalf("resolution should be recorded in a new snapshot")
+		return
+	}
+	if conflicts, err = repo.GetConflicts(); nil != err || 0 != len(conflicts) {
+		t.Fatalf("conflict should be removed after resolving")
+		return
+	}
+}
+
+func TestConflictMerge(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "conflict-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	sy := func(blocks ...string) string {
+		var children []string
+		for i := 0; i < len(blocks); i += 2 {
+			children = append(children, `{"ID":"`+blocks[i]+`","Type":"NodeParagraph","Properties":{"id":"`+blocks[i]+`"},"Children":[{"Type":"NodeText","Data":"`+blocks[i+1]+`"}]}`)
+		}
+		return `{"ID":"20220101000000-docdocd","Type":"NodeDocument","Properties":{"id":"20220101000000-docdocd"},"Children":[` + strings.Join(children, ",") + `]}`
+	}
+	absPath := filepath.Join(dataPath, "doc.sy")
+	indexVersion := func(content string, updated time.Time) (index *entity.Index, file *entity.File) {
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if err = os.Chtimes(absPath, updated, updated); nil != err {
+			t.Fatalf("change file time failed: %s", err)
+			return
+		}
+		if index, err = repo.Index("", true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		files, getErr := repo.GetFiles(index)
+		if nil != getErr || 1 != len(files) {
+			t.Fatalf("get files failed: %v", getErr)
+			return
+		}
+		file = files[0]
+		return
+	}
+	cloudIndex, cloudFile := indexVersion(sy("20220101000000-bbbbbbb", "cloud", "20220101000000-ddddddd", "only cloud"), time.Now().Add(-time.Hour))
+	merged := sy("20220101000000-bbbbbbb", "local", "20220101000000-ccccccc", "only local")
+	localIndex, localFile := indexVersion(merged, time.Now())
+	repo.recordConflicts([]*Conflict{newConflict(localFile.Path, localFile, cloudFile, localIndex, cloudIndex, time.Now())})
+
+	conflictMerge, err := repo.GetConflictMerge(localFile.Path)
+	if nil != err {
+		t.Fatalf("get conflict merge failed: %s", err)
+		return
+	}
+	ops := map[string]string{}
+	for _, diff := range conflictMerge.Diffs {
+		ops[diff.ID] = diff.Op
+	}
+	if 3 != len(ops) || BlockDiffModified != ops["20220101000000-bbbbbbb"] ||
+		BlockDiffLocalOnly != ops["20220101000000-ccccccc"] || BlockDiffCloudOnly != ops["20220101000000-ddddddd"] {
+		t.Fatalf("unexpected block diffs: %v", ops)
+		return
+	}
+
+	if err = repo.ApplyConflictMerge(localFile.Path, []byte("invalid"), map[string]interface{}{}); nil == err {
+		t.Fatalf("apply invalid merge should be failed")
+		return
+	}
+	if err = repo.ApplyConflictMerge(localFile.Path, []byte(merged), map[string]interface{}{}); nil != err {
+		t.Fatalf("apply conflict merge failed: %s", err)
+		return
+	}
+	if conflicts, _ := repo.GetConflicts(); 0 != len(conflicts) {
+		t.Fatalf("conflict should be removed after applying merge")
+		return
+	}
+}
+
+func TestOffloadChunks(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	newLocal := func(name string) cloud.Cloud {
+		endpoint := filepath.Join(testTempPath, name)
+		if err := os.RemoveAll(endpoint); nil != err {
+			t.Fatalf("remove failed: %s", err)
+		}
+		return cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+			Dir:      "test",
+			UserID:   "0",
+			RepoPath: repo.Path,
+			Local:    &cloud.ConfLocal{Endpoint: endpoint},
+		}})
+	}
+	repo.cloud = newLocal("cloud-primary")
+	secondary := newLocal("cloud-offload")
+	repo.SetOffloadPolicy(&OffloadPolicy{Cloud: secondary, MinFileSize: 1})
+
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	chunkIDs := repo.getChunks(files)
+	if _, err = repo.uploadFileChunks(files, chunkIDs, map[string]interface{}{}); nil != err {
+		t.Fatalf("upload file chunks failed: %s", err)
+		return
+	}
+
+	id := chunkIDs[0]
+	key := path.Join("objects", id[:2], id[2:])
+	if _, err = repo.cloud.DownloadObject(key); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("chunk should not be uploaded to primary cloud: %v", err)
+		return
+	}
+	if _, err = secondary.DownloadObject(key); nil != err {
+		t.Fatalf("chunk should be uploaded to offload cloud: %s", err)
+		return
+	}
+	if _, _, err = repo.downloadCloudChunk(id, 1, 1, map[string]interface{}{}); nil != err {
+		t.Fatalf("download offloaded chunk failed: %s", err)
+		return
+	}
+
+	// 校验云端时转存的分块不视为缺失
+	checkReport, err := repo.computeCloudCheckReport(index, &TrafficStat{m: &sync.Mutex{}})
+	if nil != err {
+		t.Fatalf("compute check report failed: %s", err)
+		return
+	}
+	for _, missingObject := range checkReport.MissingObjects {
+		if strings.ReplaceAll(missingObject, "/", "") == id {
+			t.Fatalf("offloaded chunk [%s] should not be missing", id)
+			return
+		}
+	}
+
+	// 清理时删除次级云端存储服务中未引用的分块
+	stray := util.Hash([]byte("stray"))
+	if _, err = secondary.UploadBytes(path.Join("objects", stray[:2], stray[2:]), []byte("stray"), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	referenced := map[string]bool{}
+	for _, chunkID := range chunkIDs {
+		referenced[chunkID] = true
+	}
+	stat := &entity.PurgeStat{}
+	if err = repo.purgeOffloadObjects(referenced, nil, stat); nil != err {
+		t.Fatalf("purge offloaded objects failed: %s", err)
+		return
+	}
+	if 1 != stat.Objects {
+		t.Fatalf("should purge [1] offloaded object, purged [%d]", stat.Objects)
+		return
+	}
+	if _, err = secondary.DownloadObject(path.Join("objects", stray[:2], stray[2:])); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("unreferenced offloaded chunk should be purged: %v", err)
+		return
+	}
+	if _, err = secondary.DownloadObject(key); nil != err {
+		t.Fatalf("referenced offloaded chunk should be kept: %s", err)
+		return
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "lazy-data")
+	endpoint := filepath.Join(testTempPath, "cloud-lazy")
+	for _, dir := range []string{dataPath, endpoint} {
+		if err = os.RemoveAll(dir); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+	}
+	if err = os.MkdirAll(filepath.Join(dataPath, "assets"), 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	data := bytes.Repeat([]byte("asset"), 1024)
+	absPath := filepath.Join(dataPath, "assets", "video.mp4")
+	if err = os.WriteFile(absPath, data, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "a.txt"), []byte("a"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:    "test",
+		UserID: "0",
+		Local:  &cloud.ConfLocal{Endpoint: endpoint},
+	}}))
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	index, err := repo.Index("lazy", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	if _, err = repo.uploadChunks(repo.getChunks(files), map[string]interface{}{}); nil != err {
+		t.Fatalf("upload chunks failed: %s", err)
+		return
+	}
+
+	// 模拟云端新增的文件：分块仅存在于云端
+	var file *entity.File
+	for _, f := range files {
+		if "/assets/video.mp4" == cleanRelPath(f.Path) {
+			file = f
+		}
+	}
+	for _, chunkID := range file.Chunks {
+		if err = repo.store.Remove(chunkID); nil != err {
+			t.Fatalf("remove chunk failed: %s", err)
+			return
+		}
+	}
+
+	repo.SetLazyPolicy(&LazyPolicy{PathPrefixes: []string{"/assets/"}})
+	if err = repo.restoreFiles(&MergeResult{Upserts: []*entity.File{file}}, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if gulu.File.IsExist(absPath) {
+		t.Fatalf("lazy file should not be checked out")
+		return
+	}
+	placeholders, err := repo.GetPlaceholders()
+	if nil != err || 1 != len(placeholders) || file.ID != placeholders[0].FileID {
+		t.Fatalf("placeholder not recorded: %v", err)
+		return
+	}
+
+	latest, err := repo.Index("placeholder", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if !gulu.Str.Contains(file.ID, latest.Files) {
+		t.Fatalf("placeholder should be kept in index")
+		return
+	}
+
+	if _, err = repo.Materialize(file.Path, map[string]interface{}{}); nil != err {
+		t.Fatalf("materialize failed: %s", err)
+		return
+	}
+	materialized, err := os.ReadFile(absPath)
+	if nil != err || !bytes.Equal(data, materialized) {
+		t.Fatalf("materialized file not match: %v", err)
+		return
+	}
+	if placeholders, _ = repo.GetPlaceholders(); 0 != len(placeholders) {
+		t.Fatalf("placeholder should be removed")
+		return
+	}
+	if _, err = repo.Materialize(file.Path, map[string]interface{}{}); !errors.Is(err, ErrPlaceholderNotFound) {
+		t.Fatalf("materialize again should be failed: %v", err)
+		return
+	}
+}
+
+func TestMigrateCloud(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	newLocal := func(name string) cloud.Cloud {
+		endpoint := filepath.Join(testTempPath, name)
+		if err := os.RemoveAll(endpoint); nil != err {
+			t.Fatalf("remove failed: %s", err)
+		}
+		return cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+			Dir:      "test",
+			UserID:   "0",
+			RepoPath: repo.Path,
+			Local:    &cloud.ConfLocal{Endpoint: endpoint},
+		}})
+	}
+	repo.cloud = newLocal("cloud-migrate-src")
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	dst := newLocal("cloud-migrate-dst")
+	stat, err := repo.MigrateCloud(dst, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("migrate cloud failed: %s", err)
+		return
+	}
+	if 1 > stat.Indexes || 1 > stat.Objects || 0 != stat.Skipped {
+		t.Fatalf("migrate stat not match: %+v", stat)
+		return
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	data, err := dst.DownloadObject("refs/latest")
+	if nil != err || latest.ID != string(data) {
+		t.Fatalf("dst latest not match: %v", err)
+		return
+	}
+
+	// 再次迁移时跳过已经复制的数据对象
+	again, err := repo.MigrateCloud(dst, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("migrate cloud again failed: %s", err)
+		return
+	}
+	if 0 != again.Objects || stat.Objects != again.Skipped {
+		t.Fatalf("migrate again stat not match: %+v", again)
+		return
+	}
+}
+
+func TestReplica(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	newLocal := func(name string) cloud.Cloud {
+		endpoint := filepath.Join(testTempPath, name)
+		if err := os.RemoveAll(endpoint); nil != err {
+			t.Fatalf("remove failed: %s", err)
+		}
+		return cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+			Dir:      "test",
+			UserID:   "0",
+			RepoPath: repo.Path,
+			Local:    &cloud.ConfLocal{Endpoint: endpoint},
+		}})
+	}
+	repo.cloud = newLocal("cloud-replica-primary")
+	replica := newLocal("cloud-replica")
+	repo.SetReplica(replica)
+	defer repo.SetReplica(nil)
+
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	replicaWaitGroup.Wait()
+
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	data, err := replica.DownloadObject("refs/latest")
+	if nil != err || latest.ID != string(data) {
+		t.Fatalf("replica latest not match: %v", err)
+		return
+	}
+	files, err := repo.GetFiles(latest)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	missing, err := replica.GetChunks(append(repo.getChunks(files), latest.Files...))
+	if nil != err || 0 != len(missing) {
+		t.Fatalf("replica objects missing: %v", err)
+		return
+	}
+}
+
+func TestApplyFilesRollback(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "apply-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	write := func(name, content string) {
+		if err = os.MkdirAll(dataPath, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+		}
+		if err = os.WriteFile(filepath.Join(dataPath, name), []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+	}
+	read := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dataPath, name))
+		return string(data)
+	}
+
+	write("a.txt", "old a")
+	write("b.txt", "old b")
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	oldIndex, err := repo.Index("old", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	write("a.txt", "new a")
+	write("c.txt", "new c")
+	if err = os.Remove(filepath.Join(dataPath, "b.txt")); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	newIndex, err := repo.Index("new", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if _, _, err = repo.Checkout(oldIndex.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+
+	oldFiles, err := repo.GetFiles(oldIndex)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	newFiles, err := repo.GetFiles(newIndex)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	upserts, removes := repo.diffUpsertRemove(newFiles, oldFiles, false)
+
+	// 模拟应用了一部分变更后崩溃
+	dir := filepath.Join(repo.Path, "checkout", "crashed")
+	journal := &checkoutJournal{Stage: filepath.Join(dir, "stage"), Backup: filepath.Join(dir, "backup")}
+	if err = repo.checkoutFilesTo(upserts, journal.Stage, map[string]interface{}{}); nil != err {
+		t.Fatalf("stage failed: %s", err)
+		return
+	}
+	for _, file := range upserts {
+		journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: file.Path, Existed: lexists(repo.absPath(file.Path))})
+	}
+	for _, file := range removes {
+		journal.Entries = append(journal.Entries, &checkoutJournalEntry{Path: file.Path, Remove: true, Existed: true})
+	}
+	if err = repo.writeCheckoutJournal(journal); nil != err {
+		t.Fatalf("write journal failed: %s", err)
+		return
+	}
+	for _, entry := range journal.Entries[:2] {
+		if err = repo.applyCheckoutEntry(journal, entry); nil != err {
+			t.Fatalf("apply failed: %s", err)
+			return
+		}
+	}
+
+	if repo, err = NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil); nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if "old a" != read("a.txt") || "old b" != read("b.txt") || gulu.File.IsExist(filepath.Join(dataPath, "c.txt")) {
+		t.Fatalf("unfinished checkout should be rolled back")
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(repo.Path, checkoutJournalFile)) {
+		t.Fatalf("checkout journal should be removed")
+		return
+	}
+
+	if err = repo.applyFiles(upserts, removes, nil, nil, map[string]interface{}{}); nil != err {
+		t.Fatalf("apply files failed: %s", err)
+		return
+	}
+	if "new a" != read("a.txt") || "new c" != read("c.txt") || gulu.File.IsExist(filepath.Join(dataPath, "b.txt")) {
+		t.Fatalf("checkout should be applied")
+		return
+	}
+	if entries, _ := os.ReadDir(filepath.Join(repo.Path, "checkout")); 0 < len(entries) {
+		t.Fatalf("stage and backup dirs should be removed")
+		return
+	}
+
+	// 模拟写入回滚日志前崩溃，暂存文件夹在下次打开仓库时清理
+	stale := filepath.Join(repo.Path, "checkout", "stale", "stage")
+	if err = os.MkdirAll(stale, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(stale, "c.txt"), []byte("staged"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if repo, err = NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil); nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if entries, _ := os.ReadDir(filepath.Join(repo.Path, "checkout")); 0 < len(entries) {
+		t.Fatalf("stale stage dirs should be removed")
+		return
+	}
+	if "new c" != read("c.txt") {
+		t.Fatalf("data should not be changed by stale stage dirs")
+		return
+	}
+}
+
+func TestPreMergeSnapshot(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "pre-merge-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	p := filepath.Join(dataPath, "a.txt")
+	if err = os.WriteFile(p, []byte("cloud"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	cloudIndex, err := repo.Index("cloud", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	cloudFiles, err := repo.GetFiles(cloudIndex)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if err = os.WriteFile(p, []byte("local"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+
+	repo.SetPreMergeSnapshot(true)
+	mergeResult := &MergeResult{Upserts: cloudFiles}
+	if err = repo.restoreFiles(mergeResult, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if data, _ := os.ReadFile(p); "cloud" != string(data) {
+		t.Fatalf("file should be restored")
+		return
+	}
+	if "" == mergeResult.PreMergeIndexID {
+		t.Fatalf("pre-merge snapshot should be created")
+		return
+	}
+	if latest, _ := repo.Latest(); latest.ID != cloudIndex.ID {
+		t.Fatalf("pre-merge snapshot should not become latest")
+		return
+	}
+	if _, err = repo.Purge(); nil != err {
+		t.Fatalf("purge failed: %s", err)
+		return
+	}
+	if !repo.store.indexExist(mergeResult.PreMergeIndexID) {
+		t.Fatalf("pre-merge snapshot should not be purged")
+		return
+	}
+
+	if _, _, err = repo.Checkout(mergeResult.PreMergeIndexID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if data, _ := os.ReadFile(p); "local" != string(data) {
+		t.Fatalf("pre-merge snapshot should be checked out")
+		return
+	}
+}
+
+func TestCloudCheckReport(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "cloud-check")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:      "test",
+		UserID:   "0",
+		RepoPath: repo.Path,
+		Local:    &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	// 模拟上传中断导致云端缺失数据对象
+	missingID := index.Files[0]
+	cloudObject := filepath.Join(endpoint, "test", "objects", missingID[:2], missingID[2:])
+	if err := os.Remove(cloudObject); nil != err {
+		t.Fatalf("remove cloud object failed: %s", err)
+		return
+	}
+
+	report, err := repo.RequestCloudVerify(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("request cloud verify failed: %s", err)
+		return
+	}
+	// 同步时已经计算过一次校验报告
+	if 0 < len(report.MissingObjects) || 1 != report.FixCount || 2 != report.CheckCount {
+		t.Fatalf("unexpected check report [%+v]", report)
+		return
+	}
+	if !gulu.File.IsExist(cloudObject) {
+		t.Fatalf("missing cloud object should be uploaded")
+		return
+	}
+	// 已经尝试修复的校验报告记录在本地，新创建的实例也不会重复修复
+	if reopened := reopenRepo(t); nil == reopened || 1 > reopened.readFixedCheckTime() {
+		t.Fatalf("fixed check time should be persisted")
+		return
+	}
+
+	if report, err = repo.GetCloudCheckReport(); nil != err || 2 != report.CheckCount {
+		t.Fatalf("get cloud check report failed: %v", err)
+		return
+	}
+
+	local := repo.newCloudCheckReport(&entity.CheckReport{MissingObjects: []string{missingID[:2] + "/" + missingID[2:]}})
+	if 1 != len(local.MissingObjects) || !local.MissingObjects[0].Local || missingID != local.MissingObjects[0].ID {
+		t.Fatalf("unexpected missing object [%+v]", local.MissingObjects)
+		return
+	}
+}
+
+func TestListCloudRepos(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "cloud-repos")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:      "test",
+		UserID:   "0",
+		RepoPath: repo.Path,
+		Local:    &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	for _, name := range []string{"b-empty", "a-empty"} {
+		if err := repo.CreateCloudRepo(name); nil != err {
+			t.Fatalf("create cloud repo failed: %s", err)
+			return
+		}
+	}
+
+	repos, total, _, err := repo.ListCloudRepos(&CloudReposQuery{SortBy: CloudReposSortByName, Desc: true, Page: 1, PageSize: 2, WithLatest: true})
+	if nil != err {
+		t.Fatalf("list cloud repos failed: %s", err)
+		return
+	}
+	if 3 != total || 2 != len(repos) || "test" != repos[0].Name || "b-empty" != repos[1].Name {
+		t.Fatalf("unexpected cloud repos [total=%d, repos=%d]", total, len(repos))
+		return
+	}
+	if nil == repos[0].Latest || index.ID != repos[0].Latest.ID || index.SystemID != repos[0].Latest.SystemID {
+		t.Fatalf("unexpected cloud repo latest [%+v]", repos[0].Latest)
+		return
+	}
+	if nil != repos[1].Latest {
+		t.Fatalf("empty cloud repo should not have latest")
+		return
+	}
+
+	repos, _, _, err = repo.ListCloudRepos(&CloudReposQuery{Page: 2, PageSize: 2})
+	if nil != err || 1 != len(repos) || "test" != repos[0].Name || nil != repos[0].Latest {
+		t.Fatalf("unexpected cloud repos page 2: %v", err)
+		return
+	}
+}
+
+func TestRenameDuplicateCloudRepo(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "cloud-rename")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:      "test",
+		UserID:   "0",
+		RepoPath: repo.Path,
+		Local:    &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	if err := repo.RenameCloudRepo("test", "renamed"); nil != err {
+		t.Fatalf("rename cloud repo failed: %s", err)
+		return
+	}
+	if "renamed" != repo.cloud.GetConf().Dir {
+		t.Fatalf("current cloud repo should be switched to the new name")
+		return
+	}
+	if err := repo.DuplicateCloudRepo("renamed", "copy", map[string]interface{}{}); nil != err {
+		t.Fatalf("duplicate cloud repo failed: %s", err)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(endpoint, "copy", lockSyncKey)) || gulu.File.IsExist(filepath.Join(endpoint, "renamed", lockSyncKey)) {
+		t.Fatalf("sync lock should be removed")
+		return
+	}
+	if err := repo.RenameCloudRepo("renamed", "copy"); !errors.Is(err, ErrCloudRepoExists) {
+		t.Fatalf("rename to an existing cloud repo should fail: %v", err)
+		return
+	}
+
+	repos, total, _, err := repo.ListCloudRepos(&CloudReposQuery{WithLatest: true})
+	if nil != err || 2 != total {
+		t.Fatalf("list cloud repos failed: %v", err)
+		return
+	}
+	for _, r := range repos {
+		if nil == r.Latest || index.ID != r.Latest.ID {
+			t.Fatalf("unexpected cloud repo [%s] latest [%+v]", r.Name, r.Latest)
+			return
+		}
+	}
+
+	if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync after rename failed: %s", err)
+		return
+	}
+}
+
+func TestEstimateSyncSize(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "cloud-estimate")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "test",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+
+	estimate, err := repo.EstimateSyncSize(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("estimate sync size failed: %s", err)
+		return
+	}
+	if len(index.Files) != estimate.UploadFileCount || 1 > estimate.UploadChunkCount || 1 > estimate.UploadBytes || estimate.Exceeded {
+		t.Fatalf("unexpected estimate [%+v]", estimate)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(endpoint, "test", "objects")) {
+		t.Fatalf("estimate should not upload objects")
+		return
+	}
+
+	_, trafficStat, err := repo.Sync(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if trafficStat.UploadChunkCount != estimate.UploadChunkCount {
+		t.Fatalf("estimated chunks [%d] mismatch uploaded chunks [%d]", estimate.UploadChunkCount, trafficStat.UploadChunkCount)
+		return
+	}
+
+	if estimate, err = repo.EstimateSyncSize(map[string]interface{}{}); nil != err || 0 != estimate.UploadBytes {
+		t.Fatalf("unexpected estimate after sync [%+v]: %v", estimate, err)
+		return
+	}
+}
+
+func TestMetadataPrivacy(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "cloud-privacy")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:      "test",
+		UserID:   "0",
+		RepoPath: repo.Path,
+		Local:    &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+	repo.SetMetadataPrivacy(true)
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	privateName := repo.PrivateCloudRepoName("test")
+	if gulu.File.IsExist(filepath.Join(endpoint, "test")) || !gulu.File.IsDir(filepath.Join(endpoint, privateName)) {
+		t.Fatalf("cloud repo dir should be hashed")
+		return
+	}
+
+	for _, key := range []string{filepath.Join("indexes", index.ID), "indexes-v2.json"} {
+		data, err := os.ReadFile(filepath.Join(endpoint, privateName, key))
+		if nil != err {
+			t.Fatalf("read cloud object failed: %s", err)
+			return
+		}
+		if data, err = repo.store.compressDecoder.DecodeAll(data, nil); nil != err {
+			t.Fatalf("decompress cloud object failed: %s", err)
+			return
+		}
+		if bytes.Contains(data, []byte(deviceID)) || !bytes.Contains(data, []byte("sealed")) {
+			t.Fatalf("cloud object [%s] should not contain plain system info", key)
+			return
+		}
+	}
+
+	_, cloudLatest, err := repo.downloadCloudLatest(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("download cloud latest failed: %s", err)
+		return
+	}
+	if deviceID != cloudLatest.SystemID || deviceOS != cloudLatest.SystemOS || "" != cloudLatest.Sealed {
+		t.Fatalf("cloud latest system info should be unsealed [%s]", cloudLatest)
+		return
+	}
+
+	logs, _, _, err := repo.GetCloudRepoLogs(1)
+	if nil != err || 1 != len(logs) || deviceID != logs[0].SystemID {
+		t.Fatalf("cloud repo logs should have unsealed system info: %v", err)
+		return
+	}
+
+	repo.SetMetadataPrivacy(false)
+	if "test" != repo.cloud.GetConf().Dir {
+		t.Fatalf("cloud repo dir should be restored")
+		return
+	}
+}
+
+func TestIndexAuthor(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	dataPath := filepath.Join(testTempPath, "author-data")
+	endpoint := filepath.Join(testTempPath, "cloud-author")
+	for _, dir := range []string{dataPath, endpoint} {
+		if err = os.RemoveAll(dir); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+	}
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "a.txt"), []byte("a"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "test",
+		UserID:        "0",
+		AvailableSize: 1 << 30,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint},
+	}}))
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repo.SetAuthor("user-1", "Alice")
+	repo.SetMetadataPrivacy(true)
+	index, err := repo.Index("author", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if "user-1" != index.AuthorID || "Alice" != index.AuthorName {
+		t.Fatalf("index should record author")
+		return
+	}
+	if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(endpoint, repo.PrivateCloudRepoName("test"), "indexes", index.ID))
+	if nil != err {
+		t.Fatalf("read cloud index failed: %s", err)
+		return
+	}
+	if data, err = repo.store.compressDecoder.DecodeAll(data, nil); nil != err || bytes.Contains(data, []byte("Alice")) {
+		t.Fatalf("cloud index should not contain plain author: %v", err)
+		return
+	}
+
+	logs, _, _, err := repo.GetCloudRepoLogs(1)
+	if nil != err || 1 != len(logs) || "user-1" != logs[0].AuthorID || "Alice" != logs[0].AuthorName {
+		t.Fatalf("cloud repo logs should have unsealed author: %v", err)
+		return
+	}
+	logs, _, _, err = repo.GetIndexLogs(1, 10)
+	if nil != err || 1 != len(logs) || "Alice" != logs[0].AuthorName {
+		t.Fatalf("index logs should have author: %v", err)
+		return
+	}
+}
+
+func TestWebDAVTransferCache(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	root := filepath.Join(testTempPath, "webdav")
+	if err := os.RemoveAll(root); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err := os.MkdirAll(root, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+
+	var gets, ranges, gzipped atomic.Int32
+	handler := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if http.MethodGet == r.Method {
+			gets.Add(1)
+			if "" != r.Header.Get("Range") {
+				ranges.Add(1)
+			}
+		}
+		if "PROPFIND" == r.Method && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gzipped.Add(1)
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			defer zw.Close()
+			handler.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, w: zw}, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := gowebdav.NewClient(server.URL, "", "")
+	client.SetTransport(cloud.NewCompressionTransport(nil))
+	repo.cloud = cloud.NewWebDAV(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "webdav-transfer",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		WebDAV:        &cloud.ConfWebDAV{Endpoint: server.URL, Timeout: 30, ConcurrentReqs: 4},
+	}}, client)
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if 1 > gzipped.Load() {
+		t.Fatalf("PROPFIND should negotiate gzip")
+		return
+	}
+
+	// 索引列表未变更时使用本地缓存
+	if _, err := repo.cloud.DownloadObject("indexes-v2.json"); nil != err {
+		t.Fatalf("download indexes failed: %s", err)
+		return
+	}
+	gets.Store(0)
+	data, err := repo.cloud.DownloadObject("indexes-v2.json")
+	if nil != err || 1 > len(data) || 0 != gets.Load() {
+		t.Fatalf("unchanged indexes should be served from cache [gets=%d]: %v", gets.Load(), err)
+		return
+	}
+
+	// 下载中断后使用 Range 请求续传
+	if _, _, err = repo.downloadCloudLatest(map[string]interface{}{}); nil != err {
+		t.Fatalf("download cloud latest failed: %s", err)
+		return
+	}
+	cacheDir := filepath.Join(repo.Path, "cloud-cache", "webdav")
+	entries, err := os.ReadDir(cacheDir)
+	if nil != err {
+		t.Fatalf("read cache dir failed: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		cached := filepath.Join(cacheDir, entry.Name())
+		meta := map[string]interface{}{}
+		metaData, _ := os.ReadFile(cached + ".json")
+		gulu.JSON.UnmarshalJSON(metaData, &meta)
+		meta["complete"] = false
+		metaData, _ = gulu.JSON.MarshalJSON(meta)
+		os.WriteFile(cached+".json", metaData, 0644)
+		full, _ := os.ReadFile(cached)
+		os.WriteFile(cached, full[:len(full)/2], 0644)
+	}
+	clearCache()
+	if _, cloudLatest, downloadErr := repo.downloadCloudLatest(map[string]interface{}{}); nil != downloadErr || index.ID != cloudLatest.ID {
+		t.Fatalf("download cloud latest failed: %v", downloadErr)
+		return
+	}
+	if 1 > ranges.Load() {
+		t.Fatalf("interrupted download should be resumed with range requests")
+		return
+	}
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func TestCloudHTTPConnectionReuse(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	root := filepath.Join(testTempPath, "webdav-pool")
+	if err := os.RemoveAll(root); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err := os.MkdirAll(root, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+
+	var conns, requests atomic.Int32
+	handler := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if http.StateNew == state {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	conf := &cloud.Conf{
+		Dir:           "webdav-pool",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		HTTP:          &cloud.ConfHTTP{MaxIdleConnsPerHost: 8},
+		WebDAV:        &cloud.ConfWebDAV{Endpoint: server.URL, Timeout: 30, ConcurrentReqs: 4},
+	}
+	if cloud.NewHTTPClient(conf).Transport != cloud.NewHTTPClient(conf).Transport {
+		t.Fatalf("clients with the same conf should share the connection pool")
+		return
+	}
+
+	repo.cloud = cloud.NewWebDAV(&cloud.BaseCloud{Conf: conf}, gowebdav.NewClient(server.URL, "", ""))
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if int32(conf.WebDAV.ConcurrentReqs)+1 < conns.Load() || requests.Load() <= conns.Load() {
+		t.Fatalf("connections should be reused [requests=%d, conns=%d]", requests.Load(), conns.Load())
+		return
+	}
+}
+
+func TestCloudHTTPProxyAndRootCAs(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	root := filepath.Join(testTempPath, "webdav-proxy")
+	if err := os.RemoveAll(root); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err := os.MkdirAll(root, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+
+	// 代理直接处理转发过来的请求，端点使用无法解析的域名，只有经过代理时才能同步成功
+	var proxied atomic.Int32
+	handler := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.IsAbs() {
+			proxied.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	endpoint := "http://webdav.invalid/"
+	conf := &cloud.Conf{
+		Dir:           "webdav-proxy",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		HTTP:          &cloud.ConfHTTP{Proxy: proxy.URL},
+		WebDAV:        &cloud.ConfWebDAV{Endpoint: endpoint, Timeout: 30, ConcurrentReqs: 4},
+	}
+	repo.cloud = cloud.NewWebDAV(&cloud.BaseCloud{Conf: conf}, gowebdav.NewClient(endpoint, "", ""))
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync via proxy failed: %s", err)
+		return
+	}
+	if 1 > proxied.Load() {
+		t.Fatalf("requests should be sent via proxy")
+		return
+	}
+
+	// 自签名证书的服务端只有在配置了自定义根证书后才能访问
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	caPath := filepath.Join(testTempPath, "webdav-proxy-ca.pem")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, caData, 0644); nil != err {
+		t.Fatalf("write CA failed: %s", err)
+		return
+	}
+
+	conf = &cloud.Conf{
+		Dir:           "webdav-ca",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		HTTP:          &cloud.ConfHTTP{},
+		WebDAV:        &cloud.ConfWebDAV{Endpoint: server.URL, Timeout: 30, ConcurrentReqs: 4},
+	}
+	repo.cloud = cloud.NewWebDAV(&cloud.BaseCloud{Conf: conf}, gowebdav.NewClient(server.URL, "", ""))
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil == err {
+		t.Fatalf("sync should fail without trusting the server certificate")
+		return
+	}
+
+	conf.HTTP.RootCAs = caPath
+	repo.cloud = cloud.NewWebDAV(&cloud.BaseCloud{Conf: conf}, gowebdav.NewClient(server.URL, "", ""))
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync with custom root CAs failed: %s", err)
+		return
+	}
+}
+
+func TestCloudTimeoutsPerOperationClass(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	root := filepath.Join(testTempPath, "webdav-timeout")
+	if err := os.RemoveAll(root); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err := os.MkdirAll(root, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+
+	handler := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conf := &cloud.Conf{
+		Dir:           "webdav-timeout",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		Timeouts: &cloud.ConfTimeouts{
+			Small: cloud.ConfTimeout{Read: 1, Write: 1},
+			Large: cloud.ConfTimeout{Read: 10, Write: 10},
+		},
+		WebDAV: &cloud.ConfWebDAV{Endpoint: server.URL, Timeout: 1, ConcurrentReqs: 4},
+	}
+	client := gowebdav.NewClient(server.URL, "", "")
+	client.SetTimeout(time.Second)
+	webDAV := cloud.NewWebDAV(&cloud.BaseCloud{Conf: conf}, client)
+
+	data := []byte("slow")
+	if _, err := webDAV.UploadBytes("objects/00/slow", data, true); nil != err {
+		t.Fatalf("upload large object failed: %s", err)
+		return
+	}
+	if ret, err := webDAV.DownloadObject("objects/00/slow"); nil != err || !bytes.Equal(data, ret) {
+		t.Fatalf("download large object failed: %v", err)
+		return
+	}
+	if _, err := webDAV.UploadBytes("refs/slow", data, true); nil == err {
+		t.Fatalf("upload small object should time out")
+		return
+	}
+	if _, err := webDAV.DownloadObject("refs/slow"); nil == err {
+		t.Fatalf("download small object should time out")
+		return
+	}
+}
+
+func TestConcurrencyTuner(t *testing.T) {
+	tuner := newConcurrencyTuner(4)
+	for i := 0; i < 64; i++ {
+		tuner.release(tuner.acquire(), 10*time.Millisecond, nil)
+	}
+	if tuner.max != tuner.Level() {
+		t.Fatalf("concurrency should increase to [%d], got [%d]", tuner.max, tuner.Level())
+		return
+	}
+
+	// 同一轮请求多次失败只减半一次
+	seqs := []uint64{tuner.acquire(), tuner.acquire(), tuner.acquire()}
+	for _, seq := range seqs {
+		tuner.release(seq, time.Second, ErrNetworkTimeout)
+	}
+	if tuner.max/2 != tuner.Level() {
+		t.Fatalf("concurrency should be halved once to [%d], got [%d]", tuner.max/2, tuner.Level())
+		return
+	}
+
+	tuner.release(tuner.acquire(), 3*time.Second, nil)
+	if tuner.max/4 != tuner.Level() {
+		t.Fatalf("slow request should halve concurrency to [%d], got [%d]", tuner.max/4, tuner.Level())
+		return
+	}
+
+	attempts := 0
+	err := tuner.do(func() error {
+		attempts++
+		if 2 > attempts {
+			return context.DeadlineExceeded
+		}
+		return nil
+	})
+	if nil != err || 2 != attempts {
+		t.Fatalf("retryable error should be retried [attempts=%d]: %v", attempts, err)
+		return
+	}
+
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+	endpoint := filepath.Join(testTempPath, "tuner-cloud")
+	if err = os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "tuner",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint, ConcurrentReqs: 2},
+	}})
+	_, trafficStat, err := repo.Sync(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if 2 > trafficStat.UploadConcurrency || 4 < trafficStat.UploadConcurrency {
+		t.Fatalf("unexpected upload concurrency [%d]", trafficStat.UploadConcurrency)
+		return
+	}
+}
+
+func TestPauseResumeSync(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "pause-cloud")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "pause",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint, ConcurrentReqs: 2},
+	}})
+
+	if err := repo.ResumeSync(); !errors.Is(err, ErrSyncNotPaused) {
+		t.Fatalf("resume should fail when sync is not paused: %v", err)
+		return
+	}
+
+	holdBak := syncPauseLockHold
+	syncPauseLockHold = 100 * time.Millisecond
+	defer func() { syncPauseLockHold = holdBak }()
+
+	syncPaused := func() (errCh chan error) {
+		repo.PauseSync(nil)
+		errCh = make(chan error, 1)
+		go func() {
+			_, _, syncErr := repo.Sync(map[string]interface{}{})
+			errCh <- syncErr
+		}()
+		for i := 0; i < 100 && !repo.isCloudLockReleased(); i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return
+	}
+
+	// 暂停期间云端锁释放后其他设备更新了云端仓库，恢复后同步失败
+	errCh := syncPaused()
+	if !repo.isCloudLockReleased() {
+		t.Fatalf("cloud lock should be released while sync paused")
+		return
+	}
+	if _, err := repo.cloud.UploadBytes("refs/latest", []byte("0000000000000000000000000000000000000000"), true); nil != err {
+		t.Fatalf("upload latest failed: %s", err)
+		return
+	}
+	if err := repo.ResumeSync(); nil != err {
+		t.Fatalf("resume sync failed: %s", err)
+		return
+	}
+	if err := <-errCh; !errors.Is(err, ErrCloudChangedWhilePaused) {
+		t.Fatalf("sync should fail with cloud changed error: %v", err)
+		return
+	}
+	if err := repo.cloud.RemoveObject("refs/latest"); nil != err {
+		t.Fatalf("remove latest failed: %s", err)
+		return
+	}
+
+	// 云端仓库未被更新时恢复后继续完成同步
+	errCh = syncPaused()
+	if !repo.IsSyncPaused() {
+		t.Fatalf("sync should be paused")
+		return
+	}
+	if err := repo.ResumeSync(); nil != err {
+		t.Fatalf("resume sync failed: %s", err)
+		return
+	}
+	if err := <-errCh; nil != err {
+		t.Fatalf("sync failed after resume: %s", err)
+		return
+	}
+	if latestID, err := repo.cloudLatestID(); nil != err || "" == latestID {
+		t.Fatalf("cloud latest should be updated: %v", err)
+		return
+	}
+}
+
+func TestUploadPriority(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	asset := &entity.File{Path: "/assets/a.png", Size: 4 * 1024 * 1024, Chunks: []string{"c3", "c1"}}
+	small := &entity.File{Path: "/storage/b.json", Size: 1024, Chunks: []string{"c2", "c1"}}
+	doc := &entity.File{Path: "/20220101/c.sy", Size: 2 * 1024 * 1024, Chunks: []string{"c4"}}
+	files := []*entity.File{asset, small, doc}
+	repo.sortUploadFiles(files)
+	if doc != files[0] || small != files[1] || asset != files[2] {
+		t.Fatalf("unexpected upload order: %s, %s, %s", files[0].Path, files[1].Path, files[2].Path)
+		return
+	}
+
+	chunkIDs, err := repo.localUpsertChunkIDs(files, []string{"c2"})
+	if nil != err {
+		t.Fatalf("get upsert chunk ids failed: %s", err)
+		return
+	}
+	if "c4,c1,c3" != strings.Join(chunkIDs, ",") {
+		t.Fatalf("unexpected upload chunk order: %v", chunkIDs)
+		return
+	}
+
+	repo.SetUploadPriority(func(file *entity.File) int {
+		if strings.HasPrefix(file.Path, "/assets/") {
+			return 0
+		}
+		return 1
+	})
+	defer repo.SetUploadPriority(nil)
+	repo.sortUploadFiles(files)
+	if asset != files[0] || small != files[1] || doc != files[2] {
+		t.Fatalf("unexpected upload order with custom priority: %s, %s, %s", files[0].Path, files[1].Path, files[2].Path)
+		return
+	}
+}
+
+func TestUploadObjectsBatch(t *testing.T) {
+	if _, err := (&cloud.BaseCloud{}).UploadObjects(nil, false); !errors.Is(err, cloud.ErrUnsupported) {
+		t.Fatalf("base cloud should not support batch upload: %v", err)
+		return
+	}
+
+	root := filepath.Join(testTempPath, "webdav-batch")
+	repoPath := filepath.Join(testTempPath, "webdav-batch-repo")
+	for _, dir := range []string{root, repoPath} {
+		if err := os.RemoveAll(dir); nil != err {
+			t.Fatalf("remove failed: %s", err)
+			return
+		}
+		if err := os.MkdirAll(dir, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+	}
+
+	var filePaths []string
+	for i := 0; i < 32; i++ {
+		filePath := fmt.Sprintf("objects/%02x/%038x", i%2, i)
+		absPath := filepath.Join(repoPath, filePath)
+		if err := os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err := os.WriteFile(absPath, []byte(filePath), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		filePaths = append(filePaths, filePath)
+	}
+
+	var propfinds atomic.Int32
+	handler := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "PROPFIND" == r.Method {
+			propfinds.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conf := &cloud.Conf{
+		Dir:      "webdav-batch",
+		UserID:   "0",
+		RepoPath: repoPath,
+		WebDAV:   &cloud.ConfWebDAV{Endpoint: server.URL, Timeout: 30, ConcurrentReqs: 4},
+	}
+	webDAV := cloud.NewWebDAV(&cloud.BaseCloud{Conf: conf}, gowebdav.NewClient(server.URL, "", ""))
+	length, err := webDAV.UploadObjects(filePaths, false)
+	if nil != err {
+		t.Fatalf("upload objects failed: %s", err)
+		return
+	}
+
+	var expected int64
+	for _, filePath := range filePaths {
+		expected += int64(len(filePath))
+		data, readErr := os.ReadFile(filepath.Join(root, "webdav-batch", "siyuan", "repo", filePath))
+		if nil != readErr || filePath != string(data) {
+			t.Fatalf("object [%s] not uploaded: %v", filePath, readErr)
+			return
+		}
+	}
+	if expected != length {
+		t.Fatalf("expected upload length [%d], got [%d]", expected, length)
+		return
+	}
+	if 8 < propfinds.Load() {
+		t.Fatalf("parent folders should not be checked for every object, got [%d] PROPFIND requests", propfinds.Load())
+		return
+	}
+}
+
+func TestVerifyDownloadedObjects(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "verify-cloud")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "verify",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	files, err := repo.getFiles(index.Files)
+	if nil != err || 1 > len(files) || 1 > len(files[0].Chunks) {
+		t.Fatalf("get files failed: %v", err)
+		return
+	}
+	file, chunkID := files[0], files[0].Chunks[0]
+
+	// 用正确编码但是内容不匹配的数据覆盖云端对象，模拟云端返回了错误的内容
+	overwrite := func(id string, data []byte) (key string) {
+		key = path.Join("objects", id[:2], id[2:])
+		encoded, encodeErr := repo.store.encodeData(id, data)
+		if nil != encodeErr {
+			t.Fatalf("encode data failed: %s", encodeErr)
+		}
+		if _, uploadErr := repo.cloud.UploadBytes(key, encoded, true); nil != uploadErr {
+			t.Fatalf("upload object failed: %s", uploadErr)
+		}
+		return
+	}
+
+	data := []byte("not the chunk content")
+	key := overwrite(chunkID, data)
+	_, _, err = repo.downloadCloudChunk(chunkID, 1, 1, map[string]interface{}{})
+	corruptedErr := &CloudObjectCorruptedError{}
+	if !errors.Is(err, ErrCloudObjectCorrupted) || !errors.As(err, &corruptedErr) || key != corruptedErr.Key || util.Hash(data) != corruptedErr.Actual {
+		t.Fatalf("corrupted chunk should be detected: %v", err)
+		return
+	}
+
+	other := entity.NewFile("/other", 1, time.Now().UnixMilli())
+	data, err = entity.MarshalFile(other, repo.store.Format)
+	if nil != err {
+		t.Fatalf("marshal file failed: %s", err)
+		return
+	}
+	key = overwrite(file.ID, data)
+	_, _, err = repo.downloadCloudFile(file.ID, 1, 1, map[string]interface{}{})
+	if !errors.As(err, &corruptedErr) || key != corruptedErr.Key || other.ID != corruptedErr.Actual {
+		t.Fatalf("corrupted file should be detected: %v", err)
+		return
+	}
+}
+
+func TestQuarantineCorruptedObjects(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	endpoint := filepath.Join(testTempPath, "quarantine-cloud")
+	if err := os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "quarantine",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1024 * 1024 * 1024,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	corrupt := func(id string) {
+		_, file := repo.store.AbsPath(id)
+		if err := os.WriteFile(file, bytes.Repeat([]byte("x"), 64), 0644); nil != err {
+			t.Fatalf("write corrupted object failed: %s", err)
+		}
+	}
+
+	// 损坏的文件对象不是必需的，索引时隔离后重新索引该文件
+	fileID := index.Files[0]
+	fileCache.Del(fileID)
+	corrupt(fileID)
+	if err := os.RemoveAll(filepath.Join(repo.Path, "full-latest.json")); nil != err {
+		t.Fatalf("remove full latest failed: %s", err)
+		return
+	}
+	if _, err := repo.Index("after corrupted", true, map[string]interface{}{}); nil != err {
+		t.Fatalf("index should not fail with corrupted file object: %s", err)
+		return
+	}
+	if _, err := repo.store.GetFile(fileID); nil != err {
+		t.Fatalf("file object should be indexed again: %s", err)
+		return
+	}
+	if !gulu.File.IsExist(filepath.Join(repo.store.quarantineDir(), fileID)) {
+		t.Fatalf("corrupted file object should be quarantined")
+		return
+	}
+
+	file, err := repo.store.GetFile(fileID)
+	if nil != err {
+		t.Fatalf("get file failed: %s", err)
+		return
+	}
+	chunkID := file.Chunks[0]
+	corrupt(chunkID)
+	if _, err = repo.store.GetChunk(chunkID); !errors.Is(err, ErrLocalCorrupt) {
+		t.Fatalf("get corrupted chunk should fail: %v", err)
+		return
+	}
+	if _, err = repo.store.Stat(chunkID); !os.IsNotExist(err) {
+		t.Fatalf("corrupted chunk should be moved out of objects: %v", err)
+		return
+	}
+
+	queue, err := repo.GetRepairQueue()
+	if nil != err || 2 != len(queue) || fileID != queue[0].ID || chunkID != queue[1].ID {
+		t.Fatalf("unexpected repair queue: %v", err)
+		return
+	}
+
+	repaired, err := repo.RepairQuarantined(map[string]interface{}{})
+	if nil != err || 2 != repaired {
+		t.Fatalf("repair quarantined objects failed [repaired=%d]: %v", repaired, err)
+		return
+	}
+	if _, err = repo.store.GetChunk(chunkID); nil != err {
+		t.Fatalf("get repaired chunk failed: %s", err)
+		return
+	}
+	if queue, err = repo.GetRepairQueue(); nil != err || 0 != len(queue) {
+		t.Fatalf("repair queue should be empty: %v", err)
+		return
+	}
+}
+
+func TestBenchmarkCloud(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	repo, err := NewRepo(testDataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if _, err = repo.BenchmarkCloud(map[string]interface{}{}); !errors.Is(err, cloud.ErrUnsupported) {
+		t.Fatalf("benchmark without cloud should be unsupported: %v", err)
+		return
+	}
+
+	endpoint := filepath.Join(testTempPath, "benchmark-cloud")
+	if err = os.RemoveAll(endpoint); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, Local: &cloud.ConfLocal{Endpoint: endpoint}}})
+	report, err := repo.BenchmarkCloud(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("benchmark failed: %s", err)
+		return
+	}
+	if len(DefaultBenchmarkClasses) != len(report.Results) {
+		t.Fatalf("expected [%d] results, got [%d]", len(DefaultBenchmarkClasses), len(report.Results))
+		return
+	}
+	for _, result := range report.Results {
+		for _, stat := range []*BenchmarkStat{result.Upload, result.Download} {
+			if 0 != stat.Errors || result.Count != stat.Count || int64(result.Count)*result.Size != stat.Bytes || 0 >= stat.Throughput || stat.LatencyMax < stat.LatencyP50 {
+				t.Fatalf("unexpected benchmark stat of [%s]: %+v", result.Name, stat)
+				return
+			}
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(endpoint, "test", "benchmark"), func(path string, d fs.DirEntry, walkErr error) error {
+		if nil == walkErr && !d.IsDir() {
+			return fmt.Errorf("benchmark object [%s] should be removed", path)
+		}
+		return walkErr
+	})
+	if nil != err {
+		t.Fatalf("walk benchmark objects failed: %s", err)
+		return
+	}
+}
+
+func TestMockCloud(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || latest.ID != string(data) {
+		t.Fatalf("cloud latest should be [%s]: %v", latest.ID, downloadErr)
+		return
+	}
+	if 1 > mock.Requests(cloud.MockOpUpload) {
+		t.Fatalf("sync should upload objects")
+		return
+	}
+
+	mock.SetFaults(&cloud.MockFaults{StaleRefs: time.Hour})
+	if _, err = mock.UploadBytes("refs/latest", []byte("new"), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || latest.ID != string(data) {
+		t.Fatalf("stale ref should be returned: %v", downloadErr)
+		return
+	}
+	if caps, capsErr := mock.Capabilities(); nil != capsErr || cloud.ConsistencyEventual != caps.Consistency {
+		t.Fatalf("mock with stale refs should be eventually consistent: %v", capsErr)
+		return
+	}
+	mock.SetFaults(nil)
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || "new" != string(data) {
+		t.Fatalf("updated ref should be returned: %v", downloadErr)
+		return
+	}
+	if _, err = mock.UploadBytes("refs/latest", []byte(latest.ID), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+
+	mock.SetFaults(&cloud.MockFaults{ErrorRate: 1})
+	if _, _, err = repo.Sync(map[string]interface{}{}); !errors.Is(err, cloud.ErrCloudServiceUnavailable) {
+		t.Fatalf("sync should fail with injected error: %v", err)
+		return
+	}
+
+	injected := errors.New("injected")
+	mock.SetFaults(&cloud.MockFaults{Latency: 10 * time.Millisecond, Inject: func(op, key string) error {
+		if cloud.MockOpDownload == op && "refs/latest" == key {
+			return injected
+		}
+		return nil
+	}})
+	start := time.Now()
+	if _, err = mock.DownloadObject("refs/latest"); !errors.Is(err, injected) || 10*time.Millisecond > time.Since(start) {
+		t.Fatalf("download should fail with injected error after latency: %v", err)
+		return
+	}
+
+	other, err := cloud.ForRepo(mock, "other")
+	if nil != err {
+		t.Fatalf("for repo failed: %s", err)
+		return
+	}
+	if _, err = other.UploadBytes("refs/latest", []byte("other"), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	mock.SetFaults(nil)
+	if repos, _, reposErr := mock.GetRepos(); nil != reposErr || 2 != len(repos) || "other" != repos[0].Name || "test" != repos[1].Name {
+		t.Fatalf("repos should be shared between mock instances: %v", reposErr)
+		return
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+
+	killed := errors.New("killed")
+	var points []string
+	pointsLock := sync.Mutex{}
+	repo.SetFaultInjector(FaultInjectorFunc(func(point string, n int) error {
+		pointsLock.Lock()
+		points = append(points, point)
+		pointsLock.Unlock()
+		if FaultBeforeUpdateCloudLatest == point {
+			return killed
+		}
+		return nil
+	}))
+	if _, _, err := repo.Sync(map[string]interface{}{}); !errors.Is(err, killed) {
+		t.Fatalf("sync should be killed before updating cloud latest: %v", err)
+		return
+	}
+	if !gulu.Str.Contains(FaultAfterUploadChunk, points) || gulu.Str.Contains(FaultAfterUpdateCloudLatest, points) {
+		t.Fatalf("unexpected fault points %v", points)
+		return
+	}
+	if _, err := mock.DownloadObject("refs/latest"); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("cloud latest should not be updated: %v", err)
+		return
+	}
+
+	repo.SetFaultInjector(nil)
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync after fault failed: %s", err)
+		return
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || latest.ID != string(data) {
+		t.Fatalf("cloud latest should be [%s] after recovery: %v", latest.ID, downloadErr)
+		return
+	}
+}
+
+func TestUpdateCloudLatestCAS(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "cas-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+
+	syncVersion := func(name, content string, updated time.Time) (latest *entity.Index) {
+		absPath := filepath.Join(dataPath, name)
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if err = os.Chtimes(absPath, updated, updated); nil != err {
+			t.Fatalf("change file time failed: %s", err)
+			return
+		}
+		if _, err = repo.Index(content, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+			t.Fatalf("sync failed: %s", err)
+			return
+		}
+		if latest, err = repo.Latest(); nil != err {
+			t.Fatalf("get latest failed: %s", err)
+		}
+		return
+	}
+	first := syncVersion("a.txt", "first", time.Now().Add(-2*time.Hour))
+	second := syncVersion("b.txt", "second", time.Now().Add(-time.Hour))
+	if nil == first || nil == second {
+		return
+	}
+
+	// 模拟其他设备在本次同步期间更新了云端 refs/latest
+	var updates int
+	repo.SetFaultInjector(FaultInjectorFunc(func(point string, n int) error {
+		if FaultBeforeUpdateCloudLatest != point {
+			return nil
+		}
+		if updates++; 1 == updates {
+			_, uploadErr := mock.UploadBytes("refs/latest", []byte(first.ID), true)
+			return uploadErr
+		}
+		return nil
+	}))
+	third := syncVersion("c.txt", "third", time.Now())
+	if nil == third {
+		return
+	}
+	if 2 != updates {
+		t.Fatalf("sync should update cloud latest again after conflict, updated [%d] times", updates)
+		return
+	}
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || third.ID != string(data) {
+		t.Fatalf("cloud latest should be [%s]: %v", third.ID, downloadErr)
+		return
+	}
+
+	// 云端 refs/latest 不是预期的索引时不能覆盖
+	if _, err = mock.UploadBytes("refs/latest", []byte(first.ID), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	if _, err = repo.updateCloudLatest(third.ID, map[string]interface{}{}); !errors.Is(err, ErrCloudLatestChanged) {
+		t.Fatalf("update cloud latest should fail with changed cloud latest: %v", err)
+		return
+	}
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || first.ID != string(data) {
+		t.Fatalf("cloud latest should not be overwritten: %v", downloadErr)
+		return
+	}
+	if _, err = repo.updateCloudLatest(first.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("update cloud latest failed: %s", err)
+		return
+	}
+
+	// 存储服务不支持条件写入时回退到检查后写入
+	repo.SetFaultInjector(nil)
+	repo.cloud = &unconditionalCloud{Mock: mock}
+	fourth := syncVersion("d.txt", "fourth", time.Now().Add(time.Hour))
+	if nil == fourth {
+		return
+	}
+	if data, downloadErr := mock.DownloadObject("refs/latest"); nil != downloadErr || fourth.ID != string(data) {
+		t.Fatalf("cloud latest should be [%s]: %v", fourth.ID, downloadErr)
+		return
+	}
+	if _, err = mock.UploadBytes("refs/latest", []byte(first.ID), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	if _, err = repo.updateCloudLatest(fourth.ID, map[string]interface{}{}); !errors.Is(err, ErrCloudLatestChanged) {
+		t.Fatalf("update cloud latest should fail with changed cloud latest: %v", err)
+		return
+	}
+}
+
+// unconditionalCloud 模拟不支持条件写入的 S3 兼容存储服务。
+type unconditionalCloud struct {
+	*cloud.Mock
+}
+
+func (c *unconditionalCloud) UploadBytesIfMatch(filePath string, data []byte, etag string) (int64, error) {
+	return 0, cloud.ErrConditionalWriteUnsupported
+}
+
+func TestMergeBases(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "merge-bases-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	indexVersion := func(name, content string, updated time.Time) (index *entity.Index, files []*entity.File) {
+		absPath := filepath.Join(dataPath, name)
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if err = os.Chtimes(absPath, updated, updated); nil != err {
+			t.Fatalf("change file time failed: %s", err)
+			return
+		}
+		if index, err = repo.Index(content, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		if files, err = repo.GetFiles(index); nil != err {
+			t.Fatalf("get files failed: %s", err)
+		}
+		return
+	}
+	indexVersion("a.txt", "a", time.Now().Add(-2*time.Hour))
+	synced, syncedFiles := indexVersion("b.txt", "b", time.Now().Add(-2*time.Hour))
+	if nil == synced {
+		return
+	}
+	if err = repo.UpdateLatestSync(synced); nil != err {
+		t.Fatalf("update latest sync failed: %s", err)
+		return
+	}
+
+	// 模拟同步中途出错：云端的 a.txt 变更和 b.txt 删除已经应用到数据文件夹，但是同步点没有更新
+	_, files := indexVersion("a.txt", "cloud a", time.Now().Add(-time.Hour))
+	if err = os.Remove(filepath.Join(dataPath, "b.txt")); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+		return
+	}
+	latest, err := repo.Index("apply cloud", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	latestFiles, err := repo.GetFiles(latest)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	cloudA, removedB := repo.getFile(files, &entity.File{Path: "/a.txt"}), repo.getFile(syncedFiles, &entity.File{Path: "/b.txt"})
+	if nil == cloudA || nil == removedB {
+		t.Fatalf("files not found")
+		return
+	}
+
+	upserts, removes := repo.diffUpsertRemove(latestFiles, repo.mergeBaseFiles(synced, syncedFiles), false)
+	if 1 != len(upserts) || 1 != len(removes) {
+		t.Fatalf("cloud changes should be local changes without merge bases, upserts [%d], removes [%d]", len(upserts), len(removes))
+		return
+	}
+
+	repo.recordMergeBases([]*entity.File{cloudA}, []*entity.File{removedB})
+	upserts, removes = repo.diffUpsertRemove(latestFiles, repo.mergeBaseFiles(synced, syncedFiles), false)
+	if 0 != len(upserts) || 0 != len(removes) {
+		t.Fatalf("applied cloud changes should not be local changes, upserts [%d], removes [%d]", len(upserts), len(removes))
+		return
+	}
+
+	if err = repo.UpdateLatestSync(latest); nil != err {
+		t.Fatalf("update latest sync failed: %s", err)
+		return
+	}
+	if bases := repo.readMergeBases(); nil == bases || latest.ID != bases.SyncID || 0 != len(bases.Files) {
+		t.Fatalf("merge bases should be reset after updating latest sync")
+		return
+	}
+}
+
+func TestMoveDetection(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(t.TempDir(), "move-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+
+	from, to := filepath.Join(dataPath, "a.txt"), filepath.Join(dataPath, "dir", "b.txt")
+	updated := time.Now().Add(-time.Hour)
+	if err = os.WriteFile(from, []byte("moved content"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = os.Chtimes(from, updated, updated); nil != err {
+		t.Fatalf("change file time failed: %s", err)
+		return
+	}
+	before, err := repo.Index("before move", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(to), 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.Rename(from, to); nil != err {
+		t.Fatalf("rename failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dataPath, "c.txt"), []byte("added content"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	after, err := repo.Index("after move", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	diff, err := repo.DiffIndex(after.ID, before.ID)
+	if nil != err {
+		t.Fatalf("diff index failed: %s", err)
+		return
+	}
+	if 1 != len(diff.Moves) || "/a.txt" != diff.Moves[0].From.Path || "/dir/b.txt" != diff.Moves[0].To.Path || 1 != len(diff.AddsLeft) || 0 != len(diff.RemovesRight) {
+		t.Fatalf("unexpected diff moves [%d], adds [%d], removes [%d]", len(diff.Moves), len(diff.AddsLeft), len(diff.RemovesRight))
+		return
+	}
+
+	// 还原到移动前的状态，然后将云端变更应用到数据文件夹
+	if err = os.Rename(to, from); nil != err {
+		t.Fatalf("rename failed: %s", err)
+		return
+	}
+	if err = os.Remove(filepath.Join(dataPath, "c.txt")); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+		return
+	}
+	mergeResult := &MergeResult{Upserts: append(diff.AddsLeft, diff.Moves[0].To), Removes: []*entity.File{diff.Moves[0].From}}
+	if err = repo.restoreFiles(mergeResult, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if 1 != len(mergeResult.Moves) || 1 != len(mergeResult.Upserts) || 0 != len(mergeResult.Removes) {
+		t.Fatalf("unexpected merge moves [%d], upserts [%d], removes [%d]", len(mergeResult.Moves), len(mergeResult.Upserts), len(mergeResult.Removes))
+		return
+	}
+	if gulu.File.IsExist(from) {
+		t.Fatalf("moved file should be removed from [%s]", from)
+		return
+	}
+	data, err := os.ReadFile(to)
+	if nil != err || "moved content" != string(data) {
+		t.Fatalf("moved file content mismatch: %v", err)
+		return
+	}
+	if info, statErr := os.Stat(to); nil != statErr || info.ModTime().Unix() != diff.Moves[0].To.Updated/1000 {
+		t.Fatalf("moved file time mismatch: %v", statErr)
+		return
+	}
+
+	// 移动后的数据文件夹和移动后的索引一致
+	reindexed, err := repo.Index("reindex", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if diff, err = repo.DiffIndex(reindexed.ID, after.ID); nil != err || 0 != len(diff.AddsLeft)+len(diff.UpdatesLeft)+len(diff.RemovesRight)+len(diff.Moves) {
+		t.Fatalf("data should match the index after move: %v", err)
+		return
+	}
+}
+
+func TestDirOps(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "dir-ops-data")
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	for _, p := range []string{"nb/a.sy", "nb/b.sy", "nb/sub/c.sy", "keep/d.sy", "keep/e.sy", "keep/bar"} {
+		absPath := filepath.Join(dataPath, p)
+		if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(absPath, []byte(p), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+	before, err := repo.Index("before", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if err = os.Rename(filepath.Join(dataPath, "nb"), filepath.Join(dataPath, "nb2")); nil != err {
+		t.Fatalf("rename failed: %s", err)
+		return
+	}
+	after, err := repo.Index("after", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	diff, err := repo.DiffIndex(after.ID, before.ID)
+	if nil != err || 3 != len(diff.Moves) {
+		t.Fatalf("diff index failed: %v", err)
+		return
+	}
+	if err = os.Rename(filepath.Join(dataPath, "nb2"), filepath.Join(dataPath, "nb")); nil != err {
+		t.Fatalf("rename failed: %s", err)
+		return
+	}
+
+	// 整个目录移动
+	mergeResult := &MergeResult{Upserts: movesTo(diff.Moves), Removes: movesFrom(diff.Moves)}
+	if err = repo.restoreFiles(mergeResult, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if 1 != len(mergeResult.DirOps) || "/nb" != mergeResult.DirOps[0].Path || "/nb2" != mergeResult.DirOps[0].To || 3 != mergeResult.DirOps[0].Count ||
+		0 != len(mergeResult.Moves) || 0 != len(mergeResult.Removes) {
+		t.Fatalf("dir move should be detected, dir ops [%d], moves [%d]", len(mergeResult.DirOps), len(mergeResult.Moves))
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(dataPath, "nb")) || !gulu.File.IsExist(filepath.Join(dataPath, "nb2", "sub", "c.sy")) {
+		t.Fatalf("dir should be moved")
+		return
+	}
+
+	// 目录下还有其他文件时逐个文件删除
+	afterFiles, err := repo.GetFiles(after)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	var keepRemoves, nbRemoves []*entity.File
+	for _, file := range afterFiles {
+		if strings.HasPrefix(file.Path, "/keep/") {
+			keepRemoves = append(keepRemoves, file)
+		} else if strings.HasPrefix(file.Path, "/nb2/") {
+			nbRemoves = append(nbRemoves, file)
+		}
+	}
+	mergeResult = &MergeResult{Removes: keepRemoves}
+	if err = repo.restoreFiles(mergeResult, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if 0 != len(mergeResult.DirOps) || 2 != len(mergeResult.Removes) || !gulu.File.IsExist(filepath.Join(dataPath, "keep", "bar")) {
+		t.Fatalf("dir with other files should not be removed as a whole")
+		return
+	}
+
+	// 整个目录删除
+	mergeResult = &MergeResult{Removes: nbRemoves}
+	if err = repo.restoreFiles(mergeResult, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if 1 != len(mergeResult.DirOps) || "" != mergeResult.DirOps[0].To || 3 != mergeResult.DirOps[0].Count || 0 != len(mergeResult.Removes) {
+		t.Fatalf("dir remove should be detected, dir ops [%d], removes [%d]", len(mergeResult.DirOps), len(mergeResult.Removes))
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(dataPath, "nb2")) {
+		t.Fatalf("dir should be removed")
+		return
+	}
+}
+
+func TestTrash(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "trash-data")
+	if err = os.MkdirAll(filepath.Join(dataPath, "dir"), 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	repo.SetTrashRetention(time.Hour)
+	for _, p := range []string{"a.txt", "dir/b.txt"} {
+		if err = os.WriteFile(filepath.Join(dataPath, p), []byte(p), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+	index, err := repo.Index("trash", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err || 2 != len(files) {
+		t.Fatalf("get files failed: %v", err)
+		return
+	}
+
+	if err = repo.restoreFiles(&MergeResult{Removes: files}, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(dataPath, "a.txt")) {
+		t.Fatalf("removed file should not exist")
+		return
+	}
+	trash, err := repo.GetTrash()
+	if nil != err || 2 != len(trash) {
+		t.Fatalf("removed files should be moved to trash: %v", err)
+		return
+	}
+
+	var entry *TrashEntry
+	for _, e := range trash {
+		if "/dir/b.txt" == e.Path {
+			entry = e
+		}
+	}
+	if nil == entry {
+		t.Fatalf("trash entry not found")
+		return
+	}
+	if err = repo.RestoreTrash(entry.Batch, entry.Path); nil != err {
+		t.Fatalf("restore trash failed: %s", err)
+		return
+	}
+	if data, readErr := os.ReadFile(filepath.Join(dataPath, "dir", "b.txt")); nil != readErr || "dir/b.txt" != string(data) {
+		t.Fatalf("restored file content mismatch: %v", readErr)
+		return
+	}
+	if err = repo.RestoreTrash(entry.Batch, entry.Path); !errors.Is(err, ErrTrashNotFound) {
+		t.Fatalf("restore trash twice should fail: %v", err)
+		return
+	}
+
+	// 超过保留时长的批次会被清理
+	trashPath := filepath.Join(repo.Path, trashDir)
+	if err = os.Rename(filepath.Join(trashPath, entry.Batch), filepath.Join(trashPath, "2000-01-01-000000-expired")); nil != err {
+		t.Fatalf("rename trash batch failed: %s", err)
+		return
+	}
+	repo.purgeTrash()
+	if trash, err = repo.GetTrash(); nil != err || 0 != len(trash) {
+		t.Fatalf("expired trash should be purged: %v", err)
+		return
+	}
+}
+
+func TestCloudListingCache(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	if _, err := mock.UploadBytes("refs/latest-1-"+strings.Repeat("a", 40), []byte(strings.Repeat("a", 40)), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+
+	context := map[string]interface{}{}
+	if err := repo.tryLockCloud(repo.DeviceID, context); nil != err {
+		t.Fatalf("lock cloud failed: %s", err)
+		return
+	}
+	lists := mock.Requests(cloud.MockOpList)
+	if id, maxSeqNum, _ := repo.getSeqNumLatest(); strings.Repeat("a", 40) != id || 1 != maxSeqNum {
+		t.Fatalf("unexpected seq num latest [%s, %d]", id, maxSeqNum)
+		return
+	}
+	key := "refs/latest-2-" + strings.Repeat("b", 40)
+	if _, err := mock.UploadBytes(key, []byte(strings.Repeat("b", 40)), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	repo.updateCloudListing(key, 40, false)
+	if id, maxSeqNum, _ := repo.getSeqNumLatest(); strings.Repeat("b", 40) != id || 2 != maxSeqNum {
+		t.Fatalf("unexpected seq num latest [%s, %d]", id, maxSeqNum)
+		return
+	}
+	if 1 != mock.Requests(cloud.MockOpList)-lists {
+		t.Fatalf("refs should be listed once while holding cloud lock, got [%d]", mock.Requests(cloud.MockOpList)-lists)
+		return
+	}
+	repo.unlockCloud(context)
+
+	// 其他设备更新云端后重新加锁时需要重新列举
+	if _, err := mock.UploadBytes("refs/latest-3-"+strings.Repeat("c", 40), []byte(strings.Repeat("c", 40)), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	if err := repo.tryLockCloud(repo.DeviceID, context); nil != err {
+		t.Fatalf("lock cloud failed: %s", err)
+		return
+	}
+	defer repo.unlockCloud(context)
+	if id, maxSeqNum, _ := repo.getSeqNumLatest(); strings.Repeat("c", 40) != id || 3 != maxSeqNum {
+		t.Fatalf("unexpected seq num latest [%s, %d]", id, maxSeqNum)
+		return
+	}
+}
+
+func TestSyncAPIOpsAndCost(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	_, trafficStat, err := repo.Sync(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if nil == trafficStat.APIOps || 1 > trafficStat.APIOps.Put || 1 > trafficStat.APIOps.Get || 1 > trafficStat.APIOps.Delete {
+		t.Fatalf("api ops should be counted: %+v", trafficStat.APIOps)
+		return
+	}
+	if total := mock.GetAPIOps().Total(); trafficStat.APIOps.Total() != total {
+		t.Fatalf("api ops [%d] should match mock requests [%d]", trafficStat.APIOps.Total(), total)
+		return
+	}
+
+	journal, err := repo.GetSyncJournal(1)
+	if nil != err || 1 != len(journal) || nil == journal[0].APIOps || trafficStat.APIOps.Put != journal[0].APIOps.Put {
+		t.Fatalf("api ops should be journaled: %v", err)
+		return
+	}
+
+	estimate, err := repo.EstimateMonthlyCost(nil, 7, 1<<30)
+	if nil != err {
+		t.Fatalf("estimate monthly cost failed: %s", err)
+		return
+	}
+	if 1 != estimate.Syncs || 1 != estimate.Days || 30*trafficStat.APIOps.Put != estimate.MonthlyOps.Put {
+		t.Fatalf("unexpected estimate: %+v", estimate)
+		return
+	}
+	if DefaultCloudPricing.StoragePerGBMonth != estimate.StorageCost || estimate.Total <= estimate.StorageCost {
+		t.Fatalf("unexpected estimate cost: %+v", estimate)
+		return
+	}
+}
+
+func TestRangeDownload(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	key := "objects/00/" + strings.Repeat("0", 38)
+	if _, err := mock.UploadBytes(key, data, true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+
+	repo.SetRangeDownload(16)
+	downloads := mock.Requests(cloud.MockOpDownload)
+	downloaded, err := repo.downloadCloudData(key)
+	if nil != err || !bytes.Equal(data, downloaded) {
+		t.Fatalf("range download mismatch: %v", err)
+		return
+	}
+	if 7 != mock.Requests(cloud.MockOpDownload)-downloads {
+		t.Fatalf("object should be downloaded in [7] ranges, got [%d]", mock.Requests(cloud.MockOpDownload)-downloads)
+		return
+	}
+	if _, err = repo.downloadCloudData("objects/00/" + strings.Repeat("1", 38)); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("not found error expected: %v", err)
+		return
+	}
+
+	// 可变对象可能在分段之间被覆盖，不分段下载
+	if _, err = mock.UploadBytes("indexes-v2.json", data, true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	downloads = mock.Requests(cloud.MockOpDownload)
+	if downloaded, err = repo.downloadCloudData("indexes-v2.json"); nil != err || !bytes.Equal(data, downloaded) || 1 != mock.Requests(cloud.MockOpDownload)-downloads {
+		t.Fatalf("mutable object should not be range downloaded: %v", err)
+		return
+	}
+
+	repo.SetRangeDownload(0)
+	downloads = mock.Requests(cloud.MockOpDownload)
+	if downloaded, err = repo.downloadCloudData(key); nil != err || !bytes.Equal(data, downloaded) || 1 != mock.Requests(cloud.MockOpDownload)-downloads {
+		t.Fatalf("plain download expected: %v", err)
+		return
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "prefetch-data")
+	if err = os.RemoveAll(dataPath); nil != err {
+		t.Fatalf("remove failed: %s", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Join(dataPath, "assets"), 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	absPath := filepath.Join(dataPath, "assets", "video.mp4")
+	if err = os.WriteFile(absPath, bytes.Repeat([]byte("asset"), 1024), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	index, err := repo.Index("prefetch", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err || 1 != len(files) {
+		t.Fatalf("get files failed: %v", err)
+		return
+	}
+	file := files[0]
+	if _, err = repo.uploadChunks(file.Chunks, map[string]interface{}{}); nil != err {
+		t.Fatalf("upload chunks failed: %s", err)
+		return
+	}
+
+	// 模拟云端新增的文件：分块仅存在于云端
+	for _, chunkID := range file.Chunks {
+		if err = repo.store.Remove(chunkID); nil != err {
+			t.Fatalf("remove chunk failed: %s", err)
+			return
+		}
+	}
+	repo.SetLazyPolicy(&LazyPolicy{PathPrefixes: []string{"/assets/"}})
+	if err = repo.restoreFiles(&MergeResult{Upserts: []*entity.File{file}}, map[string]interface{}{}); nil != err {
+		t.Fatalf("restore files failed: %s", err)
+		return
+	}
+
+	metered := true
+	repo.SetPrefetchPolicy(&PrefetchPolicy{PathPrefixes: []string{"/assets/"}, Metered: func() bool { return metered }})
+	stat, err := repo.Prefetch(map[string]interface{}{})
+	if nil != err || !stat.Stopped || 0 != stat.Chunks {
+		t.Fatalf("prefetch should stop on metered network: %v", err)
+		return
+	}
+
+	metered = false
+	if stat, err = repo.Prefetch(map[string]interface{}{}); nil != err || 1 != stat.Files || len(file.Chunks) != stat.Chunks {
+		t.Fatalf("prefetch failed: %v", err)
+		return
+	}
+	if missing, _ := repo.localNotFoundChunks(file.Chunks); 0 != len(missing) {
+		t.Fatalf("chunks should be prefetched")
+		return
+	}
+
+	downloads := mock.Requests(cloud.MockOpDownload)
+	if _, err = repo.Materialize("/assets/video.mp4", map[string]interface{}{}); nil != err {
+		t.Fatalf("materialize failed: %s", err)
+		return
+	}
+	if downloads != mock.Requests(cloud.MockOpDownload) || !gulu.File.IsExist(absPath) {
+		t.Fatalf("materialize should not download prefetched chunks")
+		return
+	}
+}
+
+func TestSyncConflictDetectedEvent(t *testing.T) {
+	clearTestdata(t)
+
+	repoB, err := prepareSyncConflict(t, "conflict-event")
+	if nil != err {
+		t.Fatalf("prepare sync conflict failed: %s", err)
+		return
+	}
+
+	var events []*ConflictEvent
+	var eventContext map[string]interface{}
+	eventbus.Subscribe(EvtSyncConflictDetected, func(context map[string]interface{}, evt *ConflictEvent) {
+		events = append(events, evt)
+		eventContext = context
+	})
+
+	context := map[string]interface{}{CtxSyncID: "conflict-event"}
+	mergeResult, _, err := repoB.Sync(context)
+	if nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if 1 != len(mergeResult.Conflicts) || 1 != len(events) {
+		t.Fatalf("one conflict event expected, got [%d] conflicts and [%d] events", len(mergeResult.Conflicts), len(events))
+		return
+	}
+	evt := events[0]
+	if "/a.txt" != evt.Path || "" == evt.LocalFileID || mergeResult.Conflicts[0].ID != evt.CloudFileID || 1 > evt.LocalUpdated || 1 > evt.CloudUpdated {
+		t.Fatalf("unexpected conflict event: %+v", evt)
+		return
+	}
+	if "conflict-event" != eventContext[CtxSyncID] {
+		t.Fatalf("conflict event should carry sync context")
+		return
+	}
+	if "conflict-event-a" != evt.CloudSystemID || "conflict-event-a" != evt.CloudSystemName {
+		t.Fatalf("conflict event should carry the device of cloud latest: %+v", evt)
+		return
+	}
+}
+
+// prepareSyncConflict 用于准备两个设备同时修改 /a.txt 的场景，返回的设备 B 同步时会产生冲突。
+func prepareSyncConflict(t *testing.T, name string) (repoB *Repo, err error) {
+	endpoint := t.TempDir()
+	repoA, dataA := newSyncTestDevice(t, endpoint, name+"-a")
+	repoB, dataB := newSyncTestDevice(t, endpoint, name+"-b")
+	pathA, pathB := filepath.Join(dataA, "a.txt"), filepath.Join(dataB, "a.txt")
+	updated := time.Now().Add(-time.Minute)
+	writeSync := func(repo *Repo, absPath, content string) {
+		if err = os.WriteFile(absPath, []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		updated = updated.Add(time.Second)
+		if err = os.Chtimes(absPath, updated, updated); nil != err {
+			t.Fatalf("change file time failed: %s", err)
+			return
+		}
+		if _, err = repo.Index(content, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+			t.Fatalf("sync failed: %s", err)
+			return
+		}
+	}
+
+	writeSync(repoA, pathA, "base")
+	writeSync(repoB, filepath.Join(filepath.Dir(pathB), "b.txt"), "b")
+	writeSync(repoA, pathA, "changed on a")
+	if err = os.WriteFile(pathB, []byte("changed on b"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err = os.Chtimes(pathB, updated.Add(time.Second), updated.Add(time.Second)); nil != err {
+		t.Fatalf("change file time failed: %s", err)
+		return
+	}
+	_, err = repoB.Index("b", true, map[string]interface{}{})
+	return
+}
+
+// recordingHistorySink 用于测试记录写入的冲突历史。
+type recordingHistorySink struct {
+	paths []string
+	data  []string
+}
+
+func (sink *recordingHistorySink) Accept(file *entity.File) bool {
+	return true
+}
+
+func (sink *recordingHistorySink) Write(now time.Time, file *entity.File, absPath string) error {
+	data, err := os.ReadFile(absPath)
+	if nil != err {
+		return err
+	}
+	sink.paths = append(sink.paths, file.Path)
+	sink.data = append(sink.data, string(data))
+	return nil
+}
+
+func TestHistorySink(t *testing.T) {
+	clearTestdata(t)
+
+	repoB, err := prepareSyncConflict(t, "history-sink")
+	if nil != err {
+		t.Fatalf("prepare sync conflict failed: %s", err)
+		return
+	}
+	sink := &recordingHistorySink{}
+	repoB.SetHistorySink(&MaxSizeHistorySink{Sink: sink, MaxSize: 1})
+	if _, _, err = repoB.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if 0 != len(sink.paths) {
+		t.Fatalf("files larger than max size should be skipped")
+		return
+	}
+
+	if repoB, err = prepareSyncConflict(t, "history-sink"); nil != err {
+		t.Fatalf("prepare sync conflict failed: %s", err)
+		return
+	}
+	repoB.SetHistorySink(sink)
+	histories, _ := os.ReadDir(repoB.HistoryPath)
+	mergeResult, _, err := repoB.Sync(map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if 1 != len(mergeResult.Conflicts) || 1 != len(sink.paths) || "/a.txt" != sink.paths[0] || "changed on a" != sink.data[0] {
+		t.Fatalf("conflict history should be written to sink: %v", sink.paths)
+		return
+	}
+	if entries, _ := os.ReadDir(repoB.HistoryPath); len(histories) != len(entries) {
+		t.Fatalf("history path should not be used with custom sink")
+		return
+	}
+}
+
+func TestRevokeDevice(t *testing.T) {
+	clearTestdata(t)
+
+	repoB, err := prepareSyncConflict(t, "revoke")
+	if nil != err {
+		t.Fatalf("prepare failed: %s", err)
+		return
+	}
+	if _, err = repoB.RegisterDevice("b", "fingerprint-b", map[string]interface{}{}); nil != err {
+		t.Fatalf("register device failed: %s", err)
+		return
+	}
+
+	repoC, dataPath := newSyncTestDevice(t, repoB.cloud.GetConf().Local.Endpoint, "revoke-c")
+	if err = os.WriteFile(filepath.Join(dataPath, "c.txt"), []byte("c"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if _, err = repoC.Index("c", true, map[string]interface{}{}); nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	if err = repoC.RevokeDevice("revoke-c", map[string]interface{}{}); !errors.Is(err, ErrRevokeCurrentDevice) {
+		t.Fatalf("unexpected err: %v", err)
+		return
+	}
+	if err = repoC.RevokeDevice("unknown", map[string]interface{}{}); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("unexpected err: %v", err)
+		return
+	}
+	if err = repoC.RevokeDevice("revoke-b", map[string]interface{}{}); nil != err {
+		t.Fatalf("revoke device failed: %s", err)
+		return
+	}
+	devices, err := repoC.GetDevices()
+	if nil != err || 1 != len(devices) || "fingerprint-b" != devices[0].Fingerprint || 1 > devices[0].Revoked {
+		t.Fatalf("unexpected devices: %v", err)
+		return
+	}
+
+	if _, _, err = repoB.Sync(map[string]interface{}{}); !errors.Is(err, ErrDeviceRevoked) {
+		t.Fatalf("sync of revoked device should fail: %v", err)
+		return
+	}
+	if _, err = repoB.RegisterDevice("b", "fingerprint-b", map[string]interface{}{}); !errors.Is(err, ErrDeviceRevoked) {
+		t.Fatalf("register of revoked device should fail: %v", err)
+		return
+	}
+
+	// 云端最新索引由设备 revoke-a 上传，模拟设备 revoke-a 被吊销后继续上传
+	devices = append(devices, &Device{ID: "revoke-a", Name: "revoke-a", Registered: 1, Revoked: 1})
+	if err = repoC.putCloudDevices(devices); nil != err {
+		t.Fatalf("put devices failed: %s", err)
+		return
+	}
+	var flagged string
+	eventbus.Subscribe(EvtCloudLatestFromRevokedDevice, func(context map[string]interface{}, device *Device) {
+		if nil != context["revokeTest"] {
+			flagged = device.ID
+		}
+	})
+	if _, _, err = repoC.Sync(map[string]interface{}{"revokeTest": true}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if "revoke-a" != flagged {
+		t.Fatalf("revoked uploader should be flagged")
+		return
+	}
+}
+
+func TestLockFreeSync(t *testing.T) {
+	clearTestdata(t)
+
+	var err error
+	endpoint := t.TempDir()
+	newDevice := func(device string) (repo *Repo, dataPath string) {
+		repo, dataPath = newSyncTestDevice(t, endpoint, device)
+		if err = repo.SetLockFreeSync(true); nil != err {
+			t.Fatalf("set lock free sync failed: %s", err)
+		}
+		return
+	}
+	writeIndex := func(repo *Repo, dataPath, name string) {
+		if err = os.WriteFile(filepath.Join(dataPath, name), []byte(name), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if _, err = repo.Index(name, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+		}
+	}
+
+	repoA, pathA := newDevice("lock-free-a")
+	repoB, pathB := newDevice("lock-free-b")
+	if t.Failed() {
+		return
+	}
+	writeIndex(repoA, pathA, "a.txt")
+	if _, _, err = repoA.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	writeIndex(repoB, pathB, "b.txt")
+	if _, _, err = repoB.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	// 设备 B 上传索引后、更新 refs/latest 前，设备 A 同时完成一次同步
+	writeIndex(repoA, pathA, "a2.txt")
+	writeIndex(repoB, pathB, "b2.txt")
+	if t.Failed() {
+		return
+	}
+	var syncErr error
+	locked := false
+	leaseOwner := ""
+	repoB.SetFaultInjector(FaultInjectorFunc(func(point string, n int) error {
+		if FaultBeforeUpdateCloudLatest == point && 1 == n {
+			locked = gulu.File.IsExist(filepath.Join(endpoint, "test", lockSyncKey))
+			leaseOwner, _, _ = repoA.activeSyncLease()
+			_, _, syncErr = repoA.sync(map[string]interface{}{})
+		}
+		return nil
+	}))
+	if _, _, err = repoB.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	repoB.SetFaultInjector(nil)
+	if nil != syncErr || locked {
+		t.Fatalf("concurrent sync of device A failed [locked=%v]: %v", locked, syncErr)
+		return
+	}
+	if "lock-free-b" != leaseOwner {
+		t.Fatalf("device B should hold a sync lease while syncing, got [%s]", leaseOwner)
+		return
+	}
+	if err = repoA.waitLockFreeSyncs(); nil != err {
+		t.Fatalf("sync lease of device B should be removed after sync: %s", err)
+		return
+	}
+	if !gulu.File.IsExist(filepath.Join(pathB, "a2.txt")) {
+		t.Fatalf("device B should rebase onto the update of device A")
+		return
+	}
+
+	if _, _, err = repoA.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	for _, name := range []string{"a.txt", "b.txt", "a2.txt", "b2.txt"} {
+		if !gulu.File.IsExist(filepath.Join(pathA, name)) || !gulu.File.IsExist(filepath.Join(pathB, name)) {
+			t.Fatalf("file [%s] should be synced to both devices", name)
+			return
+		}
+	}
+	latestA, err := repoA.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	latestB, err := repoB.Latest()
+	if nil != err || latestA.ID != latestB.ID {
+		t.Fatalf("devices should converge to the same latest: %v", err)
+		return
+	}
+}
+
+func TestSyncOrQueue(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	repo.SetSyncQueueProbeInterval(10 * time.Millisecond)
+
+	var offline atomic.Bool
+	offline.Store(true)
+	mock.SetFaults(&cloud.MockFaults{Inject: func(op, key string) error {
+		if offline.Load() {
+			return cloud.ErrCloudNetworkTimeout
+		}
+		return nil
+	}})
+	var drained atomic.Bool
+	eventbus.Subscribe(EvtSyncQueueDrained, func(context map[string]interface{}, mergeResult *MergeResult) {
+		drained.Store(true)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := repo.SyncOrQueue(map[string]interface{}{}); !errors.Is(err, ErrSyncQueued) || !errors.Is(err, ErrNetworkTimeout) {
+			t.Fatalf("sync should be queued: %v", err)
+			return
+		}
+	}
+	state := repo.GetSyncQueue()
+	if 2 != state.Requests || 1 != len(state.PendingSnapshots) || index.ID != state.PendingSnapshots[0] || "" == state.LastError {
+		t.Fatalf("unexpected sync queue: %+v", state)
+		return
+	}
+	if !gulu.File.IsExist(filepath.Join(repo.Path, syncQueueFile)) {
+		t.Fatalf("sync queue should be persisted")
+		return
+	}
+
+	offline.Store(false)
+	syncQueueWaitGroup.Wait()
+	if state = repo.GetSyncQueue(); 0 != state.Requests || state.Draining || !drained.Load() {
+		t.Fatalf("sync queue should be drained: %+v", state)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(repo.Path, syncQueueFile)) {
+		t.Fatalf("drained sync queue should be removed")
+		return
+	}
+	if data, err := mock.DownloadObject("refs/latest"); nil != err || index.ID != string(data) {
+		t.Fatalf("queued sync should upload latest: %v", err)
+		return
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	clearTestdata(t)
+
+	var err error
+	endpoint := t.TempDir()
+	writeSync := func(repo *Repo, dataPath, name string, data []byte) (mergeResult *MergeResult) {
+		if err = os.WriteFile(filepath.Join(dataPath, name), data, 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if _, err = repo.Index(name, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		if mergeResult, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+			t.Fatalf("sync failed: %s", err)
+		}
+		return
+	}
+
+	repoA, pathA := newSyncTestDevice(t, endpoint, "network-a")
+	repoB, pathB := newSyncTestDevice(t, endpoint, "network-b")
+	if t.Failed() {
+		return
+	}
+	writeSync(repoA, pathA, "a.txt", []byte("a"))
+	writeSync(repoB, pathB, "b.txt", []byte("b"))
+	writeSync(repoA, pathA, "a2.txt", []byte("a2"))
+	if t.Failed() {
+		return
+	}
+
+	metered := atomic.Bool{}
+	metered.Store(true)
+	repoB.SetNetworkPolicy(MeteredUploadLimit(metered.Load, 1024))
+	big := make([]byte, 64*1024)
+	rand.New(rand.NewSource(391)).Read(big)
+	mergeResult := writeSync(repoB, pathB, "big.bin", big)
+	if t.Failed() {
+		return
+	}
+	if !mergeResult.UploadDeferred || !gulu.File.IsExist(filepath.Join(pathB, "a2.txt")) {
+		t.Fatalf("upload should be deferred while cloud changes are merged")
+		return
+	}
+	cloudLatest, err := repoA.cloudLatestID()
+	if nil != err {
+		t.Fatalf("get cloud latest failed: %s", err)
+		return
+	}
+	latestA, _ := repoA.Latest()
+	if latestA.ID != cloudLatest {
+		t.Fatalf("cloud latest should not be updated while upload is deferred")
+		return
+	}
+	if _, err = repoB.SyncUpload(map[string]interface{}{}); !errors.Is(err, ErrUploadDeferred) {
+		t.Fatalf("upload should be deferred: %v", err)
+		return
+	}
+
+	metered.Store(false)
+	if mergeResult, _, err = repoB.Sync(map[string]interface{}{}); nil != err || mergeResult.UploadDeferred {
+		t.Fatalf("sync failed: %v", err)
+		return
+	}
+	if _, _, err = repoA.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	if data, readErr := os.ReadFile(filepath.Join(pathA, "big.bin")); nil != readErr || !bytes.Equal(big, data) {
+		t.Fatalf("deferred upload should be synced later: %v", readErr)
+		return
+	}
+}
+
+func TestSyncRepos(t *testing.T) {
+	clearTestdata(t)
+
+	var err error
+	var repos []*Repo
+	for _, name := range []string{"workspace-a", "workspace-b", "workspace-c"} {
+		repo, dataPath := newSyncTestDevice(t, t.TempDir(), name)
+		if err = os.WriteFile(filepath.Join(dataPath, name+".txt"), []byte(name), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		if _, err = repo.Index(name, true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		repos = append(repos, repo)
+	}
+
+	limiter := NewRateLimiter(0, 1000)
+	results := SyncRepos(append(repos, repos[0]), limiter, 2, map[string]interface{}{})
+	if 4 != len(results) {
+		t.Fatalf("unexpected results count [%d]", len(results))
+		return
+	}
+	for i, result := range results[:3] {
+		if nil != result.Err {
+			t.Fatalf("sync repo [%d] failed: %s", i, result.Err)
+			return
+		}
+		if repos[i] != result.Repo || limiter != result.Repo.rateLimiter {
+			t.Fatalf("unexpected result of repo [%d]", i)
+			return
+		}
+		latest, getErr := repos[i].Latest()
+		if nil != getErr {
+			t.Fatalf("get latest failed: %s", getErr)
+			return
+		}
+		data, getErr := repos[i].cloud.DownloadObject("refs/latest")
+		if nil != getErr || latest.ID != string(data) {
+			t.Fatalf("cloud latest of repo [%d] not updated: %v", i, getErr)
+			return
+		}
+	}
+	if !errors.Is(results[3].Err, ErrDuplicateSyncRepo) {
+		t.Fatalf("duplicate repo should be rejected: %v", results[3].Err)
+		return
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1024, 0)
+	start := time.Now()
+	limiter.wait(1, 1024) // 突发额度内不等待
+	if elapsed := time.Since(start); 500*time.Millisecond < elapsed {
+		t.Fatalf("burst should not wait, elapsed [%s]", elapsed)
+		return
+	}
+	limiter.wait(1, 512)
+	if elapsed := time.Since(start); 400*time.Millisecond > elapsed {
+		t.Fatalf("limiter should wait after burst, elapsed [%s]", elapsed)
+		return
+	}
+}
+
+func TestSyncNotifier(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+	if t.Failed() {
+		return
+	}
+	endpoint := filepath.Join(testTempPath, "notify-cloud")
+	if err := os.MkdirAll(endpoint, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	repo.cloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "test",
+		UserID:        "0",
+		RepoPath:      repo.Path,
+		AvailableSize: 1 << 30,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint},
+	}})
+
+	received := make(chan *SyncNotification, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := &SyncNotification{}
+		if err := json.NewDecoder(r.Body).Decode(notification); nil != err || "secret" != r.Header.Get("X-Token") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- notification
+	}))
+	defer server.Close()
+
+	repo.SetSyncNotifier(&WebhookSyncNotifier{URL: server.URL, Header: map[string]string{"X-Token": "secret"}})
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	select {
+	case notification := <-received:
+		if "sync" != notification.Kind || latest.ID != notification.IndexID || "" == notification.SyncID || 1 > notification.UploadBytes {
+			t.Fatalf("unexpected notification: %+v", notification)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not called")
+		return
+	}
+
+	notified := make(chan *SyncNotification, 2)
+	repo.SetSyncNotifier(FuncSyncNotifier(func(notification *SyncNotification) error {
+		notified <- notification
+		return nil
+	}))
+	repo.endSync("upload", time.Now(), beginSync("upload", nil), nil, nil, ErrCloudLocked)
+	repo.endSync("download", time.Now(), beginSync("download", nil), &MergeResult{}, nil, nil)
+	select {
+	case notification := <-notified:
+		if "download" != notification.Kind || notification.DataChanged {
+			t.Fatalf("unexpected notification: %+v", notification)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("callback not called")
+		return
+	}
+	if 0 != len(notified) {
+		t.Fatalf("failed sync should not notify")
+		return
+	}
+
+	failing := &WebhookSyncNotifier{URL: server.URL}
+	if err = failing.Notify(&SyncNotification{}); nil == err {
+		t.Fatalf("webhook error response should fail")
+		return
+	}
+}
+
+func TestTempManager(t *testing.T) {
+	clearTestdata(t)
+
+	tempPath := filepath.Join(testDataCheckoutPath, "temp")
+	syncTempPath := filepath.Join(tempPath, "repo", "sync")
+	for _, dir := range []string{"aborted", "conflicts"} {
+		if err := os.MkdirAll(filepath.Join(syncTempPath, dir, "2006-01-02-150405"), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+	}
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+	repo, err := NewRepo(testDataPath, testRepoPath, testHistoryPath, tempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if entries, _ := os.ReadDir(syncTempPath); 0 != len(entries) {
+		t.Fatalf("aborted sync temp dirs should be cleaned on open, got [%d]", len(entries))
+		return
+	}
+
+	// 超出大小上限时从最旧的遗留文件夹开始清理
+	repo.TempManager().SetMaxSize(10)
+	for i, name := range []string{"old", "new"} {
+		p := filepath.Join(syncTempPath, name, "file")
+		if err = os.MkdirAll(filepath.Dir(p), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+		if err = os.WriteFile(p, []byte("12345678"), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+		modTime := time.Now().Add(time.Duration(i-2) * time.Hour)
+		if err = os.Chtimes(filepath.Dir(p), modTime, modTime); nil != err {
+			t.Fatalf("chtimes failed: %s", err)
+			return
+		}
+	}
+
+	context := beginSync("sync", nil)
+	conflicts := repo.syncTemp(context, "conflicts")
+	if !strings.HasPrefix(conflicts, filepath.Join(syncTempPath, context[CtxSyncID].(string))) {
+		t.Fatalf("sync temp dir should be namespaced by sync id, got [%s]", conflicts)
+		return
+	}
+	if gulu.File.IsExist(filepath.Join(syncTempPath, "old")) || !gulu.File.IsExist(filepath.Join(syncTempPath, "new")) {
+		t.Fatalf("oldest temp dir should be removed to enforce max size")
+		return
+	}
+	if err = os.MkdirAll(conflicts, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(conflicts, "conflict.sy"), []byte("conflict"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	repo.TempManager().Clean()
+	if !gulu.File.IsExist(conflicts) {
+		t.Fatalf("active sync temp dir should not be cleaned")
+		return
+	}
+
+	// 同一临时文件夹上新打开的仓库不会清理其他实例正在使用的子文件夹
+	if _, err = NewRepo(testDataPath, testRepoPath, testHistoryPath, tempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil); nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	if !gulu.File.IsExist(conflicts) {
+		t.Fatalf("sync temp dir of another instance should not be cleaned")
+		return
+	}
+	repo.TempManager().SetMaxSize(0)
+
+	repo.endSync("sync", time.Now(), context, nil, nil, ErrNetworkTimeout)
+	if gulu.File.IsExist(filepath.Dir(conflicts)) {
+		t.Fatalf("sync temp dir should be cleaned after sync")
+		return
+	}
+}
+
+// archivedCloud 模拟位于归档存储层的对象，请求恢复后需要检查两次才能下载。
+type archivedCloud struct {
+	cloud.Cloud
+	archived  map[string]bool
+	restoring map[string]int
+	lock      sync.Mutex
+}
+
+func (c *archivedCloud) DownloadObject(filePath string) ([]byte, error) {
+	c.lock.Lock()
+	archived := c.archived[filePath]
+	c.lock.Unlock()
+	if archived {
+		return nil, cloud.ErrObjectArchived
+	}
+	return c.Cloud.DownloadObject(filePath)
+}
+
+func (c *archivedCloud) RestoreObject(filePath, tier string, days int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.restoring[filePath]; !ok {
+		c.restoring[filePath] = 2
+	}
+	return nil
+}
+
+func (c *archivedCloud) GetRestoreStatus(filePath string) (*cloud.RestoreStatus, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.archived[filePath] {
+		return &cloud.RestoreStatus{Ready: true}, nil
+	}
+	n, ok := c.restoring[filePath]
+	if !ok {
+		return &cloud.RestoreStatus{Archived: true}, nil
+	}
+	if 1 >= n {
+		delete(c.archived, filePath)
+		return &cloud.RestoreStatus{Archived: true, Ready: true}, nil
+	}
+	c.restoring[filePath] = n - 1
+	return &cloud.RestoreStatus{Archived: true, InProgress: true}, nil
+}
+
+func TestColdStorageRestore(t *testing.T) {
+	clearTestdata(t)
+	repo, _ := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	repo.cloud = mock
+	id := strings.Repeat("0", 40)
+	if err := repo.RequestRestore([]string{id}, cloud.RestoreTierBulk); !errors.Is(err, cloud.ErrUnsupported) {
+		t.Fatalf("unsupported error expected: %v", err)
+		return
+	}
+
+	key := objectKey(id)
+	if _, err := mock.UploadBytes(key, []byte("archived"), true); nil != err {
+		t.Fatalf("upload failed: %s", err)
+		return
+	}
+	repo.cloud = &archivedCloud{Cloud: mock, archived: map[string]bool{key: true}, restoring: map[string]int{}}
+
+	_, err := repo.downloadCloudObject(key)
+	var archivedErr *ObjectArchivedError
+	if !errors.Is(err, cloud.ErrObjectArchived) || !errors.As(err, &archivedErr) || id != archivedErr.ObjectID {
+		t.Fatalf("object archived error expected: %v", err)
+		return
+	}
+	if pending, pendingErr := repo.PendingRestores([]string{id}); nil != pendingErr || 1 != len(pending) {
+		t.Fatalf("object should be pending restore: %v", pendingErr)
+		return
+	}
+
+	if err = repo.RequestRestore([]string{id}, cloud.RestoreTierStandard); nil != err {
+		t.Fatalf("request restore failed: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = repo.WaitRestored(ctx, []string{id}, time.Millisecond); nil != err {
+		t.Fatalf("wait restored failed: %s", err)
+		return
+	}
+	if data, downloadErr := repo.downloadCloudData(key); nil != downloadErr || "archived" != string(data) {
+		t.Fatalf("restored object should be downloadable: %v", downloadErr)
+		return
+	}
+}
+
+// lockedCloud 模拟开启对象锁定的云端存储服务，记录每个对象的保留截止时间。
+type lockedCloud struct {
+	cloud.Cloud
+	days  int
+	until map[string]time.Time
+	lock  sync.Mutex
+}
+
+func (c *lockedCloud) ObjectLockDays() int {
+	return c.days
+}
+
+func (c *lockedCloud) ExtendObjectLocks(filePaths []string, until time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, filePath := range filePaths {
+		c.until[filePath] = until
+	}
+	return nil
+}
+
+func TestExtendObjectLocks(t *testing.T) {
+	clearTestdata(t)
+	repo, index := initIndex(t)
+
+	mock := cloud.NewMock(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "test", UserID: "0", RepoPath: repo.Path, AvailableSize: 1 << 30, LocalObjectPath: repo.store.ObjectPath}}, nil)
+	locked := &lockedCloud{Cloud: mock, days: 30, until: map[string]time.Time{}}
+	repo.cloud = locked
+	if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+		t.Fatalf("sync failed: %s", err)
+		return
+	}
+
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+		return
+	}
+	objectIDs := append(append([]string{}, index.Files...), repo.getChunks(files)...)
+	required := time.Now().AddDate(0, 0, locked.days)
+	for _, id := range objectIDs {
+		if until, ok := locked.until[objectKey(id)]; !ok || until.Before(required) {
+			t.Fatalf("object lock of [%s] should be extended", id)
+			return
+		}
+	}
+
+	// 保留截止时间已经足够的对象不会重复延长
+	locked.until = map[string]time.Time{}
+	if err = repo.extendObjectLocks(index, files); nil != err {
+		t.Fatalf("extend object locks failed: %s", err)
+		return
+	}
+	if 0 < len(locked.until) {
+		t.Fatalf("object locks should not be extended again, got [%d]", len(locked.until))
+		return
+	}
+
+	s3 := cloud.NewS3(&cloud.BaseCloud{Conf: &cloud.Conf{S3: &cloud.ConfS3{Bucket: "test", ObjectLockMode: "FOREVER", ObjectLockDays: 1}}}, nil)
+	if _, err = s3.UploadBytes(objectKey(index.Files[0]), []byte("data"), true); !errors.Is(err, cloud.ErrInvalidObjectLockMode) {
+		t.Fatalf("invalid object lock mode should be rejected: %v", err)
+		return
+	}
+}
+
+func TestLoadSyncFiles(t *testing.T) {
+	clearTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dataPath := filepath.Join(testTempPath, "load-sync-data")
+	if err = os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+		return
+	}
+	// 文件数超过 1024 时使用协程池加载
+	write := func(i int, content string) {
+		if err = os.WriteFile(filepath.Join(dataPath, strconv.Itoa(i)+".txt"), []byte(content), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+	}
+	for i := 0; i < 1100; i++ {
+		write(i, "file "+strconv.Itoa(i))
+	}
+	repo, err := NewRepo(dataPath, testRepoPath, testHistoryPath, testTempPath, deviceID, deviceName, deviceOS, aesKey, ignoreLines(), nil)
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	first, err := repo.Index("first", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+	updated := time.Now().Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		write(i, "changed "+strconv.Itoa(i))
+		if err = os.Chtimes(filepath.Join(dataPath, strconv.Itoa(i)+".txt"), updated, updated); nil != err {
+			t.Fatalf("chtimes failed: %s", err)
+			return
+		}
+	}
+	second, err := repo.Index("second", true, map[string]interface{}{})
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+		return
+	}
+
+	clearCache()
+	cloudLatestFiles, latestFiles, latestSyncFiles, err := repo.loadSyncFiles(second, first, &entity.Index{})
+	if nil != err {
+		t.Fatalf("load sync files failed: %s", err)
+		return
+	}
+
+	// 和逐个串行加载的结果一致
+	clearCache()
+	for _, c := range []struct {
+		index *entity.Index
+		files []*entity.File
+	}{{second, cloudLatestFiles}, {first, latestFiles}, {&entity.Index{}, latestSyncFiles}} {
+		if len(c.index.Files) != len(c.files) {
+			t.Fatalf("expected [%d] files, got [%d]", len(c.index.Files), len(c.files))
+			return
+		}
+		for i, fileID := range c.index.Files {
+			file, getErr := repo.store.GetFile(fileID)
+			if nil != getErr {
+				t.Fatalf("get file failed: %s", getErr)
+				return
+			}
+			if file.ID != c.files[i].ID || file.Path != c.files[i].Path || file.Updated != c.files[i].Updated {
+				t.Fatalf("file [%d] not match, expected [%s], got [%s]", i, file.Path, c.files[i].Path)
+				return
+			}
+		}
+	}
+
+	cache, err := newSyncFileCache(syncFileCacheSize)
+	if nil != err {
+		t.Fatalf("new sync file cache failed: %s", err)
+		return
+	}
+	defer cache.Close()
+	files, err := repo.getFilesCached(first.Files, cache)
+	if nil != err || len(first.Files) != len(files) {
+		t.Fatalf("get files cached failed: %v", err)
+		return
+	}
+	cache.Wait()
+	for _, file := range files {
+		if cached, ok := cache.Get(file.ID); !ok || cached.(*entity.File) != file {
+			t.Fatalf("decoded file [%s] should be cached", file.Path)
+			return
+		}
+	}
+	if cachedFiles, _ := repo.getFilesCached(first.Files, cache); files[0] != cachedFiles[0] {
+		t.Fatalf("cached file should be reused")
+		return
+	}
+}
+
+// newSyncTestDevice 用于创建使用本地云端存储服务 endpoint 的设备 device，数据文件夹和仓库文件夹位于测试结束后自动删除的临时文件夹中。
+func newSyncTestDevice(t *testing.T, endpoint, device string) (repo *Repo, dataPath string) {
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("kdf failed: %s", err)
+		return
+	}
+
+	dir := t.TempDir()
+	dataPath = filepath.Join(dir, "data")
+	for _, p := range []string{dataPath, filepath.Join(dir, "repo")} {
+		if err = os.MkdirAll(p, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+			return
+		}
+	}
+	repo, err = NewRepo(dataPath, filepath.Join(dir, "repo"), filepath.Join(dir, "history"), filepath.Join(dir, "temp"), device, device, deviceOS, aesKey, ignoreLines(), cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "test",
+		UserID:        "0",
+		AvailableSize: 1 << 30,
+		Local:         &cloud.ConfLocal{Endpoint: endpoint},
+	}}))
+	if nil != err {
+		t.Fatalf("new repo failed: %s", err)
+		return
+	}
+	return
+}
+
+func TestSyncKeepExcludedFile(t *testing.T) {
+	clearTestdata(t)
+
+	endpoint := t.TempDir()
+	repoA, dataA := newSyncTestDevice(t, endpoint, "excluded-a")
+	repoB, dataB := newSyncTestDevice(t, endpoint, "excluded-b")
+	repoA.SyncOptions = SyncOptions{MaxFileSize: 16}
+	repoB.SyncOptions = SyncOptions{MaxFileSize: 16}
+	indexSync := func(repo *Repo) {
+		if _, err := repo.Index("excluded", true, map[string]interface{}{}); nil != err {
+			t.Fatalf("index failed: %s", err)
+			return
+		}
+		if _, _, err := repo.Sync(map[string]interface{}{}); nil != err {
+			t.Fatalf("sync failed: %s", err)
+			return
+		}
+	}
+
+	small := []byte("small")
+	for name, content := range map[string][]byte{"a.txt": small, "b.txt": []byte("b")} {
+		if err := os.WriteFile(filepath.Join(dataA, name), content, 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+			return
+		}
+	}
+	indexSync(repoA)
+	if err := os.WriteFile(filepath.Join(dataB, "c.txt"), []byte("c"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	indexSync(repoB)
+	if data, err := os.ReadFile(filepath.Join(dataB, "a.txt")); nil != err || !bytes.Equal(small, data) {
+		t.Fatalf("a.txt should be synced: %v", err)
+		return
+	}
+
+	// 已经同步的文件变大超过上限后被过滤，不能被视为删除
+	large := bytes.Repeat([]byte("large"), 8)
+	if err := os.WriteFile(filepath.Join(dataA, "a.txt"), large, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dataA, "b.txt"), []byte("bb"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+		return
+	}
+	updated := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dataA, "b.txt"), updated, updated); nil != err {
+		t.Fatalf("change file time failed: %s", err)
+		return
+	}
+	indexSync(repoA)
+	latest, err := repoA.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+		return
+	}
+	files, err := repoA.GetFiles(latest)
+	if nil != err || 3 != len(files) {
+		t.Fatalf("excluded file should be kept in index: %v", err)
+		return
+	}
+
+	indexSync(repoB)
+	if data, readErr := os.ReadFile(filepath.Join(dataB, "a.txt")); nil != readErr || !bytes.Equal(small, data) {
+		t.Fatalf("excluded file should not be removed on peer: %v", readErr)
+		return
+	}
+	if data, readErr := os.ReadFile(filepath.Join(dataB, "b.txt")); nil != readErr || "bb" != string(data) {
+		t.Fatalf("b.txt should be synced: %v", readErr)
+		return
+	}
+
+	// 迁出时不覆盖被过滤的文件
+	if _, _, err = repoA.Checkout(latest.ID, map[string]interface{}{}); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+		return
+	}
+	if data, readErr := os.ReadFile(filepath.Join(dataA, "a.txt")); nil != readErr || !bytes.Equal(large, data) {
+		t.Fatalf("excluded file should not be overwritten by checkout: %v", readErr)
+		return
+	}
+}
@@ -0,0 +1,225 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// ctxSyncTemp 是本次同步临时文件夹在同步上下文 context 中的键。
+const ctxSyncTemp = "dejavuSyncTemp"
+
+// TempManager 管理同步使用的临时文件夹 TempPath/repo/sync。
+//
+// 每次同步使用以同步 ID 命名的独立子文件夹，同步结束后清理；同步中断遗留的子文件夹在下次打开仓库时清理。
+// 设置总大小上限后，新的同步开始时会从最旧的遗留子文件夹开始清理直到低于上限。
+type TempManager struct {
+	root    string          // 同步临时文件夹的路径
+	maxSize int64           // 总大小上限（字节），0 表示不限制
+	active  map[string]bool // 正在使用的子文件夹
+	lock    *sync.Mutex
+}
+
+var (
+	tempManagers     = map[string]*TempManager{} // 同步临时文件夹绝对路径到管理器的映射
+	tempManagersLock = sync.Mutex{}
+)
+
+// getTempManager 用于获取同步临时文件夹 root 的管理器，不存在时创建。
+//
+// 同一路径的所有 Repo 实例共享一个管理器，这样新创建的实例清理遗留子文件夹时不会删除其他实例正在使用的子文件夹。
+func getTempManager(root string) (ret *TempManager) {
+	key := root
+	if abs, err := filepath.Abs(root); nil == err {
+		key = abs
+	}
+
+	tempManagersLock.Lock()
+	defer tempManagersLock.Unlock()
+	ret = tempManagers[key]
+	if nil == ret {
+		ret = &TempManager{root: root, active: map[string]bool{}, lock: &sync.Mutex{}}
+		tempManagers[key] = ret
+	}
+	return
+}
+
+// SetMaxSize 用于设置临时文件夹的总大小上限（字节），0 表示不限制。
+func (tm *TempManager) SetMaxSize(size int64) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.maxSize = size
+}
+
+// Size 返回临时文件夹当前的总大小（字节）。
+func (tm *TempManager) Size() (ret int64) {
+	ret, _ = dirSize(tm.root)
+	return
+}
+
+// Clean 用于清理所有未在使用的子文件夹。
+func (tm *TempManager) Clean() {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	for _, entry := range tm.entries() {
+		tm.remove(entry.Name())
+	}
+}
+
+// acquire 用于为同步 syncID 分配子文件夹并返回其路径，子文件夹在 release 前不会被清理。
+func (tm *TempManager) acquire(syncID string) (ret string) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if !isTempName(syncID) || tm.active[syncID] {
+		syncID = util.RandHash()[:16]
+	}
+	tm.active[syncID] = true
+	tm.enforceMaxSize()
+	ret = filepath.Join(tm.root, syncID)
+	return
+}
+
+// release 用于释放并清理子文件夹 dir。
+func (tm *TempManager) release(dir string) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	name := filepath.Base(dir)
+	delete(tm.active, name)
+	tm.remove(name)
+}
+
+// enforceMaxSize 按修改时间从旧到新清理未在使用的子文件夹，直到总大小不超过上限。
+func (tm *TempManager) enforceMaxSize() {
+	if 1 > tm.maxSize {
+		return
+	}
+
+	total, _ := dirSize(tm.root)
+	if total <= tm.maxSize {
+		return
+	}
+
+	entries := tm.entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	for _, entry := range entries {
+		if total <= tm.maxSize {
+			break
+		}
+
+		size, _ := dirSize(filepath.Join(tm.root, entry.Name()))
+		if tm.remove(entry.Name()) {
+			total -= size
+		}
+	}
+	if total > tm.maxSize {
+		logging.LogWarnf("temp dir [%s] size [%d] exceeds max size [%d]", tm.root, total, tm.maxSize)
+	}
+}
+
+// entries 返回所有未在使用的子文件夹（包括旧版本直接在 root 下创建的 conflicts 等文件夹）。
+func (tm *TempManager) entries() (ret []os.FileInfo) {
+	dirEntries, err := os.ReadDir(tm.root)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogErrorf("read temp dir [%s] failed: %s", tm.root, err)
+		}
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		if tm.active[dirEntry.Name()] {
+			continue
+		}
+
+		info, infoErr := dirEntry.Info()
+		if nil != infoErr {
+			continue
+		}
+		ret = append(ret, info)
+	}
+	return
+}
+
+func (tm *TempManager) remove(name string) bool {
+	p := filepath.Join(tm.root, name)
+	if err := os.RemoveAll(p); nil != err {
+		logging.LogErrorf("remove temp dir [%s] failed: %s", p, err)
+		return false
+	}
+	return true
+}
+
+func isTempName(name string) bool {
+	return "" != name && "." != name && ".." != name && gulu.File.IsValidFilename(name)
+}
+
+func dirSize(dir string) (ret int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, walkErr error) error {
+		if nil != walkErr {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, infoErr := d.Info()
+		if nil != infoErr {
+			return nil
+		}
+		ret += info.Size()
+		return nil
+	})
+	return
+}
+
+// TempManager 返回仓库的同步临时文件夹管理器。
+func (repo *Repo) TempManager() *TempManager {
+	return repo.tempManager
+}
+
+// syncTemp 返回本次同步 kind 类临时文件（如 conflicts）使用的文件夹，首次调用时为本次同步分配子文件夹。
+func (repo *Repo) syncTemp(context map[string]interface{}, kind string) string {
+	dir, ok := context[ctxSyncTemp].(string)
+	if !ok {
+		syncID, _ := context[CtxSyncID].(string)
+		dir = repo.tempManager.acquire(syncID)
+		context[ctxSyncTemp] = dir
+	}
+	return filepath.Join(dir, kind)
+}
+
+// releaseSyncTemp 用于在同步结束时清理本次同步的临时文件夹。
+func (repo *Repo) releaseSyncTemp(context map[string]interface{}) {
+	if dir, ok := context[ctxSyncTemp].(string); ok {
+		repo.tempManager.release(dir)
+		delete(context, ctxSyncTemp)
+	}
+}
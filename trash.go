@@ -0,0 +1,198 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	trashDir        = "trash"             // 回收站文件夹，位于仓库根目录下
+	trashTimeLayout = "2006-01-02-150405" // 回收站批次文件夹名称中的时间格式
+)
+
+var (
+	ErrTrashNotFound     = errors.New("trash not found")     // 回收站中不存在指定的文件
+	ErrTrashTargetExists = errors.New("trash target exists") // 还原时数据文件夹中已经存在同名文件
+)
+
+// TrashEntry 描述了回收站中的一个文件。
+type TrashEntry struct {
+	Batch string `json:"batch"` // 所属批次，一次同步删除的文件属于同一个批次
+	Path  string `json:"path"`  // 文件路径
+	Time  int64  `json:"time"`  // 删除时间，毫秒时间戳
+}
+
+// SetTrashRetention 用于设置回收站的保留时长，大于 0 时同步删除的文件会移动到回收站而不是直接删除，默认不启用。
+//
+// 超过保留时长的文件会在下次同步删除文件时清理。
+func (repo *Repo) SetTrashRetention(retention time.Duration) {
+	repo.trashRetention = retention
+}
+
+// GetTrash 用于获取回收站中的文件列表，按删除时间倒序排列。
+func (repo *Repo) GetTrash() (ret []*TrashEntry, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	root := filepath.Join(repo.Path, trashDir)
+	batches, err := os.ReadDir(root)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	for _, batch := range batches {
+		trashed, ok := parseTrashBatch(batch.Name())
+		if !batch.IsDir() || !ok {
+			continue
+		}
+
+		batchPath := filepath.Join(root, batch.Name())
+		err = filepath.WalkDir(batchPath, func(p string, d fs.DirEntry, walkErr error) error {
+			if nil != walkErr {
+				return walkErr
+			}
+			if d.IsDir() {
+				return nil
+			}
+			localPath := "/" + filepath.ToSlash(strings.TrimPrefix(p, batchPath+string(os.PathSeparator)))
+			ret = append(ret, &TrashEntry{Batch: batch.Name(), Path: repo.originalPath(localPath), Time: trashed.UnixMilli()})
+			return nil
+		})
+		if nil != err {
+			return
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time > ret[j].Time })
+	return
+}
+
+// RestoreTrash 用于将回收站中批次 batch 下的文件 path 还原到数据文件夹中，数据文件夹中已经存在该文件时返回 ErrTrashTargetExists。
+//
+// 还原后需要重新索引才会被同步。
+func (repo *Repo) RestoreTrash(batch, path string) (err error) {
+	if err = repo.checkMutable(); nil != err {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, ok := parseTrashBatch(batch); !ok || strings.Contains(path, "..") {
+		err = ErrTrashNotFound
+		return
+	}
+
+	localPath := repo.localPath(path)
+	trashed := filepath.Join(repo.Path, trashDir, batch, filepath.FromSlash(localPath))
+	if !lexists(trashed) {
+		err = ErrTrashNotFound
+		return
+	}
+	target := repo.absPath(path)
+	if lexists(target) {
+		err = ErrTrashTargetExists
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); nil != err {
+		return
+	}
+	if err = filelock.Rename(trashed, target); nil != err {
+		logging.LogErrorf("restore trash [%s] failed: %s", path, err)
+		return
+	}
+	repo.recordCheckoutPath(&entity.File{Path: path}, repo.DataPath)
+	gulu.File.RemoveEmptyDirs(filepath.Join(repo.Path, trashDir, batch))
+	logging.LogInfof("restored trash [%s, %s]", batch, path)
+	return
+}
+
+// trashRemoved 用于将回滚日志 journal 中删除的文件从备份文件夹移动到回收站，没有移动到回收站的文件会随备份文件夹一起删除。
+func (repo *Repo) trashRemoved(journal *checkoutJournal) {
+	if 0 >= repo.trashRetention {
+		return
+	}
+	repo.purgeTrash()
+
+	batch := filepath.Join(repo.Path, trashDir, time.Now().Format(trashTimeLayout)+"-"+gulu.Rand.String(7))
+	count := 0
+	for _, entry := range journal.Entries {
+		if !entry.Remove || !entry.Existed {
+			continue
+		}
+
+		_, backup, _ := repo.checkoutJournalPaths(journal, entry)
+		trashed := filepath.Join(batch, entry.Path)
+		if err := os.MkdirAll(filepath.Dir(trashed), 0755); nil != err {
+			logging.LogErrorf("mkdir [%s] failed: %s", filepath.Dir(trashed), err)
+			return
+		}
+		if err := os.Rename(backup, trashed); nil != err {
+			logging.LogErrorf("move [%s] to trash failed: %s", entry.Path, err)
+			return
+		}
+		count++
+	}
+	if 0 < count {
+		logging.LogInfof("moved removed files [%d] to trash [%s]", count, batch)
+	}
+}
+
+// purgeTrash 用于清理回收站中超过保留时长的批次。
+func (repo *Repo) purgeTrash() {
+	root := filepath.Join(repo.Path, trashDir)
+	batches, err := os.ReadDir(root)
+	if nil != err {
+		return
+	}
+
+	for _, batch := range batches {
+		trashed, ok := parseTrashBatch(batch.Name())
+		if !ok || repo.trashRetention > time.Since(trashed) {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(root, batch.Name())); nil != err {
+			logging.LogWarnf("purge trash [%s] failed: %s", batch.Name(), err)
+			continue
+		}
+		logging.LogInfof("purged trash [%s]", batch.Name())
+	}
+}
+
+func parseTrashBatch(batch string) (ret time.Time, ok bool) {
+	if len(trashTimeLayout) > len(batch) || strings.ContainsAny(batch, `/\`) {
+		return
+	}
+	ret, err := time.ParseInLocation(trashTimeLayout, batch[:len(trashTimeLayout)], time.Local)
+	ok = nil == err
+	return
+}
@@ -0,0 +1,89 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"sort"
+	"strings"
+)
+
+// TreeEntry 描述了快照目录树中的一个文件或者文件夹。
+type TreeEntry struct {
+	Name    string `json:"name"`    // 文件名或者文件夹名
+	Path    string `json:"path"`    // 相对于数据文件夹的路径，如 /assets/foo.png
+	Size    int64  `json:"size"`    // 文件大小，文件夹为其下所有文件大小之和
+	IsDir   bool   `json:"isDir"`   // 是否是文件夹
+	FileID  string `json:"fileID"`  // 文件 ID，文件夹为空
+	Updated int64  `json:"updated"` // 最后更新时间，文件夹为其下文件的最大值
+}
+
+// ListIndexTree 用于列出索引 indexID 中文件夹 dir 下的直接子文件和子文件夹，不会迁出任何文件。
+//
+// dir 为相对于数据文件夹的路径，空字符串或者 / 表示根目录。返回结果中文件夹在前，同类按名称排序。
+func (repo *Repo) ListIndexTree(indexID, dir string) (ret []*TreeEntry, err error) {
+	index, err := repo.GetIndex(indexID)
+	if nil != err {
+		return
+	}
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+
+	prefix := cleanRelPath(dir)
+	if "/" != prefix {
+		prefix += "/"
+	}
+
+	entries := map[string]*TreeEntry{}
+	for _, file := range files {
+		p := cleanRelPath(file.Path)
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+
+		name, _, isDir := strings.Cut(p[len(prefix):], "/")
+		if "" == name {
+			continue
+		}
+
+		entry := entries[name]
+		if nil == entry {
+			entry = &TreeEntry{Name: name, Path: prefix + name, IsDir: isDir}
+			entries[name] = entry
+		}
+		entry.Size += file.Size
+		if entry.Updated < file.Updated {
+			entry.Updated = file.Updated
+		}
+		if !isDir {
+			entry.FileID = file.ID
+		}
+	}
+
+	ret = []*TreeEntry{}
+	for _, entry := range entries {
+		ret = append(ret, entry)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].IsDir != ret[j].IsDir {
+			return ret[i].IsDir
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return
+}
@@ -0,0 +1,71 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+// smallFileSize 描述了默认上传优先级中小文件的大小上限。
+const smallFileSize = 1024 * 1024
+
+// UploadPriority 用于计算待上传文件的优先级，值越小越先上传，优先级相同时按文件大小从小到大上传。
+//
+// 分块和文件对象都按照文件的上传顺序上传，同步中断时先上传的文件更可能已经完整上传到云端。
+type UploadPriority func(file *entity.File) int
+
+// DefaultUploadPriority 是默认的上传优先级：.sy 文档最先上传，其次是小于 1MB 的小文件，最后是资源文件等大文件。
+func DefaultUploadPriority(file *entity.File) int {
+	if ".sy" == strings.ToLower(path.Ext(file.Path)) {
+		return 0
+	}
+	if smallFileSize > file.Size {
+		return 1
+	}
+	return 2
+}
+
+// SetUploadPriority 用于设置上传文件的优先级，传入 nil 时使用 DefaultUploadPriority。
+func (repo *Repo) SetUploadPriority(priority UploadPriority) {
+	repo.uploadPriority = priority
+}
+
+// sortUploadFiles 用于按照上传优先级对待上传文件 files 排序。
+func (repo *Repo) sortUploadFiles(files []*entity.File) {
+	priority := repo.uploadPriority
+	if nil == priority {
+		priority = DefaultUploadPriority
+	}
+
+	priorities := make(map[*entity.File]int, len(files))
+	for _, file := range files {
+		priorities[file] = priority(file)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if priorities[files[i]] != priorities[files[j]] {
+			return priorities[files[i]] < priorities[files[j]]
+		}
+		if files[i].Size != files[j].Size {
+			return files[i].Size < files[j].Size
+		}
+		return files[i].Path < files[j].Path
+	})
+}
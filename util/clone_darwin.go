@@ -0,0 +1,34 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build darwin
+
+package util
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile 用于将文件 src 写时复制克隆为新文件 dst，仅 APFS 支持，不支持时返回 ErrCloneUnsupported。
+func CloneFile(src, dst string) (err error) {
+	err = unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) {
+		err = ErrCloneUnsupported
+	}
+	return
+}
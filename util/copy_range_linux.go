@@ -0,0 +1,47 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package util
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyRange 用于将文件 src 开头的 n 个字节复制到文件 dst 的 dstOff 处。
+//
+// 优先使用 copy_file_range 在内核中复制，Btrfs、XFS 等文件系统上会直接共享数据块，不支持时回退为普通读写。
+func CopyRange(dst *os.File, dstOff int64, src *os.File, n int64) (err error) {
+	srcOff := int64(0)
+	for srcOff < n {
+		var copied int
+		copied, err = unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, int(n-srcOff), 0)
+		if nil != err || 0 == copied {
+			break
+		}
+	}
+	if srcOff == n {
+		err = nil
+		return
+	}
+
+	_, err = io.Copy(io.NewOffsetWriter(dst, dstOff), io.NewSectionReader(src, srcOff, n-srcOff))
+	return
+}
@@ -0,0 +1,30 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package util
+
+import (
+	"io"
+	"os"
+)
+
+// CopyRange 用于将文件 src 开头的 n 个字节复制到文件 dst 的 dstOff 处。
+func CopyRange(dst *os.File, dstOff int64, src *os.File, n int64) (err error) {
+	_, err = io.Copy(io.NewOffsetWriter(dst, dstOff), io.NewSectionReader(src, 0, n))
+	return
+}
@@ -0,0 +1,43 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows && !wasm
+
+package util
+
+import "os"
+
+// SyncDirs 将 dirs 中文件夹的目录项落盘，保证新建或重命名到其中的文件在崩溃后仍然存在。
+func SyncDirs(dirs []string) (err error) {
+	for _, dir := range dirs {
+		f, openErr := os.Open(dir)
+		if nil != openErr {
+			err = openErr
+			return
+		}
+
+		err = f.Sync()
+		closeErr := f.Close()
+		if nil != err {
+			return
+		}
+		if nil != closeErr {
+			err = closeErr
+			return
+		}
+	}
+	return
+}
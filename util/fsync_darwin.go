@@ -0,0 +1,49 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SyncFiles 将 paths 中的文件内容落盘。macOS 和 iOS 上 fsync 和 sync 都不等待磁盘缓存写入介质，这里逐个文件使用 F_FULLFSYNC，文件系统不支持时回退为 fsync。
+func SyncFiles(paths []string) (err error) {
+	for _, p := range paths {
+		f, openErr := os.OpenFile(p, os.O_RDWR, 0644)
+		if nil != openErr {
+			err = openErr
+			return
+		}
+
+		_, err = unix.FcntlInt(f.Fd(), unix.F_FULLFSYNC, 0)
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL) {
+			err = f.Sync()
+		}
+		closeErr := f.Close()
+		if nil != err {
+			return
+		}
+		if nil != closeErr {
+			err = closeErr
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,24 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build windows || wasm
+
+package util
+
+// SyncDirs 将 dirs 中文件夹的目录项落盘。Windows 和 WASM 上无法打开文件夹进行 fsync，NTFS 会通过日志保证元数据一致，这里不做处理。
+func SyncDirs(dirs []string) (err error) {
+	return
+}
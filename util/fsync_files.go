@@ -0,0 +1,43 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux && !darwin
+
+package util
+
+import "os"
+
+// SyncFiles 将 paths 中的文件内容落盘，在所有文件写入完成后逐个 fsync。
+func SyncFiles(paths []string) (err error) {
+	for _, p := range paths {
+		f, openErr := os.OpenFile(p, os.O_RDWR, 0644)
+		if nil != openErr {
+			err = openErr
+			return
+		}
+
+		err = f.Sync()
+		closeErr := f.Close()
+		if nil != err {
+			return
+		}
+		if nil != closeErr {
+			err = closeErr
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,51 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SyncFiles 将 paths 中的文件内容落盘。Linux 上对每个文件系统只调用一次 syncfs，会等待该文件系统上的脏页全部写回，避免逐个文件 fsync。
+func SyncFiles(paths []string) (err error) {
+	synced := map[uint64]bool{}
+	for _, p := range paths {
+		f, openErr := os.Open(p)
+		if nil != openErr {
+			err = openErr
+			return
+		}
+
+		var stat unix.Stat_t
+		if err = unix.Fstat(int(f.Fd()), &stat); nil == err && !synced[uint64(stat.Dev)] {
+			if err = unix.Syncfs(int(f.Fd())); nil == err {
+				synced[uint64(stat.Dev)] = true
+			}
+		}
+		closeErr := f.Close()
+		if nil != err {
+			return
+		}
+		if nil != closeErr {
+			err = closeErr
+			return
+		}
+	}
+	return
+}
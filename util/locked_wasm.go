@@ -0,0 +1,27 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsFileLockedErr 用于判断 err 是否是文件被其他进程占用而无法删除或者重命名的错误。WASM 上没有 ETXTBSY，只判断 EBUSY。
+func IsFileLockedErr(err error) bool {
+	return errors.Is(err, syscall.EBUSY)
+}
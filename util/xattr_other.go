@@ -0,0 +1,29 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux && !darwin && !windows
+
+package util
+
+// ReadXattrs 用于读取文件 path 的扩展属性，当前平台不支持扩展属性。
+func ReadXattrs(path string) (ret map[string][]byte, err error) {
+	return
+}
+
+// WriteXattrs 用于将扩展属性 xattrs 写入文件 path，当前平台不支持扩展属性。
+func WriteXattrs(path string, xattrs map[string][]byte) (err error) {
+	return
+}
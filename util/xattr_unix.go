@@ -0,0 +1,86 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux || darwin
+
+package util
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadXattrs 用于读取文件 path 的扩展属性，符号链接不会被跟随。Linux 上仅读取 user 命名空间下的属性。
+func ReadXattrs(path string) (ret map[string][]byte, err error) {
+	size, err := unix.Llistxattr(path, nil)
+	if nil != err || 1 > size {
+		if unix.ENOTSUP == err {
+			err = nil
+		}
+		return
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); nil != err {
+		return
+	}
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if 1 > len(name) || !xattrSupported(string(name)) {
+			continue
+		}
+
+		var valueSize int
+		if valueSize, err = unix.Lgetxattr(path, string(name), nil); nil != err {
+			return
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(path, string(name), value); nil != err {
+			return
+		}
+		if nil == ret {
+			ret = map[string][]byte{}
+		}
+		ret[string(name)] = value[:valueSize]
+	}
+	return
+}
+
+// WriteXattrs 用于将扩展属性 xattrs 写入文件 path，当前平台不支持的属性会被跳过。
+func WriteXattrs(path string, xattrs map[string][]byte) (err error) {
+	for name, value := range xattrs {
+		if !xattrSupported(name) {
+			continue
+		}
+		if err = unix.Lsetxattr(path, name, value, 0); nil != err {
+			return
+		}
+	}
+	return
+}
+
+func xattrSupported(name string) bool {
+	if strings.HasPrefix(name, ADSXattrPrefix) {
+		return false
+	}
+	if "linux" == runtime.GOOS || "android" == runtime.GOOS {
+		return strings.HasPrefix(name, "user.")
+	}
+	return true
+}
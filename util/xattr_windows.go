@@ -0,0 +1,78 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build windows
+
+package util
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32             = syscall.NewLazyDLL("kernel32.dll")
+	procFindFirstStreamW = kernel32.NewProc("FindFirstStreamW")
+	procFindNextStreamW  = kernel32.NewProc("FindNextStreamW")
+)
+
+// win32FindStreamData 对应 WIN32_FIND_STREAM_DATA。
+type win32FindStreamData struct {
+	StreamSize int64
+	StreamName [syscall.MAX_PATH + 36]uint16
+}
+
+// ReadXattrs 用于读取文件 path 的 NTFS 备用数据流名称，名称以 ADSXattrPrefix 为前缀作为属性名，属性值为空。
+func ReadXattrs(path string) (ret map[string][]byte, err error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if nil != err {
+		return
+	}
+
+	data := &win32FindStreamData{}
+	handle, _, callErr := procFindFirstStreamW.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(data)), 0)
+	if syscall.InvalidHandle == syscall.Handle(handle) {
+		if syscall.ERROR_HANDLE_EOF == callErr {
+			// 没有任何数据流（比如文件夹）
+			return
+		}
+		err = callErr
+		return
+	}
+	defer syscall.FindClose(syscall.Handle(handle))
+
+	for {
+		// 数据流名称格式为 :name:$DATA，默认数据流为 ::$DATA
+		name := strings.TrimSuffix(strings.TrimPrefix(syscall.UTF16ToString(data.StreamName[:]), ":"), ":$DATA")
+		if "" != name {
+			if nil == ret {
+				ret = map[string][]byte{}
+			}
+			ret[ADSXattrPrefix+name] = nil
+		}
+
+		if ok, _, _ := procFindNextStreamW.Call(handle, uintptr(unsafe.Pointer(data))); 0 == ok {
+			break
+		}
+	}
+	return
+}
+
+// WriteXattrs 用于将扩展属性 xattrs 写入文件 path，Windows 上仅记录了备用数据流名称，所以不会写入。
+func WriteXattrs(path string, xattrs map[string][]byte) (err error) {
+	return
+}
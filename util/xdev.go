@@ -0,0 +1,29 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package util
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsCrossDeviceErr 用于判断 err 是否是因为源路径和目标路径不在同一个卷上而无法重命名的错误。
+func IsCrossDeviceErr(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,171 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/restic/chunker"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// RestoreVerifyReport 描述了试还原校验的结果。
+type RestoreVerifyReport struct {
+	IndexID  string                  `json:"indexID"`  // 校验的索引 ID
+	Total    int                     `json:"total"`    // 快照中的文件数
+	Verified int                     `json:"verified"` // 抽样还原并校验的文件数
+	Failures []*RestoreVerifyFailure `json:"failures"` // 还原失败或者还原结果和快照记录不一致的文件
+}
+
+// RestoreVerifyFailure 描述了试还原校验失败的一个文件。
+type RestoreVerifyFailure struct {
+	Path   string `json:"path"`   // 文件路径
+	FileID string `json:"fileID"` // 文件 ID
+	Reason string `json:"reason"` // 失败原因
+}
+
+// Healthy 用于判断抽样的文件是否都能正确还原。
+func (report *RestoreVerifyReport) Healthy() bool {
+	return 1 > len(report.Failures)
+}
+
+// VerifyRestore 用于将索引 indexID 对应快照中随机抽样的文件还原到临时文件夹中，并和快照记录的大小以及分块哈希比较，确认备份确实可以还原。
+//
+// sampleRate 为抽样比例，不在 (0, 1) 区间时还原全部文件，抽样时至少还原一个文件。还原不会修改数据文件夹和仓库，只读仓库也可以调用。
+func (repo *Repo) VerifyRestore(indexID string, sampleRate float64) (ret *RestoreVerifyReport, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	index, err := repo.store.GetIndex(indexID)
+	if nil != err {
+		return
+	}
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+
+	ret = &RestoreVerifyReport{IndexID: indexID, Total: len(files), Failures: []*RestoreVerifyFailure{}}
+	if 0 < sampleRate && 1 > sampleRate && 0 < len(files) {
+		files = slices.Clone(files)
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		files = files[:max(int(math.Ceil(float64(len(files))*sampleRate)), 1)]
+	}
+
+	dir, err := repo.verifyRestoreDir()
+	if nil != err {
+		return
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(dir); nil != removeErr {
+			logging.LogWarnf("remove verify restore dir [%s] failed: %s", dir, removeErr)
+		}
+	}()
+
+	for i, file := range files {
+		ret.Verified++
+		if reason := repo.verifyRestoreFile(file, dir, i+1, len(files)); "" != reason {
+			ret.Failures = append(ret.Failures, &RestoreVerifyFailure{Path: file.Path, FileID: file.ID, Reason: reason})
+		}
+	}
+	logging.LogInfof("verified restore of index [%s] [total=%d, verified=%d, failures=%d]", indexID, ret.Total, ret.Verified, len(ret.Failures))
+	return
+}
+
+// verifyRestoreDir 用于创建试还原使用的临时文件夹，只读仓库没有 TempPath 时使用系统临时文件夹。
+func (repo *Repo) verifyRestoreDir() (ret string, err error) {
+	root := os.TempDir()
+	if "" != repo.TempPath && "." != repo.TempPath {
+		root = filepath.Join(repo.TempPath, "repo", "verify")
+		if err = os.MkdirAll(root, 0755); nil != err {
+			return
+		}
+	}
+	ret, err = os.MkdirTemp(root, "restore-")
+	return
+}
+
+// verifyRestoreFile 用于将文件 file 还原到 dir 下并校验，校验通过时返回空字符串，否则返回失败原因。
+func (repo *Repo) verifyRestoreFile(file *entity.File, dir string, count, total int) (reason string) {
+	if err := repo.checkoutFile(file, dir, count, total, map[string]interface{}{}); nil != err {
+		return "restore failed: " + err.Error()
+	}
+
+	absPath := repo.checkoutAbsPath(dir, file.Path)
+	info, err := os.Lstat(absPath)
+	if nil != err {
+		return "stat failed: " + err.Error()
+	}
+	if 0 != info.Mode()&os.ModeSymlink {
+		if target, readErr := os.Readlink(absPath); nil != readErr || target != file.Symlink {
+			return "symlink target mismatch"
+		}
+		return
+	}
+	if "" == file.Symlink && info.Size() != file.Size {
+		return "size mismatch"
+	}
+
+	chunks, err := repo.hashFileChunks(absPath, info.Size())
+	if nil != err {
+		return "read failed: " + err.Error()
+	}
+	if !slices.Equal(chunks, file.Chunks) {
+		return "chunk hash mismatch"
+	}
+	return
+}
+
+// hashFileChunks 用于按照索引时相同的规则对文件 absPath 分块并返回分块哈希列表。
+func (repo *Repo) hashFileChunks(absPath string, size int64) (ret []string, err error) {
+	if chunker.MinSize > size {
+		var data []byte
+		if data, err = os.ReadFile(absPath); nil != err {
+			return
+		}
+		ret = append(ret, util.Hash(data))
+		return
+	}
+
+	f, err := os.Open(absPath)
+	if nil != err {
+		return
+	}
+	defer f.Close()
+
+	chnkr := chunker.NewWithBoundaries(f, repo.chunkPol, chunker.MinSize, chunker.MaxSize)
+	buf := make([]byte, chunker.MaxSize)
+	for {
+		chnk, chnkErr := chnkr.Next(buf)
+		if io.EOF == chnkErr {
+			break
+		}
+		if nil != chnkErr {
+			err = chnkErr
+			return
+		}
+		ret = append(ret, util.Hash(chnk.Data))
+	}
+	return
+}
@@ -0,0 +1,53 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// SetPreserveXattrs 用于设置是否在索引时记录数据文件的扩展属性（如 macOS 的 Finder 标签），并在迁出时还原，默认不启用。
+//
+// 扩展属性在文件内容或修改时间变化后索引时记录，仅修改扩展属性不会产生新的快照。Windows 上仅记录 NTFS 备用数据流的名称，迁出时不会还原。
+func (repo *Repo) SetPreserveXattrs(enabled bool) {
+	repo.xattrs = enabled
+}
+
+func (repo *Repo) captureXattrs(file *entity.File, absPath string) {
+	if !repo.xattrs || !repo.localData() {
+		return
+	}
+
+	xattrs, err := util.ReadXattrs(absPath)
+	if nil != err {
+		logging.LogWarnf("read xattrs of [%s] failed: %s", absPath, err)
+		return
+	}
+	file.Xattrs = xattrs
+}
+
+func (repo *Repo) restoreXattrs(file *entity.File, absPath string) {
+	if !repo.xattrs || 1 > len(file.Xattrs) {
+		return
+	}
+
+	if err := util.WriteXattrs(absPath, file.Xattrs); nil != err {
+		logging.LogWarnf("write xattrs of [%s] failed: %s", absPath, err)
+	}
+}